@@ -55,6 +55,10 @@ AVAILABLE_SCOPES = {
     "tokens:read": "View own API tokens",
     "tokens:write": "Create and revoke own tokens",
     
+    # Apps rendered from the templates (HEARTBEAT_TOKEN, REMOTE_CONFIG_TOKEN)
+    "heartbeats:write": "Report app instance heartbeats",
+    "config:read": "Fetch app remote configuration",
+    
     # Full access (admin only)
     "admin": "Full administrative access"
 }
@@ -0,0 +1,153 @@
+"""
+Render Attestations
+When the backend renders a Go template into a customer's repo it signs an
+attestation of that render: the customer, the app, the template and
+templates revision, and the digest of the files. The app is built with it
+and serves it on /.well-known/openluffy-attestation, so the control plane
+can check that a running workload really came from an OpenLuffy render
+rather than being deployed under a customer's name from elsewhere
+"""
+import hashlib
+import hmac
+import os
+import time
+from typing import Any, Dict, Mapping, Optional
+
+from fastapi import HTTPException, Depends
+from jose import JWTError, jwt
+from pydantic import BaseModel, Field
+from sqlalchemy.orm import Session
+
+from database import get_db, User
+from auth import get_current_user
+from auth_utils import JWT_SECRET_KEY
+from groups_api import user_can_access_customer
+from render_audit import output_digest
+
+
+# ============================================================================
+# SIGNING
+# ============================================================================
+#
+# An attestation is a JWT, HS256-signed with ATTESTATION_SIGNING_KEY:
+#
+#     {"iss": "openluffy", "typ": "render-attestation", "sub": "acme-corp",
+#      "iat": 1767225600, "app": "acme-app", "repo": "acme/acme-app",
+#      "template": "golang+postgres", "version": "0.1.0", "revision": "<commit>",
+#      "rendered_at": "2026-01-01T00:00:00Z", "variables_sha256": "...",
+#      "output_sha256": "..."}
+#
+# The provenance is the render record's (template_renderer.RECORD_PATH),
+# and output_sha256 the digest of the rendered files as the render audit
+# log keeps it, so a verified attestation leads to its audit entry. It is
+# written into the repo as ATTESTATION_PATH, which the Go templates'
+# Dockerfile and Makefile stamp into the binary.
+#
+# Without ATTESTATION_SIGNING_KEY the key is derived from JWT_SECRET_KEY,
+# never the same, so an attestation is not a session token. Attestations
+# do not expire: they say where a build came from, which stays true. They
+# are not credentials either; an app serves its own to anyone who asks, so
+# a verifier checks the claims against where it found the workload.
+
+ATTESTATION_PATH = ".openluffy.attestation"
+ATTESTATION_ISSUER = "openluffy"
+ATTESTATION_TYPE = "render-attestation"
+ATTESTATION_ALGORITHM = "HS256"
+
+
+def attestation_key() -> str:
+    """ATTESTATION_SIGNING_KEY, or a key derived from JWT_SECRET_KEY"""
+    key = os.getenv("ATTESTATION_SIGNING_KEY")
+    if key:
+        return key
+    return hmac.new(JWT_SECRET_KEY.encode(), b"openluffy render attestation", hashlib.sha256).hexdigest()
+
+
+def attest_render(customer_id: str, github: Mapping[str, str], record: Mapping[str, Any],
+                  files: Mapping[str, str]) -> str:
+    """
+    Sign the attestation of a render into a customer repo
+
+    Args:
+        customer_id: Customer the repo belongs to
+        github: GitHub config with the org and repo rendered into
+        record: The render's record, as RECORD_PATH holds it
+        files: The rendered files, record included
+
+    Returns:
+        The attestation, as ATTESTATION_PATH holds it, without a newline
+    """
+    claims = {
+        "iss": ATTESTATION_ISSUER,
+        "typ": ATTESTATION_TYPE,
+        "sub": customer_id,
+        "iat": int(time.time()),
+        "app": record.get("variables", {}).get("APP_NAME") or github["repo"],
+        "repo": f"{github['org']}/{github['repo']}",
+    }
+    for field in ("template", "version", "revision", "rendered_at", "variables_sha256"):
+        if record.get(field):
+            claims[field] = record[field]
+    claims["output_sha256"] = output_digest(files)
+    return jwt.encode(claims, attestation_key(), algorithm=ATTESTATION_ALGORITHM)
+
+
+def verify_attestation(token: str) -> Dict[str, Any]:
+    """
+    The claims of an attestation this backend signed
+
+    Raises:
+        ValueError: if the signature does not verify or it is not an
+            attestation
+    """
+    try:
+        claims = jwt.decode(token, attestation_key(), algorithms=[ATTESTATION_ALGORITHM],
+                            issuer=ATTESTATION_ISSUER, options={"verify_aud": False})
+    except JWTError as e:
+        raise ValueError(str(e))
+    if claims.get("typ") != ATTESTATION_TYPE or not claims.get("sub"):
+        raise ValueError("not a render attestation")
+    return claims
+
+
+# ============================================================================
+# REQUEST MODELS
+# ============================================================================
+
+class VerifyAttestationRequest(BaseModel):
+    """An attestation, as an app serves it on /.well-known/openluffy-attestation"""
+    token: str = Field(..., min_length=1, max_length=8192)
+    customer_id: Optional[str] = Field(None, max_length=100)
+    app: Optional[str] = Field(None, max_length=63)
+
+
+# ============================================================================
+# API ENDPOINTS
+# ============================================================================
+
+def verify_render_attestation(
+    request: VerifyAttestationRequest,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(get_current_user)
+):
+    """
+    Verify a workload's render attestation
+
+    POST /api/v1/attestations/verify
+
+    Body: {token, customer_id?, app?}. customer_id and app, when given, are
+    what the caller found the workload running as, and must match the
+    claims. Answers valid false with the reason for a token that does not
+    verify or match; the user must have access to the customer it names
+    """
+    try:
+        claims = verify_attestation(request.token)
+    except ValueError as e:
+        return {"valid": False, "reason": f"attestation does not verify: {e}"}
+    if not user_can_access_customer(db, current_user, claims["sub"]):
+        raise HTTPException(status_code=403, detail="No access to this customer")
+    if request.customer_id and request.customer_id != claims["sub"]:
+        return {"valid": False, "reason": f"attested for customer {claims['sub']}, not {request.customer_id}"}
+    if request.app and request.app != claims.get("app"):
+        return {"valid": False, "reason": f"attested for app {claims.get('app')}, not {request.app}"}
+    return {"valid": True, "customer_id": claims["sub"], "claims": claims}
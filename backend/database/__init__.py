@@ -6,7 +6,7 @@ from .models import (
     Base, Customer, Integration, ProvisioningStep, 
     User, UserSession, AuditLog,
     Group, UserGroup, GroupCustomerAccess, UserCustomerAccess,
-    APIToken
+    APIToken, AppHeartbeat, AppConfig
 )
 
 __all__ = [
@@ -27,5 +27,7 @@ __all__ = [
     'UserGroup',
     'GroupCustomerAccess',
     'UserCustomerAccess',
-    'APIToken'
+    'APIToken',
+    'AppHeartbeat',
+    'AppConfig'
 ]
@@ -1,7 +1,7 @@
 """
 Database models for OpenLuffy
 """
-from sqlalchemy import Column, String, Integer, DateTime, Text, JSON, Boolean, ForeignKey
+from sqlalchemy import Column, String, Integer, DateTime, Text, JSON, Boolean, ForeignKey, UniqueConstraint
 from sqlalchemy.ext.declarative import declarative_base
 from sqlalchemy.orm import relationship
 from datetime import datetime
@@ -19,6 +19,10 @@ class Customer(Base):
     github_repo = Column(String(200))  # org/repo
     project_type = Column(String(50), default='customer-project', nullable=False)  # control-plane or customer-project
     created_from_env = Column(String(20), default='dev', nullable=False)  # Which OpenLuffy env created this customer
+    template_version = Column(String(20))  # Version of the app template the repo was last rendered from
+    plan_tier = Column(String(50))  # e.g. free, team, enterprise
+    region = Column(String(50))  # Where the customer's apps run, e.g. eu-west-1
+    support_email = Column(String(200))  # Where the customer's users get help
     created_at = Column(DateTime, default=datetime.utcnow)
     updated_at = Column(DateTime, default=datetime.utcnow, onupdate=datetime.utcnow)
     
@@ -34,6 +38,10 @@ class Customer(Base):
             'github_repo': self.github_repo,
             'project_type': self.project_type,
             'created_from_env': self.created_from_env,
+            'template_version': self.template_version,
+            'plan_tier': self.plan_tier,
+            'region': self.region,
+            'support_email': self.support_email,
             'created_at': self.created_at.isoformat() if self.created_at else None,
             'updated_at': self.updated_at.isoformat() if self.updated_at else None
         }
@@ -346,3 +354,96 @@ class APIToken(Base):
         if include_hash:
             data['token_hash'] = self.token_hash
         return data
+
+
+# ============================================================================
+# APP HEARTBEATS
+# ============================================================================
+
+class AppHeartbeat(Base):
+    """Last heartbeat of one instance of a customer's app"""
+    __tablename__ = 'app_heartbeats'
+    __table_args__ = (
+        UniqueConstraint('customer_id', 'app', 'environment', 'instance', name='uq_app_heartbeats_instance'),
+    )
+    
+    id = Column(Integer, primary_key=True, autoincrement=True)
+    customer_id = Column(String(100), ForeignKey('customers.id'), nullable=False, index=True)
+    
+    # Instance identification
+    app = Column(String(63), nullable=False)
+    environment = Column(String(63), nullable=False)
+    instance = Column(String(253), nullable=False)  # Pod name, or host name outside Kubernetes
+    
+    # As last reported
+    version = Column(String(100))  # Git SHA of the build
+    build_time = Column(String(50))
+    template_version = Column(String(50))
+    status = Column(String(20), nullable=False)  # ready, starting, not ready, shutting down, stopped
+    failing = Column(JSON)  # {"postgres": "connection refused"}
+    started_at = Column(DateTime)
+    uptime_seconds = Column(Integer)
+    interval_seconds = Column(Integer, nullable=False)
+    
+    # Metadata
+    first_seen = Column(DateTime, default=datetime.utcnow)
+    last_seen = Column(DateTime, default=datetime.utcnow, index=True)
+    
+    # Relationships
+    customer = relationship("Customer")
+    
+    def to_dict(self):
+        return {
+            'customer_id': self.customer_id,
+            'app': self.app,
+            'environment': self.environment,
+            'instance': self.instance,
+            'version': self.version,
+            'build_time': self.build_time,
+            'template_version': self.template_version,
+            'status': self.status,
+            'failing': self.failing or {},
+            'started_at': self.started_at.isoformat() if self.started_at else None,
+            'uptime_seconds': self.uptime_seconds,
+            'interval_seconds': self.interval_seconds,
+            'first_seen': self.first_seen.isoformat() if self.first_seen else None,
+            'last_seen': self.last_seen.isoformat() if self.last_seen else None
+        }
+
+
+# ============================================================================
+# APP REMOTE CONFIGURATION
+# ============================================================================
+
+class AppConfig(Base):
+    """Settings the control plane serves a customer's app at REMOTE_CONFIG_URL"""
+    __tablename__ = 'app_configs'
+    __table_args__ = (
+        UniqueConstraint('customer_id', 'app', 'environment', name='uq_app_configs_document'),
+    )
+    
+    id = Column(Integer, primary_key=True, autoincrement=True)
+    customer_id = Column(String(100), ForeignKey('customers.id'), nullable=False, index=True)
+    app = Column(String(63), nullable=False)
+    environment = Column(String(63), nullable=False)  # "default" applies to every environment
+    
+    settings = Column(JSON, nullable=False)  # {"LOG_LEVEL": "debug", "RATE_LIMIT_RPS": 50}
+    revision = Column(Integer, default=1, nullable=False)
+    
+    # Metadata
+    updated_at = Column(DateTime, default=datetime.utcnow)
+    updated_by = Column(Integer, ForeignKey('users.id'), nullable=True)
+    
+    # Relationships
+    customer = relationship("Customer")
+    
+    def to_dict(self):
+        return {
+            'customer_id': self.customer_id,
+            'app': self.app,
+            'environment': self.environment,
+            'settings': self.settings,
+            'revision': self.revision,
+            'updated_at': self.updated_at.isoformat() if self.updated_at else None,
+            'updated_by': self.updated_by
+        }
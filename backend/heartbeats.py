@@ -0,0 +1,183 @@
+"""
+App Heartbeats
+Apps rendered with the heartbeat mixin report every replica to the control
+plane each HEARTBEAT_INTERVAL: version, uptime, readiness and template
+version. The last heartbeat of each instance is kept, so a customer's apps
+can be listed with what is running where and which instances went quiet
+"""
+from datetime import datetime, timedelta
+from typing import Dict, List, Optional
+
+from fastapi import HTTPException, Depends
+from pydantic import BaseModel, Field
+from sqlalchemy.orm import Session
+
+from database import get_db, User, Customer, AppHeartbeat
+from auth import get_current_user
+from api_tokens import require_scope
+from groups_api import user_can_access_customer
+
+
+# An instance is stale once it has missed this many heartbeats in a row
+STALE_INTERVALS = 3
+
+# Instances not heard from for this long are forgotten, as pods replaced
+# by a deploy or a scale-down never report again
+HEARTBEAT_RETENTION = timedelta(days=7)
+
+STATUSES = ("ready", "starting", "not ready", "shutting down", "stopped")
+
+
+# ============================================================================
+# REQUEST MODELS
+# ============================================================================
+
+class HeartbeatRequest(BaseModel):
+    """One heartbeat, as the mixin's heartbeat.go sends it"""
+    customer_id: str = Field(..., min_length=1, max_length=100)
+    app: str = Field(..., min_length=1, max_length=63)
+    environment: str = Field(..., min_length=1, max_length=63)
+    instance: str = Field(..., min_length=1, max_length=253)
+    version: str = Field("", max_length=100)
+    build_time: Optional[str] = Field(None, max_length=50)
+    template_version: str = Field("", max_length=50)
+    started_at: Optional[datetime] = None
+    uptime_seconds: int = Field(0, ge=0)
+    status: str = Field(..., pattern="^(" + "|".join(STATUSES) + ")$")
+    failing: Dict[str, str] = Field(default_factory=dict, max_length=50)
+    interval_seconds: int = Field(..., ge=1, le=86400)
+
+
+# ============================================================================
+# STATE
+# ============================================================================
+
+def instance_state(hb: AppHeartbeat, now: datetime) -> str:
+    """live, stale (missed STALE_INTERVALS heartbeats) or stopped"""
+    if hb.status == "stopped":
+        return "stopped"
+    if now - hb.last_seen > timedelta(seconds=STALE_INTERVALS * hb.interval_seconds):
+        return "stale"
+    return "live"
+
+
+def summarize(heartbeats: List[AppHeartbeat], now: datetime) -> List[dict]:
+    """
+    Group instances by app and environment, each group with its last
+    heartbeat, live instance count and versions running
+    """
+    apps: Dict[tuple, dict] = {}
+    for hb in heartbeats:
+        entry = dict(hb.to_dict(), state=instance_state(hb, now))
+        group = apps.setdefault((hb.app, hb.environment), {
+            "app": hb.app,
+            "environment": hb.environment,
+            "last_seen": entry["last_seen"],
+            "live": 0,
+            "ready": 0,
+            "versions": [],
+            "instances": [],
+        })
+        group["last_seen"] = max(group["last_seen"], entry["last_seen"])
+        if entry["state"] == "live":
+            group["live"] += 1
+            group["ready"] += hb.status == "ready"
+            if hb.version not in group["versions"]:
+                group["versions"].append(hb.version)
+        group["instances"].append(entry)
+    return [apps[key] for key in sorted(apps)]
+
+
+# ============================================================================
+# API ENDPOINTS
+# ============================================================================
+
+def record_heartbeat(
+    request: HeartbeatRequest,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(require_scope("heartbeats:write"))
+):
+    """
+    Record an app instance's heartbeat
+
+    POST /api/v1/heartbeats
+
+    Authenticated with an API token with the heartbeats:write scope, whose
+    user must have access to the customer
+    """
+    customer = db.query(Customer).filter(Customer.id == request.customer_id).first()
+    if not customer:
+        raise HTTPException(status_code=404, detail="Customer not found")
+    if not user_can_access_customer(db, current_user, request.customer_id):
+        raise HTTPException(status_code=403, detail="No access to this customer")
+
+    now = datetime.utcnow()
+    hb = db.query(AppHeartbeat).filter(
+        AppHeartbeat.customer_id == request.customer_id,
+        AppHeartbeat.app == request.app,
+        AppHeartbeat.environment == request.environment,
+        AppHeartbeat.instance == request.instance
+    ).first()
+    if not hb:
+        hb = AppHeartbeat(
+            customer_id=request.customer_id,
+            app=request.app,
+            environment=request.environment,
+            instance=request.instance,
+            first_seen=now
+        )
+        db.add(hb)
+    hb.version = request.version
+    hb.build_time = request.build_time
+    hb.template_version = request.template_version
+    hb.status = request.status
+    hb.failing = request.failing
+    hb.started_at = request.started_at.replace(tzinfo=None) if request.started_at else None
+    hb.uptime_seconds = request.uptime_seconds
+    hb.interval_seconds = request.interval_seconds
+    hb.last_seen = now
+
+    db.query(AppHeartbeat).filter(
+        AppHeartbeat.customer_id == request.customer_id,
+        AppHeartbeat.app == request.app,
+        AppHeartbeat.last_seen < now - HEARTBEAT_RETENTION
+    ).delete(synchronize_session=False)
+    db.commit()
+
+    return {"recorded": True, "last_seen": now.isoformat()}
+
+
+def list_customer_heartbeats(
+    customer_id: str,
+    app: Optional[str] = None,
+    environment: Optional[str] = None,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(get_current_user)
+):
+    """
+    List a customer's apps with the last heartbeat of each instance
+
+    GET /api/v1/customers/{customer_id}/heartbeats
+
+    Query params: app and environment. Each instance is live, stale (it
+    missed STALE_INTERVALS heartbeats) or stopped (it reported shutting
+    down); live and ready count only live instances
+    """
+    customer = db.query(Customer).filter(Customer.id == customer_id).first()
+    if not customer:
+        raise HTTPException(status_code=404, detail="Customer not found")
+    if not user_can_access_customer(db, current_user, customer_id):
+        raise HTTPException(status_code=403, detail="No access to this customer")
+
+    query = db.query(AppHeartbeat).filter(AppHeartbeat.customer_id == customer_id)
+    if app:
+        query = query.filter(AppHeartbeat.app == app)
+    if environment:
+        query = query.filter(AppHeartbeat.environment == environment)
+    heartbeats = query.order_by(AppHeartbeat.app, AppHeartbeat.environment, AppHeartbeat.instance).all()
+
+    return {
+        "customer_id": customer_id,
+        "stale_after_intervals": STALE_INTERVALS,
+        "apps": summarize(heartbeats, datetime.utcnow())
+    }
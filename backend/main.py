@@ -1,5 +1,5 @@
 from fastapi import FastAPI, HTTPException, Request, Depends
-from fastapi.responses import JSONResponse
+from fastapi.responses import JSONResponse, Response
 from fastapi.middleware.cors import CORSMiddleware
 from kubernetes import client, config
 from kubernetes.client.rest import ApiException
@@ -7,8 +7,11 @@ from pydantic import BaseModel
 from typing import Dict, Any, Optional, List
 from sqlalchemy.orm import Session
 import os
+import io
 import httpx
 import json
+import tarfile
+import time
 from pathlib import Path
 from datetime import datetime
 from triage import triage_engine
@@ -36,7 +39,17 @@ from deployment_actions import (
     restart_application, get_sync_status,
     DeployRequest, RollbackRequest, ScaleRequest, ActionResponse
 )
+from render_audit import list_renders, get_render, record_render, request_user_id
+from heartbeats import record_heartbeat, list_customer_heartbeats
+from remote_config import (
+    get_app_config, list_app_config_documents, put_app_config_document, delete_app_config_document
+)
+from attestation import ATTESTATION_PATH, attest_render, verify_render_attestation
 import projects_api
+from template_renderer import (
+    list_manifests, list_mixins, load_manifest, in_catalog, resolve_variables, render_files, parse_template_ref,
+    check_pin, TemplateRenderError, TemplateVariableError, TemplateVersionError, RECORD_PATH
+)
 
 app = FastAPI(title="openluffy")
 
@@ -76,6 +89,23 @@ app.add_api_route("/api/v1/customers/{customer_id}/danger-zone/delete-permanent"
 app.add_api_route("/api/v1/customers/{customer_id}/danger-zone/transfer-ownership", transfer_customer_ownership, methods=["POST"], tags=["danger-zone"])
 app.add_api_route("/api/v1/customers/{customer_id}/danger-zone/revoke-tokens", revoke_all_customer_tokens, methods=["POST"], tags=["danger-zone"])
 
+# Render audit routes (every template render, who asked and what it produced)
+app.add_api_route("/api/v1/audit/renders", list_renders, methods=["GET"], tags=["audit"])
+app.add_api_route("/api/v1/audit/renders/{render_id}", get_render, methods=["GET"], tags=["audit"])
+
+# App heartbeat routes (instances of apps rendered with the heartbeat mixin)
+app.add_api_route("/api/v1/heartbeats", record_heartbeat, methods=["POST"], tags=["heartbeats"], status_code=202)
+app.add_api_route("/api/v1/customers/{customer_id}/heartbeats", list_customer_heartbeats, methods=["GET"], tags=["heartbeats"])
+
+# App remote configuration routes (the settings apps fetch from REMOTE_CONFIG_URL)
+app.add_api_route("/api/v1/customers/{customer_id}/apps/{app}/config", get_app_config, methods=["GET"], tags=["app-config"])
+app.add_api_route("/api/v1/customers/{customer_id}/apps/{app}/config/documents", list_app_config_documents, methods=["GET"], tags=["app-config"])
+app.add_api_route("/api/v1/customers/{customer_id}/apps/{app}/config/documents/{environment}", put_app_config_document, methods=["PUT"], tags=["app-config"])
+app.add_api_route("/api/v1/customers/{customer_id}/apps/{app}/config/documents/{environment}", delete_app_config_document, methods=["DELETE"], tags=["app-config"])
+
+# Render attestation routes (the signed provenance Go apps serve)
+app.add_api_route("/api/v1/attestations/verify", verify_render_attestation, methods=["POST"], tags=["attestations"])
+
 # Deployment action routes (deploy, rollback, scale, restart)
 app.add_api_route(
     "/api/v1/deployments/{deployment_id}/deploy",
@@ -196,6 +226,10 @@ async def startup_event():
                         try:
                             from database.migrations.add_created_from_env import run_migration
                             run_migration()
+                            from database.migrations.add_template_version import run_migration
+                            run_migration()
+                            from database.migrations.add_customer_profile import run_migration
+                            run_migration()
                         except Exception as migration_error:
                             print(f"⚠️  Migration warning: {migration_error}")
                     
@@ -770,7 +804,276 @@ def delete_customer_integration(customer_id: str, integration_type: str, db: Ses
     
     return {'success': True, 'message': f'{integration_type} integration removed'}
 
-def initialize_customer_repo(customer_id: str, customer_name: str, stack: str, github: dict) -> dict:
+@app.get("/api/templates")
+async def list_templates():
+    """
+    List the application templates a customer can be created from
+    
+    Each entry is the template's manifest: name, language, description,
+    version and the variables it takes, so the UI and CLI can build their
+    forms from the catalog instead of hardcoding stacks. A template's spec,
+    if it has one, is the endpoints and settings it shares with the same
+    service in other languages (golang, nodejs and python). mixins lists the
+    optional features a Go template can be rendered with, as in the stack
+    golang+postgres, and the templates each composes with.
+    """
+    return {'templates': list_manifests(), 'mixins': list_mixins()}
+
+@app.post("/api/templates/{ref}/render")
+async def preview_template(ref: str, request: Request):
+    """
+    Render a template without creating or pushing anything
+    
+    ref is the template name, or name@version to check a pin, e.g.
+    golang@0.1.0. Expects:
+    {
+        "variables": {
+            "CUSTOMER_ID": "acme-corp",
+            "CUSTOMER_NAME": "Acme Corp",
+            "GITHUB_OWNER": "lebrick07",
+            "REPO_NAME": "acme-corp-api",
+            "PORT": "9090"  // any other variable overrides its default
+        }
+    }
+    
+    APP_NAME, NAMESPACE and TEMPLATE_VERSION are derived as they are for
+    a new customer unless given, so the files returned, keyed by path in
+    the customer repo, are exactly what initialize_customer_repo pushes.
+    Invalid variables return 400 with every problem, like /customers/create.
+    """
+    rendered = await render_template_request(ref, request, 'preview')
+    if isinstance(rendered, JSONResponse):
+        return rendered
+    manifest, resolved, files = rendered
+    
+    return {
+        'template': {'name': manifest['name'], 'version': manifest['version']},
+        'variables': resolved,
+        'files': files
+    }
+
+@app.post("/api/templates/{ref}/archive")
+async def download_template(ref: str, request: Request):
+    """
+    Render a template into a .tar.gz of the whole project
+    
+    Takes the same body as /api/templates/{ref}/render and renders the same
+    files, packed under one directory named after APP_NAME, so CI systems
+    can fetch and unpack a generated app in one step:
+    
+        curl -X POST -d '{"variables": {...}}' \\
+            https://openluffy.example.com/api/templates/golang/archive | tar xz
+    """
+    rendered = await render_template_request(ref, request, 'archive')
+    if isinstance(rendered, JSONResponse):
+        return rendered
+    manifest, resolved, files = rendered
+    
+    root = resolved['APP_NAME']
+    buf = io.BytesIO()
+    mtime = int(time.time())
+    with tarfile.open(fileobj=buf, mode='w:gz') as tar:
+        for path in sorted(files):
+            content = files[path].encode('utf-8')
+            info = tarfile.TarInfo(f'{root}/{path}')
+            info.size, info.mode, info.mtime = len(content), 0o644, mtime
+            tar.addfile(info, io.BytesIO(content))
+    
+    return Response(
+        content=buf.getvalue(),
+        media_type='application/gzip',
+        headers={
+            'Content-Disposition': f'attachment; filename="{root}.tar.gz"',
+            'X-Template': f"{manifest['name']}@{manifest['version']}",
+        },
+    )
+
+async def render_template_request(ref: str, request: Request, via: str):
+    """
+    Render the template of a preview or archive request, and audit-log
+    the render as via
+    
+    Returns the manifest, the resolved variables and the rendered files,
+    or the JSONResponse to answer with when the request is invalid.
+    """
+    try:
+        data = await request.json()
+    except ValueError:
+        data = {}
+    variables = data.get('variables') or {}
+    if not isinstance(variables, dict):
+        return JSONResponse(status_code=400, content={'error': 'variables must be an object'})
+    
+    try:
+        name, pinned_version = parse_template_ref(ref)
+        manifest = load_manifest(name)
+    except TemplateVersionError as e:
+        return JSONResponse(status_code=400, content={'error': str(e)})
+    if not manifest or not in_catalog(manifest):
+        return JSONResponse(status_code=404, content={'error': f'Unknown template: {name}'})
+    try:
+        check_pin(manifest, pinned_version)
+    except TemplateVersionError as e:
+        return JSONResponse(status_code=400, content={'error': str(e)})
+    
+    github = {'org': variables.get('GITHUB_OWNER'), 'repo': variables.get('REPO_NAME')}
+    values = template_values(manifest, variables.get('CUSTOMER_ID'), variables.get('CUSTOMER_NAME'), github)
+    values.update(variables)
+    try:
+        resolved = resolve_variables(manifest, values)
+    except TemplateVariableError as e:
+        return JSONResponse(status_code=400, content={
+            'error': 'Invalid template variables',
+            'problems': e.problems
+        })
+    try:
+        files = render_files(manifest, resolved)
+    except TemplateRenderError as e:
+        return JSONResponse(status_code=500, content={
+            'error': 'Template render failed',
+            'problems': e.problems
+        })
+    audit_render(via, manifest, resolved, files, await render_actor(request), resolved.get('CUSTOMER_ID'))
+    return manifest, resolved, files
+
+# Customer branding fields and the template variables they set. Only
+# templates with a landing page declare these; the others ignore branding.
+BRANDING_VARIABLES = {
+    'logo_url': 'BRAND_LOGO_URL',
+    'favicon_url': 'BRAND_FAVICON_URL',
+    'primary_color': 'BRAND_PRIMARY_COLOR',
+    'secondary_color': 'BRAND_SECONDARY_COLOR',
+    'tagline': 'BRAND_TAGLINE',
+    'theme': 'THEME',
+}
+
+# Customer record fields and the template variables every render fills in
+# from them. TEMPLATE_CUSTOMER_FIELDS allowlists, comma-separated, the
+# fields that may reach a customer's source; unset, all of them do, and
+# empty, none.
+CUSTOMER_VARIABLES = {
+    'name': 'CUSTOMER_NAME',
+    'plan_tier': 'CUSTOMER_PLAN',
+    'region': 'CUSTOMER_REGION',
+    'support_email': 'SUPPORT_EMAIL',
+}
+
+def injected_customer_fields() -> List[str]:
+    """Customer record fields TEMPLATE_CUSTOMER_FIELDS lets renders inject"""
+    allowed = os.getenv('TEMPLATE_CUSTOMER_FIELDS')
+    if allowed is None:
+        return list(CUSTOMER_VARIABLES)
+    fields = [field.strip() for field in allowed.split(',') if field.strip()]
+    for field in fields:
+        if field not in CUSTOMER_VARIABLES:
+            print(f"⚠️  TEMPLATE_CUSTOMER_FIELDS: {field!r} is not a customer field (one of {', '.join(CUSTOMER_VARIABLES)})")
+    return [field for field in fields if field in CUSTOMER_VARIABLES]
+
+def customer_profile(customer_id: Optional[str]) -> dict:
+    """The customer record's CUSTOMER_VARIABLES fields, empty if there is no record"""
+    if not db_available or not customer_id:
+        return {}
+    from database import SessionLocal
+    db = SessionLocal()
+    try:
+        customer = db.query(Customer).filter(Customer.id == customer_id).first()
+        return {field: getattr(customer, field) for field in CUSTOMER_VARIABLES} if customer else {}
+    except Exception as e:
+        print(f"⚠️  Failed to read customer profile for {customer_id}: {e}")
+        return {}
+    finally:
+        db.close()
+
+def template_values(manifest: dict, customer_id: str, customer_name: str, github: dict, branding: Optional[dict] = None,
+                    profile: Optional[dict] = None) -> dict:
+    """
+    Template variables supplied by the customer and their GitHub integration
+    
+    Everything else (port, probe paths, framework) comes from the defaults in
+    the stack's template manifest, as does any branding field not given.
+    The customer record's fields (see CUSTOMER_VARIABLES) are filled in
+    from profile, or from the database when it is not given, so callers
+    need not pass them; the record's name wins over customer_name.
+    With the heartbeat mixin, heartbeats go to OPENLUFFY_PUBLIC_URL, the
+    backend's address as the customer's cluster reaches it, when set.
+    """
+    values = {
+        'CUSTOMER_ID': customer_id,
+        'CUSTOMER_NAME': customer_name,
+        'GITHUB_OWNER': github.get('org'),
+        'REPO_NAME': github.get('repo'),
+        'APP_NAME': github.get('repo'),
+        'NAMESPACE': f"{customer_id}-dev" if customer_id else None,
+        'TEMPLATE_VERSION': manifest['version'],
+    }
+    declared = {var['name'] for var in manifest['variables']}
+    public_url = os.getenv('OPENLUFFY_PUBLIC_URL')
+    if public_url and 'HEARTBEAT_URL' in declared:
+        values['HEARTBEAT_URL'] = public_url.rstrip('/') + '/api/v1/heartbeats'
+    if profile is None:
+        profile = customer_profile(customer_id)
+    for field in injected_customer_fields():
+        if profile.get(field) and CUSTOMER_VARIABLES[field] in declared:
+            values[CUSTOMER_VARIABLES[field]] = profile[field]
+    for field, value in (branding or {}).items():
+        if BRANDING_VARIABLES[field] in declared:
+            values[BRANDING_VARIABLES[field]] = value
+    return values
+
+def branding_problems(branding) -> List[str]:
+    """Why a request's branding object is unusable; empty if it is fine"""
+    if not isinstance(branding, dict):
+        return ['branding must be an object']
+    return [f'{field}: not a branding field (one of {", ".join(BRANDING_VARIABLES)})'
+            for field in branding if field not in BRANDING_VARIABLES]
+
+def recorded_template_version(customer_id: str) -> Optional[str]:
+    """Template version the customer's repo was last rendered from, if known"""
+    if not db_available:
+        return None
+    from database import SessionLocal
+    db = SessionLocal()
+    try:
+        customer = db.query(Customer).filter(Customer.id == customer_id).first()
+        return customer.template_version if customer else None
+    except Exception as e:
+        print(f"⚠️  Failed to read template version for {customer_id}: {e}")
+        return None
+    finally:
+        db.close()
+
+def record_template_version(customer_id: str, version: str):
+    """Record the template version a customer's repo was rendered from"""
+    if not db_available:
+        return
+    from database import SessionLocal
+    db = SessionLocal()
+    try:
+        customer = db.query(Customer).filter(Customer.id == customer_id).first()
+        if customer:
+            customer.template_version = version
+            db.commit()
+    except Exception as e:
+        db.rollback()
+        print(f"⚠️  Failed to record template version for {customer_id}: {e}")
+    finally:
+        db.close()
+
+async def render_actor(request: Request) -> dict:
+    """Who a request renders for, as audit_render takes it"""
+    return {
+        'user_id': await request_user_id(request) if db_available else None,
+        'client': request.client.host if request.client else None,
+    }
+
+def audit_render(via: str, manifest: dict, variables: dict, files: dict, actor: Optional[dict] = None, customer_id: Optional[str] = None):
+    """Record a render in the audit log (see render_audit.py)"""
+    if not db_available:
+        return
+    record_render(via, manifest, variables, files, customer_id=customer_id, **(actor or {}))
+
+def initialize_customer_repo(customer_id: str, customer_name: str, stack: str, github: dict, pinned_version: Optional[str] = None, branding: Optional[dict] = None,
+                             via: str = 'create', actor: Optional[dict] = None, profile: Optional[dict] = None) -> dict:
     """
     Initialize a customer GitHub repo with CI/CD templates
     
@@ -781,9 +1084,15 @@ def initialize_customer_repo(customer_id: str, customer_name: str, stack: str, g
         customer_name: Display name (e.g., 'Acme Corp')
         stack: Tech stack (nodejs/python/golang)
         github: GitHub config dict with org, repo, token, branch
+        pinned_version: Template version the repo must stay compatible with
+        branding: Landing page branding (see BRANDING_VARIABLES)
+        via: What the render is audit-logged as: create or reinitialize
+        actor: Who requested it, from render_actor
+        profile: Customer record fields, as template_values takes them;
+            read from the database when not given
     
     Returns:
-        dict with templates_pushed list and message
+        dict with templates_pushed list, template name and version, and message
     """
     import subprocess
     import tempfile
@@ -793,94 +1102,43 @@ def initialize_customer_repo(customer_id: str, customer_name: str, stack: str, g
     result = {'templates_pushed': [], 'message': '', 'errors': []}
     
     try:
-        templates_dir = Path(__file__).parent / 'templates'
-        
-        # Map stack to template files (HELM CHART STRUCTURE - following OpenLuffy pattern)
-        stack_templates = {
-            'nodejs': {
-                '.github/workflows/ci.yaml': 'ci-nodejs.yaml',
-                '.github/workflows/release-dev.yaml': 'release-dev.yaml',
-                '.github/workflows/release-prod.yaml': 'release-prod.yaml',
-                'Dockerfile': 'Dockerfile-nodejs',
-                'index.js': 'app-nodejs.js',
-                'package.json': 'package.json',
-                '.gitignore': 'gitignore',
-                'README.md': 'README.md',
-                'helm/app/Chart.yaml': 'helm/Chart.yaml',
-                'helm/app/values.yaml': 'helm/values.yaml',
-                'helm/app/values/dev.yaml': 'helm/values-dev.yaml',
-                'helm/app/values/preprod.yaml': 'helm/values-preprod.yaml',
-                'helm/app/values/prod.yaml': 'helm/values-prod.yaml',
-                'helm/app/templates/_helpers.tpl': 'helm/templates/_helpers.tpl',
-                'helm/app/templates/deployment.yaml': 'helm/templates/deployment.yaml',
-                'helm/app/templates/service.yaml': 'helm/templates/service.yaml',
-                'helm/app/templates/ingress.yaml': 'helm/templates/ingress.yaml',
-            },
-            'python': {
-                '.github/workflows/ci.yaml': 'ci-python.yaml',
-                '.github/workflows/release-dev.yaml': 'release-dev.yaml',
-                '.github/workflows/release-prod.yaml': 'release-prod.yaml',
-                'Dockerfile': 'Dockerfile-python',
-                'app.py': 'app-python.py',
-                'requirements.txt': 'requirements.txt',
-                '.gitignore': 'gitignore',
-                'README.md': 'README.md',
-                'helm/app/Chart.yaml': 'helm/Chart.yaml',
-                'helm/app/values.yaml': 'helm/values.yaml',
-                'helm/app/values/dev.yaml': 'helm/values-dev.yaml',
-                'helm/app/values/preprod.yaml': 'helm/values-preprod.yaml',
-                'helm/app/values/prod.yaml': 'helm/values-prod.yaml',
-                'helm/app/templates/_helpers.tpl': 'helm/templates/_helpers.tpl',
-                'helm/app/templates/deployment.yaml': 'helm/templates/deployment.yaml',
-                'helm/app/templates/service.yaml': 'helm/templates/service.yaml',
-                'helm/app/templates/ingress.yaml': 'helm/templates/ingress.yaml',
-            },
-            'golang': {
-                '.github/workflows/ci.yaml': 'ci-golang.yaml',
-                '.github/workflows/release-dev.yaml': 'release-dev.yaml',
-                '.github/workflows/release-prod.yaml': 'release-prod.yaml',
-                'Dockerfile': 'Dockerfile-golang',
-                'main.go': 'app-golang.go',
-                'go.mod': 'go.mod',
-                '.gitignore': 'gitignore',
-                'README.md': 'README.md',
-                'helm/app/Chart.yaml': 'helm/Chart.yaml',
-                'helm/app/values.yaml': 'helm/values.yaml',
-                'helm/app/values/dev.yaml': 'helm/values-dev.yaml',
-                'helm/app/values/preprod.yaml': 'helm/values-preprod.yaml',
-                'helm/app/values/prod.yaml': 'helm/values-prod.yaml',
-                'helm/app/templates/_helpers.tpl': 'helm/templates/_helpers.tpl',
-                'helm/app/templates/deployment.yaml': 'helm/templates/deployment.yaml',
-                'helm/app/templates/service.yaml': 'helm/templates/service.yaml',
-                'helm/app/templates/ingress.yaml': 'helm/templates/ingress.yaml',
-            }
-        }
+        try:
+            manifest = load_manifest(stack)
+        except TemplateVersionError as e:
+            result['errors'].append(str(e))
+            return result
+        if not manifest or not in_catalog(manifest):
+            result['errors'].append(f'Unknown stack: {stack}')
+            return result
         
-        # Stack-specific instructions for README
-        stack_instructions = {
-            'nodejs': '''```bash
-npm install
-npm start
-```
-
-Visit: http://localhost:3000''',
-            'python': '''```bash
-pip install -r requirements.txt
-python main.py
-```
-
-Visit: http://localhost:8000''',
-            'go': '''```bash
-go mod download
-go run main.go
-```
-
-Visit: http://localhost:8080'''
-        }
+        try:
+            check_pin(manifest, pinned_version)
+        except TemplateVersionError as e:
+            result['errors'].append(str(e))
+            return result
+        result['template'] = {'name': stack, 'version': manifest['version']}
         
-        if stack not in stack_templates:
-            result['errors'].append(f'Unknown stack: {stack}')
+        values = template_values(manifest, customer_id, customer_name, github, branding, profile)
+        try:
+            variables = resolve_variables(manifest, values)
+        except TemplateVariableError as e:
+            result['errors'].extend(f'Invalid template variable {p}' for p in e.problems)
+            return result
+        
+        # Render every template before touching the repo, so a broken
+        # template never results in a half-initialized repository
+        try:
+            rendered = render_files(manifest, variables)
+        except TemplateRenderError as e:
+            result['errors'].extend(f'Template render failed: {p}' for p in e.problems)
             return result
+        audit_render(via, manifest, variables, rendered, actor, customer_id)
+        
+        # Go apps are built with a signed attestation of the render, which
+        # they serve for the control plane to verify (see attestation.py)
+        if manifest.get('language') == 'Go':
+            record = json.loads(rendered[RECORD_PATH])
+            rendered[ATTESTATION_PATH] = attest_render(customer_id, github, record, rendered) + '\n'
         
         # Clone repo to temp directory
         with tempfile.TemporaryDirectory() as tmpdir:
@@ -897,40 +1155,8 @@ Visit: http://localhost:8080'''
                     text=True
                 )
                 
-                # Process and write all template files
-                stack_info = {
-                    'nodejs': {'framework': 'Express.js', 'port': '3000'},
-                    'python': {'framework': 'FastAPI', 'port': '8000'},
-                    'golang': {'framework': 'net/http', 'port': '8080'},
-                }
-                
-                info = stack_info.get(stack, {'framework': 'Unknown', 'port': '8000'})
-                
-                for target_path, template_file in stack_templates[stack].items():
-                    template_path = templates_dir / template_file
-                    
-                    if not template_path.exists():
-                        result['errors'].append(f'Template not found: {template_file}')
-                        continue
-                    
-                    # Read and process template
-                    with open(template_path, 'r') as f:
-                        content = f.read()
-                    
-                    # Replace placeholders
-                    content = content.replace('{{CUSTOMER_ID}}', customer_id)
-                    content = content.replace('{{CUSTOMER_NAME}}', customer_name)
-                    content = content.replace('{{GITHUB_OWNER}}', github['org'])
-                    content = content.replace('{{REPO_NAME}}', github['repo'])
-                    content = content.replace('{{STACK}}', stack.title())
-                    content = content.replace('{{FRAMEWORK}}', info['framework'])
-                    content = content.replace('{{PORT}}', info['port'])
-                    content = content.replace('{{APP_NAME}}', github['repo'])
-                    content = content.replace('{{NAMESPACE}}', f"{customer_id}-dev")
-                    content = content.replace('{{ENVIRONMENT}}', 'development')
-                    content = content.replace('{{STACK_SETUP}}', stack_instructions.get(stack, ''))
-                    
-                    # Write file to repo
+                # Write the rendered files into the clone
+                for target_path, content in rendered.items():
                     file_path = repo_path / target_path
                     file_path.parent.mkdir(parents=True, exist_ok=True)
                     
@@ -1010,7 +1236,7 @@ async def create_customer(request: Request):
     {
         "name": "Acme Corp",
         "id": "acme-corp",
-        "stack": "nodejs",
+        "stack": "nodejs",  // or name@version to pin, e.g. golang@0.1.0; Go templates take mixins: golang+postgres@0.1.0
         "github": {
             "org": "lebrick07",
             "repo": "acme-corp-api",
@@ -1020,6 +1246,17 @@ async def create_customer(request: Request):
         "argocd": {
             "url": "http://argocd.local",
             "token": "xxx"
+        },
+        "plan_tier": "enterprise",  // optional customer profile, rendered as
+        "region": "eu-west-1",      // CUSTOMER_PLAN, CUSTOMER_REGION and
+        "support_email": "help@acme.example",  // SUPPORT_EMAIL
+        "branding": {  // optional, for templates with a landing page
+            "logo_url": "https://acme.example/logo.svg",
+            "favicon_url": "https://acme.example/favicon.ico",
+            "primary_color": "#0055ff",
+            "secondary_color": "#00aaff",
+            "tagline": "Building better rockets",
+            "theme": "corporate"  // gradient, minimal, dark, corporate or playful
         }
     }
     """
@@ -1028,9 +1265,11 @@ async def create_customer(request: Request):
         
         customer_name = data.get('name')
         customer_id = data.get('id')
-        stack = data.get('stack', 'nodejs')
+        stack_ref = data.get('stack', 'nodejs')
         github = data.get('github', {})
         argocd = data.get('argocd', {})
+        branding = data.get('branding') or {}
+        profile = {'name': customer_name, **{field: data.get(field) for field in ('plan_tier', 'region', 'support_email')}}
         
         if not customer_name or not customer_id:
             return JSONResponse(status_code=400, content={'error': 'Customer name and ID are required'})
@@ -1041,6 +1280,29 @@ async def create_customer(request: Request):
         if not argocd.get('url') or not argocd.get('token'):
             return JSONResponse(status_code=400, content={'error': 'ArgoCD integration is required'})
         
+        # Validate the template and its variables before creating anything
+        try:
+            stack, pinned_version = parse_template_ref(stack_ref)
+            manifest = load_manifest(stack)
+        except TemplateVersionError as e:
+            return JSONResponse(status_code=400, content={'error': str(e)})
+        if not manifest or not in_catalog(manifest):
+            return JSONResponse(status_code=400, content={'error': f'Unknown stack: {stack}'})
+        try:
+            check_pin(manifest, pinned_version)
+        except TemplateVersionError as e:
+            return JSONResponse(status_code=400, content={'error': str(e)})
+        problems = branding_problems(branding)
+        if problems:
+            return JSONResponse(status_code=400, content={'error': 'Invalid branding', 'problems': problems})
+        try:
+            resolve_variables(manifest, template_values(manifest, customer_id, customer_name, github, branding, profile))
+        except TemplateVariableError as e:
+            return JSONResponse(status_code=400, content={
+                'error': 'Invalid template variables',
+                'problems': e.problems
+            })
+        
         result = {
             'success': True,
             'customer_id': customer_id,
@@ -1107,7 +1369,10 @@ async def create_customer(request: Request):
                             id=customer_id,
                             name=customer_name,
                             stack=stack,
-                            created_from_env=current_env
+                            created_from_env=current_env,
+                            plan_tier=profile['plan_tier'],
+                            region=profile['region'],
+                            support_email=profile['support_email']
                         )
                         db.add(customer)
                         db.commit()
@@ -1317,8 +1582,11 @@ async def create_customer(request: Request):
             result['argocd']['message'] = 'K8s not available - ArgoCD apps not created'
         
         # Step 6: Push CI/CD templates to GitHub repo
-        template_result = initialize_customer_repo(customer_id, customer_name, stack, github)
+        template_result = initialize_customer_repo(customer_id, customer_name, stack, github, pinned_version, branding,
+                                                   actor=await render_actor(request), profile=profile)
         result['github'].update(template_result)
+        if not template_result['errors']:
+            record_template_version(customer_id, template_result['template']['version'])
         
         return result
         
@@ -1335,9 +1603,15 @@ async def reinitialize_customer_repo(customer_id: str, request: Request):
     - Updating templates after changes
     - Re-applying templates to existing repos
     
+    Re-rendering stays pinned to the template version the repo was last
+    rendered from: an incompatible template version is refused unless
+    "upgrade" is set.
+    
     Expects (optional):
     {
-        "stack": "nodejs"  // Override stack detection
+        "stack": "nodejs",  // Override stack detection
+        "upgrade": true,    // Render the current template version even if incompatible
+        "branding": {...}   // Landing page branding, as for /customers/create
     }
     """
     try:
@@ -1346,6 +1620,10 @@ async def reinitialize_customer_repo(customer_id: str, request: Request):
         # Get customer integrations
         github_config = None
         stack_override = data.get('stack')
+        branding = data.get('branding') or {}
+        problems = branding_problems(branding)
+        if problems:
+            return JSONResponse(status_code=400, content={'error': 'Invalid branding', 'problems': problems})
         
         # Try database first
         if db_available:
@@ -1382,16 +1660,30 @@ async def reinitialize_customer_repo(customer_id: str, request: Request):
             else:
                 stack = 'nodejs'  # Default
         
-        # Get customer name (try to find it)
+        # Without a customer record to take the name from (see
+        # template_values), derive one from the ID
         customer_name = customer_id.replace('-', ' ').title()
         
+        try:
+            stack, pinned_version = parse_template_ref(stack)
+        except TemplateVersionError as e:
+            return JSONResponse(status_code=400, content={'error': str(e)})
+        if not pinned_version and not data.get('upgrade'):
+            pinned_version = recorded_template_version(customer_id)
+        
         # Reinitialize repository
         result = initialize_customer_repo(
             customer_id=customer_id,
             customer_name=customer_name,
             stack=stack,
-            github=github_config
+            github=github_config,
+            pinned_version=pinned_version,
+            branding=branding,
+            via='reinitialize',
+            actor=await render_actor(request)
         )
+        if not result['errors']:
+            record_template_version(customer_id, result['template']['version'])
         
         return {
             'success': len(result['errors']) == 0,
@@ -0,0 +1,374 @@
+#!/usr/bin/env python3
+"""
+openluffy command line
+Renders the application templates locally, without the backend or GitHub
+
+Usage:
+    ./openluffy.py scaffold --list
+    ./openluffy.py scaffold golang ./acme-app --var CUSTOMER_ID=acme --build
+    ./openluffy.py scaffold golang+postgres+redis ./acme-app
+    ./openluffy.py validate golang golang-redis
+    ./openluffy.py bench golang --load 5s
+    ./openluffy.py upgrade ./acme-app --apply
+"""
+import argparse
+import os
+import shutil
+import subprocess
+import sys
+from pathlib import Path
+from typing import Any, Dict, List
+
+sys.path.insert(0, os.path.dirname(__file__))
+
+from template_renderer import (
+    list_manifests, list_mixins, load_manifest, in_catalog, resolve_variables, render_files, check_variable,
+    parse_template_ref, check_pin, TemplateRenderError, TemplateVersionError, RECORD_PATH
+)
+from template_validation import validate_templates, sync_sdk
+from template_upgrade import upgrade_app, format_patch, apply_upgrade, TemplateUpgradeError
+from template_benchmark import (
+    benchmark_templates, load_baseline, save_baseline, compare, DEFAULT_BENCHTIME
+)
+
+
+def derived_values(manifest: Dict[str, Any], values: Dict[str, str]) -> Dict[str, str]:
+    """
+    Variables the backend derives rather than asks for (see template_values
+    in main.py), so a local render matches what a customer repo gets
+    """
+    derived = {'TEMPLATE_VERSION': manifest['version']}
+    if values.get('REPO_NAME'):
+        derived['APP_NAME'] = values['REPO_NAME']
+    if values.get('CUSTOMER_ID'):
+        derived['NAMESPACE'] = f"{values['CUSTOMER_ID']}-dev"
+    return derived
+
+
+def prompt_variable(var: Dict[str, Any]) -> str:
+    """Ask for a required variable until the answer is valid"""
+    print(f"{var['name']}: {var.get('description', '')}", file=sys.stderr)
+    while True:
+        try:
+            value = input(f"  {var['name']}> ").strip()
+        except EOFError:
+            print(file=sys.stderr)
+            sys.exit(1)
+        why = check_variable(var, value) if value else "is required"
+        if not why:
+            return value
+        print(f"  {why}", file=sys.stderr)
+
+
+def collect_values(manifest: Dict[str, Any], given: Dict[str, str], interactive: bool) -> Dict[str, str]:
+    """
+    Values for the render: --var first, then what the backend would derive,
+    then answers to prompts for required variables still missing. Anything
+    else falls back to the manifest defaults in resolve_variables.
+    """
+    values = dict(given)
+    for var in manifest.get('variables', []):
+        name = var['name']
+        if name in values:
+            continue
+        derived = derived_values(manifest, values)
+        if name in derived:
+            values[name] = derived[name]
+        elif var.get('required') and interactive:
+            values[name] = prompt_variable(var)
+    return values
+
+
+def parse_vars(pairs: List[str]) -> Dict[str, Any]:
+    """--var pairs by name; a name given more than once is a list's items"""
+    values: Dict[str, Any] = {}
+    for pair in pairs:
+        name, sep, value = pair.partition('=')
+        if not sep or not name:
+            sys.exit(f"error: --var {pair!r} is not KEY=VALUE")
+        if name in values:
+            given = values[name]
+            values[name] = (given if isinstance(given, list) else [given]) + [value]
+        else:
+            values[name] = value
+    return values
+
+
+def list_templates() -> int:
+    manifests, mixins = list_manifests(), list_mixins()
+    width = max(len(m['name']) for m in manifests + mixins)
+    for m in manifests:
+        print(f"{m['name']:<{width}}  {m['version']:<8}  {m['title']}")
+    print("\nMixins, added to a Go template as golang+postgres:")
+    for m in mixins:
+        print(f"{m['name']:<{width}}  {'':<8}  {m['title']}")
+    return 0
+
+
+def check_templates(names: List[str]) -> None:
+    """Exit unless every name is a template, or a template with mixins that compose"""
+    unknown = []
+    for name in names:
+        try:
+            if not load_manifest(name):
+                unknown.append(name)
+        except TemplateVersionError as e:
+            sys.exit(f"error: {e}")
+    if unknown:
+        sys.exit(f"error: unknown template {', '.join(map(repr, unknown))}; see scaffold --list")
+
+
+def scaffold(args: argparse.Namespace) -> int:
+    if args.list:
+        return list_templates()
+    if not args.template or not args.directory:
+        sys.exit("error: scaffold needs a TEMPLATE and a DIRECTORY (or --list)")
+
+    try:
+        name, pinned = parse_template_ref(args.template)
+        manifest = load_manifest(name)
+        if not manifest:
+            sys.exit(f"error: unknown template {name!r}; see scaffold --list")
+        check_pin(manifest, pinned)
+        if not in_catalog(manifest):
+            print(f"note: {name} is not in the catalog; customers cannot create apps from it yet", file=sys.stderr)
+    except TemplateVersionError as e:
+        sys.exit(f"error: {e}")
+
+    target = Path(args.directory)
+    if target.exists() and any(target.iterdir()) and not args.force:
+        sys.exit(f"error: {target} is not empty; pass --force to render into it anyway")
+
+    interactive = not args.no_input and sys.stdin.isatty()
+    values = collect_values(manifest, parse_vars(args.var), interactive)
+    try:
+        rendered = render_files(manifest, resolve_variables(manifest, values))
+    except TemplateRenderError as e:
+        print(f"error: cannot render {manifest['name']}:", file=sys.stderr)
+        for problem in e.problems:
+            print(f"  {problem}", file=sys.stderr)
+        return 1
+
+    for path, content in rendered.items():
+        out = target / path
+        out.parent.mkdir(parents=True, exist_ok=True)
+        out.write_text(content)
+    print(f"Rendered {manifest['name']} {manifest['version']} into {target} ({len(rendered)} files)")
+
+    if args.build:
+        if manifest.get('language') != 'Go':
+            sys.exit(f"error: --build only supports Go templates, not {manifest.get('language')}")
+        if not shutil.which('go'):
+            sys.exit("error: --build needs the go toolchain on PATH")
+        print("Running go build ./...")
+        return subprocess.run(['go', 'build', './...'], cwd=target).returncode
+    return 0
+
+
+def validate(args: argparse.Namespace) -> int:
+    check_templates(args.templates)
+
+    failed = 0
+    for report in validate_templates(args.templates):
+        print(f"{'ok  ' if report['ok'] else 'FAIL'}  {report['template']} {report['version']}")
+        for step in report['steps']:
+            if not step['ok'] or args.verbose:
+                print(f"      {step['step']}: {'ok' if step['ok'] else 'failed'}")
+                for line in step['output'].splitlines():
+                    print(f"        {line}")
+        failed += not report['ok']
+    if failed:
+        print(f"{failed} template(s) failed validation", file=sys.stderr)
+    return 1 if failed else 0
+
+
+def sdk_sync(args: argparse.Namespace) -> int:
+    written = sync_sdk()
+    for target in written:
+        print(f"wrote openluffy-sdk/{target}")
+    if written:
+        print("The SDK's hash changed: update its lines in templates/golang-sdk/go.sum, "
+              "which ./openluffy.py validate golang-sdk prints")
+    else:
+        print("openluffy-sdk is up to date")
+    return 0
+
+
+def bench(args: argparse.Namespace) -> int:
+    check_templates(args.templates)
+
+    baseline = load_baseline()
+    reports = benchmark_templates(args.templates, benchtime=args.benchtime, load_duration=args.load)
+    failed = 0
+    for report in reports:
+        if report['skipped']:
+            if args.verbose:
+                print(f"skip  {report['template']} {report['version']}: no benchmarks")
+            continue
+        regressions = [] if args.update else compare(report, baseline, args.alloc_tolerance, args.time_tolerance)
+        ok = report['ok'] and not regressions
+        print(f"{'ok  ' if ok else 'FAIL'}  {report['template']} {report['version']}")
+        if not report['ok']:
+            for line in report['output'].splitlines():
+                print(f"        {line}")
+        recorded = baseline.get(report['template'], {})
+        for name, result in sorted(report['benchmarks'].items()):
+            base = recorded.get(name)
+            delta = f"{result['allocs_per_op'] - base['allocs_per_op']:+d}" if base else "new"
+            print(f"      {name:<44} {result['ns_per_op']:>10.0f} ns/op {result['bytes_per_op']:>8} B/op "
+                  f"{result['allocs_per_op']:>5} allocs/op ({delta})")
+        if report['load']:
+            load = report['load']
+            print(f"      load: {load['requests']} requests at {load['concurrency']} concurrent, "
+                  f"{load['requests_per_s']:.0f}/s, p50 {load['p50_ms']}ms, p99 {load['p99_ms']}ms, "
+                  f"{load['failed']} failed")
+        for regression in regressions:
+            print(f"      regression: {regression}")
+        failed += not ok
+    if args.update:
+        save_baseline(reports)
+        print("Baseline updated", file=sys.stderr)
+    if failed:
+        print(f"{failed} template(s) failed benchmarks", file=sys.stderr)
+    return 1 if failed else 0
+
+
+def upgrade(args: argparse.Namespace) -> int:
+    target = Path(args.directory)
+    if not target.is_dir():
+        sys.exit(f"error: {target} is not a directory")
+    values = parse_vars(args.var)
+    if args.to:
+        check_templates([args.to])
+    manifest = load_manifest(args.to) if args.to else None
+    if manifest and not (target / RECORD_PATH).is_file():
+        # Nothing recorded what the app was rendered with: ask as scaffold does
+        values = collect_values(manifest, values, not args.no_input and sys.stdin.isatty())
+    try:
+        result = upgrade_app(target, template=args.to, from_version=args.from_version,
+                             from_revision=args.from_revision, values=values)
+    except TemplateUpgradeError as e:
+        sys.exit(f"error: {e}")
+    except TemplateRenderError as e:
+        print(f"error: cannot render {e.template}:", file=sys.stderr)
+        for problem in e.problems:
+            print(f"  {problem}", file=sys.stderr)
+        return 1
+
+    print(f"Upgrading {target} from {result.from_template} {result.from_version} "
+          f"to {result.template} {result.to_version}", file=sys.stderr)
+    for change in result.changes:
+        print(f"  {change.action:<8}  {change.path}" + (f": {change.reason}" if change.reason else ""),
+              file=sys.stderr)
+    if not result.changes:
+        print("  already up to date", file=sys.stderr)
+
+    if args.apply:
+        apply_upgrade(result, target)
+    else:
+        patch = format_patch(result)
+        if args.output:
+            Path(args.output).write_text(patch)
+        else:
+            sys.stdout.write(patch)
+
+    conflicts = result.conflicts
+    if conflicts:
+        how = "fix the conflict markers" if args.apply else "merge them by hand or rerun with --apply"
+        print(f"{len(conflicts)} file(s) conflict; {how}", file=sys.stderr)
+    return 1 if conflicts else 0
+
+
+def main() -> int:
+    parser = argparse.ArgumentParser(prog='openluffy', description='openluffy command line')
+    commands = parser.add_subparsers(dest='command', required=True)
+
+    cmd = commands.add_parser(
+        'scaffold',
+        help='render an application template into a local directory',
+        description='Render an application template into a local directory, '
+                    'the same way the backend renders it into a new customer repo.',
+    )
+    cmd.add_argument('template', nargs='?',
+                     help='template name, with any mixins and optionally pinned: golang+postgres@0.1.0')
+    cmd.add_argument('directory', nargs='?', help='directory to render into')
+    cmd.add_argument('--list', action='store_true', help='list the available templates and exit')
+    cmd.add_argument('--var', action='append', default=[], metavar='KEY=VALUE',
+                     help='set a template variable; repeat for several, or for the items of a list')
+    cmd.add_argument('--no-input', action='store_true',
+                     help='never prompt; fail if a required variable is missing')
+    cmd.add_argument('--force', action='store_true', help='render into a directory that is not empty')
+    cmd.add_argument('--build', action='store_true', help='run go build ./... on the result')
+    cmd.set_defaults(func=scaffold)
+
+    cmd = commands.add_parser(
+        'validate',
+        help='render templates with sample variables and compile them',
+        description='Render templates with sample variables and run gofmt, go vet and '
+                    'go build on the Go ones in a sandbox. Exits non-zero if any fails.',
+    )
+    cmd.add_argument('templates', nargs='*', metavar='TEMPLATE', help='templates to validate (default: all)')
+    cmd.add_argument('-v', '--verbose', action='store_true', help='show the output of passing steps too')
+    cmd.set_defaults(func=validate)
+
+    cmd = commands.add_parser(
+        'sdk-sync',
+        help='regenerate the openluffy-sdk files shared with the golang template',
+        description='Regenerate the openluffy-sdk files generated from the golang template, '
+                    'so the runtime code both carry is fixed once, in the template.',
+    )
+    cmd.set_defaults(func=sdk_sync)
+
+    cmd = commands.add_parser(
+        'bench',
+        help='run the Go templates\' benchmarks and load test against the baseline',
+        description='Render Go templates with sample variables, run their benchmarks and compare '
+                    'allocations with templates/benchmarks.json. Exits non-zero on a failure or '
+                    'a regression.',
+    )
+    cmd.add_argument('templates', nargs='*', metavar='TEMPLATE', help='templates to benchmark (default: all)')
+    cmd.add_argument('--load', metavar='DURATION',
+                     help='also run each template\'s load test for DURATION, such as 5s')
+    cmd.add_argument('--benchtime', default=DEFAULT_BENCHTIME,
+                     help=f'go test -benchtime (default {DEFAULT_BENCHTIME})')
+    cmd.add_argument('--alloc-tolerance', type=float, default=0.1, metavar='FRACTION',
+                     help='allowed growth of allocs/op and B/op over the baseline (default 0.1)')
+    cmd.add_argument('--time-tolerance', type=float, metavar='FRACTION',
+                     help='also fail when ns/op grows by more than this; only meaningful on '
+                          'the machine that recorded the baseline')
+    cmd.add_argument('--update', action='store_true', help='record the results as the new baseline')
+    cmd.add_argument('-v', '--verbose', action='store_true', help='list templates without benchmarks too')
+    cmd.set_defaults(func=bench)
+
+    cmd = commands.add_parser(
+        'upgrade',
+        help='upgrade a rendered app to the current template, keeping local changes',
+        description='Three-way merge the changes between the template an app was rendered from '
+                    'and the current template into the app. Prints the clean changes as a patch '
+                    'for git apply, or writes them with --apply. Exits non-zero if any file '
+                    'conflicts.',
+    )
+    cmd.add_argument('directory', metavar='DIRECTORY', help='the rendered app')
+    cmd.add_argument('--to', metavar='TEMPLATE',
+                     help='template to upgrade to, with any mixins, which adds those the app lacks '
+                          '(default: the one the app was rendered from)')
+    cmd.add_argument('--from-version', metavar='VERSION',
+                     help='template version the app was rendered from, for apps without a '
+                          '.openluffy.json')
+    cmd.add_argument('--from-revision', metavar='COMMIT',
+                     help='openluffy commit the app was rendered from; overrides .openluffy.json')
+    cmd.add_argument('--var', action='append', default=[], metavar='KEY=VALUE',
+                     help='set a template variable, overriding the recorded one; repeat for several')
+    cmd.add_argument('--no-input', action='store_true',
+                     help='never prompt; fail if a required variable is missing')
+    cmd.add_argument('--output', '-o', metavar='FILE', help='write the patch to FILE instead of stdout')
+    cmd.add_argument('--apply', action='store_true',
+                     help='write the upgrade into the app, with conflict markers where edits overlap')
+    cmd.set_defaults(func=upgrade)
+
+    args = parser.parse_args()
+    return args.func(args)
+
+
+if __name__ == "__main__":
+    sys.exit(main())
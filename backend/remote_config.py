@@ -0,0 +1,232 @@
+"""
+App Remote Configuration
+Settings documents the control plane serves customers' Go apps at their
+REMOTE_CONFIG_URL, so platform operators change an app's settings
+centrally instead of redeploying it
+"""
+import hashlib
+import json
+import re
+from datetime import datetime
+from typing import Any, Dict, Optional
+
+from fastapi import HTTPException, Depends, Header, Query
+from fastapi.responses import JSONResponse, Response
+from pydantic import BaseModel, Field
+from sqlalchemy.orm import Session
+
+from database import get_db, User, Customer, AuditLog, AppConfig
+from auth import get_current_user, require_admin
+from api_tokens import require_scope
+from groups_api import user_can_access_customer
+
+
+# ============================================================================
+# DOCUMENTS
+# ============================================================================
+#
+# An app has a document per environment, and a "default" one for every
+# environment. An app fetches the two merged, the environment's settings
+# over the default's, as a flat JSON object:
+#
+#     {"LOG_LEVEL": "debug", "RATE_LIMIT_RPS": 50, "CORS_ORIGINS": ["https://acme.example"]}
+#
+# The app itself refuses secrets, ENVIRONMENT and REMOTE_CONFIG_* from the
+# document and reports settings it does not know, so those are not checked
+# here beyond the shape of names and values.
+
+DEFAULT_ENVIRONMENT = "default"
+
+_NAME = re.compile(r"[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?")
+_SETTING = re.compile(r"[A-Z][A-Z0-9_]{0,127}")
+
+MAX_SETTINGS = 500
+
+
+class ConfigDocumentRequest(BaseModel):
+    """Replace one environment's document"""
+    settings: Dict[str, Any] = Field(..., description="Setting names to strings, numbers, booleans or lists of them")
+
+
+def settings_problems(settings: Dict[str, Any]) -> list:
+    """Why a document's settings are unusable; empty if they are fine"""
+    if len(settings) > MAX_SETTINGS:
+        return [f"at most {MAX_SETTINGS} settings"]
+    problems = []
+    scalar = (str, int, float, bool)
+    for name, value in settings.items():
+        if not _SETTING.fullmatch(name):
+            problems.append(f"{name}: not a setting name (upper case letters, digits and underscores)")
+        elif not isinstance(value, scalar) and not (
+                isinstance(value, list) and all(isinstance(v, scalar) for v in value)):
+            problems.append(f"{name}: want a string, number, boolean or list of them")
+    return problems
+
+
+def check_app(db: Session, user: User, customer_id: str, app: str, environment: Optional[str] = None):
+    """404 for an unknown customer or malformed name, 403 without access"""
+    if not _NAME.fullmatch(app) or (environment is not None and not _NAME.fullmatch(environment)):
+        raise HTTPException(status_code=404, detail="App or environment not found")
+    customer = db.query(Customer).filter(Customer.id == customer_id).first()
+    if not customer:
+        raise HTTPException(status_code=404, detail="Customer not found")
+    if not user_can_access_customer(db, user, customer_id):
+        raise HTTPException(status_code=403, detail="No access to this customer")
+
+
+def effective_settings(db: Session, customer_id: str, app: str, environment: str) -> Dict[str, Any]:
+    """The default document's settings, overridden by the environment's"""
+    documents = {doc.environment: doc for doc in db.query(AppConfig).filter(
+        AppConfig.customer_id == customer_id,
+        AppConfig.app == app,
+        AppConfig.environment.in_([DEFAULT_ENVIRONMENT, environment])
+    ).all()}
+    settings = {}
+    for env in (DEFAULT_ENVIRONMENT, environment):
+        if env in documents:
+            settings.update(documents[env].settings)
+    return settings
+
+
+def settings_etag(settings: Dict[str, Any]) -> str:
+    """ETag of an effective document: the digest of its content"""
+    digest = hashlib.sha256(json.dumps(settings, sort_keys=True).encode("utf-8")).hexdigest()
+    return f'"{digest[:32]}"'
+
+
+# ============================================================================
+# API ENDPOINTS
+# ============================================================================
+
+def get_app_config(
+    customer_id: str,
+    app: str,
+    environment: str = Query(DEFAULT_ENVIRONMENT),
+    if_none_match: Optional[str] = Header(None),
+    db: Session = Depends(get_db),
+    current_user: User = Depends(require_scope("config:read"))
+):
+    """
+    The settings an app's environment runs with, as the app fetches them
+
+    GET /api/v1/customers/{customer_id}/apps/{app}/config?environment=prod
+
+    Answers 304 when If-None-Match holds the current ETag. An app with no
+    documents gets an empty object, and runs on its own settings.
+    """
+    check_app(db, current_user, customer_id, app, environment)
+    settings = effective_settings(db, customer_id, app, environment)
+    etag = settings_etag(settings)
+    headers = {"ETag": etag, "Cache-Control": "no-cache"}
+    if if_none_match == etag:
+        return Response(status_code=304, headers=headers)
+    return JSONResponse(settings, headers=headers)
+
+
+def list_app_config_documents(
+    customer_id: str,
+    app: str,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(get_current_user)
+):
+    """
+    List an app's documents, the default one first
+
+    GET /api/v1/customers/{customer_id}/apps/{app}/config/documents
+    """
+    check_app(db, current_user, customer_id, app)
+    documents = db.query(AppConfig).filter(
+        AppConfig.customer_id == customer_id,
+        AppConfig.app == app
+    ).all()
+    documents.sort(key=lambda doc: (doc.environment != DEFAULT_ENVIRONMENT, doc.environment))
+    return {
+        "customer_id": customer_id,
+        "app": app,
+        "documents": [doc.to_dict() for doc in documents]
+    }
+
+
+def put_app_config_document(
+    customer_id: str,
+    app: str,
+    environment: str,
+    request: ConfigDocumentRequest,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(require_admin)
+):
+    """
+    Replace an environment's document, or the default one (admin only)
+
+    PUT /api/v1/customers/{customer_id}/apps/{app}/config/documents/{environment}
+
+    Apps pick the change up on their next config reload, within
+    CONFIG_RELOAD_INTERVAL (30s by default). Settings that are not
+    reloadable take effect when the app next restarts.
+    """
+    check_app(db, current_user, customer_id, app, environment)
+    problems = settings_problems(request.settings)
+    if problems:
+        raise HTTPException(status_code=400, detail="; ".join(problems))
+
+    doc = db.query(AppConfig).filter(
+        AppConfig.customer_id == customer_id,
+        AppConfig.app == app,
+        AppConfig.environment == environment
+    ).first()
+    before = dict(doc.settings) if doc else {}
+    if doc:
+        doc.revision += 1
+    else:
+        doc = AppConfig(customer_id=customer_id, app=app, environment=environment, revision=1)
+        db.add(doc)
+    doc.settings = request.settings
+    doc.updated_at = datetime.utcnow()
+    doc.updated_by = current_user.id
+
+    db.add(AuditLog(
+        user_id=current_user.id,
+        action="app_config_updated",
+        resource_type="app_config",
+        resource_id=f"{customer_id}/{app}/{environment}",
+        details={
+            "revision": doc.revision,
+            "changed": sorted(k for k in before.keys() | request.settings.keys()
+                              if before.get(k) != request.settings.get(k))
+        }
+    ))
+    db.commit()
+    db.refresh(doc)
+    return doc.to_dict()
+
+
+def delete_app_config_document(
+    customer_id: str,
+    app: str,
+    environment: str,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(require_admin)
+):
+    """
+    Delete an environment's document, or the default one (admin only)
+
+    DELETE /api/v1/customers/{customer_id}/apps/{app}/config/documents/{environment}
+    """
+    check_app(db, current_user, customer_id, app, environment)
+    doc = db.query(AppConfig).filter(
+        AppConfig.customer_id == customer_id,
+        AppConfig.app == app,
+        AppConfig.environment == environment
+    ).first()
+    if not doc:
+        raise HTTPException(status_code=404, detail="Document not found")
+    db.delete(doc)
+    db.add(AuditLog(
+        user_id=current_user.id,
+        action="app_config_deleted",
+        resource_type="app_config",
+        resource_id=f"{customer_id}/{app}/{environment}",
+        details={"revision": doc.revision, "settings": sorted(doc.settings)}
+    ))
+    db.commit()
+    return {"deleted": True}
@@ -0,0 +1,193 @@
+"""
+Render Audit
+Every template render the backend does is recorded in the audit log: who
+asked for it, the template, version and templates revision, the variables
+with secrets redacted, and a digest of the output, so code generated into
+a customer's repo can be traced back to the request that produced it
+"""
+import hashlib
+import json
+import re
+from datetime import datetime
+from typing import Any, Dict, Mapping, Optional
+
+from fastapi import HTTPException, Depends, Request
+from sqlalchemy import or_
+from sqlalchemy.orm import Session
+
+from database import get_db, SessionLocal, User, AuditLog
+from auth import get_current_user, require_admin
+from template_renderer import RECORD_PATH
+
+
+# ============================================================================
+# RECORDING
+# ============================================================================
+#
+# Renders are logged as "template_rendered" entries against the template,
+# with details:
+#
+#     {"via": "preview" | "archive" | "create" | "reinitialize",
+#      "template": "golang+postgres", "version": "0.1.0", "revision": "<commit>",
+#      "customer_id": "acme-corp", "variables": {...}, "files": 63,
+#      "output_sha256": "...", "client": "10.0.0.7"}
+#
+# template is the name rendered, with its mixins. output_sha256 is the
+# digest of every rendered file, so a repo's content can be checked
+# against its entry: see output_digest.
+
+RENDER_ACTION = "template_rendered"
+
+REDACTED = "[redacted]"
+
+# Variables redacted whatever their manifest says, in case a template
+# takes a credential without marking it secret
+_SECRET_NAME = re.compile(r"TOKEN|SECRET|PASSWORD|PASSWD|API_KEY|PRIVATE_KEY|CREDENTIAL")
+
+
+def redact_variables(manifest: Dict[str, Any], variables: Mapping[str, str]) -> Dict[str, str]:
+    """The variables of a render as the audit log keeps them: secret ones redacted"""
+    secret = {var["name"] for var in manifest["variables"] if var.get("secret")}
+    return {
+        name: REDACTED if name in secret or _SECRET_NAME.search(name) else value
+        for name, value in sorted(variables.items())
+    }
+
+
+def output_digest(files: Mapping[str, str]) -> str:
+    """
+    SHA-256 of a render's files, the render record (RECORD_PATH) included,
+    in path order, each as its path, a NUL, its UTF-8 content and a NUL
+    """
+    h = hashlib.sha256()
+    for path in sorted(files):
+        h.update(path.encode("utf-8") + b"\0" + files[path].encode("utf-8") + b"\0")
+    return h.hexdigest()
+
+
+def render_revision(files: Mapping[str, str]) -> Optional[str]:
+    """The templates revision a render's record names, if any"""
+    try:
+        return json.loads(files[RECORD_PATH]).get("revision")
+    except (KeyError, ValueError):
+        return None
+
+
+async def request_user_id(request: Request) -> Optional[int]:
+    """The user making request, if it carries valid credentials"""
+    authorization = request.headers.get("authorization")
+    if not authorization:
+        return None
+    db = SessionLocal()
+    try:
+        user = await get_current_user(authorization=authorization, db=db)
+        return user.id
+    except HTTPException:
+        return None
+    except Exception as e:
+        print(f"⚠️  Failed to identify the user of a render: {e}")
+        return None
+    finally:
+        db.close()
+
+
+def record_render(via: str, manifest: Dict[str, Any], variables: Mapping[str, str], files: Mapping[str, str],
+                  user_id: Optional[int] = None, customer_id: Optional[str] = None,
+                  client: Optional[str] = None):
+    """
+    Log a render in the audit log
+
+    A failure is printed and otherwise ignored: the render has already
+    happened, and the caller's response should not depend on the log.
+    """
+    db = SessionLocal()
+    try:
+        details = {
+            "via": via,
+            "template": manifest["name"],
+            "version": manifest["version"],
+            "revision": render_revision(files),
+            "customer_id": customer_id,
+            "variables": redact_variables(manifest, variables),
+            "files": len(files),
+            "output_sha256": output_digest(files),
+            "client": client,
+        }
+        db.add(AuditLog(
+            user_id=user_id,
+            action=RENDER_ACTION,
+            resource_type="template",
+            resource_id=manifest["name"],
+            details=details
+        ))
+        db.commit()
+    except Exception as e:
+        db.rollback()
+        print(f"⚠️  Failed to audit-log the render of {manifest['name']}: {e}")
+    finally:
+        db.close()
+
+
+# ============================================================================
+# API ENDPOINTS
+# ============================================================================
+
+def list_renders(
+    template: Optional[str] = None,
+    customer_id: Optional[str] = None,
+    user_id: Optional[int] = None,
+    since: Optional[datetime] = None,
+    until: Optional[datetime] = None,
+    limit: int = 100,
+    offset: int = 0,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(require_admin)
+):
+    """
+    List template renders, newest first (admin only)
+
+    GET /api/v1/audit/renders
+
+    Query params: template (golang also matches golang+postgres),
+    customer_id, user_id, since and until (ISO 8601), limit (at most 1000)
+    and offset
+    """
+    if not 1 <= limit <= 1000 or offset < 0:
+        raise HTTPException(status_code=400, detail="limit must be 1 to 1000 and offset not negative")
+    query = db.query(AuditLog).filter(AuditLog.action == RENDER_ACTION)
+    if template:
+        query = query.filter(or_(AuditLog.resource_id == template, AuditLog.resource_id.like(f"{template}+%")))
+    if customer_id:
+        query = query.filter(AuditLog.details["customer_id"].as_string() == customer_id)
+    if user_id is not None:
+        query = query.filter(AuditLog.user_id == user_id)
+    if since:
+        query = query.filter(AuditLog.timestamp >= since)
+    if until:
+        query = query.filter(AuditLog.timestamp < until)
+    total = query.count()
+    entries = query.order_by(AuditLog.timestamp.desc(), AuditLog.id.desc()).offset(offset).limit(limit).all()
+
+    return {
+        "total": total,
+        "renders": [e.to_dict() for e in entries]
+    }
+
+
+def get_render(
+    render_id: int,
+    db: Session = Depends(get_db),
+    current_user: User = Depends(require_admin)
+):
+    """
+    Get one template render (admin only)
+
+    GET /api/v1/audit/renders/{render_id}
+    """
+    entry = db.query(AuditLog).filter(
+        AuditLog.id == render_id,
+        AuditLog.action == RENDER_ACTION
+    ).first()
+    if not entry:
+        raise HTTPException(status_code=404, detail="Render not found")
+    return entry.to_dict()
@@ -0,0 +1,154 @@
+"""
+Template Benchmarks
+Renders each Go template with the sample variables, runs its Go
+benchmarks and, optionally, its load test, and compares the results with
+the committed baseline, so a change to the shared middleware or handlers
+that makes every generated app slower is caught before it is published
+"""
+import json
+import math
+import os
+import re
+import shutil
+import subprocess
+import tempfile
+from pathlib import Path
+from typing import Any, Dict, List, Optional
+
+from template_renderer import list_manifests, TemplateRenderError
+from template_validation import render_sample, write_files, sandbox_env, use_local_sdk
+
+
+# Baseline results, by template and benchmark. Allocations and bytes per
+# op hardly depend on the machine, so they are what a run is checked
+# against by default; ns/op is recorded for reference and only checked
+# with a time tolerance, on the machine that recorded it.
+BASELINE_PATH = Path(__file__).parent / "templates" / "benchmarks.json"
+
+# A fixed iteration count keeps runs short and comparable; allocations per
+# op do not need more to settle.
+DEFAULT_BENCHTIME = "2000x"
+
+RUN_TIMEOUT = int(os.environ.get("TEMPLATE_BENCHMARK_TIMEOUT", "600"))
+
+# BenchmarkRequest/healthz/platform-8   2000   12221 ns/op   8003 B/op   41 allocs/op
+_BENCH_LINE = re.compile(
+    r"^(Benchmark\S+?)(?:-\d+)?\s+\d+\s+([\d.]+) ns/op\s+(\d+) B/op\s+(\d+) allocs/op"
+)
+_LOAD_LINE = re.compile(r"^loadtest (\{.*\})$")
+
+
+def parse_output(output: str) -> Dict[str, Any]:
+    """Benchmark results and the load test summary from go test output"""
+    benchmarks, load = {}, None
+    for line in output.splitlines():
+        m = _BENCH_LINE.match(line.strip())
+        if m:
+            benchmarks[m.group(1)] = {
+                "ns_per_op": float(m.group(2)),
+                "bytes_per_op": int(m.group(3)),
+                "allocs_per_op": int(m.group(4)),
+            }
+            continue
+        m = _LOAD_LINE.match(line.strip())
+        if m:
+            load = json.loads(m.group(1))
+    return {"benchmarks": benchmarks, "load": load}
+
+
+def benchmark_template(manifest: Dict[str, Any], benchtime: str = DEFAULT_BENCHTIME,
+                       load_duration: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Render a Go template in a sandbox and run go test -bench on it, plus
+    TestLoad when load_duration (a Go duration such as 5s) is given
+
+    Returns:
+        {"template", "version", "ok", "skipped", "output",
+         "benchmarks": {name: {"ns_per_op", "bytes_per_op", "allocs_per_op"}},
+         "load": {"requests", "failed", "requests_per_s", "p50_ms", ...} or None}
+    """
+    report = {"template": manifest["name"], "version": manifest["version"], "ok": False,
+              "skipped": False, "output": "", "benchmarks": {}, "load": None}
+    if manifest.get("language") != "Go" or not any(f.endswith("_test.go") for f in manifest["files"]):
+        report.update(ok=True, skipped=True, output="no Go tests")
+        return report
+    if not shutil.which("go"):
+        report["output"] = "go toolchain not found on PATH"
+        return report
+    try:
+        rendered = render_sample(manifest)
+    except TemplateRenderError as e:
+        report["output"] = "\n".join(e.problems)
+        return report
+
+    env = sandbox_env()
+    run = "^$"
+    if load_duration:
+        env["LOAD_TEST_DURATION"] = load_duration
+        run = "^TestLoad$"
+    cmd = ["go", "test", "-run", run, "-bench", ".", "-benchmem", f"-benchtime={benchtime}", "-count=1", "."]
+    with tempfile.TemporaryDirectory(prefix=f"template-bench-{manifest['name']}-") as tmpdir:
+        root = Path(tmpdir)
+        write_files(rendered, root)
+        sdk = use_local_sdk(rendered, root)
+        if sdk and not sdk["ok"]:
+            report["output"] = sdk["output"]
+            return report
+        try:
+            proc = subprocess.run(cmd, cwd=root, env=env, capture_output=True, text=True, timeout=RUN_TIMEOUT)
+        except subprocess.TimeoutExpired:
+            report["output"] = f"timed out after {RUN_TIMEOUT}s"
+            return report
+    report["output"] = (proc.stdout + proc.stderr).strip()
+    report.update(parse_output(proc.stdout))
+    report["ok"] = proc.returncode == 0
+    if report["ok"] and not report["benchmarks"]:
+        report["skipped"] = True
+    return report
+
+
+def load_baseline(path: Path = BASELINE_PATH) -> Dict[str, Any]:
+    if not path.exists():
+        return {}
+    return json.loads(path.read_text())
+
+
+def save_baseline(reports: List[Dict[str, Any]], path: Path = BASELINE_PATH) -> None:
+    """Record the reports' benchmarks, keeping templates that were not run"""
+    baseline = load_baseline(path)
+    for report in reports:
+        if report["ok"] and report["benchmarks"]:
+            baseline[report["template"]] = report["benchmarks"]
+    path.write_text(json.dumps(dict(sorted(baseline.items())), indent=2) + "\n")
+
+
+def compare(report: Dict[str, Any], baseline: Dict[str, Any], alloc_tolerance: float,
+            time_tolerance: Optional[float] = None) -> List[str]:
+    """
+    Regressions of one template against the baseline: allocations or bytes
+    per op above the baseline by more than alloc_tolerance (0.1 is 10%),
+    and with time_tolerance, ns/op likewise. Benchmarks without a baseline
+    are new and never regressions.
+    """
+    regressions = []
+    recorded = baseline.get(report["template"], {})
+    for name, result in sorted(report["benchmarks"].items()):
+        base = recorded.get(name)
+        if not base:
+            continue
+        checks = [("allocs_per_op", "allocs/op", alloc_tolerance), ("bytes_per_op", "B/op", alloc_tolerance)]
+        if time_tolerance is not None:
+            checks.append(("ns_per_op", "ns/op", time_tolerance))
+        for key, unit, tolerance in checks:
+            limit = math.ceil(base[key] * (1 + tolerance))
+            if result[key] > limit:
+                regressions.append(f"{name}: {result[key]:g} {unit}, baseline {base[key]:g} (limit {limit:g})")
+    return regressions
+
+
+def benchmark_templates(names: Optional[List[str]] = None, **kwargs) -> List[Dict[str, Any]]:
+    """Benchmark the named templates, or every template if names is empty"""
+    manifests = list_manifests(unlisted=True)
+    if names:
+        manifests = [m for m in manifests if m["name"] in names]
+    return [benchmark_template(m, **kwargs) for m in manifests]
@@ -0,0 +1,1081 @@
+"""
+Template Rendering
+Renders the application templates in backend/templates into customer repos
+"""
+import functools
+import hashlib
+import html
+import json
+import os
+import re
+import subprocess
+from collections import ChainMap
+from datetime import datetime, timezone
+from pathlib import Path
+from typing import Any, Callable, Dict, List, Mapping, Optional, Tuple
+
+
+# ============================================================================
+# SYNTAX
+# ============================================================================
+#
+# A template references a variable as [% NAME %], optionally piped through
+# one or more filters: "[% CUSTOMER_NAME | go %]". The delimiters were chosen
+# not to collide with anything the templates legitimately contain: Go and
+# Helm use {{ }}, GitHub Actions ${{ }}, Python f-strings { }, and shell
+# [[ ]]. Like Go's text/template with missingkey=error, rendering is
+# strict: an undefined variable, an unknown filter or a malformed tag fails
+# the render instead of leaving the tag in the output.
+#
+# Blocks include text only when a condition holds, or once per item of a
+# list variable:
+#
+#     [% if REDIS_URL %]...[% else %]...[% end %]
+#     [% if LOG_FORMAT == "json" %]...[% end %]
+#     [% for ROUTE in ROUTES %]mux.HandleFunc("[% ROUTE.path | go %]", ...)[% end %]
+#
+# A variable is set when its value or list is not empty; "not" negates a
+# condition, and == and != compare the value with a double-quoted string.
+# Inside a for block the item is a variable of its own, its fields read
+# as ROUTE.path, and loop.index (from 1), loop.first and loop.last tell
+# where in the list it is. A block tag alone on its line removes the whole
+# line, so blocks leave no blank lines behind.
+
+OPEN_DELIM = "[%"
+CLOSE_DELIM = "%]"
+
+_NAME = r"[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)?"
+
+_TAG = re.compile(
+    rf"\[%\s*(?P<name>{_NAME})\s*(?P<filters>(?:\|\s*[A-Za-z_]+\s*)*)%\]"
+)
+
+_BLOCK = re.compile(
+    rf"\[%\s*(?:if\s+(?P<negate>not\s+)?(?P<cond>{_NAME})(?:\s*(?P<op>==|!=)\s*\"(?P<literal>[^\"\n]*)\")?"
+    rf"|for\s+(?P<item>[A-Za-z_][A-Za-z0-9_]*)\s+in\s+(?P<list>{_NAME})"
+    r"|(?P<keyword>else|end))\s*%\]"
+)
+
+
+# ============================================================================
+# FILTERS
+# ============================================================================
+
+# String filters escape a value for use between the double quotes of a
+# string literal, so the template keeps control of the quoting:
+#
+#     const customerName = "[% CUSTOMER_NAME | go %]"
+#     description: "[% CUSTOMER_NAME | yaml %] application"
+
+def _go_string(value: str) -> str:
+    """Escape for a Go interpreted string literal, as strconv.Quote does"""
+    out = []
+    for ch in value:
+        if ch in ('"', '\\'):
+            out.append('\\' + ch)
+        elif ch == '\n':
+            out.append('\\n')
+        elif ch == '\t':
+            out.append('\\t')
+        elif ch == '\r':
+            out.append('\\r')
+        elif ord(ch) < 0x20 or ord(ch) == 0x7f:
+            out.append('\\x%02x' % ord(ch))
+        else:
+            out.append(ch)
+    return ''.join(out)
+
+
+def _json_string(value: str) -> str:
+    """Escape for a JSON string; also valid in JavaScript and Python strings"""
+    return json.dumps(value, ensure_ascii=False)[1:-1]
+
+
+FILTERS: Dict[str, Callable[[str], str]] = {
+    "go": _go_string,
+    "json": _json_string,
+    # JSON strings are valid YAML double-quoted scalars
+    "yaml": _json_string,
+    "html": lambda value: html.escape(value, quote=True),
+}
+
+
+# ============================================================================
+# RENDERING
+# ============================================================================
+
+class TemplateRenderError(Exception):
+    """A template could not be rendered; problems lists every failure"""
+
+    def __init__(self, template: str, problems: List[str]):
+        self.template = template
+        self.problems = problems
+        super().__init__(f"{template}: " + "; ".join(problems))
+
+
+class TemplateVariableError(TemplateRenderError):
+    """Variables supplied for a template failed its manifest's schema"""
+
+
+def _parse(content: str, variables: Mapping[str, Any], problem: Callable[[int, str], None]) -> List[Any]:
+    """
+    Parse template content into a tree of nodes: text as str, and tags as
+    lists of their kind, regex match and line, then an if's then and else
+    nodes or a for's body. Names are checked here, so a typo in a block
+    that does not render with the given variables is still reported.
+    """
+    def line_of(pos: int) -> int:
+        return content.count("\n", 0, pos) + 1
+
+    root: List[Any] = []
+    stack: List[Tuple[Optional[List[Any]], List[Any]]] = [(None, root)]  # open blocks and their nodes
+    loops: List[str] = []  # item names of the enclosing for blocks
+
+    def check_name(name: str, line: int) -> None:
+        head = name.split(".")[0]
+        if head in loops or (head == "loop" and loops):
+            return
+        if variables.get(head) is None:
+            problem(line, f"undefined variable {head}")
+
+    pos = search = 0
+    while (start := content.find(OPEN_DELIM, search)) != -1:
+        block = _BLOCK.match(content, start)
+        tag = block or _TAG.match(content, start)
+        if not tag:
+            problem(line_of(start), "malformed tag")
+            search = start + len(OPEN_DELIM)
+            continue
+        text_end, pos_next = start, tag.end()
+        if block:
+            line_start = content.rfind("\n", 0, start) + 1
+            line_end = content.find("\n", tag.end())
+            line_end = len(content) if line_end == -1 else line_end + 1
+            if line_start >= pos and not content[line_start:start].strip() \
+                    and not content[tag.end():line_end].strip():
+                text_end, pos_next = line_start, line_end
+        nodes = stack[-1][1]
+        if text_end > pos:
+            nodes.append(content[pos:text_end])
+        pos = search = pos_next
+
+        line = line_of(start)
+        if not block:
+            check_name(tag.group("name"), line)
+            nodes.append(["value", tag, line])
+        elif block.group("cond"):
+            check_name(block.group("cond"), line)
+            node = ["if", block, line, [], None]
+            nodes.append(node)
+            stack.append((node, node[3]))
+        elif block.group("item"):
+            item = block.group("item")
+            check_name(block.group("list"), line)
+            if variables.get(item) is not None or item in loops or item == "loop":
+                problem(line, f"for {item} hides the variable {item}")
+            node = ["for", block, line, []]
+            nodes.append(node)
+            stack.append((node, node[3]))
+            loops.append(item)
+        elif block.group("keyword") == "else":
+            node = stack[-1][0]
+            if not node or node[0] != "if" or node[4] is not None:
+                problem(line, "else outside an if block")
+                continue
+            node[4] = []
+            stack[-1] = (node, node[4])
+        else:
+            node = stack[-1][0]
+            if not node:
+                problem(line, "end without a block to close")
+                continue
+            stack.pop()
+            if node[0] == "for":
+                loops.pop()
+    if pos < len(content):
+        stack[-1][1].append(content[pos:])
+    for node, _ in stack[1:]:
+        problem(node[2], f"{node[0]} block without an end")
+    return root
+
+
+def render_template(content: str, variables: Mapping[str, Any], template: str = "<template>") -> str:
+    """
+    Render template content with the given variables
+
+    Args:
+        content: Template text
+        variables: Values keyed by variable name, usually from
+            template_variables: strings, or lists of strings or of fields
+            keyed by name for for blocks
+        template: Template name used in error messages
+
+    Returns:
+        The rendered text
+
+    Raises:
+        TemplateRenderError: listing every problem found in the template
+    """
+    problems: List[str] = []
+
+    def problem(line: int, why: str) -> None:
+        # A tag inside a for block fails the same way on every item
+        if f"line {line}: {why}" not in problems:
+            problems.append(f"line {line}: {why}")
+
+    tree = _parse(content, variables, problem)
+    if problems:
+        raise TemplateRenderError(template, problems)
+
+    def lookup(name: str, scope: Mapping[str, Any], line: int) -> Any:
+        head, _, field = name.partition(".")
+        value = scope[head]
+        if not field:
+            return value
+        if not isinstance(value, Mapping):
+            problem(line, f"{head} has no fields")
+            return None
+        if field not in value:
+            problem(line, f"{head} has no field {field}")
+            return None
+        return value[field]
+
+    def scalar(name: str, value: Any, line: int) -> Optional[str]:
+        if isinstance(value, bool):
+            return "true" if value else "false"
+        if isinstance(value, (list, tuple)):
+            problem(line, f"{name} is a list; render its items in a for block")
+            return None
+        if isinstance(value, Mapping):
+            problem(line, f"{name} has fields; render them as {name}.field")
+            return None
+        return str(value)
+
+    def holds(tag: re.Match, scope: Mapping[str, Any], line: int) -> bool:
+        value = lookup(tag.group("cond"), scope, line)
+        if tag.group("op"):
+            text = scalar(tag.group("cond"), value, line)
+            result = (text == tag.group("literal")) == (tag.group("op") == "==")
+        else:
+            result = bool(value)
+        return result != bool(tag.group("negate"))
+
+    def render(nodes: List[Any], scope: Mapping[str, Any], out: List[str]) -> None:
+        for node in nodes:
+            if isinstance(node, str):
+                out.append(node)
+                continue
+            kind, tag, line = node[:3]
+            if kind == "value":
+                name = tag.group("name")
+                value = scalar(name, lookup(name, scope, line), line)
+                if value is None:
+                    continue
+                for f in tag.group("filters").split("|")[1:]:
+                    f = f.strip()
+                    if f not in FILTERS:
+                        problem(line, f"unknown filter {f!r} (want {', '.join(FILTERS)})")
+                        break
+                    value = FILTERS[f](value)
+                out.append(value)
+            elif kind == "if":
+                branch = node[3] if holds(tag, scope, line) else node[4]
+                render(branch or [], scope, out)
+            else:
+                items = lookup(tag.group("list"), scope, line)
+                if not isinstance(items, (list, tuple)):
+                    if items is not None:
+                        problem(line, f"{tag.group('list')} is not a list")
+                    continue
+                for i, item in enumerate(items):
+                    loop = {"index": str(i + 1), "first": i == 0, "last": i == len(items) - 1}
+                    render(node[3], ChainMap({tag.group("item"): item, "loop": loop}, scope), out)
+
+    out: List[str] = []
+    render(tree, variables, out)
+    if problems:
+        raise TemplateRenderError(template, problems)
+    return "".join(out)
+
+
+# ============================================================================
+# MANIFESTS
+# ============================================================================
+#
+# Each template (stack) is described by templates/manifests/<name>.json:
+# its display title, language, description and version, the files it renders (target
+# path in the customer repo -> file under templates/), and the variables
+# it takes:
+#
+#     {"name": "PORT", "type": "integer", "default": "8080",
+#      "minimum": 1, "maximum": 65535, "description": "..."}
+#
+# type is string (one line), text (may span lines), integer or list. A
+# list has one item per line, or is given as an array, for templates to
+# render in a for block; "fields": ["name", "value"] splits each item on
+# "=" into fields, the last taking the rest, so "LOG_LEVEL=debug" renders
+# as ITEM.name and ITEM.value. A variable is either required or has a
+# default; pattern is a regular expression the whole value, or each item
+# of a list, must match. Values are validated before anything is rendered,
+# so bad input is reported against the variable, not as broken output.
+# "secret": true marks a value that must not be logged, such as a
+# credential; the render audit log (render_audit.py) redacts it.
+#
+# The version (semver) is stamped into generated apps as TEMPLATE_VERSION,
+# so support can tell which template revision a customer started from, and
+# is recorded per customer for pinning (see VERSIONS below).
+#
+# "catalog": false keeps a template out of the catalog: it is validated
+# and benchmarked like the others, and operators can scaffold it, but it
+# is not listed and no customer app is created from it. golang-sdk is
+# kept out until the openluffy-sdk version it requires is tagged, since
+# until then its go.mod resolves only in this checkout.
+
+TEMPLATES_DIR = Path(__file__).parent / "templates"
+MANIFESTS_DIR = TEMPLATES_DIR / "manifests"
+
+VARIABLE_TYPES = ("string", "text", "integer", "list")
+
+
+def load_manifest(name: str, templates_dir: Path = TEMPLATES_DIR) -> Optional[Dict[str, Any]]:
+    """
+    Load a template's manifest, or None if there is no such template
+
+    A name with mixins, such as golang+postgres, loads the template
+    composed with them (see MIXINS below); a template with a spec gets its
+    variables (see SPECS). templates_dir is another revision's templates
+    tree, as template_upgrade.py renders from.
+
+    Raises:
+        TemplateCompositionError: if the spec is unknown or the mixins do
+            not compose with the template
+    """
+    base, *mixins = name.split("+")
+    path = templates_dir / "manifests" / f"{base}.json"
+    if not path.is_file():
+        return None
+    with open(path) as f:
+        manifest = json.load(f)
+    if manifest.get("spec"):
+        manifest = apply_spec(manifest, load_spec(manifest["spec"], templates_dir))
+    if not mixins:
+        return manifest
+    return compose_manifest(manifest, [load_mixin(mixin, templates_dir) for mixin in mixins])
+
+
+def list_manifests(unlisted: bool = False) -> List[Dict[str, Any]]:
+    """Load every catalog template's manifest, sorted by name, or with unlisted every template's"""
+    manifests = [load_manifest(path.stem) for path in sorted(MANIFESTS_DIR.glob("*.json"))]
+    return [m for m in manifests if unlisted or in_catalog(m)]
+
+
+def in_catalog(manifest: Dict[str, Any]) -> bool:
+    """Whether customers can list the template and create apps from it"""
+    return manifest.get("catalog", True)
+
+
+def check_variable(var: Dict[str, Any], value: str) -> Optional[str]:
+    """Return why value is invalid for var, or None if it is valid"""
+    kind = var.get("type", "string")
+    if kind == "list":
+        for item in list_items(value):
+            why = check_item(var, item)
+            if why:
+                return why
+        return None
+    if kind == "string" and "\n" in value:
+        return "must be a single line"
+    if kind == "integer":
+        try:
+            number = int(value)
+        except ValueError:
+            return f"{value!r} is not an integer"
+        if "minimum" in var and number < var["minimum"]:
+            return f"{number} is below the minimum {var['minimum']}"
+        if "maximum" in var and number > var["maximum"]:
+            return f"{number} is above the maximum {var['maximum']}"
+    pattern = var.get("pattern")
+    if pattern and not re.fullmatch(pattern, value):
+        return f"{value!r} does not match {pattern}"
+    return None
+
+
+def list_items(value: str) -> List[str]:
+    """The items of a list variable's value, one per non-blank line"""
+    return [line.strip() for line in value.splitlines() if line.strip()]
+
+
+def check_item(var: Dict[str, Any], item: str) -> Optional[str]:
+    """Return why item is invalid for list variable var, or None if it is valid"""
+    fields = var.get("fields")
+    if fields and item.count("=") < len(fields) - 1:
+        return f"{item!r} is not {'='.join(fields)}"
+    pattern = var.get("pattern")
+    if pattern and not re.fullmatch(pattern, item):
+        return f"{item!r} does not match {pattern}"
+    return None
+
+
+def resolve_variables(manifest: Dict[str, Any], values: Mapping[str, Any]) -> Dict[str, str]:
+    """
+    Validate values against a manifest and fill in defaults
+
+    Args:
+        manifest: Template manifest from load_manifest
+        values: Supplied values keyed by variable name; None means unset
+
+    Returns:
+        Every declared variable mapped to its string value; a list's items
+        are joined one per line
+
+    Raises:
+        TemplateVariableError: listing every invalid, missing or undeclared value
+    """
+    declared = {var["name"]: var for var in manifest["variables"]}
+    problems = []
+
+    for name in sorted(set(values) - set(declared)):
+        problems.append(f"{name}: not a variable of this template")
+
+    resolved = {}
+    for name, var in declared.items():
+        value = values.get(name)
+        if value is None or value == "":
+            if var.get("required"):
+                problems.append(f"{name}: required ({var.get('description', 'no description')})")
+                continue
+            value = var.get("default", "")
+        if isinstance(value, (list, tuple)):
+            if var.get("type") != "list":
+                problems.append(f"{name}: takes a single value, not a list")
+                continue
+            value = "\n".join(str(item) for item in value)
+        value = str(value)
+
+        why = check_variable(var, value)
+        if why:
+            hint = var.get("description")
+            problems.append(f"{name}: {why}" + (f" ({hint})" if hint else ""))
+            continue
+        resolved[name] = value
+
+    if problems:
+        raise TemplateVariableError(manifest["name"], problems)
+    return resolved
+
+
+def template_variables(manifest: Dict[str, Any], variables: Mapping[str, str]) -> Dict[str, Any]:
+    """
+    Resolved variables as templates see them: list variables become lists
+    of their items, split into fields when the manifest names them, and
+    SPEC_SETTINGS, SPEC_ENDPOINTS and SPEC_ERROR_FIELDS list the
+    template's spec
+
+    Raises:
+        TemplateRenderError: if a spec setting's default does not render
+    """
+    context: Dict[str, Any] = dict(variables)
+    context.update(spec_variables(manifest.get("spec"), variables))
+    for var in manifest["variables"]:
+        if var.get("type") != "list" or var["name"] not in variables:
+            continue
+        items = list_items(variables[var["name"]])
+        if var.get("fields"):
+            fields = var["fields"]
+            items = [dict(zip(fields, item.split("=", len(fields) - 1))) for item in items]
+        context[var["name"]] = items
+    return context
+
+
+def render_files(manifest: Dict[str, Any], variables: Mapping[str, str],
+                 templates_dir: Path = TEMPLATES_DIR, revision: Optional[str] = None) -> Dict[str, str]:
+    """
+    Render every file of a template, plus its render record
+
+    Args:
+        manifest: Template manifest from load_manifest
+        variables: Resolved values from resolve_variables
+        templates_dir: Templates tree to render from; another revision's,
+            checked out for an upgrade, instead of the current one
+        revision: Git commit templates_dir was checked out from; defaults
+            to the commit of the current tree when it is a clean checkout
+
+    Returns:
+        Rendered content keyed by target path in the customer repo
+
+    Raises:
+        TemplateRenderError: listing every problem across all files, so one
+            render reports everything wrong with the template, or what
+            failed in a render hook
+    """
+    if revision is None and templates_dir == TEMPLATES_DIR:
+        revision = templates_revision()
+    sources, problems = {}, []
+    for target_path, template_file in manifest["files"].items():
+        path = templates_dir / template_file
+        if not path.is_file():
+            problems.append(f"{template_file}: template not found")
+            continue
+        sources[target_path] = path.read_text()
+    if problems:
+        raise TemplateRenderError(manifest["name"], problems)
+    sources = run_render_hooks("pre-render", manifest, variables, sources)
+
+    context = template_variables(manifest, variables)
+    rendered = {}
+    for target_path, source in sources.items():
+        template_file = manifest["files"].get(target_path, target_path)
+        try:
+            rendered[target_path] = render_template(source, context, template_file)
+        except TemplateRenderError as e:
+            problems.extend(f"{template_file}: {p}" for p in e.problems)
+    if problems:
+        raise TemplateRenderError(manifest["name"], problems)
+    if manifest.get("mixins"):
+        wire_mixins(rendered, manifest["mixins"], templates_dir)
+    rendered = run_render_hooks("post-render", manifest, variables, rendered)
+    record = render_record(manifest, variables, revision)
+    rendered[RECORD_PATH] = json.dumps(record, indent=2, ensure_ascii=False) + "\n"
+    if manifest.get("language") == "Go":
+        rendered[LDFLAGS_PATH] = render_ldflags(record)
+    return rendered
+
+
+# Every render also writes RECORD_PATH into the app: the template, version,
+# templates revision and variables it was rendered with, which is what
+# template_upgrade.py needs to re-render the app's starting point, and
+# when it was rendered, with a SHA-256 of those variables.
+#
+# A Go app also gets LDFLAGS_PATH, the same provenance as -X flags for
+# version.go, one per line. Its Dockerfile and Makefile build with them,
+# so the binary serves them on /version and carries them in its build
+# info, where go version -m and debug.ReadBuildInfo show them: a fleet's
+# binaries can be audited for template drift without their repos.
+
+RECORD_PATH = ".openluffy.json"
+LDFLAGS_PATH = ".openluffy.ldflags"
+
+# The files every render writes, which hooks and customers do not edit
+GENERATED_PATHS = (RECORD_PATH, LDFLAGS_PATH)
+
+
+def render_record(manifest: Dict[str, Any], variables: Mapping[str, str], revision: Optional[str]) -> Dict[str, Any]:
+    """
+    The render record of a render, as RECORD_PATH holds it. Variables left
+    at their default are not recorded, so an upgrade renders the new
+    template's default rather than keeping the old one.
+    """
+    defaults = {}
+    for var in manifest["variables"]:
+        default = var.get("default")
+        if isinstance(default, (list, tuple)):
+            default = "\n".join(str(item) for item in default)
+        defaults[var["name"]] = default
+    recorded = {name: value for name, value in sorted(variables.items()) if value != defaults.get(name)}
+    canonical = json.dumps(recorded, sort_keys=True, separators=(",", ":"), ensure_ascii=False)
+    record = {"template": manifest["name"], "version": manifest["version"]}
+    if revision:
+        record["revision"] = revision
+    record["rendered_at"] = datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+    record["variables_sha256"] = hashlib.sha256(canonical.encode()).hexdigest()
+    record["variables"] = recorded
+    return record
+
+
+# version.go's variable for each field of the record
+LDFLAGS_VARIABLES = (
+    ("template", "templateName"),
+    ("version", "templateVersion"),
+    ("revision", "templateRevision"),
+    ("rendered_at", "renderedAt"),
+    ("variables_sha256", "variablesHash"),
+)
+
+
+def render_ldflags(record: Mapping[str, Any]) -> str:
+    """LDFLAGS_PATH for a render record"""
+    return "".join(f"-X main.{var}={record[field]}\n" for field, var in LDFLAGS_VARIABLES if record.get(field))
+
+
+def without_render_time(content: Optional[str]) -> Optional[str]:
+    """
+    A generated file (GENERATED_PATHS) less the line saying when it was
+    rendered, to tell whether two renders differ in anything else
+    """
+    if content is None:
+        return None
+    return re.sub(r"^.*\b(rendered_at|renderedAt)\b.*\n?", "", content, flags=re.MULTILINE)
+
+
+@functools.lru_cache(maxsize=None)
+def templates_revision() -> Optional[str]:
+    """Git commit of the templates tree, or None unless it is a clean checkout"""
+    try:
+        head = subprocess.run(["git", "rev-parse", "HEAD"], cwd=TEMPLATES_DIR,
+                              capture_output=True, text=True, check=True).stdout.strip()
+        dirty = subprocess.run(["git", "status", "--porcelain", "--", "."], cwd=TEMPLATES_DIR,
+                               capture_output=True, text=True, check=True).stdout.strip()
+    except (OSError, subprocess.CalledProcessError):
+        return None
+    return None if dirty else head
+
+
+# ============================================================================
+# HOOKS
+# ============================================================================
+#
+# Render hooks let an operator customize every render without patching the
+# templates: inject company headers, append a compliance notice, run
+# gofmt. A hook is any executable (a script, or a compiled Go program) in
+# a stage directory of TEMPLATE_HOOKS_DIR:
+#
+#     pre-render.d/   run on the template sources, before variables are
+#                     substituted, so what a hook adds may use [% %] tags
+#     post-render.d/  run on the rendered files, mixins wired in, before
+#                     the render record and build flags are added
+#
+# A stage's hooks run in name order, each given the previous one's files.
+# A hook reads a JSON object on stdin:
+#
+#     {"stage": "post-render", "template": "golang+postgres",
+#      "version": "0.4.0", "variables": {...}, "files": {path: content}}
+#
+# and writes {"files": {path: content}} to stdout, the files it leaves the
+# render with: it may change, add or remove any. Writing nothing leaves the
+# files as they were, for hooks that only check them. A hook that exits
+# non-zero, writes something else or runs past TEMPLATE_HOOK_TIMEOUT
+# seconds fails the render, with its stderr as the reason. Hooks run for
+# every render, so an upgrade's base and target are rendered alike and
+# the hooks' changes are not reported as the customer's edits.
+
+HOOK_STAGES = ("pre-render", "post-render")
+HOOK_TIMEOUT = int(os.environ.get("TEMPLATE_HOOK_TIMEOUT", "60"))
+
+
+def render_hooks(stage: str) -> List[Path]:
+    """The executables of a hook stage, in the order they run"""
+    hooks_dir = os.environ.get("TEMPLATE_HOOKS_DIR")
+    if not hooks_dir:
+        return []
+    stage_dir = Path(hooks_dir) / f"{stage}.d"
+    if not stage_dir.is_dir():
+        return []
+    return [path for path in sorted(stage_dir.iterdir())
+            if path.is_file() and not path.name.startswith(".") and os.access(path, os.X_OK)]
+
+
+def run_render_hooks(stage: str, manifest: Dict[str, Any], variables: Mapping[str, str],
+                     files: Dict[str, str]) -> Dict[str, str]:
+    """
+    Run a stage's hooks over files
+
+    Returns:
+        The files the last hook left, keyed by target path
+
+    Raises:
+        TemplateRenderError: naming the hook that failed and why
+    """
+    for hook in render_hooks(stage):
+        request = json.dumps({"stage": stage, "template": manifest["name"], "version": manifest["version"],
+                              "variables": dict(variables), "files": files}, ensure_ascii=False)
+        try:
+            result = subprocess.run([str(hook)], input=request, capture_output=True, text=True,
+                                    cwd=hook.parent, timeout=HOOK_TIMEOUT)
+            files = _hook_files(result, files)
+        except subprocess.TimeoutExpired:
+            raise TemplateRenderError(manifest["name"], [f"{stage} hook {hook.name}: timed out after {HOOK_TIMEOUT}s"])
+        except (OSError, ValueError) as e:
+            raise TemplateRenderError(manifest["name"], [f"{stage} hook {hook.name}: {e}"])
+    return files
+
+
+def _hook_files(result: subprocess.CompletedProcess, files: Dict[str, str]) -> Dict[str, str]:
+    """
+    The files a hook's run left
+
+    Raises:
+        ValueError: saying why the hook failed
+    """
+    if result.returncode != 0:
+        stderr = result.stderr.strip().splitlines()
+        raise ValueError(f"exit status {result.returncode}" + (f": {stderr[-1]}" if stderr else ""))
+    if not result.stdout.strip():
+        return files
+    try:
+        out = json.loads(result.stdout)
+    except ValueError as e:
+        raise ValueError(f"output is not JSON: {e}")
+    hooked = out.get("files") if isinstance(out, dict) else None
+    if not isinstance(hooked, dict) or not all(isinstance(v, str) for v in hooked.values()):
+        raise ValueError('output is not {"files": {path: content}}')
+    for path in hooked:
+        parts = Path(path).parts
+        if not parts or Path(path).is_absolute() or ".." in parts:
+            raise ValueError(f"{path!r} is not a path inside the app")
+    for path in GENERATED_PATHS:
+        if path in hooked:
+            raise ValueError(f"{path} is written by openluffy")
+    return hooked
+
+# ============================================================================
+# SPECS
+# ============================================================================
+#
+# A spec is what templates in different languages have in common, so a
+# customer choosing Node.js or Python over Go gets the same service:
+# templates/spec/<name>.json, taken by a manifest as "spec": "service".
+# The Go template is the reference the others are held to.
+#
+#     variables  declared as in a manifest; the manifest's own follow
+#                them, and replace a spec variable of the same name
+#     settings   the env vars the app reads, as {"name", "default",
+#                "description"}; defaults may reference variables
+#     endpoints  what the app serves, as {"name", "path" or "setting",
+#                "content_type", "fields", "json_fields", "description"}:
+#                setting names the setting that holds the path, fields
+#                the keys of a JSON response, and json_fields those of
+#                the JSON an HTML endpoint answers clients preferring it
+#     errors     how every error is answered, as {"fields",
+#                "description"}: fields are the keys of the JSON body
+#
+# Templates render the settings and endpoints from SPEC_SETTINGS and
+# SPEC_ENDPOINTS, so every language's settings table, routes and tests
+# come from the one list, and the error keys from SPEC_ERROR_FIELDS. An
+# endpoint's path is its setting's default when it has a setting, which
+# is "" otherwise. The lists are empty for a template without a spec.
+
+SPECS_DIR = TEMPLATES_DIR / "spec"
+
+
+def load_spec(name: str, templates_dir: Path = TEMPLATES_DIR) -> Dict[str, Any]:
+    """
+    Load a spec
+
+    Raises:
+        TemplateCompositionError: if there is no such spec
+    """
+    path = templates_dir / "spec" / f"{name}.json"
+    if not path.is_file():
+        raise TemplateCompositionError(f"unknown spec {name!r}")
+    with open(path) as f:
+        return json.load(f)
+
+
+def apply_spec(manifest: Dict[str, Any], spec: Dict[str, Any]) -> Dict[str, Any]:
+    """The manifest with its spec's variables, and the spec in place of its name"""
+    own = {var["name"]: var for var in manifest["variables"]}
+    variables = [own.pop(var["name"], var) for var in spec["variables"]]
+    return dict(manifest, spec=spec, variables=variables + list(own.values()))
+
+
+def spec_variables(spec: Optional[Dict[str, Any]], variables: Mapping[str, str]) -> Dict[str, Any]:
+    """SPEC_SETTINGS, SPEC_ENDPOINTS and SPEC_ERROR_FIELDS of a spec, with the defaults rendered"""
+    spec = spec or {}
+    settings = [dict(setting, default=render_template(setting["default"], variables, f"spec {spec['name']}"))
+                for setting in spec.get("settings", [])]
+    defaults = {setting["name"]: setting["default"] for setting in settings}
+    endpoints = []
+    for endpoint in spec.get("endpoints", []):
+        setting = endpoint.get("setting", "")
+        endpoints.append(dict(endpoint, setting=setting, path=defaults[setting] if setting else endpoint["path"],
+                              fields=endpoint.get("fields", []), json_fields=endpoint.get("json_fields", [])))
+    errors = spec.get("errors", {}).get("fields", [])
+    return {"SPEC_SETTINGS": settings, "SPEC_ENDPOINTS": endpoints, "SPEC_ERROR_FIELDS": errors}
+
+
+# ============================================================================
+# VERSIONS
+# ============================================================================
+#
+# A template is referenced as name or name@version, e.g. golang@v1.2.0. Only
+# the version in the tree can be rendered, so a pin is a compatibility
+# constraint: golang@1.2.0 accepts any 1.x at or above 1.2.0 (0.x versions
+# must also share the minor, since 0.x minors may break). Anything else
+# would silently change a customer's app, so it fails until the caller
+# asks for an upgrade.
+
+_SEMVER = re.compile(r"v?(\d+)\.(\d+)\.(\d+)")
+
+
+class TemplateVersionError(Exception):
+    """A template reference or version pin cannot be satisfied"""
+
+
+def parse_version(version: str) -> Tuple[int, int, int]:
+    """Parse "1.2.0" or "v1.2.0" into its numeric parts"""
+    match = _SEMVER.fullmatch(version.strip())
+    if not match:
+        raise TemplateVersionError(f"invalid template version {version!r} (want MAJOR.MINOR.PATCH)")
+    return tuple(int(part) for part in match.groups())
+
+
+def parse_template_ref(ref: str) -> Tuple[str, Optional[str]]:
+    """Split "golang@v1.2.0" into ("golang", "1.2.0"); the version is None if unpinned"""
+    name, _, version = ref.partition("@")
+    if not version:
+        return name, None
+    return name, "%d.%d.%d" % parse_version(version)
+
+
+def check_pin(manifest: Dict[str, Any], pinned: Optional[str]) -> None:
+    """
+    Check the template in the tree satisfies a version pin
+
+    Raises:
+        TemplateVersionError: if rendering would change the pinned version
+            incompatibly
+    """
+    if not pinned:
+        return
+    current, want = parse_version(manifest["version"]), parse_version(pinned)
+    if current < want:
+        raise TemplateVersionError(
+            f"{manifest['name']} is pinned to {pinned}, newer than the {manifest['version']} available"
+        )
+    if current[0] != want[0] or (want[0] == 0 and current[1] != want[1]):
+        raise TemplateVersionError(
+            f"{manifest['name']} is at {manifest['version']}, which is not compatible "
+            f"with the pinned {pinned}; upgrade explicitly to render {manifest['version']}"
+        )
+
+
+# ============================================================================
+# MIXINS
+# ============================================================================
+#
+# A mixin adds one optional feature to a Go template when it is rendered,
+# so an API on Postgres with Redis is golang+postgres+redis rather than a
+# template of its own. templates/mixins/<name>.json describes it like a
+# manifest, with the templates it composes with and how it is wired in:
+#
+#     {"name": "postgres", "title": "Postgres", "description": "...",
+#      "templates": ["golang", ...],
+#      "files": {"postgres.go": "mixins/postgres/postgres.go", ...},
+#      "variables": [...],
+#      "framework": "pgx",
+#      "setup_docs": "Markdown for the README's local development section",
+#      "go": {"settings": "postgresSettings", "setup": "setupPostgres",
+#             "require": ["github.com/jackc/pgx/v5 v5.8.0", ...],
+#             "sum": "golang-postgres/go.sum"}}
+#
+# settings names the mixin's setting table, if it has one, and setup its
+# func(*http.ServeMux) error. Both are wired in by mixins.go, which
+# openluffy writes in place of the template's own, so main.go adds the
+# settings and runs the setups, in the order given, before setupApp.
+# require and sum are merged into the app's go.mod and go.sum.
+#
+# Mixins go between the template and its version: golang+postgres@0.1.0.
+# They live in the same tree as the templates, so the template's version
+# covers them.
+
+MIXINS_DIR = TEMPLATES_DIR / "mixins"
+
+MIXIN_WIRING = "mixins.go"
+_MIXIN_NAME = re.compile(r"[a-z][a-z0-9-]*")
+
+
+class TemplateCompositionError(TemplateVersionError):
+    """A template reference names mixins that do not compose with its template"""
+
+
+def load_mixin(name: str, templates_dir: Path = TEMPLATES_DIR) -> Dict[str, Any]:
+    """
+    Load a mixin's manifest
+
+    Raises:
+        TemplateCompositionError: if there is no such mixin
+    """
+    path = templates_dir / "mixins" / f"{name}.json"
+    if not _MIXIN_NAME.fullmatch(name) or not path.is_file():
+        raise TemplateCompositionError(f"unknown mixin {name!r}")
+    with open(path) as f:
+        return json.load(f)
+
+
+def list_mixins() -> List[Dict[str, Any]]:
+    """Load every mixin's manifest, sorted by name"""
+    return [load_mixin(path.stem) for path in sorted(MIXINS_DIR.glob("*.json"))]
+
+
+def compose_manifest(manifest: Dict[str, Any], mixins: List[Dict[str, Any]]) -> Dict[str, Any]:
+    """
+    Compose a template with mixins into one manifest, named like
+    golang+postgres, that every caller renders as it would a template
+
+    Raises:
+        TemplateCompositionError: listing every reason they do not compose
+    """
+    problems = []
+    files = dict(manifest["files"])
+    variables = {var["name"]: dict(var) for var in manifest["variables"]}
+    names = [mixin["name"] for mixin in mixins]
+    for mixin in mixins:
+        name = mixin["name"]
+        if manifest["name"] not in mixin["templates"]:
+            problems.append(f"{name} does not compose with {manifest['name']} "
+                            f"(only with {', '.join(mixin['templates'])})")
+            continue
+        if names.count(name) > 1:
+            problems.append(f"{name} is given more than once")
+            continue
+        for target, template_file in mixin["files"].items():
+            if target in files or target in (MIXIN_WIRING, "go.mod", "go.sum"):
+                problems.append(f"{name} renders {target}, which {manifest['name']} or another mixin already does")
+            files[target] = template_file
+        for var in mixin.get("variables", []):
+            if var["name"] in variables and variables[var["name"]] != var:
+                problems.append(f"{name} declares variable {var['name']} differently")
+            variables.setdefault(var["name"], dict(var))
+    if problems:
+        raise TemplateCompositionError(f"cannot compose {'+'.join([manifest['name'], *names])}: "
+                                       + "; ".join(problems))
+
+    # The README says what the app is built on and how to run it locally
+    for mixin in mixins:
+        if "FRAMEWORK" in variables and mixin.get("framework"):
+            variables["FRAMEWORK"]["default"] += " + " + mixin["framework"]
+        if "STACK_SETUP" in variables and mixin.get("setup_docs"):
+            variables["STACK_SETUP"]["default"] += "\n\n" + mixin["setup_docs"]
+
+    return dict(
+        manifest,
+        name="+".join([manifest["name"], *names]),
+        title=" + ".join([manifest["title"], *(mixin["title"] for mixin in mixins)]),
+        files=files,
+        variables=list(variables.values()),
+        mixins=mixins,
+    )
+
+
+def wire_mixins(rendered: Dict[str, str], mixins: List[Dict[str, Any]], templates_dir: Path) -> None:
+    """Write the mixins' wiring, go.mod and go.sum into a rendered app"""
+    rendered[MIXIN_WIRING] = mixin_wiring(mixins)
+    requires = [line for mixin in mixins for line in mixin["go"].get("require", [])]
+    rendered["go.mod"] = merge_go_mod(rendered["go.mod"], requires)
+    sums = [rendered.get("go.sum", "")]
+    sums += [(templates_dir / mixin["go"]["sum"]).read_text() for mixin in mixins if mixin["go"].get("sum")]
+    lines = {line for text in sums for line in text.splitlines() if line.strip()}
+    if lines:
+        rendered["go.sum"] = "".join(f"{line}\n" for line in sorted(lines))
+
+
+# mixins.go for an app with mixins, rendered as the templates are
+_WIRING_TEMPLATE = """package main
+
+import (
+\t"fmt"
+\t"net/http"
+[% if SETTINGS %]
+\t"slices"
+[% end %]
+)
+
+// Mixins are optional features added to the app when it is rendered. Each
+// brings its own files and is wired in here: mixinSettings joins the
+// settings table (config.go) and setupMixins runs every mixin's setup, in
+// order, before setupApp, so the app's own code can use what they open.
+// openluffy writes this file; this app was rendered with:
+//
+[% for MIXIN in MIXINS %]
+//\t[% MIXIN.label %]  [% MIXIN.title %]
+[% end %]
+
+[% if SETTINGS %]
+var mixinSettings = slices.Concat([% for TABLE in SETTINGS %][% TABLE %][% if not loop.last %], [% end %][% end %])
+[% else %]
+var mixinSettings []setting
+[% end %]
+
+func setupMixins(mux *http.ServeMux) error {
+\tfor _, mixin := range []struct {
+\t\tname  string
+\t\tsetup func(*http.ServeMux) error
+\t}{
+[% for MIXIN in MIXINS %]
+\t\t{"[% MIXIN.name | go %]", [% MIXIN.setup %]},
+[% end %]
+\t} {
+\t\tif err := mixin.setup(mux); err != nil {
+\t\t\treturn fmt.Errorf("%s: %w", mixin.name, err)
+\t\t}
+\t}
+\treturn nil
+}
+"""
+
+
+def mixin_wiring(mixins: List[Dict[str, Any]]) -> str:
+    """mixins.go for an app with mixins, gofmt-formatted"""
+    width = max(len(mixin["name"]) for mixin in mixins)
+    return render_template(_WIRING_TEMPLATE, {
+        "MIXINS": [{"name": mixin["name"], "label": f"{mixin['name']:<{width}}", "title": mixin["title"],
+                    "setup": mixin["go"]["setup"]} for mixin in mixins],
+        "SETTINGS": [mixin["go"]["settings"] for mixin in mixins if mixin["go"].get("settings")],
+    }, MIXIN_WIRING)
+
+
+_GO_REQUIRE = re.compile(r"(\S+)\s+(v\S+)(\s*//\s*indirect)?")
+
+
+def _module_version(version: str) -> Tuple:
+    """Sort key for module versions: releases above their pre-releases and pseudo-versions"""
+    match = _SEMVER.match(version)
+    if not match:
+        return ()
+    pre = version[match.end():]
+    return tuple(int(part) for part in match.groups()) + (not pre, pre)
+
+
+def merge_go_mod(go_mod: str, requires: List[str]) -> str:
+    """
+    Add requirements to a go.mod, keeping the higher version of a module
+    both require, as the go command's minimal version selection would
+
+    Args:
+        go_mod: The rendered go.mod
+        requires: "path version" lines, with a "// indirect" comment for
+            modules the app does not import directly
+
+    Returns:
+        The go.mod with one block of direct and one of indirect
+        requirements, as go mod tidy writes them
+    """
+    modules: Dict[str, Tuple[str, bool]] = {}
+
+    def add(line: str) -> None:
+        match = _GO_REQUIRE.fullmatch(line.strip())
+        if not match:
+            raise ValueError(f"not a go.mod requirement: {line!r}")
+        path, version, indirect = match.group(1), match.group(2), bool(match.group(3))
+        if path in modules:
+            old_version, old_indirect = modules[path]
+            version = max(version, old_version, key=_module_version)
+            indirect = indirect and old_indirect
+        modules[path] = (version, indirect)
+
+    head, in_block = [], False
+    for line in go_mod.splitlines():
+        stripped = line.strip()
+        if in_block:
+            if stripped == ")":
+                in_block = False
+            elif stripped:
+                add(stripped)
+        elif stripped == "require (":
+            in_block = True
+        elif stripped.startswith("require "):
+            add(stripped[len("require "):])
+        else:
+            head.append(line)
+    for line in requires:
+        add(line)
+
+    out = "\n".join(head).rstrip("\n") + "\n"
+    for indirect in (False, True):
+        block = sorted(path for path, (_, i) in modules.items() if i == indirect)
+        lines = [f"{path} {modules[path][0]}{' // indirect' if indirect else ''}" for path in block]
+        if len(lines) == 1:
+            out += f"\nrequire {lines[0]}\n"
+        elif lines:
+            out += "\nrequire (\n" + "".join(f"\t{line}\n" for line in lines) + ")\n"
+    return out
@@ -0,0 +1,349 @@
+"""
+Template Upgrades
+Upgrades an app rendered from an older template to the current one by a
+three-way merge, so customers pick up template fixes without regenerating
+and losing their own changes
+"""
+import difflib
+import io
+import json
+import subprocess
+import tarfile
+import tempfile
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import Any, Dict, List, Mapping, Optional, Tuple
+
+from template_renderer import (
+    TEMPLATES_DIR, RECORD_PATH, GENERATED_PATHS, load_manifest, resolve_variables, render_files,
+    without_render_time, TemplateVersionError
+)
+
+
+# ============================================================================
+# THREE-WAY MERGE
+# ============================================================================
+#
+# For every file either template renders, three versions are compared:
+#
+#     base    the old template rendered with the app's variables, which is
+#             what the app looked like before the customer changed it
+#     ours    the file in the app as it is now
+#     theirs  the new template rendered with the same variables
+#
+# A file the customer never touched takes the new template's version; a
+# file the template did not change keeps the customer's. Only files both
+# changed are merged line by line (git merge-file), and only overlapping
+# edits conflict. Adds and deletes follow the same rule: the template
+# removing a file the customer edited, or changing one they deleted, is a
+# conflict for them to resolve.
+#
+# Old templates come from the git history of this repository, so base can
+# be rendered exactly as it was. The render record (RECORD_PATH) says
+# which commit an app was rendered from; apps rendered before it existed
+# name the old version or commit instead.
+
+class TemplateUpgradeError(Exception):
+    """An upgrade cannot be computed, e.g. the old template is not found"""
+
+
+@dataclass
+class FileChange:
+    """The upgrade of one file; content is None when the file is deleted"""
+    path: str
+    action: str  # "add", "update", "delete" or "conflict"
+    content: Optional[str] = None
+    reason: str = ""
+
+
+@dataclass
+class Upgrade:
+    from_template: str
+    from_version: str
+    template: str
+    to_version: str
+    changes: List[FileChange] = field(default_factory=list)
+    ours: Dict[str, Optional[str]] = field(default_factory=dict)
+
+    @property
+    def conflicts(self) -> List[FileChange]:
+        return [c for c in self.changes if c.action == "conflict"]
+
+
+def merge_file(path: str, ours: str, base: str, theirs: str) -> Tuple[str, bool]:
+    """
+    Merge the new template's changes to path into the customer's version
+
+    Returns:
+        The merged text, with conflict markers around edits that overlap,
+        and whether it merged cleanly
+    """
+    with tempfile.TemporaryDirectory() as tmp:
+        names = []
+        for label, text in (("ours", ours), ("base", base), ("theirs", theirs)):
+            p = Path(tmp) / label
+            p.write_text(text)
+            names.append(str(p))
+        proc = subprocess.run(
+            ["git", "merge-file", "-p", "-L", f"{path} (yours)", "-L", f"{path} (base)",
+             "-L", f"{path} (template)", *names],
+            capture_output=True, text=True,
+        )
+    # The exit status is the number of conflicts, or above 127 on an error
+    if proc.returncode > 127:
+        raise TemplateUpgradeError(f"git merge-file failed on {path}: {proc.stderr.strip()}")
+    return proc.stdout, proc.returncode == 0
+
+
+def plan_upgrade(base: Mapping[str, str], theirs: Mapping[str, str],
+                 ours: Mapping[str, Optional[str]]) -> List[FileChange]:
+    """
+    Work out the upgrade of every file base or theirs renders
+
+    Args:
+        base: The old template's render
+        theirs: The new template's render
+        ours: The app's current content of those paths; None if missing
+
+    Returns:
+        The changes to make, sorted by path; unchanged files are left out
+    """
+    changes, generated = [], []
+    for path in sorted(set(base) | set(theirs)):
+        b, t, o = base.get(path), theirs.get(path), ours.get(path)
+        if path in GENERATED_PATHS:
+            # They describe the render, never the customer's edits
+            generated.append((path, t, o))
+            continue
+        if o == t or b == t:
+            continue  # already upgraded, or the template did not change it
+        if o == b:
+            if t is None:
+                changes.append(FileChange(path, "delete"))
+            else:
+                changes.append(FileChange(path, "add" if o is None else "update", t))
+            continue
+
+        # Both the customer and the template changed the file
+        if t is None:
+            changes.append(FileChange(path, "conflict", o, "you changed it; the new template removes it"))
+        elif o is None:
+            changes.append(FileChange(path, "conflict", None, "you removed it; the new template changes it"))
+        else:
+            merged, clean = merge_file(path, o, b or "", t)
+            if not clean:
+                what = "you and the new template both add it" if b is None else "your changes overlap the template's"
+                changes.append(FileChange(path, "conflict", merged, what))
+            elif merged != o:
+                changes.append(FileChange(path, "update", merged))
+
+    # Every render is stamped with its time: an app the new template would
+    # render the same is up to date whenever it was rendered
+    for path, t, o in generated:
+        if t != o and (changes or without_render_time(t) != without_render_time(o)):
+            action = "delete" if t is None else "add" if o is None else "update"
+            changes.append(FileChange(path, action, t))
+    return sorted(changes, key=lambda change: change.path)
+
+
+# ============================================================================
+# OLD TEMPLATES
+# ============================================================================
+
+def _git(*args: str) -> str:
+    proc = subprocess.run(["git", *args], cwd=TEMPLATES_DIR, capture_output=True, text=True)
+    if proc.returncode != 0:
+        raise TemplateUpgradeError(f"git {args[0]} failed: {proc.stderr.strip()}")
+    return proc.stdout
+
+
+def templates_prefix() -> str:
+    """Path of the templates tree within the repository, e.g. backend/templates/"""
+    return _git("rev-parse", "--show-prefix").strip()
+
+
+def find_revision(name: str, version: str) -> str:
+    """
+    The newest commit whose manifest for template name has the version
+
+    Raises:
+        TemplateUpgradeError: if no commit does
+    """
+    manifest = f"{templates_prefix()}manifests/{name}.json"
+    for revision in _git("log", "--format=%H", "--", f":(top){manifest}").split():
+        try:
+            old = json.loads(_git("show", f"{revision}:{manifest}"))
+        except (TemplateUpgradeError, ValueError):
+            continue  # the commit deleted it, or it did not parse
+        if old.get("version") == version:
+            return revision
+    raise TemplateUpgradeError(f"no commit has {name} at version {version}")
+
+
+def snapshot_templates(revision: str, dest: Path) -> Path:
+    """Extract the templates tree as of revision into dest and return it"""
+    # git archive refuses to run from a subdirectory
+    root = _git("rev-parse", "--show-toplevel").strip()
+    archive = subprocess.run(
+        ["git", "archive", "--format=tar", f"{revision}:{templates_prefix().rstrip('/')}"],
+        cwd=root, capture_output=True,
+    )
+    if archive.returncode != 0:
+        raise TemplateUpgradeError(f"cannot read the templates at {revision}: "
+                                   f"{archive.stderr.decode(errors='replace').strip()}")
+    with tarfile.open(fileobj=io.BytesIO(archive.stdout)) as tar:
+        tar.extractall(dest, filter="data")
+    return dest
+
+
+def render_with(manifest: Dict[str, Any], values: Mapping[str, str], templates_dir: Path,
+                revision: Optional[str]) -> Dict[str, str]:
+    """
+    Render a template with an app's values, keeping only those the template
+    declares: variables come and go between versions
+    """
+    declared = {var["name"] for var in manifest["variables"]}
+    given = {k: v for k, v in values.items() if k in declared}
+    if "TEMPLATE_VERSION" in declared:
+        given["TEMPLATE_VERSION"] = manifest["version"]
+    return render_files(manifest, resolve_variables(manifest, given), templates_dir, revision)
+
+
+# ============================================================================
+# UPGRADES
+# ============================================================================
+
+def load_record(app_dir: Path) -> Optional[Dict[str, Any]]:
+    """The app's render record, or None if it predates them"""
+    path = app_dir / RECORD_PATH
+    if not path.is_file():
+        return None
+    try:
+        return json.loads(path.read_text())
+    except ValueError as e:
+        raise TemplateUpgradeError(f"{path} is not valid JSON: {e}")
+
+
+def upgrade_app(app_dir: Path, template: Optional[str] = None, from_version: Optional[str] = None,
+                from_revision: Optional[str] = None, values: Optional[Mapping[str, str]] = None) -> Upgrade:
+    """
+    Compute the upgrade of an app to the current template
+
+    Args:
+        app_dir: The rendered app, with the customer's changes
+        template: Template to upgrade to, with any mixins; defaults to the
+            one the app was rendered from. Naming mixins the app lacks adds
+            them
+        from_version: Template version the app was rendered from, when it
+            has no render record
+        from_revision: Commit the app was rendered from; overrides the
+            record and from_version
+        values: Variables overriding the recorded ones; an app without a
+            record needs at least the required ones
+
+    Raises:
+        TemplateUpgradeError: if the old or new template cannot be found
+        TemplateVersionError: if the new template's mixins do not compose
+        TemplateRenderError: if either does not render with the values
+    """
+    record = load_record(app_dir) or {}
+    name = template or record.get("template")
+    if not name:
+        raise TemplateUpgradeError(f"{app_dir} has no {RECORD_PATH}; name the template to upgrade to")
+    manifest = load_manifest(name)
+    if not manifest:
+        raise TemplateUpgradeError(f"unknown template {name!r}")
+
+    old_name = record.get("template", name)
+    revision = from_revision
+    if not revision and not from_version:
+        revision = record.get("revision")
+    if not revision:
+        version = from_version or record.get("version")
+        if not version:
+            raise TemplateUpgradeError(f"{app_dir} has no {RECORD_PATH}; give the version it was rendered from")
+        revision = find_revision(old_name.split("+")[0], version)
+    try:
+        revision = _git("rev-parse", "--verify", "--quiet", f"{revision}^{{commit}}").strip()
+    except TemplateUpgradeError:
+        raise TemplateUpgradeError(f"{revision} is not a commit of this repository")
+
+    merged_values = dict(record.get("variables", {}))
+    merged_values.update(values or {})
+
+    with tempfile.TemporaryDirectory() as tmp:
+        old_dir = snapshot_templates(revision, Path(tmp))
+        try:
+            old_manifest = load_manifest(old_name, old_dir)
+        except TemplateVersionError as e:
+            raise TemplateUpgradeError(f"{e} at {revision[:12]}")
+        if not old_manifest:
+            raise TemplateUpgradeError(f"{old_name} does not exist at {revision[:12]}")
+        base = render_with(old_manifest, merged_values, old_dir, revision)
+    theirs = render_with(manifest, merged_values, TEMPLATES_DIR, None)
+
+    ours = {}
+    for path in set(base) | set(theirs):
+        file = app_dir / path
+        ours[path] = file.read_text() if file.is_file() else None
+
+    return Upgrade(
+        from_template=old_name,
+        from_version=old_manifest["version"],
+        template=name,
+        to_version=manifest["version"],
+        changes=plan_upgrade(base, theirs, ours),
+        ours=ours,
+    )
+
+
+def _diff_lines(text: Optional[str]) -> List[str]:
+    return text.splitlines(keepends=True) if text else []
+
+
+def format_patch(upgrade: Upgrade) -> str:
+    """
+    The clean changes of an upgrade as a unified diff that git apply and
+    patch -p1 accept; conflicts are left out
+    """
+    out = []
+    for change in upgrade.changes:
+        if change.action == "conflict":
+            continue
+        old, new = upgrade.ours.get(change.path), change.content
+        diff = difflib.unified_diff(
+            _diff_lines(old), _diff_lines(new),
+            fromfile="/dev/null" if old is None else f"a/{change.path}",
+            tofile="/dev/null" if new is None else f"b/{change.path}",
+        )
+        lines = list(diff)
+        if not lines:
+            continue
+        out.append(f"diff --git a/{change.path} b/{change.path}\n")
+        if old is None:
+            out.append("new file mode 100644\n")
+        elif new is None:
+            out.append("deleted file mode 100644\n")
+        for line in lines:
+            out.append(line)
+            if not line.endswith("\n"):
+                out.append("\n\\ No newline at end of file\n")
+    return "".join(out)
+
+
+def apply_upgrade(upgrade: Upgrade, app_dir: Path) -> None:
+    """
+    Write an upgrade into the app: clean changes as they are, overlapping
+    edits with conflict markers. Files the customer and the template
+    disagree on keeping are left alone.
+    """
+    for change in upgrade.changes:
+        file = app_dir / change.path
+        if change.content is None:
+            if change.action == "delete":
+                file.unlink(missing_ok=True)
+            continue
+        if change.action == "conflict" and upgrade.ours.get(change.path) == change.content:
+            continue
+        file.parent.mkdir(parents=True, exist_ok=True)
+        file.write_text(change.content)
@@ -0,0 +1,263 @@
+"""
+Template Validation
+Renders each template with sample variables and compiles the result in a
+sandbox, so a template that renders to broken code never gets published
+"""
+import base64
+import hashlib
+import os
+import re
+import shutil
+import subprocess
+import sys
+import tempfile
+from pathlib import Path
+from typing import Any, Dict, List, Optional
+
+from template_renderer import (
+    TEMPLATES_DIR, list_manifests, list_mixins, load_manifest, resolve_variables, render_files, TemplateRenderError
+)
+
+
+# ============================================================================
+# SAMPLE VARIABLES
+# ============================================================================
+#
+# Values for the variables every manifest requires, standing in for what
+# template_values supplies from a real customer. CUSTOMER_NAME is awkward
+# on purpose: quotes, an ampersand and a format verb break any template
+# that interpolates it without the right filter, e.g. into a Printf format
+# string, which go vet then reports.
+
+SAMPLE_VALUES = {
+    "CUSTOMER_ID": "sample",
+    "CUSTOMER_NAME": 'Sample "Co" & Sons 100%s',
+    "GITHUB_OWNER": "sample-org",
+    "REPO_NAME": "sample-app",
+    "APP_NAME": "sample-app",
+    "NAMESPACE": "sample-dev",
+}
+
+# Steps run on a rendered Go template, in order. gofmt -l lists the files
+# that are not formatted, and succeeds regardless, so its output is the
+# failure.
+GO_STEPS = [
+    ("gofmt", ["gofmt", "-l", "."]),
+    ("go vet", ["go", "vet", "./..."]),
+    ("go build", ["go", "build", "./..."]),
+]
+
+# Node.js and Python templates are only syntax-checked: their dependencies
+# are not installed in the sandbox.
+NODE_STEPS = [("node --check", ["node", "--check", "index.js"])]
+PYTHON_STEPS = [("py_compile", [sys.executable, "-m", "py_compile", "app.py"])]
+
+# The toolchain each language's steps need, and the steps
+LANGUAGE_STEPS = {
+    "Go": ("go", GO_STEPS),
+    "JavaScript": ("node", NODE_STEPS),
+    "Python": (sys.executable, PYTHON_STEPS),
+}
+
+STEP_TIMEOUT = int(os.environ.get("TEMPLATE_VALIDATION_TIMEOUT", "300"))
+
+# The sandbox passes the toolchain only what it needs to find itself and
+# its caches; nothing from the backend's environment (tokens, database
+# URLs) reaches the rendered code or its build.
+_PASSTHROUGH_ENV = ("PATH", "HOME", "GOPATH", "GOMODCACHE", "GOCACHE", "GOPROXY", "GONOSUMDB", "GOPRIVATE")
+
+
+def sandbox_env() -> Dict[str, str]:
+    env = {k: os.environ[k] for k in _PASSTHROUGH_ENV if k in os.environ}
+    env.update({
+        # Fail rather than fix up an incomplete go.mod or go.sum, as a
+        # customer's CI would
+        "GOFLAGS": "-mod=readonly",
+        "GOTOOLCHAIN": "local",
+        "GOWORK": "off",
+        "CGO_ENABLED": "0",
+    })
+    return env
+
+
+def _run_step(name: str, cmd: List[str], cwd: Path) -> Dict[str, Any]:
+    try:
+        proc = subprocess.run(
+            cmd, cwd=cwd, env=sandbox_env(), capture_output=True, text=True, timeout=STEP_TIMEOUT
+        )
+    except subprocess.TimeoutExpired:
+        return {"step": name, "ok": False, "output": f"timed out after {STEP_TIMEOUT}s"}
+    output = (proc.stdout + proc.stderr).strip()
+    ok = proc.returncode == 0 and not (name == "gofmt" and output)
+    if name == "gofmt" and output:
+        output = "not gofmt-formatted:\n" + output
+    return {"step": name, "ok": ok, "output": output}
+
+
+# The SDK module the golang-sdk template imports. Rendered apps are built
+# against this checkout of it rather than a published version, so a
+# template change and the SDK change it needs can land together before the
+# release is tagged; the go.sum check keeps the template's pinned hashes
+# in step with what the tag will hold.
+SDK_MODULE = "github.com/lebrick07/openluffy/openluffy-sdk"
+SDK_DIR = Path(__file__).resolve().parent.parent / "openluffy-sdk"
+
+
+# The SDK files generated from the golang template's (SDK path -> template
+# path), so the runtime code both carry is fixed in one place. Only the
+# package clause changes; the template files use no template tags and
+# nothing outside themselves. ./openluffy.py sdk-sync writes them, and
+# validating a template that uses the SDK fails while one is out of date.
+SDK_GENERATED = {
+    "config/configfile.go": "golang/configfile.go",
+    "health/pool.go": "golang/pool.go",
+    "middleware/errorcode.go": "golang/errorcode.go",
+    "middleware/requestid.go": "golang/requestid.go",
+}
+
+
+def generated_sdk_files() -> Dict[str, str]:
+    """The content of each SDK_GENERATED file, generated from the template"""
+    files = {}
+    for target, source in SDK_GENERATED.items():
+        text = (TEMPLATES_DIR / source).read_text()
+        header = f"// Code generated by ./openluffy.py sdk-sync from backend/templates/{source}. DO NOT EDIT.\n\n"
+        files[target] = header + re.sub(r"^package main$", f"package {Path(target).parent.name}", text, count=1, flags=re.M)
+    return files
+
+
+def stale_sdk_files() -> List[str]:
+    """The SDK_GENERATED files that differ from what sdk-sync would write"""
+    stale = []
+    for target, content in generated_sdk_files().items():
+        path = SDK_DIR / target
+        if not path.is_file() or path.read_text() != content:
+            stale.append(target)
+    return stale
+
+
+def sync_sdk() -> List[str]:
+    """Write the stale SDK_GENERATED files, returning their paths"""
+    stale = stale_sdk_files()
+    for target in stale:
+        (SDK_DIR / target).write_text(generated_sdk_files()[target])
+    return stale
+
+
+def _hash1(files: List[Any]) -> str:
+    """Go's dirhash.Hash1 over (name, content) pairs"""
+    summary = hashlib.sha256()
+    for name, data in sorted(files):
+        summary.update(f"{hashlib.sha256(data).hexdigest()}  {name}\n".encode())
+    return "h1:" + base64.b64encode(summary.digest()).decode()
+
+
+def sdk_sums(version: str) -> List[str]:
+    """The go.sum lines of SDK_DIR tagged as version, e.g. v0.1.0"""
+    prefix = f"{SDK_MODULE}@{version}"
+    files = []
+    for dirpath, dirnames, filenames in os.walk(SDK_DIR):
+        dirnames[:] = [d for d in dirnames if not d.startswith(".")]
+        for filename in filenames:
+            path = Path(dirpath) / filename
+            files.append((f"{prefix}/{path.relative_to(SDK_DIR).as_posix()}", path.read_bytes()))
+    go_mod = (SDK_DIR / "go.mod").read_bytes()
+    return [
+        f"{SDK_MODULE} {version} {_hash1(files)}",
+        f"{SDK_MODULE} {version}/go.mod {_hash1([('go.mod', go_mod)])}",
+    ]
+
+
+def use_local_sdk(rendered: Dict[str, str], root: Path) -> Optional[Dict[str, Any]]:
+    """
+    Point a rendered app that requires the SDK at SDK_DIR, after checking
+    that its version matches app.Version and its go.sum matches SDK_DIR
+
+    Returns the step's report, or None when the app does not use the SDK.
+    """
+    match = re.search(rf"^\s*(?:require\s+)?{re.escape(SDK_MODULE)}\s+(v\S+)", rendered.get("go.mod", ""), re.M)
+    if not match:
+        return None
+    version, problems = match.group(1), []
+    app_go = SDK_DIR / "app" / "app.go"
+    if not app_go.is_file():
+        return {"step": "sdk", "ok": False, "output": f"{SDK_DIR} not found"}
+    for target in stale_sdk_files():
+        problems.append(f"openluffy-sdk/{target} is out of date with backend/templates/{SDK_GENERATED[target]}; "
+                        "run ./openluffy.py sdk-sync")
+    sdk_version = re.search(r'^const Version = "([^"]+)"', app_go.read_text(), re.M)
+    if not sdk_version or f"v{sdk_version.group(1)}" != version:
+        problems.append(f"go.mod requires {version} but openluffy-sdk/app/app.go has Version "
+                        f"{sdk_version.group(1) if sdk_version else '(missing)'}")
+    expected = sdk_sums(version)
+    if not set(expected) <= set(rendered.get("go.sum", "").splitlines()):
+        problems.append("go.sum does not match openluffy-sdk; its lines for the SDK should be:\n" + "\n".join(expected))
+    if problems:
+        return {"step": "sdk", "ok": False, "output": "\n".join(problems)}
+    return _run_step("sdk", ["go", "mod", "edit", f"-replace={SDK_MODULE}={SDK_DIR}"], root)
+
+
+def render_sample(manifest: Dict[str, Any]) -> Dict[str, str]:
+    """Render a template with the sample variables; raises TemplateRenderError"""
+    values = dict(SAMPLE_VALUES, TEMPLATE_VERSION=manifest["version"])
+    return render_files(manifest, resolve_variables(manifest, values))
+
+
+def write_files(rendered: Dict[str, str], root: Path) -> None:
+    for path, content in rendered.items():
+        out = root / path
+        out.parent.mkdir(parents=True, exist_ok=True)
+        out.write_text(content)
+
+
+def validate_template(manifest: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Render a template with the sample variables and check the result
+
+    Templates are written to a temporary directory and checked there: Go
+    ones with gofmt, go vet and go build, Node.js and Python ones for
+    syntax. Other languages are only rendered.
+
+    Returns:
+        {"template", "version", "ok", "steps": [{"step", "ok", "output"}]}
+    """
+    report = {"template": manifest["name"], "version": manifest["version"], "ok": False, "steps": []}
+    steps = report["steps"]
+
+    try:
+        rendered = render_sample(manifest)
+    except TemplateRenderError as e:
+        steps.append({"step": "render", "ok": False, "output": "\n".join(e.problems)})
+        return report
+    steps.append({"step": "render", "ok": True, "output": f"{len(rendered)} files"})
+
+    if manifest.get("language") in LANGUAGE_STEPS:
+        tool, language_steps = LANGUAGE_STEPS[manifest["language"]]
+        if not shutil.which(tool):
+            steps.append({"step": tool, "ok": False, "output": f"{tool} toolchain not found on PATH"})
+            return report
+        with tempfile.TemporaryDirectory(prefix=f"template-{manifest['name']}-") as tmpdir:
+            root = Path(tmpdir)
+            write_files(rendered, root)
+            sdk = use_local_sdk(rendered, root)
+            if sdk:
+                steps.append(sdk)
+                if not sdk["ok"]:
+                    return report
+            for name, cmd in language_steps:
+                steps.append(_run_step(name, cmd, root))
+
+    report["ok"] = all(step["ok"] for step in steps)
+    return report
+
+
+def validate_templates(names: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+    """
+    Validate the named templates, which may have mixins (golang+postgres),
+    or if names is empty every template, and every mixin on the first
+    template it composes with
+    """
+    if not names:
+        names = [m["name"] for m in list_manifests(unlisted=True)]
+        names += [f"{mixin['templates'][0]}+{mixin['name']}" for mixin in list_mixins()]
+    return [validate_template(load_manifest(name)) for name in names]
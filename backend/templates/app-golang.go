@@ -1,128 +1,202 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-type HealthResponse struct {
-	Status    string `json:"status"`
-	Timestamp string `json:"timestamp"`
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck())
+	}
+	setupLogging()
+	validateConfig()
+	loadFeatureFlags()
+	setupTracing()
+	setupErrorReporting()
+	setupProfiling()
+	http.DefaultTransport = &propagatingTransport{base: http.DefaultTransport}
 
-type RootResponse struct {
-	Message     string `json:"message"`
-	Environment string `json:"environment"`
-	Version     string `json:"version"`
-}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(HealthResponse{
-		Status:    "healthy",
-		Timestamp: time.Now().Format(time.RFC3339),
-	})
-}
+	port := conf("PORT")
 
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	env := os.Getenv("ENVIRONMENT")
-	if env == "" {
-		env = "development"
-	}
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	html := fmt.Sprintf(`
-<!DOCTYPE html>
-<html lang="en">
-<head>
-  <meta charset="UTF-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <title>{{CUSTOMER_NAME}}</title>
-  <style>
-    * { margin: 0; padding: 0; box-sizing: border-box; }
-    body {
-      font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-      background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
-      min-height: 100vh;
-      display: flex;
-      align-items: center;
-      justify-content: center;
-      padding: 20px;
-    }
-    .container {
-      background: rgba(255, 255, 255, 0.95);
-      border-radius: 20px;
-      box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
-      padding: 60px 40px;
-      text-align: center;
-      max-width: 600px;
-      width: 100%%;
-    }
-    h1 {
-      font-size: 3rem;
-      color: #2d3748;
-      margin-bottom: 20px;
-      font-weight: 800;
-    }
-    .subtitle {
-      font-size: 1.2rem;
-      color: #718096;
-      margin-bottom: 40px;
-    }
-    .badge {
-      display: inline-block;
-      padding: 8px 16px;
-      border-radius: 20px;
-      font-size: 0.875rem;
-      font-weight: 600;
-      text-transform: uppercase;
-      letter-spacing: 0.5px;
-    }
-    .badge.dev { background: #48bb78; color: white; }
-    .badge.preprod { background: #ed8936; color: white; }
-    .badge.prod { background: #667eea; color: white; }
-    .footer {
-      margin-top: 40px;
-      font-size: 0.875rem;
-      color: #a0aec0;
-    }
-  </style>
-</head>
-<body>
-  <div class="container">
-    <h1>{{CUSTOMER_NAME}}</h1>
-    <div class="subtitle">Application is running successfully</div>
-    <div class="badge %s">%s</div>
-    <div class="footer">Powered by OpenLuffy</div>
-  </div>
-</body>
-</html>
-	`, env, env)
-	fmt.Fprint(w, html)
-}
+	if err := registerDependencies(); err != nil {
+		slog.Error("invalid health check configuration", "error", err)
+		os.Exit(1)
+	}
+	// STARTUP_WAIT_FOR: DEPENDENCIES first, then the app's own checks,
+	// all before the listener is bound.
+	startupWait := newStartupWait()
+	if err := startupWait.wait(ctx, false); err != nil {
+		exitStartupWait(ctx, err)
+	}
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// An explicit mux rather than http.DefaultServeMux: imported packages
+	// (net/http/pprof in particular) register handlers on the default mux,
+	// and those must not leak onto the public port.
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	if err := setupMixins(mux); err != nil {
+		slog.Error("mixin setup failed", "error", err)
+		os.Exit(1)
+	}
+	if err := setupApp(mux); err != nil {
+		slog.Error("app setup failed", "error", err)
+		os.Exit(1)
+	}
+	if err := startupWait.wait(ctx, true); err != nil {
+		exitStartupWait(ctx, err)
 	}
 
-	http.HandleFunc("/healthz", healthHandler)
-	http.HandleFunc("/", rootHandler)
+	startPprof(ctx, mux)
 
-	env := os.Getenv("ENVIRONMENT")
-	if env == "" {
-		env = "development"
+	limiter := newRateLimiter()
+	if limiter != nil {
+		go limiter.janitor(ctx)
 	}
 
-	fmt.Printf("Starting server on port %s\n", port)
-	fmt.Printf("Environment: %s\n", env)
+	// The platform middleware and the app's own, in the order chain.go
+	// documents.
+	handler := platformHandler(mux, limiter)
+
+	// Every onConfigReload hook is registered by now.
+	go watchConfig(ctx)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	srv := newServer(handler)
+
+	tlsConfig, err := setupTLS(ctx)
+	if err != nil {
+		slog.Error("invalid TLS configuration", "error", err)
+		os.Exit(1)
+	}
+	srv.TLSConfig = tlsConfig
+
+	// H2C_ENABLED=true additionally accepts HTTP/2 without TLS
+	// (prior-knowledge h2c), for gRPC-web proxies and ingresses that speak
+	// HTTP/2 to their backends. HTTP/1.1 and HTTP/2 over TLS stay enabled.
+	h2c := confBool("H2C_ENABLED")
+	if h2c {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	ln, err := listen(ctx, srv)
+	if err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+	adminSrv, err := startAdmin(ctx)
+	if err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("starting server", "addr", ln.Addr().String(), "port", port, "git_sha", version.GitSHA, "tls", tlsConfig != nil, "h2c", h2c,
+		"read_header_timeout", srv.ReadHeaderTimeout.String(),
+		"read_timeout", srv.ReadTimeout.String(),
+		"write_timeout", srv.WriteTimeout.String(),
+		"idle_timeout", srv.IdleTimeout.String(),
+		"max_header_bytes", srv.MaxHeaderBytes,
+		"keep_alives", confBool("HTTP_KEEP_ALIVES"),
+		"max_idle_conns", confInt("HTTP_MAX_IDLE_CONNS"),
+		"tcp_keep_alive_period", conf("HTTP_TCP_KEEP_ALIVE_PERIOD"))
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// Certificates come from TLSConfig.GetCertificate.
+			serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+	go runStartupTasks(ctx)
+
+	// Background services outlive the signal context: they are stopped
+	// only after the drain window, alongside the HTTP server.
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	backgroundFailed := startBackground(backgroundCtx)
+
+	failed := false
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	case err := <-backgroundFailed:
+		slog.Error("background service failed, shutting down", "error", err)
+		failed = true
+	case <-ctx.Done():
+	}
+	// Until the delay is over a second signal only skips the rest of it;
+	// after that one stops the process as usual.
+	skip := make(chan os.Signal, 1)
+	signal.Notify(skip, syscall.SIGTERM, os.Interrupt)
+	stop()
+
+	// SHUTDOWN_DELAY keeps serving for a while after SIGTERM with readiness
+	// failing, so endpoints controllers, kube-proxy and ingresses stop
+	// routing here before the listener closes; without it requests still in
+	// flight to this pod get 502s during rollouts. Keep-alives are disabled
+	// so clients reconnect elsewhere. A second signal skips the wait.
+	delay := confDuration("SHUTDOWN_DELAY")
+	beginDrain(delay)
+	if delay > 0 {
+		slog.Info("shutdown signal received, waiting before closing the listener", "delay", delay.String())
+		srv.SetKeepAlivesEnabled(false)
+		select {
+		case <-time.After(delay):
+		case <-skip:
+			slog.Info("second shutdown signal received, closing the listener now")
+		}
+	}
+	signal.Stop(skip)
+
+	// The requests in flight when the listener closes are logged as
+	// drained, or cancelled when SHUTDOWN_TIMEOUT cut them off: cancelled
+	// requests mean the timeout (and terminationGracePeriodSeconds) is
+	// shorter than the slowest requests.
+	timeout := confDuration("SHUTDOWN_TIMEOUT")
+	draining := time.Now()
+	inFlight := metrics.beginDraining()
+	slog.Info("shutting down, draining connections", "timeout", timeout.String(), "in_flight", inFlight)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stopBackground()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("graceful shutdown incomplete, closing remaining connections", "error", err, "in_flight", metrics.inFlight.Load())
+		metrics.beginForced()
+		srv.Close()
+	}
+	drained, cancelled := metrics.shutdownCounts()
+	slog.Info("connections drained", "in_flight", inFlight, "drained", drained, "cancelled", cancelled, "duration", time.Since(draining).Round(time.Millisecond).String())
+	if adminSrv != nil && adminSrv.Shutdown(shutdownCtx) != nil {
+		adminSrv.Close()
+	}
+	if err := waitBackground(shutdownCtx); err != nil {
+		slog.Warn("background services did not stop in time", "error", err)
+	}
+	runShutdownHooks(shutdownCtx)
+	shutdownTracing(shutdownCtx)
+	flushErrorReports(shutdownCtx)
+	flushProfiles(shutdownCtx)
+	slog.Info("server stopped")
+	flushLogs(shutdownCtx)
+	if failed {
+		os.Exit(1)
 	}
 }
@@ -1,87 +1,163 @@
+const crypto = require('crypto');
 const express = require('express');
+const fs = require('fs');
+const http = require('http');
+const os = require('os');
+const path = require('path');
+
 const app = express();
-const PORT = process.env.PORT || 3000;
+const APP_NAME = "[% APP_NAME | json %]";
+const TEMPLATE_VERSION = "[% TEMPLATE_VERSION %]";
+
+// Settings, as OpenLuffy's service spec declares them for every stack, so
+// a Go, Node.js or Python app is configured the same way. An unset or
+// empty environment variable takes the default the app was generated with.
+const SETTINGS = {
+[% for SETTING in SPEC_SETTINGS %]
+  [% SETTING.name %]: "[% SETTING.default | json %]",
+[% end %]
+};
+
+const conf = (name) => {
+  if (!Object.hasOwn(SETTINGS, name)) {
+    throw new Error(`undeclared setting ${name}`);
+  }
+  return process.env[name] || SETTINGS[name];
+};
+
+// Build metadata, from the Dockerfile's GIT_SHA and BUILD_TIME build args.
+const GIT_SHA = process.env.GIT_SHA || 'unknown';
+const BUILD_TIME = process.env.BUILD_TIME || 'unknown';
+
+const environment = conf('ENVIRONMENT').trim().toLowerCase() || 'development';
+
+const escapeHtml = (s) => s.replace(/[&<>"']/g, (c) => `&#${c.charCodeAt(0)};`);
+
+// The landing page, web/index.html, carries the branding; its theme and
+// environment badge are filled in per request. THEME picks one of the
+// looks its stylesheet has, falling back to the generated default.
+const THEMES = ['gradient', 'minimal', 'dark', 'corporate', 'playful'];
+const BADGE_COLORS = {
+  dev: '#48bb78', development: '#48bb78', test: '#38b2ac', qa: '#38b2ac', uat: '#805ad5',
+  staging: '#ed8936', preprod: '#ed8936', prod: '', production: '',
+};
+const landingPage = fs.readFileSync(path.join(__dirname, 'web', 'index.html'), 'utf8');
+
+const timestamp = () => new Date().toISOString();
 
-// Health check endpoint
-app.get('/healthz', (req, res) => {
-  res.status(200).json({ status: 'healthy', timestamp: new Date().toISOString() });
+// Every response carries an X-Request-ID: the caller's when it is well
+// formed, a fresh one otherwise.
+const REQUEST_ID = /^[A-Za-z0-9._:=/+-]{1,128}$/;
+app.use((req, res, next) => {
+  const id = req.get('X-Request-ID');
+  req.id = REQUEST_ID.test(id || '') ? id : crypto.randomBytes(16).toString('hex');
+  res.set('X-Request-ID', req.id);
+  next();
 });
 
-// Root endpoint - Landing page
-app.get('/', (req, res) => {
-  const env = process.env.ENVIRONMENT || 'development';
-  const html = `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-  <meta charset="UTF-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <title>{{CUSTOMER_NAME}}</title>
-  <style>
-    * { margin: 0; padding: 0; box-sizing: border-box; }
-    body {
-      font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-      background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
-      min-height: 100vh;
-      display: flex;
-      align-items: center;
-      justify-content: center;
-      padding: 20px;
-    }
-    .container {
-      background: rgba(255, 255, 255, 0.95);
-      border-radius: 20px;
-      box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
-      padding: 60px 40px;
-      text-align: center;
-      max-width: 600px;
-      width: 100%;
-    }
-    h1 {
-      font-size: 3rem;
-      color: #2d3748;
-      margin-bottom: 20px;
-      font-weight: 800;
-    }
-    .subtitle {
-      font-size: 1.2rem;
-      color: #718096;
-      margin-bottom: 40px;
+// Errors are answered in the service spec's envelope: code is the
+// status's reason phrase in snake_case, error repeats the message for
+// older clients.
+const sendError = (req, res, status, message) => {
+  const code = (http.STATUS_CODES[status] || 'error').toLowerCase().replace(/[^a-z0-9]/g, '_');
+  res.status(status).json({ code, message, error: message, request_id: req.id });
+};
+
+const handlers = {
+  // API clients get JSON on /, browsers and clients with no preference
+  // the page.
+  landing: (req, res) => {
+    res.vary('Accept');
+    if (req.accepts(['html', 'json']) === 'json') {
+      res.json({ message: 'Application is running successfully', environment, version: GIT_SHA });
+      return;
     }
-    .badge {
-      display: inline-block;
-      padding: 8px 16px;
-      border-radius: 20px;
-      font-size: 0.875rem;
-      font-weight: 600;
-      text-transform: uppercase;
-      letter-spacing: 0.5px;
+    const theme = THEMES.includes(conf('THEME')) ? conf('THEME') : SETTINGS.THEME;
+    const color = Object.hasOwn(BADGE_COLORS, environment) ? BADGE_COLORS[environment] || 'var(--brand-primary)' : '#718096';
+    const values = { theme, environment: escapeHtml(environment), badge_color: color };
+    res.type('html').send(landingPage.replace(/\{\{(\w+)\}\}/g, (_, key) => values[key]));
+  },
+  liveness: (req, res) => {
+    res.json({ status: 'healthy', environment, timestamp: timestamp() });
+  },
+  readiness: (req, res) => {
+    res.json({ status: 'ready', timestamp: timestamp() });
+  },
+  startup: (req, res) => {
+    res.json({ status: 'started', timestamp: timestamp() });
+  },
+  version: (req, res) => {
+    res.json({ git_sha: GIT_SHA, build_time: BUILD_TIME, node_version: process.version, template_version: TEMPLATE_VERSION });
+  },
+  info: (req, res) => {
+    res.set('Cache-Control', 'no-store').json({
+      app: APP_NAME,
+      environment,
+      version: GIT_SHA,
+      pod: conf('POD_NAME') || os.hostname(),
+      node: conf('NODE_NAME') || undefined,
+      namespace: conf('POD_NAMESPACE') || undefined,
+    });
+  },
+  robots: (req, res) => {
+    let body = conf('ROBOTS_TXT');
+    if (body === 'off') {
+      sendError(req, res, 404, 'not found');
+      return;
     }
-    .badge.dev { background: #48bb78; color: white; }
-    .badge.preprod { background: #ed8936; color: white; }
-    .badge.prod { background: #667eea; color: white; }
-    .footer {
-      margin-top: 40px;
-      font-size: 0.875rem;
-      color: #a0aec0;
+    if (!body) {
+      const crawl = environment === 'prod' || environment === 'production';
+      body = `User-agent: *\n${crawl ? 'Allow' : 'Disallow'}: /\n`;
     }
-  </style>
-</head>
-<body>
-  <div class="container">
-    <h1>{{CUSTOMER_NAME}}</h1>
-    <div class="subtitle">Application is running successfully</div>
-    <div class="badge ${env}">${env.toUpperCase()}</div>
-    <div class="footer">Powered by OpenLuffy</div>
-  </div>
-</body>
-</html>
-  `;
-  res.send(html);
+    res.type('text/plain').set('Cache-Control', 'public, max-age=86400').send(body);
+  },
+};
+
+// The endpoints of the service spec. They answer GET and HEAD only; the
+// probes are on the paths their settings name, which must differ.
+const ENDPOINTS = [
+[% for ENDPOINT in SPEC_ENDPOINTS %]
+  [[% if ENDPOINT.setting %]conf('[% ENDPOINT.setting %]')[% else %]"[% ENDPOINT.path | json %]"[% end %], handlers.[% ENDPOINT.name %]],
+[% end %]
+];
+const served = new Set();
+for (const [route, handler] of ENDPOINTS) {
+  if (served.has(route)) {
+    console.error(`endpoint paths must differ: ${route} is served twice, exiting`);
+    process.exit(1);
+  }
+  served.add(route);
+  app.get(route, handler);
+  app.all(route, (req, res) => {
+    res.set('Allow', 'GET, HEAD');
+    sendError(req, res, 405, 'method not allowed');
+  });
+}
+
+// Express's own answers are HTML: an unknown path, and a handler that
+// throws.
+app.use((req, res) => sendError(req, res, 404, 'not found'));
+app.use((err, req, res, next) => {
+  console.error(err);
+  if (res.headersSent) {
+    next(err);
+    return;
+  }
+  sendError(req, res, 500, 'internal server error');
+});
+
+// Start server. BIND_ADDR=127.0.0.1 (or ::1) serves the pod's own traffic
+// only, as a sidecar does; unset listens on every interface.
+const PORT = Number(conf('PORT'));
+const BIND_ADDR = conf('BIND_ADDR').replace(/^\[(.*)\]$/, '$1') || undefined;
+const server = app.listen(PORT, BIND_ADDR, () => {
+  console.log(`Server running on ${BIND_ADDR || '*'}:${PORT}`);
+  console.log(`Environment: ${environment}`);
 });
 
-// Start server
-app.listen(PORT, () => {
-  console.log(`Server running on port ${PORT}`);
-  console.log(`Environment: ${process.env.ENVIRONMENT || 'development'}`);
+// Node as the container's PID 1 would ignore SIGTERM until the kubelet
+// kills it; stop once the requests in flight finish instead.
+process.on('SIGTERM', () => {
+  console.log('SIGTERM received, shutting down');
+  server.close(() => process.exit(0));
 });
@@ -1,93 +1,219 @@
-from fastapi import FastAPI
-from fastapi.responses import HTMLResponse
-from datetime import datetime
+from fastapi import FastAPI, Request
+from fastapi.responses import HTMLResponse, JSONResponse, PlainTextResponse
+from starlette.exceptions import HTTPException
+from datetime import datetime, timezone
+from html import escape
+from http import HTTPStatus
+from pathlib import Path
 import os
+import platform
+import re
+import socket
+import sys
+import uuid
 import uvicorn
 
-app = FastAPI(title="{{CUSTOMER_NAME}} API")
+CUSTOMER_NAME = "[% CUSTOMER_NAME | json %]"
+APP_NAME = "[% APP_NAME | json %]"
+TEMPLATE_VERSION = "[% TEMPLATE_VERSION %]"
 
-@app.get("/healthz")
-async def health_check():
+# Settings, as OpenLuffy's service spec declares them for every stack, so
+# a Go, Node.js or Python app is configured the same way. An unset or
+# empty environment variable takes the default the app was generated with.
+SETTINGS = {
+[% for SETTING in SPEC_SETTINGS %]
+    "[% SETTING.name %]": "[% SETTING.default | json %]",
+[% end %]
+}
+
+
+def conf(name: str) -> str:
+    if name not in SETTINGS:
+        raise KeyError(f"undeclared setting {name}")
+    return os.getenv(name) or SETTINGS[name]
+
+
+# Build metadata, from the Dockerfile's GIT_SHA and BUILD_TIME build args
+GIT_SHA = os.getenv("GIT_SHA") or "unknown"
+BUILD_TIME = os.getenv("BUILD_TIME") or "unknown"
+
+ENVIRONMENT = conf("ENVIRONMENT").strip().lower() or "development"
+
+# The landing page, web/index.html, carries the branding; its theme and
+# environment badge are filled in per request. THEME picks one of the
+# looks its stylesheet has, falling back to the generated default.
+THEMES = ("gradient", "minimal", "dark", "corporate", "playful")
+BADGE_COLORS = {
+    "dev": "#48bb78", "development": "#48bb78", "test": "#38b2ac", "qa": "#38b2ac", "uat": "#805ad5",
+    "staging": "#ed8936", "preprod": "#ed8936", "prod": "", "production": "",
+}
+LANDING_PAGE = (Path(__file__).parent / "web" / "index.html").read_text()
+
+app = FastAPI(title=f"{CUSTOMER_NAME} API")
+
+
+def timestamp() -> str:
+    return datetime.now(timezone.utc).isoformat()
+
+
+# Every response carries an X-Request-ID: the caller's when it is well
+# formed, a fresh one otherwise.
+REQUEST_ID = re.compile(r"[A-Za-z0-9._:=/+-]{1,128}")
+
+
+@app.middleware("http")
+async def request_id(request: Request, call_next):
+    value = request.headers.get("x-request-id", "")
+    request.state.request_id = value if REQUEST_ID.fullmatch(value) else uuid.uuid4().hex
+    response = await call_next(request)
+    response.headers["X-Request-ID"] = request.state.request_id
+    return response
+
+
+def error_response(request: Request, status: int, message: str, headers=None) -> JSONResponse:
+    """
+    An error in the service spec's envelope: code is the status's reason
+    phrase in snake_case, error repeats the message for older clients
+    """
+    code = re.sub(r"[^a-z0-9]", "_", HTTPStatus(status).phrase.lower())
+    body = {"code": code, "message": message, "error": message, "request_id": getattr(request.state, "request_id", "")}
+    return JSONResponse(body, status_code=status, headers=headers)
+
+
+# Starlette answers an unknown path, an unsupported method and a handler
+# that raises with {"detail": ...} or plain text.
+@app.exception_handler(HTTPException)
+async def http_error(request: Request, exc: HTTPException):
+    phrase = HTTPStatus(exc.status_code).phrase
+    message = phrase.lower() if exc.detail == phrase else str(exc.detail)
+    return error_response(request, exc.status_code, message, getattr(exc, "headers", None))
+
+
+@app.exception_handler(Exception)
+async def internal_error(request: Request, exc: Exception):
+    return error_response(request, 500, "internal server error")
+
+
+def accept_match(header: str, media_type: str) -> tuple:
+    """
+    How an Accept header ranks media_type: the q of the most specific
+    range matching it, how specific that range is (2 for the type itself,
+    1 for application/* and the like, 0 for */*) and its position, as a
+    tuple where the greater ranks higher
+    """
+    kind = media_type.split("/")[0]
+    best = (0.0, -1, 0)
+    for index, part in enumerate(header.split(",")):
+        media_range, *params = part.split(";")
+        specificity = {media_type: 2, f"{kind}/*": 1, "*/*": 0}.get(media_range.strip().lower(), -1)
+        if specificity <= best[1]:
+            continue
+        q = 1.0
+        for param in params:
+            name, _, value = param.strip().partition("=")
+            if name == "q":
+                try:
+                    q = float(value)
+                except ValueError:
+                    pass
+        best = (q, specificity, -index)
+    return best
+
+
+def prefers_json(request: Request) -> bool:
+    """Whether Accept ranks application/json above text/html, as Express's req.accepts does"""
+    accept = request.headers.get("accept", "")
+    page = max(accept_match(accept, "text/html"), accept_match(accept, "application/xhtml+xml"))
+    data = accept_match(accept, "application/json")
+    return data[0] > 0 and data > page
+
+
+# API clients get JSON on /, browsers and clients with no preference the page
+async def landing(request: Request):
+    if prefers_json(request):
+        body = {"message": "Application is running successfully", "environment": ENVIRONMENT, "version": GIT_SHA}
+        return JSONResponse(body, headers={"Vary": "Accept"})
+    theme = conf("THEME") if conf("THEME") in THEMES else SETTINGS["THEME"]
+    color = (BADGE_COLORS[ENVIRONMENT] or "var(--brand-primary)") if ENVIRONMENT in BADGE_COLORS else "#718096"
+    values = {"theme": theme, "environment": escape(ENVIRONMENT), "badge_color": color}
+    return HTMLResponse(re.sub(r"\{\{(\w+)\}\}", lambda m: values[m.group(1)], LANDING_PAGE), headers={"Vary": "Accept"})
+
+
+async def liveness():
+    return {"status": "healthy", "environment": ENVIRONMENT, "timestamp": timestamp()}
+
+
+async def readiness():
+    return {"status": "ready", "timestamp": timestamp()}
+
+
+async def startup():
+    return {"status": "started", "timestamp": timestamp()}
+
+
+async def version():
     return {
-        "status": "healthy",
-        "timestamp": datetime.now().isoformat()
+        "git_sha": GIT_SHA,
+        "build_time": BUILD_TIME,
+        "python_version": platform.python_version(),
+        "template_version": TEMPLATE_VERSION,
     }
 
-@app.get("/", response_class=HTMLResponse)
-async def root():
-    env = os.getenv("ENVIRONMENT", "development")
-    env_class = env.lower()
-    html = f"""
-<!DOCTYPE html>
-<html lang="en">
-<head>
-  <meta charset="UTF-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <title>{{{{CUSTOMER_NAME}}}}</title>
-  <style>
-    * {{ margin: 0; padding: 0; box-sizing: border-box; }}
-    body {{
-      font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-      background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
-      min-height: 100vh;
-      display: flex;
-      align-items: center;
-      justify-content: center;
-      padding: 20px;
-    }}
-    .container {{
-      background: rgba(255, 255, 255, 0.95);
-      border-radius: 20px;
-      box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
-      padding: 60px 40px;
-      text-align: center;
-      max-width: 600px;
-      width: 100%;
-    }}
-    h1 {{
-      font-size: 3rem;
-      color: #2d3748;
-      margin-bottom: 20px;
-      font-weight: 800;
-    }}
-    .subtitle {{
-      font-size: 1.2rem;
-      color: #718096;
-      margin-bottom: 40px;
-    }}
-    .badge {{
-      display: inline-block;
-      padding: 8px 16px;
-      border-radius: 20px;
-      font-size: 0.875rem;
-      font-weight: 600;
-      text-transform: uppercase;
-      letter-spacing: 0.5px;
-    }}
-    .badge.dev {{ background: #48bb78; color: white; }}
-    .badge.preprod {{ background: #ed8936; color: white; }}
-    .badge.prod {{ background: #667eea; color: white; }}
-    .footer {{
-      margin-top: 40px;
-      font-size: 0.875rem;
-      color: #a0aec0;
-    }}
-  </style>
-</head>
-<body>
-  <div class="container">
-    <h1>{{{{CUSTOMER_NAME}}}}</h1>
-    <div class="subtitle">Application is running successfully</div>
-    <div class="badge {env_class}">{env.upper()}</div>
-    <div class="footer">Powered by OpenLuffy</div>
-  </div>
-</body>
-</html>
-    """
-    return html
+
+async def info():
+    body = {
+        "app": APP_NAME,
+        "environment": ENVIRONMENT,
+        "version": GIT_SHA,
+        "pod": conf("POD_NAME") or socket.gethostname(),
+    }
+    if conf("NODE_NAME"):
+        body["node"] = conf("NODE_NAME")
+    if conf("POD_NAMESPACE"):
+        body["namespace"] = conf("POD_NAMESPACE")
+    return JSONResponse(body, headers={"Cache-Control": "no-store"})
+
+
+async def robots(request: Request):
+    body = conf("ROBOTS_TXT")
+    if body == "off":
+        return error_response(request, 404, "not found")
+    if not body:
+        crawl = ENVIRONMENT in ("prod", "production")
+        body = f"User-agent: *\n{'Allow' if crawl else 'Disallow'}: /\n"
+    return PlainTextResponse(body, headers={"Cache-Control": "public, max-age=86400"})
+
+
+HANDLERS = {
+    "landing": landing,
+    "liveness": liveness,
+    "readiness": readiness,
+    "startup": startup,
+    "version": version,
+    "info": info,
+    "robots": robots,
+}
+
+# The endpoints of the service spec. They answer GET and HEAD only; the
+# probes are on the paths their settings name, which must differ.
+ENDPOINTS = [
+[% for ENDPOINT in SPEC_ENDPOINTS %]
+    ([% if ENDPOINT.setting %]conf("[% ENDPOINT.setting %]")[% else %]"[% ENDPOINT.path | json %]"[% end %], "[% ENDPOINT.name %]"),
+[% end %]
+]
+
+served = set()
+for path, name in ENDPOINTS:
+    if path in served:
+        sys.exit(f"endpoint paths must differ: {path} is served twice, exiting")
+    served.add(path)
+    app.add_api_route(path, HANDLERS[name], methods=["GET", "HEAD"])
 
 if __name__ == "__main__":
-    port = int(os.getenv("PORT", 8000))
+    port = int(conf("PORT"))
     print(f"Starting server on port {port}")
-    print(f"Environment: {os.getenv('ENVIRONMENT', 'development')}")
-    uvicorn.run(app, host="0.0.0.0", port=port)
+    print(f"Environment: {ENVIRONMENT}")
+    # BIND_ADDR=127.0.0.1 (or ::1) serves the pod's own traffic only, as
+    # a sidecar does; :: listens on every IPv6 and IPv4 interface.
+    host = conf("BIND_ADDR").strip("[]") or "0.0.0.0"
+    uvicorn.run(app, host=host, port=port)
@@ -0,0 +1,48 @@
+# Image build definition for docker buildx bake, for every platform the
+# app is released on. The release workflows build the same platforms.
+#
+#   docker buildx bake --push                  every platform, pushed as IMAGE
+#   docker buildx bake app-linux-arm64 --load  one platform, into local docker
+#
+# A multi-platform image cannot be loaded into a local docker that does
+# not use the containerd image store, so without --push the default
+# target only checks that every platform builds. Building for a platform
+# other than the host's needs QEMU (docker run --privileged --rm
+# tonistiigi/binfmt --install all) unless the Dockerfile cross-compiles.
+
+variable "IMAGE" {
+  default = "[% APP_NAME %]:dev"
+}
+
+variable "GIT_SHA" {
+  default = ""
+}
+
+variable "BUILD_TIME" {
+  default = ""
+}
+
+group "default" {
+  targets = ["app"]
+}
+
+target "app" {
+  context    = "."
+  dockerfile = "Dockerfile"
+  platforms  = [[% for PLATFORM in PLATFORMS %]"[% PLATFORM %]"[% if not loop.last %], [% end %][% end %]]
+  tags       = [IMAGE]
+  args = {
+    GIT_SHA    = GIT_SHA
+    BUILD_TIME = BUILD_TIME
+  }
+}
+
+# app-linux-amd64, app-linux-arm64, ...: one platform each, tagged
+# IMAGE-linux-arm64 and so on
+target "platform" {
+  name      = "app-${replace(platform, "/", "-")}"
+  matrix    = { platform = [[% for PLATFORM in PLATFORMS %]"[% PLATFORM %]"[% if not loop.last %], [% end %][% end %]] }
+  inherits  = ["app"]
+  platforms = [platform]
+  tags      = ["${IMAGE}-${replace(platform, "/", "-")}"]
+}
@@ -1,5 +1,3 @@
-module github.com/{{GITHUB_OWNER}}/{{REPO_NAME}}
+module github.com/[% GITHUB_OWNER %]/[% REPO_NAME %]
 
-go 1.21
-
-require ()
+go 1.24.0
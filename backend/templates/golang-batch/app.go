@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The app: a batch job run to completion by a Kubernetes Job. main.go runs
+// the batch once under JOB_MAX_RUNTIME, serves its progress and reports
+// the result; batch.go checkpoints and resumes it. The work itself is
+// listItems and processItem below.
+//
+//	JOB_NAME                   name in logs and reports (default the app name)
+//	JOB_MAX_RUNTIME            deadline for the run (default 1h); the batch
+//	                           stops, checkpoints and reports a partial result
+//	JOB_WEBHOOK_URL            receives a JSON report of every run when set
+//	JOB_WEBHOOK_ON             always (default) or failure
+//	BATCH_STATE_FILE           checkpoint a later run resumes from (default
+//	                           batch-state.json; the chart puts it on a volume)
+//	BATCH_CHECKPOINT_EVERY     items between checkpoints (default 100)
+//	BATCH_CHECKPOINT_INTERVAL  longest time between checkpoints (default 10s)
+//	BATCH_MAX_FAILURES         failed items tolerated before the batch stops
+//	                           (default 0: the first failure stops it)
+//	BATCH_RESULT_FILE          the run's result is written there as JSON when
+//	                           set; "complete": false marks a partial result
+//
+// GET /progress reports done, failed and remaining items, the rate and the
+// ETA while the batch runs.
+
+var appSettings = []setting{
+	{name: "JOB_NAME", def: serviceName},
+	{name: "JOB_MAX_RUNTIME", kind: kindDuration, def: "1h"},
+	{name: "JOB_WEBHOOK_URL", secret: true}, // webhook URLs usually embed a token
+	{name: "JOB_WEBHOOK_ON", def: "always", check: oneOf("always", "failure")},
+	{name: "BATCH_STATE_FILE", def: "batch-state.json"},
+	{name: "BATCH_CHECKPOINT_EVERY", kind: kindInt, def: "100", check: atLeast(1)},
+	{name: "BATCH_CHECKPOINT_INTERVAL", kind: kindDuration, def: "10s"},
+	{name: "BATCH_MAX_FAILURES", kind: kindInt, def: "0", check: atLeast(0)},
+	{name: "BATCH_RESULT_FILE"},
+}
+
+// listItems returns the IDs of the items to process. It must return them
+// in the same order on every run: a resumed run skips as many as its
+// checkpoint records as done. Query with a stable ORDER BY, or list
+// objects by key.
+//
+// The sample lists 200 numbered items.
+func listItems(ctx context.Context) ([]string, error) {
+	items := make([]string, 200)
+	for i := range items {
+		items[i] = fmt.Sprintf("item-%03d", i+1)
+	}
+	return items, nil
+}
+
+// processItem does the work for one item; this is where the job's real
+// code goes. Return an error to record the item as failed. ctx is
+// cancelled at JOB_MAX_RUNTIME or when the pod is stopped; pass it to
+// every call that blocks and return soon after it is done, and the item is
+// retried by the next run. An item may be processed more than once (it was
+// in flight at a crash, or its run stopped), so the work should be safe to
+// repeat: upsert rather than insert.
+//
+// The sample only waits a moment.
+func processItem(ctx context.Context, id string) error {
+	select {
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// The batch loop. Items are processed one at a time, in listItems order,
+// and the position reached is checkpointed to BATCH_STATE_FILE every
+// BATCH_CHECKPOINT_EVERY items and at least every
+// BATCH_CHECKPOINT_INTERVAL. A run that finds a checkpoint resumes after
+// the last item it records as done, so a batch cut short by
+// JOB_MAX_RUNTIME, a stop signal or a crash continues where it stopped
+// when the Job retries it. The file is removed once the batch completes.
+//
+// An item whose processItem returns an error is logged and recorded as
+// failed; up to BATCH_MAX_FAILURES of them are tolerated and listed in the
+// result. The one over the limit stops the batch without being marked
+// done, so a retry starts with it. An item interrupted by the deadline is
+// not marked done either: processing is at least once, and processItem
+// should be safe to repeat.
+//
+// Progress is served as JSON on /progress and as batch_* metrics on
+// /metrics.
+
+// batchState is the checkpoint saved in BATCH_STATE_FILE.
+type batchState struct {
+	// Next is the index of the first item not yet done.
+	Next      int       `json:"next"`
+	Total     int       `json:"total"`
+	Failed    []string  `json:"failed,omitempty"`
+	Runs      int       `json:"runs"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadState reads the checkpoint at path; a missing file is a fresh batch.
+func loadState(path string) (batchState, bool, error) {
+	var st batchState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, false, fmt.Errorf("%s is not a batch checkpoint: %w", path, err)
+	}
+	return st, true, nil
+}
+
+// saveState replaces the checkpoint at path atomically: it is written to
+// a temporary file in the same directory, synced and renamed over the old
+// one, so a crash mid-write leaves the previous checkpoint intact.
+func saveState(path string, st batchState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// batchReport summarises a run's batch for the result and the webhook.
+type batchReport struct {
+	Complete    bool     `json:"complete"`
+	Total       int      `json:"total"`
+	Done        int      `json:"done"`
+	Failed      int      `json:"failed"`
+	FailedItems []string `json:"failed_items,omitempty"`
+	Remaining   int      `json:"remaining"`
+	ResumedFrom int      `json:"resumed_from"`
+	// ProcessedThisRun counts the items this run got through.
+	ProcessedThisRun int    `json:"processed_this_run"`
+	StateFile        string `json:"state_file,omitempty"`
+}
+
+// runBatch processes the items list returns with process, checkpointing
+// as it goes, until all are done, ctx is cancelled or too many fail. The
+// report describes the batch whatever the outcome.
+func runBatch(ctx context.Context, list func(context.Context) ([]string, error), process func(context.Context, string) error) (batchReport, error) {
+	path := conf("BATCH_STATE_FILE")
+	st, resumed, err := loadState(path)
+	if err != nil {
+		return batchReport{}, err
+	}
+	items, err := list(ctx)
+	if err != nil {
+		return batchReport{}, fmt.Errorf("listing items: %w", err)
+	}
+	if resumed {
+		if st.Total != len(items) {
+			slog.Warn("item count changed since the checkpoint, resuming by position", "checkpoint_total", st.Total, "total", len(items))
+		}
+		st.Next = min(st.Next, len(items))
+		slog.Info("resuming batch from checkpoint", "next", st.Next, "total", len(items), "failed", len(st.Failed), "runs", st.Runs)
+	} else {
+		st.StartedAt = time.Now().UTC()
+	}
+	st.Total = len(items)
+	st.Runs++
+	resumedFrom := st.Next
+	report := func() batchReport {
+		r := batchReport{
+			Complete:         st.Next == st.Total,
+			Total:            st.Total,
+			Done:             st.Next,
+			Failed:           len(st.Failed),
+			FailedItems:      st.Failed,
+			Remaining:        st.Total - st.Next,
+			ResumedFrom:      resumedFrom,
+			ProcessedThisRun: st.Next - resumedFrom,
+		}
+		if !r.Complete {
+			r.StateFile = path
+		}
+		return r
+	}
+
+	every, interval := confInt("BATCH_CHECKPOINT_EVERY"), confDuration("BATCH_CHECKPOINT_INTERVAL")
+	maxFailures := confInt("BATCH_MAX_FAILURES")
+	progress.start(st)
+	lastSave, sinceSave := time.Now(), 0
+	checkpoint := func() error {
+		st.UpdatedAt = time.Now().UTC()
+		if err := saveState(path, st); err != nil {
+			return fmt.Errorf("saving checkpoint: %w", err)
+		}
+		lastSave, sinceSave = time.Now(), 0
+		progress.checkpointed(st.UpdatedAt)
+		slog.Info("batch progress", progress.logAttrs()...)
+		return nil
+	}
+
+	for st.Next < len(items) && ctx.Err() == nil {
+		id := items[st.Next]
+		err := processOne(ctx, process, id)
+		if err != nil && ctx.Err() != nil {
+			// Interrupted, not failed: the item is retried on resume.
+			break
+		}
+		if err != nil {
+			if len(st.Failed) >= maxFailures {
+				err = fmt.Errorf("item %s failed with %d failures already tolerated (BATCH_MAX_FAILURES): %w", id, len(st.Failed), err)
+				return report(), errors.Join(err, checkpoint())
+			}
+			slog.Warn("item failed", "item", id, "error", err)
+			st.Failed = append(st.Failed, id)
+		}
+		st.Next++
+		sinceSave++
+		progress.advance(err != nil)
+		if sinceSave >= every || time.Since(lastSave) >= interval {
+			if err := checkpoint(); err != nil {
+				return report(), err
+			}
+		}
+	}
+
+	if st.Next < len(items) {
+		// Cut short: keep the position for the next run.
+		return report(), errors.Join(ctx.Err(), checkpoint())
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("removing the checkpoint of a completed batch failed", "path", path, "error", err)
+	}
+	return report(), nil
+}
+
+// processOne runs process for one item, turning a panic into an item
+// failure.
+func processOne(ctx context.Context, process func(context.Context, string) error, id string) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			slog.Error("panic processing item",
+				"item", id,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()))
+			reportPanic(nil, recovered)
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return process(ctx, id)
+}
+
+// batchProgress is the live progress served on /progress.
+type batchProgress struct {
+	mu           sync.Mutex
+	status       string
+	total        int
+	done         int
+	failed       int
+	resumedFrom  int
+	startedAt    time.Time // this run's start, for the rate
+	checkpointAt time.Time
+}
+
+var progress = &batchProgress{status: "starting"}
+
+func (p *batchProgress) start(st batchState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = "running"
+	p.total, p.done, p.failed, p.resumedFrom = st.Total, st.Next, len(st.Failed), st.Next
+	p.startedAt = time.Now()
+}
+
+func (p *batchProgress) advance(failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if failed {
+		p.failed++
+	}
+}
+
+func (p *batchProgress) checkpointed(at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkpointAt = at
+}
+
+func (p *batchProgress) finish(status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+}
+
+// ProgressResponse is the body of /progress. The rate counts this run's
+// items only, so a resumed batch's ETA is not skewed by earlier runs.
+type ProgressResponse struct {
+	Status         string     `json:"status"` // starting, running, or the run's final status
+	Total          int        `json:"total"`
+	Done           int        `json:"done"`
+	Failed         int        `json:"failed"`
+	Remaining      int        `json:"remaining"`
+	Percent        float64    `json:"percent"`
+	ResumedFrom    int        `json:"resumed_from"`
+	RatePerSecond  float64    `json:"rate_per_second"`
+	ETASeconds     *float64   `json:"eta_seconds"` // null until the rate is known
+	ETA            *time.Time `json:"eta"`
+	ElapsedSeconds float64    `json:"elapsed_seconds"`
+	LastCheckpoint *time.Time `json:"last_checkpoint"`
+}
+
+func (p *batchProgress) snapshot(now time.Time) ProgressResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	resp := ProgressResponse{
+		Status:      p.status,
+		Total:       p.total,
+		Done:        p.done,
+		Failed:      p.failed,
+		Remaining:   p.total - p.done,
+		ResumedFrom: p.resumedFrom,
+	}
+	if p.total > 0 {
+		resp.Percent = float64(p.done) * 100 / float64(p.total)
+	}
+	if !p.checkpointAt.IsZero() {
+		at := p.checkpointAt
+		resp.LastCheckpoint = &at
+	}
+	if p.startedAt.IsZero() {
+		return resp
+	}
+	elapsed := now.Sub(p.startedAt)
+	resp.ElapsedSeconds = elapsed.Seconds()
+	if n := p.done - p.resumedFrom; n > 0 && elapsed > 0 {
+		resp.RatePerSecond = float64(n) / elapsed.Seconds()
+		eta := float64(resp.Remaining) / resp.RatePerSecond
+		at := now.Add(time.Duration(eta * float64(time.Second))).UTC()
+		resp.ETASeconds, resp.ETA = &eta, &at
+	}
+	return resp
+}
+
+func (p *batchProgress) logAttrs() []any {
+	s := p.snapshot(time.Now())
+	attrs := []any{"done", s.Done, "total", s.Total, "failed", s.Failed, "percent", math.Round(s.Percent*10) / 10}
+	if s.ETASeconds != nil {
+		attrs = append(attrs, "eta", time.Duration(*s.ETASeconds*float64(time.Second)).Round(time.Second).String())
+	}
+	return attrs
+}
+
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress.snapshot(time.Now()))
+}
+
+func (p *batchProgress) writeMetrics(w io.Writer) {
+	s := p.snapshot(time.Now())
+	fmt.Fprintln(w, "# HELP batch_items Items in the batch by state.")
+	fmt.Fprintln(w, "# TYPE batch_items gauge")
+	fmt.Fprintf(w, "batch_items{state=\"total\"} %d\n", s.Total)
+	fmt.Fprintf(w, "batch_items{state=\"done\"} %d\n", s.Done)
+	fmt.Fprintf(w, "batch_items{state=\"failed\"} %d\n", s.Failed)
+	fmt.Fprintln(w, "# HELP batch_items_per_second Items processed per second in this run.")
+	fmt.Fprintln(w, "# TYPE batch_items_per_second gauge")
+	fmt.Fprintf(w, "batch_items_per_second %s\n", formatFloat(s.RatePerSecond))
+	if s.ETASeconds != nil {
+		fmt.Fprintln(w, "# HELP batch_eta_seconds Estimated time until the batch completes.")
+		fmt.Fprintln(w, "# TYPE batch_eta_seconds gauge")
+		fmt.Fprintf(w, "batch_eta_seconds %s\n", formatFloat(*s.ETASeconds))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withState points BATCH_STATE_FILE at a fresh temporary directory.
+func withState(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state.json")
+	t.Setenv("BATCH_STATE_FILE", path)
+	return path
+}
+
+func numbered(n int) func(context.Context) ([]string, error) {
+	return func(context.Context) ([]string, error) {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = fmt.Sprint(i)
+		}
+		return items, nil
+	}
+}
+
+// recorder processes items by recording them, failing those in fail.
+type recorder struct {
+	seen []string
+	fail map[string]bool
+}
+
+func (rec *recorder) process(ctx context.Context, id string) error {
+	rec.seen = append(rec.seen, id)
+	if rec.fail[id] {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+func TestRunBatch(t *testing.T) {
+	path := withState(t)
+	t.Setenv("BATCH_CHECKPOINT_EVERY", "3")
+	rec := &recorder{}
+	report, err := runBatch(context.Background(), numbered(10), rec.process)
+	if err != nil || !report.Complete || report.Done != 10 || report.ProcessedThisRun != 10 || len(rec.seen) != 10 {
+		t.Fatalf("runBatch = %+v, %v after %d items, want all 10 done", report, err, len(rec.seen))
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint of a completed batch left behind: %v", err)
+	}
+}
+
+func TestRunBatchResumes(t *testing.T) {
+	path := withState(t)
+	if err := saveState(path, batchState{Next: 7, Total: 10, Failed: []string{"3"}, Runs: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{}
+	report, err := runBatch(context.Background(), numbered(10), rec.process)
+	if err != nil || !report.Complete || report.ResumedFrom != 7 || report.ProcessedThisRun != 3 || report.Failed != 1 {
+		t.Fatalf("resumed runBatch = %+v, %v, want the last 3 items done and the earlier failure kept", report, err)
+	}
+	if !slices.Equal(rec.seen, []string{"7", "8", "9"}) {
+		t.Errorf("resumed batch processed %v, want 7, 8 and 9", rec.seen)
+	}
+}
+
+func TestRunBatchDeadline(t *testing.T) {
+	path := withState(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var seen []string
+	process := func(ctx context.Context, id string) error {
+		seen = append(seen, id)
+		if id == "4" {
+			// The deadline passes while item 4 is in flight.
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	}
+	report, err := runBatch(ctx, numbered(10), process)
+	if !errors.Is(err, context.Canceled) || report.Complete || report.Done != 4 || report.Remaining != 6 || report.StateFile != path {
+		t.Fatalf("interrupted runBatch = %+v, %v, want a partial result with 4 done", report, err)
+	}
+	st, ok, err := loadState(path)
+	if err != nil || !ok || st.Next != 4 || st.Total != 10 {
+		t.Fatalf("checkpoint = %+v, %v, %v, want next 4 so the interrupted item is retried", st, ok, err)
+	}
+}
+
+func TestRunBatchFailures(t *testing.T) {
+	t.Setenv("BATCH_MAX_FAILURES", "1")
+	path := withState(t)
+	rec := &recorder{fail: map[string]bool{"2": true, "5": true}}
+	report, err := runBatch(context.Background(), numbered(10), rec.process)
+	if err == nil || !strings.Contains(err.Error(), "item 5 failed") || report.Failed != 1 || report.Done != 5 {
+		t.Fatalf("runBatch = %+v, %v, want it stopped at the second failure with one tolerated", report, err)
+	}
+	if st, _, _ := loadState(path); st.Next != 5 || !slices.Equal(st.Failed, []string{"2"}) {
+		t.Fatalf("checkpoint = %+v, want next 5 so the item over the limit is retried", st)
+	}
+
+	// Within the limit, failed items are listed and the batch completes.
+	t.Setenv("BATCH_MAX_FAILURES", "5")
+	report, err = runBatch(context.Background(), numbered(10), rec.process)
+	if err != nil || !report.Complete || !slices.Equal(report.FailedItems, []string{"2", "5"}) {
+		t.Fatalf("runBatch = %+v, %v, want it complete with 2 and 5 failed", report, err)
+	}
+}
+
+func TestRunBatchPanic(t *testing.T) {
+	withState(t)
+	t.Setenv("BATCH_MAX_FAILURES", "1")
+	process := func(ctx context.Context, id string) error {
+		if id == "1" {
+			panic("nil map")
+		}
+		return nil
+	}
+	if report, err := runBatch(context.Background(), numbered(3), process); err != nil || !slices.Equal(report.FailedItems, []string{"1"}) {
+		t.Fatalf("runBatch = %+v, %v, want the panicking item recorded as failed", report, err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	start := time.Now()
+	p := &batchProgress{status: "running", total: 100, done: 40, resumedFrom: 20, startedAt: start}
+	s := p.snapshot(start.Add(10 * time.Second))
+	if s.Remaining != 60 || s.Percent != 40 || s.RatePerSecond != 2 || s.ETASeconds == nil || *s.ETASeconds != 30 {
+		t.Fatalf("snapshot = %+v, want 60 remaining at 2/s, 30s to go", s)
+	}
+
+	// Before the first item there is no rate to estimate from.
+	p = &batchProgress{status: "running", total: 100, startedAt: start}
+	if s := p.snapshot(start.Add(time.Second)); s.ETASeconds != nil || s.ETA != nil {
+		t.Fatalf("snapshot before any progress = %+v, want no ETA", s)
+	}
+}
+
+func TestProgressHandler(t *testing.T) {
+	withState(t)
+	if _, err := runBatch(context.Background(), numbered(5), (&recorder{}).process); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	progressHandler(w, httptest.NewRequest("GET", "/progress", nil))
+	var resp ProgressResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || resp.Done != 5 || resp.Total != 5 {
+		t.Fatalf("GET /progress = %d %s, want 5 of 5 done", w.Code, w.Body)
+	}
+}
+
+func TestRunOnceTimedOut(t *testing.T) {
+	withState(t)
+	t.Setenv("JOB_MAX_RUNTIME", "120ms")
+	run := runOnce(context.Background())
+	if run.Status != "timed_out" || run.ExitCode != exitTimedOut || run.Batch.Complete || run.Batch.Done == 0 || run.Batch.StateFile == "" {
+		t.Fatalf("runOnce past JOB_MAX_RUNTIME = %+v, want timed_out with a partial, checkpointed batch", run)
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.json")
+	t.Setenv("BATCH_RESULT_FILE", path)
+	writeResult(jobRun{Status: "timed_out", ExitCode: exitTimedOut, Batch: batchReport{Total: 10, Done: 4, Remaining: 6}})
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), `"complete": false`) || !strings.Contains(string(data), `"remaining": 6`) {
+		t.Fatalf("result file = %s, %v, want the partial batch", data, err)
+	}
+}
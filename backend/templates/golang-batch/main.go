@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The batch runner. Each run is one process: it serves progress on PORT,
+// works through the batch (batch.go) and exits with a code the Job's
+// retries and alerting can rely on.
+//
+//	0    succeeded: every item is done, failures within BATCH_MAX_FAILURES
+//	1    failed: listing or too many items failed, or the checkpoint could
+//	     not be saved
+//	124  timed out: JOB_MAX_RUNTIME passed, as timeout(1) reports it
+//	143  cancelled: the pod was stopped (SIGTERM)
+//
+// Every exit but 0 leaves the checkpoint in place, so the Job's next try
+// resumes the batch. When the run is timed out or cancelled, the item in
+// flight gets SHUTDOWN_TIMEOUT to return after its ctx is cancelled before
+// the partial result is reported anyway.
+
+const (
+	exitSucceeded = 0
+	exitFailed    = 1
+	exitTimedOut  = 124
+	exitCancelled = 128 + int(syscall.SIGTERM)
+)
+
+// jobRun is a run's outcome, logged when it finishes, written to
+// BATCH_RESULT_FILE and sent to the webhook.
+type jobRun struct {
+	Job         string      `json:"job"`
+	RunID       string      `json:"run_id"`
+	Environment string      `json:"environment"`
+	GitSHA      string      `json:"git_sha"`
+	Status      string      `json:"status"` // succeeded, failed, timed_out or cancelled
+	ExitCode    int         `json:"exit_code"`
+	Error       string      `json:"error,omitempty"`
+	StartedAt   time.Time   `json:"started_at"`
+	FinishedAt  time.Time   `json:"finished_at"`
+	DurationMS  float64     `json:"duration_ms"`
+	Batch       batchReport `json:"batch"`
+}
+
+// runID identifies the run. Kubernetes names each Job pod uniquely and
+// uses that name as its hostname.
+func runID() string {
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "unknown"
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck())
+	}
+	setupLogging()
+	validateConfig()
+	loadFeatureFlags()
+	setupErrorReporting()
+	setupProfiling()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	srv := serveProgress()
+	runStartupTasks(ctx)
+	run := runOnce(ctx)
+	progress.finish(run.Status)
+	writeResult(run)
+
+	notifyCtx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	notifyWebhook(notifyCtx, run)
+	srv.Shutdown(notifyCtx)
+	runShutdownHooks(notifyCtx)
+	flushErrorReports(notifyCtx)
+	flushProfiles(notifyCtx)
+	flushLogs(notifyCtx)
+	os.Exit(run.ExitCode)
+}
+
+// serveProgress starts the HTTP server on PORT for the run's lifetime:
+// /progress and the platform endpoints, so probes and Prometheus reach
+// the job as they do a service. Mixins are set up here too, so their
+// startup tasks, such as migrations, run before the batch.
+func serveProgress() *http.Server {
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	if err := setupMixins(mux); err != nil {
+		slog.Error("mixin setup failed", "error", err)
+		os.Exit(1)
+	}
+	handleGet(mux, "/progress", progressHandler)
+	registerMetrics(progress.writeMetrics)
+
+	srv := newServer(platformHandler(mux, nil))
+	// With ADMIN_PORT the probes are on the admin server: unlike
+	// /progress, the liveness probe needs it, so failing to listen is fatal.
+	admin, err := startAdmin(context.Background())
+	if err != nil {
+		slog.Error("admin server failed", "error", err)
+		os.Exit(1)
+	}
+	if admin != nil {
+		srv.RegisterOnShutdown(func() { admin.Close() })
+	}
+	go func() {
+		ln, err := listen(context.Background(), srv)
+		if err == nil {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			// Progress is a convenience; the batch runs without it.
+			slog.Warn("progress server failed", "port", conf("PORT"), "error", err)
+		}
+	}()
+	return srv
+}
+
+// runOnce runs the batch under the JOB_MAX_RUNTIME deadline and logs its
+// start and finish.
+func runOnce(ctx context.Context) jobRun {
+	maxRuntime := confDuration("JOB_MAX_RUNTIME")
+	run := jobRun{
+		Job:         conf("JOB_NAME"),
+		RunID:       runID(),
+		Environment: environment,
+		GitSHA:      version.GitSHA,
+		StartedAt:   time.Now().UTC(),
+	}
+	logger := slog.With("job", run.Job, "run_id", run.RunID)
+	logger.Info("job started", "max_runtime", maxRuntime.String(), "state_file", conf("BATCH_STATE_FILE"), "git_sha", run.GitSHA)
+
+	batchCtx, cancel := context.WithTimeout(ctx, maxRuntime)
+	defer cancel()
+
+	type outcome struct {
+		report batchReport
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		report, err := runBatch(batchCtx, listItems, processItem)
+		done <- outcome{report, err}
+	}()
+
+	var out outcome
+	select {
+	case out = <-done:
+	case <-batchCtx.Done():
+		reason := "max runtime exceeded"
+		if ctx.Err() != nil {
+			reason = "stop signal received"
+		}
+		grace := confDuration("SHUTDOWN_TIMEOUT")
+		logger.Warn("stopping the batch, waiting for the item in flight", "reason", reason, "grace", grace.String())
+		select {
+		case out = <-done:
+		case <-time.After(grace):
+			// The last checkpoint stands; the report is what /progress saw.
+			out.err = fmt.Errorf("batch did not stop within %s of being cancelled", grace)
+			s := progress.snapshot(time.Now())
+			out.report = batchReport{Total: s.Total, Done: s.Done, Failed: s.Failed, Remaining: s.Remaining,
+				ResumedFrom: s.ResumedFrom, ProcessedThisRun: s.Done - s.ResumedFrom, StateFile: conf("BATCH_STATE_FILE")}
+		}
+	}
+
+	run.Batch = out.report
+	run.FinishedAt = time.Now().UTC()
+	run.DurationMS = float64(run.FinishedAt.Sub(run.StartedAt).Microseconds()) / 1000
+	err := out.err
+	switch {
+	case errors.Is(batchCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil && err != nil:
+		run.Status, run.ExitCode = "timed_out", exitTimedOut
+	case ctx.Err() != nil && err != nil:
+		run.Status, run.ExitCode = "cancelled", exitCancelled
+	case err != nil:
+		run.Status, run.ExitCode = "failed", exitFailed
+	default:
+		run.Status, run.ExitCode = "succeeded", exitSucceeded
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	attrs := []any{"status", run.Status, "exit_code", run.ExitCode, "duration_ms", run.DurationMS,
+		"done", run.Batch.Done, "total", run.Batch.Total, "failed", run.Batch.Failed, "processed_this_run", run.Batch.ProcessedThisRun}
+	switch {
+	case run.Status == "failed":
+		reportError(nil, fmt.Errorf("job %s failed: %w", run.Job, err))
+		logger.Error("job finished", append(attrs, "error", run.Error)...)
+	case err != nil:
+		// Cut short with a checkpoint: a partial result, not an error.
+		logger.Warn("job stopped before the batch completed, the next run resumes it", append(attrs, "error", run.Error)...)
+	default:
+		logger.Info("job finished", attrs...)
+	}
+	return run
+}
+
+// writeResult writes run to BATCH_RESULT_FILE, when set, for whatever
+// consumes the batch's output to check before relying on it: "complete"
+// false means a partial result.
+func writeResult(run jobRun) {
+	path := conf("BATCH_RESULT_FILE")
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		slog.Error("writing the batch result failed", "path", path, "error", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// The app: a task run to completion by a Kubernetes CronJob on the chart's
+// schedule. main.go runs runTask once, logs the start and finish with the
+// duration and exit code, enforces JOB_MAX_RUNTIME and reports the result
+// to JOB_WEBHOOK_URL; webhook.go sends the report.
+//
+//	JOB_NAME         name in logs and reports (default the app name)
+//	JOB_MAX_RUNTIME  deadline for the run; runTask's ctx is cancelled when
+//	                 it passes (default 1h)
+//	JOB_WEBHOOK_URL  receives a JSON report of every run when set; the
+//	                 "text" field makes it readable in Slack and Teams
+//	JOB_WEBHOOK_ON   always (default) or failure
+
+var appSettings = []setting{
+	{name: "JOB_NAME", def: serviceName},
+	{name: "JOB_MAX_RUNTIME", kind: kindDuration, def: "1h"},
+	{name: "JOB_WEBHOOK_URL", secret: true}, // webhook URLs usually embed a token
+	{name: "JOB_WEBHOOK_ON", def: "always", check: oneOf("always", "failure")},
+}
+
+// runTask does the job's work; this is where the job's real code goes.
+// Return nil on success and an error on failure. ctx is cancelled at
+// JOB_MAX_RUNTIME or when the pod is stopped; pass it to every call that
+// blocks and return soon after it is done. Kubernetes may occasionally
+// start a scheduled run twice, so the work should be safe to repeat.
+//
+// The sample only waits a moment.
+func runTask(ctx context.Context) error {
+	slog.InfoContext(ctx, "doing the work")
+	select {
+	case <-time.After(time.Second):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
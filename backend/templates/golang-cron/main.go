@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+// The job runner. Each run is one process: it runs runTask (app.go) once
+// and exits with a code the CronJob's history and alerting can rely on.
+//
+//	0    succeeded
+//	1    failed: runTask returned an error or panicked
+//	124  timed out: JOB_MAX_RUNTIME passed, as timeout(1) reports it
+//	143  cancelled: the pod was stopped (SIGTERM)
+//
+// When the run is timed out or cancelled, runTask gets SHUTDOWN_TIMEOUT to
+// return after its ctx is cancelled before the run is reported anyway.
+
+const (
+	exitSucceeded = 0
+	exitFailed    = 1
+	exitTimedOut  = 124
+	exitCancelled = 128 + int(syscall.SIGTERM)
+)
+
+// jobRun is a run's outcome, logged when it finishes and sent to the
+// webhook.
+type jobRun struct {
+	Job         string    `json:"job"`
+	RunID       string    `json:"run_id"`
+	Environment string    `json:"environment"`
+	GitSHA      string    `json:"git_sha"`
+	Status      string    `json:"status"` // succeeded, failed, timed_out or cancelled
+	ExitCode    int       `json:"exit_code"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	DurationMS  float64   `json:"duration_ms"`
+}
+
+// runID identifies the run. Kubernetes names each Job pod uniquely and
+// uses that name as its hostname.
+func runID() string {
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "unknown"
+}
+
+func main() {
+	setupLogging()
+	validateConfig()
+	loadFeatureFlags()
+	setupErrorReporting()
+	setupProfiling()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	run := runOnce(ctx)
+
+	notifyCtx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	notifyWebhook(notifyCtx, run)
+	runShutdownHooks(notifyCtx)
+	flushErrorReports(notifyCtx)
+	flushProfiles(notifyCtx)
+	flushLogs(notifyCtx)
+	os.Exit(run.ExitCode)
+}
+
+// runOnce runs the task under the JOB_MAX_RUNTIME deadline and logs its
+// start and finish.
+func runOnce(ctx context.Context) jobRun {
+	maxRuntime := confDuration("JOB_MAX_RUNTIME")
+	run := jobRun{
+		Job:         conf("JOB_NAME"),
+		RunID:       runID(),
+		Environment: environment,
+		GitSHA:      version.GitSHA,
+		StartedAt:   time.Now().UTC(),
+	}
+	logger := slog.With("job", run.Job, "run_id", run.RunID)
+	logger.Info("job started", "max_runtime", maxRuntime.String(), "git_sha", run.GitSHA)
+
+	taskCtx, cancel := context.WithTimeout(ctx, maxRuntime)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- callTask(taskCtx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-taskCtx.Done():
+		reason := "max runtime exceeded"
+		if ctx.Err() != nil {
+			reason = "stop signal received"
+		}
+		grace := confDuration("SHUTDOWN_TIMEOUT")
+		logger.Warn("cancelling the task, waiting for it to return", "reason", reason, "grace", grace.String())
+		select {
+		case err = <-done:
+		case <-time.After(grace):
+			err = fmt.Errorf("task did not return within %s of being cancelled", grace)
+		}
+	}
+
+	run.FinishedAt = time.Now().UTC()
+	run.DurationMS = float64(run.FinishedAt.Sub(run.StartedAt).Microseconds()) / 1000
+	switch {
+	case errors.Is(taskCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil && err != nil:
+		run.Status, run.ExitCode = "timed_out", exitTimedOut
+	case ctx.Err() != nil && err != nil:
+		run.Status, run.ExitCode = "cancelled", exitCancelled
+	case err != nil:
+		run.Status, run.ExitCode = "failed", exitFailed
+	default:
+		run.Status, run.ExitCode = "succeeded", exitSucceeded
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	attrs := []any{"status", run.Status, "exit_code", run.ExitCode, "duration_ms", run.DurationMS}
+	if err != nil {
+		if !errors.Is(err, errTaskPanicked) {
+			reportError(nil, fmt.Errorf("job %s %s: %w", run.Job, run.Status, err))
+		}
+		logger.Error("job finished", append(attrs, "error", run.Error)...)
+	} else {
+		logger.Info("job finished", attrs...)
+	}
+	return run
+}
+
+// errTaskPanicked marks a task error from a panic, which callTask has
+// already reported.
+var errTaskPanicked = errors.New("panic")
+
+// callTask runs runTask, turning a panic into an error so the run is still
+// reported.
+func callTask(ctx context.Context) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			slog.Error("panic running task",
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()))
+			reportPanic(nil, recovered)
+			err = fmt.Errorf("%w: %v", errTaskPanicked, recovered)
+		}
+	}()
+	return runTask(ctx)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunOnce(t *testing.T) {
+	run := runOnce(context.Background())
+	if run.Status != "succeeded" || run.ExitCode != exitSucceeded || run.Error != "" || run.DurationMS <= 0 {
+		t.Fatalf("runOnce = %+v, want a successful run", run)
+	}
+}
+
+func TestRunOnceTimedOut(t *testing.T) {
+	t.Setenv("JOB_MAX_RUNTIME", "50ms")
+	if run := runOnce(context.Background()); run.Status != "timed_out" || run.ExitCode != exitTimedOut {
+		t.Fatalf("runOnce past JOB_MAX_RUNTIME = %+v, want timed_out with exit code %d", run, exitTimedOut)
+	}
+}
+
+func TestRunOnceCancelled(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+	if run := runOnce(ctx); run.Status != "cancelled" || run.ExitCode != exitCancelled {
+		t.Fatalf("runOnce after a stop signal = %+v, want cancelled with exit code %d", run, exitCancelled)
+	}
+}
+
+// webhookRecorder is a webhook endpoint that answers with the given
+// statuses in turn, then 200, and keeps the reports it received.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	reports  []webhookPayload
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var p webhookPayload
+	json.Unmarshal(body, &p)
+	rec.reports = append(rec.reports, p)
+	if len(rec.statuses) > 0 {
+		w.WriteHeader(rec.statuses[0])
+		rec.statuses = rec.statuses[1:]
+	}
+}
+
+func newWebhook(t *testing.T, statuses ...int) *webhookRecorder {
+	t.Helper()
+	rec := &webhookRecorder{statuses: statuses}
+	srv := httptest.NewServer(rec)
+	t.Cleanup(srv.Close)
+	t.Setenv("JOB_WEBHOOK_URL", srv.URL)
+	return rec
+}
+
+var failedRun = jobRun{Job: "nightly-report", Status: "failed", ExitCode: exitFailed, Error: "upstream unavailable", DurationMS: 1500}
+
+func TestNotifyWebhook(t *testing.T) {
+	rec := newWebhook(t, http.StatusServiceUnavailable)
+	notifyWebhook(context.Background(), failedRun)
+
+	if len(rec.reports) != 2 {
+		t.Fatalf("webhook received %d reports, want a retry after the 503", len(rec.reports))
+	}
+	got := rec.reports[1]
+	if got.Job != "nightly-report" || got.ExitCode != exitFailed ||
+		!strings.HasPrefix(got.Text, "nightly-report failed in 1.5s") || !strings.HasSuffix(got.Text, ": upstream unavailable") {
+		t.Fatalf("report = %+v, want the run with a readable summary", got)
+	}
+}
+
+func TestNotifyWebhookOnFailureOnly(t *testing.T) {
+	rec := newWebhook(t)
+	t.Setenv("JOB_WEBHOOK_ON", "failure")
+
+	notifyWebhook(context.Background(), jobRun{Job: "nightly-report", Status: "succeeded", ExitCode: exitSucceeded})
+	if len(rec.reports) != 0 {
+		t.Fatalf("webhook received %d reports of a successful run with JOB_WEBHOOK_ON=failure, want none", len(rec.reports))
+	}
+	notifyWebhook(context.Background(), failedRun)
+	if len(rec.reports) != 1 {
+		t.Fatalf("webhook received %d reports of a failed run, want one", len(rec.reports))
+	}
+}
+
+func TestNotifyWebhookGivesUp(t *testing.T) {
+	rec := newWebhook(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	notifyWebhook(ctx, failedRun)
+	if len(rec.reports) != webhookAttempts {
+		t.Fatalf("webhook received %d reports, want %d attempts", len(rec.reports), webhookAttempts)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Run reports. When JOB_WEBHOOK_URL is set, each run's jobRun is POSTed to
+// it as JSON with a "text" summary added, the field Slack and Teams
+// incoming webhooks display. A failing webhook is logged and retried a
+// couple of times but never changes the run's exit code.
+
+const (
+	// webhookTimeout bounds reporting, retries included.
+	webhookTimeout   = 15 * time.Second
+	webhookAttempts  = 3
+	webhookRetryWait = time.Second
+)
+
+type webhookPayload struct {
+	jobRun
+	Text string `json:"text"`
+}
+
+// notifyWebhook reports run, honouring JOB_WEBHOOK_ON.
+func notifyWebhook(ctx context.Context, run jobRun) {
+	url := conf("JOB_WEBHOOK_URL")
+	if url == "" || (conf("JOB_WEBHOOK_ON") == "failure" && run.ExitCode == exitSucceeded) {
+		return
+	}
+
+	text := fmt.Sprintf("%s %s in %s (%s, exit code %d)", run.Job, strings.ReplaceAll(run.Status, "_", " "),
+		time.Duration(run.DurationMS*float64(time.Millisecond)).Round(time.Millisecond), run.Environment, run.ExitCode)
+	if run.Error != "" {
+		text += ": " + run.Error
+	}
+	body, err := json.Marshal(webhookPayload{jobRun: run, Text: text})
+	if err != nil {
+		slog.Error("encoding job report failed", "error", err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(webhookRetryWait * time.Duration(attempt-1)):
+			case <-ctx.Done():
+				slog.Warn("job report not sent", "error", err)
+				return
+			}
+		}
+		if err = postReport(ctx, url, body); err == nil {
+			slog.Info("job report sent", "attempt", attempt)
+			return
+		}
+	}
+	slog.Warn("job report not sent", "error", err)
+}
+
+func postReport(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", serviceName+"/"+version.GitSHA)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// The app: a Prometheus exporter for domain metrics, the numbers no
+// library exports for you (orders waiting to ship, rows behind in a sync,
+// days until a contract renews). Collectors compute them from a SQL query,
+// a JSON API, a command, or Go code, and /metrics serves them next to the
+// platform metrics; see exporter.go for how they are run and sources.go
+// for the sources.
+//
+//	EXPORTER_COLLECTORS    JSON array of collectors; default [% EXPORTER_COLLECTORS %]
+//	EXPORTER_INTERVAL      default time between a collector's runs (30s)
+//	EXPORTER_TIMEOUT       default deadline for one run (10s)
+//	DATABASE_URL           Postgres URL, needed by sql collectors
+//	DB_MAX_OPEN_CONNS      pool size (default 2)
+//	DB_MAX_IDLE_CONNS      connections kept open when idle (default 2)
+//	DB_CONN_MAX_LIFETIME   connections are recycled after this long (30m)
+//	DB_CONN_MAX_IDLE_TIME  idle connections are closed after this long (5m)
+//
+// The DB_* pool settings are reloadable.
+//
+// A collector:
+//
+//	{
+//	  "name": "orders_pending",                 metric name
+//	  "help": "Orders waiting to ship.",        HELP text
+//	  "type": "gauge",                          gauge (default) or counter
+//	  "labels": ["region"],                     label names
+//	  "interval": "1m",                         overrides EXPORTER_INTERVAL
+//	  "timeout": "5s",                          overrides EXPORTER_TIMEOUT
+//
+//	  and exactly one source:
+//	  "sql": "SELECT region, count(*) FROM orders WHERE state = 'pending' GROUP BY region",
+//	  "url": "https://status.example.com/api/queues", "path": "depth",
+//	         "headers": {"Authorization": "Bearer ${STATUS_API_TOKEN}"},
+//	  "command": ["/opt/exporter/backup-age"]
+//	}
+//
+// The exporter runs whatever query it is given: give DATABASE_URL a role
+// that can only read the tables the queries need.
+
+var appSettings = []setting{
+	// May hold URLs with credentials.
+	{name: "EXPORTER_COLLECTORS", def: `[% EXPORTER_COLLECTORS %]`, secret: true, check: checkCollectors},
+	{name: "EXPORTER_INTERVAL", kind: kindDuration, def: "30s"},
+	{name: "EXPORTER_TIMEOUT", kind: kindDuration, def: "10s"},
+	{name: "DATABASE_URL", secret: true},
+	{name: "DB_MAX_OPEN_CONNS", kind: kindInt, def: "2", check: atLeast(1), reloadable: true},
+	{name: "DB_MAX_IDLE_CONNS", kind: kindInt, def: "2", check: atLeast(0), reloadable: true},
+	{name: "DB_CONN_MAX_LIFETIME", kind: kindDuration, def: "30m", reloadable: true},
+	{name: "DB_CONN_MAX_IDLE_TIME", kind: kindDuration, def: "5m", reloadable: true},
+}
+
+// goCollectors are the collectors written in Go, run next to those in
+// EXPORTER_COLLECTORS. Replace the sample with your own; collect is given
+// the collector's timeout as its deadline and returns one sample per set
+// of label values:
+//
+//	{
+//		name:   "invoices_overdue",
+//		help:   "Unpaid invoices past their due date.",
+//		labels: []string{"currency"},
+//		collect: func(ctx context.Context) ([]sample, error) {
+//			totals, err := billing.Overdue(ctx)
+//			...
+//		},
+//	}
+var goCollectors = []*collector{
+	{
+		name: "exporter_sample_items",
+		help: "A sample metric from app.go; replace it with your own.",
+		kind: "gauge",
+		collect: func(ctx context.Context) ([]sample, error) {
+			return []sample{{value: 42}}, nil
+		},
+	},
+}
+
+// db is the connection pool of sql collectors, opened by setupApp when
+// there are any.
+var db *sql.DB
+
+func setupApp(mux *http.ServeMux) error {
+	configured, err := parseCollectors(conf("EXPORTER_COLLECTORS"))
+	if err != nil {
+		return fmt.Errorf("EXPORTER_COLLECTORS: %w", err)
+	}
+	if err := addCollectors(slices.Concat(goCollectors, configured)...); err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(collectors, func(c *collector) bool { return c.source == "sql" }) {
+		if conf("DATABASE_URL") == "" {
+			return errors.New("sql collectors need DATABASE_URL")
+		}
+		if db, err = openDB(conf("DATABASE_URL")); err != nil {
+			return err
+		}
+		// No readiness check: an unready exporter drops out of the
+		// Service, and Prometheus would lose exporter_collector_up too.
+	}
+
+	for _, c := range collectors {
+		slog.Info("collector", "name", c.name, "source", c.source, "interval", c.interval.String(), "timeout", c.timeout.String())
+	}
+	registerMetrics(writeCollectorMetrics)
+	registerBackground("collectors", runCollectors)
+	handleGet(mux, "/api/collectors", collectorsHandler)
+	return nil
+}
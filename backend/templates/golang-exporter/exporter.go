@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collectors. Each one produces a metric family, on its own interval, and
+// the last successful result is served on /metrics after the platform's
+// own metrics, so Prometheus scrapes one endpoint. Collection runs in the
+// background rather than on scrape: a slow query delays no scrape, and two
+// Prometheus replicas scraping do not run it twice. Scrape at least as
+// often as the shortest interval.
+//
+// A collector that fails or times out exports nothing until it succeeds
+// again, rather than a stale value that looks current; alert on
+// exporter_collector_up == 0 instead. GET /api/collectors reports each
+// collector's last run and error.
+//
+//	exporter_collector_up                              gauge    collector
+//	exporter_collector_duration_seconds                gauge    collector
+//	exporter_collector_last_success_timestamp_seconds  gauge    collector
+//	exporter_collector_errors_total                    counter  collector
+
+// sample is one value of a collector's metric.
+type sample struct {
+	labels []string // label values, in the order of the collector's labels
+	value  float64
+}
+
+type collector struct {
+	name     string // the metric name
+	help     string
+	kind     string // gauge or counter
+	labels   []string
+	source   string // sql, url, command or go
+	interval time.Duration
+	timeout  time.Duration
+	collect  func(ctx context.Context) ([]sample, error)
+
+	mu       sync.Mutex
+	samples  []sample
+	up       bool
+	duration time.Duration
+	lastOK   time.Time
+	lastErr  string
+	errors   int64
+}
+
+var (
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// validate checks what every collector needs, whatever its source, and
+// fills in the defaults that need no configuration.
+func (c *collector) validate() error {
+	if c.source == "" {
+		c.source = "go"
+	}
+	if !metricNameRe.MatchString(c.name) {
+		return fmt.Errorf("%q is not a valid metric name", c.name)
+	}
+	if c.kind == "" {
+		c.kind = "gauge"
+	}
+	if c.kind != "gauge" && c.kind != "counter" {
+		return fmt.Errorf("%s: type %q: want gauge or counter", c.name, c.kind)
+	}
+	for _, l := range c.labels {
+		if !labelNameRe.MatchString(l) || strings.HasPrefix(l, "__") {
+			return fmt.Errorf("%s: %q is not a valid label name", c.name, l)
+		}
+	}
+	if c.help == "" {
+		c.help = c.name + " collected from " + c.source + "."
+	}
+	return nil
+}
+
+// run collects once and records the result.
+func (c *collector) run(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	samples, err := c.collect(ctx)
+	if err == nil {
+		err = c.checkSamples(samples)
+	}
+	elapsed := time.Since(start)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.duration = elapsed
+	if err != nil {
+		if c.up || c.lastErr != err.Error() {
+			slog.Warn("collector failed", "collector", c.name, "source", c.source, "error", err)
+		}
+		c.samples, c.up, c.lastErr = nil, false, err.Error()
+		c.errors++
+		return
+	}
+	if !c.up && c.lastErr != "" {
+		slog.Info("collector recovered", "collector", c.name)
+	}
+	c.samples, c.up, c.lastErr, c.lastOK = samples, true, "", time.Now()
+}
+
+// checkSamples rejects results the exposition format cannot carry: a
+// label count that does not match, or the same labels twice.
+func (c *collector) checkSamples(samples []sample) error {
+	seen := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		if len(s.labels) != len(c.labels) {
+			return fmt.Errorf("sample with %d label values, want %d (%s)", len(s.labels), len(c.labels), strings.Join(c.labels, ", "))
+		}
+		key := strings.Join(s.labels, "\x00")
+		if seen[key] {
+			return fmt.Errorf("two samples with labels %s", strings.Join(s.labels, ", "))
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// loop collects every interval until ctx is cancelled.
+func (c *collector) loop(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.run(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectors are every configured collector, set by setupApp.
+var collectors []*collector
+
+// runCollectors is the background service running every collector.
+func runCollectors(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, c := range collectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func writeCollectorMetrics(w io.Writer) {
+	for _, c := range collectors {
+		c.mu.Lock()
+		if len(c.samples) > 0 {
+			fmt.Fprintf(w, "# HELP %s %s\n", c.name, strings.ReplaceAll(c.help, "\n", " "))
+			fmt.Fprintf(w, "# TYPE %s %s\n", c.name, c.kind)
+			for _, s := range c.samples {
+				fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatFloat(s.value))
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	type state struct {
+		name, up, duration, lastOK string
+		errors                     int64
+	}
+	states := make([]state, len(collectors))
+	for i, c := range collectors {
+		c.mu.Lock()
+		states[i] = state{
+			name:     escapeLabel(c.name),
+			up:       "0",
+			duration: formatFloat(c.duration.Seconds()),
+			errors:   c.errors,
+		}
+		if c.up {
+			states[i].up = "1"
+		}
+		if !c.lastOK.IsZero() {
+			states[i].lastOK = formatFloat(float64(c.lastOK.UnixMilli()) / 1000)
+		}
+		c.mu.Unlock()
+	}
+	fmt.Fprintln(w, "# HELP exporter_collector_up Whether the collector's last run succeeded.")
+	fmt.Fprintln(w, "# TYPE exporter_collector_up gauge")
+	for _, s := range states {
+		fmt.Fprintf(w, "exporter_collector_up{collector=\"%s\"} %s\n", s.name, s.up)
+	}
+	fmt.Fprintln(w, "# HELP exporter_collector_duration_seconds How long the collector's last run took.")
+	fmt.Fprintln(w, "# TYPE exporter_collector_duration_seconds gauge")
+	for _, s := range states {
+		fmt.Fprintf(w, "exporter_collector_duration_seconds{collector=\"%s\"} %s\n", s.name, s.duration)
+	}
+	fmt.Fprintln(w, "# HELP exporter_collector_last_success_timestamp_seconds When the collector last succeeded.")
+	fmt.Fprintln(w, "# TYPE exporter_collector_last_success_timestamp_seconds gauge")
+	for _, s := range states {
+		if s.lastOK != "" {
+			fmt.Fprintf(w, "exporter_collector_last_success_timestamp_seconds{collector=\"%s\"} %s\n", s.name, s.lastOK)
+		}
+	}
+	fmt.Fprintln(w, "# HELP exporter_collector_errors_total Failed collector runs.")
+	fmt.Fprintln(w, "# TYPE exporter_collector_errors_total counter")
+	for _, s := range states {
+		fmt.Fprintf(w, "exporter_collector_errors_total{collector=\"%s\"} %d\n", s.name, s.errors)
+	}
+}
+
+// formatLabels renders {name="value",...}, or nothing without labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// CollectorStatus is one entry of GET /api/collectors.
+type CollectorStatus struct {
+	Name        string     `json:"name"`
+	Source      string     `json:"source"`
+	Interval    string     `json:"interval"`
+	Up          bool       `json:"up"`
+	Samples     int        `json:"samples"`
+	DurationMS  float64    `json:"duration_ms"`
+	LastSuccess *time.Time `json:"last_success"`
+	LastError   string     `json:"last_error,omitempty"`
+	Errors      int64      `json:"errors"`
+}
+
+func collectorsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := make([]CollectorStatus, 0, len(collectors))
+	for _, c := range collectors {
+		c.mu.Lock()
+		s := CollectorStatus{
+			Name:       c.name,
+			Source:     c.source,
+			Interval:   c.interval.String(),
+			Up:         c.up,
+			Samples:    len(c.samples),
+			DurationMS: float64(c.duration.Microseconds()) / 1000,
+			LastError:  c.lastErr,
+			Errors:     c.errors,
+		}
+		if !c.lastOK.IsZero() {
+			t := c.lastOK.UTC()
+			s.LastSuccess = &t
+		}
+		c.mu.Unlock()
+		resp = append(resp, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// collectorSpec is one entry of EXPORTER_COLLECTORS.
+type collectorSpec struct {
+	Name     string            `json:"name"`
+	Help     string            `json:"help"`
+	Type     string            `json:"type"`
+	Labels   []string          `json:"labels"`
+	Interval string            `json:"interval"`
+	Timeout  string            `json:"timeout"`
+	SQL      string            `json:"sql"`
+	URL      string            `json:"url"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers"`
+	Command  []string          `json:"command"`
+}
+
+// parseCollectors parses and validates EXPORTER_COLLECTORS.
+func parseCollectors(v string) ([]*collector, error) {
+	var specs []collectorSpec
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&specs); err != nil {
+		return nil, fmt.Errorf("want a JSON array of collectors: %w", err)
+	}
+	var out []*collector
+	for i, spec := range specs {
+		c, err := spec.collector()
+		if err != nil {
+			return nil, fmt.Errorf("collector %d: %w", i, err)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func checkCollectors(v string) error {
+	_, err := parseCollectors(v)
+	return err
+}
+
+func (spec collectorSpec) collector() (*collector, error) {
+	c := &collector{name: spec.Name, help: spec.Help, kind: spec.Type, labels: spec.Labels}
+	var err error
+	if c.interval, err = specDuration("interval", spec.Interval); err != nil {
+		return nil, fmt.Errorf("%s: %w", spec.Name, err)
+	}
+	if c.timeout, err = specDuration("timeout", spec.Timeout); err != nil {
+		return nil, fmt.Errorf("%s: %w", spec.Name, err)
+	}
+
+	var sources []string
+	if spec.SQL != "" {
+		sources = append(sources, "sql")
+	}
+	if spec.URL != "" {
+		sources = append(sources, "url")
+	}
+	if len(spec.Command) > 0 {
+		sources = append(sources, "command")
+	}
+	if len(sources) != 1 {
+		return nil, fmt.Errorf("%s: want exactly one of sql, url or command", spec.Name)
+	}
+	if (spec.Path != "" || spec.Headers != nil) && spec.URL == "" {
+		return nil, fmt.Errorf("%s: path and headers only apply to url collectors", spec.Name)
+	}
+	c.source = sources[0]
+
+	switch c.source {
+	case "sql":
+		c.collect = sqlCollector(spec.SQL, len(c.labels))
+	case "url":
+		if len(c.labels) > 1 {
+			return nil, fmt.Errorf("%s: url collectors take at most one label", spec.Name)
+		}
+		if c.collect, err = urlCollector(spec.URL, spec.Path, spec.Headers, len(c.labels)); err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+	case "command":
+		c.collect = commandCollector(spec.Command, len(c.labels))
+	}
+	return c, c.validate()
+}
+
+// specDuration parses an optional interval or timeout; zero means the
+// default.
+func specDuration(field, v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s %q: want a positive duration such as 30s", field, v)
+	}
+	return d, nil
+}
+
+// addCollectors validates the collectors and adds them to collectors,
+// rejecting duplicate names. Those without an interval or timeout get
+// EXPORTER_INTERVAL and EXPORTER_TIMEOUT.
+func addCollectors(cs ...*collector) error {
+	for _, c := range cs {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.interval <= 0 {
+			c.interval = confDuration("EXPORTER_INTERVAL")
+		}
+		if c.timeout <= 0 {
+			c.timeout = confDuration("EXPORTER_TIMEOUT")
+		}
+		if slices.ContainsFunc(collectors, func(other *collector) bool { return other.name == c.name }) {
+			return fmt.Errorf("two collectors named %s", c.name)
+		}
+		collectors = append(collectors, c)
+	}
+	return nil
+}
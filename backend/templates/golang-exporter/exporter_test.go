@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCollectors swaps in cs as the configured collectors for one test.
+func withCollectors(t *testing.T, cs ...*collector) {
+	t.Helper()
+	saved := collectors
+	collectors = nil
+	t.Cleanup(func() { collectors = saved })
+	if err := addCollectors(cs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCollectors(t *testing.T) {
+	cs, err := parseCollectors(`[
+		{"name": "queue_depth", "url": "http://status:8080/queues", "path": "depth", "interval": "1m"},
+		{"name": "backups_total", "type": "counter", "labels": ["kind"], "command": ["/opt/backups", "--count"]},
+		{"name": "orders", "labels": ["state"], "sql": "SELECT state, count(*) FROM orders GROUP BY state"}
+	]`)
+	if err != nil || len(cs) != 3 {
+		t.Fatalf("parseCollectors = %d collectors, %v, want 3", len(cs), err)
+	}
+	withCollectors(t, cs...)
+	if cs[0].source != "url" || cs[0].interval != time.Minute || cs[0].timeout != 10*time.Second || cs[0].kind != "gauge" {
+		t.Errorf("url collector = %+v, want a gauge every minute with the default timeout", cs[0])
+	}
+	if cs[1].source != "command" || cs[1].kind != "counter" || cs[2].source != "sql" {
+		t.Errorf("sources = %s, %s, want command and sql", cs[1].source, cs[2].source)
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`[{"name": "9lives", "url": "http://x/"}]`,
+		`[{"name": "x", "url": "http://x/", "command": ["/bin/x"]}]`,
+		`[{"name": "x"}]`,
+		`[{"name": "x", "url": "ftp://x/"}]`,
+		`[{"name": "x", "url": "http://x/", "labels": ["a", "b"]}]`,
+		`[{"name": "x", "command": ["/bin/x"], "path": "a"}]`,
+		`[{"name": "x", "command": ["/bin/x"], "labels": ["__name"]}]`,
+		`[{"name": "x", "command": ["/bin/x"], "type": "histogram"}]`,
+		`[{"name": "x", "command": ["/bin/x"], "interval": "-1s"}]`,
+		`[{"name": "x", "command": ["/bin/x"], "query": "SELECT 1"}]`,
+	} {
+		if err := checkCollectors(bad); err == nil {
+			t.Errorf("EXPORTER_COLLECTORS=%s accepted", bad)
+		}
+	}
+}
+
+func TestURLCollector(t *testing.T) {
+	t.Setenv("STATUS_API_TOKEN", "s3cret")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"data": {"depth": 7, "healthy": true, "queues": {"sms": 2, "email": 12.5}, "items": [{"n": 3}]}}`))
+	}))
+	defer srv.Close()
+	headers := map[string]string{"Authorization": "Bearer ${STATUS_API_TOKEN}"}
+
+	for _, tc := range []struct {
+		path   string
+		labels int
+		want   []sample
+	}{
+		{"data.depth", 0, []sample{{value: 7}}},
+		{"data.healthy", 0, []sample{{value: 1}}},
+		{"data.items.0.n", 0, []sample{{value: 3}}},
+		{"data.queues", 1, []sample{{labels: []string{"email"}, value: 12.5}, {labels: []string{"sms"}, value: 2}}},
+	} {
+		collect, err := urlCollector(srv.URL, tc.path, headers, tc.labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := collect(context.Background())
+		if err != nil || !samplesEqual(got, tc.want) {
+			t.Errorf("path %s = %v, %v, want %v", tc.path, got, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		path   string
+		labels int
+	}{{"data.missing", 0}, {"data.queues", 0}, {"data.depth", 1}, {"data.items", 0}} {
+		collect, _ := urlCollector(srv.URL, tc.path, headers, tc.labels)
+		if _, err := collect(context.Background()); err == nil {
+			t.Errorf("path %s with %d labels succeeded", tc.path, tc.labels)
+		}
+	}
+	collect, _ := urlCollector(srv.URL, "data.depth", nil, 0)
+	if _, err := collect(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unauthorized GET = %v, want the status in the error", err)
+	}
+}
+
+func TestCommandCollector(t *testing.T) {
+	collect := commandCollector([]string{"sh", "-c", "echo '# backups by kind'; echo full 3; echo; echo incremental 41"}, 1)
+	got, err := collect(context.Background())
+	want := []sample{{labels: []string{"full"}, value: 3}, {labels: []string{"incremental"}, value: 41}}
+	if err != nil || !samplesEqual(got, want) {
+		t.Fatalf("command = %v, %v, want %v", got, err, want)
+	}
+
+	for _, argv := range [][]string{
+		{"sh", "-c", "echo oops >&2; exit 3"},
+		{"sh", "-c", "echo full three"},
+		{"sh", "-c", "echo 3"},
+		{"/no/such/command"},
+	} {
+		if _, err := commandCollector(argv, 1)(context.Background()); err == nil {
+			t.Errorf("command %q succeeded", argv)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := commandCollector([]string{"sleep", "10"}, 0)(ctx); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("command past its timeout = %v after %s, want it killed", err, time.Since(start))
+	}
+}
+
+func TestCollectorMetrics(t *testing.T) {
+	fail := false
+	c := &collector{
+		name:   "orders_pending",
+		help:   "Orders waiting to ship.",
+		labels: []string{"region"},
+		collect: func(context.Context) ([]sample, error) {
+			if fail {
+				return nil, errors.New("database is down")
+			}
+			return []sample{{labels: []string{"eu"}, value: 3}, {labels: []string{`us "east"`}, value: 5}}, nil
+		},
+	}
+	withCollectors(t, c)
+	c.run(context.Background())
+
+	var out strings.Builder
+	writeCollectorMetrics(&out)
+	for _, want := range []string{
+		"# HELP orders_pending Orders waiting to ship.\n# TYPE orders_pending gauge\n",
+		`orders_pending{region="eu"} 3`,
+		`orders_pending{region="us \"east\""} 5`,
+		`exporter_collector_up{collector="orders_pending"} 1`,
+		`exporter_collector_errors_total{collector="orders_pending"} 0`,
+		`exporter_collector_last_success_timestamp_seconds{collector="orders_pending"} `,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+
+	// A failed run exports no stale values.
+	fail = true
+	c.run(context.Background())
+	out.Reset()
+	writeCollectorMetrics(&out)
+	if strings.Contains(out.String(), "orders_pending{") || !strings.Contains(out.String(), `exporter_collector_up{collector="orders_pending"} 0`) {
+		t.Errorf("metrics after a failed run:\n%s\nwant no samples and up 0", out.String())
+	}
+
+	w := do(http.HandlerFunc(collectorsHandler), "GET", "/api/collectors", nil)
+	var resp []CollectorStatus
+	decode(t, w, &resp)
+	if len(resp) != 1 || resp[0].Up || resp[0].LastError != "database is down" || resp[0].Errors != 1 || resp[0].LastSuccess == nil {
+		t.Errorf("GET /api/collectors = %+v, want the failure and the earlier success", resp)
+	}
+}
+
+func TestCollectorChecksSamples(t *testing.T) {
+	for name, samples := range map[string][]sample{
+		"missing label": {{value: 1}},
+		"duplicate":     {{labels: []string{"a"}, value: 1}, {labels: []string{"a"}, value: 2}},
+	} {
+		c := &collector{name: "x", labels: []string{"l"}, collect: func(context.Context) ([]sample, error) { return samples, nil }}
+		withCollectors(t, c)
+		c.run(context.Background())
+		if c.up {
+			t.Errorf("%s: collector up, want the run rejected", name)
+		}
+	}
+	if err := addCollectors(&collector{name: "x"}); err == nil {
+		t.Error("second collector named x accepted")
+	}
+}
+
+func samplesEqual(a, b []sample) bool {
+	return slices.EqualFunc(a, b, func(x, y sample) bool {
+		return x.value == y.value && slices.Equal(x.labels, y.labels)
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The collector sources of EXPORTER_COLLECTORS. Each returns the samples
+// of one run; the collector's labels say how many label values a sample
+// carries.
+
+// maxSourceOutput bounds what is read of a url collector's response.
+const maxSourceOutput = 10 << 20
+
+// sqlCollector runs query on db. Each row is a sample: the columns before
+// the last are its label values, the last is its value (a number, a
+// boolean, or a timestamp, exported as Unix seconds).
+func sqlCollector(query string, labels int) func(context.Context) ([]sample, error) {
+	return func(ctx context.Context) ([]sample, error) {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		cols, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		if len(cols) != labels+1 {
+			return nil, fmt.Errorf("query returns %d columns, want %d: the label values, then the value", len(cols), labels+1)
+		}
+
+		var samples []sample
+		values := make([]any, len(cols))
+		dest := make([]any, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				return nil, err
+			}
+			s := sample{labels: make([]string, labels)}
+			for i := range labels {
+				s.labels[i] = sqlText(values[i])
+			}
+			if s.value, err = sqlNumber(values[labels]); err != nil {
+				return nil, fmt.Errorf("column %s: %w", cols[labels], err)
+			}
+			samples = append(samples, s)
+		}
+		return samples, rows.Err()
+	}
+}
+
+func sqlText(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sqlNumber(v any) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case time.Time:
+		return float64(v.UnixMilli()) / 1000, nil
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case nil:
+		return 0, errors.New("value is NULL")
+	default:
+		return 0, fmt.Errorf("%T is not a number", v)
+	}
+}
+
+// collectorClient makes url collectors' requests. Their deadline is the
+// collector's timeout.
+var collectorClient = &http.Client{}
+
+// urlCollector GETs rawURL and reads JSON from it. path is a dotted path
+// into the document ("data.queues", "items.0.count"; empty for the whole
+// document) leading to a number, a sample without labels, or an object of
+// numbers, a sample per key with the key as the one label value. Header
+// values may reference environment variables, as in
+// {"Authorization": "Bearer ${STATUS_API_TOKEN}"}, so tokens stay in a
+// Secret.
+func urlCollector(rawURL, path string, headers map[string]string, labels int) (func(context.Context) ([]sample, error), error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q: want an http:// or https:// URL", rawURL)
+	}
+	var segments []string
+	if path != "" {
+		segments = strings.Split(path, ".")
+	}
+	return func(ctx context.Context) ([]sample, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, os.ExpandEnv(v))
+		}
+		resp, err := collectorClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("GET %s: %s", u.Redacted(), resp.Status)
+		}
+		var doc any
+		dec := json.NewDecoder(io.LimitReader(resp.Body, maxSourceOutput))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("GET %s: %w", u.Redacted(), err)
+		}
+		for i, seg := range segments {
+			if doc, err = jsonChild(doc, seg); err != nil {
+				return nil, fmt.Errorf("path %s: %w", strings.Join(segments[:i+1], "."), err)
+			}
+		}
+		return jsonSamples(doc, labels)
+	}, nil
+}
+
+func jsonChild(doc any, seg string) (any, error) {
+	switch doc := doc.(type) {
+	case map[string]any:
+		if v, ok := doc[seg]; ok {
+			return v, nil
+		}
+	case []any:
+		if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(doc) {
+			return doc[i], nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func jsonSamples(doc any, labels int) ([]sample, error) {
+	if obj, ok := doc.(map[string]any); ok {
+		if labels != 1 {
+			return nil, errors.New("is an object; give the collector one label for its keys")
+		}
+		var samples []sample
+		for _, k := range slices.Sorted(maps.Keys(obj)) {
+			v, err := jsonNumber(obj[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			samples = append(samples, sample{labels: []string{k}, value: v})
+		}
+		return samples, nil
+	}
+	if labels != 0 {
+		return nil, errors.New("is a single value; a labelled collector needs an object")
+	}
+	v, err := jsonNumber(doc)
+	if err != nil {
+		return nil, err
+	}
+	return []sample{{value: v}}, nil
+}
+
+func jsonNumber(v any) (float64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+}
+
+// commandCollector runs argv, without a shell. Each line it prints is a
+// sample: the label values, separated by whitespace, then the value.
+// Empty lines and lines starting with # are skipped. A non-zero exit
+// fails the run. The command is killed when the collector's timeout
+// passes.
+//
+// The image is distroless, with no shell or tools: commands must be
+// static binaries copied into it in the Dockerfile.
+func commandCollector(argv []string, labels int) func(context.Context) ([]sample, error) {
+	return func(ctx context.Context) ([]sample, error) {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.WaitDelay = time.Second
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %w: %s", argv[0], err, lastLine(msg))
+			}
+			return nil, fmt.Errorf("%s: %w", argv[0], err)
+		}
+
+		var samples []sample
+		sc := bufio.NewScanner(&stdout)
+		for n := 1; sc.Scan(); n++ {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != labels+1 {
+				return nil, fmt.Errorf("line %d: %d fields, want %d: the label values, then the value", n, len(fields), labels+1)
+			}
+			v, err := strconv.ParseFloat(fields[labels], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %q is not a number", n, fields[labels])
+			}
+			samples = append(samples, sample{labels: fields[:labels], value: v})
+		}
+		return samples, sc.Err()
+	}
+}
+
+func lastLine(s string) string {
+	return s[strings.LastIndex(s, "\n")+1:]
+}
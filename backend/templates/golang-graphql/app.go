@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// The app: a schema-first GraphQL API next to the landing page.
+// schema.graphql defines the API, resolvers.go implements it over an
+// in-memory notes store and graphql.go serves it:
+//
+//	POST /graphql  run a query or mutation, {"query", "operationName",
+//	               "variables"} in, {"data", "errors"} out
+//	GET /graphql   the GraphiQL playground, when GRAPHQL_PLAYGROUND is set
+//
+//	GRAPHQL_PLAYGROUND       "true" serves GraphiQL on GET /graphql; it
+//	                         loads from a CDN, so leave it off in prod
+//	GRAPHQL_INTROSPECTION    "false" rejects introspection queries, hiding
+//	                         the schema from clients (and the playground)
+//	GRAPHQL_MAX_DEPTH        deepest selection nesting a query may have
+//	                         (default 10)
+//	GRAPHQL_MAX_PARALLELISM  resolvers run concurrently per request
+//	                         (default 10)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "GRAPHQL_PLAYGROUND", kind: kindBool, def: "false"},
+	{name: "GRAPHQL_INTROSPECTION", kind: kindBool, def: "true"},
+	{name: "GRAPHQL_MAX_DEPTH", kind: kindInt, def: "10", check: atLeast(1)},
+	{name: "GRAPHQL_MAX_PARALLELISM", kind: kindInt, def: "10", check: atLeast(1)},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	schema, err := parseSchema()
+	if err != nil {
+		return fmt.Errorf("graphql schema: %w", err)
+	}
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.Handle("POST /graphql", graphqlHandler(schema))
+	if confBool("GRAPHQL_PLAYGROUND") {
+		mux.HandleFunc("GET /graphql", playgroundHandler)
+		mux.HandleFunc("/graphql", methodNotAllowed("GET, HEAD, POST"))
+	} else {
+		mux.HandleFunc("/graphql", methodNotAllowed("POST"))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	gqllog "github.com/graph-gophers/graphql-go/log"
+)
+
+// GraphQL over HTTP with graphql-go. The schema is parsed against the
+// resolvers at startup, so a field without a resolver stops the app
+// rather than failing its first query. A request that reaches the
+// executor always answers 200, with any failures in "errors" next to the
+// data that did resolve; only a body that is not a GraphQL request gets a
+// 4xx. Panics in resolvers are logged with their stack and reported to
+// the client as an internal error, without the panic value.
+
+//go:embed schema.graphql
+var schemaSource string
+
+//go:embed web/graphiql.html
+var playgroundPage []byte
+
+// graphqlRequest is the body of POST /graphql.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+	Extensions    map[string]any `json:"extensions"`
+}
+
+func parseSchema() (*graphql.Schema, error) {
+	opts := []graphql.SchemaOpt{
+		graphql.UseStringDescriptions(),
+		graphql.UseFieldResolvers(),
+		graphql.MaxDepth(confInt("GRAPHQL_MAX_DEPTH")),
+		graphql.MaxParallelism(confInt("GRAPHQL_MAX_PARALLELISM")),
+		graphql.Logger(gqllog.LoggerFunc(logPanic)),
+		graphql.PanicHandler(panicHandler{}),
+	}
+	if !confBool("GRAPHQL_INTROSPECTION") {
+		opts = append(opts, graphql.DisableIntrospection())
+	}
+	return graphql.ParseSchema(schemaSource, newResolver(), opts...)
+}
+
+func graphqlHandler(schema *graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphqlRequest
+		if err := readJSON(w, r, &req); err != nil {
+			writeGraphQLError(w, requestErrorStatus(err), err.Error())
+			return
+		}
+		if req.Query == "" {
+			writeGraphQLError(w, http.StatusBadRequest, "query is required")
+			return
+		}
+		resp := schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// writeGraphQLError answers a request the executor never saw, in the
+// {"errors": [...]} shape GraphQL clients read.
+func writeGraphQLError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string][]map[string]string{
+		"errors": {{"message": message}},
+	})
+}
+
+func playgroundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(playgroundPage)
+}
+
+// logPanic logs a resolver panic. graphql-go calls it from the recovering
+// function, so the stack is the panicking resolver's.
+func logPanic(ctx context.Context, value any) {
+	slog.ErrorContext(ctx, "panic resolving graphql field",
+		"request_id", requestIDFromContext(ctx),
+		"panic", fmt.Sprint(value),
+		"stack", string(debug.Stack()))
+}
+
+// panicHandler reports a resolver panic to the client without its value.
+type panicHandler struct{}
+
+func (panicHandler) MakePanicError(ctx context.Context, value any) *gqlerrors.QueryError {
+	return gqlerrors.Errorf("internal server error")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// graphqlResponse is the shape of every POST /graphql answer.
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// newGraphQLMux serves the app as setupApp wires it, with a fresh store.
+func newGraphQLMux(tb testing.TB) *http.ServeMux {
+	tb.Helper()
+	mux := http.NewServeMux()
+	if err := setupApp(mux); err != nil {
+		tb.Fatalf("setupApp: %v", err)
+	}
+	return mux
+}
+
+// execQuery posts a query and decodes the answer.
+func execQuery(t *testing.T, h http.Handler, query string, variables map[string]any) graphqlResponse {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"query": query, "variables": variables})
+	w := do(h, "POST", "/graphql", strings.NewReader(string(body)), "Content-Type", "application/json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /graphql = %d: %s", w.Code, w.Body)
+	}
+	var resp graphqlResponse
+	decode(t, w, &resp)
+	return resp
+}
+
+func TestNotesLifecycle(t *testing.T) {
+	mux := newGraphQLMux(t)
+
+	created := execQuery(t, mux, `mutation($input: NoteInput!) { createNote(input: $input) { id title body } }`,
+		map[string]any{"input": map[string]any{"title": "  Groceries ", "body": "milk"}})
+	var c struct {
+		CreateNote struct{ ID, Title, Body string }
+	}
+	if len(created.Errors) > 0 || json.Unmarshal(created.Data, &c) != nil || c.CreateNote.Title != "Groceries" {
+		t.Fatalf("createNote = %s %v, want the note with a trimmed title", created.Data, created.Errors)
+	}
+	id := c.CreateNote.ID
+
+	listed := execQuery(t, mux, `{ notes(first: 5) { id title } }`, nil)
+	if !strings.Contains(string(listed.Data), `"id":"`+id+`"`) {
+		t.Fatalf("notes = %s, want note %s", listed.Data, id)
+	}
+
+	deleted := execQuery(t, mux, `mutation($id: ID!) { deleteNote(id: $id) }`, map[string]any{"id": id})
+	if string(deleted.Data) != `{"deleteNote":true}` {
+		t.Fatalf("deleteNote = %s, want true", deleted.Data)
+	}
+	gone := execQuery(t, mux, `query($id: ID!) { note(id: $id) { id } }`, map[string]any{"id": id})
+	if string(gone.Data) != `{"note":null}` {
+		t.Fatalf("note after delete = %s, want null", gone.Data)
+	}
+}
+
+func TestCreateNoteValidation(t *testing.T) {
+	resp := execQuery(t, newGraphQLMux(t), `mutation { createNote(input: {title: "   "}) { id } }`, nil)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != "title is required" {
+		t.Fatalf("createNote with a blank title = %v, want title is required", resp.Errors)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	t.Setenv("GRAPHQL_MAX_DEPTH", "1")
+	resp := execQuery(t, newGraphQLMux(t), `{ notes { id } }`, nil)
+	if len(resp.Errors) == 0 {
+		t.Fatalf("query deeper than GRAPHQL_MAX_DEPTH = %s, want an error", resp.Data)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	const query = `{ __schema { queryType { name } } }`
+	if resp := execQuery(t, newGraphQLMux(t), query, nil); !strings.Contains(string(resp.Data), `"Query"`) {
+		t.Fatalf("introspection = %s %v, want the Query type", resp.Data, resp.Errors)
+	}
+
+	t.Setenv("GRAPHQL_INTROSPECTION", "false")
+	if resp := execQuery(t, newGraphQLMux(t), query, nil); strings.Contains(string(resp.Data), `"Query"`) {
+		t.Fatalf("introspection with GRAPHQL_INTROSPECTION=false = %s, want nothing", resp.Data)
+	}
+}
+
+func TestGraphQLBadRequests(t *testing.T) {
+	mux := newGraphQLMux(t)
+	for _, body := range []string{`not json`, `{}`, `{"query": "{ notes { id } }", "extra": 1}`} {
+		w := do(mux, "POST", "/graphql", strings.NewReader(body))
+		var resp graphqlResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusBadRequest || len(resp.Errors) != 1 {
+			t.Errorf("POST /graphql %s = %d %s, want 400 with one error", body, w.Code, w.Body)
+		}
+	}
+}
+
+func TestPlayground(t *testing.T) {
+	if w := do(newGraphQLMux(t), "GET", "/graphql", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /graphql without the playground = %d, want 405", w.Code)
+	}
+
+	t.Setenv("GRAPHQL_PLAYGROUND", "true")
+	w := do(newGraphQLMux(t), "GET", "/graphql", nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /graphql with the playground = %d %s, want 200 text/html", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	mux := newGraphQLMux(b)
+	body := `{"query": "{ notes(first: 5) { id title body } }"}`
+	b.ReportAllocs()
+	for b.Loop() {
+		if w := do(mux, "POST", "/graphql", strings.NewReader(body), "Content-Type", "application/json"); w.Code != http.StatusOK {
+			b.Fatalf("POST /graphql = %d: %s", w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+// The resolvers behind schema.graphql. Query and Mutation fields are
+// methods on resolver, named after the field; object fields are read from
+// the struct fields of the returned value. Arguments arrive as a struct
+// whose fields match the argument names, with nullable ones as pointers.
+// The notes live in memory, per replica and gone on restart; replace
+// notesStore with your database.
+
+const (
+	maxNotesPage       = 100
+	maxNoteTitleLength = 200
+	maxNoteBodyLength  = 10000
+	// maxNotes bounds the in-memory store.
+	maxNotes = 10000
+)
+
+type note struct {
+	ID        graphql.ID
+	Title     string
+	Body      string
+	CreatedAt graphql.Time
+}
+
+// noteInput is the NoteInput input type.
+type noteInput struct {
+	Title string
+	Body  string
+}
+
+func (in *noteInput) validate() error {
+	in.Title = strings.TrimSpace(in.Title)
+	switch {
+	case in.Title == "":
+		return errors.New("title is required")
+	case utf8.RuneCountInString(in.Title) > maxNoteTitleLength:
+		return errors.New("title must be at most " + strconv.Itoa(maxNoteTitleLength) + " characters")
+	case utf8.RuneCountInString(in.Body) > maxNoteBodyLength:
+		return errors.New("body must be at most " + strconv.Itoa(maxNoteBodyLength) + " characters")
+	}
+	return nil
+}
+
+type notesStore struct {
+	mu     sync.Mutex
+	notes  map[int64]*note
+	nextID int64
+}
+
+type resolver struct {
+	store *notesStore
+}
+
+func newResolver() *resolver {
+	return &resolver{store: &notesStore{notes: map[int64]*note{}, nextID: 1}}
+}
+
+// noteID parses a note ID; an ID that is not one of ours matches no note.
+func noteID(id graphql.ID) (int64, bool) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	return n, err == nil && n > 0
+}
+
+func (r *resolver) Notes(args struct{ First int32 }) ([]*note, error) {
+	first := args.First
+	if first < 0 || first > maxNotesPage {
+		return nil, errors.New("first must be between 0 and " + strconv.Itoa(maxNotesPage))
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	ids := make([]int64, 0, len(r.store.notes))
+	for id := range r.store.notes {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b int64) int { return cmp.Compare(b, a) })
+	notes := make([]*note, 0, min(len(ids), int(first)))
+	for _, id := range ids[:min(len(ids), int(first))] {
+		notes = append(notes, r.store.notes[id])
+	}
+	return notes, nil
+}
+
+func (r *resolver) Note(args struct{ ID graphql.ID }) *note {
+	id, ok := noteID(args.ID)
+	if !ok {
+		return nil
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return r.store.notes[id]
+}
+
+func (r *resolver) CreateNote(args struct{ Input noteInput }) (*note, error) {
+	if err := args.Input.validate(); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if len(r.store.notes) >= maxNotes {
+		return nil, errors.New("note limit reached; delete some notes first")
+	}
+	id := r.store.nextID
+	r.store.nextID++
+	n := &note{
+		ID:        graphql.ID(strconv.FormatInt(id, 10)),
+		Title:     args.Input.Title,
+		Body:      args.Input.Body,
+		CreatedAt: graphql.Time{Time: time.Now().UTC()},
+	}
+	r.store.notes[id] = n
+	return n, nil
+}
+
+func (r *resolver) DeleteNote(args struct{ ID graphql.ID }) bool {
+	id, ok := noteID(args.ID)
+	if !ok {
+		return false
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.notes[id]; !ok {
+		return false
+	}
+	delete(r.store.notes, id)
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// The app: one proto definition served twice. The gRPC server listens on
+// GRPC_PORT; the HTTP server on PORT serves the same RPCs as REST/JSON
+// under /v1/, through the gateway generated from the google.api.http
+// options in proto/ (see gateway.go), next to the platform endpoints.
+// Both share the probes and /metrics: grpc.health.v1 answers from the
+// same state as /readyz, and /metrics counts REST requests and RPCs alike.
+// See grpc.go for the server and greeter.go for the sample service.
+//
+//	GRPC_PORT                gRPC listen port (default 9090)
+//	GRPC_REFLECTION          "true" (default) enables server reflection, so
+//	                         grpcurl and grpcui can list and call methods
+//	GRPC_MAX_RECV_MSG_SIZE   largest message in bytes, for requests and for
+//	                         the gateway's responses (default 4 MiB)
+//	GRPC_MAX_CONNECTION_AGE  connections are closed after this long so
+//	                         clients re-resolve and rebalance across pods
+//	                         (default 5m)
+//
+// REST requests pass through the platform middleware (access log, CORS,
+// rate limiting, authentication) before reaching the gateway; direct gRPC
+// calls do not.
+
+var appSettings = []setting{
+	{name: "GRPC_PORT", kind: kindInt, def: "9090", check: inRange(1, 65535)},
+	{name: "GRPC_REFLECTION", kind: kindBool, def: "true"},
+	{name: "GRPC_MAX_RECV_MSG_SIZE", kind: kindInt, def: strconv.Itoa(4 << 20), check: atLeast(1)},
+	{name: "GRPC_MAX_CONNECTION_AGE", kind: kindDuration, def: "5m"},
+}
+
+func setupApp(mux *http.ServeMux) error {
+	if conf("GRPC_PORT") == conf("PORT") {
+		return errors.New("GRPC_PORT must differ from PORT, which serves the REST gateway")
+	}
+	srv := newGRPCServer()
+	registerMetrics(rpcMetrics.write)
+	registerBackground("grpc", func(ctx context.Context) error {
+		return serveGRPC(ctx, srv, listenAddr(conf("GRPC_PORT")))
+	})
+
+	// The client connects lazily, so the gateway can be set up before the
+	// gRPC server is listening.
+	conn, err := dialGRPC(selfAddr(conf("GRPC_PORT")))
+	if err != nil {
+		return err
+	}
+	gw, err := newGateway(context.Background(), conn)
+	if err != nil {
+		return err
+	}
+	mux.Handle("/v1/", gw)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	greeterv1 "github.com/[% GITHUB_OWNER %]/[% REPO_NAME %]/gen/greeter/v1"
+)
+
+// The REST/JSON gateway: grpc-gateway's generated handlers, from the
+// google.api.http options in proto/, translate each HTTP request into a
+// call to the gRPC server over loopback. Calls go through the gRPC
+// server's interceptors like any other client's, so they are logged,
+// counted and recovered the same way.
+//
+// JSON uses the proto field names (interval_ms, not intervalMs) and
+// writes fields at their zero value, like the platform's own endpoints;
+// unknown request fields are rejected. Errors are in the platform's error
+// envelope (errors.go), with the HTTP status grpc-gateway maps the gRPC
+// code to (InvalidArgument is 400, NotFound 404, Unavailable 503).
+// Streaming RPCs answer with one {"result": ...} object per line, and a
+// stream that fails ends with an {"error": {"code", "message"}} line.
+
+// dialGRPC connects to the gRPC server the gateway forwards to.
+func dialGRPC(addr string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(confInt("GRPC_MAX_RECV_MSG_SIZE"))))
+}
+
+// newGateway returns the REST handler for the services reached over conn.
+func newGateway(ctx context.Context, conn *grpc.ClientConn) (http.Handler, error) {
+	gw := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions: protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+		}),
+		runtime.WithMetadata(gatewayMetadata),
+		runtime.WithErrorHandler(gatewayError),
+	)
+	if err := greeterv1.RegisterGreeterServiceHandler(ctx, gw, conn); err != nil {
+		return nil, err
+	}
+	return gw, nil
+}
+
+// gatewayMetadata passes the request's correlation IDs on to the RPC, as
+// propagatingTransport does for outbound HTTP calls.
+func gatewayMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	if id := requestIDFromContext(r.Context()); id != "" {
+		md.Set("x-request-id", id)
+	}
+	if sc, ok := spanFromContext(r.Context()); ok {
+		md.Set("traceparent", sc.traceparent())
+	}
+	return md
+}
+
+// gatewayError answers a failed RPC in the platform's error shape.
+func gatewayError(ctx context.Context, _ *runtime.ServeMux, _ runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	writeError(w, r, runtime.HTTPStatusFromCode(st.Code()), st.Message())
+}
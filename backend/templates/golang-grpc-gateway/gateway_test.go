@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// newTestGateway serves the gateway in front of an in-memory gRPC server,
+// behind the request ID middleware as in the real chain.
+func newTestGateway(tb testing.TB) http.Handler {
+	tb.Helper()
+	gw, err := newGateway(testContext(tb), dialServer(tb))
+	if err != nil {
+		tb.Fatalf("newGateway: %v", err)
+	}
+	return requestIDMiddleware(gw)
+}
+
+func TestGatewaySayHello(t *testing.T) {
+	h := newTestGateway(t)
+	for _, tc := range []struct {
+		method, target, body, want string
+	}{
+		{"GET", "/v1/hello/Ada", "", "Hello, Ada!"},
+		{"POST", "/v1/hello", `{"name": "Grace"}`, "Hello, Grace!"},
+		{"POST", "/v1/hello", `{}`, "Hello, world!"},
+	} {
+		w := do(h, tc.method, tc.target, strings.NewReader(tc.body), "Content-Type", "application/json")
+		var resp map[string]any
+		decode(t, w, &resp)
+		if w.Code != http.StatusOK || resp["message"] != tc.want {
+			t.Errorf("%s %s = %d %v, want 200 with message %q", tc.method, tc.target, w.Code, resp, tc.want)
+		}
+	}
+}
+
+func TestGatewayStreamHellos(t *testing.T) {
+	w := do(newTestGateway(t), "GET", "/v1/hellos?name=Ada&count=3&interval_ms=1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /v1/hellos = %d %s, want 200", w.Code, w.Body)
+	}
+	lines := bufio.NewScanner(w.Body)
+	var n int
+	for lines.Scan() {
+		var chunk struct {
+			Result struct {
+				Message  string `json:"message"`
+				Sequence int    `json:"sequence"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &chunk); err != nil {
+			t.Fatalf("line %d %q: %v", n+1, lines.Text(), err)
+		}
+		n++
+		if chunk.Result.Sequence != n || chunk.Result.Message != "Hello, Ada!" {
+			t.Errorf("line %d = %+v", n, chunk.Result)
+		}
+	}
+	if n != 3 {
+		t.Errorf("stream had %d messages, want 3", n)
+	}
+}
+
+func TestGatewayErrors(t *testing.T) {
+	h := newTestGateway(t)
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/v1/hello", `{"name":`, http.StatusBadRequest},
+		{"POST", "/v1/hello", `{"nickname": "Ada"}`, http.StatusBadRequest},
+		{"GET", "/v1/goodbye", "", http.StatusNotFound},
+	} {
+		w := do(h, tc.method, tc.target, strings.NewReader(tc.body), "X-Request-ID", "req-1")
+		var resp map[string]string
+		decode(t, w, &resp)
+		if w.Code != tc.want || resp["error"] == "" || resp["request_id"] != "req-1" {
+			t.Errorf("%s %s = %d %v, want a JSON %d with the request ID", tc.method, tc.target, w.Code, resp, tc.want)
+		}
+	}
+
+	// A stream that fails before its first message still gets the mapped
+	// status; the error itself is the stream's one line.
+	w := do(h, "GET", "/v1/hellos?count=101", nil)
+	var chunk struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	decode(t, w, &chunk)
+	if w.Code != http.StatusBadRequest || chunk.Error.Message != "count must be between 0 and 100" {
+		t.Errorf("GET /v1/hellos?count=101 = %d %s, want 400 with the InvalidArgument message", w.Code, w.Body)
+	}
+}
+
+func TestGatewayMetadata(t *testing.T) {
+	var md metadata.MD
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md = gatewayMetadata(r.Context(), r)
+	}))
+	do(h, "GET", "/v1/hello/Ada", nil, "X-Request-ID", "req-1")
+	if got := md.Get("x-request-id"); len(got) != 1 || got[0] != "req-1" {
+		t.Errorf("metadata %v, want x-request-id req-1", md)
+	}
+}
+
+func BenchmarkGatewaySayHello(b *testing.B) {
+	h := newTestGateway(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		if w := do(h, "GET", "/v1/hello/Ada", nil); w.Code != http.StatusOK {
+			b.Fatalf("GET /v1/hello/Ada = %d %s", w.Code, w.Body)
+		}
+	}
+}
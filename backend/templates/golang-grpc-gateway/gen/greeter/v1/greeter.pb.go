@@ -0,0 +1,307 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: greeter/v1/greeter.proto
+
+// Sample service. Replace it with the app's own API, then regenerate the Go
+// code under gen/ with `buf generate`. The google.api.http options map each
+// RPC to the REST route the gateway serves it on.
+
+package greeterv1
+
+import (
+	_ "google.golang.org/genproto/googleapis/api/annotations"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SayHelloRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SayHelloRequest) Reset() {
+	*x = SayHelloRequest{}
+	mi := &file_greeter_v1_greeter_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SayHelloRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SayHelloRequest) ProtoMessage() {}
+
+func (x *SayHelloRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greeter_v1_greeter_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SayHelloRequest.ProtoReflect.Descriptor instead.
+func (*SayHelloRequest) Descriptor() ([]byte, []int) {
+	return file_greeter_v1_greeter_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SayHelloRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type SayHelloResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Message       string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SayHelloResponse) Reset() {
+	*x = SayHelloResponse{}
+	mi := &file_greeter_v1_greeter_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SayHelloResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SayHelloResponse) ProtoMessage() {}
+
+func (x *SayHelloResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greeter_v1_greeter_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SayHelloResponse.ProtoReflect.Descriptor instead.
+func (*SayHelloResponse) Descriptor() ([]byte, []int) {
+	return file_greeter_v1_greeter_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SayHelloResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type StreamHellosRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Number of greetings; 0 means 5, at most 100.
+	Count int32 `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	// Milliseconds between greetings; 0 means 1000.
+	IntervalMs    int32 `protobuf:"varint,3,opt,name=interval_ms,json=intervalMs,proto3" json:"interval_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamHellosRequest) Reset() {
+	*x = StreamHellosRequest{}
+	mi := &file_greeter_v1_greeter_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamHellosRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamHellosRequest) ProtoMessage() {}
+
+func (x *StreamHellosRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greeter_v1_greeter_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamHellosRequest.ProtoReflect.Descriptor instead.
+func (*StreamHellosRequest) Descriptor() ([]byte, []int) {
+	return file_greeter_v1_greeter_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StreamHellosRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *StreamHellosRequest) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *StreamHellosRequest) GetIntervalMs() int32 {
+	if x != nil {
+		return x.IntervalMs
+	}
+	return 0
+}
+
+type StreamHellosResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Message       string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	Sequence      int32                  `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamHellosResponse) Reset() {
+	*x = StreamHellosResponse{}
+	mi := &file_greeter_v1_greeter_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamHellosResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamHellosResponse) ProtoMessage() {}
+
+func (x *StreamHellosResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greeter_v1_greeter_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamHellosResponse.ProtoReflect.Descriptor instead.
+func (*StreamHellosResponse) Descriptor() ([]byte, []int) {
+	return file_greeter_v1_greeter_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StreamHellosResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *StreamHellosResponse) GetSequence() int32 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+var File_greeter_v1_greeter_proto protoreflect.FileDescriptor
+
+const file_greeter_v1_greeter_proto_rawDesc = "" +
+	"\n" +
+	"\x18greeter/v1/greeter.proto\x12\n" +
+	"greeter.v1\x1a\x1cgoogle/api/annotations.proto\"%\n" +
+	"\x0fSayHelloRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\",\n" +
+	"\x10SayHelloResponse\x12\x18\n" +
+	"\amessage\x18\x01 \x01(\tR\amessage\"`\n" +
+	"\x13StreamHellosRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05count\x18\x02 \x01(\x05R\x05count\x12\x1f\n" +
+	"\vinterval_ms\x18\x03 \x01(\x05R\n" +
+	"intervalMs\"L\n" +
+	"\x14StreamHellosResponse\x12\x18\n" +
+	"\amessage\x18\x01 \x01(\tR\amessage\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x05R\bsequence2\xea\x01\n" +
+	"\x0eGreeterService\x12o\n" +
+	"\bSayHello\x12\x1b.greeter.v1.SayHelloRequest\x1a\x1c.greeter.v1.SayHelloResponse\"(\x82\xd3\xe4\x93\x02\":\x01*Z\x12\x12\x10/v1/hello/{name}\"\t/v1/hello\x12g\n" +
+	"\fStreamHellos\x12\x1f.greeter.v1.StreamHellosRequest\x1a .greeter.v1.StreamHellosResponse\"\x12\x82\xd3\xe4\x93\x02\f\x12\n" +
+	"/v1/hellos0\x01B\x16Z\x14greeter/v1;greeterv1b\x06proto3"
+
+var (
+	file_greeter_v1_greeter_proto_rawDescOnce sync.Once
+	file_greeter_v1_greeter_proto_rawDescData []byte
+)
+
+func file_greeter_v1_greeter_proto_rawDescGZIP() []byte {
+	file_greeter_v1_greeter_proto_rawDescOnce.Do(func() {
+		file_greeter_v1_greeter_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_greeter_v1_greeter_proto_rawDesc), len(file_greeter_v1_greeter_proto_rawDesc)))
+	})
+	return file_greeter_v1_greeter_proto_rawDescData
+}
+
+var file_greeter_v1_greeter_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_greeter_v1_greeter_proto_goTypes = []any{
+	(*SayHelloRequest)(nil),      // 0: greeter.v1.SayHelloRequest
+	(*SayHelloResponse)(nil),     // 1: greeter.v1.SayHelloResponse
+	(*StreamHellosRequest)(nil),  // 2: greeter.v1.StreamHellosRequest
+	(*StreamHellosResponse)(nil), // 3: greeter.v1.StreamHellosResponse
+}
+var file_greeter_v1_greeter_proto_depIdxs = []int32{
+	0, // 0: greeter.v1.GreeterService.SayHello:input_type -> greeter.v1.SayHelloRequest
+	2, // 1: greeter.v1.GreeterService.StreamHellos:input_type -> greeter.v1.StreamHellosRequest
+	1, // 2: greeter.v1.GreeterService.SayHello:output_type -> greeter.v1.SayHelloResponse
+	3, // 3: greeter.v1.GreeterService.StreamHellos:output_type -> greeter.v1.StreamHellosResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_greeter_v1_greeter_proto_init() }
+func file_greeter_v1_greeter_proto_init() {
+	if File_greeter_v1_greeter_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_greeter_v1_greeter_proto_rawDesc), len(file_greeter_v1_greeter_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_greeter_v1_greeter_proto_goTypes,
+		DependencyIndexes: file_greeter_v1_greeter_proto_depIdxs,
+		MessageInfos:      file_greeter_v1_greeter_proto_msgTypes,
+	}.Build()
+	File_greeter_v1_greeter_proto = out.File
+	file_greeter_v1_greeter_proto_goTypes = nil
+	file_greeter_v1_greeter_proto_depIdxs = nil
+}
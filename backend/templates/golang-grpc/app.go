@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// The app: a gRPC server on GRPC_PORT. The HTTP server on PORT becomes the
+// admin port, serving only the platform endpoints (probes, /metrics,
+// /version), so the kubelet and Prometheus reach the app exactly as they do
+// an HTTP template, and /metrics adds per-RPC counts and latencies. See
+// grpc.go for the server and greeter.go for the sample service.
+//
+//	GRPC_PORT                gRPC listen port (default 9090)
+//	GRPC_REFLECTION          "true" (default) enables server reflection, so
+//	                         grpcurl and grpcui can list and call methods
+//	GRPC_MAX_RECV_MSG_SIZE   largest request message in bytes (default 4 MiB)
+//	GRPC_MAX_CONNECTION_AGE  connections are closed after this long so
+//	                         clients re-resolve and rebalance across pods
+//	                         (default 5m)
+
+var appSettings = []setting{
+	{name: "GRPC_PORT", kind: kindInt, def: "9090", check: inRange(1, 65535)},
+	{name: "GRPC_REFLECTION", kind: kindBool, def: "true"},
+	{name: "GRPC_MAX_RECV_MSG_SIZE", kind: kindInt, def: strconv.Itoa(4 << 20), check: atLeast(1)},
+	{name: "GRPC_MAX_CONNECTION_AGE", kind: kindDuration, def: "5m"},
+}
+
+func setupApp(mux *http.ServeMux) error {
+	if conf("GRPC_PORT") == conf("PORT") {
+		return errors.New("GRPC_PORT must differ from PORT, which serves the admin endpoints")
+	}
+	srv := newGRPCServer()
+	registerMetrics(rpcMetrics.write)
+	registerBackground("grpc", func(ctx context.Context) error {
+		return serveGRPC(ctx, srv, listenAddr(conf("GRPC_PORT")))
+	})
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	greeterv1 "github.com/[% GITHUB_OWNER %]/[% REPO_NAME %]/gen/greeter/v1"
+)
+
+// greeterServer implements the sample GreeterService from
+// proto/greeter/v1/greeter.proto: one unary and one server-streaming RPC.
+type greeterServer struct {
+	greeterv1.UnimplementedGreeterServiceServer
+}
+
+func greeting(name string) string {
+	if name == "" {
+		name = "world"
+	}
+	return fmt.Sprintf("Hello, %s!", name)
+}
+
+func (greeterServer) SayHello(ctx context.Context, req *greeterv1.SayHelloRequest) (*greeterv1.SayHelloResponse, error) {
+	return &greeterv1.SayHelloResponse{Message: greeting(req.GetName())}, nil
+}
+
+func (greeterServer) StreamHellos(req *greeterv1.StreamHellosRequest, stream greeterv1.GreeterService_StreamHellosServer) error {
+	count, interval := req.GetCount(), time.Duration(req.GetIntervalMs())*time.Millisecond
+	switch {
+	case count < 0 || count > 100:
+		return status.Error(codes.InvalidArgument, "count must be between 0 and 100")
+	case count == 0:
+		count = 5
+	}
+	switch {
+	case interval < 0:
+		return status.Error(codes.InvalidArgument, "interval_ms must not be negative")
+	case interval == 0:
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := int32(1); ; i++ {
+		if err := stream.Send(&greeterv1.StreamHellosResponse{Message: greeting(req.GetName()), Sequence: i}); err != nil {
+			return err
+		}
+		if i == count {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
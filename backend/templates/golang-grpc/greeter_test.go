@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	greeterv1 "github.com/[% GITHUB_OWNER %]/[% REPO_NAME %]/gen/greeter/v1"
+)
+
+// dialServer serves newGRPCServer on an in-memory listener and returns a
+// client connection to it; both stop when the test ends.
+func dialServer(tb testing.TB) *grpc.ClientConn {
+	tb.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	tb.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		tb.Fatalf("grpc.NewClient: %v", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func testContext(tb testing.TB) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	tb.Cleanup(cancel)
+	return ctx
+}
+
+func TestSayHello(t *testing.T) {
+	client := greeterv1.NewGreeterServiceClient(dialServer(t))
+	for name, want := range map[string]string{"Ada": "Hello, Ada!", "": "Hello, world!"} {
+		resp, err := client.SayHello(testContext(t), &greeterv1.SayHelloRequest{Name: name})
+		if err != nil || resp.GetMessage() != want {
+			t.Errorf("SayHello(%q) = %q, %v, want %q", name, resp.GetMessage(), err, want)
+		}
+	}
+}
+
+func TestStreamHellos(t *testing.T) {
+	client := greeterv1.NewGreeterServiceClient(dialServer(t))
+	stream, err := client.StreamHellos(testContext(t), &greeterv1.StreamHellosRequest{Name: "Ada", Count: 3, IntervalMs: 1})
+	if err != nil {
+		t.Fatalf("StreamHellos: %v", err)
+	}
+	for want := int32(1); ; want++ {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			if want != 4 {
+				t.Fatalf("stream ended after %d messages, want 3", want-1)
+			}
+			return
+		}
+		if err != nil || resp.GetSequence() != want || resp.GetMessage() != "Hello, Ada!" {
+			t.Fatalf("message %d = %v, %v", want, resp, err)
+		}
+	}
+}
+
+func TestStreamHellosInvalidArgument(t *testing.T) {
+	client := greeterv1.NewGreeterServiceClient(dialServer(t))
+	for _, req := range []*greeterv1.StreamHellosRequest{{Count: 101}, {Count: -1}, {IntervalMs: -5}} {
+		stream, err := client.StreamHellos(testContext(t), req)
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("StreamHellos(%v) = %v, want InvalidArgument", req, err)
+		}
+	}
+}
+
+func TestGRPCHealth(t *testing.T) {
+	withChecks(t)
+	client := healthpb.NewHealthClient(dialServer(t))
+
+	for _, service := range []string{"", greeterv1.GreeterService_ServiceDesc.ServiceName} {
+		resp, err := client.Check(testContext(t), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Check(%q) = %v, %v, want SERVING", service, resp.GetStatus(), err)
+		}
+	}
+	if _, err := client.Check(testContext(t), &healthpb.HealthCheckRequest{Service: "other.v1.Service"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Check of an unknown service = %v, want NotFound", err)
+	}
+
+	readinessChecks.register("db", checkFunc(failingCheck), 0)
+	resp, err := client.Check(testContext(t), &healthpb.HealthCheckRequest{})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check with a failing readiness check = %v, %v, want NOT_SERVING", resp.GetStatus(), err)
+	}
+}
+
+func TestRecoverRPC(t *testing.T) {
+	if err := recoverRPC("/greeter.v1.GreeterService/SayHello", nil, "boom"); status.Code(err) != codes.Internal {
+		t.Fatalf("recoverRPC after a panic = %v, want Internal", err)
+	}
+	if err := recoverRPC("/greeter.v1.GreeterService/SayHello", nil, nil); err != nil {
+		t.Fatalf("recoverRPC without a panic = %v, want nil", err)
+	}
+}
+
+func TestRPCMetrics(t *testing.T) {
+	client := greeterv1.NewGreeterServiceClient(dialServer(t))
+	client.SayHello(testContext(t), &greeterv1.SayHelloRequest{Name: "Ada"})
+	if stream, err := client.StreamHellos(testContext(t), &greeterv1.StreamHellosRequest{Count: -1}); err == nil {
+		stream.Recv()
+	}
+
+	var out strings.Builder
+	rpcMetrics.write(&out)
+	for _, want := range []string{
+		`grpc_server_handled_total{method="/greeter.v1.GreeterService/SayHello",code="OK"} `,
+		`grpc_server_handled_total{method="/greeter.v1.GreeterService/StreamHellos",code="InvalidArgument"} `,
+		`grpc_server_handling_seconds_count{method="/greeter.v1.GreeterService/SayHello"} `,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %s\n%s", want, out.String())
+		}
+	}
+}
+
+func BenchmarkSayHello(b *testing.B) {
+	client := greeterv1.NewGreeterServiceClient(dialServer(b))
+	ctx := testContext(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := client.SayHello(ctx, &greeterv1.SayHelloRequest{Name: "Ada"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
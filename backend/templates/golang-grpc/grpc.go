@@ -0,0 +1,236 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	greeterv1 "github.com/[% GITHUB_OWNER %]/[% REPO_NAME %]/gen/greeter/v1"
+)
+
+// newGRPCServer builds the gRPC server: the sample GreeterService, the
+// standard grpc.health.v1 service and, with GRPC_REFLECTION, reflection.
+// Every RPC is logged like an HTTP request in the access log and counted
+// in /metrics, and a panic becomes an Internal error instead of killing
+// the process.
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.MaxRecvMsgSize(confInt("GRPC_MAX_RECV_MSG_SIZE")),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionAge:      confDuration("GRPC_MAX_CONNECTION_AGE"),
+			MaxConnectionAgeGrace: confDuration("SHUTDOWN_TIMEOUT"),
+		}),
+		grpc.ChainUnaryInterceptor(unaryInterceptor),
+		grpc.ChainStreamInterceptor(streamInterceptor),
+	)
+	greeterv1.RegisterGreeterServiceServer(srv, greeterServer{})
+	healthpb.RegisterHealthServer(srv, grpcHealth{})
+	if confBool("GRPC_REFLECTION") {
+		reflection.Register(srv)
+	}
+	return srv
+}
+
+// serveGRPC serves on addr until ctx is cancelled, then stops gracefully:
+// new RPCs are refused and in-flight ones may finish within
+// SHUTDOWN_TIMEOUT, after which the rest are cancelled.
+func serveGRPC(ctx context.Context, srv *grpc.Server, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("starting gRPC server", "addr", addr, "reflection", confBool("GRPC_REFLECTION"))
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(lis) }()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(confDuration("SHUTDOWN_TIMEOUT")):
+		slog.Warn("gRPC graceful stop timed out, cancelling remaining RPCs")
+		srv.Stop()
+	}
+	return nil
+}
+
+// grpcHealth answers grpc.health.v1 Check from the same state as /readyz:
+// NOT_SERVING while startup tasks run, once shutdown begins, and while a
+// readiness check fails. The empty service name means the whole server.
+type grpcHealth struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (grpcHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	switch req.GetService() {
+	case "", greeterv1.GreeterService_ServiceDesc.ServiceName:
+	default:
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+
+	resp := &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}
+	if reason, _ := shuttingDown(); reason != "" || !started() || len(failing(readinessChecks.run(ctx))) > 0 {
+		resp.Status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return resp, nil
+}
+
+func unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	start := time.Now()
+	defer func() {
+		err = recoverRPC(info.FullMethod, err, recover())
+		logRPC(ctx, info.FullMethod, err, start)
+		rpcMetrics.observe(info.FullMethod, err, time.Since(start))
+	}()
+	return handler(ctx, req)
+}
+
+func streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	start := time.Now()
+	defer func() {
+		err = recoverRPC(info.FullMethod, err, recover())
+		logRPC(ss.Context(), info.FullMethod, err, start)
+		rpcMetrics.observe(info.FullMethod, err, time.Since(start))
+	}()
+	return handler(srv, ss)
+}
+
+// recoverRPC turns a recovered panic into a logged stack trace and an
+// Internal status; without a panic it returns err unchanged.
+func recoverRPC(method string, err error, recovered any) error {
+	if recovered == nil {
+		return err
+	}
+	slog.Error("panic serving RPC",
+		"method", method,
+		"panic", fmt.Sprint(recovered),
+		"stack", string(debug.Stack()))
+	return status.Error(codes.Internal, "internal error")
+}
+
+// logRPC writes one line per RPC, honouring ACCESS_LOG. Health checks are
+// left out, like the probe paths are from the HTTP access log. A caller's
+// x-request-id metadata is logged as request_id, to match its own logs.
+func logRPC(ctx context.Context, method string, err error, start time.Time) {
+	if !confBool("ACCESS_LOG") || method == healthpb.Health_Check_FullMethodName {
+		return
+	}
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if code != codes.OK && code != codes.Canceled {
+		level = slog.LevelWarn
+	}
+	attrs := []any{
+		"method", method,
+		"code", code.String(),
+		"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs = append(attrs, "remote_addr", p.Addr.String())
+	}
+	if ids := metadata.ValueFromIncomingContext(ctx, "x-request-id"); len(ids) > 0 {
+		attrs = append(attrs, "request_id", ids[0])
+	}
+	if err != nil {
+		attrs = append(attrs, "error", status.Convert(err).Message())
+	}
+	slog.Log(ctx, level, "rpc", attrs...)
+}
+
+// RPC metrics, next to the HTTP ones on /metrics:
+//
+//	grpc_server_handled_total     counter   method, code
+//	grpc_server_handling_seconds  histogram method
+//
+// method is the full method name, such as
+// /greeter.v1.GreeterService/SayHello, so the label set is bounded by the
+// registered services. A streaming RPC is timed until the stream ends.
+
+type rpcKey struct {
+	method, code string
+}
+
+type rpcStats struct {
+	mu        sync.Mutex
+	handled   map[rpcKey]uint64
+	durations map[string]*histogram
+}
+
+var rpcMetrics = &rpcStats{
+	handled:   map[rpcKey]uint64{},
+	durations: map[string]*histogram{},
+}
+
+func (m *rpcStats) observe(method string, err error, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handled[rpcKey{method, status.Code(err).String()}]++
+	h, ok := m.durations[method]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[method] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *rpcStats) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP grpc_server_handled_total RPCs completed by method and status code.")
+	fmt.Fprintln(out, "# TYPE grpc_server_handled_total counter")
+	keys := make([]rpcKey, 0, len(m.handled))
+	for k := range m.handled {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b rpcKey) int {
+		return cmp.Or(cmp.Compare(a.method, b.method), cmp.Compare(a.code, b.code))
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "grpc_server_handled_total{method=%q,code=%q} %d\n", k.method, k.code, m.handled[k])
+	}
+
+	fmt.Fprintln(out, "# HELP grpc_server_handling_seconds RPC latency by method.")
+	fmt.Fprintln(out, "# TYPE grpc_server_handling_seconds histogram")
+	methods := make([]string, 0, len(m.durations))
+	for method := range m.durations {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	for _, method := range methods {
+		h := m.durations[method]
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "grpc_server_handling_seconds_bucket{method=%q,le=\"%s\"} %d\n", method, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "grpc_server_handling_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(out, "grpc_server_handling_seconds_sum{method=%q} %s\n", method, formatFloat(h.sum))
+		fmt.Fprintf(out, "grpc_server_handling_seconds_count{method=%q} %d\n", method, h.count)
+	}
+}
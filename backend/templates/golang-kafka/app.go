@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// The app: a Kafka consumer group member and producer. Records from
+// KAFKA_TOPICS are passed to handleRecord (handler.go) partition by
+// partition; see consumer.go for the delivery guarantees, kafka.go for the
+// clients and lag.go for the consumer lag metrics. POST /events produces
+// to KAFKA_OUTPUT_TOPIC. The HTTP server on PORT also serves the platform
+// endpoints (probes, /metrics, /version).
+//
+//	KAFKA_BROKERS           comma-separated seed brokers, host:port
+//	KAFKA_TOPICS            comma-separated topics to consume
+//	KAFKA_GROUP             consumer group (default the app name)
+//	KAFKA_OUTPUT_TOPIC      topic POST /events and the sample handler
+//	                        produce to; unset turns both off
+//	KAFKA_DLQ_TOPIC         topic for records that fail every attempt; unset
+//	                        logs and skips them
+//	KAFKA_START_OFFSET      earliest or latest: where a new group starts
+//	                        reading (default earliest)
+//	KAFKA_TLS               "true" connects with TLS
+//	KAFKA_SASL_MECHANISM    plain, scram-sha-256 or scram-sha-512, with
+//	                        KAFKA_USERNAME and KAFKA_PASSWORD
+//	KAFKA_MAX_POLL_RECORDS  records fetched and handled per batch
+//	                        (default 500)
+//	KAFKA_MAX_ATTEMPTS      tries per record before it is dead-lettered
+//	                        (default 3)
+//	KAFKA_BACKOFF_INITIAL   wait before the first retry, doubled for each
+//	                        one after it (default 500ms)
+//	KAFKA_BACKOFF_MAX       longest wait between retries (default 10s)
+//	KAFKA_HANDLER_TIMEOUT   deadline for a single try (default 10s)
+//	KAFKA_LAG_INTERVAL      how often consumer lag is measured (default 30s)
+
+var appSettings = []setting{
+	{name: "KAFKA_BROKERS", kind: kindList, required: true},
+	{name: "KAFKA_TOPICS", kind: kindList, required: true},
+	{name: "KAFKA_GROUP", def: serviceName},
+	{name: "KAFKA_OUTPUT_TOPIC"},
+	{name: "KAFKA_DLQ_TOPIC"},
+	{name: "KAFKA_START_OFFSET", def: "earliest", check: oneOf("earliest", "latest")},
+	{name: "KAFKA_TLS", kind: kindBool, def: "false"},
+	{name: "KAFKA_SASL_MECHANISM", check: oneOf("", "plain", "scram-sha-256", "scram-sha-512")},
+	{name: "KAFKA_USERNAME"},
+	{name: "KAFKA_PASSWORD", secret: true},
+	{name: "KAFKA_MAX_POLL_RECORDS", kind: kindInt, def: "500", check: atLeast(1)},
+	{name: "KAFKA_MAX_ATTEMPTS", kind: kindInt, def: "3", check: atLeast(1)},
+	{name: "KAFKA_BACKOFF_INITIAL", kind: kindDuration, def: "500ms"},
+	{name: "KAFKA_BACKOFF_MAX", kind: kindDuration, def: "10s"},
+	{name: "KAFKA_HANDLER_TIMEOUT", kind: kindDuration, def: "10s"},
+	{name: "KAFKA_LAG_INTERVAL", kind: kindDuration, def: "30s"},
+}
+
+func setupApp(mux *http.ServeMux) error {
+	var err error
+	if producer, err = newProducer(); err != nil {
+		return fmt.Errorf("kafka producer: %w", err)
+	}
+	consumer, err := newConsumer()
+	if err != nil {
+		return fmt.Errorf("kafka consumer: %w", err)
+	}
+
+	readinessChecks.register("kafka", checkFunc(producer.Ping), 0)
+	registerMetrics(kafkaMetrics.write)
+	registerBackground("consumer", func(ctx context.Context) error {
+		defer consumer.Close()
+		return runConsumer(ctx, consumer)
+	})
+
+	if conf("KAFKA_OUTPUT_TOPIC") != "" {
+		mux.HandleFunc("POST /events", publishHandler)
+	}
+	return nil
+}
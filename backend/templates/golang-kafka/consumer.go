@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The consumer loop. Records are polled in batches of up to
+// KAFKA_MAX_POLL_RECORDS; each batch's partitions are handled in parallel,
+// each partition's records one at a time and in offset order. A record
+// whose handler fails is retried in place after an exponential backoff
+// with jitter, up to KAFKA_MAX_ATTEMPTS tries; a handler that returns
+// permanent(err) gives up at once. A record that gives up is produced to
+// KAFKA_DLQ_TOPIC, or logged and skipped when it is unset, so one bad
+// record cannot stall its partition.
+//
+// Offsets are committed after each batch, up to the last record handled
+// in each partition, so delivery is at least once: handlers must be
+// idempotent. Rebalances wait until the batch is committed, which keeps a
+// replica from committing partitions it no longer owns; retries therefore
+// hold up the group's rebalances, so keep KAFKA_MAX_ATTEMPTS times
+// KAFKA_HANDLER_TIMEOUT well inside the 60s rebalance timeout.
+//
+// On shutdown the consumer stops polling, lets in-flight handlers finish,
+// abandons records waiting for a retry, commits what was handled and
+// leaves the group so its partitions move to another replica at once.
+
+// commitTimeout bounds committing a batch's offsets.
+const commitTimeout = 10 * time.Second
+
+// permanentError marks a failure retrying cannot fix, such as a malformed
+// record.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so the consumer gives up on the record at once.
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+func newConsumer() (*kgo.Client, error) {
+	opts, err := clientOpts()
+	if err != nil {
+		return nil, err
+	}
+	start := kgo.NewOffset().AtStart()
+	if conf("KAFKA_START_OFFSET") == "latest" {
+		start = kgo.NewOffset().AtEnd()
+	}
+	return kgo.NewClient(append(opts,
+		kgo.ConsumerGroup(conf("KAFKA_GROUP")),
+		kgo.ConsumeTopics(confList("KAFKA_TOPICS")...),
+		kgo.ConsumeResetOffset(start),
+		kgo.DisableAutoCommit(),
+		kgo.BlockRebalanceOnPoll(),
+	)...)
+}
+
+// runConsumer polls and handles records until ctx is cancelled.
+func runConsumer(ctx context.Context, cl *kgo.Client) error {
+	var lag sync.WaitGroup
+	lag.Add(1)
+	go func() {
+		defer lag.Done()
+		watchLag(ctx, cl)
+	}()
+	defer lag.Wait()
+
+	maxRecords := confInt("KAFKA_MAX_POLL_RECORDS")
+	for {
+		fetches := cl.PollRecords(ctx, maxRecords)
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			cl.AllowRebalance()
+			return ctx.Err()
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			slog.Warn("fetch failed", "topic", topic, "partition", partition, "error", err)
+		})
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			handled []*kgo.Record
+		)
+		fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+			if len(p.Records) == 0 {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if last := processPartition(ctx, p.Records); last != nil {
+					mu.Lock()
+					handled = append(handled, last)
+					mu.Unlock()
+				}
+			}()
+		})
+		wg.Wait()
+
+		if len(handled) > 0 {
+			commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), commitTimeout)
+			err := cl.CommitRecords(commitCtx, handled...)
+			cancel()
+			kafkaMetrics.committed(err)
+			if err != nil {
+				// The records are redelivered after the next rebalance.
+				slog.Warn("committing offsets failed", "error", err)
+			}
+		}
+		cl.AllowRebalance()
+	}
+}
+
+// processPartition handles one partition's records in order and returns
+// the last one done with, or nil if shutdown came first.
+func processPartition(ctx context.Context, records []*kgo.Record) *kgo.Record {
+	var last *kgo.Record
+	for _, rec := range records {
+		if ctx.Err() != nil || !process(ctx, rec) {
+			break
+		}
+		last = rec
+	}
+	return last
+}
+
+// process runs the handler with retries. It reports false when shutdown
+// interrupted a retry, leaving the record uncommitted.
+func process(ctx context.Context, rec *kgo.Record) bool {
+	logger := slog.With("topic", rec.Topic, "partition", rec.Partition, "offset", rec.Offset)
+	maxAttempts := confInt("KAFKA_MAX_ATTEMPTS")
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := handle(ctx, rec)
+		kafkaMetrics.observe(err, time.Since(start))
+		if err == nil {
+			kafkaMetrics.count(rec.Topic, outcomeHandled)
+			return true
+		}
+
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= maxAttempts {
+			logger.Error("record failed", "attempt", attempt, "permanent", errors.As(err, &perm), "error", err)
+			deadLetter(ctx, logger, rec, err)
+			return true
+		}
+
+		delay := backoff(attempt)
+		logger.Warn("record failed, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+		kafkaMetrics.count(rec.Topic, outcomeRetried)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			logger.Info("shutting down, leaving record for redelivery", "attempt", attempt)
+			return false
+		}
+	}
+}
+
+// handle runs one try of the handler. It is not cancelled by shutdown, only
+// by KAFKA_HANDLER_TIMEOUT, so a record being handled when SIGTERM arrives
+// completes rather than being abandoned halfway.
+func handle(ctx context.Context, rec *kgo.Record) (err error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), confDuration("KAFKA_HANDLER_TIMEOUT"))
+	defer cancel()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			slog.Error("panic handling record",
+				"topic", rec.Topic,
+				"partition", rec.Partition,
+				"offset", rec.Offset,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return handleRecord(ctx, rec)
+}
+
+// deadLetter produces a record that gave up to KAFKA_DLQ_TOPIC with
+// headers naming where it came from and why it failed. Without a DLQ
+// topic, or when producing fails, the record is skipped.
+func deadLetter(ctx context.Context, logger *slog.Logger, rec *kgo.Record, cause error) {
+	topic := conf("KAFKA_DLQ_TOPIC")
+	if topic == "" {
+		kafkaMetrics.count(rec.Topic, outcomeSkipped)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), produceTimeout)
+	defer cancel()
+	headers := append(slices.Clone(rec.Headers),
+		kgo.RecordHeader{Key: "dlq-source-topic", Value: []byte(rec.Topic)},
+		kgo.RecordHeader{Key: "dlq-source-partition", Value: []byte(strconv.Itoa(int(rec.Partition)))},
+		kgo.RecordHeader{Key: "dlq-source-offset", Value: []byte(strconv.FormatInt(rec.Offset, 10))},
+		kgo.RecordHeader{Key: "dlq-error", Value: []byte(cause.Error())},
+	)
+	if err := publish(ctx, topic, rec.Key, rec.Value, headers...); err != nil {
+		logger.Error("dead-lettering record failed, skipping it", "dlq_topic", topic, "error", err)
+		kafkaMetrics.count(rec.Topic, outcomeSkipped)
+		return
+	}
+	kafkaMetrics.count(rec.Topic, outcomeDeadLettered)
+}
+
+// backoff is the wait before retrying after the given attempt: the
+// initial backoff doubled per attempt, capped at KAFKA_BACKOFF_MAX, with
+// the upper half randomised so failing replicas do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d, ceiling := confDuration("KAFKA_BACKOFF_INITIAL"), confDuration("KAFKA_BACKOFF_MAX")
+	for i := 1; i < attempt && d < ceiling; i++ {
+		d *= 2
+	}
+	d = min(d, ceiling)
+	return d/2 + rand.N(d/2+1)
+}
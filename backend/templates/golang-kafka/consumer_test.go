@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// newCluster starts an in-process Kafka with the given topics and points
+// the shared producer at it.
+func newCluster(t *testing.T, topics ...string) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topics...))
+	if err != nil {
+		t.Fatalf("starting kfake: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	t.Setenv("KAFKA_BROKERS", strings.Join(cluster.ListenAddrs(), ","))
+
+	if producer, err = newProducer(); err != nil {
+		t.Fatalf("newProducer: %v", err)
+	}
+	t.Cleanup(producer.Close)
+	return cluster
+}
+
+// firstRecord reads the first record on topic.
+func firstRecord(t *testing.T, cluster *kfake.Cluster, topic string) *kgo.Record {
+	t.Helper()
+	cl, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatalf("consumer: %v", err)
+	}
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		fetches := cl.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("no record on %s: %v", topic, err)
+		}
+		if records := fetches.Records(); len(records) > 0 {
+			return records[0]
+		}
+	}
+}
+
+// header returns the value of the named record header.
+func header(rec *kgo.Record, key string) string {
+	for _, h := range rec.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestHandleRecordProducesOutput(t *testing.T) {
+	cluster := newCluster(t, "orders", "orders-processed")
+	t.Setenv("KAFKA_OUTPUT_TOPIC", "orders-processed")
+
+	rec := &kgo.Record{Topic: "orders", Offset: 7, Key: []byte("customer-1"), Value: []byte(`{"id": 1, "total": 20}`)}
+	if err := handleRecord(context.Background(), rec); err != nil {
+		t.Fatalf("handleRecord: %v", err)
+	}
+	out := firstRecord(t, cluster, "orders-processed")
+	if string(out.Key) != "customer-1" || string(out.Value) != `{"fields":2,"source_offset":7,"source_topic":"orders"}` {
+		t.Fatalf("output record = %s %s, want the processed event keyed like the input", out.Key, out.Value)
+	}
+}
+
+func TestProcessDeadLettersMalformedRecord(t *testing.T) {
+	cluster := newCluster(t, "orders", "orders-dlq")
+	t.Setenv("KAFKA_DLQ_TOPIC", "orders-dlq")
+
+	rec := &kgo.Record{Topic: "orders", Partition: 0, Offset: 3, Key: []byte("k"), Value: []byte("not json")}
+	if !process(context.Background(), rec) {
+		t.Fatal("process = false, want the record done with")
+	}
+	dlq := firstRecord(t, cluster, "orders-dlq")
+	if string(dlq.Value) != "not json" || header(dlq, "dlq-source-topic") != "orders" ||
+		header(dlq, "dlq-source-offset") != "3" || !strings.Contains(header(dlq, "dlq-error"), "not a JSON object") {
+		t.Fatalf("dead-lettered record = %q %v, want the original with its source and error", dlq.Value, dlq.Headers)
+	}
+}
+
+func TestProcessStopsRetryingOnShutdown(t *testing.T) {
+	newCluster(t, "orders")
+	// Producing to a topic that does not exist fails, and is retried.
+	t.Setenv("KAFKA_OUTPUT_TOPIC", "missing")
+	t.Setenv("KAFKA_HANDLER_TIMEOUT", "200ms")
+	t.Setenv("KAFKA_BACKOFF_INITIAL", "1m")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if process(ctx, &kgo.Record{Topic: "orders", Value: []byte(`{}`)}) {
+		t.Fatal("process interrupted by shutdown = true, want the record left uncommitted")
+	}
+}
+
+func TestPublishHandler(t *testing.T) {
+	cluster := newCluster(t, "events")
+	t.Setenv("KAFKA_OUTPUT_TOPIC", "events")
+	h := requestIDMiddleware(http.HandlerFunc(publishHandler))
+
+	if w := do(h, "POST", "/events", strings.NewReader("")); w.Code != http.StatusBadRequest {
+		t.Fatalf("POST /events with no body = %d, want 400", w.Code)
+	}
+	w := do(h, "POST", "/events?key=user-9", strings.NewReader(`{"signed_up": true}`), requestIDHeader, "req-1")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /events = %d %s, want 202", w.Code, w.Body)
+	}
+	rec := firstRecord(t, cluster, "events")
+	if string(rec.Key) != "user-9" || string(rec.Value) != `{"signed_up": true}` || header(rec, requestIDHeader) != "req-1" {
+		t.Fatalf("produced record = %s %s %v, want the body keyed user-9 with the request ID", rec.Key, rec.Value, rec.Headers)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Setenv("KAFKA_BACKOFF_INITIAL", "500ms")
+	t.Setenv("KAFKA_BACKOFF_MAX", "3s")
+	for attempt, ceiling := range map[int]time.Duration{1: 500 * time.Millisecond, 2: time.Second, 3: 2 * time.Second, 4: 3 * time.Second, 10: 3 * time.Second} {
+		for range 20 {
+			if d := backoff(attempt); d < ceiling/2 || d > ceiling {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt, d, ceiling/2, ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// handleRecord processes one record; this is where the consumer's real
+// work goes. Return nil once the record is fully handled, an error to
+// have it retried, or permanent(err) when retrying cannot help. ctx ends
+// at KAFKA_HANDLER_TIMEOUT; pass it to every call that blocks.
+//
+// The sample expects a JSON object. When KAFKA_OUTPUT_TOPIC is set it
+// produces a "processed" event keyed like the input, and a failure to
+// produce is retried like any other error, so the input's offset is only
+// committed once the output is stored.
+func handleRecord(ctx context.Context, rec *kgo.Record) error {
+	var payload map[string]any
+	if err := json.Unmarshal(rec.Value, &payload); err != nil {
+		return permanent(fmt.Errorf("value is not a JSON object: %w", err))
+	}
+
+	if topic := conf("KAFKA_OUTPUT_TOPIC"); topic != "" && topic != rec.Topic {
+		event, err := json.Marshal(map[string]any{
+			"source_topic":  rec.Topic,
+			"source_offset": rec.Offset,
+			"fields":        len(payload),
+		})
+		if err != nil {
+			return permanent(err)
+		}
+		if err := publish(ctx, topic, rec.Key, event); err != nil {
+			return fmt.Errorf("producing to %s: %w", topic, err)
+		}
+	}
+	slog.InfoContext(ctx, "record handled",
+		"topic", rec.Topic, "partition", rec.Partition, "offset", rec.Offset, "fields", len(payload))
+	return nil
+}
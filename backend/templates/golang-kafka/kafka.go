@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Kafka clients, built with franz-go. The app runs two: the consumer, a
+// member of KAFKA_GROUP that the consumer background service closes (and
+// so leaves the group) on shutdown, and the producer, shared by HTTP
+// handlers and the record handler. The producer is never closed: it only
+// produces synchronously, so nothing is left buffered when the process
+// exits, and in-flight requests can still produce while the server drains.
+//
+// Produced records wait for every in-sync replica (acks=all) with
+// idempotent retries, franz-go's defaults, so an acknowledged record is
+// not lost or duplicated by a broker failover.
+
+// produceTimeout bounds producing one record from an HTTP request.
+const produceTimeout = 10 * time.Second
+
+// producer is the shared producing client, created by setupApp.
+var producer *kgo.Client
+
+// clientOpts are the connection options both clients share.
+func clientOpts() ([]kgo.Opt, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(confList("KAFKA_BROKERS")...),
+		kgo.ClientID(serviceName),
+		kgo.WithLogger(kafkaLogger{}),
+	}
+	if confBool("KAFKA_TLS") {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	if mech := conf("KAFKA_SASL_MECHANISM"); mech != "" {
+		user, pass := conf("KAFKA_USERNAME"), conf("KAFKA_PASSWORD")
+		if user == "" || pass == "" {
+			return nil, errors.New("KAFKA_SASL_MECHANISM needs KAFKA_USERNAME and KAFKA_PASSWORD")
+		}
+		var m sasl.Mechanism
+		switch mech {
+		case "plain":
+			m = plain.Auth{User: user, Pass: pass}.AsMechanism()
+		case "scram-sha-256":
+			m = scram.Auth{User: user, Pass: pass}.AsSha256Mechanism()
+		case "scram-sha-512":
+			m = scram.Auth{User: user, Pass: pass}.AsSha512Mechanism()
+		}
+		opts = append(opts, kgo.SASL(m))
+	}
+	return opts, nil
+}
+
+func newProducer() (*kgo.Client, error) {
+	opts, err := clientOpts()
+	if err != nil {
+		return nil, err
+	}
+	return kgo.NewClient(opts...)
+}
+
+// publish produces one record and waits until the brokers have it.
+func publish(ctx context.Context, topic string, key, value []byte, headers ...kgo.RecordHeader) error {
+	err := producer.ProduceSync(ctx, &kgo.Record{Topic: topic, Key: key, Value: value, Headers: headers}).FirstErr()
+	kafkaMetrics.produced(topic, err)
+	return err
+}
+
+// publishHandler produces the request body to KAFKA_OUTPUT_TOPIC. The
+// optional ?key= sets the record key, which picks the partition, so
+// records with the same key are consumed in order.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody()))
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		writeError(w, r, http.StatusRequestEntityTooLarge, "request body larger than "+strconv.FormatInt(maxErr.Limit, 10)+" bytes")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, "reading request body failed")
+		return
+	case len(body) == 0:
+		writeError(w, r, http.StatusBadRequest, "request body is empty")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), produceTimeout)
+	defer cancel()
+	var key []byte
+	if k := r.URL.Query().Get("key"); k != "" {
+		key = []byte(k)
+	}
+	topic := conf("KAFKA_OUTPUT_TOPIC")
+	if err := publish(ctx, topic, key, body,
+		kgo.RecordHeader{Key: requestIDHeader, Value: []byte(requestIDFromContext(r.Context()))}); err != nil {
+		requestLogger(r).Error("producing event failed", "topic", topic, "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "event not accepted")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted", "topic": topic})
+}
+
+// kafkaLogger sends franz-go's warnings and errors to the structured log.
+type kafkaLogger struct{}
+
+func (kafkaLogger) Level() kgo.LogLevel { return kgo.LogLevelWarn }
+
+func (kafkaLogger) Log(level kgo.LogLevel, msg string, keyvals ...any) {
+	attrs := append([]any{"component", "franz-go"}, keyvals...)
+	if level == kgo.LogLevelError {
+		slog.Error(msg, attrs...)
+		return
+	}
+	slog.Warn(msg, attrs...)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Kafka metrics, served on /metrics after the HTTP ones:
+//
+//	kafka_records_total              counter   topic, outcome (handled,
+//	                                           retried, dead_lettered,
+//	                                           skipped)
+//	kafka_handler_duration_seconds   histogram result
+//	kafka_produced_total             counter   topic, result (ok, error)
+//	kafka_commits_total              counter   result (ok, error)
+//	kafka_consumer_lag               gauge     topic, partition
+//	kafka_consumer_lag_age_seconds   gauge
+//
+// kafka_consumer_lag is the group's committed offset behind the end of
+// each partition, measured every KAFKA_LAG_INTERVAL. Each replica reports
+// only the partitions assigned to it, so sum(kafka_consumer_lag) across
+// replicas is the group's lag. kafka_consumer_lag_age_seconds is the time
+// since the last successful measurement, for alerting when it goes stale.
+
+// Record outcomes, the outcome label of kafka_records_total.
+const (
+	outcomeHandled      = "handled"
+	outcomeRetried      = "retried"
+	outcomeDeadLettered = "dead_lettered"
+	outcomeSkipped      = "skipped"
+)
+
+// watchLag measures the group's lag until ctx is cancelled.
+func watchLag(ctx context.Context, cl *kgo.Client) {
+	adm := kadm.NewClient(cl)
+	group := conf("KAFKA_GROUP")
+	ticker := time.NewTicker(confDuration("KAFKA_LAG_INTERVAL"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		lags, err := adm.Lag(ctx, group)
+		if err == nil {
+			err = lags.Error()
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("measuring consumer lag failed", "group", group, "error", err)
+			}
+			continue
+		}
+
+		memberID, _ := cl.GroupMetadata()
+		owned := map[lagKey]int64{}
+		for topic, partitions := range lags[group].Lag {
+			for partition, l := range partitions {
+				if l.Member != nil && l.Member.MemberID == memberID && l.Lag >= 0 {
+					owned[lagKey{topic, partition}] = l.Lag
+				}
+			}
+		}
+		kafkaMetrics.setLag(owned)
+	}
+}
+
+type lagKey struct {
+	topic     string
+	partition int32
+}
+
+type topicOutcome struct{ topic, outcome string }
+
+type kafkaStats struct {
+	mu         sync.Mutex
+	records    map[topicOutcome]uint64
+	produces   map[topicOutcome]uint64
+	commits    map[string]uint64
+	durations  map[string]*histogram
+	lag        map[lagKey]int64
+	lagUpdated time.Time
+}
+
+var kafkaMetrics = &kafkaStats{
+	records:   map[topicOutcome]uint64{},
+	produces:  map[topicOutcome]uint64{},
+	commits:   map[string]uint64{},
+	durations: map[string]*histogram{},
+}
+
+func resultOf(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (m *kafkaStats) count(topic, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[topicOutcome{topic, outcome}]++
+}
+
+func (m *kafkaStats) produced(topic string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.produces[topicOutcome{topic, resultOf(err)}]++
+}
+
+func (m *kafkaStats) committed(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commits[resultOf(err)]++
+}
+
+func (m *kafkaStats) observe(err error, d time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.durations[result]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[result] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *kafkaStats) setLag(lag map[lagKey]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lag, m.lagUpdated = lag, time.Now()
+}
+
+func (m *kafkaStats) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP kafka_records_total Consumed records by outcome: handled, retried, dead_lettered or skipped.")
+	fmt.Fprintln(out, "# TYPE kafka_records_total counter")
+	for _, k := range sortedKeys(m.records) {
+		fmt.Fprintf(out, "kafka_records_total{topic=%q,outcome=%q} %d\n", k.topic, k.outcome, m.records[k])
+	}
+
+	fmt.Fprintln(out, "# HELP kafka_handler_duration_seconds Handler run time per try, by result.")
+	fmt.Fprintln(out, "# TYPE kafka_handler_duration_seconds histogram")
+	for _, result := range []string{"success", "error"} {
+		h, ok := m.durations[result]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "kafka_handler_duration_seconds_bucket{result=\"%s\",le=\"%s\"} %d\n", result, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "kafka_handler_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.count)
+		fmt.Fprintf(out, "kafka_handler_duration_seconds_sum{result=\"%s\"} %s\n", result, formatFloat(h.sum))
+		fmt.Fprintf(out, "kafka_handler_duration_seconds_count{result=\"%s\"} %d\n", result, h.count)
+	}
+
+	fmt.Fprintln(out, "# HELP kafka_produced_total Produced records by result.")
+	fmt.Fprintln(out, "# TYPE kafka_produced_total counter")
+	for _, k := range sortedKeys(m.produces) {
+		fmt.Fprintf(out, "kafka_produced_total{topic=%q,result=%q} %d\n", k.topic, k.outcome, m.produces[k])
+	}
+
+	fmt.Fprintln(out, "# HELP kafka_commits_total Offset commits by result.")
+	fmt.Fprintln(out, "# TYPE kafka_commits_total counter")
+	for _, result := range []string{"ok", "error"} {
+		fmt.Fprintf(out, "kafka_commits_total{result=%q} %d\n", result, m.commits[result])
+	}
+
+	fmt.Fprintln(out, "# HELP kafka_consumer_lag Records between the group's committed offset and the end of each partition assigned to this replica.")
+	fmt.Fprintln(out, "# TYPE kafka_consumer_lag gauge")
+	keys := make([]lagKey, 0, len(m.lag))
+	for k := range m.lag {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b lagKey) int {
+		if a.topic != b.topic {
+			return cmp.Compare(a.topic, b.topic)
+		}
+		return cmp.Compare(a.partition, b.partition)
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "kafka_consumer_lag{topic=%q,partition=\"%d\"} %d\n", k.topic, k.partition, m.lag[k])
+	}
+
+	if !m.lagUpdated.IsZero() {
+		fmt.Fprintln(out, "# HELP kafka_consumer_lag_age_seconds Time since consumer lag was last measured.")
+		fmt.Fprintln(out, "# TYPE kafka_consumer_lag_age_seconds gauge")
+		fmt.Fprintf(out, "kafka_consumer_lag_age_seconds %s\n", formatFloat(time.Since(m.lagUpdated).Seconds()))
+	}
+}
+
+// sortedKeys returns the keys of a topic-labelled counter map in label
+// order, so the output is stable between scrapes.
+func sortedKeys(counts map[topicOutcome]uint64) []topicOutcome {
+	keys := make([]topicOutcome, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b topicOutcome) int {
+		if a.topic != b.topic {
+			return cmp.Compare(a.topic, b.topic)
+		}
+		return cmp.Compare(a.outcome, b.outcome)
+	})
+	return keys
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"slices"
+	"time"
+)
+
+// The app: an email service for the customer's other services, next to
+// the landing page. message.go renders the messages from templates,
+// queue.go queues them for worker goroutines that send them with retries,
+// and smtp.go talks to the relay:
+//
+//	POST /v1/messages  {"to": [...], "template": "welcome", "data": {...},
+//	                   "reply_to": "..."} renders the message and queues
+//	                   it: 202 with its {"id"}
+//	GET /v1/templates  the templates POST /v1/messages takes
+//
+// /v1 is on AUTH_PATHS and the app refuses to start without API_KEYS or
+// JWT_JWKS_URL, so only the customer's services can send mail as
+// MAIL_FROM.
+//
+//	MAIL_FROM             sender of every message, e.g.
+//	                      "Acme <no-reply@acme.example>"
+//	MAIL_TEMPLATES_DIR    directory of message templates, e.g. a mounted
+//	                      ConfigMap; unset uses the embedded emails/
+//	MAIL_MAX_RECIPIENTS   recipients per message (default 50)
+//	MAIL_QUEUE_SIZE       messages queued before more are refused with a
+//	                      503 (default 1000)
+//	MAIL_WORKERS          messages sent at once (default 4)
+//	MAIL_MAX_ATTEMPTS     tries per message before it is dropped
+//	                      (default 5)
+//	MAIL_BACKOFF_INITIAL  wait before the first retry, doubled for each
+//	                      one after it (default 2s)
+//	MAIL_BACKOFF_MAX      longest wait between retries (default 1m)
+//	SMTP_HOST             the relay, e.g. email-smtp.eu-west-1.amazonaws.com
+//	SMTP_PORT             its port (default 587)
+//	SMTP_TLS              starttls (default), tls or none; see smtp.go
+//	SMTP_USERNAME         login at the relay, if it needs one
+//	SMTP_PASSWORD         its password
+//	SMTP_TIMEOUT          deadline for one SMTP session (default 30s,
+//	                      inside SHUTDOWN_TIMEOUT so sends under way finish)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "MAIL_FROM", required: true, check: checkAddress},
+	{name: "MAIL_TEMPLATES_DIR"},
+	{name: "MAIL_MAX_RECIPIENTS", kind: kindInt, def: "50", check: atLeast(1)},
+	{name: "MAIL_QUEUE_SIZE", kind: kindInt, def: "1000", check: atLeast(1)},
+	{name: "MAIL_WORKERS", kind: kindInt, def: "4", check: atLeast(1)},
+	{name: "MAIL_MAX_ATTEMPTS", kind: kindInt, def: "5", check: atLeast(1)},
+	{name: "MAIL_BACKOFF_INITIAL", kind: kindDuration, def: "2s"},
+	{name: "MAIL_BACKOFF_MAX", kind: kindDuration, def: "1m"},
+	{name: "SMTP_HOST", required: true},
+	{name: "SMTP_PORT", kind: kindInt, def: "587", check: atLeast(1)},
+	{name: "SMTP_TLS", def: "starttls", check: oneOf("starttls", "tls", "none")},
+	{name: "SMTP_USERNAME"},
+	{name: "SMTP_PASSWORD", secret: true},
+	{name: "SMTP_TIMEOUT", kind: kindDuration, def: "30s"},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	if conf("API_KEYS") == "" && conf("JWT_JWKS_URL") == "" {
+		return errors.New("set API_KEYS or JWT_JWKS_URL: without them anyone could send mail as MAIL_FROM")
+	}
+	if !protectedPath("/v1/messages", confList("AUTH_PATHS")) {
+		return errors.New("AUTH_PATHS must cover /v1, or anyone could send mail as MAIL_FROM")
+	}
+	if conf("SMTP_TLS") == "none" && conf("SMTP_USERNAME") != "" && !isLocalhost(conf("SMTP_HOST")) {
+		return errors.New("SMTP_TLS=none would send SMTP_PASSWORD unencrypted; use it for a relay on localhost only")
+	}
+	templates, err := loadMailTemplates()
+	if err != nil {
+		return fmt.Errorf("loading message templates: %w", err)
+	}
+	from, _ := mail.ParseAddress(conf("MAIL_FROM"))
+	q := newMailQueue(newSMTPSender().send)
+	registerBackground("mail queue", q.run)
+	registerMetrics(mailMetrics.write)
+	registerMetrics(q.writeMetrics)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.Handle("POST /v1/messages", &messagesHandler{templates: templates, from: from, queue: q})
+	mux.HandleFunc("/v1/messages", methodNotAllowed("POST"))
+	mux.HandleFunc("GET /v1/templates", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string][]string{"templates": templateNames(templates)})
+	})
+	mux.HandleFunc("/v1/templates", methodNotAllowed("GET, HEAD"))
+	return nil
+}
+
+// isLocalhost reports whether host is this machine, the only host
+// smtp.PlainAuth sends a password to without TLS.
+func isLocalhost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// sendRequest is the body of POST /v1/messages.
+type sendRequest struct {
+	To       []string       `json:"to"`
+	Template string         `json:"template"`
+	Data     map[string]any `json:"data"`
+	ReplyTo  string         `json:"reply_to"`
+}
+
+type messagesHandler struct {
+	templates map[string]*mailTemplate
+	from      *mail.Address
+	queue     *mailQueue
+}
+
+func (h *messagesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in sendRequest
+	if err := readJSON(w, r, &in); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	label := in.Template
+	if _, ok := h.templates[label]; !ok {
+		label = "unknown"
+	}
+	m, err := h.message(r, in)
+	if err != nil {
+		mailMetrics.received(label, mailInvalid)
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if !h.queue.enqueue(m) {
+		mailMetrics.received(label, mailQueueFull)
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusServiceUnavailable, "send queue full, retry later")
+		return
+	}
+	mailMetrics.received(label, mailAccepted)
+	requestLogger(r).Info("mail queued", "message_id", m.ID, "template", m.Template, "recipients", len(m.To))
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": m.ID})
+}
+
+// message renders the requested message. Its errors are safe to return
+// to the client.
+func (h *messagesHandler) message(r *http.Request, in sendRequest) (*outgoingMail, error) {
+	if len(in.To) == 0 {
+		return nil, errors.New(`"to" needs at least one recipient`)
+	}
+	if len(in.To) > confInt("MAIL_MAX_RECIPIENTS") {
+		return nil, fmt.Errorf(`"to" has %d recipients, at most %d allowed`, len(in.To), confInt("MAIL_MAX_RECIPIENTS"))
+	}
+	m := &outgoingMail{ID: newMessageID(), Template: in.Template, From: h.from, QueuedAt: time.Now(), RequestID: requestIDFromContext(r.Context())}
+	for _, to := range in.To {
+		a, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q is not an email address", to)
+		}
+		m.To = append(m.To, a)
+	}
+	if in.ReplyTo != "" {
+		a, err := mail.ParseAddress(in.ReplyTo)
+		if err != nil {
+			return nil, fmt.Errorf("reply_to %q is not an email address", in.ReplyTo)
+		}
+		m.ReplyTo = a
+	}
+	var err error
+	if m.Subject, m.Text, m.HTML, err = render(h.templates, in.Template, in.Data); err != nil {
+		if errors.Is(err, errUnknownTemplate) {
+			return nil, fmt.Errorf("unknown template %q", in.Template)
+		}
+		return nil, fmt.Errorf("rendering template %q: %w", in.Template, err)
+	}
+	return m, nil
+}
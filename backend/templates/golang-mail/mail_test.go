@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// testRelay is an SMTP relay on localhost that keeps what it receives.
+// Recipients at reject.example are refused with a 550, and the first
+// tempFails sessions with a 451.
+type testRelay struct {
+	addr string
+
+	mu        sync.Mutex
+	tempFails int
+	auth      string
+	received  []*mail.Message
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	relay := &testRelay{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go relay.serve(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(relay.addr)
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("SMTP_TLS", "none")
+	return relay
+}
+
+func (relay *testRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 relay.test ESMTP")
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		switch verb := strings.ToUpper(strings.Fields(cmd + " x")[0]); verb {
+		case "EHLO", "HELO":
+			reply("250-relay.test")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			relay.mu.Lock()
+			relay.auth = cmd
+			relay.mu.Unlock()
+			reply("235 ok")
+		case "MAIL":
+			relay.mu.Lock()
+			fail := relay.tempFails > 0
+			relay.tempFails--
+			relay.mu.Unlock()
+			if fail {
+				reply("451 try again later")
+				continue
+			}
+			reply("250 ok")
+		case "RCPT":
+			if strings.Contains(cmd, "@reject.example") {
+				reply("550 no such user")
+				continue
+			}
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := in.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				reply("554 malformed message")
+				continue
+			}
+			relay.mu.Lock()
+			relay.received = append(relay.received, msg)
+			relay.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// messages waits for n messages to arrive.
+func (relay *testRelay) messages(t *testing.T, n int) []*mail.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		relay.mu.Lock()
+		got := relay.received
+		relay.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay received %d messages, want %d", len(got), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// withMailer serves POST /v1/messages with the embedded templates,
+// sending to relay through a running queue of queueSize messages.
+func withMailer(t *testing.T, queueSize int) (http.Handler, *mailQueue) {
+	t.Helper()
+	t.Setenv("MAIL_FROM", "Acme <no-reply@acme.example>")
+	t.Setenv("MAIL_BACKOFF_INITIAL", "10ms")
+	metrics := mailMetrics
+	mailMetrics = newMailStats()
+	t.Cleanup(func() { mailMetrics = metrics })
+
+	templates, err := loadMailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, _ := mail.ParseAddress(conf("MAIL_FROM"))
+	q := newMailQueue(newSMTPSender().send)
+	q.queue = make(chan *outgoingMail, queueSize)
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/messages", &messagesHandler{templates: templates, from: from, queue: q})
+	return mux, q
+}
+
+// runQueue runs q until the test ends.
+func runQueue(t *testing.T, q *mailQueue) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func post(h http.Handler, body string) (int, map[string]any) {
+	w := do(h, "POST", "/v1/messages", strings.NewReader(body), "Content-Type", "application/json")
+	var out map[string]any
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+// sends is the count of a send result.
+func sends(result string) uint64 {
+	mailMetrics.mu.Lock()
+	defer mailMetrics.mu.Unlock()
+	return mailMetrics.sends[result]
+}
+
+func TestSendMessage(t *testing.T) {
+	relay := newTestRelay(t)
+	h, q := withMailer(t, 10)
+	runQueue(t, q)
+
+	status, out := post(h, `{"to": ["Ada <ada@example.com>", "bob@example.com"], "template": "welcome",
+		"data": {"name": "Ada <script>", "login_url": "https://acme.example/login"}, "reply_to": "help@acme.example"}`)
+	if status != http.StatusAccepted || out["id"] == "" {
+		t.Fatalf("POST /v1/messages = %d %v, want 202 with an id", status, out)
+	}
+	msg := relay.messages(t, 1)[0]
+
+	for header, want := range map[string]string{
+		"From":     `"Acme" <no-reply@acme.example>`,
+		"To":       `"Ada" <ada@example.com>, <bob@example.com>`,
+		"Reply-To": "<help@acme.example>",
+	} {
+		if got := msg.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if !strings.HasPrefix(subject, "Welcome to ") || !strings.HasSuffix(subject, ", Ada <script>") {
+		t.Errorf("Subject = %q, want the rendered subject", subject)
+	}
+	if got := msg.Header.Get("Message-ID"); got != "<"+out["id"].(string)+"@acme.example>" {
+		t.Errorf("Message-ID = %q, want the message's id", got)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		p, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		bodies = append(bodies, p.Header.Get("Content-Type")+"\n"+string(b))
+	}
+	if len(bodies) != 2 || !strings.Contains(bodies[0], "Hi Ada <script>,") || !strings.Contains(bodies[1], "Hi Ada &lt;script&gt;,") {
+		t.Errorf("parts = %q, want the text body and the escaped HTML body", bodies)
+	}
+}
+
+func TestSendRejects(t *testing.T) {
+	newTestRelay(t)
+	h, _ := withMailer(t, 10)
+
+	for _, tc := range []struct {
+		name, body string
+		want       int
+	}{
+		{"no recipients", `{"to": [], "template": "welcome", "data": {"name": "Ada", "login_url": "x"}}`, http.StatusUnprocessableEntity},
+		{"bad recipient", `{"to": ["not an address"], "template": "welcome", "data": {"name": "Ada", "login_url": "x"}}`, http.StatusUnprocessableEntity},
+		{"header injection", `{"to": ["ada@example.com\r\nBcc: eve@example.com"], "template": "welcome", "data": {"name": "Ada", "login_url": "x"}}`, http.StatusUnprocessableEntity},
+		{"bad reply_to", `{"to": ["ada@example.com"], "template": "welcome", "data": {"name": "Ada", "login_url": "x"}, "reply_to": "nope"}`, http.StatusUnprocessableEntity},
+		{"unknown template", `{"to": ["ada@example.com"], "template": "nope"}`, http.StatusUnprocessableEntity},
+		{"missing data", `{"to": ["ada@example.com"], "template": "welcome", "data": {"name": "Ada"}}`, http.StatusUnprocessableEntity},
+		{"unknown field", `{"to": ["ada@example.com"], "template": "welcome", "cc": []}`, http.StatusBadRequest},
+	} {
+		if status, out := post(h, tc.body); status != tc.want {
+			t.Errorf("%s: POST /v1/messages = %d %v, want %d", tc.name, status, out, tc.want)
+		}
+	}
+	t.Setenv("MAIL_MAX_RECIPIENTS", "1")
+	if status, _ := post(h, `{"to": ["a@example.com", "b@example.com"], "template": "welcome", "data": {"name": "Ada", "login_url": "x"}}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("POST /v1/messages over MAIL_MAX_RECIPIENTS = %d, want 422", status)
+	}
+}
+
+func TestSendSubjectIsOneLine(t *testing.T) {
+	relay := newTestRelay(t)
+	h, q := withMailer(t, 10)
+	runQueue(t, q)
+
+	if status, _ := post(h, `{"to": ["ada@example.com"], "template": "welcome", "data": {"name": "Ada\r\nBcc: eve@example.com", "login_url": "x"}}`); status != http.StatusAccepted {
+		t.Fatalf("POST /v1/messages = %d, want 202", status)
+	}
+	msg := relay.messages(t, 1)[0]
+	if msg.Header.Get("Bcc") != "" {
+		t.Fatalf("data injected a Bcc header: %v", msg.Header)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	relay := newTestRelay(t)
+	relay.tempFails = 2
+	h, q := withMailer(t, 10)
+	runQueue(t, q)
+
+	post(h, `{"to": ["ada@example.com"], "template": "password-reset", "data": {"name": "Ada", "reset_url": "https://acme.example/r/1", "expires_in": "1 hour"}}`)
+	msg := relay.messages(t, 1)[0]
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain for a template without HTML", ct)
+	}
+
+	post(h, `{"to": ["ada@example.com", "eve@reject.example"], "template": "password-reset", "data": {"name": "Ada", "reset_url": "x", "expires_in": "1 hour"}}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for sends(sendFailed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := sends(sendFailed); got != 1 {
+		t.Fatalf("failed sends = %d, want the rejected recipient's message failed", got)
+	}
+	if got := sends(sendRetried); got != 2 {
+		t.Errorf("retries = %d, want 2: the 451s only, not the 550", got)
+	}
+
+	var out strings.Builder
+	mailMetrics.write(&out)
+	q.writeMetrics(&out)
+	for _, want := range []string{
+		`mail_messages_total{template="password-reset",result="accepted"} 2`,
+		`mail_messages_sent_total{result="sent"} 1`,
+		`mail_messages_sent_total{result="failed"} 1`,
+		"mail_send_retries_total 2",
+		`mail_smtp_duration_seconds_count{result="error"} 3`,
+		"mail_queue_capacity 10",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	newTestRelay(t)
+	h, _ := withMailer(t, 1)
+
+	body := `{"to": ["ada@example.com"], "template": "welcome", "data": {"name": "Ada", "login_url": "x"}}`
+	if status, _ := post(h, body); status != http.StatusAccepted {
+		t.Fatalf("first POST = %d, want 202", status)
+	}
+	if status, _ := post(h, body); status != http.StatusServiceUnavailable {
+		t.Fatalf("POST with the queue full = %d, want 503", status)
+	}
+}
+
+func TestSMTPAuth(t *testing.T) {
+	relay := newTestRelay(t)
+	t.Setenv("SMTP_USERNAME", "apikey")
+	t.Setenv("SMTP_PASSWORD", "s3cret")
+	m := &outgoingMail{ID: newMessageID(), From: &mail.Address{Address: "a@acme.example"}, To: []*mail.Address{{Address: "b@example.com"}}, Text: "hi", QueuedAt: time.Now()}
+	if err := newSMTPSender().send(context.Background(), m); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	relay.mu.Lock()
+	auth := relay.auth
+	relay.mu.Unlock()
+	if auth != "AUTH PLAIN AGFwaWtleQBzM2NyZXQ=" {
+		t.Errorf("relay saw %q, want PLAIN auth as apikey", auth)
+	}
+
+	t.Setenv("SMTP_TLS", "starttls")
+	if err := newSMTPSender().send(context.Background(), m); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("send to a relay without STARTTLS = %v, want refused", err)
+	}
+}
+
+func TestParseMailTemplates(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files fstest.MapFS
+		ok    bool
+	}{
+		{"text only", fstest.MapFS{"a.txt": {Data: []byte(`{{define "subject"}}Hi{{end}}Body`)}}, true},
+		{"text and HTML", fstest.MapFS{"a.txt": {Data: []byte(`{{define "subject"}}Hi{{end}}Body`)}, "a.html": {Data: []byte(`<p>{{.x}}</p>`)}}, true},
+		{"no templates", fstest.MapFS{"a.html": {Data: []byte(`<p>Body</p>`)}}, false},
+		{"no subject", fstest.MapFS{"a.txt": {Data: []byte(`Body`)}}, false},
+		{"bad syntax", fstest.MapFS{"a.txt": {Data: []byte(`{{define "subject"}}Hi{{end}}{{.x`)}}, false},
+	} {
+		if _, err := parseMailTemplates(tc.files); (err == nil) != tc.ok {
+			t.Errorf("%s: parseMailTemplates = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Message templates. Each message is a template in emails/ (or
+// MAIL_TEMPLATES_DIR, e.g. a mounted ConfigMap) named by its file:
+//
+//	welcome.txt   the plain-text body, defining "subject" too; required
+//	welcome.html  the HTML body; optional, without it the message is
+//	              plain text only
+//
+// They are Go templates executed with the request's "data" object, plus
+// {{app}}, the customer name. A field the data lacks fails the request
+// with a 422 rather than mailing "<no value>". The HTML body is escaped
+// as html/template does, so data cannot inject markup.
+
+//go:embed emails
+var embeddedEmails embed.FS
+
+// mailTemplate is one message's templates.
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var templateFuncs = map[string]any{"app": func() string { return customerName }}
+
+// loadMailTemplates parses every template in MAIL_TEMPLATES_DIR, or the
+// embedded emails/ when it is unset.
+func loadMailTemplates() (map[string]*mailTemplate, error) {
+	var fsys fs.FS = os.DirFS(conf("MAIL_TEMPLATES_DIR"))
+	if conf("MAIL_TEMPLATES_DIR") == "" {
+		fsys, _ = fs.Sub(embeddedEmails, "emails")
+	}
+	return parseMailTemplates(fsys)
+}
+
+func parseMailTemplates(fsys fs.FS) (map[string]*mailTemplate, error) {
+	texts, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return nil, err
+	}
+	if len(texts) == 0 {
+		return nil, errors.New("no message templates (*.txt)")
+	}
+	templates := map[string]*mailTemplate{}
+	for _, file := range texts {
+		name := strings.TrimSuffix(file, ".txt")
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		t := &mailTemplate{}
+		if t.text, err = texttemplate.New(file).Funcs(templateFuncs).Option("missingkey=error").Parse(string(data)); err != nil {
+			return nil, err
+		}
+		if t.text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("%s: no {{define \"subject\"}}", file)
+		}
+		switch data, err := fs.ReadFile(fsys, name+".html"); {
+		case err == nil:
+			if t.html, err = htmltemplate.New(name + ".html").Funcs(templateFuncs).Option("missingkey=error").Parse(string(data)); err != nil {
+				return nil, err
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// errUnknownTemplate is returned by render for a template that does not
+// exist.
+var errUnknownTemplate = errors.New("unknown template")
+
+// render executes the named message's templates with data.
+func render(templates map[string]*mailTemplate, name string, data map[string]any) (subject, text, html string, err error) {
+	t, ok := templates[name]
+	if !ok {
+		return "", "", "", errUnknownTemplate
+	}
+	var buf strings.Builder
+	if err := t.text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", "", err
+	}
+	// A subject is one header line: a newline from the data would start
+	// another header.
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	text = buf.String()
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return "", "", "", err
+		}
+		html = buf.String()
+	}
+	return subject, text, html, nil
+}
+
+// templateNames lists the templates, sorted.
+func templateNames(templates map[string]*mailTemplate) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// outgoingMail is a rendered message waiting to be sent.
+type outgoingMail struct {
+	ID       string
+	Template string
+	From     *mail.Address
+	To       []*mail.Address
+	ReplyTo  *mail.Address
+	Subject  string
+	Text     string
+	HTML     string
+	QueuedAt time.Time
+	// RequestID is the ID of the request the message came in on.
+	RequestID string
+}
+
+// newMessageID returns a random message ID, used in the Message-ID
+// header and the API's answers.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// recipients returns the bare addresses to send m to.
+func (m *outgoingMail) recipients() []string {
+	to := make([]string, len(m.To))
+	for i, a := range m.To {
+		to[i] = a.Address
+	}
+	return to
+}
+
+// bytes encodes m as a MIME message: text/plain, or multipart/alternative
+// with an HTML part, both quoted-printable.
+func (m *outgoingMail) bytes() []byte {
+	var buf bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&buf, "%s: %s\r\n", name, value) }
+	to := make([]string, len(m.To))
+	for i, a := range m.To {
+		to[i] = a.String()
+	}
+	domain := m.From.Address[strings.LastIndex(m.From.Address, "@")+1:]
+
+	header("From", m.From.String())
+	header("To", strings.Join(to, ", "))
+	if m.ReplyTo != nil {
+		header("Reply-To", m.ReplyTo.String())
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", m.QueuedAt.Format(time.RFC1123Z))
+	header("Message-ID", "<"+m.ID+"@"+domain+">")
+	header("MIME-Version", "1.0")
+
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeQuotedPrintable(&buf, m.Text)
+		return buf.Bytes()
+	}
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(w, p.body)
+	}
+	parts.Close()
+	return buf.Bytes()
+}
+
+// writeQuotedPrintable writes body quoted-printable, with CRLF line ends.
+func writeQuotedPrintable(w io.Writer, body string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(body))
+	qp.Close()
+}
+
+// checkAddress accepts a single mail address, e.g. MAIL_FROM.
+func checkAddress(v string) error {
+	if v == "" {
+		return nil
+	}
+	_, err := mail.ParseAddress(v)
+	return err
+}
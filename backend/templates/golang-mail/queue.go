@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The send queue. Accepted messages wait in a queue of MAIL_QUEUE_SIZE
+// for one of MAIL_WORKERS goroutines, so a slow relay never holds up the
+// caller. The queue is bounded: a burst the relay cannot keep up with is
+// pushed back to the callers, as 503s they retry, instead of growing
+// until the pod runs out of memory.
+//
+// A failed send is retried, up to MAIL_MAX_ATTEMPTS tries, with an
+// exponential backoff from MAIL_BACKOFF_INITIAL to MAIL_BACKOFF_MAX and
+// jitter; a permanent failure (smtp.go) is not. A message that fails for
+// good is logged with its ID and counted in
+// mail_messages_sent_total{result="failed"}.
+//
+// The queue does not outlive the process. On shutdown the workers finish
+// what is queued and new messages are refused with a 503; a message
+// waiting for a retry, or left when SHUTDOWN_TIMEOUT runs out, is lost
+// and logged. Put a durable queue in front (see the golang-worker
+// template) when every message must be sent.
+
+type mailQueue struct {
+	queue   chan *outgoingMail
+	workers int
+	// stopped is set once shutdown begins.
+	stopped atomic.Bool
+	send    func(context.Context, *outgoingMail) error
+}
+
+func newMailQueue(send func(context.Context, *outgoingMail) error) *mailQueue {
+	return &mailQueue{
+		queue:   make(chan *outgoingMail, confInt("MAIL_QUEUE_SIZE")),
+		workers: confInt("MAIL_WORKERS"),
+		send:    send,
+	}
+}
+
+// enqueue queues m, or returns false if the queue is full or shutting
+// down.
+func (q *mailQueue) enqueue(m *outgoingMail) bool {
+	if q.stopped.Load() {
+		return false
+	}
+	select {
+	case q.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends messages until ctx is cancelled, then drains the queue.
+func (q *mailQueue) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for range q.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	<-ctx.Done()
+	q.stopped.Store(true)
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (q *mailQueue) work(ctx context.Context) {
+	for {
+		select {
+		case m := <-q.queue:
+			q.deliver(ctx, m)
+		case <-ctx.Done():
+			for {
+				select {
+				case m := <-q.queue:
+					q.deliver(ctx, m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends m, retrying failures. Tries are not cancelled by
+// shutdown, only by SMTP_TIMEOUT, so one under way when SIGTERM arrives
+// completes; waits for a retry are.
+func (q *mailQueue) deliver(ctx context.Context, m *outgoingMail) {
+	logger := slog.With("request_id", m.RequestID, "message_id", m.ID, "template", m.Template)
+	maxAttempts := confInt("MAIL_MAX_ATTEMPTS")
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := q.try(context.WithoutCancel(ctx), logger, m)
+		mailMetrics.observe(err, time.Since(start))
+		if err == nil {
+			mailMetrics.count(sendSent)
+			logger.Info("mail sent", "attempt", attempt, "queued_ms", start.Sub(m.QueuedAt).Milliseconds())
+			return
+		}
+
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= maxAttempts {
+			mailMetrics.count(sendFailed)
+			logger.Error("mail not sent", "attempt", attempt, "permanent", errors.As(err, &perm), "error", err)
+			return
+		}
+
+		delay := backoff(attempt)
+		logger.Warn("mail send failed, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+		mailMetrics.count(sendRetried)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			mailMetrics.count(sendFailed)
+			logger.Error("shutting down, mail not sent", "attempt", attempt, "error", err)
+			return
+		}
+	}
+}
+
+// try runs one send, recovering a panic as a failure.
+func (q *mailQueue) try(ctx context.Context, logger *slog.Logger, m *outgoingMail) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Error("panic sending mail", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return q.send(ctx, m)
+}
+
+// backoff is the wait before retrying after the given attempt: the
+// initial backoff doubled per attempt, capped at MAIL_BACKOFF_MAX, with
+// the upper half randomised so replicas do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d, ceiling := confDuration("MAIL_BACKOFF_INITIAL"), confDuration("MAIL_BACKOFF_MAX")
+	for i := 1; i < attempt && d < ceiling; i++ {
+		d *= 2
+	}
+	d = min(d, ceiling)
+	return d/2 + rand.N(d/2+1)
+}
+
+// Results counted in mail_messages_total, when a message is taken or
+// turned away, and mail_messages_sent_total, once it is done with;
+// sendRetried counts in mail_send_retries_total.
+const (
+	mailAccepted  = "accepted"
+	mailInvalid   = "invalid"
+	mailQueueFull = "queue_full"
+
+	sendSent    = "sent"
+	sendFailed  = "failed"
+	sendRetried = "retried"
+)
+
+// mailStats counts messages. Templates are the loaded ones only: a
+// request for any other is counted as "unknown".
+type mailStats struct {
+	mu        sync.Mutex
+	messages  map[mailKey]uint64
+	sends     map[string]uint64
+	durations map[string]*histogram
+}
+
+type mailKey struct{ template, result string }
+
+var mailMetrics = newMailStats()
+
+func newMailStats() *mailStats {
+	return &mailStats{messages: map[mailKey]uint64{}, sends: map[string]uint64{}, durations: map[string]*histogram{}}
+}
+
+func (m *mailStats) received(template, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[mailKey{template, result}]++
+}
+
+func (m *mailStats) count(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sends[result]++
+}
+
+// observe records one SMTP session's duration.
+func (m *mailStats) observe(err error, d time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.durations[result]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[result] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *mailStats) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP mail_messages_total Messages received, by template and result: accepted, invalid or queue_full.")
+	fmt.Fprintln(out, "# TYPE mail_messages_total counter")
+	keys := slices.SortedFunc(maps.Keys(m.messages), func(a, b mailKey) int {
+		return cmp.Or(strings.Compare(a.template, b.template), strings.Compare(a.result, b.result))
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "mail_messages_total{template=%q,result=%q} %d\n", k.template, k.result, m.messages[k])
+	}
+
+	fmt.Fprintln(out, "# HELP mail_messages_sent_total Messages done with, by result: sent, or failed for good.")
+	fmt.Fprintln(out, "# TYPE mail_messages_sent_total counter")
+	for _, result := range []string{sendSent, sendFailed} {
+		fmt.Fprintf(out, "mail_messages_sent_total{result=%q} %d\n", result, m.sends[result])
+	}
+
+	fmt.Fprintln(out, "# HELP mail_send_retries_total Send attempts that failed and were retried.")
+	fmt.Fprintln(out, "# TYPE mail_send_retries_total counter")
+	fmt.Fprintf(out, "mail_send_retries_total %d\n", m.sends[sendRetried])
+
+	fmt.Fprintln(out, "# HELP mail_smtp_duration_seconds SMTP session time per send attempt, by result.")
+	fmt.Fprintln(out, "# TYPE mail_smtp_duration_seconds histogram")
+	for _, result := range []string{"success", "error"} {
+		h, ok := m.durations[result]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "mail_smtp_duration_seconds_bucket{result=\"%s\",le=\"%s\"} %d\n", result, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "mail_smtp_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.count)
+		fmt.Fprintf(out, "mail_smtp_duration_seconds_sum{result=\"%s\"} %s\n", result, formatFloat(h.sum))
+		fmt.Fprintf(out, "mail_smtp_duration_seconds_count{result=\"%s\"} %d\n", result, h.count)
+	}
+}
+
+// writeMetrics writes the queue's gauges.
+func (q *mailQueue) writeMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP mail_queue_depth Messages waiting for a worker.")
+	fmt.Fprintln(out, "# TYPE mail_queue_depth gauge")
+	fmt.Fprintf(out, "mail_queue_depth %d\n", len(q.queue))
+	fmt.Fprintln(out, "# HELP mail_queue_capacity Messages the queue holds before refusing more.")
+	fmt.Fprintln(out, "# TYPE mail_queue_capacity gauge")
+	fmt.Fprintf(out, "mail_queue_capacity %d\n", cap(q.queue))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// Sending over SMTP, to a relay such as Amazon SES, SendGrid, Postmark or
+// the company's own, with SMTP_TLS:
+//
+//	starttls  connect in plain text and upgrade with STARTTLS, refusing
+//	          relays that do not offer it (port 587, the default)
+//	tls       TLS from the first byte (port 465)
+//	none      no TLS, for a relay on localhost or a sidecar only; login
+//	          credentials are never sent unencrypted to another host
+//
+// The relay's 5xx answers, such as an unknown recipient, are permanent:
+// the message is not retried. Anything else, from a refused connection to
+// a 4xx "try again later", is retried (queue.go).
+
+type smtpSender struct {
+	host     string
+	addr     string
+	tlsMode  string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+func newSMTPSender() *smtpSender {
+	return &smtpSender{
+		host:     conf("SMTP_HOST"),
+		addr:     net.JoinHostPort(conf("SMTP_HOST"), strconv.Itoa(confInt("SMTP_PORT"))),
+		tlsMode:  conf("SMTP_TLS"),
+		username: conf("SMTP_USERNAME"),
+		password: conf("SMTP_PASSWORD"),
+		timeout:  confDuration("SMTP_TIMEOUT"),
+	}
+}
+
+// permanentError is a failure retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// classify marks the relay's 5xx answers permanent.
+func classify(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// send delivers m in one SMTP session, within SMTP_TIMEOUT.
+func (s *smtpSender) send(ctx context.Context, m *outgoingMail) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	tlsConfig := &tls.Config{ServerName: s.host, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	var err error
+	if s.tlsMode == "tls" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.tlsMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", s.addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.username != "" {
+		// PlainAuth refuses to send the password without TLS, except to
+		// localhost.
+		if err := c.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return classify(err)
+		}
+	}
+	if err := c.Mail(m.From.Address); err != nil {
+		return classify(err)
+	}
+	for _, to := range m.recipients() {
+		if err := c.Rcpt(to); err != nil {
+			return classify(fmt.Errorf("recipient %s: %w", to, err))
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return classify(err)
+	}
+	if _, err := w.Write(m.bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return classify(err)
+	}
+	// The message is accepted once DATA is; a failed QUIT changes nothing.
+	c.Quit()
+	return nil
+}
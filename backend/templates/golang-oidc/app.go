@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// The app: human login with OpenID Connect next to the landing page.
+// oidc.go runs the authorization-code flow against the provider, session.go
+// keeps the logged-in user in a signed cookie, and GET /me is a sample
+// route behind requireSession:
+//
+//	GET /me  the logged-in user as {"sub", "name", "email"}; browsers
+//	         without a session are sent to /login first
+//
+//	OIDC_ISSUER                    the provider's issuer URL, e.g.
+//	                               https://accounts.google.com
+//	OIDC_CLIENT_ID                 the app's client ID at the provider
+//	OIDC_CLIENT_SECRET             its client secret
+//	OIDC_REDIRECT_URL              this app's callback as registered with
+//	                               the provider, e.g.
+//	                               https://app.example.com/auth/callback
+//	OIDC_POST_LOGOUT_REDIRECT_URL  where the provider sends users after
+//	                               logout, if it supports that
+//	OIDC_SCOPES                    scopes requested at login (default
+//	                               openid,profile,email)
+//	SESSION_SECRET                 key signing the session cookies, at
+//	                               least 32 characters
+//	SESSION_TTL                    how long a login lasts (default 8h)
+//	SESSION_COOKIE_SECURE          "false" lets cookies travel over plain
+//	                               HTTP, for local development only
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "OIDC_ISSUER", required: true},
+	{name: "OIDC_CLIENT_ID", required: true},
+	{name: "OIDC_CLIENT_SECRET", required: true, secret: true},
+	{name: "OIDC_REDIRECT_URL", required: true},
+	{name: "OIDC_POST_LOGOUT_REDIRECT_URL"},
+	{name: "OIDC_SCOPES", kind: kindList, def: "openid,profile,email"},
+	{name: "SESSION_SECRET", required: true, secret: true, check: checkSessionSecret},
+	{name: "SESSION_TTL", kind: kindDuration, def: "8h"},
+	{name: "SESSION_COOKIE_SECURE", kind: kindBool, def: "true"},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	appOIDC = newOIDCClient()
+	registerStartupTask("oidc discovery", appOIDC.discover)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	registerLoginRoutes(mux)
+	mux.HandleFunc("GET /me", requireSession(meHandler))
+	return nil
+}
+
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromContext(r.Context())
+	writeJSON(w, http.StatusOK, map[string]string{"sub": s.Subject, "name": s.Name, "email": s.Email})
+}
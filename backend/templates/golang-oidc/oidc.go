@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The OpenID Connect authorization-code flow, with PKCE:
+//
+//	GET  /login          redirects to the provider; ?return_to=/path picks
+//	                     where the user lands afterwards (default /)
+//	GET  /auth/callback  the provider redirects back here with a code,
+//	                     which is exchanged for an ID token; a verified
+//	                     token starts a session (session.go)
+//	POST /logout         ends the session, and the provider's too when it
+//	                     publishes an end_session_endpoint
+//
+// The provider's endpoints come from OIDC_ISSUER's discovery document,
+// fetched as a startup task, so the app only reports started once it can
+// log users in. ID tokens are checked by the jwtVerifier of auth.go
+// against the provider's key set, with the client ID as the audience and
+// the nonce sent with the login. The state, nonce and PKCE verifier of a
+// login in progress travel in a short-lived signed cookie, so any replica
+// can handle the callback.
+
+// loginFlowTTL bounds how long a user may take at the provider's login
+// page.
+const loginFlowTTL = 10 * time.Minute
+
+const flowCookie = "oidc_flow"
+
+// oidcProvider is what discovery learns about the provider.
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+
+	verifier *jwtVerifier
+}
+
+// oidcClient is the app's registration with the provider.
+type oidcClient struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	logoutURL    string
+	scopes       []string
+	http         *http.Client
+
+	provider atomic.Pointer[oidcProvider] // nil until discovery succeeds
+}
+
+// appOIDC is the OIDC client, created by setupApp.
+var appOIDC *oidcClient
+
+func newOIDCClient() *oidcClient {
+	return &oidcClient{
+		issuer:       strings.TrimSuffix(conf("OIDC_ISSUER"), "/"),
+		clientID:     conf("OIDC_CLIENT_ID"),
+		clientSecret: conf("OIDC_CLIENT_SECRET"),
+		redirectURL:  conf("OIDC_REDIRECT_URL"),
+		logoutURL:    conf("OIDC_POST_LOGOUT_REDIRECT_URL"),
+		scopes:       confList("OIDC_SCOPES"),
+		http:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// discover fetches the provider's discovery document and checks that it
+// is the issuer's.
+func (c *oidcClient) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery: status %s", resp.Status)
+	}
+	var doc struct {
+		Issuer string `json:"issuer"`
+		oidcProvider
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != c.issuer {
+		return fmt.Errorf("discovery: issuer %q, want %q", doc.Issuer, c.issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return errors.New("discovery: authorization_endpoint, token_endpoint and jwks_uri are required")
+	}
+	p := doc.oidcProvider
+	p.verifier = &jwtVerifier{
+		jwksURL:  p.JWKSURI,
+		issuer:   doc.Issuer,
+		audience: c.clientID,
+		leeway:   confDuration("JWT_LEEWAY"),
+		refresh:  confDuration("JWT_JWKS_REFRESH"),
+		client:   c.http,
+	}
+	c.provider.Store(&p)
+	return nil
+}
+
+func registerLoginRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /login", loginHandler)
+	mux.HandleFunc("GET /auth/callback", callbackHandler)
+	mux.HandleFunc("POST /logout", logoutHandler)
+	mux.HandleFunc("/logout", methodNotAllowed("POST"))
+}
+
+// loginFlow is a login in progress, from /login to /auth/callback.
+type loginFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code_verifier
+	ReturnTo string `json:"return_to"`
+	Expires  int64  `json:"exp"`
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localPath returns target if it is a path on this app, else "/", so
+// return_to cannot send users to another site.
+func localPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	p := appOIDC.provider.Load()
+	if p == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "login unavailable: identity provider not discovered yet")
+		return
+	}
+	flow := loginFlow{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		ReturnTo: localPath(r.URL.Query().Get("return_to")),
+		Expires:  time.Now().Add(loginFlowTTL).Unix(),
+	}
+	setSignedCookie(w, flowCookie, flow, loginFlowTTL)
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {appOIDC.clientID},
+		"redirect_uri":          {appOIDC.redirectURL},
+		"scope":                 {strings.Join(appOIDC.scopes, " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(p.AuthorizationEndpoint, q), http.StatusFound)
+}
+
+// withQuery appends q to endpoint, which may already have a query.
+func withQuery(endpoint string, q url.Values) string {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + q.Encode()
+}
+
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	p := appOIDC.provider.Load()
+	if p == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "login unavailable: identity provider not discovered yet")
+		return
+	}
+	var flow loginFlow
+	ok := readSignedCookie(r, flowCookie, &flow) && time.Now().Unix() < flow.Expires
+	clearCookie(w, flowCookie)
+	q := r.URL.Query()
+	switch {
+	case !ok:
+		writeError(w, r, http.StatusBadRequest, "login expired or not started here; try again")
+		return
+	case q.Get("state") != flow.State:
+		writeError(w, r, http.StatusBadRequest, "login state mismatch; try again")
+		return
+	case q.Get("error") != "":
+		requestLogger(r).Info("login refused by the identity provider", "error", q.Get("error"),
+			"description", q.Get("error_description"))
+		writeError(w, r, http.StatusUnauthorized, "login refused: "+q.Get("error"))
+		return
+	case q.Get("code") == "":
+		writeError(w, r, http.StatusBadRequest, "callback without a code")
+		return
+	}
+
+	claims, err := appOIDC.exchange(r.Context(), p, q.Get("code"), flow)
+	if err != nil {
+		requestLogger(r).Warn("login failed", "error", err)
+		writeError(w, r, http.StatusBadGateway, "login failed")
+		return
+	}
+	s := newSession(claims)
+	setSignedCookie(w, sessionCookie, s, time.Until(time.Unix(s.Expires, 0)))
+	requestLogger(r).Info("user logged in", "sub", s.Subject)
+	http.Redirect(w, r, flow.ReturnTo, http.StatusFound)
+}
+
+// exchange trades an authorization code for an ID token and returns its
+// verified claims.
+func (c *oidcClient) exchange(ctx context.Context, p *oidcProvider, code string, flow loginFlow) (jwtClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURL},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: status %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: status %s, error %q", resp.Status, tokens.Error)
+	}
+
+	claims, err := p.verifier.verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	if claims["nonce"] != flow.Nonce {
+		return nil, errors.New("ID token: nonce mismatch")
+	}
+	if claims.subject() == "" {
+		return nil, errors.New("ID token: no sub claim")
+	}
+	return claims, nil
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if s, ok := sessionFromRequest(r); ok {
+		requestLogger(r).Info("user logged out", "sub", s.Subject)
+	}
+	clearCookie(w, sessionCookie)
+
+	p := appOIDC.provider.Load()
+	if p == nil || p.EndSessionEndpoint == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	q := url.Values{"client_id": {appOIDC.clientID}}
+	if appOIDC.logoutURL != "" {
+		q.Set("post_logout_redirect_uri", appOIDC.logoutURL)
+	}
+	http.Redirect(w, r, withQuery(p.EndSessionEndpoint, q), http.StatusSeeOther)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProvider is an OpenID provider on httptest: discovery, a token
+// endpoint that issues ID tokens signed by a testIdP (auth_test.go), and
+// the testIdP's key set.
+type testProvider struct {
+	*testIdP
+	server *httptest.Server
+
+	// The last authorization request, which the token endpoint checks the
+	// exchange against.
+	nonce, challenge string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	p := &testProvider{testIdP: newTestIdP(t)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.testIdP.server.URL,
+			"end_session_endpoint":   p.server.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		switch {
+		case id != "test-client" || secret != "test-secret":
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		case r.PostFormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"id_token": p.token("RS256", "rsa-1", map[string]any{
+				"iss":   p.server.URL,
+				"aud":   "test-client",
+				"sub":   "user-42",
+				"name":  "Ada Lovelace",
+				"email": "ada@example.com",
+				"nonce": p.nonce,
+				"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			})})
+		}
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// withOIDC points the app at p and returns the login routes and /me.
+func withOIDC(t *testing.T, p *testProvider) http.Handler {
+	t.Setenv("OIDC_ISSUER", p.server.URL)
+	t.Setenv("OIDC_CLIENT_ID", "test-client")
+	t.Setenv("OIDC_CLIENT_SECRET", "test-secret")
+	t.Setenv("OIDC_REDIRECT_URL", "https://app.example.com/auth/callback")
+	t.Setenv("OIDC_POST_LOGOUT_REDIRECT_URL", "https://app.example.com/")
+	t.Setenv("SESSION_SECRET", strings.Repeat("s", sessionSecretMinLength))
+	appOIDC = newOIDCClient()
+	if err := appOIDC.discover(context.Background()); err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	mux := http.NewServeMux()
+	registerLoginRoutes(mux)
+	mux.HandleFunc("GET /me", requireSession(meHandler))
+	return mux
+}
+
+// login starts a login for returnTo and returns the state sent to the
+// provider and the flow cookie.
+func (p *testProvider) login(t *testing.T, h http.Handler, returnTo string) (string, *http.Cookie) {
+	t.Helper()
+	w := do(h, "GET", "/login?return_to="+url.QueryEscape(returnTo), nil)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || !strings.HasPrefix(loc.String(), p.server.URL+"/authorize?") {
+		t.Fatalf("GET /login = %d to %q, want a redirect to the provider", w.Code, w.Header().Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("client_id") != "test-client" || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("redirect_uri") != "https://app.example.com/auth/callback" || q.Get("scope") != "openid profile email" {
+		t.Fatalf("authorization request %v lacks the client's parameters", q)
+	}
+	p.nonce, p.challenge = q.Get("nonce"), q.Get("code_challenge")
+	return q.Get("state"), cookieNamed(t, w, flowCookie)
+}
+
+func cookieNamed(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("response sets no %s cookie", name)
+	return nil
+}
+
+// doWithCookie serves one request carrying cookie c.
+func doWithCookie(h http.Handler, method, target string, c *http.Cookie, header ...string) *httptest.ResponseRecorder {
+	return do(h, method, target, nil, append(header, "Cookie", c.Name+"="+c.Value)...)
+}
+
+func TestLoginFlow(t *testing.T) {
+	p := newTestProvider(t)
+	h := withOIDC(t, p)
+
+	w := do(h, "GET", "/me", nil, "Accept", "text/html")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login?return_to=%2Fme" {
+		t.Fatalf("GET /me from a browser without a session = %d to %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+
+	state, flow := p.login(t, h, "/me")
+	w = doWithCookie(h, "GET", "/auth/callback?code=good-code&state="+state, flow)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/me" {
+		t.Fatalf("callback = %d to %q %s, want a redirect back to /me", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	sess := cookieNamed(t, w, sessionCookie)
+	if !sess.HttpOnly || sess.SameSite != http.SameSiteLaxMode || !sess.Secure {
+		t.Errorf("session cookie %+v is not HttpOnly, SameSite=Lax and Secure", sess)
+	}
+
+	w = doWithCookie(h, "GET", "/me", sess)
+	var me map[string]string
+	decode(t, w, &me)
+	if w.Code != http.StatusOK || me["sub"] != "user-42" || me["email"] != "ada@example.com" {
+		t.Fatalf("GET /me with a session = %d %v, want 200 with the user", w.Code, me)
+	}
+
+	w = doWithCookie(h, "POST", "/logout", sess)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(loc.String(), p.server.URL+"/logout?") ||
+		loc.Query().Get("post_logout_redirect_uri") != "https://app.example.com/" {
+		t.Fatalf("POST /logout = %d to %q, want a redirect to the provider's end_session_endpoint", w.Code, loc)
+	}
+	if c := cookieNamed(t, w, sessionCookie); c.MaxAge >= 0 {
+		t.Errorf("logout leaves the session cookie: %+v", c)
+	}
+}
+
+func TestCallbackRejects(t *testing.T) {
+	p := newTestProvider(t)
+	h := withOIDC(t, p)
+
+	state, flow := p.login(t, h, "/")
+	if w := do(h, "GET", "/auth/callback?code=good-code&state="+state, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without the flow cookie = %d, want 400", w.Code)
+	}
+	if w := doWithCookie(h, "GET", "/auth/callback?code=good-code&state=forged", flow); w.Code != http.StatusBadRequest {
+		t.Errorf("callback with another state = %d, want 400", w.Code)
+	}
+	if w := doWithCookie(h, "GET", "/auth/callback?error=access_denied&state="+state, flow); w.Code != http.StatusUnauthorized {
+		t.Errorf("callback with a provider error = %d, want 401", w.Code)
+	}
+	if w := doWithCookie(h, "GET", "/auth/callback?code=stolen-code&state="+state, flow); w.Code != http.StatusBadGateway {
+		t.Errorf("callback with a code the provider refuses = %d, want 502", w.Code)
+	}
+
+	state, flow = p.login(t, h, "/")
+	p.nonce = "replayed"
+	if w := doWithCookie(h, "GET", "/auth/callback?code=good-code&state="+state, flow); w.Code != http.StatusBadGateway {
+		t.Errorf("callback with an ID token for another nonce = %d, want 502", w.Code)
+	}
+}
+
+func TestSessionCookieTampered(t *testing.T) {
+	t.Setenv("SESSION_SECRET", strings.Repeat("s", sessionSecretMinLength))
+	h := requireSession(meHandler)
+
+	w := httptest.NewRecorder()
+	setSignedCookie(w, sessionCookie, session{Subject: "user-42", Expires: time.Now().Add(time.Hour).Unix()}, time.Hour)
+	c := cookieNamed(t, w, sessionCookie)
+	if w := doWithCookie(h, "GET", "/me", c); w.Code != http.StatusOK {
+		t.Fatalf("GET /me with a signed session = %d, want 200", w.Code)
+	}
+
+	_, sig, _ := strings.Cut(c.Value, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`))
+	if w := doWithCookie(h, "GET", "/me", &http.Cookie{Name: sessionCookie, Value: forged + "." + sig}); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me with a forged session = %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	setSignedCookie(w, sessionCookie, session{Subject: "user-42", Expires: time.Now().Add(-time.Minute).Unix()}, time.Hour)
+	if w := doWithCookie(h, "GET", "/me", cookieNamed(t, w, sessionCookie)); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me with an expired session = %d, want 401", w.Code)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for target, want := range map[string]string{
+		"/me":                  "/me",
+		"/items?page=2":        "/items?page=2",
+		"":                     "/",
+		"https://evil.example": "/",
+		"//evil.example/path":  "/",
+		"/\\evil.example":      "/",
+		"javascript:alert(1)":  "/",
+	} {
+		if got := localPath(target); got != want {
+			t.Errorf("localPath(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sessions live entirely in a cookie: the user's identity as JSON, signed
+// with HMAC-SHA256 under SESSION_SECRET, so every replica accepts every
+// session and there is no store to run. The cookie is HttpOnly, SameSite
+// Lax and, unless SESSION_COOKIE_SECURE=false, Secure. Changing
+// SESSION_SECRET logs everybody out.
+//
+// A session lasts SESSION_TTL from login, however long the provider's ID
+// token was valid for; logging out at the provider does not end it early.
+
+const sessionCookie = "session"
+
+// sessionSecretMinLength keeps SESSION_SECRET out of brute-force range.
+const sessionSecretMinLength = 32
+
+// session is a logged-in user.
+type session struct {
+	Subject string `json:"sub"`
+	Name    string `json:"name,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+func newSession(claims jwtClaims) session {
+	s := session{Subject: claims.subject(), Expires: time.Now().Add(confDuration("SESSION_TTL")).Unix()}
+	s.Name, _ = claims["name"].(string)
+	s.Email, _ = claims["email"].(string)
+	return s
+}
+
+func checkSessionSecret(v string) error {
+	if len(v) < sessionSecretMinLength {
+		return errors.New("want at least 32 characters, e.g. from openssl rand -base64 32")
+	}
+	return nil
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(conf("SESSION_SECRET")))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSignedCookie stores v in cookie name for maxAge.
+func setSignedCookie(w http.ResponseWriter, name string, v any, maxAge time.Duration) {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + sign(payload),
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   confBool("SESSION_COOKIE_SECURE"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readSignedCookie decodes cookie name into v, reporting false if it is
+// missing or its signature does not match.
+func readSignedCookie(r *http.Request, name string, v any) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(payload))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   confBool("SESSION_COOKIE_SECURE"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionFromRequest returns the request's unexpired session.
+func sessionFromRequest(r *http.Request) (session, bool) {
+	var s session
+	if !readSignedCookie(r, sessionCookie, &s) || s.Subject == "" || time.Now().Unix() >= s.Expires {
+		return session{}, false
+	}
+	return s, true
+}
+
+type sessionKey struct{}
+
+// sessionFromContext returns the session put in the context by
+// requireSession.
+func sessionFromContext(ctx context.Context) session {
+	s, _ := ctx.Value(sessionKey{}).(session)
+	return s
+}
+
+// requireSession serves next only to logged-in users. Browsers are sent
+// to /login and brought back afterwards; API clients get a 401.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := sessionFromRequest(r)
+		if !ok {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			writeError(w, r, http.StatusUnauthorized, "login required")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+	}
+}
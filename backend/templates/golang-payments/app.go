@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// The app: a receiver for payment provider webhooks, Stripe's or any
+// provider signing the same way, next to the landing page. signature.go
+// verifies deliveries, events.go processes them exactly once through the
+// idempotency store (store.go, store_redis.go), handlers.go is where each
+// type of event is handled, and replay.go fetches the events the app
+// missed:
+//
+//	POST /webhooks/payments  an event from the provider: 200 once
+//	                         processed, or a repeat of one that was, 500
+//	                         for the provider to retry when the handler
+//	                         failed
+//	POST /v1/replay          replays the events since a time (replay.go),
+//	                         with PAYMENT_API_KEY set
+//	GET /v1/replay           the last replay's progress
+//
+//	PAYMENT_WEBHOOK_SECRETS      the endpoint's signing secrets (whsec_...),
+//	                             comma- or newline-separated; two while
+//	                             one is rolled
+//	PAYMENT_SIGNATURE_HEADER     header with the signature (default
+//	                             Stripe-Signature)
+//	PAYMENT_SIGNATURE_TOLERANCE  how old a signature may be (default 5m)
+//	PAYMENT_HANDLER_TIMEOUT      deadline for handling one event (default
+//	                             20s, inside HTTP_WRITE_TIMEOUT)
+//	PAYMENT_PROCESSING_LEASE     how long a claimed event is refused to
+//	                             other deliveries (default 1m, above
+//	                             PAYMENT_HANDLER_TIMEOUT)
+//	PAYMENT_EVENT_TTL            how long a processed event is remembered
+//	                             (default 720h); cover the provider's
+//	                             retries and its event log
+//	PAYMENT_EVENT_STORE          memory (default), or redis for an
+//	                             idempotency store shared by every replica
+//	REDIS_URL                    redis:// or rediss:// URL, with the
+//	                             password and database number if any, for
+//	                             PAYMENT_EVENT_STORE=redis
+//	REDIS_POOL_SIZE              connections per replica (default 10)
+//	REDIS_TIMEOUT                deadline for each store read or write
+//	                             (default 250ms)
+//	PAYMENT_EVENT_KEY_PREFIX     prefix for every event key, so apps can
+//	                             share a Redis (default the app name and
+//	                             ":event:")
+//	PAYMENT_API_URL              the provider's API (default
+//	                             https://api.stripe.com)
+//	PAYMENT_API_KEY              a key that can read events, to replay them
+//	PAYMENT_REPLAY_MAX           events one replay fetches at most (default
+//	                             1000)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "PAYMENT_WEBHOOK_SECRETS", required: true, secret: true, reloadable: true, check: checkPaymentSecrets},
+	{name: "PAYMENT_SIGNATURE_HEADER", def: "Stripe-Signature"},
+	{name: "PAYMENT_SIGNATURE_TOLERANCE", kind: kindDuration, def: "5m"},
+	{name: "PAYMENT_HANDLER_TIMEOUT", kind: kindDuration, def: "20s"},
+	{name: "PAYMENT_PROCESSING_LEASE", kind: kindDuration, def: "1m"},
+	{name: "PAYMENT_EVENT_TTL", kind: kindDuration, def: "720h"},
+	{name: "PAYMENT_EVENT_STORE", def: "memory", check: oneOf("memory", "redis")},
+	{name: "REDIS_URL", secret: true},
+	{name: "REDIS_POOL_SIZE", kind: kindInt, def: "10", check: atLeast(1)},
+	{name: "REDIS_TIMEOUT", kind: kindDuration, def: "250ms"},
+	{name: "PAYMENT_EVENT_KEY_PREFIX", def: serviceName + ":event:"},
+	{name: "PAYMENT_API_URL", def: "https://api.stripe.com"},
+	{name: "PAYMENT_API_KEY", secret: true},
+	{name: "PAYMENT_REPLAY_MAX", kind: kindInt, def: "1000", check: atLeast(1)},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	if confDuration("PAYMENT_PROCESSING_LEASE") <= confDuration("PAYMENT_HANDLER_TIMEOUT") {
+		return errors.New("PAYMENT_PROCESSING_LEASE must exceed PAYMENT_HANDLER_TIMEOUT, or a slow handler's event could run twice")
+	}
+	replay := conf("PAYMENT_API_KEY") != ""
+	if replay && conf("API_KEYS") == "" && conf("JWT_JWKS_URL") == "" {
+		return errors.New("set API_KEYS or JWT_JWKS_URL with PAYMENT_API_KEY: without them anyone could start a replay")
+	}
+	if replay && !protectedPath("/v1/replay", confList("AUTH_PATHS")) {
+		return errors.New("AUTH_PATHS must cover /v1 with PAYMENT_API_KEY, or anyone could start a replay")
+	}
+	store, err := openEventStore(conf("PAYMENT_EVENT_STORE"))
+	if err != nil {
+		return fmt.Errorf("opening the event store: %w", err)
+	}
+	router := newEventRouter(eventHandlers)
+	slog.Info("payment events handled", "types", router.types())
+	processor := &eventProcessor{store: store, router: router}
+	paymentMetrics.known = func(eventType string) bool {
+		_, ok := router.handler(eventType)
+		return ok
+	}
+	registerMetrics(paymentMetrics.write)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.Handle("POST /webhooks/payments", &paymentReceiver{
+		secrets:   newPaymentSecrets(),
+		header:    conf("PAYMENT_SIGNATURE_HEADER"),
+		tolerance: confDuration("PAYMENT_SIGNATURE_TOLERANCE"),
+		processor: processor,
+	})
+	mux.HandleFunc("/webhooks/payments", methodNotAllowed("POST"))
+	if replay {
+		rp := newReplayer(processor)
+		registerBackground("payment event replay", rp.run)
+		mux.HandleFunc("POST /v1/replay", rp.startHandler)
+		mux.HandleFunc("GET /v1/replay", rp.statusHandler)
+		mux.HandleFunc("/v1/replay", methodNotAllowed("GET, HEAD, POST"))
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receiving events. POST /webhooks/payments takes an event from the
+// provider and processes it before answering, so the answer tells the
+// provider whether to retry:
+//
+//  1. The body is read whole, up to MAX_REQUEST_BODY, and its signature
+//     checked over those exact bytes (signature.go): 400 if it fails.
+//  2. The event's ID is claimed in the idempotency store (store.go): an
+//     event processed before is answered 200 and not processed again,
+//     and one being processed by another delivery gets a 409.
+//  3. Its type picks the handler (handlers.go), run within
+//     PAYMENT_HANDLER_TIMEOUT. A type with no handler is answered 200,
+//     as ignored, so the provider stops sending it. Success is 200 and
+//     marks the event done; an error, or a panic, is 500 and releases
+//     the claim, so the provider's retry runs the handler again.
+//
+// Handlers run even when the request is cancelled, only
+// PAYMENT_HANDLER_TIMEOUT stops them, so a provider that gives up on a
+// slow answer cannot cut a handler off halfway.
+
+// paymentMaxEventID bounds event IDs, which become store keys.
+const paymentMaxEventID = 255
+
+// paymentEvent is an event as the provider sends it. Object is the
+// payment, charge, subscription, ... it is about, for the handler to
+// decode.
+type paymentEvent struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Created    int64  `json:"created"`
+	Livemode   bool   `json:"livemode"`
+	APIVersion string `json:"api_version"`
+	Data       struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// eventHandler processes one type of event.
+type eventHandler func(ctx context.Context, ev *paymentEvent) error
+
+// eventRouter picks an event's handler by its type: an exact match, or
+// else the longest "prefix.*" pattern matching it, e.g.
+// "customer.subscription.*".
+type eventRouter struct {
+	handlers map[string]eventHandler
+}
+
+func newEventRouter(handlers map[string]eventHandler) *eventRouter {
+	return &eventRouter{handlers: handlers}
+}
+
+func (rt *eventRouter) handler(eventType string) (eventHandler, bool) {
+	if h, ok := rt.handlers[eventType]; ok {
+		return h, true
+	}
+	for prefix := eventType; ; {
+		i := strings.LastIndex(prefix, ".")
+		if i < 0 {
+			return nil, false
+		}
+		prefix = prefix[:i]
+		if h, ok := rt.handlers[prefix+".*"]; ok {
+			return h, true
+		}
+	}
+}
+
+// types lists the patterns handled, sorted.
+func (rt *eventRouter) types() []string {
+	types := make([]string, 0, len(rt.handlers))
+	for t := range rt.handlers {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// Results of processing an event, as payment_events_total labels them.
+const (
+	eventProcessed        = "processed"
+	eventDuplicate        = "duplicate"
+	eventInProgress       = "in_progress"
+	eventIgnored          = "ignored"
+	eventFailed           = "failed"
+	eventInvalidSignature = "invalid_signature"
+)
+
+// eventProcessor runs events through the idempotency store and their
+// handlers, for deliveries and replays alike.
+type eventProcessor struct {
+	store  eventStore
+	router *eventRouter
+}
+
+// process processes ev once. The error is the handler's or the store's;
+// the result says what happened either way.
+func (p *eventProcessor) process(ctx context.Context, logger *slog.Logger, ev *paymentEvent) (string, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), confDuration("PAYMENT_HANDLER_TIMEOUT"))
+	defer cancel()
+
+	handle, ok := p.router.handler(ev.Type)
+	if !ok {
+		paymentMetrics.count(ev.Type, eventIgnored, 0)
+		return eventIgnored, nil
+	}
+	switch claim, err := p.store.claim(ctx, ev.ID, confDuration("PAYMENT_PROCESSING_LEASE")); {
+	case err != nil:
+		paymentMetrics.count(ev.Type, eventFailed, 0)
+		return eventFailed, fmt.Errorf("claiming the event: %w", err)
+	case claim == claimDone:
+		paymentMetrics.count(ev.Type, eventDuplicate, 0)
+		return eventDuplicate, nil
+	case claim == claimBusy:
+		paymentMetrics.count(ev.Type, eventInProgress, 0)
+		return eventInProgress, nil
+	}
+
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.Error("panic handling payment event", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+				err = fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		return handle(ctx, ev)
+	}()
+	if err != nil {
+		paymentMetrics.count(ev.Type, eventFailed, time.Since(start))
+		if rerr := p.store.release(context.WithoutCancel(ctx), ev.ID); rerr != nil {
+			logger.Warn("releasing the event failed; it is retried once its lease ends", "error", rerr)
+		}
+		return eventFailed, err
+	}
+	paymentMetrics.count(ev.Type, eventProcessed, time.Since(start))
+	if err := p.store.complete(context.WithoutCancel(ctx), ev.ID, confDuration("PAYMENT_EVENT_TTL")); err != nil {
+		// The handler's work is done; a repeat within the lease is still
+		// refused, and one after it runs the handler again.
+		logger.Error("marking the event processed failed", "error", err)
+	}
+	return eventProcessed, nil
+}
+
+// parseEvent decodes and checks an event body.
+func parseEvent(body []byte) (*paymentEvent, error) {
+	var ev paymentEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, errors.New("body is not a JSON event")
+	}
+	switch {
+	case ev.ID == "" || ev.Type == "":
+		return nil, errors.New(`event without an "id" and "type"`)
+	case len(ev.ID) > paymentMaxEventID:
+		return nil, fmt.Errorf("event ID longer than %d characters", paymentMaxEventID)
+	}
+	return &ev, nil
+}
+
+// paymentReceiver serves POST /webhooks/payments.
+type paymentReceiver struct {
+	secrets   *paymentSecrets
+	header    string
+	tolerance time.Duration
+	processor *eventProcessor
+}
+
+func (rcv *paymentReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody()))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "body too large")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "reading the body failed")
+		return
+	}
+	if err := verifyPaymentSignature(rcv.secrets.current(), r.Header.Get(rcv.header), body, rcv.tolerance, time.Now()); err != nil {
+		paymentMetrics.count("", eventInvalidSignature, 0)
+		requestLogger(r).Warn("payment webhook signature invalid", "error", err)
+		writeError(w, r, http.StatusBadRequest, "invalid signature")
+		return
+	}
+	ev, err := parseEvent(body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger := requestLogger(r).With("event_id", ev.ID, "event_type", ev.Type)
+
+	result, err := rcv.processor.process(r.Context(), logger, ev)
+	switch result {
+	case eventFailed:
+		logger.Error("payment event failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "processing the event failed")
+	case eventInProgress:
+		logger.Info("payment event already being processed")
+		writeError(w, r, http.StatusConflict, "event is being processed")
+	default:
+		if result == eventProcessed {
+			logger.Info("payment event processed")
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": result, "id": ev.ID})
+	}
+}
+
+// paymentStats counts events by type and result. Types are the ones with
+// a handler only, and "other" for the rest, so made-up types cannot grow
+// the series.
+type paymentStats struct {
+	mu        sync.Mutex
+	events    map[paymentKey]uint64
+	durations map[string]*histogram
+	known     func(string) bool
+}
+
+type paymentKey struct{ eventType, result string }
+
+var paymentMetrics = newPaymentStats()
+
+func newPaymentStats() *paymentStats {
+	return &paymentStats{events: map[paymentKey]uint64{}, durations: map[string]*histogram{}, known: func(string) bool { return false }}
+}
+
+// count records an event's result, and the handler's run time d when it
+// ran.
+func (m *paymentStats) count(eventType, result string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if result == eventInvalidSignature || !m.known(eventType) {
+		eventType = "other"
+	}
+	m.events[paymentKey{eventType, result}]++
+	if result != eventProcessed && result != eventFailed {
+		return
+	}
+	h, ok := m.durations[result]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[result] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *paymentStats) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP payment_events_total Payment events received, by type and result: processed, duplicate, in_progress, ignored, failed or invalid_signature.")
+	fmt.Fprintln(out, "# TYPE payment_events_total counter")
+	keys := make([]paymentKey, 0, len(m.events))
+	for k := range m.events {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b paymentKey) int {
+		if c := strings.Compare(a.eventType, b.eventType); c != 0 {
+			return c
+		}
+		return strings.Compare(a.result, b.result)
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "payment_events_total{type=%q,result=%q} %d\n", k.eventType, k.result, m.events[k])
+	}
+
+	fmt.Fprintln(out, "# HELP payment_handler_duration_seconds Handler run time per event, by result.")
+	fmt.Fprintln(out, "# TYPE payment_handler_duration_seconds histogram")
+	for _, result := range []string{eventProcessed, eventFailed} {
+		h, ok := m.durations[result]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "payment_handler_duration_seconds_bucket{result=\"%s\",le=\"%s\"} %d\n", result, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "payment_handler_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.count)
+		fmt.Fprintf(out, "payment_handler_duration_seconds_sum{result=\"%s\"} %s\n", result, formatFloat(h.sum))
+		fmt.Fprintf(out, "payment_handler_duration_seconds_count{result=\"%s\"} %d\n", result, h.count)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// The app's event handlers, by event type. Replace the samples with the
+// app's own: fulfil the order, extend the subscription, email the
+// receipt. Add a type here and enable it for the endpoint at the
+// provider; types without a handler are acknowledged and ignored.
+//
+// A handler returning an error has the event retried, by the provider or
+// the next replay, so return one for failures worth retrying (the
+// database is down) and nil for events that will never apply (an order
+// this app does not know). The idempotency store keeps a processed event
+// from running twice; a handler whose writes must never repeat, even
+// after a crash right after them, keys them by ev.ID too.
+var eventHandlers = map[string]eventHandler{
+	"payment_intent.succeeded":      paymentSucceeded,
+	"payment_intent.payment_failed": paymentFailed,
+	"charge.refunded":               chargeRefunded,
+	"customer.subscription.*":       subscriptionChanged,
+}
+
+// paymentIntent is the part of a payment_intent object the samples read.
+type paymentIntent struct {
+	ID       string            `json:"id"`
+	Amount   int64             `json:"amount"`
+	Currency string            `json:"currency"`
+	Customer string            `json:"customer"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// decodeObject decodes the event's object into v. A malformed one is
+// logged and skipped: retrying the same body cannot fix it.
+func decodeObject(ev *paymentEvent, v any) bool {
+	if err := json.Unmarshal(ev.Data.Object, v); err != nil {
+		slog.Error("payment event object malformed", "event_id", ev.ID, "event_type", ev.Type, "error", err)
+		return false
+	}
+	return true
+}
+
+func paymentSucceeded(ctx context.Context, ev *paymentEvent) error {
+	var pi paymentIntent
+	if !decodeObject(ev, &pi) {
+		return nil
+	}
+	slog.InfoContext(ctx, "payment succeeded", "event_id", ev.ID, "payment_intent", pi.ID,
+		"amount", pi.Amount, "currency", pi.Currency, "order_id", pi.Metadata["order_id"])
+	return nil
+}
+
+func paymentFailed(ctx context.Context, ev *paymentEvent) error {
+	var pi paymentIntent
+	if !decodeObject(ev, &pi) {
+		return nil
+	}
+	slog.WarnContext(ctx, "payment failed", "event_id", ev.ID, "payment_intent", pi.ID, "order_id", pi.Metadata["order_id"])
+	return nil
+}
+
+func chargeRefunded(ctx context.Context, ev *paymentEvent) error {
+	var charge struct {
+		ID             string `json:"id"`
+		PaymentIntent  string `json:"payment_intent"`
+		AmountRefunded int64  `json:"amount_refunded"`
+		Currency       string `json:"currency"`
+	}
+	if !decodeObject(ev, &charge) {
+		return nil
+	}
+	slog.InfoContext(ctx, "charge refunded", "event_id", ev.ID, "charge", charge.ID,
+		"payment_intent", charge.PaymentIntent, "amount_refunded", charge.AmountRefunded, "currency", charge.Currency)
+	return nil
+}
+
+func subscriptionChanged(ctx context.Context, ev *paymentEvent) error {
+	var sub struct {
+		ID       string `json:"id"`
+		Customer string `json:"customer"`
+		Status   string `json:"status"`
+	}
+	if !decodeObject(ev, &sub) {
+		return nil
+	}
+	slog.InfoContext(ctx, "subscription changed", "event_id", ev.ID, "event_type", ev.Type,
+		"subscription", sub.ID, "customer", sub.Customer, "status", sub.Status)
+	return nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// signPayment returns the Stripe-Signature value of body under each of
+// secrets, signed at t.
+func signPayment(body string, t time.Time, secrets ...string) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	header := "t=" + ts
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "." + body))
+		header += ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return header
+}
+
+// testEvent returns an event body of type eventType.
+func testEvent(id, eventType string) string {
+	return fmt.Sprintf(`{"id": %q, "type": %q, "created": 1760400000, "livemode": false,
+		"data": {"object": {"id": "pi_1", "amount": 2000, "currency": "eur", "metadata": {"order_id": "o-1"}}}}`, id, eventType)
+}
+
+// calls counts how often each event ID reached a test handler.
+type calls struct {
+	mu  sync.Mutex
+	ids map[string]int
+}
+
+func (c *calls) add(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[id]++
+	return c.ids[id]
+}
+
+func (c *calls) get(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ids[id]
+}
+
+// withPayments serves POST /webhooks/payments under the secrets
+// whsec_old and whsec_new, mid-rotation, keeping events in store. Events
+// of type test.ok succeed, test.fail fail on their first delivery and
+// test.panic panic on theirs.
+func withPayments(t *testing.T, store eventStore) (http.Handler, *eventProcessor, *calls) {
+	t.Helper()
+	t.Setenv("PAYMENT_WEBHOOK_SECRETS", "whsec_old,\nwhsec_new")
+	c := &calls{ids: map[string]int{}}
+	router := newEventRouter(map[string]eventHandler{
+		"test.ok": func(_ context.Context, ev *paymentEvent) error {
+			c.add(ev.ID)
+			return nil
+		},
+		"test.fail": func(_ context.Context, ev *paymentEvent) error {
+			if c.add(ev.ID) == 1 {
+				return errors.New("database unavailable")
+			}
+			return nil
+		},
+		"test.panic": func(_ context.Context, ev *paymentEvent) error {
+			if c.add(ev.ID) == 1 {
+				panic("nil order")
+			}
+			return nil
+		},
+	})
+	metrics := paymentMetrics
+	paymentMetrics = newPaymentStats()
+	paymentMetrics.known = func(eventType string) bool {
+		_, ok := router.handler(eventType)
+		return ok
+	}
+	t.Cleanup(func() { paymentMetrics = metrics })
+
+	processor := &eventProcessor{store: store, router: router}
+	mux := http.NewServeMux()
+	mux.Handle("POST /webhooks/payments", &paymentReceiver{
+		secrets:   newPaymentSecrets(),
+		header:    "Stripe-Signature",
+		tolerance: 5 * time.Minute,
+		processor: processor,
+	})
+	return mux, processor, c
+}
+
+// deliverPayment posts body signed under secret now, and returns the
+// status and the answer's status field.
+func deliverPayment(t *testing.T, h http.Handler, secret, body string) (int, string) {
+	t.Helper()
+	w := do(h, "POST", "/webhooks/payments", strings.NewReader(body), "Stripe-Signature", signPayment(body, time.Now(), secret))
+	var out struct{ Status string }
+	if w.Code == http.StatusOK {
+		decode(t, w, &out)
+	}
+	return w.Code, out.Status
+}
+
+func TestVerifySignature(t *testing.T) {
+	secrets := parsePaymentSecrets("whsec_old\n# rolled out on 2026-10-01\nwhsec_new")
+	body := testEvent("evt_1", "test.ok")
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name, header string
+		want         error
+	}{
+		{"current secret", signPayment(body, now, "whsec_new"), nil},
+		{"secret being rolled out", signPayment(body, now, "whsec_old"), nil},
+		{"one signature per secret", signPayment(body, now, "whsec_other", "whsec_new"), nil},
+		{"within the tolerance", signPayment(body, now.Add(-4*time.Minute), "whsec_new"), nil},
+		{"unknown secret", signPayment(body, now, "whsec_other"), errBadSignature},
+		{"other body", signPayment(body+" ", now, "whsec_new"), errBadSignature},
+		{"too old", signPayment(body, now.Add(-6*time.Minute), "whsec_new"), errStaleEvent},
+		{"from the future", signPayment(body, now.Add(6*time.Minute), "whsec_new"), errStaleEvent},
+		{"no timestamp", strings.SplitN(signPayment(body, now, "whsec_new"), ",", 2)[1], errNoSignature},
+		{"no signature", signPayment(body, now), errNoSignature},
+		{"not hex", "t=" + strconv.FormatInt(now.Unix(), 10) + ",v1=zz", errNoSignature},
+		{"empty", "", errNoSignature},
+	} {
+		if err := verifyPaymentSignature(secrets, tc.header, []byte(body), 5*time.Minute, now); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if checkPaymentSecrets(" ,\n# none yet") == nil {
+		t.Error("PAYMENT_WEBHOOK_SECRETS without a secret was accepted")
+	}
+}
+
+func TestPaymentSecretsReload(t *testing.T) {
+	t.Setenv("PAYMENT_WEBHOOK_SECRETS", "whsec_old,whsec_new")
+	secrets := newPaymentSecrets()
+	body := []byte(testEvent("evt_reload", "test.ok"))
+	verify := func(secret string) error {
+		return verifyPaymentSignature(secrets.current(), signPayment(string(body), time.Now(), secret), body, time.Minute, time.Now())
+	}
+
+	t.Setenv("PAYMENT_WEBHOOK_SECRETS", "whsec_new")
+	secrets.reload()
+	if verify("whsec_old") == nil || verify("whsec_new") != nil {
+		t.Error("reload did not roll out whsec_old")
+	}
+	t.Setenv("PAYMENT_WEBHOOK_SECRETS", "")
+	secrets.reload()
+	if verify("whsec_new") != nil {
+		t.Error("an empty reload dropped the current secrets")
+	}
+}
+
+func TestPaymentExactlyOnce(t *testing.T) {
+	h, _, c := withPayments(t, newMemoryStore())
+	body := testEvent("evt_once", "test.ok")
+
+	for i, want := range []string{eventProcessed, eventDuplicate, eventDuplicate} {
+		code, status := deliverPayment(t, h, "whsec_new", body)
+		if code != http.StatusOK || status != want {
+			t.Errorf("delivery %d: got %d %q, want 200 %q", i+1, code, status, want)
+		}
+	}
+	if n := c.get("evt_once"); n != 1 {
+		t.Errorf("handler ran %d times, want once", n)
+	}
+	if code, _ := deliverPayment(t, h, "whsec_other", testEvent("evt_forged", "test.ok")); code != http.StatusBadRequest {
+		t.Errorf("forged event: got %d, want 400", code)
+	}
+	if n := c.get("evt_forged"); n != 0 {
+		t.Errorf("forged event reached the handler %d times", n)
+	}
+}
+
+func TestPaymentRetries(t *testing.T) {
+	h, _, c := withPayments(t, newMemoryStore())
+
+	for _, eventType := range []string{"test.fail", "test.panic"} {
+		body := testEvent("evt_"+eventType, eventType)
+		if code, _ := deliverPayment(t, h, "whsec_new", body); code != http.StatusInternalServerError {
+			t.Errorf("%s first delivery: got %d, want 500", eventType, code)
+		}
+		if code, status := deliverPayment(t, h, "whsec_new", body); code != http.StatusOK || status != eventProcessed {
+			t.Errorf("%s retry: got %d %q, want the released event processed", eventType, code, status)
+		}
+		if code, status := deliverPayment(t, h, "whsec_new", body); status != eventDuplicate {
+			t.Errorf("%s after success: got %d %q, want a duplicate", eventType, code, status)
+		}
+		if n := c.get("evt_" + eventType); n != 2 {
+			t.Errorf("%s handler ran %d times, want twice", eventType, n)
+		}
+	}
+}
+
+func TestPaymentInProgress(t *testing.T) {
+	store := newMemoryStore()
+	h, _, c := withPayments(t, store)
+	if _, err := store.claim(context.Background(), "evt_busy", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := deliverPayment(t, h, "whsec_new", testEvent("evt_busy", "test.ok")); code != http.StatusConflict {
+		t.Errorf("event claimed by another delivery: got %d, want 409", code)
+	}
+	if n := c.get("evt_busy"); n != 0 {
+		t.Errorf("handler ran %d times for a claimed event", n)
+	}
+}
+
+func TestPaymentIgnoredAndInvalid(t *testing.T) {
+	h, _, _ := withPayments(t, newMemoryStore())
+	if code, status := deliverPayment(t, h, "whsec_new", testEvent("evt_other", "invoice.created")); code != http.StatusOK || status != eventIgnored {
+		t.Errorf("unhandled type: got %d %q, want 200 ignored", code, status)
+	}
+	for name, body := range map[string]string{
+		"not JSON":   "id=evt_1",
+		"no type":    `{"id": "evt_1"}`,
+		"long ID":    testEvent(strings.Repeat("e", paymentMaxEventID+1), "test.ok"),
+		"empty body": "",
+	} {
+		if code, _ := deliverPayment(t, h, "whsec_new", body); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", name, code)
+		}
+	}
+}
+
+func TestEventRouter(t *testing.T) {
+	handled := func(name string) eventHandler {
+		return func(context.Context, *paymentEvent) error { return errors.New(name) }
+	}
+	rt := newEventRouter(map[string]eventHandler{
+		"customer.subscription.*":       handled("subscription"),
+		"customer.subscription.deleted": handled("deleted"),
+		"customer.*":                    handled("customer"),
+	})
+	for eventType, want := range map[string]string{
+		"customer.subscription.deleted": "deleted",
+		"customer.subscription.updated": "subscription",
+		"customer.created":              "customer",
+		"customer.source.expiring":      "customer",
+		"customer":                      "",
+		"payment_intent.succeeded":      "",
+	} {
+		h, ok := rt.handler(eventType)
+		got := ""
+		if ok {
+			got = h(context.Background(), nil).Error()
+		}
+		if got != want {
+			t.Errorf("%s: routed to %q, want %q", eventType, got, want)
+		}
+	}
+}
+
+func TestRedisEventStore(t *testing.T) {
+	rdb := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+rdb.Addr())
+	withChecks(t)
+	store, err := openEventStore("redis")
+	if err != nil {
+		t.Fatalf("opening the redis store: %v", err)
+	}
+	ctx := context.Background()
+	key := conf("PAYMENT_EVENT_KEY_PREFIX") + "evt_1"
+
+	claim := func(want claimResult) {
+		t.Helper()
+		if got, err := store.claim(ctx, "evt_1", time.Minute); err != nil || got != want {
+			t.Fatalf("claim = %v, %v; want %v", got, err, want)
+		}
+	}
+	claim(claimed)
+	claim(claimBusy)
+	if err := store.release(ctx, "evt_1"); err != nil {
+		t.Fatal(err)
+	}
+	claim(claimed)
+	if err := store.complete(ctx, "evt_1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	claim(claimDone)
+	if got, _ := rdb.Get(key); got != eventDone || rdb.TTL(key) != time.Hour {
+		t.Errorf("%s = %q for %v, want done for PAYMENT_EVENT_TTL", key, got, rdb.TTL(key))
+	}
+	rdb.FastForward(time.Hour)
+	claim(claimed)
+
+	h, _, c := withPayments(t, store)
+	for range 2 {
+		deliverPayment(t, h, "whsec_new", testEvent("evt_2", "test.ok"))
+	}
+	if n := c.get("evt_2"); n != 1 {
+		t.Errorf("handler ran %d times with the redis store, want once", n)
+	}
+}
+
+// fakeEventsAPI serves GET /v1/events from events, newest first, two per
+// page, recording each request's query.
+func fakeEventsAPI(t *testing.T, events []string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/events" || r.Header.Get("Authorization") != "Bearer rk_test" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		start := 0
+		if after := r.URL.Query().Get("starting_after"); after != "" {
+			for i, ev := range events {
+				if strings.Contains(ev, `"`+after+`"`) {
+					start = i + 1
+				}
+			}
+		}
+		end := min(start+2, len(events))
+		fmt.Fprintf(w, `{"object": "list", "data": [ %s ], "has_more": %t}`, strings.Join(events[start:end], ","), end < len(events))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &queries
+}
+
+func TestPaymentReplay(t *testing.T) {
+	// Newest first, as the provider lists them.
+	srv, queries := fakeEventsAPI(t, []string{
+		testEvent("evt_5", "test.ok"),
+		testEvent("evt_4", "invoice.created"),
+		testEvent("evt_3", "test.ok"),
+		testEvent("evt_2", "test.ok"),
+		testEvent("evt_1", "test.ok"),
+	})
+	t.Setenv("PAYMENT_API_URL", srv.URL)
+	t.Setenv("PAYMENT_API_KEY", "rk_test")
+	h, processor, c := withPayments(t, newMemoryStore())
+	deliverPayment(t, h, "whsec_new", testEvent("evt_3", "test.ok"))
+
+	rp := newReplayer(processor)
+	since := time.Now().Add(-time.Hour)
+	if !rp.start(replayRequest{Since: since, UndeliveredOnly: true}) {
+		t.Fatal("replay refused with none running")
+	}
+	if rp.start(replayRequest{Since: since}) {
+		t.Error("second replay started while one runs")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rp.run(ctx)
+	var s *replayStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if s = rp.status(); s.State != "running" {
+			break
+		}
+	}
+
+	if s.State != "done" || s.Fetched != 5 || s.LastEvent != "evt_5" {
+		t.Fatalf("replay status = %+v, want 5 events done, evt_5 last", s)
+	}
+	want := map[string]int{eventProcessed: 3, eventDuplicate: 1, eventIgnored: 1}
+	for result, n := range want {
+		if s.Results[result] != n {
+			t.Errorf("results = %v, want %v", s.Results, want)
+			break
+		}
+	}
+	for _, id := range []string{"evt_1", "evt_2", "evt_3", "evt_5"} {
+		if n := c.get(id); n != 1 {
+			t.Errorf("%s handled %d times, want once", id, n)
+		}
+	}
+	if len(*queries) != 3 || !strings.Contains((*queries)[0], "delivery_success=false") ||
+		!strings.Contains((*queries)[0], "created%5Bgte%5D="+strconv.FormatInt(since.Unix(), 10)) ||
+		!strings.Contains((*queries)[2], "starting_after=evt_2") {
+		t.Errorf("events API queried with %q, want three pages of undelivered events since the start", *queries)
+	}
+	if !rp.start(replayRequest{Since: since}) {
+		t.Error("replay refused after the last one finished")
+	}
+}
+
+func TestPaymentReplayLimits(t *testing.T) {
+	srv, _ := fakeEventsAPI(t, []string{testEvent("evt_3", "test.ok"), testEvent("evt_2", "test.ok"), testEvent("evt_1", "test.ok")})
+	t.Setenv("PAYMENT_API_URL", srv.URL)
+	t.Setenv("PAYMENT_API_KEY", "rk_test")
+	t.Setenv("PAYMENT_REPLAY_MAX", "2")
+	_, processor, _ := withPayments(t, newMemoryStore())
+	rp := newReplayer(processor)
+
+	events, truncated, err := rp.fetch(context.Background(), replayRequest{Since: time.Now().Add(-time.Hour)})
+	if err != nil || !truncated || len(events) != 2 || events[1].ID != "evt_2" {
+		t.Errorf("fetch past PAYMENT_REPLAY_MAX = %d events, truncated %t, %v; want the newest 2, truncated", len(events), truncated, err)
+	}
+	rp.apiKey = "rk_revoked"
+	if _, _, err := rp.fetch(context.Background(), replayRequest{Since: time.Now().Add(-time.Hour)}); err == nil {
+		t.Error("fetch with a revoked key succeeded")
+	}
+}
+
+func TestPaymentReplayHandlers(t *testing.T) {
+	t.Setenv("PAYMENT_API_KEY", "rk_test")
+	_, processor, _ := withPayments(t, newMemoryStore())
+	rp := newReplayer(processor)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/replay", rp.startHandler)
+	mux.HandleFunc("GET /v1/replay", rp.statusHandler)
+
+	if w := do(mux, "GET", "/v1/replay", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status before any replay: got %d, want 404", w.Code)
+	}
+	types := `["` + strings.Repeat(`a.b", "`, replayMaxTypes) + `c.d"]`
+	for name, body := range map[string]string{
+		"no since":     `{}`,
+		"future since": `{"since": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`,
+		"too many":     `{"since": "2026-10-01T00:00:00Z", "types": ` + types + `}`,
+	} {
+		if w := do(mux, "POST", "/v1/replay", strings.NewReader(body)); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got %d, want 422", name, w.Code)
+		}
+	}
+
+	body := `{"since": "2026-10-01T00:00:00Z", "types": ["test.ok"]}`
+	w := do(mux, "POST", "/v1/replay", strings.NewReader(body))
+	var s replayStatus
+	decode(t, w, &s)
+	if w.Code != http.StatusAccepted || s.State != "running" || len(s.Types) != 1 {
+		t.Errorf("starting a replay: got %d %+v, want 202 running", w.Code, s)
+	}
+	if w := do(mux, "POST", "/v1/replay", strings.NewReader(body)); w.Code != http.StatusConflict {
+		t.Errorf("second replay: got %d, want 409", w.Code)
+	}
+	if w := do(mux, "GET", "/v1/replay", nil); w.Code != http.StatusOK {
+		t.Errorf("status of a running replay: got %d, want 200", w.Code)
+	}
+}
+
+func TestPaymentMetrics(t *testing.T) {
+	h, _, _ := withPayments(t, newMemoryStore())
+	deliverPayment(t, h, "whsec_new", testEvent("evt_1", "test.ok"))
+	deliverPayment(t, h, "whsec_new", testEvent("evt_1", "test.ok"))
+	deliverPayment(t, h, "whsec_new", testEvent("evt_2", "made.up"))
+	deliverPayment(t, h, "whsec_other", testEvent("evt_3", "test.ok"))
+
+	var out strings.Builder
+	paymentMetrics.write(&out)
+	for _, want := range []string{
+		`payment_events_total{type="test.ok",result="processed"} 1`,
+		`payment_events_total{type="test.ok",result="duplicate"} 1`,
+		`payment_events_total{type="other",result="ignored"} 1`,
+		`payment_events_total{type="other",result="invalid_signature"} 1`,
+		`payment_handler_duration_seconds_count{result="processed"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %s:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "made.up") {
+		t.Errorf("unhandled type labelled by name:\n%s", out.String())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Replaying missed events. Events the app never processed, because it
+// was down longer than the provider retries or a bug failed them until
+// the provider gave up, are still in the provider's event log (30 days
+// at Stripe). POST /v1/replay fetches them from PAYMENT_API_URL with
+// PAYMENT_API_KEY and runs them through the same processing as
+// deliveries, so those processed already are skipped as duplicates:
+//
+//	POST /v1/replay  {"since": "2026-10-01T00:00:00Z", "types": [...],
+//	                 "undelivered_only": true} starts a replay of the
+//	                 events created since then, of those types (default
+//	                 every type; those without a handler are ignored),
+//	                 and only those whose delivery failed if
+//	                 undelivered_only: 202 with its status, 409 while
+//	                 another runs
+//	GET /v1/replay   the last replay's status: its state (running, done
+//	                 or failed), events fetched, and results counted as
+//	                 payment_events_total counts them
+//
+// A replay runs in the background, one at a time, oldest event first,
+// and fetches at most PAYMENT_REPLAY_MAX events; run another from the
+// last one it reached for more. It needs a restricted API key that can
+// read events, and is only served with API_KEYS or JWT_JWKS_URL set, so
+// only operators can start one.
+
+// replayPageSize is the number of events fetched per call, the
+// provider's maximum.
+const replayPageSize = 100
+
+// replayMaxTypes is the most types a replay can filter on, the
+// provider's limit.
+const replayMaxTypes = 20
+
+// replayRequest is the body of POST /v1/replay.
+type replayRequest struct {
+	Since           time.Time `json:"since"`
+	Types           []string  `json:"types"`
+	UndeliveredOnly bool      `json:"undelivered_only"`
+}
+
+// replayStatus is a replay's progress, as GET /v1/replay answers it.
+type replayStatus struct {
+	replayRequest
+	State      string         `json:"state"`
+	Fetched    int            `json:"fetched"`
+	Results    map[string]int `json:"results"`
+	LastEvent  string         `json:"last_event,omitempty"`
+	Truncated  bool           `json:"truncated"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+type replayer struct {
+	client    *http.Client
+	apiURL    string
+	apiKey    string
+	max       int
+	processor *eventProcessor
+	requests  chan replayRequest
+
+	mu   sync.Mutex
+	last *replayStatus
+}
+
+func newReplayer(processor *eventProcessor) *replayer {
+	return &replayer{
+		client:    newUpstreamClient("payment-api"),
+		apiURL:    conf("PAYMENT_API_URL"),
+		apiKey:    conf("PAYMENT_API_KEY"),
+		max:       confInt("PAYMENT_REPLAY_MAX"),
+		processor: processor,
+		requests:  make(chan replayRequest, 1),
+	}
+}
+
+// status returns a copy of the last replay's status, or nil.
+func (rp *replayer) status() *replayStatus {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.last == nil {
+		return nil
+	}
+	s := *rp.last
+	s.Results = make(map[string]int, len(rp.last.Results))
+	for k, v := range rp.last.Results {
+		s.Results[k] = v
+	}
+	return &s
+}
+
+// update applies f to the last replay's status.
+func (rp *replayer) update(f func(*replayStatus)) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	f(rp.last)
+}
+
+// start queues req, or returns false while a replay runs.
+func (rp *replayer) start(req replayRequest) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.last != nil && rp.last.State == "running" {
+		return false
+	}
+	rp.last = &replayStatus{replayRequest: req, State: "running", Results: map[string]int{}, StartedAt: time.Now()}
+	rp.requests <- req
+	return true
+}
+
+// run replays the requested events until ctx is cancelled.
+func (rp *replayer) run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case req := <-rp.requests:
+			err := rp.replay(ctx, req)
+			now := time.Now()
+			rp.update(func(s *replayStatus) {
+				s.State, s.FinishedAt = "done", &now
+				if err != nil {
+					s.State, s.Error = "failed", err.Error()
+				}
+			})
+			s := rp.status()
+			slog.Info("payment event replay finished", "state", s.State, "fetched", s.Fetched, "results", s.Results, "error", s.Error)
+		}
+	}
+}
+
+func (rp *replayer) replay(ctx context.Context, req replayRequest) error {
+	events, truncated, err := rp.fetch(ctx, req)
+	rp.update(func(s *replayStatus) { s.Fetched, s.Truncated = len(events), truncated })
+	if err != nil {
+		return err
+	}
+	// The provider lists newest first; handlers see them in order.
+	slices.Reverse(events)
+	for _, ev := range events {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger := slog.With("event_id", ev.ID, "event_type", ev.Type, "replay", true)
+		result, err := rp.processor.process(ctx, logger, ev)
+		if err != nil {
+			logger.Error("replayed payment event failed", "error", err)
+		}
+		rp.update(func(s *replayStatus) {
+			s.Results[result]++
+			s.LastEvent = ev.ID
+		})
+	}
+	return nil
+}
+
+// fetch lists the events req asks for, up to rp.max, newest first.
+func (rp *replayer) fetch(ctx context.Context, req replayRequest) ([]*paymentEvent, bool, error) {
+	query := url.Values{
+		"limit":        {strconv.Itoa(replayPageSize)},
+		"created[gte]": {strconv.FormatInt(req.Since.Unix(), 10)},
+		"types[]":      req.Types,
+	}
+	if req.UndeliveredOnly {
+		query.Set("delivery_success", "false")
+	}
+	var events []*paymentEvent
+	for {
+		var page struct {
+			Data    []json.RawMessage `json:"data"`
+			HasMore bool              `json:"has_more"`
+		}
+		if err := rp.get(ctx, "/v1/events?"+query.Encode(), &page); err != nil {
+			return events, false, err
+		}
+		for _, raw := range page.Data {
+			ev, err := parseEvent(raw)
+			if err != nil {
+				return events, false, fmt.Errorf("listing events: %w", err)
+			}
+			if len(events) == rp.max {
+				return events, true, nil
+			}
+			events = append(events, ev)
+		}
+		if !page.HasMore || len(page.Data) == 0 {
+			return events, false, nil
+		}
+		query.Set("starting_after", events[len(events)-1].ID)
+	}
+}
+
+func (rp *replayer) get(ctx context.Context, path string, v any) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, rp.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+rp.apiKey)
+	resp, err := rp.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("listing events: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing events: %s answered %s", rp.apiURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (rp *replayer) startHandler(w http.ResponseWriter, r *http.Request) {
+	var req replayRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	switch {
+	case req.Since.IsZero() || req.Since.After(time.Now()):
+		writeError(w, r, http.StatusUnprocessableEntity, `"since" must be a past RFC 3339 time`)
+		return
+	case len(req.Types) > replayMaxTypes:
+		writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf(`"types" takes at most %d types`, replayMaxTypes))
+		return
+	}
+	if !rp.start(req) {
+		writeError(w, r, http.StatusConflict, "a replay is running")
+		return
+	}
+	requestLogger(r).Info("payment event replay started", "since", req.Since, "types", req.Types, "undelivered_only", req.UndeliveredOnly)
+	writeJSON(w, http.StatusAccepted, rp.status())
+}
+
+func (rp *replayer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	s := rp.status()
+	if s == nil {
+		writeError(w, r, http.StatusNotFound, "no replay has run")
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature verification, as Stripe signs its webhooks. The signature
+// header, PAYMENT_SIGNATURE_HEADER (default Stripe-Signature), is
+// comma-separated key=value pairs:
+//
+//	t=1760400000,v1=5257a869...,v1=9c1f3e0b...
+//
+// t is when the provider signed the event, in Unix seconds, and each v1
+// is the hex HMAC-SHA256 of "<t>.<body>" under one of the endpoint's
+// signing secrets; the provider sends one for each secret it is rolling
+// between. The event is accepted when any v1 matches any of
+// PAYMENT_WEBHOOK_SECRETS and t is within PAYMENT_SIGNATURE_TOLERANCE of
+// now, so a captured event cannot be replayed later.
+//
+// To roll the secret, add the new one to PAYMENT_WEBHOOK_SECRETS, roll it
+// at the provider, then remove the old one once the provider has stopped
+// signing with it. The setting is secret and reloadable, so with
+// PAYMENT_WEBHOOK_SECRETS_FILE mounted from a Kubernetes Secret it changes
+// without a restart.
+
+var (
+	errNoSignature  = errors.New("no signature")
+	errBadSignature = errors.New("signature does not match")
+	errStaleEvent   = errors.New("signature timestamp outside the tolerance")
+)
+
+// parsePaymentSecrets parses PAYMENT_WEBHOOK_SECRETS, secrets separated
+// by commas or newlines.
+func parsePaymentSecrets(raw string) [][]byte {
+	var secrets [][]byte
+	for _, s := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if s = strings.TrimSpace(s); s != "" && !strings.HasPrefix(s, "#") {
+			secrets = append(secrets, []byte(s))
+		}
+	}
+	return secrets
+}
+
+func checkPaymentSecrets(v string) error {
+	if len(parsePaymentSecrets(v)) == 0 {
+		return errors.New("want at least one signing secret")
+	}
+	return nil
+}
+
+// paymentSecrets holds the signing secrets, swapped by reload.
+type paymentSecrets struct {
+	mu      sync.RWMutex
+	secrets [][]byte
+}
+
+func newPaymentSecrets() *paymentSecrets {
+	s := &paymentSecrets{secrets: parsePaymentSecrets(conf("PAYMENT_WEBHOOK_SECRETS"))}
+	onConfigReload(s.reload)
+	return s
+}
+
+// reload applies a new PAYMENT_WEBHOOK_SECRETS. An empty one keeps the
+// current secrets until restart.
+func (s *paymentSecrets) reload() {
+	secrets := parsePaymentSecrets(conf("PAYMENT_WEBHOOK_SECRETS"))
+	if len(secrets) == 0 {
+		slog.Warn("PAYMENT_WEBHOOK_SECRETS empty after reload, keeping the current secrets")
+		return
+	}
+	s.mu.Lock()
+	s.secrets = secrets
+	s.mu.Unlock()
+	slog.Info("payment webhook secrets reloaded", "secrets", len(secrets))
+}
+
+func (s *paymentSecrets) current() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secrets
+}
+
+// verifyPaymentSignature checks header, a Stripe-Signature value,
+// against body. Every signature is tried under every secret, in constant
+// time, so timing reveals neither a signature nor which secret matched.
+func verifyPaymentSignature(secrets [][]byte, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp string
+	var signatures [][]byte
+	for pair := range strings.SplitSeq(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil && len(sig) == sha256.Size {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errNoSignature
+	}
+
+	valid := false
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		want := mac.Sum(nil)
+		for _, sig := range signatures {
+			if hmac.Equal(want, sig) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return errBadSignature
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)); age > tolerance || age < -tolerance {
+		return errStaleEvent
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The idempotency store: which events have been processed, so each is
+// processed once however often the provider delivers it. The provider
+// retries every event it gets no 2xx for, for days, and replays send old
+// ones again; the store turns those repeats into no-ops.
+//
+// Processing an event claims its ID first, for PAYMENT_PROCESSING_LEASE.
+// A second delivery while the claim stands is answered 409, and the
+// provider retries it later. Success marks the ID done, for
+// PAYMENT_EVENT_TTL; failure releases it, so the provider's retry runs the
+// handler again. A replica that dies mid-event leaves a claim that
+// expires with its lease.
+//
+// Two backends come with the template, picked by PAYMENT_EVENT_STORE:
+//
+//	memory  a map in the replica; run one replica, or the replicas could
+//	        each process the same event once
+//	redis   Redis (store_redis.go), shared by every replica
+//
+// Another backend implements eventStore in its own file. One in the
+// app's own database can mark the event done in the same transaction as
+// the handler's writes, for exactly-once even across a crash between the
+// two.
+
+// claimResult is what claiming an event ID found.
+type claimResult int
+
+const (
+	// claimed: the event is this caller's to process.
+	claimed claimResult = iota
+	// claimDone: the event was processed already.
+	claimDone
+	// claimBusy: another delivery of the event is being processed.
+	claimBusy
+)
+
+type eventStore interface {
+	claim(ctx context.Context, id string, lease time.Duration) (claimResult, error)
+	complete(ctx context.Context, id string, ttl time.Duration) error
+	release(ctx context.Context, id string) error
+}
+
+// openEventStore opens the PAYMENT_EVENT_STORE backend.
+func openEventStore(backend string) (eventStore, error) {
+	switch backend {
+	case "memory":
+		store := newMemoryStore()
+		registerBackground("event store sweeper", store.sweep)
+		return store, nil
+	case "redis":
+		return openRedisStore()
+	}
+	return nil, fmt.Errorf("unknown event store %q", backend)
+}
+
+// memorySweepInterval is how often expired event IDs leave memory.
+const memorySweepInterval = time.Minute
+
+type memoryStore struct {
+	mu     sync.Mutex
+	events map[string]memoryEvent
+}
+
+type memoryEvent struct {
+	done    bool
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{events: map[string]memoryEvent{}}
+}
+
+func (m *memoryStore) claim(_ context.Context, id string, lease time.Duration) (claimResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if e, ok := m.events[id]; ok && now.Before(e.expires) {
+		if e.done {
+			return claimDone, nil
+		}
+		return claimBusy, nil
+	}
+	m.events[id] = memoryEvent{expires: now.Add(lease)}
+	return claimed, nil
+}
+
+func (m *memoryStore) complete(_ context.Context, id string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[id] = memoryEvent{done: true, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryStore) release(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.events, id)
+	return nil
+}
+
+// sweep drops expired IDs until ctx is done.
+func (m *memoryStore) sweep(ctx context.Context) error {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for id, e := range m.events {
+				if !now.Before(e.expires) {
+					delete(m.events, id)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The Redis idempotency store. Each event is one key,
+// PAYMENT_EVENT_KEY_PREFIX and the event ID, holding "processing" for the
+// lease of a claim and "done" for PAYMENT_EVENT_TTL after. A claim is a
+// SET NX, so of two replicas handed the same event at once only one gets
+// it.
+//
+// Redis is on /readyz: without it no event can be told from a repeat, so
+// a replica that cannot reach it takes no traffic, and the provider
+// retries the events it misses.
+
+// redisConnectTimeout bounds the first ping at startup.
+const redisConnectTimeout = 5 * time.Second
+
+const (
+	eventProcessing = "processing"
+	eventDone       = "done"
+)
+
+type redisStore struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+func openRedisStore() (*redisStore, error) {
+	if conf("REDIS_URL") == "" {
+		return nil, errors.New("PAYMENT_EVENT_STORE=redis needs REDIS_URL")
+	}
+	opts, err := redis.ParseURL(conf("REDIS_URL"))
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL: %w", err)
+	}
+	opts.PoolSize = confInt("REDIS_POOL_SIZE")
+	opts.ContextTimeoutEnabled = true
+	redis.SetLogger(redisLogger{})
+	client := redis.NewClient(opts)
+
+	// An unreachable Redis is not fatal at startup: /readyz reports it
+	// until it comes up.
+	ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		slog.Warn("redis not reachable at startup", "error", err)
+	}
+	readinessChecks.register("redis", checkFunc(func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}), 0)
+
+	return &redisStore{client: client, prefix: conf("PAYMENT_EVENT_KEY_PREFIX"), timeout: confDuration("REDIS_TIMEOUT")}, nil
+}
+
+func (s *redisStore) claim(ctx context.Context, id string, lease time.Duration) (claimResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	ok, err := s.client.SetNX(ctx, s.prefix+id, eventProcessing, lease).Result()
+	if err != nil || ok {
+		return claimed, err
+	}
+	state, err := s.client.Get(ctx, s.prefix+id).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		// The other claim expired in between; the provider's retry
+		// claims it.
+		return claimBusy, nil
+	case err != nil:
+		return claimBusy, err
+	case state == eventDone:
+		return claimDone, nil
+	}
+	return claimBusy, nil
+}
+
+func (s *redisStore) complete(ctx context.Context, id string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+id, eventDone, ttl).Err()
+}
+
+func (s *redisStore) release(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Del(ctx, s.prefix+id).Err()
+}
+
+// redisLogger sends go-redis's internal messages, such as pool dial
+// failures, to the structured log instead of the standard logger.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.WarnContext(ctx, fmt.Sprintf(format, v...), "component", "go-redis")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+)
+
+// The app: a JSON CRUD API for items backed by Postgres, next to the
+// landing page. db.go opens the connection pool, migrate.go applies the
+// embedded migrations at startup and items.go serves the resource:
+//
+//	GET    /items          list, ?limit= (default 50, max 200) and ?offset=
+//	POST   /items          create from {"name": ..., "description": ...}
+//	GET    /items/{id}     fetch one
+//	PUT    /items/{id}     replace name and description
+//	DELETE /items/{id}     delete
+//	GET    /openapi.json   the API's OpenAPI document (openapi.go)
+//
+//	DATABASE_URL           postgres:// URL or key=value connection string
+//	DB_MAX_OPEN_CONNS      pool size per replica (default 10)
+//	DB_MAX_IDLE_CONNS      connections kept open when idle (default 5)
+//	DB_CONN_MAX_LIFETIME   connections are recycled after this long, so
+//	                       failovers and PgBouncer restarts are picked up
+//	                       (default 30m)
+//	DB_CONN_MAX_IDLE_TIME  idle connections are closed after this long
+//	                       (default 5m)
+//	DB_QUERY_TIMEOUT       deadline for each request's queries (default 5s)
+//	DB_MIGRATE             "false" skips migrations at startup, for
+//	                       deployments that run them separately
+//
+// The pool sizes are reloadable, and the pool is on /readyz (checkDB).
+
+var appSettings = slices.Concat(landingSettings, openAPISettings, []setting{
+	{name: "DATABASE_URL", required: true, secret: true},
+	{name: "DB_MAX_OPEN_CONNS", kind: kindInt, def: "10", check: atLeast(1), reloadable: true},
+	{name: "DB_MAX_IDLE_CONNS", kind: kindInt, def: "5", check: atLeast(0), reloadable: true},
+	{name: "DB_CONN_MAX_LIFETIME", kind: kindDuration, def: "30m", reloadable: true},
+	{name: "DB_CONN_MAX_IDLE_TIME", kind: kindDuration, def: "5m", reloadable: true},
+	{name: "DB_QUERY_TIMEOUT", kind: kindDuration, def: "5s"},
+	{name: "DB_MIGRATE", kind: kindBool, def: "true"},
+})
+
+// db is the connection pool, opened by setupApp.
+var db *sql.DB
+
+func setupApp(mux *http.ServeMux) error {
+	var err error
+	if db, err = openDB(conf("DATABASE_URL")); err != nil {
+		return err
+	}
+
+	readinessChecks.register("postgres", checkDB(db), 0)
+	if confBool("DB_MIGRATE") {
+		registerStartupTask("migrations", func(ctx context.Context) error {
+			return migrate(ctx, db)
+		})
+	}
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	registerItemRoutes(mux)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres through database/sql with the pgx driver. database/sql owns the
+// pool; the DB_* settings size it, and take effect on a config reload
+// without a restart. Only a malformed DATABASE_URL or pool size fails
+// setup: opening does not connect, so a database that is down at boot
+// shows up as a failing migrations startup task and /readyz check rather
+// than a crash loop. The pool is closed at shutdown, once the server has
+// drained, so Postgres sees the connections end rather than time out.
+//
+// Pool metrics, served on /metrics:
+//
+//	db_connections                    gauge   state (in_use, idle)
+//	db_connections_max                gauge
+//	db_connection_waits_total         counter
+//	db_connection_wait_seconds_total  counter
+//	db_connections_closed_total       counter reason (max_idle,
+//	                                          max_idle_time, max_lifetime)
+
+// openDB opens the pool and registers its metrics and shutdown.
+func openDB(dsn string) (*sql.DB, error) {
+	if confInt("DB_MAX_IDLE_CONNS") > confInt("DB_MAX_OPEN_CONNS") {
+		return nil, errors.New("DB_MAX_IDLE_CONNS must not exceed DB_MAX_OPEN_CONNS")
+	}
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	pool := stdlib.OpenDB(*cfg)
+	sizePool := func() {
+		// database/sql lowers the idle limit to the open one itself.
+		pool.SetMaxOpenConns(confInt("DB_MAX_OPEN_CONNS"))
+		pool.SetMaxIdleConns(confInt("DB_MAX_IDLE_CONNS"))
+		pool.SetConnMaxLifetime(confDuration("DB_CONN_MAX_LIFETIME"))
+		pool.SetConnMaxIdleTime(confDuration("DB_CONN_MAX_IDLE_TIME"))
+	}
+	sizePool()
+	onConfigReload(sizePool)
+	registerMetrics(func(out io.Writer) { writeDBMetrics(out, pool) })
+	onShutdown("postgres", func(context.Context) error { return pool.Close() })
+	return pool, nil
+}
+
+// checkDB is the pool's readiness check: a ping, unless every connection
+// is in use. The ping would then wait behind the queries for one and time
+// out, and replicas that are only busy would leave the Service together,
+// moving their load onto the rest. A full pool has reached the database;
+// if it stops doing so, the queries fail on their deadlines, free their
+// connections and the next probe pings.
+func checkDB(pool *sql.DB) checker {
+	return checkFunc(func(ctx context.Context) error {
+		if s := pool.Stats(); s.MaxOpenConnections > 0 && s.InUse >= s.MaxOpenConnections {
+			return nil
+		}
+		return pool.PingContext(ctx)
+	})
+}
+
+func writeDBMetrics(out io.Writer, pool *sql.DB) {
+	s := pool.Stats()
+
+	fmt.Fprintln(out, "# HELP db_connections Open database connections by state.")
+	fmt.Fprintln(out, "# TYPE db_connections gauge")
+	fmt.Fprintf(out, "db_connections{state=\"in_use\"} %d\n", s.InUse)
+	fmt.Fprintf(out, "db_connections{state=\"idle\"} %d\n", s.Idle)
+
+	fmt.Fprintln(out, "# HELP db_connections_max Maximum open database connections (DB_MAX_OPEN_CONNS).")
+	fmt.Fprintln(out, "# TYPE db_connections_max gauge")
+	fmt.Fprintf(out, "db_connections_max %d\n", s.MaxOpenConnections)
+
+	fmt.Fprintln(out, "# HELP db_connection_waits_total Times a query waited for a free connection.")
+	fmt.Fprintln(out, "# TYPE db_connection_waits_total counter")
+	fmt.Fprintf(out, "db_connection_waits_total %d\n", s.WaitCount)
+
+	fmt.Fprintln(out, "# HELP db_connection_wait_seconds_total Total time spent waiting for a free connection.")
+	fmt.Fprintln(out, "# TYPE db_connection_wait_seconds_total counter")
+	fmt.Fprintf(out, "db_connection_wait_seconds_total %s\n", formatFloat(s.WaitDuration.Seconds()))
+
+	fmt.Fprintln(out, "# HELP db_connections_closed_total Connections closed by the pool, by reason.")
+	fmt.Fprintln(out, "# TYPE db_connections_closed_total counter")
+	fmt.Fprintf(out, "db_connections_closed_total{reason=\"max_idle\"} %d\n", s.MaxIdleClosed)
+	fmt.Fprintf(out, "db_connections_closed_total{reason=\"max_idle_time\"} %d\n", s.MaxIdleTimeClosed)
+	fmt.Fprintf(out, "db_connections_closed_total{reason=\"max_lifetime\"} %d\n", s.MaxLifetimeClosed)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The example resource: items with a name and a description. Handlers run
+// their queries under DB_QUERY_TIMEOUT, and a database failure is logged
+// and returned as a 500 without its details. Replace it with your own
+// resources, adding a migration for each schema change.
+
+const (
+	defaultListLimit     = 50
+	maxListLimit         = 200
+	maxNameLength        = 200
+	maxDescriptionLength = 2000
+)
+
+type item struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// itemInput is the body of POST /items and PUT /items/{id}.
+type itemInput struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// itemSchema is the contract of itemInput, checked by handleAPI before the
+// handlers run: a body that breaks it is answered 400 with its violations.
+var itemSchema = fmt.Sprintf(`{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": %d},
+		"description": {"type": "string", "maxLength": %d}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`, maxNameLength, maxDescriptionLength)
+
+// validate trims the name and checks what the schema cannot: that it is
+// not only whitespace.
+func (in *itemInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return errors.New("name must not be blank")
+	}
+	return nil
+}
+
+const itemColumns = "id, name, description, created_at, updated_at"
+
+func scanItem(row interface{ Scan(...any) error }) (item, error) {
+	var it item
+	err := row.Scan(&it.ID, &it.Name, &it.Description, &it.CreatedAt, &it.UpdatedAt)
+	return it, err
+}
+
+func registerItemRoutes(mux *http.ServeMux) {
+	id := []apiParam{{Name: "id", Type: "integer"}}
+	dbErrors := []int{http.StatusInternalServerError, http.StatusGatewayTimeout}
+	handleAPI(mux, "GET /items", apiDoc{
+		Summary: "List items",
+		Params: []apiParam{
+			{Name: "limit", Type: "integer", Description: "page size, 1 to " + strconv.Itoa(maxListLimit) + " (default " + strconv.Itoa(defaultListLimit) + ")"},
+			{Name: "offset", Type: "integer", Description: "items to skip"},
+		},
+		Response: []item{},
+		Errors:   append([]int{http.StatusBadRequest}, dbErrors...),
+	}, listItems)
+	handleAPI(mux, "POST /items", apiDoc{
+		Summary:  "Create an item",
+		Request:  itemInput{},
+		Schema:   itemSchema,
+		Response: item{},
+		Status:   http.StatusCreated,
+		Errors:   append([]int{http.StatusUnprocessableEntity}, dbErrors...),
+	}, createItem)
+	mux.HandleFunc("/items", methodNotAllowed("GET, HEAD, POST"))
+	handleAPI(mux, "GET /items/{id}", apiDoc{
+		Summary:  "Fetch an item",
+		Params:   id,
+		Response: item{},
+		Errors:   append([]int{http.StatusNotFound}, dbErrors...),
+	}, getItem)
+	handleAPI(mux, "PUT /items/{id}", apiDoc{
+		Summary:  "Replace an item's name and description",
+		Params:   id,
+		Request:  itemInput{},
+		Schema:   itemSchema,
+		Response: item{},
+		Errors:   append([]int{http.StatusNotFound, http.StatusUnprocessableEntity}, dbErrors...),
+	}, updateItem)
+	handleAPI(mux, "DELETE /items/{id}", apiDoc{
+		Summary: "Delete an item",
+		Params:  id,
+		Status:  http.StatusNoContent,
+		Errors:  append([]int{http.StatusNotFound}, dbErrors...),
+	}, deleteItem)
+	mux.HandleFunc("/items/{id}", methodNotAllowed("GET, HEAD, PUT, DELETE"))
+	registerOpenAPI(mux)
+}
+
+// queryContext bounds a request's queries by DB_QUERY_TIMEOUT.
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), confDuration("DB_QUERY_TIMEOUT"))
+}
+
+// dbError answers a failed query: 404 for a missing row, 504 when the
+// query timed out and 500 otherwise.
+func dbError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, r, http.StatusNotFound, "item not found")
+	case errors.Is(err, context.DeadlineExceeded):
+		requestLogger(r).Error("database query timed out", "error", err)
+		writeError(w, r, http.StatusGatewayTimeout, "database query timed out")
+	case r.Context().Err() != nil:
+		// The client went away; nobody reads the response.
+	default:
+		requestLogger(r).Error("database query failed", "error", err)
+		reportError(r, err)
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+	}
+}
+
+func listItems(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryInt(w, r, "limit", defaultListLimit, 1, maxListLimit)
+	if !ok {
+		return
+	}
+	offset, ok := queryInt(w, r, "offset", 0, 0, math.MaxInt)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+itemColumns+" FROM items ORDER BY id LIMIT $1 OFFSET $2", limit, offset)
+	if err != nil {
+		dbError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	items := []item{}
+	for rows.Next() {
+		it, err := scanItem(rows)
+		if err != nil {
+			dbError(w, r, err)
+			return
+		}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func createItem(w http.ResponseWriter, r *http.Request) {
+	var in itemInput
+	if err := readJSON(w, r, &in); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	it, err := scanItem(db.QueryRowContext(ctx,
+		"INSERT INTO items (name, description) VALUES ($1, $2) RETURNING "+itemColumns,
+		in.Name, in.Description))
+	if err != nil {
+		dbError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/items/"+strconv.FormatInt(it.ID, 10))
+	writeJSON(w, http.StatusCreated, it)
+}
+
+func getItem(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id", "item")
+	if !ok {
+		return
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	it, err := scanItem(db.QueryRowContext(ctx,
+		"SELECT "+itemColumns+" FROM items WHERE id = $1", id))
+	if err != nil {
+		dbError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, it)
+}
+
+func updateItem(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id", "item")
+	if !ok {
+		return
+	}
+	var in itemInput
+	if err := readJSON(w, r, &in); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	it, err := scanItem(db.QueryRowContext(ctx,
+		"UPDATE items SET name = $1, description = $2, updated_at = now() WHERE id = $3 RETURNING "+itemColumns,
+		in.Name, in.Description, id))
+	if err != nil {
+		dbError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, it)
+}
+
+func deleteItem(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id", "item")
+	if !ok {
+		return
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	res, err := db.ExecContext(ctx, "DELETE FROM items WHERE id = $1", id)
+	if err != nil {
+		dbError(w, r, err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		dbError(w, r, sql.ErrNoRows)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
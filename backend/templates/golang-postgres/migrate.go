@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Schema migrations, embedded in the binary so the schema always matches
+// the code that ships with it. Each file in migrations/ is one version,
+// named NNNN_description.sql and applied in name order inside its own
+// transaction; applied versions are recorded in schema_migrations. Never
+// edit a migration that has been deployed: add a new one.
+//
+// Every replica runs migrate at startup. A Postgres advisory lock makes
+// them take turns, so exactly one applies each pending version and the
+// others find nothing left to do.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key, the same in every replica.
+const migrationLockID = 7_204_311_806
+
+// migrationConnectTimeout bounds the wait for the database at startup.
+// Migrations run before /startupz passes, so the startup probe's own
+// threshold still applies.
+const migrationConnectTimeout = 2 * time.Minute
+
+// migrate applies every pending migration.
+func migrate(ctx context.Context, db *sql.DB) error {
+	conn, err := waitForDB(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1::bigint)", migrationLockID); err != nil {
+		return fmt.Errorf("taking the migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1::bigint)", migrationLockID)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    text PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	applied := map[string]bool{}
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		if applied[version] {
+			continue
+		}
+		body, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := applyMigration(ctx, conn, version, string(body)); err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		slog.Info("migration applied", "version", version, "duration", time.Since(start).String())
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, version, body string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// waitForDB returns a connection once the database accepts one, retrying
+// for up to migrationConnectTimeout so a pod starting alongside its
+// database does not fail straight away.
+func waitForDB(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, migrationConnectTimeout)
+	defer cancel()
+	for delay := 500 * time.Millisecond; ; delay = min(delay*2, 10*time.Second) {
+		conn, err := db.Conn(ctx)
+		if err == nil {
+			if err = conn.PingContext(ctx); err == nil {
+				return conn, nil
+			}
+			conn.Close()
+		}
+		slog.Warn("database not reachable, retrying", "error", err, "retry_in", delay.String())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("database not reachable: %w", err)
+		}
+	}
+}
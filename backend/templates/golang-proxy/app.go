@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// The app: a reverse proxy in front of existing backends, routing path
+// prefixes to upstream URLs. proxy.go builds one httputil.ReverseProxy
+// per route; the platform middleware (request IDs, access log, CORS, rate
+// limiting, authentication, metrics, tracing) applies to every proxied
+// request as to any other.
+//
+//	PROXY_ROUTES   the route table, a JSON array; default [% PROXY_ROUTES %]
+//	PROXY_TIMEOUT  default wait for an upstream's response headers (30s)
+//
+// A route:
+//
+//	{
+//	  "prefix": "/api/",                        path subtree, ending in /
+//	  "upstream": "http://api.backend:8080",    base URL to send it to
+//	  "strip_prefix": true,                     send /api/items as /items
+//	  "preserve_host": false,                   keep the client's Host
+//	  "timeout": "5s",                          overrides PROXY_TIMEOUT
+//	  "set_headers": {"X-Gateway": "edge"},     added to the request
+//	  "remove_headers": ["Cookie"],             removed from the request
+//	  "response_headers": {"X-Frame-Options": "DENY"}
+//	}
+//
+// The longest matching prefix wins. Upstreams see X-Forwarded-For,
+// X-Forwarded-Host and X-Forwarded-Proto, X-Forwarded-Prefix for stripped
+// routes, and the request ID and trace context. Unreachable upstreams get
+// a JSON 502, slow ones a 504. The platform's own paths (/healthz,
+// /metrics, /api/info, ...) are served by the proxy itself and never
+// forwarded. A route on "/" replaces the landing page.
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "PROXY_ROUTES", def: `[% PROXY_ROUTES %]`, check: checkProxyRoutes},
+	{name: "PROXY_TIMEOUT", kind: kindDuration, def: "30s"},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	routes, err := parseProxyRoutes(conf("PROXY_ROUTES"), confDuration("PROXY_TIMEOUT"))
+	if err != nil {
+		return fmt.Errorf("PROXY_ROUTES: %w", err)
+	}
+	root := false
+	for _, rt := range routes {
+		mux.Handle(rt.Prefix, rt.handler())
+		// The route's timeout bounds the wait for the upstream's headers;
+		// the body streams for as long as it takes.
+		setRouteTimeout(rt.Prefix, 0)
+		root = root || rt.Prefix == "/"
+		slog.Info("proxy route", "prefix", rt.Prefix, "upstream", rt.target.Redacted(), "timeout", rt.timeout.String())
+	}
+	if !root {
+		loadLandingPage()
+		mux.HandleFunc("/", rootHandler)
+	}
+	return nil
+}
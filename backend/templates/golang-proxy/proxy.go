@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyRoute is one entry of PROXY_ROUTES.
+type proxyRoute struct {
+	// Prefix is the path subtree served by the route, ending in "/".
+	// Requests go to the route with the longest matching prefix.
+	Prefix string `json:"prefix"`
+	// Upstream is the base URL requests are sent to; its path, if any,
+	// is prepended to the request path.
+	Upstream string `json:"upstream"`
+	// StripPrefix removes Prefix from the path before it is sent, so
+	// /api/items reaches the upstream as /items.
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	// PreserveHost sends the client's Host header instead of the
+	// upstream's.
+	PreserveHost bool `json:"preserve_host,omitempty"`
+	// Timeout bounds the wait for the upstream's response headers, as a
+	// Go duration; default PROXY_TIMEOUT. Streamed bodies are not cut off.
+	Timeout string `json:"timeout,omitempty"`
+	// SetHeaders and RemoveHeaders rewrite the request headers sent
+	// upstream; ResponseHeaders are set on the response to the client.
+	SetHeaders      map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders   []string          `json:"remove_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+
+	target  *url.URL
+	timeout time.Duration
+}
+
+// parseProxyRoutes reads PROXY_ROUTES, a JSON array of routes.
+func parseProxyRoutes(v string, defaultTimeout time.Duration) ([]*proxyRoute, error) {
+	var routes []*proxyRoute
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&routes); err != nil {
+		return nil, fmt.Errorf("not a JSON array of routes: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, rt := range routes {
+		if rt == nil {
+			return nil, fmt.Errorf("route %d is null", i)
+		}
+		if !strings.HasPrefix(rt.Prefix, "/") || !strings.HasSuffix(rt.Prefix, "/") {
+			return nil, fmt.Errorf("route %d: prefix %q must start and end with /", i, rt.Prefix)
+		}
+		if seen[rt.Prefix] {
+			return nil, fmt.Errorf("route %d: prefix %s is already routed", i, rt.Prefix)
+		}
+		seen[rt.Prefix] = true
+		u, err := url.Parse(rt.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("route %s: upstream %q must be an http or https URL", rt.Prefix, rt.Upstream)
+		}
+		rt.target = u
+		rt.timeout = defaultTimeout
+		if rt.Timeout != "" {
+			if rt.timeout, err = time.ParseDuration(rt.Timeout); err != nil || rt.timeout <= 0 {
+				return nil, fmt.Errorf("route %s: timeout %q must be a positive Go duration such as 5s", rt.Prefix, rt.Timeout)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// checkProxyRoutes validates PROXY_ROUTES at startup.
+func checkProxyRoutes(v string) error {
+	_, err := parseProxyRoutes(v, time.Second)
+	return err
+}
+
+// handler returns the reverse proxy for the route.
+func (rt *proxyRoute) handler() http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite:        rt.rewrite,
+		Transport:      &propagatingTransport{base: newProxyTransport(rt.timeout)},
+		ModifyResponse: rt.modifyResponse,
+		ErrorHandler:   rt.proxyError,
+	}
+}
+
+func (rt *proxyRoute) rewrite(pr *httputil.ProxyRequest) {
+	if rt.StripPrefix {
+		pr.Out.URL.Path = "/" + strings.TrimPrefix(pr.In.URL.Path, rt.Prefix)
+		pr.Out.URL.RawPath = ""
+	}
+	pr.SetURL(rt.target)
+	pr.SetXForwarded()
+	if rt.PreserveHost {
+		pr.Out.Host = pr.In.Host
+	}
+	if rt.StripPrefix {
+		pr.Out.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(rt.Prefix, "/"))
+	}
+	for _, h := range rt.RemoveHeaders {
+		pr.Out.Header.Del(h)
+	}
+	for h, v := range rt.SetHeaders {
+		pr.Out.Header.Set(h, v)
+	}
+}
+
+func (rt *proxyRoute) modifyResponse(resp *http.Response) error {
+	for h, v := range rt.ResponseHeaders {
+		resp.Header.Set(h, v)
+	}
+	return nil
+}
+
+// proxyError answers a failed upstream call: 504 when the upstream did
+// not answer within the route's timeout, 502 otherwise.
+func (rt *proxyRoute) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		// The client went away; nobody reads the response.
+		return
+	}
+	status, message := http.StatusBadGateway, "upstream unavailable"
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status, message = http.StatusGatewayTimeout, "upstream timed out"
+	}
+	requestLogger(r).Warn("proxy request failed", "route", rt.Prefix, "upstream", rt.target.Redacted(), "error", err)
+	writeError(w, r, status, message)
+}
+
+// newProxyTransport returns a transport for one route, with its own pool
+// of idle upstream connections. A proxy reuses connections to few hosts
+// heavily, so it keeps more of them idle than http.DefaultTransport's two.
+func newProxyTransport(timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
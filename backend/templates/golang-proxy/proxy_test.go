@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// seen is what the echo upstream received.
+type seen struct {
+	Name    string      `json:"name"`
+	Path    string      `json:"path"`
+	Host    string      `json:"host"`
+	Headers http.Header `json:"headers"`
+}
+
+// echoUpstream answers every request with what it received.
+func echoUpstream(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(seen{Name: name, Path: r.URL.RequestURI(), Host: r.Host, Headers: r.Header})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newProxy serves routes, a PROXY_ROUTES value, the way main does.
+func newProxy(t *testing.T, routes string) http.Handler {
+	t.Helper()
+	t.Setenv("PROXY_ROUTES", routes)
+	mux := http.NewServeMux()
+	if err := setupApp(mux); err != nil {
+		t.Fatalf("setupApp: %v", err)
+	}
+	return requestIDMiddleware(mux)
+}
+
+func proxied(t *testing.T, w *httptest.ResponseRecorder) seen {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("proxied request = %d %s, want 200", w.Code, w.Body)
+	}
+	var s seen
+	decode(t, w, &s)
+	return s
+}
+
+func TestProxyRoutes(t *testing.T) {
+	api, users := echoUpstream(t, "api"), echoUpstream(t, "users")
+	h := newProxy(t, `[
+		{"prefix": "/api/", "upstream": "`+api.URL+`/v1", "strip_prefix": true,
+		 "set_headers": {"X-Gateway": "edge"}, "remove_headers": ["Cookie"],
+		 "response_headers": {"X-Frame-Options": "DENY"}},
+		{"prefix": "/api/users/", "upstream": "`+users.URL+`", "preserve_host": true}
+	]`)
+
+	w := do(h, "GET", "/api/items?page=2", nil, "Cookie", "session=secret", "X-Request-ID", "req-1")
+	s := proxied(t, w)
+	if s.Name != "api" || s.Path != "/v1/items?page=2" || s.Host != strings.TrimPrefix(api.URL, "http://") {
+		t.Errorf("GET /api/items reached %s %s (Host %s), want api /v1/items?page=2 with the upstream's Host", s.Name, s.Path, s.Host)
+	}
+	if s.Headers.Get("X-Gateway") != "edge" || s.Headers.Get("Cookie") != "" || s.Headers.Get("X-Forwarded-Prefix") != "/api" {
+		t.Errorf("upstream headers %v, want X-Gateway set, Cookie removed and X-Forwarded-Prefix /api", s.Headers)
+	}
+	if s.Headers.Get("X-Request-Id") != "req-1" || s.Headers.Get("X-Forwarded-For") == "" {
+		t.Errorf("upstream headers %v, want the request ID and X-Forwarded-For", s.Headers)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("response headers %v, want X-Frame-Options from the route", w.Header())
+	}
+
+	// The longer prefix wins; without strip_prefix the path is kept.
+	s = proxied(t, do(h, "POST", "/api/users/42", nil))
+	if s.Name != "users" || s.Path != "/api/users/42" || s.Host != "example.com" {
+		t.Errorf("POST /api/users/42 reached %s %s (Host %s), want users /api/users/42 with the client's Host", s.Name, s.Path, s.Host)
+	}
+
+	if w := do(h, "GET", "/", nil); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("GET / = %d, want the landing page", w.Code)
+	}
+}
+
+func TestProxyRootRoute(t *testing.T) {
+	app := echoUpstream(t, "app")
+	h := newProxy(t, `[{"prefix": "/", "upstream": "`+app.URL+`"}]`)
+	if s := proxied(t, do(h, "GET", "/", nil)); s.Name != "app" {
+		t.Errorf("GET / reached %s, want the upstream instead of the landing page", s.Name)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	slow := echoUpstream(t, "slow")
+	h := newProxy(t, `[
+		{"prefix": "/down/", "upstream": "`+down.URL+`"},
+		{"prefix": "/slow/", "upstream": "`+slow.URL+`", "strip_prefix": true, "timeout": "50ms"}
+	]`)
+
+	for path, want := range map[string]int{"/down/x": http.StatusBadGateway, "/slow/slow": http.StatusGatewayTimeout} {
+		w := do(h, "GET", path, nil)
+		var resp map[string]string
+		decode(t, w, &resp)
+		if w.Code != want || resp["request_id"] == "" {
+			t.Errorf("GET %s = %d %v, want a JSON %d", path, w.Code, resp, want)
+		}
+	}
+}
+
+// TestProxyAuthPaths sends OPTIONS, which a prefix route forwards like any
+// other method, through the platform chain: without a key it must be
+// refused before it reaches the upstream.
+func TestProxyAuthPaths(t *testing.T) {
+	var hits atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(api.Close)
+	t.Setenv("API_KEYS", "billing:"+billingKey)
+	t.Setenv("AUTH_PATHS", "/api/")
+	t.Setenv("JWT_JWKS_URL", "")
+	t.Setenv("PROXY_ROUTES", `[{"prefix": "/api/", "upstream": "`+api.URL+`"}]`)
+	mux := http.NewServeMux()
+	if err := setupApp(mux); err != nil {
+		t.Fatalf("setupApp: %v", err)
+	}
+	h := platformHandler(mux, nil)
+
+	for _, method := range []string{"OPTIONS", "GET", "DELETE"} {
+		if w := do(h, method, "/api/items", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s /api/items without a key = %d, want 401", method, w.Code)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("the upstream got %d unauthenticated requests, want none", n)
+	}
+	if w := do(h, "OPTIONS", "/api/items", nil, "X-API-Key", billingKey); w.Code != http.StatusOK || hits.Load() != 1 {
+		t.Errorf("OPTIONS /api/items with a key = %d, %d upstream requests; want 200 and 1", w.Code, hits.Load())
+	}
+}
+
+func TestParseProxyRoutes(t *testing.T) {
+	for routes, wantErr := range map[string]string{
+		``:   "",
+		`[]`: "",
+		`[{"prefix": "/api/", "upstream": "https://api.example"}]`: "",
+		`{"prefix": "/api/"}`: "not a JSON array",
+		`[{"prefix": "/api", "upstream": "https://api.example"}]`:                                "must start and end with /",
+		`[{"prefix": "/api/", "upstream": "api.example"}]`:                                       "must be an http or https URL",
+		`[{"prefix": "/api/", "upstream": "https://api.example", "timeout": "fast"}]`:            "positive Go duration",
+		`[{"prefix": "/api/", "upstream": "https://api.example", "retries": 3}]`:                 "unknown field",
+		`[{"prefix": "/a/", "upstream": "http://a"}, {"prefix": "/a/", "upstream": "http://b"}]`: "already routed",
+	} {
+		_, err := parseProxyRoutes(routes, time.Second)
+		if (wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("parseProxyRoutes(%s) = %v, want an error containing %q", routes, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The app: a JSON API whose reads go through a Redis cache, next to the
+// landing page. cache.go implements read-through caching and products.go
+// serves the example resource from a slow in-memory source:
+//
+//	GET /products/{id}  read through the cache
+//	PUT /products/{id}  update the source and invalidate the cached copy
+//	GET /openapi.json   the API's OpenAPI document (openapi.go)
+//
+// The cache is an optimisation, not a store: when Redis is slow or down,
+// reads fall back to the source and the X-Cache response header says
+// ERROR. Clients can skip the cache per request:
+//
+//	Cache-Control: no-cache  load from the source and refresh the cache
+//	Cache-Control: no-store  load from the source, leave the cache alone
+//
+//	REDIS_URL           redis:// or rediss:// URL, with the password and
+//	                    database number if any
+//	REDIS_POOL_SIZE     connections per replica (default 10)
+//	REDIS_TIMEOUT       deadline for each cache read or write (default
+//	                    250ms); a slower Redis counts as a miss
+//	REDIS_REQUIRED      "false" leaves Redis off /readyz, so an outage
+//	                    serves uncached reads instead of taking every
+//	                    replica out of the Service
+//	CACHE_TTL           how long a loaded value is cached (default 5m)
+//	CACHE_NEGATIVE_TTL  how long a "not found" is cached (default 30s)
+//	CACHE_LOAD_TIMEOUT  deadline for loading a value from the source
+//	                    (default 10s)
+//	CACHE_KEY_PREFIX    prefix for every key, so apps can share a Redis
+//	                    (default the app name and a colon)
+
+// redisConnectTimeout bounds the first ping at startup.
+const redisConnectTimeout = 5 * time.Second
+
+var appSettings = slices.Concat(landingSettings, openAPISettings, []setting{
+	{name: "REDIS_URL", required: true, secret: true},
+	{name: "REDIS_POOL_SIZE", kind: kindInt, def: "10", check: atLeast(1)},
+	{name: "REDIS_TIMEOUT", kind: kindDuration, def: "250ms"},
+	{name: "REDIS_REQUIRED", kind: kindBool, def: "true"},
+	{name: "CACHE_TTL", kind: kindDuration, def: "5m"},
+	{name: "CACHE_NEGATIVE_TTL", kind: kindDuration, def: "30s"},
+	{name: "CACHE_LOAD_TIMEOUT", kind: kindDuration, def: "10s"},
+	{name: "CACHE_KEY_PREFIX", def: serviceName + ":"},
+})
+
+// appCache is the Redis cache, opened by setupApp.
+var appCache *cache
+
+func setupApp(mux *http.ServeMux) error {
+	opts, err := redis.ParseURL(conf("REDIS_URL"))
+	if err != nil {
+		return fmt.Errorf("REDIS_URL: %w", err)
+	}
+	opts.PoolSize = confInt("REDIS_POOL_SIZE")
+	opts.ContextTimeoutEnabled = true
+	redis.SetLogger(redisLogger{})
+	client := redis.NewClient(opts)
+
+	// An unreachable Redis is not fatal: reads fall back to the source,
+	// and /readyz reports it when REDIS_REQUIRED is set.
+	ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		slog.Warn("redis not reachable at startup", "error", err)
+	}
+
+	appCache = newCache(client)
+	if confBool("REDIS_REQUIRED") {
+		readinessChecks.register("redis", checkFunc(func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		}), 0)
+	}
+	registerMetrics(cacheMetrics.write)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	registerProductRoutes(mux)
+	return nil
+}
+
+// redisLogger sends go-redis's internal messages, such as pool dial
+// failures, to the structured log instead of the standard logger.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.WarnContext(ctx, fmt.Sprintf(format, v...), "component", "go-redis")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// Read-through caching. readThrough returns the cached value for a key,
+// or loads it from the source, caches it and returns it. Values are stored
+// as JSON under CACHE_KEY_PREFIX + key; a load that returns errNotFound is
+// cached too, as an empty string for CACHE_NEGATIVE_TTL, so lookups of
+// missing IDs do not all reach the source.
+//
+// Concurrent misses for the same key in one replica share a single load,
+// so an expired hot key costs the source one request, not one per client.
+// The load runs under CACHE_LOAD_TIMEOUT and is not cancelled when the
+// client that started it goes away, since others may be waiting for it.
+//
+// Cache metrics, served on /metrics:
+//
+//	cache_requests_total  counter  result (hit, miss, bypass, error)
+//	cache_loads_total     counter  result (ok, not_found, error)
+
+// errNotFound is returned by loaders, and by readThrough, for a key the
+// source does not have.
+var errNotFound = errors.New("not found")
+
+// Cache results, reported in the X-Cache response header.
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheBypass = "bypass"
+	cacheError  = "error"
+)
+
+// cacheMode is what a request asked of the cache.
+type cacheMode int
+
+const (
+	cacheUse     cacheMode = iota // read, and write on a miss
+	cacheRefresh                  // skip the read, write the fresh value
+	cacheSkip                     // neither read nor write
+)
+
+// requestCacheMode maps the request's Cache-Control header to a cacheMode.
+func requestCacheMode(r *http.Request) cacheMode {
+	mode := cacheUse
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			return cacheSkip
+		case "no-cache":
+			mode = cacheRefresh
+		}
+	}
+	return mode
+}
+
+type cache struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+	loads   singleflight.Group
+}
+
+func newCache(client *redis.Client) *cache {
+	return &cache{
+		client:  client,
+		prefix:  conf("CACHE_KEY_PREFIX"),
+		timeout: confDuration("REDIS_TIMEOUT"),
+	}
+}
+
+// readThrough returns the value for key and the cache result. A failing
+// Redis is logged and the value is loaded from the source; only a failing
+// load returns an error.
+func readThrough[T any](ctx context.Context, c *cache, key string, mode cacheMode, load func(context.Context) (T, error)) (T, string, error) {
+	var zero T
+	result := cacheBypass
+	if mode == cacheUse {
+		raw, err := c.get(ctx, key)
+		switch {
+		case err == nil:
+			if raw == "" {
+				cacheMetrics.request(cacheHit)
+				return zero, cacheHit, errNotFound
+			}
+			var v T
+			if err := json.Unmarshal([]byte(raw), &v); err == nil {
+				cacheMetrics.request(cacheHit)
+				return v, cacheHit, nil
+			}
+			// An entry in an old format: load it again and overwrite it.
+			slog.Warn("discarding undecodable cache entry", "key", key)
+			result = cacheMiss
+		case errors.Is(err, redis.Nil):
+			result = cacheMiss
+		default:
+			slog.Warn("cache read failed, loading from the source", "key", key, "error", err)
+			result = cacheError
+		}
+	}
+	cacheMetrics.request(result)
+
+	ch := c.loads.DoChan(key, func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), confDuration("CACHE_LOAD_TIMEOUT"))
+		defer cancel()
+		v, err := load(loadCtx)
+		switch {
+		case err == nil:
+			cacheMetrics.load("ok")
+		case errors.Is(err, errNotFound):
+			cacheMetrics.load("not_found")
+		default:
+			cacheMetrics.load("error")
+			return v, err
+		}
+		if mode != cacheSkip {
+			c.store(loadCtx, key, v, err)
+		}
+		return v, err
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return zero, result, res.Err
+		}
+		return res.Val.(T), result, nil
+	case <-ctx.Done():
+		return zero, result, ctx.Err()
+	}
+}
+
+// invalidate deletes the cached value for key, after the source changed.
+func (c *cache) invalidate(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+func (c *cache) get(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.Get(ctx, c.prefix+key).Result()
+}
+
+// store caches a load's outcome: the value for CACHE_TTL, or a not-found
+// marker for CACHE_NEGATIVE_TTL. Failures are logged; the next read loads
+// again.
+func (c *cache) store(ctx context.Context, key string, v any, loadErr error) {
+	raw, ttl := "", confDuration("CACHE_NEGATIVE_TTL")
+	if loadErr == nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			slog.Warn("encoding cache entry failed", "key", key, "error", err)
+			return
+		}
+		raw, ttl = string(b), confDuration("CACHE_TTL")
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	if err := c.client.Set(ctx, c.prefix+key, raw, ttl).Err(); err != nil {
+		slog.Warn("cache write failed", "key", key, "error", err)
+	}
+}
+
+// setCacheHeader reports the cache result to the client.
+func setCacheHeader(w http.ResponseWriter, result string) {
+	w.Header().Set("X-Cache", strings.ToUpper(result))
+}
+
+type cacheCounters struct {
+	mu       sync.Mutex
+	requests map[string]uint64
+	loads    map[string]uint64
+}
+
+var cacheMetrics = &cacheCounters{
+	requests: map[string]uint64{},
+	loads:    map[string]uint64{},
+}
+
+func (m *cacheCounters) request(result string) {
+	m.mu.Lock()
+	m.requests[result]++
+	m.mu.Unlock()
+}
+
+func (m *cacheCounters) load(result string) {
+	m.mu.Lock()
+	m.loads[result]++
+	m.mu.Unlock()
+}
+
+func (m *cacheCounters) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP cache_requests_total Cache lookups by result.")
+	fmt.Fprintln(out, "# TYPE cache_requests_total counter")
+	for _, result := range []string{cacheHit, cacheMiss, cacheBypass, cacheError} {
+		fmt.Fprintf(out, "cache_requests_total{result=%q} %d\n", result, m.requests[result])
+	}
+
+	fmt.Fprintln(out, "# HELP cache_loads_total Loads from the source by result.")
+	fmt.Fprintln(out, "# TYPE cache_loads_total counter")
+	for _, result := range []string{"ok", "not_found", "error"} {
+		fmt.Fprintf(out, "cache_loads_total{result=%q} %d\n", result, m.loads[result])
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The example resource: products read through the cache. productSource
+// stands in for the slow system the cache protects, a database or an
+// upstream API; replace loadProduct and saveProduct with calls to yours.
+// Writes go to the source first and then invalidate the cached copy, so
+// the next read loads the new value. A read that was already loading when
+// the write landed can cache the old value; CACHE_TTL bounds how long.
+
+// productCacheVersion is part of every product key. Bump it when product's
+// JSON shape changes, so replicas running the new code ignore entries
+// written by the old.
+const productCacheVersion = "v1"
+
+// sourceLatency is the simulated cost of a source lookup.
+const sourceLatency = 100 * time.Millisecond
+
+const maxProductNameLength = 200
+
+type product struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	PriceCents int64     `json:"price_cents"`
+	UpdatedAt  time.Time `json:"updated_at,omitzero"`
+}
+
+// productInput is the body of PUT /products/{id}.
+type productInput struct {
+	Name       string `json:"name"`
+	PriceCents int64  `json:"price_cents"`
+}
+
+func (in *productInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	switch {
+	case in.Name == "":
+		return errors.New("name is required")
+	case utf8.RuneCountInString(in.Name) > maxProductNameLength:
+		return errors.New("name must be at most " + strconv.Itoa(maxProductNameLength) + " characters")
+	case in.PriceCents < 0:
+		return errors.New("price_cents must not be negative")
+	}
+	return nil
+}
+
+var productSource = struct {
+	mu       sync.Mutex
+	products map[int64]product
+}{products: map[int64]product{
+	1: {ID: 1, Name: "Widget", PriceCents: 1999},
+	2: {ID: 2, Name: "Gadget", PriceCents: 4999},
+	3: {ID: 3, Name: "Gizmo", PriceCents: 999},
+}}
+
+// loadProduct fetches a product from the source, or returns errNotFound.
+func loadProduct(ctx context.Context, id int64) (product, error) {
+	select {
+	case <-time.After(sourceLatency):
+	case <-ctx.Done():
+		return product{}, ctx.Err()
+	}
+	productSource.mu.Lock()
+	defer productSource.mu.Unlock()
+	p, ok := productSource.products[id]
+	if !ok {
+		return product{}, errNotFound
+	}
+	return p, nil
+}
+
+// saveProduct creates or replaces a product in the source.
+func saveProduct(ctx context.Context, p product) error {
+	select {
+	case <-time.After(sourceLatency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	productSource.mu.Lock()
+	defer productSource.mu.Unlock()
+	productSource.products[p.ID] = p
+	return nil
+}
+
+func productKey(id int64) string {
+	return "product:" + productCacheVersion + ":" + strconv.FormatInt(id, 10)
+}
+
+func registerProductRoutes(mux *http.ServeMux) {
+	id := []apiParam{{Name: "id", Type: "integer"}}
+	handleAPI(mux, "GET /products/{id}", apiDoc{
+		Summary:  "Fetch a product through the cache",
+		Params:   id,
+		Response: product{},
+		Errors:   []int{http.StatusNotFound, http.StatusBadGateway},
+	}, getProduct)
+	handleAPI(mux, "PUT /products/{id}", apiDoc{
+		Summary:  "Update a product and invalidate its cached copy",
+		Params:   id,
+		Request:  productInput{},
+		Response: product{},
+		Errors:   []int{http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusBadGateway},
+	}, putProduct)
+	mux.HandleFunc("/products/{id}", methodNotAllowed("GET, HEAD, PUT"))
+	registerOpenAPI(mux)
+}
+
+func getProduct(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id", "product")
+	if !ok {
+		return
+	}
+	p, result, err := readThrough(r.Context(), appCache, productKey(id), requestCacheMode(r),
+		func(ctx context.Context) (product, error) { return loadProduct(ctx, id) })
+	setCacheHeader(w, result)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, p)
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, "product not found")
+	case r.Context().Err() != nil:
+		// The client went away; nobody reads the response.
+	default:
+		requestLogger(r).Error("loading product failed", "product_id", id, "error", err)
+		writeError(w, r, http.StatusBadGateway, "product source unavailable")
+	}
+}
+
+func putProduct(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id", "product")
+	if !ok {
+		return
+	}
+	var in productInput
+	if err := readJSON(w, r, &in); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	if err := in.validate(); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	p := product{ID: id, Name: in.Name, PriceCents: in.PriceCents, UpdatedAt: time.Now().UTC()}
+	if err := saveProduct(r.Context(), p); err != nil {
+		requestLogger(r).Error("saving product failed", "product_id", id, "error", err)
+		writeError(w, r, http.StatusBadGateway, "product source unavailable")
+		return
+	}
+	if err := appCache.invalidate(r.Context(), productKey(id)); err != nil {
+		// The write stands; the cached copy expires within CACHE_TTL.
+		requestLogger(r).Warn("cache invalidation failed", "product_id", id, "error", err)
+	}
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newProductsMux serves the app as setupApp wires it, caching in an
+// in-memory Redis, and restores the sample products afterwards.
+func newProductsMux(t *testing.T) (*http.ServeMux, *miniredis.Miniredis) {
+	t.Helper()
+	withChecks(t)
+	rdb := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+rdb.Addr())
+
+	productSource.mu.Lock()
+	saved := map[int64]product{}
+	for id, p := range productSource.products {
+		saved[id] = p
+	}
+	productSource.mu.Unlock()
+	t.Cleanup(func() {
+		productSource.mu.Lock()
+		productSource.products = saved
+		productSource.mu.Unlock()
+	})
+
+	mux := http.NewServeMux()
+	if err := setupApp(mux); err != nil {
+		t.Fatalf("setupApp: %v", err)
+	}
+	return mux, rdb
+}
+
+func TestGetProductCaching(t *testing.T) {
+	mux, rdb := newProductsMux(t)
+
+	for _, tc := range []struct {
+		cacheControl, want string
+	}{
+		{"", "MISS"},
+		{"", "HIT"},
+		{"no-cache", "BYPASS"},
+		{"no-store", "BYPASS"},
+		{"", "HIT"},
+	} {
+		w := do(mux, "GET", "/products/1", nil, "Cache-Control", tc.cacheControl)
+		var p product
+		decode(t, w, &p)
+		if w.Code != http.StatusOK || p.Name != "Widget" || w.Header().Get("X-Cache") != tc.want {
+			t.Fatalf("GET /products/1 (Cache-Control %q) = %d %s %+v, want 200 %s Widget",
+				tc.cacheControl, w.Code, w.Header().Get("X-Cache"), p, tc.want)
+		}
+	}
+	if !rdb.Exists(conf("CACHE_KEY_PREFIX") + productKey(1)) {
+		t.Fatalf("Redis keys = %v, want the product cached", rdb.Keys())
+	}
+}
+
+func TestGetProductNotFoundIsCached(t *testing.T) {
+	mux, rdb := newProductsMux(t)
+
+	for _, want := range []string{"MISS", "HIT"} {
+		if w := do(mux, "GET", "/products/404", nil); w.Code != http.StatusNotFound || w.Header().Get("X-Cache") != want {
+			t.Fatalf("GET /products/404 = %d %s, want 404 %s", w.Code, w.Header().Get("X-Cache"), want)
+		}
+	}
+	if ttl := rdb.TTL(conf("CACHE_KEY_PREFIX") + productKey(404)); ttl <= 0 || ttl > confDuration("CACHE_NEGATIVE_TTL") {
+		t.Fatalf("not-found entry TTL = %v, want CACHE_NEGATIVE_TTL", ttl)
+	}
+	for _, path := range []string{"/products/0", "/products/abc"} {
+		if w := do(mux, "GET", path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestPutProductInvalidatesCache(t *testing.T) {
+	mux, _ := newProductsMux(t)
+	do(mux, "GET", "/products/2", nil)
+
+	w := do(mux, "PUT", "/products/2", strings.NewReader(`{"name": " Gadget Pro ", "price_cents": 5999}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /products/2 = %d %s, want 200", w.Code, w.Body)
+	}
+	w = do(mux, "GET", "/products/2", nil)
+	var p product
+	decode(t, w, &p)
+	if w.Header().Get("X-Cache") != "MISS" || p.Name != "Gadget Pro" || p.PriceCents != 5999 {
+		t.Fatalf("GET /products/2 after PUT = %s %+v, want a MISS with the new values", w.Header().Get("X-Cache"), p)
+	}
+}
+
+func TestPutProductValidation(t *testing.T) {
+	mux, _ := newProductsMux(t)
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"name": "   ", "price_cents": 1}`, http.StatusUnprocessableEntity},
+		{`{"name": "` + strings.Repeat("x", maxProductNameLength+1) + `"}`, http.StatusUnprocessableEntity},
+		{`{"name": "Widget", "price_cents": -1}`, http.StatusUnprocessableEntity},
+		{`{"name": "Widget", "colour": "red"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	} {
+		if w := do(mux, "PUT", "/products/1", strings.NewReader(tc.body)); w.Code != tc.want {
+			t.Errorf("PUT /products/1 %.40s = %d, want %d", tc.body, w.Code, tc.want)
+		}
+	}
+}
+
+func TestRedisDownFallsBackToSource(t *testing.T) {
+	mux, rdb := newProductsMux(t)
+	rdb.Close()
+
+	w := do(mux, "GET", "/products/3", nil)
+	var p product
+	decode(t, w, &p)
+	if w.Code != http.StatusOK || p.Name != "Gizmo" || w.Header().Get("X-Cache") != "ERROR" {
+		t.Fatalf("GET /products/3 with Redis down = %d %s %+v, want 200 ERROR Gizmo", w.Code, w.Header().Get("X-Cache"), p)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/app"
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+)
+
+// The app itself, and where customer code starts.
+//
+//	appSettings  settings read by the app's own code, declared as the
+//	             SDK's are and read with rt.Config
+//	setupApp     registers the app's routes on rt.Mux, and any readiness
+//	             checks (rt.Health), middleware (rt.Use) and shutdown
+//	             hooks (rt.Shutdown) it needs. It runs once before the
+//	             server starts; an error stops startup.
+
+var appSettings = []config.Setting{
+	{Name: "GREETING", Default: "Hello from [% APP_NAME %]", Reloadable: true},
+}
+
+// InfoResponse answers GET /.
+type InfoResponse struct {
+	Message     string `json:"message"`
+	Environment string `json:"environment"`
+	Version     string `json:"version"`
+}
+
+func setupApp(rt *app.Runtime) error {
+	rt.Mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(InfoResponse{
+			Message:     rt.Config.Get("GREETING"),
+			Environment: rt.Config.Environment(),
+			Version:     gitSHA,
+		})
+	})
+	return nil
+}
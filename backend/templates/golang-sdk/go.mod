@@ -0,0 +1,5 @@
+module github.com/[% GITHUB_OWNER %]/[% REPO_NAME %]
+
+go 1.24.0
+
+require github.com/lebrick07/openluffy/openluffy-sdk v0.1.0
@@ -0,0 +1,27 @@
+package main
+
+import "github.com/lebrick07/openluffy/openluffy-sdk/app"
+
+// Configuration, probes, logging, middleware and graceful shutdown come
+// from the OpenLuffy SDK, github.com/lebrick07/openluffy/openluffy-sdk:
+// runtime fixes arrive by upgrading it in go.mod, with no re-render. The
+// app's own code is in app.go.
+
+// Build metadata, stamped by the Dockerfile and the Makefile with -ldflags.
+var gitSHA, buildTime string
+
+func main() {
+	app.Main(newApp())
+}
+
+func newApp() app.App {
+	return app.App{
+		Name:          "[% APP_NAME %]",
+		Port:          [% PORT %],
+		LivenessPath:  "[% LIVENESS_PATH %]",
+		ReadinessPath: "[% READINESS_PATH %]",
+		StartupPath:   "[% STARTUP_PATH %]",
+		Settings:      appSettings,
+		Setup:         setupApp,
+	}
+}
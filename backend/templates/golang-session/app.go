@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The app: browser logins with server-side cookie sessions, next to the
+// landing page. session.go keeps the sessions and their cookie, store.go
+// and store_redis.go the backends they are kept in, csrf.go protects the
+// cookie from other sites' forms and scripts, and login.go checks the
+// credentials:
+//
+//	GET /session   the browser's session as {"authenticated", "user",
+//	               "csrf_token", "expires_at"}, starting an anonymous one
+//	               for its CSRF token when it has none
+//	GET /login     the login form
+//	POST /login    a form post, or {"username", "password"}, logs in
+//	POST /logout   ends the session (204)
+//	GET /me        the logged-in user, a sample route behind
+//	               requireLogin; browsers without a login are sent to
+//	               /login first
+//
+// Every POST, PUT, PATCH and DELETE from a browser with a session carries
+// its csrf_token, in the X-CSRF-Token header or a form field.
+//
+//	SESSION_STORE            memory (default), or redis for sessions
+//	                         shared by every replica
+//	REDIS_URL                redis:// or rediss:// URL, with the password
+//	                         and database number if any, for
+//	                         SESSION_STORE=redis
+//	REDIS_POOL_SIZE          connections per replica (default 10)
+//	REDIS_TIMEOUT            deadline for each session read or write
+//	                         (default 250ms)
+//	SESSION_KEY_PREFIX       prefix for every session key, so apps can
+//	                         share a Redis (default the app name and
+//	                         ":session:")
+//	SESSION_TTL              how long a login lasts at most (default 12h)
+//	SESSION_IDLE_TIMEOUT     how long an unused session lasts (default 30m)
+//	SESSION_ROTATE_INTERVAL  how often the session ID is replaced (default
+//	                         15m)
+//	SESSION_COOKIE_SECURE    "false" lets the cookie travel over plain
+//	                         HTTP, for local development only
+//	SESSION_COOKIE_SAMESITE  lax (default), or strict, which also keeps
+//	                         the cookie off links followed from other sites
+//	LOGIN_USERS              comma-separated name=hash logins authenticate
+//	                         accepts (login.go)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "SESSION_STORE", def: "memory", check: oneOf("memory", "redis")},
+	{name: "REDIS_URL", secret: true},
+	{name: "REDIS_POOL_SIZE", kind: kindInt, def: "10", check: atLeast(1)},
+	{name: "REDIS_TIMEOUT", kind: kindDuration, def: "250ms"},
+	{name: "SESSION_KEY_PREFIX", def: serviceName + ":session:"},
+	{name: "SESSION_TTL", kind: kindDuration, def: "12h"},
+	{name: "SESSION_IDLE_TIMEOUT", kind: kindDuration, def: "30m"},
+	{name: "SESSION_ROTATE_INTERVAL", kind: kindDuration, def: "15m"},
+	{name: "SESSION_COOKIE_SECURE", kind: kindBool, def: "true"},
+	{name: "SESSION_COOKIE_SAMESITE", def: "lax", check: oneOf("lax", "strict")},
+	{name: "LOGIN_USERS", kind: kindList, secret: true, check: checkLoginUsers},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	store, err := openSessionStore(conf("SESSION_STORE"))
+	if err != nil {
+		return err
+	}
+	appSessions = store
+	useMiddleware(sessionMiddleware)
+	useMiddleware(csrfMiddleware)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("GET /session", sessionHandler)
+	mux.HandleFunc("/session", methodNotAllowed("GET, HEAD"))
+	mux.HandleFunc("GET /login", loginFormHandler)
+	mux.HandleFunc("POST /login", loginHandler)
+	mux.HandleFunc("/login", methodNotAllowed("GET, HEAD, POST"))
+	mux.HandleFunc("POST /logout", logoutHandler)
+	mux.HandleFunc("/logout", methodNotAllowed("POST"))
+	mux.HandleFunc("GET /me", requireLogin(meHandler))
+	mux.HandleFunc("/me", methodNotAllowed("GET, HEAD"))
+	return nil
+}
+
+// sessionInfo is a session as GET /session and a JSON login answer it.
+type sessionInfo struct {
+	Authenticated bool      `json:"authenticated"`
+	User          string    `json:"user,omitempty"`
+	CSRFToken     string    `json:"csrf_token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+func writeSession(w http.ResponseWriter, s *session) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, sessionInfo{Authenticated: s.User != "", User: s.User, CSRFToken: s.CSRFToken, ExpiresAt: s.Expires})
+}
+
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := startSession(w, r)
+	if err != nil {
+		requestLogger(r).Error("starting a session failed", "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "sessions unavailable")
+		return
+	}
+	writeSession(w, s)
+}
+
+// requireLogin serves next only to logged-in sessions.
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s := currentSession(r); s == nil || s.User == "" {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			writeError(w, r, http.StatusUnauthorized, "login required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"user": currentSession(r).User})
+}
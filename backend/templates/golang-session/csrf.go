@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"mime"
+	"net/http"
+)
+
+// CSRF protection. Browsers send the session cookie with every request to
+// the app, including those another site makes them send, so a request
+// that changes something must also prove it comes from the app's own
+// pages: it carries the session's CSRF token, in the X-CSRF-Token header
+// or, from an HTML form, a csrf_token field. Scripts get the token from
+// GET /session, and the login form has it filled in.
+//
+// SameSite already keeps the cookie off cross-site POSTs in current
+// browsers; the token also covers older ones and sibling subdomains,
+// which count as same-site. Requests a browser marks Sec-Fetch-Site:
+// cross-site are refused before the token is looked at.
+//
+// Every request with a session, other than GET, HEAD, OPTIONS and TRACE,
+// is checked. Requests without one carry no cookie to abuse, except a
+// login, which would sign the victim into the attacker's account, so
+// loginHandler refuses to run without a session.
+
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// csrfMiddleware refuses state-changing requests whose session's CSRF
+// token they do not carry. It runs after sessionMiddleware.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		s := currentSession(r)
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Sec-Fetch-Site") == "cross-site" || !validCSRFToken(s, csrfToken(r)) {
+			requestLogger(r).Warn("CSRF check failed", "method", r.Method, "path", r.URL.Path, "sec_fetch_site", r.Header.Get("Sec-Fetch-Site"))
+			writeError(w, r, http.StatusForbidden, "invalid CSRF token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken is the token the request carries: the header, or the form
+// field of a form post.
+func csrfToken(r *http.Request) string {
+	if t := r.Header.Get(csrfHeader); t != "" {
+		return t
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data" {
+		return r.PostFormValue(csrfField)
+	}
+	return ""
+}
+
+func validCSRFToken(s *session, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
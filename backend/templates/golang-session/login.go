@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Logging in and out. GET /login serves a minimal form and POST /login
+// checks the credentials with authenticate. A form post is redirected to
+// its return_to, and a JSON post, {"username", "password"}, is answered
+// with the new session as GET /session describes it. POST /logout ends
+// the session.
+//
+// authenticate checks LOGIN_USERS, entries of "name=hash" where the hash
+// is PBKDF2-SHA256, as "pbkdf2-sha256$iterations$salt$key" with the salt
+// and key in unpadded base64. The template's README shows how to make
+// one. Replace authenticate to check the app's own user database.
+
+// pbkdf2MinIterations is what OWASP recommends for PBKDF2-HMAC-SHA256.
+const pbkdf2MinIterations = 600000
+
+// passwordHash is a parsed LOGIN_USERS hash.
+type passwordHash struct {
+	iterations int
+	salt, key  []byte
+}
+
+func parsePasswordHash(v string) (passwordHash, error) {
+	parts := strings.Split(v, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return passwordHash{}, errors.New("want pbkdf2-sha256$iterations$salt$key")
+	}
+	var h passwordHash
+	var err error
+	if h.iterations, err = strconv.Atoi(parts[1]); err != nil || h.iterations < pbkdf2MinIterations {
+		return passwordHash{}, fmt.Errorf("want at least %d iterations", pbkdf2MinIterations)
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil || len(h.salt) < 16 {
+		return passwordHash{}, errors.New("want a salt of at least 16 bytes, in unpadded base64")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(h.key) < 32 {
+		return passwordHash{}, errors.New("want a key of at least 32 bytes, in unpadded base64")
+	}
+	return h, nil
+}
+
+func (h passwordHash) matches(password string) bool {
+	key, err := pbkdf2.Key(sha256.New, password, h.salt, h.iterations, len(h.key))
+	return err == nil && subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// checkLoginUsers accepts LOGIN_USERS entries of "name=hash".
+func checkLoginUsers(v string) error {
+	for entry := range strings.SplitSeq(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, hash, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return errors.New("want name=hash entries")
+		}
+		if _, err := parsePasswordHash(strings.TrimSpace(hash)); err != nil {
+			return fmt.Errorf("user %s: %w", strings.TrimSpace(name), err)
+		}
+	}
+	return nil
+}
+
+// unknownUser is checked against for names LOGIN_USERS does not have, so
+// a login takes as long whether or not the name exists.
+var unknownUser = passwordHash{iterations: pbkdf2MinIterations, salt: make([]byte, 16), key: make([]byte, 32)}
+
+// authenticate returns the user the credentials belong to.
+func authenticate(_ context.Context, username, password string) (string, bool) {
+	h := unknownUser
+	raw, ok := parseHeaders(confList("LOGIN_USERS"))[username]
+	if ok {
+		h, _ = parsePasswordHash(raw)
+	}
+	return username, h.matches(password) && ok
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in - {{.App}}</title>
+</head>
+<body>
+<form method="post" action="/login">
+<h1>Log in to {{.App}}</h1>
+{{if .Failed}}<p role="alert">Wrong username or password.</p>{{end}}
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="return_to" value="{{.ReturnTo}}">
+<p><label>Username <input name="username" autocomplete="username" required autofocus></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<p><button type="submit">Log in</button></p>
+</form>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	App       string
+	CSRFToken string
+	ReturnTo  string
+	Failed    bool
+}
+
+// localPath returns target if it is a path on this app, else "/", so
+// return_to cannot send users to another site.
+func localPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+func loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := startSession(w, r)
+	if err != nil {
+		requestLogger(r).Error("starting a session failed", "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "sessions unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if r.URL.Query().Has("failed") {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	loginPage.Execute(w, loginPageData{
+		App:       customerName,
+		CSRFToken: s.CSRFToken,
+		ReturnTo:  localPath(r.URL.Query().Get("return_to")),
+		Failed:    r.URL.Query().Has("failed"),
+	})
+}
+
+// loginRequest is the body of a JSON login.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	// csrfMiddleware has checked the token of any session; a login
+	// without one is a forged one.
+	if currentSession(r) == nil {
+		writeError(w, r, http.StatusForbidden, "invalid CSRF token")
+		return
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	form := mt != "application/json"
+	var in loginRequest
+	if form {
+		in.Username, in.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	} else if err := readJSON(w, r, &in); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	user, ok := authenticate(r.Context(), in.Username, in.Password)
+	if !ok {
+		requestLogger(r).Warn("login failed", "user", in.Username)
+		if form {
+			returnTo := localPath(r.PostFormValue("return_to"))
+			http.Redirect(w, r, "/login?failed&return_to="+url.QueryEscape(returnTo), http.StatusSeeOther)
+			return
+		}
+		writeError(w, r, http.StatusUnauthorized, "wrong username or password")
+		return
+	}
+	s, err := loginSession(w, r, user)
+	if err != nil {
+		requestLogger(r).Error("starting a session failed", "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "sessions unavailable")
+		return
+	}
+	requestLogger(r).Info("logged in", "user", user)
+	if form {
+		http.Redirect(w, r, localPath(r.PostFormValue("return_to")), http.StatusSeeOther)
+		return
+	}
+	writeSession(w, s)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := endSession(w, r); err != nil {
+		requestLogger(r).Error("ending the session failed", "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "sessions unavailable")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Sessions are kept on the server: the cookie holds nothing but a random
+// session ID, and the session itself (the user, its CSRF token and the
+// app's values) is in the SESSION_STORE. Logging a user out, or every
+// user, is deleting sessions from the store.
+//
+// The cookie is HttpOnly, so scripts cannot read it, and SameSite
+// SESSION_COOKIE_SAMESITE (lax, or strict). It is Secure and named
+// __Host-session unless SESSION_COOKIE_SECURE=false: browsers only accept
+// a __Host- cookie over HTTPS, for the whole host and from the host
+// itself, so a sibling subdomain cannot plant one.
+//
+// A session ends SESSION_TTL after it started, or once unused for
+// SESSION_IDLE_TIMEOUT, whichever comes first. Its ID is replaced at
+// login and logout, so an ID planted before login is worthless after it
+// (session fixation), and on the first request once SESSION_ROTATE_INTERVAL
+// has passed, so a leaked ID soon stops working. The old ID stays valid
+// for rotationGrace, read-only, for requests already in flight with it.
+//
+// App code reads the request's session with currentSession, and keeps
+// its own data in the session's Values, saving it with saveSession.
+
+// rotationGrace is how long a replaced session ID keeps working.
+const rotationGrace = 30 * time.Second
+
+// session is a browser's session. User is empty until login.
+type session struct {
+	id string
+
+	User      string            `json:"user,omitempty"`
+	CSRFToken string            `json:"csrf_token"`
+	Values    map[string]string `json:"values,omitempty"`
+	Created   time.Time         `json:"created"`
+	Rotated   time.Time         `json:"rotated"`
+	Expires   time.Time         `json:"expires"`
+
+	// ReplacedBy is the ID that replaced this one: the session is a
+	// read-only copy kept for rotationGrace.
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// appSessions is the session store, opened by setupApp.
+var appSessions sessionStore
+
+// randomToken returns a random 256-bit URL-safe token.
+func randomToken() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// sessionCookieName is __Host-session for Secure cookies, which is the
+// only way browsers take the prefix.
+func sessionCookieName() string {
+	if confBool("SESSION_COOKIE_SECURE") {
+		return "__Host-session"
+	}
+	return "session"
+}
+
+func setSessionCookie(w http.ResponseWriter, s *session) {
+	sameSite := http.SameSiteLaxMode
+	if conf("SESSION_COOKIE_SAMESITE") == "strict" {
+		sameSite = http.SameSiteStrictMode
+	}
+	maxAge := int(time.Until(s.Expires).Seconds())
+	if s.id == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName(),
+		Value:    s.id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   confBool("SESSION_COOKIE_SECURE"),
+		SameSite: sameSite,
+	})
+}
+
+// storeTTL is how long the store keeps s: until it idles out, or its
+// absolute expiry if that comes first.
+func storeTTL(s *session) time.Duration {
+	return min(confDuration("SESSION_IDLE_TIMEOUT"), time.Until(s.Expires))
+}
+
+type sessionKey struct{}
+
+// currentSession returns the request's session, or nil when it has none.
+func currentSession(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionKey{}).(*session)
+	return s
+}
+
+// sessionMiddleware loads the request's session from its cookie, rotating
+// its ID when it is due and extending its idle timeout. Requests with no
+// session, or an expired one, go on without.
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := loadSession(r)
+		if err != nil {
+			requestLogger(r).Error("loading the session failed", "error", err)
+			writeError(w, r, http.StatusServiceUnavailable, "sessions unavailable")
+			return
+		}
+		if s != nil && s.ReplacedBy == "" {
+			if time.Since(s.Rotated) >= confDuration("SESSION_ROTATE_INTERVAL") {
+				err = rotateSession(w, r, s)
+			} else {
+				err = saveSession(r, s)
+			}
+			if err != nil {
+				requestLogger(r).Error("saving the session failed", "error", err)
+				writeError(w, r, http.StatusServiceUnavailable, "sessions unavailable")
+				return
+			}
+		}
+		if s != nil {
+			r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, s))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loadSession(r *http.Request) (*session, error) {
+	c, err := r.Cookie(sessionCookieName())
+	if err != nil || c.Value == "" {
+		return nil, nil
+	}
+	data, err := appSessions.load(r.Context(), c.Value)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	s := &session{id: c.Value}
+	if err := json.Unmarshal(data, s); err != nil || !time.Now().Before(s.Expires) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// saveSession stores s, as changed by the handler. A read-only copy left
+// by rotation is not saved.
+func saveSession(r *http.Request, s *session) error {
+	if s.ReplacedBy != "" {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return appSessions.save(r.Context(), s.id, data, storeTTL(s))
+}
+
+// startSession returns the request's session, starting an anonymous one
+// when it has none: a login form needs one for its CSRF token.
+func startSession(w http.ResponseWriter, r *http.Request) (*session, error) {
+	if s := currentSession(r); s != nil {
+		return s, nil
+	}
+	now := time.Now()
+	s := &session{id: randomToken(), CSRFToken: randomToken(), Created: now, Rotated: now, Expires: now.Add(confDuration("SESSION_TTL"))}
+	if err := saveSession(r, s); err != nil {
+		return nil, err
+	}
+	setSessionCookie(w, s)
+	return s, nil
+}
+
+// rotateSession moves s to a new ID, leaving the old one as a read-only
+// copy for rotationGrace.
+func rotateSession(w http.ResponseWriter, r *http.Request, s *session) error {
+	old := *s
+	s.id, s.Rotated = randomToken(), time.Now()
+	if err := saveSession(r, s); err != nil {
+		return err
+	}
+	old.ReplacedBy = s.id
+	if data, err := json.Marshal(old); err == nil {
+		appSessions.save(r.Context(), old.id, data, min(rotationGrace, storeTTL(&old)))
+	}
+	setSessionCookie(w, s)
+	return nil
+}
+
+// loginSession logs user in: the request's session, if any, is replaced
+// by a new one, with a new ID and CSRF token and a fresh SESSION_TTL.
+// The app's Values carry over.
+func loginSession(w http.ResponseWriter, r *http.Request, user string) (*session, error) {
+	now := time.Now()
+	s := &session{id: randomToken(), User: user, CSRFToken: randomToken(), Created: now, Rotated: now, Expires: now.Add(confDuration("SESSION_TTL"))}
+	if old := currentSession(r); old != nil {
+		s.Values = old.Values
+		if err := appSessions.delete(r.Context(), old.id); err != nil {
+			return nil, err
+		}
+	}
+	if err := saveSession(r, s); err != nil {
+		return nil, err
+	}
+	setSessionCookie(w, s)
+	return s, nil
+}
+
+// endSession deletes the request's session and clears its cookie.
+func endSession(w http.ResponseWriter, r *http.Request) error {
+	if s := currentSession(r); s != nil {
+		if err := appSessions.delete(r.Context(), s.id); err != nil {
+			return err
+		}
+	}
+	setSessionCookie(w, &session{})
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testPasswordHash hashes password as LOGIN_USERS expects it.
+func testPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+	salt := []byte("0123456789abcdef")
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2MinIterations, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2MinIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// withSessions serves the app's routes behind the session and CSRF
+// middleware, keeping sessions in store, with the login ada/secret.
+func withSessions(t *testing.T, store sessionStore) http.Handler {
+	t.Helper()
+	t.Setenv("LOGIN_USERS", "ada="+testPasswordHash(t, "secret"))
+	saved := appSessions
+	appSessions = store
+	t.Cleanup(func() { appSessions = saved })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /session", sessionHandler)
+	mux.HandleFunc("GET /login", loginFormHandler)
+	mux.HandleFunc("POST /login", loginHandler)
+	mux.HandleFunc("POST /logout", logoutHandler)
+	mux.HandleFunc("GET /me", requireLogin(meHandler))
+	return chain(mux, sessionMiddleware, csrfMiddleware)
+}
+
+// sessionCookie returns the session cookie w sets, or nil.
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName() {
+			return c
+		}
+	}
+	return nil
+}
+
+// newBrowserSession starts an anonymous session, returning its cookie
+// header and CSRF token.
+func newBrowserSession(t *testing.T, h http.Handler) (cookie, token string) {
+	t.Helper()
+	w := do(h, "GET", "/session", nil)
+	var info sessionInfo
+	decode(t, w, &info)
+	c := sessionCookie(w)
+	if c == nil || info.Authenticated || info.CSRFToken == "" {
+		t.Fatalf("GET /session = %v %+v, want a new anonymous session", w.Result().Cookies(), info)
+	}
+	return c.Name + "=" + c.Value, info.CSRFToken
+}
+
+func TestLoginFlow(t *testing.T) {
+	h := withSessions(t, newMemoryStore())
+	cookie, token := newBrowserSession(t, h)
+
+	creds := `{"username": "ada", "password": "secret"}`
+	if w := do(h, "POST", "/login", strings.NewReader(creds), "Cookie", cookie, "Content-Type", "application/json"); w.Code != http.StatusForbidden {
+		t.Fatalf("POST /login without the CSRF token = %d, want 403", w.Code)
+	}
+	if w := do(h, "POST", "/login", strings.NewReader(creds), "Content-Type", "application/json", "X-CSRF-Token", token); w.Code != http.StatusForbidden {
+		t.Fatalf("POST /login without a session = %d, want 403", w.Code)
+	}
+
+	w := do(h, "POST", "/login", strings.NewReader(creds), "Cookie", cookie, "Content-Type", "application/json", "X-CSRF-Token", token)
+	var info sessionInfo
+	decode(t, w, &info)
+	c := sessionCookie(w)
+	if w.Code != http.StatusOK || !info.Authenticated || info.User != "ada" || c == nil {
+		t.Fatalf("POST /login = %d %+v, want ada logged in", w.Code, info)
+	}
+	loggedIn := c.Name + "=" + c.Value
+	if loggedIn == cookie || info.CSRFToken == token {
+		t.Fatal("login kept the session ID or CSRF token, want both replaced")
+	}
+	if w := do(h, "GET", "/me", nil, "Cookie", cookie); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /me with the pre-login session = %d, want 401", w.Code)
+	}
+
+	w = do(h, "GET", "/me", nil, "Cookie", loggedIn)
+	var me map[string]string
+	decode(t, w, &me)
+	if w.Code != http.StatusOK || me["user"] != "ada" {
+		t.Fatalf("GET /me = %d %v, want ada", w.Code, me)
+	}
+
+	if w := do(h, "POST", "/logout", nil, "Cookie", loggedIn, "X-CSRF-Token", token); w.Code != http.StatusForbidden {
+		t.Fatalf("POST /logout with the pre-login CSRF token = %d, want 403", w.Code)
+	}
+	w = do(h, "POST", "/logout", nil, "Cookie", loggedIn, "X-CSRF-Token", info.CSRFToken)
+	if c := sessionCookie(w); w.Code != http.StatusNoContent || c == nil || c.MaxAge >= 0 {
+		t.Fatalf("POST /logout = %d, want 204 clearing the cookie", w.Code)
+	}
+	if w := do(h, "GET", "/me", nil, "Cookie", loggedIn); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /me after logout = %d, want 401", w.Code)
+	}
+}
+
+func TestLoginForm(t *testing.T) {
+	h := withSessions(t, newMemoryStore())
+
+	w := do(h, "GET", "/me", nil, "Accept", "text/html")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login?return_to=%2Fme" {
+		t.Fatalf("GET /me from a browser = %d %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+	w = do(h, "GET", "/login?return_to=/me", nil)
+	c := sessionCookie(w)
+	if w.Code != http.StatusOK || c == nil || !strings.Contains(w.Body.String(), `name="return_to" value="/me"`) {
+		t.Fatalf("GET /login = %d, want the form with a session", w.Code)
+	}
+	cookie := c.Name + "=" + c.Value
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", cookie)
+	s, err := loadSession(req)
+	if s == nil {
+		t.Fatalf("loadSession = %v, %v, want the form's session", s, err)
+	}
+
+	post := func(password, token string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"ada"}, "password": {password}, "csrf_token": {token}, "return_to": {"/me"}}
+		return do(h, "POST", "/login", strings.NewReader(form.Encode()), "Cookie", cookie, "Content-Type", "application/x-www-form-urlencoded")
+	}
+	if w := post("secret", "forged"); w.Code != http.StatusForbidden {
+		t.Fatalf("form login with a forged token = %d, want 403", w.Code)
+	}
+	if w := post("wrong", s.CSRFToken); w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login?failed") {
+		t.Fatalf("form login with the wrong password = %d %q, want back to the form", w.Code, w.Header().Get("Location"))
+	}
+	w = post("secret", s.CSRFToken)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/me" || sessionCookie(w) == nil {
+		t.Fatalf("form login = %d %q, want a redirect to /me with a new session", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestLoginRejects(t *testing.T) {
+	h := withSessions(t, newMemoryStore())
+	cookie, token := newBrowserSession(t, h)
+
+	for _, body := range []string{
+		`{"username": "ada", "password": "wrong"}`,
+		`{"username": "bob", "password": "secret"}`,
+		`{"username": "", "password": ""}`,
+	} {
+		w := do(h, "POST", "/login", strings.NewReader(body), "Cookie", cookie, "Content-Type", "application/json", "X-CSRF-Token", token)
+		var e errorResponse
+		decode(t, w, &e)
+		if w.Code != http.StatusUnauthorized || e.Code != "unauthorized" {
+			t.Errorf("POST /login %s = %d %+v, want 401", body, w.Code, e)
+		}
+	}
+	w := do(h, "POST", "/logout", nil, "Cookie", cookie, "X-CSRF-Token", token, "Sec-Fetch-Site", "cross-site")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("cross-site POST /logout = %d, want 403 even with the token", w.Code)
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	h := withSessions(t, newMemoryStore())
+
+	c := sessionCookie(do(h, "GET", "/session", nil))
+	if c == nil || c.Name != "__Host-session" || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode || c.Path != "/" || c.Domain != "" {
+		t.Fatalf("session cookie = %+v, want __Host-session, HttpOnly, Secure and SameSite=Lax", c)
+	}
+	if c.MaxAge <= 0 || c.MaxAge > int(confDuration("SESSION_TTL").Seconds()) {
+		t.Errorf("session cookie Max-Age = %d, want up to SESSION_TTL", c.MaxAge)
+	}
+
+	t.Setenv("SESSION_COOKIE_SECURE", "false")
+	t.Setenv("SESSION_COOKIE_SAMESITE", "strict")
+	c = sessionCookie(do(h, "GET", "/session", nil))
+	if c == nil || c.Name != "session" || c.Secure || c.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("session cookie for local development = %+v, want session, not Secure, SameSite=Strict", c)
+	}
+	if w := do(h, "GET", "/session", nil, "Cookie", "session=unknown"); sessionCookie(w) == nil {
+		t.Error("GET /session with an unknown ID kept it, want a new session")
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	store := newMemoryStore()
+	h := withSessions(t, store)
+	cookie, token := newBrowserSession(t, h)
+
+	t.Setenv("SESSION_ROTATE_INTERVAL", "1ms")
+	time.Sleep(2 * time.Millisecond)
+	w := do(h, "GET", "/session", nil, "Cookie", cookie)
+	var info sessionInfo
+	decode(t, w, &info)
+	c := sessionCookie(w)
+	if c == nil || c.Name+"="+c.Value == cookie || info.CSRFToken != token {
+		t.Fatalf("GET /session due for rotation = %v %+v, want a new ID and the same CSRF token", c, info)
+	}
+	rotated := c.Name + "=" + c.Value
+
+	t.Setenv("SESSION_ROTATE_INTERVAL", "1h")
+	if w := do(h, "GET", "/session", nil, "Cookie", cookie); w.Code != http.StatusOK || sessionCookie(w) != nil {
+		t.Fatalf("GET /session with the replaced ID = %d %v, want it still served within the grace period", w.Code, sessionCookie(w))
+	}
+	if w := do(h, "GET", "/session", nil, "Cookie", rotated); sessionCookie(w) != nil {
+		t.Fatalf("GET /session with the new ID set a cookie, want none before the next rotation")
+	}
+	id := strings.TrimPrefix(cookie, sessionCookieName()+"=")
+	store.sessions[id] = memorySession{data: store.sessions[id].data, expires: time.Now()}
+	if w := do(h, "GET", "/session", nil, "Cookie", cookie); sessionCookie(w) == nil {
+		t.Fatal("GET /session with the replaced ID after the grace period kept it, want a new session")
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	store := newMemoryStore()
+	h := withSessions(t, store)
+	cookie, _ := newBrowserSession(t, h)
+	id := strings.TrimPrefix(cookie, sessionCookieName()+"=")
+
+	if left := time.Until(store.sessions[id].expires); left <= 29*time.Minute || left > 30*time.Minute {
+		t.Fatalf("session kept for %s, want SESSION_IDLE_TIMEOUT", left)
+	}
+	store.sessions[id] = memorySession{data: store.sessions[id].data, expires: time.Now()}
+	if w := do(h, "GET", "/session", nil, "Cookie", cookie); sessionCookie(w) == nil {
+		t.Fatal("GET /session with an idle session kept it, want a new session")
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	withChecks(t)
+	rdb := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+rdb.Addr())
+	store, err := openSessionStore("redis")
+	if err != nil {
+		t.Fatalf("opening the redis store: %v", err)
+	}
+	h := withSessions(t, store)
+	cookie, token := newBrowserSession(t, h)
+	key := conf("SESSION_KEY_PREFIX") + strings.TrimPrefix(cookie, sessionCookieName()+"=")
+	if !rdb.Exists(key) || rdb.TTL(key) != confDuration("SESSION_IDLE_TIMEOUT") {
+		t.Fatalf("Redis keys = %v, want the session kept for SESSION_IDLE_TIMEOUT", rdb.Keys())
+	}
+
+	w := do(h, "POST", "/login", strings.NewReader(`{"username": "ada", "password": "secret"}`), "Cookie", cookie, "Content-Type", "application/json", "X-CSRF-Token", token)
+	if c := sessionCookie(w); w.Code != http.StatusOK || c == nil || rdb.Exists(key) {
+		t.Fatalf("POST /login = %d, want the pre-login session deleted", w.Code)
+	}
+	c := sessionCookie(w)
+	if w := do(h, "GET", "/me", nil, "Cookie", c.Name+"="+c.Value); w.Code != http.StatusOK {
+		t.Fatalf("GET /me = %d, want 200", w.Code)
+	}
+
+	rdb.FastForward(confDuration("SESSION_IDLE_TIMEOUT"))
+	if w := do(h, "GET", "/me", nil, "Cookie", c.Name+"="+c.Value); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /me after the idle timeout = %d, want 401", w.Code)
+	}
+
+	rdb.Close()
+	if w := do(h, "GET", "/me", nil, "Cookie", c.Name+"="+c.Value); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /me with Redis down = %d, want 503", w.Code)
+	}
+	if w := do(h, "GET", "/me", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /me without a cookie and Redis down = %d, want the request served", w.Code)
+	}
+	if _, err := openSessionStore("redis"); err != nil {
+		t.Errorf("opening the redis store with Redis down: %v, want /readyz to report it", err)
+	}
+}
+
+func TestCheckLoginUsers(t *testing.T) {
+	good := testPasswordHash(t, "secret")
+	for _, tc := range []struct {
+		value string
+		ok    bool
+	}{
+		{"", true},
+		{"ada=" + good, true},
+		{"ada=" + good + ", bob=" + good, true},
+		{"ada", false},
+		{"=" + good, false},
+		{"ada=secret", false},
+		{"ada=" + strings.Replace(good, "$600000$", "$1000$", 1), false},
+		{"ada=pbkdf2-sha256$600000$c2FsdA$" + strings.Repeat("A", 43), false},
+	} {
+		if err := checkLoginUsers(tc.value); (err == nil) != tc.ok {
+			t.Errorf("checkLoginUsers(%q) = %v, want ok %v", tc.value, err, tc.ok)
+		}
+	}
+}
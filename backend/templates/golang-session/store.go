@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A sessionStore keeps sessions by ID, as the JSON session.go encodes,
+// for ttl after each save. Two backends come with the template, picked
+// by SESSION_STORE:
+//
+//	memory  a map in the replica (store.go); sessions end with the pod,
+//	        and each replica has its own, so run one replica or make the
+//	        Service sticky
+//	redis   Redis (store_redis.go), shared by every replica and kept
+//	        across restarts
+//
+// Another backend, such as Postgres or DynamoDB, implements the interface
+// in its own file and joins the switch in openSessionStore.
+type sessionStore interface {
+	// load returns the session saved under id, or nil when there is
+	// none or it has expired.
+	load(ctx context.Context, id string) ([]byte, error)
+	save(ctx context.Context, id string, data []byte, ttl time.Duration) error
+	delete(ctx context.Context, id string) error
+}
+
+// openSessionStore opens the SESSION_STORE backend.
+func openSessionStore(backend string) (sessionStore, error) {
+	switch backend {
+	case "memory":
+		store := newMemoryStore()
+		registerBackground("session sweeper", store.sweep)
+		return store, nil
+	case "redis":
+		return openRedisStore()
+	}
+	return nil, fmt.Errorf("unknown session store %q", backend)
+}
+
+// memorySweepInterval is how often expired sessions leave memory.
+const memorySweepInterval = time.Minute
+
+type memoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	data    []byte
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{sessions: map[string]memorySession{}}
+}
+
+func (m *memoryStore) load(_ context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || !time.Now().Before(s.expires) {
+		return nil, nil
+	}
+	return s.data, nil
+}
+
+func (m *memoryStore) save(_ context.Context, id string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = memorySession{data: data, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryStore) delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// sweep drops expired sessions until ctx is done, so abandoned ones do
+// not pile up.
+func (m *memoryStore) sweep(ctx context.Context) error {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for id, s := range m.sessions {
+				if !now.Before(s.expires) {
+					delete(m.sessions, id)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The Redis session store. Each session is one key, SESSION_KEY_PREFIX
+// and the session ID, holding the session's JSON with the session's
+// expiry as its TTL, so Redis drops abandoned sessions itself. Every
+// replica shares the sessions, and they survive restarts and rollouts.
+//
+// Redis is on /readyz: without it no request can be matched to its user,
+// so a replica that cannot reach it takes no traffic.
+
+// redisConnectTimeout bounds the first ping at startup.
+const redisConnectTimeout = 5 * time.Second
+
+type redisStore struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+func openRedisStore() (*redisStore, error) {
+	if conf("REDIS_URL") == "" {
+		return nil, errors.New("SESSION_STORE=redis needs REDIS_URL")
+	}
+	opts, err := redis.ParseURL(conf("REDIS_URL"))
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL: %w", err)
+	}
+	opts.PoolSize = confInt("REDIS_POOL_SIZE")
+	opts.ContextTimeoutEnabled = true
+	redis.SetLogger(redisLogger{})
+	client := redis.NewClient(opts)
+
+	// An unreachable Redis is not fatal at startup: /readyz reports it
+	// until it comes up.
+	ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		slog.Warn("redis not reachable at startup", "error", err)
+	}
+	readinessChecks.register("redis", checkFunc(func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}), 0)
+
+	return &redisStore{client: client, prefix: conf("SESSION_KEY_PREFIX"), timeout: confDuration("REDIS_TIMEOUT")}, nil
+}
+
+func (s *redisStore) load(ctx context.Context, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.prefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *redisStore) save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+id, data, ttl).Err()
+}
+
+func (s *redisStore) delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Del(ctx, s.prefix+id).Err()
+}
+
+// redisLogger sends go-redis's internal messages, such as pool dial
+// failures, to the structured log instead of the standard logger.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.WarnContext(ctx, fmt.Sprintf(format, v...), "component", "go-redis")
+}
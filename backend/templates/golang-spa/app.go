@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The app: a single-page app's static bundle, served by static.go with
+// client-side routes falling back to index.html, and its runtime
+// configuration on /config.js (publicconfig.go). Build the frontend into
+// static/, or mount it and set STATIC_DIR. The platform endpoints
+// (probes, /metrics, /version) are served next to it, so keep the
+// frontend's routes clear of them.
+//
+//	STATIC_DIR              serve this directory instead of the embedded
+//	                        static/
+//	STATIC_IMMUTABLE_PATHS  comma-separated path prefixes holding
+//	                        content-hashed files, cached for a year
+//	                        (default /assets/)
+//	STATIC_MAX_AGE          cache lifetime of other files (default 1h)
+//
+// Add the frontend's own settings below with a PUBLIC_ prefix; they are
+// served on /config.js.
+
+var appSettings = []setting{
+	{name: "STATIC_DIR"},
+	{name: "STATIC_IMMUTABLE_PATHS", kind: kindList, def: "/assets/"},
+	{name: "STATIC_MAX_AGE", kind: kindDuration, def: "1h"},
+
+	{name: "PUBLIC_APP_NAME", def: "[% CUSTOMER_NAME | go %]", reloadable: true},
+	{name: "PUBLIC_API_URL", def: "/api", reloadable: true},
+}
+
+func setupApp(mux *http.ServeMux) error {
+	if err := checkPublicSettings(); err != nil {
+		return err
+	}
+	fsys, err := openStaticFS()
+	if err != nil {
+		return fmt.Errorf("static bundle: %w", err)
+	}
+
+	mux.HandleFunc("GET /config.js", configScriptHandler)
+	mux.HandleFunc("GET /config.json", configJSONHandler)
+	mux.HandleFunc("/", staticHandler(fsys))
+	return nil
+}
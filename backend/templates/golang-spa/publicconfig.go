@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Runtime configuration for the frontend. A bundle is built once and
+// promoted from dev to prod unchanged, so values that differ between
+// environments (API URLs, feature flags, analytics keys) are served by
+// the app rather than baked in at build time. Every setting in
+// appSettings whose name starts with PUBLIC_ is exposed, with its declared
+// type (durations in milliseconds):
+//
+//	GET /config.js    window.__APP_CONFIG__ = {"PUBLIC_API_URL": "/api"};
+//	GET /config.json  the same object as JSON
+//
+// index.html loads /config.js before the bundle, so the values are there
+// when the app starts. Both are sent with no-store, and reloadable PUBLIC_
+// settings take effect on the next page load. Never give a PUBLIC_
+// setting a secret value: anyone who can load the page can read it.
+
+const publicPrefix = "PUBLIC_"
+
+// checkPublicSettings refuses a PUBLIC_ setting marked secret, which would
+// otherwise be served to every visitor.
+func checkPublicSettings() error {
+	for _, s := range appSettings {
+		if strings.HasPrefix(s.name, publicPrefix) && s.secret {
+			return errors.New(s.name + " is marked secret but PUBLIC_ settings are served to browsers")
+		}
+	}
+	return nil
+}
+
+// publicConfig is the current value of every PUBLIC_ setting.
+func publicConfig() map[string]any {
+	values := map[string]any{}
+	for _, s := range appSettings {
+		if !strings.HasPrefix(s.name, publicPrefix) {
+			continue
+		}
+		switch s.kind {
+		case kindBool:
+			values[s.name] = confBool(s.name)
+		case kindInt:
+			values[s.name] = confInt(s.name)
+		case kindFloat:
+			values[s.name] = confFloat(s.name)
+		case kindDuration:
+			values[s.name] = confDuration(s.name).Milliseconds()
+		case kindList:
+			values[s.name] = append([]string{}, confList(s.name)...)
+		default:
+			values[s.name] = conf(s.name)
+		}
+	}
+	return values
+}
+
+// configScriptHandler serves /config.js. encoding/json escapes <, > and
+// &, so a value cannot end the script early.
+func configScriptHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(publicConfig())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "encoding config failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte("window.__APP_CONFIG__ = " + string(body) + ";\n"))
+}
+
+func configJSONHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, publicConfig())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Static file serving for a single-page app. The bundle is static/,
+// embedded into the binary at build time, or the directory named by
+// STATIC_DIR, e.g. a volume an init container fills, read on every
+// request so it can change without a restart.
+//
+// A request for a file that exists is served as-is. Any other GET for a
+// path without an extension, from a client that accepts HTML, is a route
+// handled by the app's client-side router and gets index.html; a missing
+// file with an extension (a stale chunk, a typo) is a 404, so the browser
+// sees an error instead of HTML where it expected JavaScript. Paths with
+// a segment starting with a dot are never served.
+//
+// Cache headers follow what the bundle's file names promise:
+//
+//	index.html              no-cache: revalidated on every load, so a
+//	                        deploy reaches clients at once
+//	STATIC_IMMUTABLE_PATHS  public, max-age=1y, immutable: build tools put
+//	                        content-hashed files here (/assets/ for Vite)
+//	everything else         public, max-age=STATIC_MAX_AGE
+//
+// Every response carries an ETag from the file's content, so revalidation
+// costs a 304 rather than the file.
+
+//go:embed static
+var embeddedStatic embed.FS
+
+const (
+	indexFile           = "index.html"
+	immutableCacheValue = "public, max-age=31536000, immutable"
+)
+
+// openStaticFS returns the bundle to serve and checks it has index.html.
+func openStaticFS() (fs.FS, error) {
+	var fsys fs.FS
+	if dir := conf("STATIC_DIR"); dir != "" {
+		fsys = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(embeddedStatic, "static")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	}
+	if _, err := fs.Stat(fsys, indexFile); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func staticHandler(fsys fs.FS) http.HandlerFunc {
+	etags := &etagCache{entries: map[string]etagEntry{}}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed("GET, HEAD")(w, r)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = indexFile
+		}
+		if hiddenPath(name) {
+			writeError(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		f, info, err := openFile(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) && path.Ext(name) == "" && acceptsHTML(r) {
+			name = indexFile
+			f, info, err = openFile(fsys, name)
+		}
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			writeError(w, r, http.StatusNotFound, "not found")
+			return
+		case err != nil:
+			requestLogger(r).Error("opening static file failed", "file", name, "error", err)
+			writeError(w, r, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		defer f.Close()
+
+		content, ok := f.(io.ReadSeeker)
+		if !ok {
+			writeError(w, r, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		etag, err := etags.get(name, info, content)
+		if err != nil {
+			requestLogger(r).Error("reading static file failed", "file", name, "error", err)
+			writeError(w, r, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		h := w.Header()
+		h.Set("ETag", etag)
+		h.Set("Cache-Control", cacheControl(name))
+		h.Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, name, info.ModTime(), content)
+	}
+}
+
+// openFile opens a regular file; directories count as missing.
+func openFile(fsys fs.FS, name string) (fs.File, fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func hiddenPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsHTML reports whether the request is a browser navigation rather
+// than a fetch for data, so API typos get a 404 instead of index.html.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func cacheControl(name string) string {
+	if name == indexFile {
+		return "no-cache"
+	}
+	for _, prefix := range confList("STATIC_IMMUTABLE_PATHS") {
+		if strings.HasPrefix("/"+name, "/"+strings.Trim(prefix, "/")+"/") {
+			return immutableCacheValue
+		}
+	}
+	return "public, max-age=" + strconv.Itoa(int(confDuration("STATIC_MAX_AGE")/time.Second))
+}
+
+// etagCache remembers each file's ETag until its size or modification
+// time changes, so files are hashed once rather than on every request.
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func (c *etagCache) get(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	e = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`}
+	c.mu.Lock()
+	c.entries[name] = e
+	c.mu.Unlock()
+	return e.etag, nil
+}
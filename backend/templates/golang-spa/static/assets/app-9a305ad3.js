@@ -0,0 +1,62 @@
+// A minimal client-side router standing in for the real frontend: replace
+// static/ with your build output. Runtime configuration is read from
+// window.__APP_CONFIG__, set by /config.js before this script runs.
+(function () {
+  'use strict';
+
+  var config = window.__APP_CONFIG__ || {};
+
+  var routes = {
+    '/': function () {
+      return '<h2>Home</h2>' +
+        '<p>This page is rendered in the browser. Reload it, or any other ' +
+        'route, and the server answers with index.html.</p>';
+    },
+    '/about': function () {
+      return '<h2>About</h2><p>Served by a Go binary with the bundle embedded.</p>';
+    },
+    '/config': function () {
+      return '<h2>Runtime configuration</h2>' +
+        '<p>From <code>/config.js</code>; change it with <code>PUBLIC_</code> settings, no rebuild needed.</p>' +
+        '<pre>' + escapeHTML(JSON.stringify(config, null, 2)) + '</pre>';
+    }
+  };
+
+  function escapeHTML(s) {
+    return s.replace(/[&<>"']/g, function (c) {
+      return { '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c];
+    });
+  }
+
+  function render() {
+    var path = window.location.pathname;
+    var view = routes[path] || function () {
+      return '<h2>Not found</h2><p>No route for <code>' + escapeHTML(path) + '</code>.</p>';
+    };
+    document.getElementById('app').innerHTML = view();
+    document.querySelectorAll('nav a').forEach(function (a) {
+      if (a.getAttribute('href') === path) {
+        a.setAttribute('aria-current', 'page');
+      } else {
+        a.removeAttribute('aria-current');
+      }
+    });
+  }
+
+  document.addEventListener('click', function (e) {
+    var a = e.target.closest('a[data-link]');
+    if (!a || e.metaKey || e.ctrlKey || e.shiftKey) {
+      return;
+    }
+    e.preventDefault();
+    window.history.pushState(null, '', a.getAttribute('href'));
+    render();
+  });
+  window.addEventListener('popstate', render);
+
+  if (config.PUBLIC_APP_NAME) {
+    document.title = config.PUBLIC_APP_NAME;
+    document.getElementById('app-name').textContent = config.PUBLIC_APP_NAME;
+  }
+  render();
+})();
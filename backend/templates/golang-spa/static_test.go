@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testBundle stands in for a built frontend, so the tests keep passing as
+// the real bundle's file names change.
+var testBundle = fstest.MapFS{
+	"index.html":           {Data: []byte("<!doctype html><title>app</title>")},
+	"favicon.ico":          {Data: []byte("icon")},
+	"assets/app-1a2b3c.js": {Data: []byte("console.log('app')")},
+	".env":                 {Data: []byte("SECRET=1")},
+	"assets/.map/app.js":   {Data: []byte("{}")},
+}
+
+func TestEmbeddedBundle(t *testing.T) {
+	if _, err := openStaticFS(); err != nil {
+		t.Fatalf("embedded static/: %v, want a bundle with index.html", err)
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	h := staticHandler(testBundle)
+	for _, tc := range []struct {
+		method, path, accept string
+		wantCode             int
+		wantBody             string
+		wantCache            string
+	}{
+		{"GET", "/", "text/html", http.StatusOK, "<!doctype html>", "no-cache"},
+		{"GET", "/assets/app-1a2b3c.js", "*/*", http.StatusOK, "console.log", immutableCacheValue},
+		{"GET", "/favicon.ico", "*/*", http.StatusOK, "icon", "public, max-age=3600"},
+		{"GET", "/settings/profile", "text/html,application/xhtml+xml", http.StatusOK, "<!doctype html>", "no-cache"},
+		{"HEAD", "/settings/profile", "text/html", http.StatusOK, "", "no-cache"},
+		{"GET", "/api/items", "application/json", http.StatusNotFound, "", ""},
+		{"GET", "/assets/app-old.js", "text/html", http.StatusNotFound, "", ""},
+		{"GET", "/assets", "text/html", http.StatusOK, "<!doctype html>", "no-cache"},
+		{"GET", "/.env", "*/*", http.StatusNotFound, "", ""},
+		{"GET", "/assets/.map/app.js", "*/*", http.StatusNotFound, "", ""},
+		{"GET", "/../index.html", "text/html", http.StatusOK, "<!doctype html>", "no-cache"},
+		{"POST", "/", "text/html", http.StatusMethodNotAllowed, "", ""},
+	} {
+		w := do(h, tc.method, tc.path, nil, "Accept", tc.accept)
+		if w.Code != tc.wantCode || !strings.HasPrefix(w.Body.String(), tc.wantBody) {
+			t.Errorf("%s %s = %d %q, want %d %q", tc.method, tc.path, w.Code, w.Body, tc.wantCode, tc.wantBody)
+		}
+		if tc.wantCache != "" && w.Header().Get("Cache-Control") != tc.wantCache {
+			t.Errorf("%s %s Cache-Control = %q, want %q", tc.method, tc.path, w.Header().Get("Cache-Control"), tc.wantCache)
+		}
+	}
+}
+
+func TestStaticImmutablePaths(t *testing.T) {
+	t.Setenv("STATIC_IMMUTABLE_PATHS", "/static/js")
+	if got := cacheControl("static/js/main.js"); got != immutableCacheValue {
+		t.Errorf("cacheControl under STATIC_IMMUTABLE_PATHS = %q, want %q", got, immutableCacheValue)
+	}
+	if got := cacheControl("static/jsx/main.js"); got == immutableCacheValue {
+		t.Errorf("cacheControl beside STATIC_IMMUTABLE_PATHS = %q, want the default", got)
+	}
+}
+
+func TestStaticETag(t *testing.T) {
+	h := staticHandler(testBundle)
+	etag := do(h, "GET", "/favicon.ico", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /favicon.ico sent no ETag")
+	}
+	if w := do(h, "GET", "/favicon.ico", nil, "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Fatalf("GET /favicon.ico with If-None-Match = %d, want 304", w.Code)
+	}
+}
+
+func TestPublicConfig(t *testing.T) {
+	t.Setenv("PUBLIC_API_URL", "https://api.example.com")
+
+	w := do(http.HandlerFunc(configScriptHandler), "GET", "/config.js", nil)
+	if body := w.Body.String(); !strings.HasPrefix(body, "window.__APP_CONFIG__ = {") ||
+		!strings.Contains(body, `"PUBLIC_API_URL":"https://api.example.com"`) ||
+		w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("GET /config.js = %q, want the PUBLIC_ settings, uncached", body)
+	}
+
+	w = do(http.HandlerFunc(configJSONHandler), "GET", "/config.json", nil)
+	var config map[string]any
+	decode(t, w, &config)
+	if config["PUBLIC_API_URL"] != "https://api.example.com" || config["STATIC_DIR"] != nil {
+		t.Fatalf("GET /config.json = %v, want only the PUBLIC_ settings", config)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// The app: an event stream on GET /events next to the landing page, for
+// dashboards and notification feeds. broker.go fans events out to the
+// open streams and sse.go serves them; POST /notifications publishes a
+// sample event:
+//
+//	GET /events          text/event-stream of notification events, with
+//	                     heartbeat events in between
+//	POST /notifications  {"message": "...", "level": "info"} publishes a
+//	                     notification to every stream on this replica
+//
+//	SSE_HEARTBEAT_INTERVAL  time between heartbeat events (default 15s);
+//	                        keep it under the ingress's idle timeout
+//	SSE_RETRY               reconnect delay sent to clients (default 3s)
+//	SSE_HISTORY             recent events kept for clients reconnecting
+//	                        with Last-Event-ID (default 100)
+//	SSE_BUFFER              events queued per stream before a slow client
+//	                        is disconnected (default 32)
+//	SSE_MAX_STREAMS         open streams per replica; more are refused
+//	                        with a 503 (default 1000)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "SSE_HEARTBEAT_INTERVAL", kind: kindDuration, def: "15s"},
+	{name: "SSE_RETRY", kind: kindDuration, def: "3s"},
+	{name: "SSE_HISTORY", kind: kindInt, def: "100", check: atLeast(0)},
+	{name: "SSE_BUFFER", kind: kindInt, def: "32", check: atLeast(1)},
+	{name: "SSE_MAX_STREAMS", kind: kindInt, def: "1000", check: atLeast(1)},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	appBroker = newBroker(confInt("SSE_HISTORY"), confInt("SSE_MAX_STREAMS"), confInt("SSE_BUFFER"))
+	registerBackground("broker", appBroker.run)
+	registerMetrics(appBroker.writeMetrics)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("GET /events", streamHandler)
+	// Streams last as long as their clients stay.
+	setRouteTimeout("/events", 0)
+	mux.HandleFunc("/events", methodNotAllowed("GET, HEAD"))
+	mux.HandleFunc("POST /notifications", publishHandler)
+	mux.HandleFunc("/notifications", methodNotAllowed("POST"))
+	return nil
+}
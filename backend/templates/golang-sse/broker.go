@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The broker fans published events out to this replica's streams. Every
+// event gets an ID and is kept in a history of the last SSE_HISTORY
+// events, so a client that reconnects with Last-Event-ID (which
+// EventSource sends on its own) is first sent what it missed. IDs are
+// "<epoch>-<seq>", where epoch is when this process started: a client
+// reconnecting to another replica, or after a restart, has an ID from a
+// different epoch and gets live events only. Events published on one
+// replica reach only its streams; to fan out across replicas, publish
+// through a shared bus (Redis pub/sub, NATS, Kafka) and call publish from
+// its subscriber on every replica.
+//
+// Each stream has a buffer of SSE_BUFFER events. A client too slow to
+// keep up is disconnected rather than holding up publishers; it
+// reconnects and catches up from the history. When shutdown begins the
+// broker ends every stream, so the HTTP server's graceful shutdown is not
+// held up by responses that never finish, and clients reconnect to
+// another replica.
+//
+// SSE metrics, served on /metrics after the HTTP ones:
+//
+//	sse_streams            gauge    open streams
+//	sse_events_total       counter  events published
+//	sse_disconnects_total  counter  reason (client, slow, shutdown)
+
+// Disconnect reasons, the reason label of sse_disconnects_total.
+const (
+	disconnectClient   = "client"
+	disconnectSlow     = "slow"
+	disconnectShutdown = "shutdown"
+)
+
+var (
+	errBrokerClosed = errors.New("server shutting down")
+	errBrokerFull   = errors.New("too many streams")
+)
+
+type event struct {
+	id   uint64
+	typ  string
+	data string
+}
+
+// subscriber is one open stream.
+type subscriber struct {
+	events chan event
+	// done is closed when the broker ends the stream, with reason saying
+	// why.
+	done   chan struct{}
+	reason string
+}
+
+type broker struct {
+	mu      sync.Mutex
+	epoch   string
+	nextID  uint64
+	history []event
+	subs    map[*subscriber]struct{}
+	closed  bool
+
+	maxHistory  int
+	maxStreams  int
+	bufferSize  int
+	published   uint64
+	disconnects map[string]uint64
+}
+
+func newBroker(maxHistory, maxStreams, bufferSize int) *broker {
+	return &broker{
+		epoch:       strconv.FormatInt(time.Now().UnixMilli(), 10),
+		nextID:      1,
+		subs:        map[*subscriber]struct{}{},
+		maxHistory:  maxHistory,
+		maxStreams:  maxStreams,
+		bufferSize:  bufferSize,
+		disconnects: map[string]uint64{},
+	}
+}
+
+// eventID formats an event ID for the id field.
+func (b *broker) eventID(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// publish sends an event of the given type to every stream. data may span
+// several lines.
+func (b *broker) publish(typ, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ev := event{id: b.nextID, typ: typ, data: data}
+	b.nextID++
+	b.published++
+	b.history = append(b.history, ev)
+	if len(b.history) > b.maxHistory {
+		b.history = append(b.history[:0], b.history[len(b.history)-b.maxHistory:]...)
+	}
+	for s := range b.subs {
+		select {
+		case s.events <- ev:
+		default:
+			b.endLocked(s, disconnectSlow)
+		}
+	}
+}
+
+// subscribe opens a stream. lastEventID is the client's Last-Event-ID,
+// or ""; the events after it still in the history are returned to send
+// first. Registering and reading the history happen together, so the
+// client sees every event exactly once.
+func (b *broker) subscribe(lastEventID string) (*subscriber, []event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.closed:
+		return nil, nil, errBrokerClosed
+	case len(b.subs) >= b.maxStreams:
+		return nil, nil, errBrokerFull
+	}
+	s := &subscriber{events: make(chan event, b.bufferSize), done: make(chan struct{})}
+	b.subs[s] = struct{}{}
+
+	var backlog []event
+	if epoch, seq, ok := strings.Cut(lastEventID, "-"); ok && epoch == b.epoch {
+		if after, err := strconv.ParseUint(seq, 10, 64); err == nil {
+			for _, ev := range b.history {
+				if ev.id > after {
+					backlog = append(backlog, ev)
+				}
+			}
+		}
+	}
+	return s, backlog, nil
+}
+
+// unsubscribe closes a stream the client ended.
+func (b *broker) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endLocked(s, disconnectClient)
+}
+
+func (b *broker) endLocked(s *subscriber, reason string) {
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	s.reason = reason
+	close(s.done)
+	b.disconnects[reason]++
+}
+
+// run waits for shutdown, then ends every stream.
+func (b *broker) run(ctx context.Context) error {
+	<-ctx.Done()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		b.endLocked(s, disconnectShutdown)
+	}
+	return nil
+}
+
+func (b *broker) writeMetrics(out io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP sse_streams Open event streams.")
+	fmt.Fprintln(out, "# TYPE sse_streams gauge")
+	fmt.Fprintf(out, "sse_streams %d\n", len(b.subs))
+
+	fmt.Fprintln(out, "# HELP sse_events_total Events published.")
+	fmt.Fprintln(out, "# TYPE sse_events_total counter")
+	fmt.Fprintf(out, "sse_events_total %d\n", b.published)
+
+	fmt.Fprintln(out, "# HELP sse_disconnects_total Ended event streams by reason.")
+	fmt.Fprintln(out, "# TYPE sse_disconnects_total counter")
+	for _, reason := range []string{disconnectClient, disconnectSlow, disconnectShutdown} {
+		fmt.Fprintf(out, "sse_disconnects_total{reason=%q} %d\n", reason, b.disconnects[reason])
+	}
+}
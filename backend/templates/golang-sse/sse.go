@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server-Sent Events over a long-lived GET response. Each event is
+// flushed as soon as it is written; nothing is buffered between events,
+// and text/event-stream is never compressed. A heartbeat event every
+// SSE_HEARTBEAT_INTERVAL keeps proxies and load balancers from closing
+// an idle stream and lets clients notice a dead one. A client that goes
+// away is noticed when the request context ends or a write fails,
+// whichever comes first, and its stream is closed at once.
+//
+// Streams outlive the server's HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT,
+// which bound whole requests: the handler lifts both deadlines for its
+// own response, leaving them in force for every other route.
+
+// appBroker is the event broker, created by setupApp.
+var appBroker *broker
+
+// sseWriter writes events in the text/event-stream format.
+type sseWriter struct {
+	w  *bufio.Writer
+	rc *http.ResponseController
+}
+
+// writeEvent writes one event and flushes it to the client. Every line of
+// data gets its own data field; EventSource joins them back with "\n".
+func (sw *sseWriter) writeEvent(id, typ, data string) error {
+	if id != "" {
+		sw.w.WriteString("id: " + id + "\n")
+	}
+	if typ != "" {
+		sw.w.WriteString("event: " + typ + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		sw.w.WriteString("data: " + line + "\n")
+	}
+	sw.w.WriteString("\n")
+	return sw.flush()
+}
+
+func (sw *sseWriter) flush() error {
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	return sw.rc.Flush()
+}
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "text/event-stream")
+		return
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		requestLogger(r).Error("event stream unsupported by the connection", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	rc.SetWriteDeadline(time.Time{})
+
+	sub, backlog, err := appBroker.subscribe(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer appBroker.unsubscribe(sub)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	// Tells nginx-based proxies not to buffer the response.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sw := &sseWriter{w: bufio.NewWriter(w), rc: rc}
+	sw.w.WriteString("retry: " + strconv.FormatInt(confDuration("SSE_RETRY").Milliseconds(), 10) + "\n\n")
+	for _, ev := range backlog {
+		sw.writeEvent(appBroker.eventID(ev.id), ev.typ, ev.data)
+	}
+	if err := sw.flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(confDuration("SSE_HEARTBEAT_INTERVAL"))
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case ev := <-sub.events:
+			err = sw.writeEvent(appBroker.eventID(ev.id), ev.typ, ev.data)
+		case now := <-heartbeat.C:
+			err = sw.writeEvent("", "heartbeat", `{"time":"`+now.UTC().Format(time.RFC3339)+`"}`)
+		case <-sub.done:
+			if sub.reason == disconnectSlow {
+				requestLogger(r).Warn("event stream too slow, disconnecting")
+			}
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// notification is the body of POST /notifications.
+type notification struct {
+	Message string `json:"message"`
+	Level   string `json:"level"`
+}
+
+// publishHandler sends a notification event to every stream on this
+// replica. It stands in for the app's own event sources; call
+// appBroker.publish wherever something worth pushing happens.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	var n notification
+	if err := readJSON(w, r, &n); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	n.Message = strings.TrimSpace(n.Message)
+	if n.Level == "" {
+		n.Level = "info"
+	}
+	switch {
+	case n.Message == "":
+		writeError(w, r, http.StatusUnprocessableEntity, "message is required")
+		return
+	case n.Level != "info" && n.Level != "warning" && n.Level != "error":
+		writeError(w, r, http.StatusUnprocessableEntity, "level must be info, warning or error")
+		return
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"message": n.Message,
+		"level":   n.Level,
+		"sent_at": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "encoding event failed")
+		return
+	}
+	appBroker.publish("notification", string(data))
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "published"})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSSEServer serves the stream and publish handlers on a test listener
+// with a fresh broker allowing maxStreams streams.
+func newSSEServer(t *testing.T, maxStreams int) *httptest.Server {
+	t.Helper()
+	appBroker = newBroker(10, maxStreams, 4)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events", streamHandler)
+	mux.HandleFunc("POST /notifications", publishHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// sseEvent is one parsed event; data lines are joined with "\n".
+type sseEvent struct {
+	id, typ, data string
+}
+
+// openStream starts GET /events, with Last-Event-ID when lastEventID is
+// set, and returns a reader positioned after the retry field. It returns
+// once the broker has registered the stream.
+func openStream(t *testing.T, srv *httptest.Server, lastEventID string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /events = %d %s, want 200 text/event-stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(resp.Body)
+	if line, _ := stream.ReadString('\n'); !strings.HasPrefix(line, "retry: ") {
+		t.Fatalf("first line = %q, want the retry field", line)
+	}
+	stream.ReadString('\n')
+	return stream
+}
+
+// readEvent reads the next event, skipping heartbeats.
+func readEvent(t *testing.T, stream *bufio.Reader) sseEvent {
+	t.Helper()
+	for {
+		var ev sseEvent
+		var data []string
+		for {
+			line, err := stream.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading the stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				ev.id = value
+			case "event":
+				ev.typ = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+		ev.data = strings.Join(data, "\n")
+		if ev.typ != "heartbeat" {
+			return ev
+		}
+	}
+}
+
+func TestStreamReceivesNotifications(t *testing.T) {
+	srv := newSSEServer(t, 10)
+	stream := openStream(t, srv, "")
+
+	resp, err := srv.Client().Post(srv.URL+"/notifications", "application/json",
+		strings.NewReader(`{"message": " Deploy finished ", "level": "warning"}`))
+	if err != nil {
+		t.Fatalf("POST /notifications: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /notifications = %d, want 202", resp.StatusCode)
+	}
+
+	ev := readEvent(t, stream)
+	var n map[string]string
+	if err := json.Unmarshal([]byte(ev.data), &n); err != nil || ev.typ != "notification" || ev.id != appBroker.eventID(1) ||
+		n["message"] != "Deploy finished" || n["level"] != "warning" {
+		t.Fatalf("event = %+v, want notification %s with the trimmed message", ev, appBroker.eventID(1))
+	}
+}
+
+func TestLastEventIDReplay(t *testing.T) {
+	srv := newSSEServer(t, 10)
+	for _, data := range []string{"one", "two", "three\nlines"} {
+		appBroker.publish("notification", data)
+	}
+
+	stream := openStream(t, srv, appBroker.eventID(1))
+	for _, want := range []sseEvent{
+		{id: appBroker.eventID(2), typ: "notification", data: "two"},
+		{id: appBroker.eventID(3), typ: "notification", data: "three\nlines"},
+	} {
+		if got := readEvent(t, stream); got != want {
+			t.Fatalf("replayed event = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestPublishValidation(t *testing.T) {
+	appBroker = newBroker(10, 10, 4)
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"message": "hi"}`, http.StatusAccepted},
+		{`{"message": "   "}`, http.StatusUnprocessableEntity},
+		{`{"message": "hi", "level": "debug"}`, http.StatusUnprocessableEntity},
+		{`{"message": "hi", "extra": true}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	} {
+		if w := do(http.HandlerFunc(publishHandler), "POST", "/notifications", strings.NewReader(tc.body)); w.Code != tc.want {
+			t.Errorf("POST /notifications %s = %d, want %d", tc.body, w.Code, tc.want)
+		}
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	srv := newSSEServer(t, 1)
+	openStream(t, srv, "")
+
+	resp, err := srv.Client().Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("GET /events past SSE_MAX_STREAMS = %d, want 503 with Retry-After", resp.StatusCode)
+	}
+}
+
+func TestShutdownEndsStreams(t *testing.T) {
+	srv := newSSEServer(t, 10)
+	stream := openStream(t, srv, "")
+
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+	appBroker.run(ctx)
+	if rest, err := io.ReadAll(stream); err != nil || len(rest) != 0 {
+		t.Fatalf("stream after shutdown = %q, %v, want it to end", rest, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The app: a JSON API shared by several tenants, next to the landing
+// page. tenant.go resolves each request's tenant and refuses requests
+// without a known one; the handlers here only ever see their own
+// tenant's data:
+//
+//	GET /v1/tenant   the tenant's profile: name, plan and settings
+//	GET /v1/notes    the tenant's notes, oldest first
+//	POST /v1/notes   {"text": "..."} adds a note, up to the tenant's
+//	                 max_notes (403 beyond)
+//
+//	TENANTS_FILE   JSON registry of the tenants and their configuration;
+//	               unset serves the sample tenants.json
+//	TENANT_DOMAIN  domain whose subdomains name tenants, e.g.
+//	               api.example.com for acme.api.example.com; unset
+//	               resolves tenants by header only
+//	TENANT_HEADER  header naming the tenant (default X-Tenant-Id)
+//	TENANT_PATHS   comma-separated path prefixes that need a tenant
+//	               (default /v1); probes, metrics and the landing page
+//	               are served without one
+//
+// Notes are kept in memory, per replica. An app with a database keys its
+// tables by tenant ID the same way, from tenantFromContext.
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "TENANTS_FILE"},
+	{name: "TENANT_DOMAIN"},
+	{name: "TENANT_HEADER", def: "X-Tenant-Id"},
+	{name: "TENANT_PATHS", kind: kindList, def: "/v1"},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	if !protectedPath("/v1/", confList("TENANT_PATHS")) {
+		return errors.New("TENANT_PATHS must cover /v1, whose handlers serve a tenant's data")
+	}
+	tenants, err := loadTenants()
+	if err != nil {
+		return err
+	}
+	resolver := newTenantResolver(tenants)
+	useMiddleware(func(next http.Handler) http.Handler { return tenantMiddleware(resolver, next) })
+	registerMetrics(resolver.stats.writeMetrics)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("GET /v1/tenant", tenantHandler)
+	mux.HandleFunc("/v1/tenant", methodNotAllowed("GET, HEAD"))
+	mux.HandleFunc("GET /v1/notes", listNotesHandler)
+	mux.HandleFunc("POST /v1/notes", createNoteHandler)
+	mux.HandleFunc("/v1/notes", methodNotAllowed("GET, HEAD, POST"))
+	return nil
+}
+
+func tenantHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, tenantFromContext(r.Context()))
+}
+
+type note struct {
+	ID        int       `json:"id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// noteStore keeps each tenant's notes apart.
+type noteStore struct {
+	mu    sync.Mutex
+	notes map[string][]note
+}
+
+var appNotes = &noteStore{notes: map[string][]note{}}
+
+func (s *noteStore) list(tenantID string) []note {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.notes[tenantID])
+}
+
+// add stores a note for t, or returns false if t has max_notes already.
+func (s *noteStore) add(t *tenant, text string) (note, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	notes := s.notes[t.ID]
+	if t.MaxNotes > 0 && len(notes) >= t.MaxNotes {
+		return note{}, false
+	}
+	n := note{ID: len(notes) + 1, Text: text, CreatedAt: time.Now().UTC()}
+	s.notes[t.ID] = append(notes, n)
+	return n, true
+}
+
+func listNotesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, appNotes.list(tenantFromContext(r.Context()).ID))
+}
+
+func createNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	if strings.TrimSpace(body.Text) == "" {
+		writeError(w, r, http.StatusBadRequest, "text is required")
+		return
+	}
+	t := tenantFromContext(r.Context())
+	n, ok := appNotes.add(t, body.Text)
+	if !ok {
+		writeError(w, r, http.StatusForbidden, "note limit of the "+t.Plan+" plan reached")
+		return
+	}
+	requestLogger(r).Info("note added", "note_id", n.ID)
+	writeJSON(w, http.StatusCreated, n)
+}
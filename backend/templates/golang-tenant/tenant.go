@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Tenants are the customers sharing this deployment. Each request on
+// TENANT_PATHS names its tenant, by the subdomain of TENANT_DOMAIN it was
+// sent to (acme.api.example.com) or by the TENANT_HEADER header a gateway
+// sets; tenantMiddleware looks the tenant up in the registry and turns the
+// request away if it names none, or one the registry does not know.
+//
+// The registry is TENANTS_FILE, a JSON object from tenant ID to its
+// configuration, read at startup; the tenants.json built into the binary
+// stands in when it is not set:
+//
+//	{"acme": {"name": "Acme Corp", "plan": "enterprise", "max_notes": 1000,
+//	          "settings": {"region": "eu-west-1"}}}
+//
+// Tenant IDs are DNS labels, so every ID can be a subdomain. Metrics are
+// labelled with the tenant only once it is known to the registry, which
+// keeps the number of series bounded however many IDs clients make up.
+
+//go:embed tenants.json
+var sampleTenants []byte
+
+// tenant is one tenant's configuration.
+type tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Plan string `json:"plan"`
+	// Disabled tenants are turned away as if they were unknown.
+	Disabled bool `json:"disabled,omitempty"`
+	// MaxNotes caps the tenant's notes; 0 is no limit.
+	MaxNotes int `json:"max_notes,omitempty"`
+	// Settings are the tenant's own values for app settings.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// tenantIDPattern restricts tenant IDs to DNS labels.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// parseTenants parses a registry, giving each tenant its ID.
+func parseTenants(data []byte) (map[string]*tenant, error) {
+	var tenants map[string]*tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("no tenants")
+	}
+	for id, t := range tenants {
+		if !tenantIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("tenant ID %q is not a DNS label: lowercase letters, digits and dashes, at most 63 characters", id)
+		}
+		if t == nil {
+			return nil, fmt.Errorf("tenant %s has no configuration", id)
+		}
+		if t.MaxNotes < 0 {
+			return nil, fmt.Errorf("tenant %s: max_notes must not be negative", id)
+		}
+		t.ID = id
+	}
+	return tenants, nil
+}
+
+// loadTenants reads TENANTS_FILE, or the sample registry if it is unset.
+func loadTenants() (map[string]*tenant, error) {
+	data, path := sampleTenants, conf("TENANTS_FILE")
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("TENANTS_FILE: %w", err)
+		}
+	}
+	tenants, err := parseTenants(data)
+	if err != nil && path != "" {
+		return nil, fmt.Errorf("TENANTS_FILE %s: %w", path, err)
+	}
+	return tenants, err
+}
+
+// Reasons a request is turned away, as tenant_rejections_total labels them.
+const (
+	rejectMissing  = "missing"
+	rejectUnknown  = "unknown"
+	rejectMismatch = "mismatch"
+)
+
+// tenantResolver finds the tenant of a request.
+type tenantResolver struct {
+	tenants map[string]*tenant
+	header  string
+	// domain is TENANT_DOMAIN with a leading dot, or "" if subdomains
+	// do not name tenants.
+	domain string
+	paths  []string
+	stats  *tenantStats
+}
+
+func newTenantResolver(tenants map[string]*tenant) *tenantResolver {
+	res := &tenantResolver{
+		tenants: tenants,
+		header:  http.CanonicalHeaderKey(conf("TENANT_HEADER")),
+		paths:   confList("TENANT_PATHS"),
+		stats:   newTenantStats(),
+	}
+	if d := strings.Trim(strings.ToLower(conf("TENANT_DOMAIN")), "."); d != "" {
+		res.domain = "." + d
+	}
+	return res
+}
+
+// subdomain returns the label of host in front of the tenant domain, or
+// "" if host is not a direct subdomain of it.
+func (res *tenantResolver) subdomain(host string) string {
+	if res.domain == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), res.domain)
+	if !ok || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
+
+// resolve returns the tenant of r, or the reason there is none. The
+// subdomain wins over the header, and a header naming another tenant is
+// refused rather than trusted over the host the client connected to.
+func (res *tenantResolver) resolve(r *http.Request) (*tenant, string) {
+	id, header := res.subdomain(r.Host), r.Header.Get(res.header)
+	switch {
+	case id == "" && header == "":
+		return nil, rejectMissing
+	case id == "":
+		id = header
+	case header != "" && header != id:
+		return nil, rejectMismatch
+	}
+	t := res.tenants[id]
+	if t == nil || t.Disabled {
+		return nil, rejectUnknown
+	}
+	return t, ""
+}
+
+// tenantKey is the context key of the request's *tenant.
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant tenantMiddleware resolved, or nil
+// outside TENANT_PATHS.
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// tenantMiddleware requires a known tenant on TENANT_PATHS and puts it in
+// the request context, and in the request's log lines, error reports and
+// metrics.
+func tenantMiddleware(res *tenantResolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) || !protectedPath(r.URL.Path, res.paths) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, reason := res.resolve(r)
+		if t == nil {
+			res.stats.rejected(reason)
+			switch reason {
+			case rejectMissing:
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("tenant required: use a subdomain or the %s header", res.header))
+			case rejectMismatch:
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("the %s header names another tenant than the host", res.header))
+			default:
+				requestLogger(r).Info("rejected unknown tenant")
+				writeError(w, r, http.StatusNotFound, "unknown tenant")
+			}
+			return
+		}
+		r = setTenantID(r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)), t.ID)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		res.stats.served(t.ID, rec.statusCode())
+	})
+}
+
+// tenantStats counts requests by tenant.
+type tenantStats struct {
+	mu         sync.Mutex
+	requests   map[tenantRequestKey]int64
+	rejections map[string]int64
+}
+
+type tenantRequestKey struct {
+	tenant      string
+	statusClass string
+}
+
+func newTenantStats() *tenantStats {
+	return &tenantStats{requests: map[tenantRequestKey]int64{}, rejections: map[string]int64{}}
+}
+
+func (s *tenantStats) served(tenant string, code int) {
+	s.mu.Lock()
+	s.requests[tenantRequestKey{tenant, statusClass(code)}]++
+	s.mu.Unlock()
+}
+
+func (s *tenantStats) rejected(reason string) {
+	s.mu.Lock()
+	s.rejections[reason]++
+	s.mu.Unlock()
+}
+
+func (s *tenantStats) writeMetrics(out io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP tenant_http_requests_total Requests served to known tenants.")
+	fmt.Fprintln(out, "# TYPE tenant_http_requests_total counter")
+	keys := make([]tenantRequestKey, 0, len(s.requests))
+	for k := range s.requests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b tenantRequestKey) int {
+		return strings.Compare(a.tenant+" "+a.statusClass, b.tenant+" "+b.statusClass)
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "tenant_http_requests_total{tenant=%q,status_class=%q} %d\n", k.tenant, k.statusClass, s.requests[k])
+	}
+
+	fmt.Fprintln(out, "# HELP tenant_rejections_total Requests turned away for want of a known tenant, by reason.")
+	fmt.Fprintln(out, "# TYPE tenant_rejections_total counter")
+	for _, reason := range []string{rejectMissing, rejectUnknown, rejectMismatch} {
+		fmt.Fprintf(out, "tenant_rejections_total{reason=%q} %d\n", reason, s.rejections[reason])
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// withTenants serves the app's routes behind tenantMiddleware with the
+// sample tenants, fresh notes and acme.example.com-style subdomains.
+func withTenants(t *testing.T) (http.Handler, *tenantResolver) {
+	t.Helper()
+	t.Setenv("TENANT_DOMAIN", "example.com")
+	tenants, err := parseTenants(sampleTenants)
+	if err != nil {
+		t.Fatalf("sample tenants: %v", err)
+	}
+	notes := appNotes
+	appNotes = &noteStore{notes: map[string][]note{}}
+	t.Cleanup(func() { appNotes = notes })
+
+	res := newTenantResolver(tenants)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /v1/tenant", tenantHandler)
+	mux.HandleFunc("GET /v1/notes", listNotesHandler)
+	mux.HandleFunc("POST /v1/notes", createNoteHandler)
+	return tenantMiddleware(res, mux), res
+}
+
+// doHost is do with the request sent to host, returning the status.
+func doHost(h http.Handler, method, host, target, body string, header ...string) int {
+	return do(h, method, "http://"+host+target, strings.NewReader(body), header...).Code
+}
+
+func TestTenantResolution(t *testing.T) {
+	h, _ := withTenants(t)
+
+	for _, tc := range []struct {
+		name, host, header string
+		want               int
+	}{
+		{"header", "svc.local", "acme", http.StatusOK},
+		{"subdomain", "acme.example.com", "", http.StatusOK},
+		{"subdomain with port and upper case", "Globex.Example.com:8443", "", http.StatusOK},
+		{"subdomain and the same header", "acme.example.com", "acme", http.StatusOK},
+		{"subdomain and another header", "acme.example.com", "globex", http.StatusBadRequest},
+		{"no tenant", "svc.local", "", http.StatusBadRequest},
+		{"the domain itself", "example.com", "", http.StatusBadRequest},
+		{"nested subdomain", "eu.acme.example.com", "", http.StatusBadRequest},
+		{"unknown tenant", "svc.local", "umbrella", http.StatusNotFound},
+		{"unknown subdomain", "umbrella.example.com", "", http.StatusNotFound},
+		{"disabled tenant", "initech.example.com", "", http.StatusNotFound},
+	} {
+		if got := doHost(h, "GET", tc.host, "/v1/tenant", "", "X-Tenant-Id", tc.header); got != tc.want {
+			t.Errorf("%s: GET /v1/tenant = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	if got := doHost(h, "GET", "svc.local", "/healthz", ""); got != http.StatusOK {
+		t.Errorf("GET /healthz without a tenant = %d, want 200: only TENANT_PATHS need one", got)
+	}
+	// A CORS preflight carries no tenant header and goes through; any other
+	// OPTIONS request needs a tenant like the rest.
+	if got := doHost(h, "OPTIONS", "svc.local", "/v1/tenant", "", "Origin", "https://app.example", "Access-Control-Request-Method", "GET"); got == http.StatusBadRequest {
+		t.Errorf("preflight without a tenant = %d, want it let through", got)
+	}
+	if got := doHost(h, "OPTIONS", "svc.local", "/v1/tenant", ""); got != http.StatusBadRequest {
+		t.Errorf("OPTIONS without a tenant = %d, want 400", got)
+	}
+}
+
+func TestTenantProfile(t *testing.T) {
+	h, _ := withTenants(t)
+
+	w := do(h, "GET", "/v1/tenant", nil, "X-Tenant-Id", "acme")
+	var got tenant
+	decode(t, w, &got)
+	if got.ID != "acme" || got.Plan != "enterprise" || got.Settings["region"] != "eu-west-1" {
+		t.Errorf("GET /v1/tenant = %+v, want acme's configuration", got)
+	}
+}
+
+func TestNotesAreTenantScoped(t *testing.T) {
+	h, _ := withTenants(t)
+
+	for i := range 10 {
+		if got := doHost(h, "POST", "globex.example.com", "/v1/notes", `{"text": "call back"}`); got != http.StatusCreated {
+			t.Fatalf("note %d for globex = %d, want 201", i+1, got)
+		}
+	}
+	if got := doHost(h, "POST", "globex.example.com", "/v1/notes", `{"text": "one too many"}`); got != http.StatusForbidden {
+		t.Errorf("note beyond globex's max_notes = %d, want 403", got)
+	}
+	if got := doHost(h, "POST", "acme.example.com", "/v1/notes", `{"text": "ship it"}`); got != http.StatusCreated {
+		t.Errorf("note for acme = %d, want 201: globex's limit is its own", got)
+	}
+
+	var notes []note
+	decode(t, do(h, "GET", "/v1/notes", nil, "X-Tenant-Id", "acme"), &notes)
+	if len(notes) != 1 || notes[0].Text != "ship it" {
+		t.Errorf("acme's notes = %+v, want only its own", notes)
+	}
+}
+
+func TestTenantMetrics(t *testing.T) {
+	h, res := withTenants(t)
+
+	doHost(h, "GET", "acme.example.com", "/v1/tenant", "")
+	doHost(h, "GET", "acme.example.com", "/v1/nope", "")
+	doHost(h, "GET", "svc.local", "/v1/tenant", "", "X-Tenant-Id", "made-up")
+	doHost(h, "GET", "svc.local", "/v1/tenant", "")
+
+	var buf bytes.Buffer
+	res.stats.writeMetrics(&buf)
+	for _, want := range []string{
+		`tenant_http_requests_total{tenant="acme",status_class="2xx"} 1`,
+		`tenant_http_requests_total{tenant="acme",status_class="4xx"} 1`,
+		`tenant_rejections_total{reason="missing"} 1`,
+		`tenant_rejections_total{reason="unknown"} 1`,
+		`tenant_rejections_total{reason="mismatch"} 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics lack %s:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "made-up") {
+		t.Errorf("metrics are labelled with an unknown tenant:\n%s", buf.String())
+	}
+}
+
+func TestTenantLogged(t *testing.T) {
+	h, _ := withTenants(t)
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	doHost(accessLogMiddleware(h), "POST", "acme.example.com", "/v1/notes", `{"text": "ship it"}`)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want the note's and the access log's:\n%s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"tenant_id":"acme"`) {
+			t.Errorf("log line lacks the tenant resolved from the subdomain: %s", line)
+		}
+	}
+}
+
+func TestParseTenants(t *testing.T) {
+	for name, data := range map[string]string{
+		"not JSON":       `acme`,
+		"empty":          `{}`,
+		"upper case ID":  `{"Acme": {"name": "Acme"}}`,
+		"dotted ID":      `{"acme.eu": {"name": "Acme"}}`,
+		"null tenant":    `{"acme": null}`,
+		"negative limit": `{"acme": {"max_notes": -1}}`,
+	} {
+		if _, err := parseTenants([]byte(data)); err == nil {
+			t.Errorf("%s: parseTenants(%s) succeeded, want an error", name, data)
+		}
+	}
+}
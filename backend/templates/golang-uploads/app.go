@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// The app: file uploads to S3-compatible storage, next to the landing
+// page. uploads.go handles the requests and storage.go talks to the
+// bucket:
+//
+//	POST /uploads       multipart/form-data with the file in the "file"
+//	                    field, streamed to the bucket; answers 201 with
+//	                    the upload and a signed download URL
+//	GET  /uploads/{id}  the upload with a fresh signed download URL
+//
+// Files never pass through the app on the way out: clients download them
+// from the bucket with the signed URL, which works without credentials
+// until DOWNLOAD_URL_TTL has passed. The sample leaves both routes open;
+// put them behind the app's own authentication before going live.
+//
+// Credentials and region come from the usual AWS sources (environment,
+// IRSA, instance metadata). For MinIO, Ceph or another S3-compatible
+// store, set AWS_ENDPOINT_URL_S3 to its URL and usually S3_PATH_STYLE.
+//
+//	S3_BUCKET              bucket the files are stored in
+//	S3_KEY_PREFIX          prefix of every object key (default uploads/)
+//	S3_PATH_STYLE          "true" addresses the bucket in the URL path
+//	                       rather than the host name, as most S3-compatible
+//	                       stores need
+//	UPLOAD_MAX_SIZE        largest file accepted, in bytes (default
+//	                       26214400, 25 MiB)
+//	UPLOAD_ALLOWED_TYPES   comma-separated media types accepted, judged
+//	                       from the file's content rather than what the
+//	                       client claims (default PNG, JPEG, GIF, WebP, PDF
+//	                       and plain text)
+//	UPLOAD_MAX_CONCURRENT  uploads in progress per replica, each holding an
+//	                       8 MiB buffer; more are refused with a 503
+//	                       (default 8)
+//	UPLOAD_TIMEOUT         deadline for receiving and storing one file
+//	                       (default 5m), replacing HTTP_READ_TIMEOUT and
+//	                       HTTP_WRITE_TIMEOUT for uploads
+//	DOWNLOAD_URL_TTL       how long a signed download URL works (default
+//	                       15m, at most 7 days)
+
+// storageConnectTimeout bounds reaching the bucket at startup.
+const storageConnectTimeout = 15 * time.Second
+
+// maxDownloadURLTTL is the longest expiry S3 accepts for a signed URL.
+const maxDownloadURLTTL = 7 * 24 * time.Hour
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "S3_BUCKET", required: true},
+	{name: "S3_KEY_PREFIX", def: "uploads/"},
+	{name: "S3_PATH_STYLE", kind: kindBool, def: "false"},
+	{name: "UPLOAD_MAX_SIZE", kind: kindInt, def: "26214400", check: atLeast(1)},
+	{name: "UPLOAD_ALLOWED_TYPES", kind: kindList, def: "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain"},
+	{name: "UPLOAD_MAX_CONCURRENT", kind: kindInt, def: "8", check: atLeast(1)},
+	{name: "UPLOAD_TIMEOUT", kind: kindDuration, def: "5m"},
+	{name: "DOWNLOAD_URL_TTL", kind: kindDuration, def: "15m"},
+})
+
+// appStore is the bucket, opened by setupApp.
+var appStore *objectStore
+
+func setupApp(mux *http.ServeMux) error {
+	if ttl := confDuration("DOWNLOAD_URL_TTL"); ttl <= 0 || ttl > maxDownloadURLTTL {
+		return errors.New("DOWNLOAD_URL_TTL must be between 1s and 168h")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storageConnectTimeout)
+	defer cancel()
+	store, err := openStore(ctx, conf("S3_BUCKET"), conf("S3_KEY_PREFIX"))
+	if err != nil {
+		return fmt.Errorf("opening bucket %s: %w", conf("S3_BUCKET"), err)
+	}
+	appStore = store
+	uploadSlots = make(chan struct{}, confInt("UPLOAD_MAX_CONCURRENT"))
+
+	readinessChecks.register("s3", store, 0)
+	registerMetrics(uploadMetrics.write)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("POST /uploads", createUpload)
+	// createUpload caps the body at UPLOAD_MAX_SIZE itself.
+	exemptBodyLimit("/uploads")
+	// createUpload gives uploads UPLOAD_TIMEOUT instead.
+	setRouteTimeout("/uploads", 0)
+	mux.HandleFunc("/uploads", methodNotAllowed("POST"))
+	mux.HandleFunc("GET /uploads/{id}", getUpload)
+	mux.HandleFunc("/uploads/{id}", methodNotAllowed("GET, HEAD"))
+	return nil
+}
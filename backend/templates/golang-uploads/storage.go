@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// The bucket. Files are streamed in: a file that fits in one part is
+// stored with a single PutObject, a larger one as a multipart upload of
+// uploadPartSize parts, so an upload holds one part in memory however big
+// the file. A multipart upload that fails part-way is aborted, leaving
+// nothing behind; a lifecycle rule that aborts incomplete multipart
+// uploads after a day covers the ones a crash interrupts.
+//
+// Signed URLs are signed with the credentials the app has at the time.
+// With temporary credentials (IRSA, instance roles) a URL stops working
+// when they expire, which may be before DOWNLOAD_URL_TTL.
+
+// uploadPartSize is the size of each part of a multipart upload. S3
+// requires at least 5 MiB for every part but the last.
+const uploadPartSize = 8 << 20
+
+// defaultRegion is used when no AWS region is configured. MinIO and most
+// other S3-compatible stores accept it; on AWS, set AWS_REGION.
+const defaultRegion = "us-east-1"
+
+var errObjectNotFound = errors.New("object not found")
+
+type objectStore struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+	prefix  string
+}
+
+// object is what the bucket says about a stored file.
+type object struct {
+	size        int64
+	contentType string
+	metadata    map[string]string
+	modified    time.Time
+}
+
+func openStore(ctx context.Context, bucket, prefix string) (*objectStore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultRegion
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = confBool("S3_PATH_STYLE")
+	})
+	s := &objectStore{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		bucket:  bucket,
+		prefix:  prefix,
+	}
+	return s, s.Check(ctx)
+}
+
+// Check is the readiness check: the bucket exists and the app may use it.
+func (s *objectStore) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
+
+func (s *objectStore) key(id string) string {
+	return s.prefix + id
+}
+
+// put stores everything read from body under id and returns its size.
+func (s *objectStore) put(ctx context.Context, id, contentType string, metadata map[string]string, body io.Reader) (int64, error) {
+	buf := make([]byte, uploadPartSize)
+	n, err := io.ReadFull(body, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(s.key(id)),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+			ContentType:   aws.String(contentType),
+			Metadata:      metadata,
+		})
+		return int64(n), err
+	case err != nil:
+		return 0, err
+	}
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key(id)),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return 0, err
+	}
+	size, err := s.putParts(ctx, id, created.UploadId, buf, n, body)
+	if err != nil {
+		// Abort even when the request was cancelled, or the parts stay
+		// in the bucket, billed, until a lifecycle rule removes them.
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storageConnectTimeout)
+		defer cancel()
+		s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(s.key(id)),
+			UploadId: created.UploadId,
+		})
+		return 0, err
+	}
+	return size, nil
+}
+
+// putParts uploads the parts of a multipart upload, starting with the n
+// bytes already in buf, and completes it.
+func (s *objectStore) putParts(ctx context.Context, id string, uploadID *string, buf []byte, n int, body io.Reader) (int64, error) {
+	var parts []types.CompletedPart
+	var size int64
+	for number := int32(1); n > 0; number++ {
+		part, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(s.key(id)),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(number),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(number)})
+		size += int64(n)
+
+		n, err = io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+	}
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(s.key(id)),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return size, err
+}
+
+// head describes a stored file, or returns errObjectNotFound.
+func (s *objectStore) head(ctx context.Context, id string) (object, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if err != nil {
+		var re *awshttp.ResponseError
+		if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound {
+			return object{}, errObjectNotFound
+		}
+		return object{}, err
+	}
+	return object{
+		size:        aws.ToInt64(out.ContentLength),
+		contentType: aws.ToString(out.ContentType),
+		metadata:    out.Metadata,
+		modified:    aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// downloadURL signs a GET for a stored file that downloads it as an
+// attachment named by disposition, valid for ttl.
+func (s *objectStore) downloadURL(ctx context.Context, id, contentType, disposition string, ttl time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(s.bucket),
+		Key:                        aws.String(s.key(id)),
+		ResponseContentType:        aws.String(contentType),
+		ResponseContentDisposition: aws.String(disposition),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
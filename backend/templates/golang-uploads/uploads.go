@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Upload handling. POST /uploads reads the multipart body as it arrives
+// rather than spooling it to memory or disk first: the form fields before
+// "file" are skipped, the file is checked and streamed to the bucket, and
+// anything after it is never read. The whole body is capped at
+// UPLOAD_MAX_SIZE plus MAX_REQUEST_BODY for the other fields and the
+// multipart framing, and the file itself at UPLOAD_MAX_SIZE.
+//
+// The file's type is sniffed from its first 512 bytes with the rules
+// browsers use (http.DetectContentType), and the Content-Type the client
+// sent is ignored: it is whatever the client says, so trusting it would
+// let an HTML page in labelled as a PNG. Only the sniffed type is stored
+// and served. Types the sniffer cannot tell apart from others, such as
+// SVG, JSON or Office documents, need the app's own validation before
+// they are added to UPLOAD_ALLOWED_TYPES.
+//
+// Files are stored under a random ID, never the client's file name, which
+// is kept as metadata and offered as the name of the download.
+//
+// Errors:
+//
+//	400  not a multipart body, no "file" field, or a body cut short
+//	408  the file was not received within UPLOAD_TIMEOUT
+//	413  the file is larger than UPLOAD_MAX_SIZE
+//	415  the file's type is not in UPLOAD_ALLOWED_TYPES
+//	422  the file is empty
+//	502  the bucket refused the file
+//	503  UPLOAD_MAX_CONCURRENT uploads are already in progress
+//
+// Upload metrics, served on /metrics after the HTTP ones:
+//
+//	uploads_total       counter  result (stored, rejected, aborted, failed)
+//	upload_bytes_total  counter  bytes stored
+
+// Upload results, the result label of uploads_total.
+const (
+	uploadStored   = "stored"
+	uploadRejected = "rejected"
+	uploadAborted  = "aborted"
+	uploadFailed   = "failed"
+)
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// maxFilenameLen is the longest file name kept, in bytes.
+const maxFilenameLen = 255
+
+var errFileTooLarge = errors.New("file too large")
+
+// uploadSlots limits the uploads in progress; setupApp sizes it.
+var uploadSlots chan struct{}
+
+// upload is the JSON form of a stored file.
+type upload struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	DownloadURL string    `json:"download_url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	select {
+	case uploadSlots <- struct{}{}:
+		defer func() { <-uploadSlots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, "too many uploads in progress")
+		return
+	}
+
+	maxSize := int64(confInt("UPLOAD_MAX_SIZE"))
+	if r.ContentLength > maxSize+maxRequestBody() {
+		rejectUpload(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("file larger than %d bytes", maxSize))
+		return
+	}
+	// Uploads of large files on slow links outlast the server-wide
+	// timeouts, so this request gets UPLOAD_TIMEOUT instead.
+	deadline := time.Now().Add(confDuration("UPLOAD_TIMEOUT"))
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+maxRequestBody())
+	mr, err := r.MultipartReader()
+	if err != nil {
+		rejectUpload(w, r, http.StatusBadRequest, "expected a multipart/form-data body")
+		return
+	}
+	var part io.Reader
+	var filename string
+	for part == nil {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			rejectUpload(w, r, http.StatusBadRequest, `the "file" field is required`)
+			return
+		}
+		if err != nil {
+			rejectBody(w, r, err, maxSize)
+			return
+		}
+		if p.FormName() == "file" {
+			part, filename = p, cleanFilename(p.FileName())
+		}
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		rejectBody(w, r, err, maxSize)
+		return
+	}
+	if n == 0 {
+		rejectUpload(w, r, http.StatusUnprocessableEntity, "file is empty")
+		return
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !allowedType(contentType) {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		rejectUpload(w, r, http.StatusUnsupportedMediaType, "file type "+mediaType+" is not allowed")
+		return
+	}
+
+	id := newUploadID()
+	body := &uploadBody{r: io.MultiReader(bytes.NewReader(head[:n]), part), max: maxSize}
+	size, err := appStore.put(ctx, id, contentType, map[string]string{"filename": url.PathEscape(filename)}, body)
+	switch {
+	case err == nil:
+	case body.err != nil:
+		rejectBody(w, r, body.err, maxSize)
+		return
+	case r.Context().Err() != nil:
+		// The client went away; nobody reads the response.
+		uploadMetrics.upload(uploadAborted, 0)
+		return
+	default:
+		requestLogger(r).Error("storing upload failed", "upload_id", id, "error", err)
+		uploadMetrics.upload(uploadFailed, 0)
+		writeError(w, r, http.StatusBadGateway, "storage unavailable")
+		return
+	}
+	uploadMetrics.upload(uploadStored, size)
+	requestLogger(r).Info("upload stored", "upload_id", id, "size", size, "content_type", contentType)
+
+	u, err := describeUpload(ctx, id, object{size: size, contentType: contentType, modified: time.Now().Truncate(time.Second)}, filename)
+	if err != nil {
+		requestLogger(r).Error("signing download URL failed", "upload_id", id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "signing download URL failed")
+		return
+	}
+	w.Header().Set("Location", "/uploads/"+id)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, u)
+}
+
+func getUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !validUploadID(id) {
+		writeError(w, r, http.StatusNotFound, "upload not found")
+		return
+	}
+	obj, err := appStore.head(r.Context(), id)
+	switch {
+	case err == nil:
+	case errors.Is(err, errObjectNotFound):
+		writeError(w, r, http.StatusNotFound, "upload not found")
+		return
+	case r.Context().Err() != nil:
+		return
+	default:
+		requestLogger(r).Error("looking up upload failed", "upload_id", id, "error", err)
+		writeError(w, r, http.StatusBadGateway, "storage unavailable")
+		return
+	}
+
+	filename, err := url.PathUnescape(obj.metadata["filename"])
+	if err != nil {
+		filename = obj.metadata["filename"]
+	}
+	u, err := describeUpload(r.Context(), id, obj, filename)
+	if err != nil {
+		requestLogger(r).Error("signing download URL failed", "upload_id", id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "signing download URL failed")
+		return
+	}
+	// The signed URL grants access to the file; keep it out of caches.
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, u)
+}
+
+// describeUpload builds the JSON form of a stored file with a freshly
+// signed download URL.
+func describeUpload(ctx context.Context, id string, obj object, filename string) (upload, error) {
+	if filename == "" {
+		filename = id
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	ttl := confDuration("DOWNLOAD_URL_TTL")
+	signed, err := appStore.downloadURL(ctx, id, obj.contentType, disposition, ttl)
+	if err != nil {
+		return upload{}, err
+	}
+	return upload{
+		ID:          id,
+		Filename:    filename,
+		ContentType: obj.contentType,
+		Size:        obj.size,
+		CreatedAt:   obj.modified.UTC(),
+		DownloadURL: signed,
+		ExpiresAt:   time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}, nil
+}
+
+func rejectUpload(w http.ResponseWriter, r *http.Request, status int, message string) {
+	uploadMetrics.upload(uploadRejected, 0)
+	writeError(w, r, status, message)
+}
+
+// rejectBody answers an error reading the request body.
+func rejectBody(w http.ResponseWriter, r *http.Request, err error, maxSize int64) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge), errors.As(err, &maxErr):
+		rejectUpload(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("file larger than %d bytes", maxSize))
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		rejectUpload(w, r, http.StatusRequestTimeout, "upload not received in time")
+	default:
+		rejectUpload(w, r, http.StatusBadRequest, "reading the upload failed: "+err.Error())
+	}
+}
+
+// uploadBody is the file on its way to the bucket. It fails with
+// errFileTooLarge once more than max bytes have been read, and records
+// any error reading the request, so a failed put can be told apart from a
+// failed request.
+type uploadBody struct {
+	r   io.Reader
+	max int64
+	n   int64
+	err error
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.n > b.max {
+		err = errFileTooLarge
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func allowedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range confList("UPLOAD_ALLOWED_TYPES") {
+		if strings.EqualFold(allowed, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func newUploadID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validUploadID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil && strings.ToLower(id) == id
+}
+
+// cleanFilename keeps the last element of the client's file name, without
+// control characters and at most maxFilenameLen bytes.
+func cleanFilename(name string) string {
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name))
+	for len(name) > maxFilenameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+type uploadCounters struct {
+	mu      sync.Mutex
+	results map[string]uint64
+	bytes   uint64
+}
+
+var uploadMetrics = &uploadCounters{results: map[string]uint64{}}
+
+func (m *uploadCounters) upload(result string, size int64) {
+	m.mu.Lock()
+	m.results[result]++
+	m.bytes += uint64(size)
+	m.mu.Unlock()
+}
+
+func (m *uploadCounters) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP uploads_total Uploads by result.")
+	fmt.Fprintln(out, "# TYPE uploads_total counter")
+	for _, result := range []string{uploadStored, uploadRejected, uploadAborted, uploadFailed} {
+		fmt.Fprintf(out, "uploads_total{result=%q} %d\n", result, m.results[result])
+	}
+
+	fmt.Fprintln(out, "# HELP upload_bytes_total Bytes stored by uploads.")
+	fmt.Fprintln(out, "# TYPE upload_bytes_total counter")
+	fmt.Fprintf(out, "upload_bytes_total %d\n", m.bytes)
+}
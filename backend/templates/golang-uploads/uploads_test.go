@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBucket is just enough of the S3 API for single-part uploads:
+// HeadBucket, PutObject and HeadObject, path-style, on one bucket.
+type fakeBucket struct {
+	name    string
+	failPut bool
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+	header      http.Header
+	modified    time.Time
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != b.name {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case r.Method == http.MethodPut && b.failPut:
+		w.WriteHeader(http.StatusInternalServerError)
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		meta := http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				meta[name] = values
+			}
+		}
+		b.objects[key] = fakeObject{body: body, contentType: r.Header.Get("Content-Type"), header: meta, modified: time.Now()}
+	case r.Method == http.MethodHead:
+		obj, ok := b.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range obj.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// newUploadsMux serves the app as setupApp wires it, against a fake
+// bucket.
+func newUploadsMux(t *testing.T) (*http.ServeMux, *fakeBucket) {
+	t.Helper()
+	withChecks(t)
+	bucket := &fakeBucket{name: "uploads", objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(bucket)
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	for name, value := range map[string]string{
+		"S3_BUCKET":                        bucket.name,
+		"S3_PATH_STYLE":                    "true",
+		"AWS_ENDPOINT_URL":                 srv.URL,
+		"AWS_REGION":                       "us-east-1",
+		"AWS_ACCESS_KEY_ID":                "test",
+		"AWS_SECRET_ACCESS_KEY":            "test",
+		"AWS_CONFIG_FILE":                  dir + "/config",
+		"AWS_SHARED_CREDENTIALS_FILE":      dir + "/credentials",
+		"AWS_REQUEST_CHECKSUM_CALCULATION": "when_required",
+		"AWS_EC2_METADATA_DISABLED":        "true",
+	} {
+		t.Setenv(name, value)
+	}
+
+	mux := http.NewServeMux()
+	if err := setupApp(mux); err != nil {
+		t.Fatalf("setupApp: %v", err)
+	}
+	return mux, bucket
+}
+
+// multipartBody is a form with one file field.
+func multipartBody(field, filename string, content []byte) (io.Reader, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile(field, filename)
+	fw.Write(content)
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+var pngFile = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestUploadRoundTrip(t *testing.T) {
+	mux, bucket := newUploadsMux(t)
+
+	body, contentType := multipartBody("file", `C:\photos\résumé.png`, pngFile)
+	w := do(mux, "POST", "/uploads", body, "Content-Type", contentType)
+	var created upload
+	decode(t, w, &created)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/uploads/"+created.ID ||
+		created.Filename != "résumé.png" || created.ContentType != "image/png" || created.Size != int64(len(pngFile)) {
+		t.Fatalf("POST /uploads = %d %+v, want 201 with the file's details", w.Code, created)
+	}
+	if obj := bucket.objects["uploads/"+created.ID]; !bytes.Equal(obj.body, pngFile) {
+		t.Fatalf("stored object = %q, want the uploaded file", obj.body)
+	}
+
+	w = do(mux, "GET", "/uploads/"+created.ID, nil)
+	var got upload
+	decode(t, w, &got)
+	if w.Code != http.StatusOK || got.Filename != created.Filename || got.Size != created.Size ||
+		!strings.Contains(got.DownloadURL, "/uploads/uploads/"+created.ID+"?") || !strings.Contains(got.DownloadURL, "X-Amz-Signature=") {
+		t.Fatalf("GET /uploads/{id} = %d %+v, want the upload with a signed download URL", w.Code, got)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("GET /uploads/{id} Cache-Control = %q, want no-store", w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	mux, bucket := newUploadsMux(t)
+	t.Setenv("UPLOAD_MAX_SIZE", "64")
+
+	for _, tc := range []struct {
+		name    string
+		field   string
+		content []byte
+		want    int
+	}{
+		{"missing file field", "attachment", pngFile, http.StatusBadRequest},
+		{"empty file", "file", nil, http.StatusUnprocessableEntity},
+		{"disallowed type", "file", []byte("<html><script>alert(1)</script>"), http.StatusUnsupportedMediaType},
+		{"too large", "file", append(append([]byte{}, pngFile...), make([]byte, 64)...), http.StatusRequestEntityTooLarge},
+	} {
+		body, contentType := multipartBody(tc.field, "file.png", tc.content)
+		if w := do(mux, "POST", "/uploads", body, "Content-Type", contentType); w.Code != tc.want {
+			t.Errorf("%s: POST /uploads = %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+	if w := do(mux, "POST", "/uploads", strings.NewReader(`{}`), "Content-Type", "application/json"); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /uploads with JSON = %d, want 400", w.Code)
+	}
+	if len(bucket.objects) != 0 {
+		t.Errorf("bucket holds %d objects after rejected uploads, want none", len(bucket.objects))
+	}
+}
+
+func TestUploadNotFound(t *testing.T) {
+	mux, _ := newUploadsMux(t)
+	for _, id := range []string{newUploadID(), "not-an-id", strings.ToUpper(newUploadID())} {
+		if w := do(mux, "GET", "/uploads/"+id, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET /uploads/%s = %d, want 404", id, w.Code)
+		}
+	}
+}
+
+func TestUploadStorageUnavailable(t *testing.T) {
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	mux, bucket := newUploadsMux(t)
+	bucket.failPut = true
+
+	body, contentType := multipartBody("file", "file.png", pngFile)
+	if w := do(mux, "POST", "/uploads", body, "Content-Type", contentType); w.Code != http.StatusBadGateway {
+		t.Fatalf("POST /uploads with the bucket failing = %d, want 502", w.Code)
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	for in, want := range map[string]string{
+		"report.pdf":             "report.pdf",
+		"../../etc/passwd":       "passwd",
+		`C:\Users\me\photo.jpg`:  "photo.jpg",
+		"  spaced.txt ":          "spaced.txt",
+		"bell\a\r\nname.txt":     "bellname.txt",
+		"..":                     "",
+		strings.Repeat("é", 200): strings.Repeat("é", maxFilenameLen/2),
+	} {
+		if got := cleanFilename(in); got != want {
+			t.Errorf("cleanFilename(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// The app: a receiver for third-party webhooks, next to the landing page.
+// webhook.go verifies and deduplicates deliveries, dispatch.go queues them
+// for worker goroutines, and handleWebhook (handler.go) is where they are
+// processed:
+//
+//	POST /webhooks/{source}  a delivery from source, signed with one of
+//	                         its WEBHOOK_SECRETS: 202 once queued, 200 for
+//	                         a delivery already received
+//
+//	WEBHOOK_SECRETS           source:secret entries, e.g.
+//	                          github:<secret>,stripe:<secret>
+//	WEBHOOK_SIGNATURE_HEADER  header with the body's HMAC-SHA256 (default
+//	                          X-Hub-Signature-256, as GitHub sends it)
+//	WEBHOOK_ID_HEADERS        headers with the sender's delivery ID, the
+//	                          first present used (default Idempotency-Key,
+//	                          X-GitHub-Delivery, Webhook-Id)
+//	WEBHOOK_DEDUP_TTL         how long a delivery ID is remembered (default
+//	                          24h); cover the senders' retry window
+//	WEBHOOK_DEDUP_MAX         delivery IDs remembered (default 100000)
+//	WEBHOOK_QUEUE_SIZE        deliveries queued before more are refused
+//	                          with a 503 (default 1000)
+//	WEBHOOK_WORKERS           deliveries handled at once (default 4)
+//	WEBHOOK_HANDLER_TIMEOUT   deadline for handling one delivery (default
+//	                          20s, inside SHUTDOWN_TIMEOUT so queued ones
+//	                          finish)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "WEBHOOK_SECRETS", required: true, secret: true, reloadable: true, check: checkWebhookSecrets},
+	{name: "WEBHOOK_SIGNATURE_HEADER", def: "X-Hub-Signature-256"},
+	{name: "WEBHOOK_ID_HEADERS", kind: kindList, def: "Idempotency-Key,X-GitHub-Delivery,Webhook-Id"},
+	{name: "WEBHOOK_DEDUP_TTL", kind: kindDuration, def: "24h"},
+	{name: "WEBHOOK_DEDUP_MAX", kind: kindInt, def: "100000", check: atLeast(1)},
+	{name: "WEBHOOK_QUEUE_SIZE", kind: kindInt, def: "1000", check: atLeast(1)},
+	{name: "WEBHOOK_WORKERS", kind: kindInt, def: "4", check: atLeast(1)},
+	{name: "WEBHOOK_HANDLER_TIMEOUT", kind: kindDuration, def: "20s"},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	secrets, err := newWebhookSecrets()
+	if err != nil {
+		return err
+	}
+	d := newDispatcher()
+	receiver := newWebhookReceiver(secrets, d)
+	registerBackground("webhooks", d.run)
+	registerMetrics(webhookMetrics.write)
+	registerMetrics(d.writeMetrics)
+	registerMetrics(receiver.dedup.writeMetrics)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.Handle("POST /webhooks/{source}", receiver)
+	mux.HandleFunc("/webhooks/{source}", methodNotAllowed("POST"))
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers delivery IDs for WEBHOOK_DEDUP_TTL, and at most
+// WEBHOOK_DEDUP_MAX of them, forgetting the oldest first when full. It is
+// per replica and lost on restart: a retry routed to another replica, or
+// arriving after a deploy, is handled again, so handleWebhook should
+// still tolerate the odd duplicate.
+type dedupCache struct {
+	ttl   time.Duration
+	limit int
+
+	mu sync.Mutex
+	// entries are the remembered IDs; order holds them oldest first, and
+	// every ID lives for ttl, so the oldest expires first.
+	entries map[string]*dedupEntry
+	order   []*dedupEntry
+	now     func() time.Time
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newDedupCache(ttl time.Duration, limit int) *dedupCache {
+	return &dedupCache{ttl: ttl, limit: limit, entries: map[string]*dedupEntry{}, now: time.Now}
+}
+
+// add records key and returns true, or returns false if key is already
+// recorded.
+func (c *dedupCache) add(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.evict(now)
+	if _, ok := c.entries[key]; ok {
+		return false
+	}
+	e := &dedupEntry{key: key, expires: now.Add(c.ttl)}
+	c.entries[key] = e
+	c.order = append(c.order, e)
+	if len(c.order) > 2*c.limit {
+		c.compact()
+	}
+	return true
+}
+
+// remove forgets key, so it is accepted again.
+func (c *dedupCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// evict forgets the expired IDs, and the oldest beyond the limit.
+func (c *dedupCache) evict(now time.Time) {
+	for len(c.order) > 0 {
+		e := c.order[0]
+		switch {
+		case c.entries[e.key] != e:
+			// Removed since, and perhaps added again further back.
+		case now.Before(e.expires) && len(c.entries) < c.limit:
+			return
+		default:
+			delete(c.entries, e.key)
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// compact drops the entries of removed IDs from order, which otherwise
+// stay there until they are the oldest.
+func (c *dedupCache) compact() {
+	live := make([]*dedupEntry, 0, len(c.entries))
+	for _, e := range c.order {
+		if c.entries[e.key] == e {
+			live = append(live, e)
+		}
+	}
+	c.order = live
+}
+
+func (c *dedupCache) writeMetrics(out io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintln(out, "# HELP webhook_dedup_ids Delivery IDs remembered to tell retries from new deliveries.")
+	fmt.Fprintln(out, "# TYPE webhook_dedup_ids gauge")
+	fmt.Fprintf(out, "webhook_dedup_ids %d\n", len(c.entries))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The handoff from the receiver to handleWebhook. Accepted deliveries wait
+// in a queue of WEBHOOK_QUEUE_SIZE for one of WEBHOOK_WORKERS goroutines.
+// The queue is bounded so a burst the workers cannot keep up with is
+// pushed back to the senders, as 503s they retry, instead of growing
+// until the pod runs out of memory.
+//
+// A delivery is acknowledged once queued, so a handler that fails is not
+// retried by the sender: it is logged and counted in
+// webhook_handled_total{result="error"}. Nor does the queue outlive the
+// process. On shutdown the workers finish what is queued, each delivery
+// within WEBHOOK_HANDLER_TIMEOUT, and new deliveries are refused with a
+// 503; whatever is left when SHUTDOWN_TIMEOUT runs out is lost. Handoff
+// to a durable queue (see the golang-worker template) when every
+// delivery must be handled.
+
+// delivery is one accepted webhook.
+type delivery struct {
+	Source string
+	// ID is the sender's delivery ID, or the digest of Body.
+	ID     string
+	Header http.Header
+	// Body is the request body exactly as received.
+	Body       []byte
+	ReceivedAt time.Time
+	// RequestID is the ID of the request the delivery came in on.
+	RequestID string
+}
+
+type dispatcher struct {
+	queue   chan *delivery
+	workers int
+	timeout time.Duration
+	// stopped is set once shutdown begins.
+	stopped atomic.Bool
+	handle  func(context.Context, *delivery) error
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		queue:   make(chan *delivery, confInt("WEBHOOK_QUEUE_SIZE")),
+		workers: confInt("WEBHOOK_WORKERS"),
+		timeout: confDuration("WEBHOOK_HANDLER_TIMEOUT"),
+		handle:  handleWebhook,
+	}
+}
+
+// enqueue queues dl, or returns false if the queue is full or shutting
+// down.
+func (d *dispatcher) enqueue(dl *delivery) bool {
+	if d.stopped.Load() {
+		return false
+	}
+	select {
+	case d.queue <- dl:
+		return true
+	default:
+		return false
+	}
+}
+
+// run handles deliveries until ctx is cancelled, then drains the queue.
+func (d *dispatcher) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for range d.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx)
+		}()
+	}
+	<-ctx.Done()
+	d.stopped.Store(true)
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (d *dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case dl := <-d.queue:
+			d.process(ctx, dl)
+		case <-ctx.Done():
+			for {
+				select {
+				case dl := <-d.queue:
+					d.process(ctx, dl)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// process runs the handler on one delivery. It is not cancelled by
+// shutdown, only by WEBHOOK_HANDLER_TIMEOUT, so a delivery being handled
+// when SIGTERM arrives completes.
+func (d *dispatcher) process(ctx context.Context, dl *delivery) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.timeout)
+	defer cancel()
+	logger := slog.With("request_id", dl.RequestID, "source", dl.Source, "delivery_id", dl.ID)
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.Error("panic handling webhook", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+				err = fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		return d.handle(ctx, dl)
+	}()
+	webhookMetrics.observe(dl.Source, err, time.Since(start))
+	if err != nil {
+		logger.Error("webhook handler failed", "error", err, "queued_ms", start.Sub(dl.ReceivedAt).Milliseconds())
+	}
+}
+
+// webhookStats counts deliveries. Sources are the configured ones only:
+// deliveries for any other are refused before they are counted.
+type webhookStats struct {
+	mu         sync.Mutex
+	deliveries map[webhookKey]uint64
+	handled    map[webhookKey]uint64
+	durations  map[string]*histogram
+}
+
+// webhookKey labels a count: a delivery result (deliveryAccepted, ...) or
+// a handler result ("success" or "error").
+type webhookKey struct{ source, result string }
+
+var webhookMetrics = newWebhookStats()
+
+func newWebhookStats() *webhookStats {
+	return &webhookStats{
+		deliveries: map[webhookKey]uint64{},
+		handled:    map[webhookKey]uint64{},
+		durations:  map[string]*histogram{},
+	}
+}
+
+func (m *webhookStats) delivered(source, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[webhookKey{source, result}]++
+}
+
+func (m *webhookStats) observe(source string, err error, d time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handled[webhookKey{source, result}]++
+	h, ok := m.durations[result]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[result] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// writeCounts writes a counter family labelled by source and result.
+func writeCounts(out io.Writer, name string, counts map[webhookKey]uint64) {
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b webhookKey) int {
+		return cmp.Or(strings.Compare(a.source, b.source), strings.Compare(a.result, b.result))
+	})
+	for _, k := range keys {
+		fmt.Fprintf(out, "%s{source=%q,result=%q} %d\n", name, k.source, k.result, counts[k])
+	}
+}
+
+func (m *webhookStats) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP webhook_deliveries_total Deliveries received, by source and result: accepted, duplicate, invalid_signature or queue_full.")
+	fmt.Fprintln(out, "# TYPE webhook_deliveries_total counter")
+	writeCounts(out, "webhook_deliveries_total", m.deliveries)
+
+	fmt.Fprintln(out, "# HELP webhook_handled_total Deliveries handled, by source and result: success or error.")
+	fmt.Fprintln(out, "# TYPE webhook_handled_total counter")
+	writeCounts(out, "webhook_handled_total", m.handled)
+
+	fmt.Fprintln(out, "# HELP webhook_handler_duration_seconds Handler run time per delivery, by result.")
+	fmt.Fprintln(out, "# TYPE webhook_handler_duration_seconds histogram")
+	for _, result := range []string{"success", "error"} {
+		h, ok := m.durations[result]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "webhook_handler_duration_seconds_bucket{result=\"%s\",le=\"%s\"} %d\n", result, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "webhook_handler_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.count)
+		fmt.Fprintf(out, "webhook_handler_duration_seconds_sum{result=\"%s\"} %s\n", result, formatFloat(h.sum))
+		fmt.Fprintf(out, "webhook_handler_duration_seconds_count{result=\"%s\"} %d\n", result, h.count)
+	}
+}
+
+// writeMetrics writes the queue's gauges.
+func (d *dispatcher) writeMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP webhook_queue_depth Deliveries waiting for a worker.")
+	fmt.Fprintln(out, "# TYPE webhook_queue_depth gauge")
+	fmt.Fprintf(out, "webhook_queue_depth %d\n", len(d.queue))
+	fmt.Fprintln(out, "# HELP webhook_queue_capacity Deliveries the queue holds before refusing more.")
+	fmt.Fprintln(out, "# TYPE webhook_queue_capacity gauge")
+	fmt.Fprintf(out, "webhook_queue_capacity %d\n", cap(d.queue))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// handleWebhook processes one delivery; this is where the app's real work
+// goes. The delivery's signature is already verified and its ID not seen
+// before. Return nil once it is handled, or an error, which is logged and
+// counted: the sender got its 202 and will not send it again. ctx ends at
+// WEBHOOK_HANDLER_TIMEOUT; pass it to every call that blocks.
+//
+// The sample expects a JSON object and only logs it, with the event type
+// GitHub sends in X-GitHub-Event when there is one.
+func handleWebhook(ctx context.Context, d *delivery) error {
+	var payload map[string]any
+	if err := json.Unmarshal(d.Body, &payload); err != nil {
+		return fmt.Errorf("body is not a JSON object: %w", err)
+	}
+	slog.InfoContext(ctx, "webhook handled",
+		"request_id", d.RequestID,
+		"source", d.Source,
+		"delivery_id", d.ID,
+		"event", d.Header.Get("X-GitHub-Event"),
+		"bytes", len(d.Body),
+		"fields", len(payload))
+	return nil
+}
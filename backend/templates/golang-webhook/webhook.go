@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receiving webhooks. POST /webhooks/{source} takes a delivery from one
+// sender, e.g. /webhooks/github, and answers it as soon as it is queued
+// for handleWebhook, so a slow handler never makes the sender time out
+// and retry:
+//
+//  1. The body is read whole, up to MAX_REQUEST_BODY, and kept as sent:
+//     the signature is over those exact bytes, which decoding and
+//     re-encoding the JSON would not reproduce.
+//  2. WEBHOOK_SIGNATURE_HEADER must hold the hex HMAC-SHA256 of the body
+//     under one of the source's secrets, with or without a "sha256="
+//     prefix, or the delivery is refused with a 401.
+//  3. The delivery's ID is the first of WEBHOOK_ID_HEADERS it has, or
+//     else the SHA-256 of its body. An ID seen in the last
+//     WEBHOOK_DEDUP_TTL is answered 200 and not handled again, so the
+//     retries senders make after a lost response are harmless.
+//  4. The delivery is queued (202), or, with the queue full, refused
+//     with a 503 and Retry-After, for the sender to retry later.
+//
+// The secrets are WEBHOOK_SECRETS, source:secret entries separated by
+// commas or newlines. A source may have several, to rotate its secret:
+// add the new one, switch the sender over, then remove the old. The
+// setting is secret and reloadable, so with WEBHOOK_SECRETS_FILE mounted
+// from a Kubernetes Secret they change without a restart. Only configured
+// sources are served: any other is a 404, and never a metrics label.
+
+// webhookMaxID bounds delivery IDs taken from request headers.
+const webhookMaxID = 200
+
+// parseWebhookSecrets parses WEBHOOK_SECRETS. Errors name the entry by
+// position or source, never by secret.
+func parseWebhookSecrets(raw string) (map[string][][]byte, error) {
+	secrets := map[string][][]byte{}
+	for i, entry := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		source, secret, ok := strings.Cut(entry, ":")
+		source, secret = strings.TrimSpace(source), strings.TrimSpace(secret)
+		switch {
+		case !ok || source == "" || secret == "":
+			return nil, fmt.Errorf("entry %d: want source:secret", i+1)
+		case !contextHeaderValue.MatchString(source) || strings.Contains(source, "/"):
+			return nil, fmt.Errorf("entry %d: source must be letters, digits and ._:@-", i+1)
+		}
+		secrets[source] = append(secrets[source], []byte(secret))
+	}
+	return secrets, nil
+}
+
+func checkWebhookSecrets(v string) error {
+	_, err := parseWebhookSecrets(v)
+	return err
+}
+
+// webhookSecrets holds the secrets by source, swapped by reload.
+type webhookSecrets struct {
+	mu      sync.RWMutex
+	secrets map[string][][]byte
+}
+
+func newWebhookSecrets() (*webhookSecrets, error) {
+	secrets, err := parseWebhookSecrets(conf("WEBHOOK_SECRETS"))
+	if err != nil {
+		return nil, fmt.Errorf("WEBHOOK_SECRETS: %w", err)
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("WEBHOOK_SECRETS has no source:secret entries")
+	}
+	s := &webhookSecrets{secrets: secrets}
+	onConfigReload(s.reload)
+	slog.Info("webhook sources configured", "sources", s.sources())
+	return s, nil
+}
+
+// reload applies a new WEBHOOK_SECRETS. An empty or invalid one keeps the
+// current secrets until restart.
+func (s *webhookSecrets) reload() {
+	secrets, err := parseWebhookSecrets(conf("WEBHOOK_SECRETS"))
+	if err != nil || len(secrets) == 0 {
+		slog.Warn("WEBHOOK_SECRETS empty or invalid after reload, keeping the current secrets", "error", err)
+		return
+	}
+	s.mu.Lock()
+	s.secrets = secrets
+	s.mu.Unlock()
+	slog.Info("webhook secrets reloaded", "sources", s.sources())
+}
+
+func (s *webhookSecrets) sources() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sources := make([]string, 0, len(s.secrets))
+	for source := range s.secrets {
+		sources = append(sources, source)
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+func (s *webhookSecrets) forSource(source string) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secrets[source]
+}
+
+// validSignature reports whether signature is the hex HMAC-SHA256 of body
+// under one of secrets. Every secret is tried, in constant time, so
+// timing reveals neither the signature nor which secret matched.
+func validSignature(secrets [][]byte, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+	if err != nil || len(sig) != sha256.Size {
+		return false
+	}
+	valid := false
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), sig) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Results of a delivery, as webhook_deliveries_total labels them.
+const (
+	deliveryAccepted         = "accepted"
+	deliveryDuplicate        = "duplicate"
+	deliveryInvalidSignature = "invalid_signature"
+	deliveryQueueFull        = "queue_full"
+)
+
+// webhookReceiver serves POST /webhooks/{source}.
+type webhookReceiver struct {
+	secrets         *webhookSecrets
+	signatureHeader string
+	idHeaders       []string
+	dedup           *dedupCache
+	dispatcher      *dispatcher
+}
+
+func newWebhookReceiver(secrets *webhookSecrets, d *dispatcher) *webhookReceiver {
+	return &webhookReceiver{
+		secrets:         secrets,
+		signatureHeader: conf("WEBHOOK_SIGNATURE_HEADER"),
+		idHeaders:       confList("WEBHOOK_ID_HEADERS"),
+		dedup:           newDedupCache(confDuration("WEBHOOK_DEDUP_TTL"), confInt("WEBHOOK_DEDUP_MAX")),
+		dispatcher:      d,
+	}
+}
+
+// deliveryID returns the ID the sender gave the delivery, or else the
+// digest of its body.
+func (rcv *webhookReceiver) deliveryID(r *http.Request, body []byte) string {
+	for _, h := range rcv.idHeaders {
+		if id := r.Header.Get(h); id != "" {
+			return id
+		}
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+	secrets := rcv.secrets.forSource(source)
+	if len(secrets) == 0 {
+		writeError(w, r, http.StatusNotFound, "unknown webhook source")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody()))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "body too large")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "reading the body failed")
+		return
+	}
+	logger := requestLogger(r).With("source", source)
+
+	if !validSignature(secrets, body, r.Header.Get(rcv.signatureHeader)) {
+		webhookMetrics.delivered(source, deliveryInvalidSignature)
+		logger.Warn("webhook signature invalid")
+		writeError(w, r, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+	id := rcv.deliveryID(r, body)
+	if len(id) > webhookMaxID {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("delivery ID longer than %d characters", webhookMaxID))
+		return
+	}
+	logger = logger.With("delivery_id", id)
+
+	key := source + "\x00" + id
+	if !rcv.dedup.add(key) {
+		webhookMetrics.delivered(source, deliveryDuplicate)
+		logger.Info("duplicate webhook ignored")
+		writeJSON(w, http.StatusOK, map[string]string{"status": deliveryDuplicate, "id": id})
+		return
+	}
+	d := &delivery{
+		Source:     source,
+		ID:         id,
+		Header:     r.Header.Clone(),
+		Body:       body,
+		ReceivedAt: time.Now(),
+		RequestID:  requestIDFromContext(r.Context()),
+	}
+	if !rcv.dispatcher.enqueue(d) {
+		// Forget the ID, or the sender's retry would be taken for a
+		// duplicate of a delivery that was never handled.
+		rcv.dedup.remove(key)
+		webhookMetrics.delivered(source, deliveryQueueFull)
+		logger.Warn("webhook queue full, delivery refused")
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusServiceUnavailable, "webhook queue full")
+		return
+	}
+	webhookMetrics.delivered(source, deliveryAccepted)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": deliveryAccepted, "id": id})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign returns the X-Hub-Signature-256 value of body under secret.
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// withReceiver serves POST /webhooks/{source} for the github (two
+// secrets, mid-rotation) and stripe sources, queueing up to queueSize
+// deliveries for a dispatcher that is not running.
+func withReceiver(t *testing.T, queueSize int) (http.Handler, *dispatcher) {
+	t.Helper()
+	t.Setenv("WEBHOOK_SECRETS", "github:old-secret,\ngithub:new-secret,stripe:whsec_test")
+	metrics := webhookMetrics
+	webhookMetrics = newWebhookStats()
+	t.Cleanup(func() { webhookMetrics = metrics })
+
+	secrets, err := newWebhookSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher()
+	d.queue = make(chan *delivery, queueSize)
+	mux := http.NewServeMux()
+	mux.Handle("POST /webhooks/{source}", newWebhookReceiver(secrets, d))
+	return mux, d
+}
+
+// deliver posts body to source, signed with secret unless it is "".
+func deliver(h http.Handler, source, secret, body string, header ...string) *http.Response {
+	if secret != "" {
+		header = append(header, "X-Hub-Signature-256", sign(secret, body))
+	}
+	return do(h, "POST", "/webhooks/"+source, strings.NewReader(body), header...).Result()
+}
+
+func TestWebhookSignature(t *testing.T) {
+	h, d := withReceiver(t, 10)
+	body := `{"action": "opened",  "number": 1}`
+
+	for _, tc := range []struct {
+		name, source, secret string
+		want                 int
+	}{
+		{"current secret", "github", "new-secret", http.StatusAccepted},
+		{"secret being rotated out", "github", "old-secret", http.StatusAccepted},
+		{"another source's secret", "github", "whsec_test", http.StatusUnauthorized},
+		{"no signature", "github", "", http.StatusUnauthorized},
+		{"unknown source", "gitlab", "new-secret", http.StatusNotFound},
+	} {
+		resp := deliver(h, tc.source, tc.secret, body, "X-GitHub-Delivery", tc.name)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+	for name, sig := range map[string]string{
+		"bare hex":       strings.TrimPrefix(sign("whsec_test", body), "sha256="),
+		"prefixed hex":   sign("whsec_test", body),
+		"truncated":      sign("whsec_test", body)[:40],
+		"other body":     sign("whsec_test", body+" "),
+		"not hex at all": "sha256=zz",
+	} {
+		resp := deliver(h, "stripe", "", body, "X-Hub-Signature-256", sig, "Idempotency-Key", name)
+		want := http.StatusUnauthorized
+		if strings.HasSuffix(name, "hex") {
+			want = http.StatusAccepted
+		}
+		if resp.StatusCode != want {
+			t.Errorf("signature %s: got %d, want %d", name, resp.StatusCode, want)
+		}
+	}
+
+	dl := <-d.queue
+	if string(dl.Body) != body || dl.Source != "github" || dl.ID != "current secret" {
+		t.Errorf("queued delivery = %s %s %q, want github's, with the body exactly as sent", dl.Source, dl.ID, dl.Body)
+	}
+}
+
+func TestWebhookDedup(t *testing.T) {
+	h, d := withReceiver(t, 10)
+
+	for i, want := range []int{http.StatusAccepted, http.StatusOK} {
+		resp := deliver(h, "github", "new-secret", `{"n": 1}`, "X-GitHub-Delivery", "72d3162e")
+		if resp.StatusCode != want {
+			t.Errorf("delivery %d of 72d3162e: got %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	if resp := deliver(h, "stripe", "whsec_test", `{"n": 1}`, "X-GitHub-Delivery", "72d3162e"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("the same ID from another source: got %d, want 202", resp.StatusCode)
+	}
+	// Without an ID header, deliveries are told apart by their bodies.
+	for i, want := range []int{http.StatusAccepted, http.StatusOK} {
+		if resp := deliver(h, "github", "new-secret", `{"n": 2}`); resp.StatusCode != want {
+			t.Errorf("delivery %d of an unnamed body: got %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	if resp := deliver(h, "github", "new-secret", `{"n": 3}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("another unnamed body: got %d, want 202", resp.StatusCode)
+	}
+	if len(d.queue) != 4 {
+		t.Errorf("%d deliveries queued, want 4", len(d.queue))
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	h, d := withReceiver(t, 1)
+
+	deliver(h, "github", "new-secret", `{}`, "X-GitHub-Delivery", "first")
+	resp := deliver(h, "github", "new-secret", `{}`, "X-GitHub-Delivery", "second")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("delivery to a full queue: got %d Retry-After %q, want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	<-d.queue
+	if resp := deliver(h, "github", "new-secret", `{}`, "X-GitHub-Delivery", "second"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("retry of the refused delivery: got %d, want 202, not a duplicate", resp.StatusCode)
+	}
+
+	var buf bytes.Buffer
+	webhookMetrics.write(&buf)
+	for _, want := range []string{
+		`webhook_deliveries_total{source="github",result="accepted"} 2`,
+		`webhook_deliveries_total{source="github",result="queue_full"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics lack %s:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestDispatcherDrainsOnShutdown(t *testing.T) {
+	_, d := withReceiver(t, 10)
+	handled := make(chan string, 10)
+	d.handle = func(ctx context.Context, dl *delivery) error {
+		defer func() { handled <- dl.ID }()
+		switch dl.ID {
+		case "panics":
+			panic("boom")
+		case "fails":
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	}
+	for _, id := range []string{"ok", "fails", "panics"} {
+		if !d.enqueue(&delivery{Source: "github", ID: id, ReceivedAt: time.Now()}) {
+			t.Fatalf("enqueue %s refused", id)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("run = %v, want context.Canceled", err)
+	}
+	if len(handled) != 3 {
+		t.Errorf("%d deliveries handled on shutdown, want all 3 queued", len(handled))
+	}
+	if d.enqueue(&delivery{ID: "late"}) {
+		t.Error("enqueue after shutdown succeeded")
+	}
+
+	var buf bytes.Buffer
+	webhookMetrics.write(&buf)
+	for _, want := range []string{
+		`webhook_handled_total{source="github",result="error"} 2`,
+		`webhook_handled_total{source="github",result="success"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics lack %s:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	now := time.Now()
+	c := newDedupCache(time.Hour, 2)
+	c.now = func() time.Time { return now }
+
+	if !c.add("a") || c.add("a") {
+		t.Fatal("add(a) twice: want true, then false")
+	}
+	now = now.Add(30 * time.Minute)
+	c.add("b")
+	c.add("c")
+	if !c.add("a") {
+		t.Error("a still remembered beyond the limit of 2: want the oldest forgotten")
+	}
+	c.remove("c")
+	if !c.add("c") {
+		t.Error("c still remembered after remove")
+	}
+	now = now.Add(2 * time.Hour)
+	if !c.add("b") {
+		t.Error("b still remembered after the TTL")
+	}
+	for range 10 {
+		c.add("x")
+		c.remove("x")
+	}
+	if len(c.order) > 4 {
+		t.Errorf("order holds %d entries with a limit of 2: removed IDs are not compacted away", len(c.order))
+	}
+}
+
+func TestParseWebhookSecrets(t *testing.T) {
+	secrets, err := parseWebhookSecrets("github:one, github:two\n# comment\nstripe:three")
+	if err != nil || len(secrets["github"]) != 2 || len(secrets["stripe"]) != 1 {
+		t.Errorf("parseWebhookSecrets = %d github and %d stripe secrets, %v; want 2 and 1", len(secrets["github"]), len(secrets["stripe"]), err)
+	}
+	for _, raw := range []string{"github", "github:", ":hunter2", "git/hub:hunter2", "git hub:hunter2"} {
+		_, err := parseWebhookSecrets(raw)
+		if err == nil {
+			t.Errorf("parseWebhookSecrets(%q) succeeded, want an error", raw)
+		} else if strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("parseWebhookSecrets(%q) error %q gives the secret away", raw, err)
+		}
+	}
+}
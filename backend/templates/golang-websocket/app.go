@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// The app: a WebSocket endpoint on GET /ws next to the landing page.
+// Messages from clients go to handleMessage (handler.go), whose sample
+// broadcasts them to every connection; hub.go tracks the connections and
+// ws.go runs them. The HTTP server on PORT also serves the platform
+// endpoints (probes, /metrics, /version).
+//
+//	WS_ALLOWED_ORIGINS   comma-separated origin hosts allowed to connect
+//	                     from a browser besides the app's own, e.g.
+//	                     app.example.com or *.example.com
+//	WS_MAX_CONNECTIONS   connections per replica; more are refused with
+//	                     a 503 (default 1000)
+//	WS_MAX_MESSAGE_SIZE  largest message a client may send, in bytes
+//	                     (default 65536)
+//	WS_SEND_BUFFER       messages queued per connection before a slow
+//	                     client is disconnected (default 64)
+//	WS_PING_INTERVAL     how often each client is pinged (default 30s);
+//	                     keep it under the ingress's read timeout
+//	WS_PONG_TIMEOUT      how long a client has to answer a ping (default
+//	                     10s)
+//	WS_WRITE_TIMEOUT     deadline for sending one message (default 10s)
+
+var appSettings = slices.Concat(landingSettings, []setting{
+	{name: "WS_ALLOWED_ORIGINS", kind: kindList},
+	{name: "WS_MAX_CONNECTIONS", kind: kindInt, def: "1000", check: atLeast(1)},
+	{name: "WS_MAX_MESSAGE_SIZE", kind: kindInt, def: "65536", check: atLeast(1)},
+	{name: "WS_SEND_BUFFER", kind: kindInt, def: "64", check: atLeast(1)},
+	{name: "WS_PING_INTERVAL", kind: kindDuration, def: "30s"},
+	{name: "WS_PONG_TIMEOUT", kind: kindDuration, def: "10s"},
+	{name: "WS_WRITE_TIMEOUT", kind: kindDuration, def: "10s"},
+})
+
+func setupApp(mux *http.ServeMux) error {
+	appHub = newHub(confInt("WS_MAX_CONNECTIONS"))
+	registerBackground("hub", appHub.run)
+	registerMetrics(appHub.writeMetrics)
+
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("GET /ws", wsHandler)
+	// Connections last as long as their clients stay.
+	setRouteTimeout("/ws", 0)
+	mux.HandleFunc("/ws", methodNotAllowed("GET"))
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+// handleMessage processes one message from a client; this is where the
+// app's realtime logic goes. It runs on the connection's reader, so
+// messages from one client are handled in order and a slow handler
+// delays that client's next read. Returning an error closes the
+// connection with 1008 (policy violation). ctx ends when the connection
+// closes.
+//
+// The sample is a chat room: each text message is broadcast to every
+// client on this replica as
+//
+//	{"from": "<client id>", "text": "...", "sent_at": "<RFC 3339 time>"}
+func handleMessage(ctx context.Context, c *client, typ websocket.MessageType, data []byte) error {
+	if typ != websocket.MessageText {
+		return errors.New("binary messages are not supported")
+	}
+	if !utf8.Valid(data) {
+		return errors.New("message is not valid UTF-8")
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return nil
+	}
+
+	msg, err := json.Marshal(map[string]string{
+		"from":    c.id,
+		"text":    text,
+		"sent_at": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	appHub.broadcast(msg)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// The hub tracks this replica's connections and fans messages out to
+// them. Each connection has a send buffer of WS_SEND_BUFFER messages
+// drained by its own writer goroutine, so one slow client never holds up
+// a broadcast: a client whose buffer is full is disconnected instead, and
+// can reconnect and catch up. The hub only reaches clients connected to
+// this replica; to broadcast across replicas, publish through a shared
+// bus (Redis pub/sub, NATS, Kafka) and call broadcast from its subscriber
+// on every replica.
+//
+// The hub runs as the "hub" background service. Hijacked connections are
+// invisible to the HTTP server's graceful shutdown, so when shutdown
+// begins the hub closes every connection with 1001 (going away), which
+// tells clients to reconnect, and waits for them to finish closing.
+//
+// WebSocket metrics, served on /metrics after the HTTP ones:
+//
+//	ws_connections       gauge    open connections
+//	ws_messages_total    counter  direction (in, out)
+//	ws_disconnects_total counter  reason (client, invalid, slow,
+//	                              ping_timeout, error, shutdown)
+
+// Disconnect reasons, the reason label of ws_disconnects_total.
+const (
+	disconnectClient      = "client"
+	disconnectInvalid     = "invalid"
+	disconnectSlow        = "slow"
+	disconnectPingTimeout = "ping_timeout"
+	disconnectError       = "error"
+	disconnectShutdown    = "shutdown"
+)
+
+// errHubClosed is returned by add once shutdown has begun.
+var errHubClosed = errors.New("server shutting down")
+
+// errHubFull is returned by add at WS_MAX_CONNECTIONS.
+var errHubFull = errors.New("too many connections")
+
+type hub struct {
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	closed  bool
+	max     int
+	running sync.WaitGroup
+
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	disconnects map[string]uint64
+}
+
+func newHub(max int) *hub {
+	return &hub{clients: map[*client]struct{}{}, max: max, disconnects: map[string]uint64{}}
+}
+
+// add registers a connection. The caller must call remove when the
+// connection is done.
+func (h *hub) add(c *client) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.admitLocked(); err != nil {
+		return err
+	}
+	h.clients[c] = struct{}{}
+	h.running.Add(1)
+	return nil
+}
+
+func (h *hub) remove(c *client, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	h.disconnects[reason]++
+	h.running.Done()
+}
+
+// broadcast queues msg for every connection, disconnecting those whose
+// send buffer is full.
+func (h *hub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if !c.queue(msg) {
+			c.disconnect(disconnectSlow)
+		}
+	}
+}
+
+// run waits for shutdown, then closes every connection and waits for them
+// to finish.
+func (h *hub) run(ctx context.Context) error {
+	<-ctx.Done()
+	h.mu.Lock()
+	h.closed = true
+	for c := range h.clients {
+		c.disconnect(disconnectShutdown)
+	}
+	h.mu.Unlock()
+	h.running.Wait()
+	return nil
+}
+
+// accepting reports whether add would currently succeed, so the handler
+// can refuse with an HTTP error before upgrading.
+func (h *hub) accepting() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.admitLocked()
+}
+
+func (h *hub) admitLocked() error {
+	switch {
+	case h.closed:
+		return errHubClosed
+	case len(h.clients) >= h.max:
+		return errHubFull
+	}
+	return nil
+}
+
+func (h *hub) writeMetrics(out io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP ws_connections Open WebSocket connections.")
+	fmt.Fprintln(out, "# TYPE ws_connections gauge")
+	fmt.Fprintf(out, "ws_connections %d\n", len(h.clients))
+
+	fmt.Fprintln(out, "# HELP ws_messages_total WebSocket messages received (in) and sent (out).")
+	fmt.Fprintln(out, "# TYPE ws_messages_total counter")
+	fmt.Fprintf(out, "ws_messages_total{direction=\"in\"} %d\n", h.messagesIn.Load())
+	fmt.Fprintf(out, "ws_messages_total{direction=\"out\"} %d\n", h.messagesOut.Load())
+
+	fmt.Fprintln(out, "# HELP ws_disconnects_total Closed WebSocket connections by reason.")
+	fmt.Fprintln(out, "# TYPE ws_disconnects_total counter")
+	for _, reason := range []string{disconnectClient, disconnectInvalid, disconnectSlow, disconnectPingTimeout, disconnectError, disconnectShutdown} {
+		fmt.Fprintf(out, "ws_disconnects_total{reason=%q} %d\n", reason, h.disconnects[reason])
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// WebSocket connections, built with coder/websocket. Each connection has
+// two goroutines: the handler's, which reads messages and passes them to
+// handleMessage, and a writer, which drains the send buffer and pings the
+// client every WS_PING_INTERVAL. A client that does not answer a ping
+// within WS_PONG_TIMEOUT is dropped, so dead connections (a laptop lid
+// closed, a NAT mapping expired) are noticed well before TCP would, and
+// the pings keep proxies and load balancers from timing out idle
+// connections. Browsers answer pings on their own.
+//
+// Either goroutine ends the connection through disconnect; the writer
+// closes it with the status for the reason and the handler unregisters it
+// once both are done, so nothing writes to a closed connection.
+//
+// Cross-origin upgrades are refused unless the origin's host is in
+// WS_ALLOWED_ORIGINS: browsers send cookies with WebSocket handshakes, so
+// accepting any origin would let other sites act as the user.
+
+// appHub is the connection hub, created by setupApp.
+var appHub *hub
+
+// client is one WebSocket connection.
+type client struct {
+	id     string
+	conn   *websocket.Conn
+	send   chan []byte
+	logger *slog.Logger
+
+	// ctx ends when the connection should close, with reason saying why.
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	reason string
+}
+
+// queue adds msg to the send buffer, reporting false when it is full.
+func (c *client) queue(msg []byte) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// disconnect asks the writer to close the connection. Only the first
+// reason counts.
+func (c *client) disconnect(reason string) {
+	c.once.Do(func() {
+		c.reason = reason
+		c.cancel()
+	})
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := appHub.accepting(); err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: confList("WS_ALLOWED_ORIGINS"),
+	})
+	if err != nil {
+		// Accept has already answered the request.
+		requestLogger(r).Warn("websocket handshake rejected", "error", err)
+		return
+	}
+	conn.SetReadLimit(int64(confInt("WS_MAX_MESSAGE_SIZE")))
+
+	// The request context must not be used once the connection is
+	// hijacked; the connection's lifetime is the client's own.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &client{
+		id:     requestIDFromContext(r.Context()),
+		conn:   conn,
+		send:   make(chan []byte, confInt("WS_SEND_BUFFER")),
+		logger: requestLogger(r),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if err := appHub.add(c); err != nil {
+		conn.Close(websocket.StatusTryAgainLater, err.Error())
+		return
+	}
+
+	start := time.Now()
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		c.writeLoop()
+	}()
+	c.disconnect(c.readLoop())
+	writer.Wait()
+	appHub.remove(c, c.reason)
+	c.logger.Info("websocket closed", "reason", c.reason, "duration", time.Since(start).Round(time.Millisecond).String())
+}
+
+// readLoop passes messages to handleMessage until the connection fails,
+// and returns the disconnect reason. It reads with a context that is
+// never cancelled: the writer's close is what ends it, after the close
+// handshake, so messages in flight are not cut off mid-frame.
+func (c *client) readLoop() string {
+	for {
+		typ, data, err := c.conn.Read(context.Background())
+		if err != nil {
+			switch {
+			case c.ctx.Err() != nil:
+				return c.reason
+			case websocket.CloseStatus(err) == websocket.StatusNormalClosure,
+				websocket.CloseStatus(err) == websocket.StatusGoingAway:
+				return disconnectClient
+			case websocket.CloseStatus(err) != -1:
+				c.logger.Info("websocket closed by client", "status", websocket.CloseStatus(err).String())
+				return disconnectClient
+			default:
+				c.logger.Warn("websocket read failed", "error", err)
+				return disconnectError
+			}
+		}
+		appHub.messagesIn.Add(1)
+		if err := handleMessage(c.ctx, c, typ, data); err != nil {
+			c.logger.Warn("websocket message rejected", "error", err)
+			return disconnectInvalid
+		}
+	}
+}
+
+// writeLoop sends queued messages and pings until disconnect, then closes
+// the connection. Messages still queued at that point are dropped.
+func (c *client) writeLoop() {
+	writeTimeout, pongTimeout := confDuration("WS_WRITE_TIMEOUT"), confDuration("WS_PONG_TIMEOUT")
+	ticker := time.NewTicker(confDuration("WS_PING_INTERVAL"))
+	defer ticker.Stop()
+	for c.ctx.Err() == nil {
+		select {
+		case msg := <-c.send:
+			// Not derived from c.ctx, so a write under way when shutdown
+			// begins completes instead of breaking the connection.
+			ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+			err := c.conn.Write(ctx, websocket.MessageText, msg)
+			cancel()
+			if err != nil {
+				c.disconnect(disconnectError)
+			} else {
+				appHub.messagesOut.Add(1)
+			}
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), pongTimeout)
+			err := c.conn.Ping(ctx)
+			cancel()
+			if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					c.disconnect(disconnectPingTimeout)
+				} else {
+					c.disconnect(disconnectError)
+				}
+			}
+		case <-c.ctx.Done():
+		}
+	}
+	c.close()
+}
+
+// close ends the connection with the status for the disconnect reason.
+// Close waits for the client's close frame, up to five seconds.
+func (c *client) close() {
+	switch c.reason {
+	case disconnectShutdown:
+		c.conn.Close(websocket.StatusGoingAway, "server shutting down")
+	case disconnectSlow:
+		c.conn.Close(websocket.StatusPolicyViolation, "client too slow")
+	case disconnectInvalid:
+		c.conn.Close(websocket.StatusPolicyViolation, "invalid message")
+	case disconnectClient:
+		c.conn.Close(websocket.StatusNormalClosure, "")
+	default:
+		c.conn.CloseNow()
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// newWSServer serves wsHandler on a test listener with a fresh hub of at
+// most max connections, and returns its ws:// URL. The hub shuts down with
+// the test.
+func newWSServer(t *testing.T, max int) string {
+	t.Helper()
+	appHub = newHub(max)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		appHub.run(ctx)
+	}()
+
+	srv := httptest.NewServer(requestIDMiddleware(http.HandlerFunc(wsHandler)))
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		srv.Close()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// dialWS opens a connection, closed when the test ends.
+func dialWS(t *testing.T, ctx context.Context, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	return conn
+}
+
+// waitForClients blocks until the hub has n connections registered; the
+// handler adds a client only after the handshake has returned to the
+// dialer.
+func waitForClients(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		appHub.mu.Lock()
+		got := len(appHub.clients)
+		appHub.mu.Unlock()
+		if got == n {
+			return
+		}
+	}
+	t.Fatalf("hub never reached %d connections", n)
+}
+
+func TestBroadcast(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := newWSServer(t, 10)
+	alice, bob := dialWS(t, ctx, url), dialWS(t, ctx, url)
+	waitForClients(t, 2)
+
+	if err := alice.Write(ctx, websocket.MessageText, []byte("  hello  ")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for name, conn := range map[string]*websocket.Conn{"sender": alice, "other client": bob} {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("%s read: %v", name, err)
+		}
+		var msg map[string]string
+		if err := json.Unmarshal(data, &msg); err != nil || msg["text"] != "hello" || msg["from"] == "" || msg["sent_at"] == "" {
+			t.Fatalf("%s received %s, want the trimmed message with its sender and time", name, data)
+		}
+	}
+}
+
+func TestBinaryMessageClosesConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dialWS(t, ctx, newWSServer(t, 10))
+
+	if err := conn.Write(ctx, websocket.MessageBinary, []byte{0x01}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_, _, err := conn.Read(ctx)
+	if got := websocket.CloseStatus(err); got != websocket.StatusPolicyViolation {
+		t.Fatalf("close status after a binary message = %v (%v), want %v", got, err, websocket.StatusPolicyViolation)
+	}
+}
+
+func TestCrossOriginRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := newWSServer(t, 10)
+
+	_, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Origin": {"https://evil.example"}},
+	})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-origin dial = %v, %v, want a 403", resp, err)
+	}
+
+	t.Setenv("WS_ALLOWED_ORIGINS", "evil.example")
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Origin": {"https://evil.example"}},
+	})
+	if err != nil {
+		t.Fatalf("dial from an allowed origin: %v", err)
+	}
+	conn.CloseNow()
+}
+
+func TestMaxConnections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := newWSServer(t, 1)
+	dialWS(t, ctx, url)
+	waitForClients(t, 1)
+
+	_, resp, err := websocket.Dial(ctx, url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("dial past WS_MAX_CONNECTIONS = %v, %v, want a 503 with Retry-After", resp, err)
+	}
+}
+
+func TestShutdownClosesConnections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	appHub = newHub(10)
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	conn := dialWS(t, ctx, "ws"+strings.TrimPrefix(srv.URL, "http"))
+	waitForClients(t, 1)
+
+	hubCtx, stop := context.WithCancel(context.Background())
+	stop()
+	go appHub.run(hubCtx)
+	_, _, err := conn.Read(ctx)
+	if got := websocket.CloseStatus(err); got != websocket.StatusGoingAway {
+		t.Fatalf("close status on shutdown = %v (%v), want %v", got, err, websocket.StatusGoingAway)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The app: a queue consumer. Messages are received from QUEUE_BACKEND and
+// passed to handleMessage (handler.go) with retries; see worker.go for the
+// delivery guarantees and queue.go for the brokers. The HTTP server on
+// PORT is only the admin port, serving the platform endpoints (probes,
+// /metrics, /version), so the kubelet and Prometheus reach the worker
+// exactly as they do an HTTP template.
+//
+//	QUEUE_BACKEND           sqs, rabbitmq or nats (default [% QUEUE_BACKEND %])
+//	QUEUE_URL               SQS queue URL, amqp:// URL or nats:// URL
+//	QUEUE_NAME              RabbitMQ queue, or NATS JetStream stream
+//	QUEUE_CONSUMER          NATS durable consumer name (default the app name)
+//	WORKER_CONCURRENCY      messages handled at once (default 4)
+//	WORKER_MAX_ATTEMPTS     tries per message before it is rejected
+//	                        (default 5)
+//	WORKER_BACKOFF_INITIAL  wait before the first retry, doubled for each
+//	                        one after it (default 1s)
+//	WORKER_BACKOFF_MAX      longest wait between retries (default 1m)
+//	WORKER_HANDLER_TIMEOUT  deadline for a single try (default 20s, inside
+//	                        SHUTDOWN_TIMEOUT so in-flight tries finish)
+
+// queueConnectTimeout bounds connecting to the broker at startup.
+const queueConnectTimeout = 15 * time.Second
+
+var appSettings = []setting{
+	{name: "QUEUE_BACKEND", def: "[% QUEUE_BACKEND %]", check: oneOf("sqs", "rabbitmq", "nats")},
+	{name: "QUEUE_URL", required: true, secret: true}, // amqp:// and nats:// URLs may embed credentials
+	{name: "QUEUE_NAME"},
+	{name: "QUEUE_CONSUMER", def: serviceName},
+	{name: "WORKER_CONCURRENCY", kind: kindInt, def: "4", check: atLeast(1)},
+	{name: "WORKER_MAX_ATTEMPTS", kind: kindInt, def: "5", check: atLeast(1)},
+	{name: "WORKER_BACKOFF_INITIAL", kind: kindDuration, def: "1s"},
+	{name: "WORKER_BACKOFF_MAX", kind: kindDuration, def: "1m"},
+	{name: "WORKER_HANDLER_TIMEOUT", kind: kindDuration, def: "20s"},
+}
+
+func setupApp(mux *http.ServeMux) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queueConnectTimeout)
+	defer cancel()
+	q, err := openQueue(ctx, conf("QUEUE_BACKEND"))
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", conf("QUEUE_BACKEND"), err)
+	}
+
+	readinessChecks.register("queue", q, 0)
+	registerMetrics(workerMetrics.write)
+	registerBackground("worker", func(ctx context.Context) error {
+		defer q.close()
+		return runWorker(ctx, q)
+	})
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// handleMessage processes one message; this is where the worker's real
+// work goes. Return nil once the message is fully handled, an error to
+// have it retried, or permanent(err) when retrying cannot help. ctx ends
+// at WORKER_HANDLER_TIMEOUT; pass it to every call that blocks.
+//
+// The sample expects a JSON object and only logs it.
+func handleMessage(ctx context.Context, msg *message) error {
+	var payload map[string]any
+	if err := json.Unmarshal(msg.Body, &payload); err != nil {
+		return permanent(fmt.Errorf("body is not a JSON object: %w", err))
+	}
+	slog.InfoContext(ctx, "message handled", "message_id", msg.ID, "bytes", len(msg.Body), "fields", len(payload))
+	return nil
+}
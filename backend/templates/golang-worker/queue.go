@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// A queue is a broker connection the worker receives messages from. Each
+// backend lives in its own file (queue_sqs.go, queue_rabbitmq.go,
+// queue_nats.go) and maps the three ways a message can end onto its
+// broker:
+//
+//	          ack               release              reject
+//	SQS       DeleteMessage     visibility 0         left to the redrive policy
+//	RabbitMQ  Ack               Nack, requeue        Nack, no requeue (to the DLX)
+//	NATS      Ack               Nak                  Term
+//
+// Rejected messages are dead-lettered only where the broker is set up for
+// it: an SQS redrive policy, a RabbitMQ dead-letter exchange. Without one
+// RabbitMQ and NATS drop them and SQS redelivers them after the visibility
+// timeout.
+type queue interface {
+	// receive blocks until a message arrives or ctx is done.
+	receive(ctx context.Context) (*message, error)
+	// Check reports whether the broker is reachable, for /readyz.
+	Check(ctx context.Context) error
+	// close releases anything received but not yet handed out and
+	// disconnects.
+	close() error
+}
+
+// message is one delivery. Exactly one of ack, release or reject must be
+// called when the worker is done with it.
+type message struct {
+	ID   string
+	Body []byte
+	// Attributes holds the broker's message attributes or headers.
+	Attributes map[string]string
+
+	ack     func(ctx context.Context) error // processed; remove it
+	release func(ctx context.Context) error // not processed; redeliver it
+	reject  func(ctx context.Context) error // gave up; dead-letter or drop it
+}
+
+// openQueue connects to the configured broker.
+func openQueue(ctx context.Context, backend string) (queue, error) {
+	switch backend {
+	case "sqs":
+		return openSQS(ctx, conf("QUEUE_URL"))
+	case "rabbitmq":
+		return openRabbitMQ(conf("QUEUE_URL"), conf("QUEUE_NAME"), confInt("WORKER_CONCURRENCY"))
+	case "nats":
+		return openNATS(ctx, conf("QUEUE_URL"), conf("QUEUE_NAME"), conf("QUEUE_CONSUMER"), confInt("WORKER_CONCURRENCY"))
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", backend)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATS JetStream. Core NATS has no acknowledgements, so the worker reads
+// from a stream: QUEUE_URL is a nats:// URL, QUEUE_NAME the stream and
+// QUEUE_CONSUMER a durable pull consumer with explicit acks, created if it
+// does not exist. Replicas sharing QUEUE_CONSUMER share the work.
+// Messages pulled but not started when the worker stops are redelivered
+// after the consumer's ack wait.
+
+type natsQueue struct {
+	conn *nats.Conn
+	iter jetstream.MessagesContext
+}
+
+func openNATS(ctx context.Context, rawURL, stream, consumer string, pending int) (*natsQueue, error) {
+	if stream == "" {
+		return nil, errors.New("QUEUE_NAME is required for nats")
+	}
+	conn, err := nats.Connect(rawURL, nats.Name(serviceName))
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cons, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:   consumer,
+		AckPolicy: jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("consumer %s on stream %s: %w", consumer, stream, err)
+	}
+	iter, err := cons.Messages(jetstream.PullMaxMessages(pending))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &natsQueue{conn: conn, iter: iter}, nil
+}
+
+func (q *natsQueue) receive(ctx context.Context) (*message, error) {
+	m, err := q.iter.Next(jetstream.NextContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{}
+	for k := range m.Headers() {
+		attrs[k] = m.Headers().Get(k)
+	}
+	id := m.Headers().Get(jetstream.MsgIDHeader)
+	if meta, err := m.Metadata(); err == nil && id == "" {
+		id = fmt.Sprintf("%s:%d", meta.Stream, meta.Sequence.Stream)
+	}
+	return &message{
+		ID:         id,
+		Body:       m.Data(),
+		Attributes: attrs,
+		ack:        func(ctx context.Context) error { return m.DoubleAck(ctx) },
+		release:    func(context.Context) error { return m.Nak() },
+		reject:     func(context.Context) error { return m.Term() },
+	}, nil
+}
+
+func (q *natsQueue) Check(ctx context.Context) error {
+	if status := q.conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("connection %s", status)
+	}
+	return nil
+}
+
+func (q *natsQueue) close() error {
+	q.iter.Stop()
+	q.conn.Close()
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RabbitMQ over AMQP 0-9-1. QUEUE_URL is an amqp:// or amqps:// URL and
+// QUEUE_NAME an existing queue; the worker does not declare it, so its
+// arguments (durability, dead-letter exchange, quorum type) stay with
+// whoever owns the topology. Prefetch is WORKER_CONCURRENCY, and
+// deliveries still unacknowledged when the channel closes are requeued by
+// the broker. A lost connection ends the worker, and with it the pod, so
+// Kubernetes restarts it against a fresh connection.
+
+type rabbitQueue struct {
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	deliveries <-chan amqp.Delivery
+}
+
+func openRabbitMQ(rawURL, name string, prefetch int) (*rabbitQueue, error) {
+	if name == "" {
+		return nil, errors.New("QUEUE_NAME is required for rabbitmq")
+	}
+	conn, err := amqp.DialConfig(rawURL, amqp.Config{Properties: amqp.Table{"connection_name": serviceName}})
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	deliveries, err := ch.Consume(name, serviceName, false, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("consuming %s: %w", name, err)
+	}
+	return &rabbitQueue{conn: conn, ch: ch, deliveries: deliveries}, nil
+}
+
+func (q *rabbitQueue) receive(ctx context.Context) (*message, error) {
+	select {
+	case d, ok := <-q.deliveries:
+		if !ok {
+			return nil, errors.New("RabbitMQ channel closed")
+		}
+		return rabbitMessage(d), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func rabbitMessage(d amqp.Delivery) *message {
+	attrs := map[string]string{}
+	for k, v := range d.Headers {
+		attrs[k] = fmt.Sprint(v)
+	}
+	return &message{
+		ID:         d.MessageId,
+		Body:       d.Body,
+		Attributes: attrs,
+		ack:        func(context.Context) error { return d.Ack(false) },
+		release:    func(context.Context) error { return d.Nack(false, true) },
+		reject:     func(context.Context) error { return d.Nack(false, false) },
+	}
+}
+
+func (q *rabbitQueue) Check(ctx context.Context) error {
+	if q.conn.IsClosed() || q.ch.IsClosed() {
+		return errors.New("connection closed")
+	}
+	return nil
+}
+
+func (q *rabbitQueue) close() error {
+	return q.conn.Close()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Amazon SQS. QUEUE_URL is the queue URL; credentials and region come from
+// the usual AWS sources (environment, IRSA, instance metadata), and
+// AWS_ENDPOINT_URL_SQS points the client at LocalStack or ElasticMQ. The
+// queue's visibility timeout must cover WORKER_MAX_ATTEMPTS tries and the
+// backoff between them, or SQS hands the message to another consumer
+// while this one is still retrying.
+
+// sqsWaitSeconds is the long-poll wait, the longest SQS allows.
+const sqsWaitSeconds = 20
+
+type sqsQueue struct {
+	client *sqs.Client
+	url    string
+	batch  int32
+	buf    []types.Message
+}
+
+func openSQS(ctx context.Context, queueURL string) (*sqsQueue, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = sqsRegion(queueURL)
+	}
+	q := &sqsQueue{
+		client: sqs.NewFromConfig(cfg),
+		url:    queueURL,
+		batch:  int32(min(confInt("WORKER_CONCURRENCY"), 10)),
+	}
+	return q, q.Check(ctx)
+}
+
+// sqsRegion takes the region from a queue URL such as
+// https://sqs.eu-west-1.amazonaws.com/123456789012/orders.
+func sqsRegion(queueURL string) string {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) >= 4 && parts[0] == "sqs" {
+		return parts[1]
+	}
+	return ""
+}
+
+func (q *sqsQueue) receive(ctx context.Context) (*message, error) {
+	for len(q.buf) == 0 {
+		out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(q.url),
+			MaxNumberOfMessages:         q.batch,
+			WaitTimeSeconds:             sqsWaitSeconds,
+			MessageAttributeNames:       []string{"All"},
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		if err != nil {
+			return nil, err
+		}
+		q.buf = out.Messages
+	}
+	m := q.buf[0]
+	q.buf = q.buf[1:]
+	return q.message(m), nil
+}
+
+func (q *sqsQueue) message(m types.Message) *message {
+	attrs := map[string]string{}
+	for k, v := range m.MessageAttributes {
+		if v.StringValue != nil {
+			attrs[k] = *v.StringValue
+		}
+	}
+	for k, v := range m.Attributes {
+		attrs[k] = v
+	}
+	handle := m.ReceiptHandle
+	return &message{
+		ID:         aws.ToString(m.MessageId),
+		Body:       []byte(aws.ToString(m.Body)),
+		Attributes: attrs,
+		ack: func(ctx context.Context) error {
+			_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(q.url), ReceiptHandle: handle})
+			return err
+		},
+		release: func(ctx context.Context) error {
+			return q.makeVisible(ctx, handle)
+		},
+		reject: func(ctx context.Context) error {
+			// The redrive policy moves it to the dead-letter queue once it
+			// has been received maxReceiveCount times.
+			return nil
+		},
+	}
+}
+
+func (q *sqsQueue) makeVisible(ctx context.Context, handle *string) error {
+	_, err := q.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.url),
+		ReceiptHandle:     handle,
+		VisibilityTimeout: 0,
+	})
+	return err
+}
+
+func (q *sqsQueue) Check(ctx context.Context) error {
+	_, err := q.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(q.url),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	return err
+}
+
+// close hands messages received in the last batch but never started back
+// to the queue, so other replicas pick them up without waiting out the
+// visibility timeout.
+func (q *sqsQueue) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, m := range q.buf {
+		if err := q.makeVisible(ctx, m.ReceiptHandle); err != nil {
+			slog.Warn("releasing unhandled SQS message failed", "message_id", aws.ToString(m.MessageId), "error", err)
+		}
+	}
+	q.buf = nil
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The worker loop. Up to WORKER_CONCURRENCY messages are handled at once.
+// A message whose handler fails is retried in place after an exponential
+// backoff with jitter, up to WORKER_MAX_ATTEMPTS tries, then rejected; a
+// handler that returns permanent(err) is rejected at once. Delivery is at
+// least once: a message is acknowledged only after its handler succeeds,
+// so handlers must be idempotent.
+//
+// On shutdown the worker stops receiving, lets in-flight handlers finish
+// (each within WORKER_HANDLER_TIMEOUT) and releases messages waiting for a
+// retry back to the broker. Anything still running when SHUTDOWN_TIMEOUT
+// runs out is redelivered by the broker once the process exits.
+
+// settleTimeout bounds acknowledging, releasing or rejecting a message.
+const settleTimeout = 10 * time.Second
+
+// permanentError marks a failure retrying cannot fix, such as a malformed
+// message.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so the worker rejects the message without retrying.
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// runWorker receives and handles messages until ctx is cancelled, then
+// waits for in-flight messages.
+func runWorker(ctx context.Context, q queue) error {
+	slots := make(chan struct{}, confInt("WORKER_CONCURRENCY"))
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		msg, err := q.receive(ctx)
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("receiving: %w", err)
+		}
+
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			process(ctx, msg)
+		}()
+	}
+}
+
+// process runs the handler with retries and settles the message.
+func process(ctx context.Context, msg *message) {
+	workerMetrics.inFlight.Add(1)
+	defer workerMetrics.inFlight.Add(-1)
+
+	logger := slog.With("message_id", msg.ID)
+	maxAttempts := confInt("WORKER_MAX_ATTEMPTS")
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := handle(ctx, msg)
+		workerMetrics.observe(err, time.Since(start))
+		if err == nil {
+			settle(ctx, logger, msg, outcomeAcked)
+			return
+		}
+
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= maxAttempts {
+			logger.Error("message rejected", "attempt", attempt, "permanent", errors.As(err, &perm), "error", err)
+			settle(ctx, logger, msg, outcomeRejected)
+			return
+		}
+
+		delay := backoff(attempt)
+		logger.Warn("message failed, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+		workerMetrics.count(outcomeRetried)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			logger.Info("shutting down, releasing message for redelivery", "attempt", attempt)
+			settle(ctx, logger, msg, outcomeReleased)
+			return
+		}
+	}
+}
+
+// handle runs one try of the handler. It is not cancelled by shutdown, only
+// by WORKER_HANDLER_TIMEOUT, so a message being handled when SIGTERM
+// arrives completes rather than being abandoned halfway.
+func handle(ctx context.Context, msg *message) (err error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), confDuration("WORKER_HANDLER_TIMEOUT"))
+	defer cancel()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			slog.Error("panic handling message",
+				"message_id", msg.ID,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return handleMessage(ctx, msg)
+}
+
+// backoff is the wait before retrying after the given attempt: the
+// initial backoff doubled per attempt, capped at WORKER_BACKOFF_MAX, with
+// the upper half randomised so failing replicas do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d, ceiling := confDuration("WORKER_BACKOFF_INITIAL"), confDuration("WORKER_BACKOFF_MAX")
+	for i := 1; i < attempt && d < ceiling; i++ {
+		d *= 2
+	}
+	d = min(d, ceiling)
+	return d/2 + rand.N(d/2+1)
+}
+
+// settle acknowledges, releases or rejects msg. It runs even during
+// shutdown; a failure only means the broker redelivers the message.
+func settle(ctx context.Context, logger *slog.Logger, msg *message, outcome string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), settleTimeout)
+	defer cancel()
+
+	var err error
+	switch outcome {
+	case outcomeAcked:
+		err = msg.ack(ctx)
+	case outcomeReleased:
+		err = msg.release(ctx)
+	case outcomeRejected:
+		err = msg.reject(ctx)
+	}
+	if err != nil {
+		logger.Warn("settling message failed, the broker will redeliver it", "outcome", outcome, "error", err)
+		return
+	}
+	workerMetrics.count(outcome)
+}
+
+// Message outcomes, the outcome label of worker_messages_total.
+const (
+	outcomeAcked    = "acked"
+	outcomeRetried  = "retried"
+	outcomeReleased = "released"
+	outcomeRejected = "rejected"
+)
+
+// Worker metrics, served on /metrics after the HTTP ones:
+//
+//	worker_messages_total            counter   outcome
+//	worker_messages_in_flight        gauge
+//	worker_handler_duration_seconds  histogram result
+type workerStats struct {
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	outcomes  map[string]uint64
+	durations map[string]*histogram
+}
+
+var workerMetrics = &workerStats{
+	outcomes:  map[string]uint64{},
+	durations: map[string]*histogram{},
+}
+
+func (m *workerStats) count(outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outcomes[outcome]++
+}
+
+func (m *workerStats) observe(err error, d time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.durations[result]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[result] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *workerStats) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP worker_messages_total Messages by outcome: acked, retried, released or rejected.")
+	fmt.Fprintln(out, "# TYPE worker_messages_total counter")
+	for _, outcome := range []string{outcomeAcked, outcomeRetried, outcomeReleased, outcomeRejected} {
+		fmt.Fprintf(out, "worker_messages_total{outcome=\"%s\"} %d\n", outcome, m.outcomes[outcome])
+	}
+
+	fmt.Fprintln(out, "# HELP worker_messages_in_flight Messages currently being handled or waiting for a retry.")
+	fmt.Fprintln(out, "# TYPE worker_messages_in_flight gauge")
+	fmt.Fprintf(out, "worker_messages_in_flight %d\n", m.inFlight.Load())
+
+	fmt.Fprintln(out, "# HELP worker_handler_duration_seconds Handler run time per try, by result.")
+	fmt.Fprintln(out, "# TYPE worker_handler_duration_seconds histogram")
+	for _, result := range []string{"success", "error"} {
+		h, ok := m.durations[result]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "worker_handler_duration_seconds_bucket{result=\"%s\",le=\"%s\"} %d\n", result, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "worker_handler_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.count)
+		fmt.Fprintf(out, "worker_handler_duration_seconds_sum{result=\"%s\"} %s\n", result, formatFloat(h.sum))
+		fmt.Fprintf(out, "worker_handler_duration_seconds_count{result=\"%s\"} %d\n", result, h.count)
+	}
+}
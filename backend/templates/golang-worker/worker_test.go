@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeQueue hands out the messages sent on its channel and reports how
+// each one was settled.
+type fakeQueue struct {
+	messages chan *message
+	settled  chan string // "<id> <outcome>"
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{messages: make(chan *message, 10), settled: make(chan string, 10)}
+}
+
+// push queues a message with the given ID and body.
+func (q *fakeQueue) push(id, body string) {
+	settle := func(outcome string) func(context.Context) error {
+		return func(context.Context) error {
+			q.settled <- id + " " + outcome
+			return nil
+		}
+	}
+	q.messages <- &message{
+		ID:      id,
+		Body:    []byte(body),
+		ack:     settle(outcomeAcked),
+		release: settle(outcomeReleased),
+		reject:  settle(outcomeRejected),
+	}
+}
+
+func (q *fakeQueue) receive(ctx context.Context) (*message, error) {
+	select {
+	case msg := <-q.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *fakeQueue) Check(context.Context) error { return nil }
+func (q *fakeQueue) close() error                { return nil }
+
+// startWorker runs runWorker on q until the test ends.
+func startWorker(t *testing.T, q queue) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runWorker(ctx, q) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("runWorker after shutdown = %v, want context.Canceled", err)
+		}
+	})
+}
+
+// waitSettled returns the next settled message, or fails after a while.
+func waitSettled(t *testing.T, q *fakeQueue) string {
+	t.Helper()
+	select {
+	case s := <-q.settled:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message settled")
+		return ""
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	if err := handleMessage(context.Background(), &message{ID: "1", Body: []byte(`{"order": 42}`)}); err != nil {
+		t.Fatalf("handleMessage with a JSON object = %v, want nil", err)
+	}
+	var perm permanentError
+	if err := handleMessage(context.Background(), &message{ID: "2", Body: []byte(`not json`)}); !errors.As(err, &perm) {
+		t.Fatalf("handleMessage with a malformed body = %v, want a permanent error", err)
+	}
+}
+
+func TestWorkerSettlesMessages(t *testing.T) {
+	q := newFakeQueue()
+	startWorker(t, q)
+
+	q.push("good", `{"order": 42}`)
+	if got := waitSettled(t, q); got != "good "+outcomeAcked {
+		t.Fatalf("handled message = %q, want it acked", got)
+	}
+	// A permanent failure is rejected on the first try, without a backoff.
+	q.push("bad", `not json`)
+	if got := waitSettled(t, q); got != "bad "+outcomeRejected {
+		t.Fatalf("malformed message = %q, want it rejected", got)
+	}
+}
+
+func TestWorkerReceiveError(t *testing.T) {
+	err := runWorker(context.Background(), failingQueue{})
+	if err == nil || !errors.Is(err, errBrokerGone) {
+		t.Fatalf("runWorker with a failing broker = %v, want the receive error", err)
+	}
+}
+
+var errBrokerGone = errors.New("connection reset")
+
+// failingQueue is a broker that has gone away.
+type failingQueue struct{}
+
+func (failingQueue) receive(context.Context) (*message, error) { return nil, errBrokerGone }
+func (failingQueue) Check(context.Context) error               { return errBrokerGone }
+func (failingQueue) close() error                              { return nil }
+
+func TestBackoff(t *testing.T) {
+	t.Setenv("WORKER_BACKOFF_INITIAL", "1s")
+	t.Setenv("WORKER_BACKOFF_MAX", "10s")
+	for attempt, ceiling := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 20: 10 * time.Second} {
+		for range 20 {
+			if d := backoff(attempt); d < ceiling/2 || d > ceiling {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt, d, ceiling/2, ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Basic auth for the operator endpoints, so they can be exposed through
+// the app's own ingress. Disabled unless ADMIN_PASSWORD is set.
+//
+//	ADMIN_USERNAME   user name (default admin)
+//	ADMIN_PASSWORD   password; secret and reloadable, so it can be
+//	                 mounted with ADMIN_PASSWORD_FILE and rotated
+//	ADMIN_ENDPOINTS  which endpoints need the credentials, any of metrics,
+//	                 pprof, health, faults, drain and config (default all
+//	                 six)
+//
+// "metrics" guards /metrics, so Prometheus has to scrape with basic auth
+// (basicAuth in a ServiceMonitor). "pprof" guards the profiling listener
+// and, with PPROF_APP_PORT=true, its endpoints on the application port
+// (see pprof.go). "health" guards the HEALTH_DETAIL check details only:
+// the probes keep answering the kubelet without credentials and simply
+// leave the details out. "faults" guards /debug/faults (see faults.go),
+// "drain" POST /drain (see drain.go), GET /drain staying open to the load
+// balancers polling it, and "config" /admin/config (see adminconfig.go).
+
+var adminEndpoints = []string{"metrics", "pprof", "health", "faults", "drain", "config"}
+
+func checkAdminEndpoints(v string) error {
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" && !slices.Contains(adminEndpoints, e) {
+			return fmt.Errorf("unknown endpoint %q, want metrics, pprof, health, faults, drain or config", e)
+		}
+	}
+	return nil
+}
+
+// adminProtected reports whether endpoint needs the admin credentials.
+func adminProtected(endpoint string) bool {
+	return conf("ADMIN_PASSWORD") != "" && slices.Contains(confList("ADMIN_ENDPOINTS"), endpoint)
+}
+
+// adminAuthorized reports whether r carries the admin credentials. Both
+// are compared as SHA-256 digests in constant time, so neither their
+// length nor a matching prefix shows in the timing.
+func adminAuthorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	equal := func(got, want string) int {
+		g, w := sha256.Sum256([]byte(got)), sha256.Sum256([]byte(want))
+		return subtle.ConstantTimeCompare(g[:], w[:])
+	}
+	return equal(user, conf("ADMIN_USERNAME"))&equal(pass, conf("ADMIN_PASSWORD")) == 1
+}
+
+// requireAdmin serves next only with the admin credentials while
+// endpoint is protected. The check runs per request, so a reloaded
+// ADMIN_PASSWORD applies at once.
+func requireAdmin(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminProtected(endpoint) && !adminAuthorized(r) {
+			if _, _, ok := r.BasicAuth(); ok {
+				requestLogger(r).Warn("admin credentials rejected", "endpoint", endpoint, "path", r.URL.Path)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="[% APP_NAME %] admin", charset="UTF-8"`)
+			writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
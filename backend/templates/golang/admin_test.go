@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func basicAuth(user, pass string) []string {
+	return []string{"Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))}
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := requireAdmin("metrics", metricsHandler)
+
+	t.Setenv("ADMIN_PASSWORD", "")
+	if w := do(h, "GET", "/metrics", nil); w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics without ADMIN_PASSWORD = %d, want 200", w.Code)
+	}
+
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+	for name, header := range map[string][]string{
+		"no credentials": nil,
+		"wrong password": basicAuth("admin", "guess"),
+		"wrong user":     basicAuth("root", "s3cret-admin-pass"),
+		"bearer":         {"Authorization", "Bearer s3cret-admin-pass"},
+	} {
+		w := do(h, "GET", "/metrics", nil, header...)
+		if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s: got %d WWW-Authenticate %q, want 401 with a Basic challenge", name, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	if w := do(h, "GET", "/metrics", nil, basicAuth("admin", "s3cret-admin-pass")...); w.Code != http.StatusOK {
+		t.Errorf("GET /metrics with the admin credentials = %d, want 200", w.Code)
+	}
+
+	t.Setenv("ADMIN_ENDPOINTS", "pprof,health")
+	if w := do(h, "GET", "/metrics", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /metrics with metrics left out of ADMIN_ENDPOINTS = %d, want 200", w.Code)
+	}
+}
+
+func TestHealthDetailNeedsAdmin(t *testing.T) {
+	withChecks(t)
+	livenessChecks.register("deadlock", checkFunc(failingCheck), 0)
+	t.Setenv("HEALTH_DETAIL", "true")
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+
+	var resp HealthResponse
+	w := do(http.HandlerFunc(healthHandler), "GET", "/healthz", nil)
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Checks != nil {
+		t.Fatalf("GET /healthz without credentials = %d with %d check details, want 503 and none", w.Code, len(resp.Checks))
+	}
+
+	w = do(http.HandlerFunc(healthHandler), "GET", "/healthz", nil, basicAuth("admin", "s3cret-admin-pass")...)
+	decode(t, w, &resp)
+	if len(resp.Checks) != 1 || resp.Checks[0].Name != "deadlock" {
+		t.Fatalf("GET /healthz with the admin credentials has check details %+v, want the deadlock check", resp.Checks)
+	}
+}
+
+func TestPprofOnAppPort(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+	mux := http.NewServeMux()
+	registerPprof(mux)
+
+	if w := do(mux, "GET", "/debug/pprof/cmdline", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /debug/pprof/cmdline without credentials = %d, want 401", w.Code)
+	}
+	if w := do(mux, "GET", "/debug/pprof/cmdline", nil, basicAuth("admin", "s3cret-admin-pass")...); w.Code != http.StatusOK {
+		t.Errorf("GET /debug/pprof/cmdline with the admin credentials = %d, want 200", w.Code)
+	}
+}
+
+func TestCheckAdminEndpoints(t *testing.T) {
+	if err := checkAdminEndpoints("metrics, pprof"); err != nil {
+		t.Errorf("checkAdminEndpoints(metrics, pprof) = %v", err)
+	}
+	if err := checkAdminEndpoints("metrics,debug"); err == nil {
+		t.Error("checkAdminEndpoints(metrics,debug) accepted an unknown endpoint")
+	}
+}
+
+func TestAdminPort(t *testing.T) {
+	withChecks(t)
+	t.Setenv("ADMIN_PORT", "9091")
+	t.Setenv("ENABLE_PPROF", "true")
+	app := http.NewServeMux()
+	registerPlatform(app)
+	admin := newAdminServer()
+
+	for _, path := range []string{"/healthz", "/readyz", "/startupz", "/metrics"} {
+		if w := do(app, "GET", path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s on the app port = %d, want 404", path, w.Code)
+		}
+		if w := do(admin.Handler, "GET", path, nil); w.Code != http.StatusOK {
+			t.Errorf("GET %s on the admin port = %d, want 200", path, w.Code)
+		}
+	}
+	if w := do(admin.Handler, "GET", "/debug/pprof/cmdline", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /debug/pprof/cmdline on the admin port = %d, want 200", w.Code)
+	}
+	if w := do(app, "GET", "/version", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /version on the app port = %d, want 200", w.Code)
+	}
+
+	t.Setenv("ADMIN_PORT", "")
+	if newAdminServer() != nil {
+		t.Error("admin server without ADMIN_PORT")
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	startupOnce.Do(loadStartupSources)
+	sources, hooks := currentSources.Load(), reloadHooks
+	reloadHooks = nil
+	t.Cleanup(func() { currentSources.Store(sources); reloadHooks = hooks })
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+	t.Setenv("API_KEYS", "billing:"+billingKey)
+
+	mux := http.NewServeMux()
+	registerConfigEndpoint(mux)
+	if w := do(mux, "GET", "/admin/config", nil, basicAuth("admin", "s3cret-admin-pass")...); w.Code != http.StatusNotFound {
+		t.Fatalf("GET /admin/config without ENABLE_CONFIG_ENDPOINT = %d, want 404", w.Code)
+	}
+
+	t.Setenv("ENABLE_CONFIG_ENDPOINT", "true")
+	mux = http.NewServeMux()
+	registerConfigEndpoint(mux)
+	if w := do(mux, "GET", "/admin/config", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /admin/config without credentials = %d, want 401", w.Code)
+	}
+	get := func() map[string]ConfigSetting {
+		t.Helper()
+		w := do(mux, "GET", "/admin/config", nil, basicAuth("admin", "s3cret-admin-pass")...)
+		var resp ConfigResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusOK || len(resp.Settings) != len(settings) {
+			t.Fatalf("GET /admin/config = %d with %d settings, want 200 with %d", w.Code, len(resp.Settings), len(settings))
+		}
+		byName := map[string]ConfigSetting{}
+		for _, s := range resp.Settings {
+			byName[s.Name] = s
+		}
+		return byName
+	}
+
+	got := get()
+	for name, want := range map[string]ConfigSetting{
+		"API_KEYS":       {Name: "API_KEYS", Value: "[redacted]", Source: "env", Reloadable: true},
+		"ADMIN_PASSWORD": {Name: "ADMIN_PASSWORD", Value: "[redacted]", Source: "env", Reloadable: true},
+		"LOG_LEVEL":      {Name: "LOG_LEVEL", Value: "info", Source: "default", Reloadable: true},
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %+v, want %+v", name, got[name], want)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(file, []byte("LOG_LEVEL: debug\nSECURITY_CONTACT: security@example.com\n"), 0o600)
+	t.Setenv("CONFIG_FILE", file)
+	reloadConfig()
+	got = get()
+	if s := got["LOG_LEVEL"]; s.Value != "debug" || s.Source != "CONFIG_FILE" {
+		t.Errorf("LOG_LEVEL after a reload = %+v, want debug from CONFIG_FILE", s)
+	}
+	if s := got["SECURITY_CONTACT"]; s.Value != "" || !s.RestartPending {
+		t.Errorf("SECURITY_CONTACT after a reload = %+v, want the startup value with a restart pending", s)
+	}
+
+	// The remote URL can carry a token.
+	t.Setenv("REMOTE_CONFIG_URL", "https://control.example/config?token=s3cret-token")
+	var resp ConfigResponse
+	decode(t, do(mux, "GET", "/admin/config", nil, basicAuth("admin", "s3cret-admin-pass")...), &resp)
+	if resp.RemoteURL != "[redacted]" {
+		t.Errorf("remote_url = %q, want it redacted", resp.RemoteURL)
+	}
+	t.Setenv("REMOTE_CONFIG_URL", "")
+
+	// A reload that unsets the password closes the endpoint rather than
+	// opening it.
+	t.Setenv("ADMIN_PASSWORD", "")
+	if w := do(mux, "GET", "/admin/config", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/config once ADMIN_PASSWORD is unset = %d, want 404", w.Code)
+	}
+}
+
+func TestConfigEndpointAdminPort(t *testing.T) {
+	withChecks(t)
+	t.Setenv("ADMIN_PORT", "9091")
+	t.Setenv("ENABLE_CONFIG_ENDPOINT", "true")
+	t.Setenv("ADMIN_PASSWORD", "")
+	if w := do(newAdminServer().Handler, "GET", "/admin/config", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/config on the admin port without ADMIN_PASSWORD = %d, want 404", w.Code)
+	}
+
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+	admin := newAdminServer().Handler
+	if w := do(admin, "GET", "/admin/config", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/config on the admin port without credentials = %d, want 401", w.Code)
+	}
+	if w := do(admin, "GET", "/admin/config", nil, basicAuth("admin", "s3cret-admin-pass")...); w.Code != http.StatusOK {
+		t.Errorf("GET /admin/config on the admin port with credentials = %d, want 200", w.Code)
+	}
+	app := http.NewServeMux()
+	registerConfigEndpoint(app)
+	if w := do(app, "GET", "/admin/config", nil, basicAuth("admin", "s3cret-admin-pass")...); w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/config on the app port with ADMIN_PORT set = %d, want 404", w.Code)
+	}
+}
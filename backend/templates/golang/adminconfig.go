@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The effective configuration, for "what is this instance running with"
+// during incidents and after deploys. Off unless ENABLE_CONFIG_ENDPOINT
+// is true:
+//
+//	GET /admin/config  every setting's value in effect, with secrets
+//	                   redacted, where it came from and whether a changed
+//	                   value is waiting for a restart
+//
+// Values are read as conf reads them, so a reloadable setting shows its
+// reloaded value as soon as reloadConfig applies it, and any other setting
+// the value it started with. "source" is env, NAME_FILE, remote,
+// CONFIG_FILE, profile (the ENVIRONMENT's observability defaults,
+// observability.go) or default; "invalid" marks a configured value that
+// failed validation and was replaced by the default.
+//
+// The endpoint always needs the admin credentials (admin.go): it is not
+// served unless ADMIN_PASSWORD is set and config is among
+// ADMIN_ENDPOINTS, and answers 404 while a reload leaves it without them.
+// It is on the admin server with ADMIN_PORT set and on the application
+// port otherwise. REMOTE_CONFIG_URL is a secret, since the URL can carry
+// a token, so remote_url is redacted like the secret settings.
+
+// configPath is where the effective configuration is served.
+const configPath = "/admin/config"
+
+// ConfigResponse answers GET /admin/config.
+type ConfigResponse struct {
+	ConfigFile string          `json:"config_file,omitempty"`
+	RemoteURL  string          `json:"remote_url,omitempty"`
+	RemoteErr  string          `json:"remote_error,omitempty"`
+	Settings   []ConfigSetting `json:"settings"`
+	Timestamp  string          `json:"timestamp"`
+}
+
+// ConfigSetting is one setting in a ConfigResponse.
+type ConfigSetting struct {
+	Name           string `json:"name"`
+	Value          string `json:"value"`
+	Source         string `json:"source"`
+	Reloadable     bool   `json:"reloadable"`
+	Invalid        bool   `json:"invalid,omitempty"`
+	RestartPending bool   `json:"restart_pending,omitempty"`
+}
+
+// registerConfigEndpoint adds /admin/config on the application port when
+// ENABLE_CONFIG_ENDPOINT is set and ADMIN_PORT is not; newAdminServer
+// (server.go) serves it otherwise.
+func registerConfigEndpoint(mux *http.ServeMux) {
+	if conf("ADMIN_PORT") == "" && configEndpointEnabled() {
+		handleGet(mux, configPath, serveConfig)
+	}
+}
+
+// configEndpointEnabled reports whether /admin/config is to be served:
+// ENABLE_CONFIG_ENDPOINT is set and so are the credentials it needs.
+func configEndpointEnabled() bool {
+	if !confBool("ENABLE_CONFIG_ENDPOINT") {
+		return false
+	}
+	if !adminProtected("config") {
+		slog.Error("ENABLE_CONFIG_ENDPOINT ignored: it needs ADMIN_PASSWORD set and config in ADMIN_ENDPOINTS")
+		return false
+	}
+	return true
+}
+
+// serveConfig is configHandler behind the admin credentials. Where
+// requireAdmin alone would serve an endpoint openly once a reload unsets
+// ADMIN_PASSWORD, this one is closed instead.
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	if !adminProtected("config") {
+		notFound(w, r)
+		return
+	}
+	requireAdmin("config", configHandler)(w, r)
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	startupOnce.Do(loadStartupSources)
+	current := currentSources.Load()
+	resp := ConfigResponse{
+		ConfigFile: os.Getenv("CONFIG_FILE"),
+		RemoteURL:  redact(settingIndex["REMOTE_CONFIG_URL"], conf("REMOTE_CONFIG_URL")),
+		Settings:   make([]ConfigSetting, 0, len(settings)),
+		Timestamp:  time.Now().Format(time.RFC3339),
+	}
+	if current.remoteErr != nil {
+		resp.RemoteErr = current.remoteErr.Error()
+	}
+	for i := range settings {
+		s := &settings[i]
+		src := sourcesFor(s)
+		raw := rawSetting(s, src)
+		resp.Settings = append(resp.Settings, ConfigSetting{
+			Name:           s.name,
+			Value:          redact(s, s.effective(src)),
+			Source:         settingSource(s, src),
+			Reloadable:     s.reloadable,
+			Invalid:        raw != "" && s.validate(raw) != nil,
+			RestartPending: !s.reloadable && s.effective(current) != s.effective(src),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// settingSource names where rawSetting found s's value.
+func settingSource(s *setting, src *configSources) string {
+	if strings.TrimSpace(os.Getenv(s.name)) != "" {
+		return "env"
+	}
+	if _, ok := src.secrets[s.name]; ok {
+		return s.name + "_FILE"
+	}
+	if _, ok := src.remote[s.name]; ok {
+		return "remote"
+	}
+	if v := src.file[s.name]; v != "" {
+		return "CONFIG_FILE"
+	}
+	if _, ok := profileDefault(s, src); ok {
+		return "profile"
+	}
+	return "default"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// JSON helpers for API handlers, included by the Go templates that serve
+// a JSON API. Errors are answered with writeError, in the platform's
+// error envelope (errors.go).
+
+// writeJSON writes v as the response body with the given status. A nil
+// slice is written as [] rather than null, so list endpoints always return
+// an array.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = []any{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requestError is a problem with the request body, carrying the status
+// to answer it with. Its message is safe to return to the client.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string { return e.message }
+
+func badBody(format string, args ...any) *requestError {
+	return &requestError{status: http.StatusBadRequest, message: "invalid JSON body: " + fmt.Sprintf(format, args...)}
+}
+
+// readJSON decodes the request body into v. It rejects a Content-Type
+// other than JSON (415), bodies over MAX_REQUEST_BODY (413), and
+// malformed JSON, values of the wrong type, unknown fields and trailing
+// data (400), so a typo in a field name fails loudly instead of leaving
+// the field at its zero value. Errors are *requestError; answer them with
+// writeRequestError.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mt != "application/json" && !strings.HasSuffix(mt, "+json")) {
+			return &requestError{status: http.StatusUnsupportedMediaType, message: "Content-Type must be application/json"}
+		}
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return badBody("unexpected data after the value")
+	}
+	return nil
+}
+
+// decodeError turns a json.Decoder error into a *requestError that says
+// what was wrong and where, without echoing the body back.
+func decodeError(err error) *requestError {
+	var (
+		maxErr    *http.MaxBytesError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &maxErr):
+		return &requestError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("request body larger than %d bytes", maxErr.Limit)}
+	case errors.Is(err, io.EOF):
+		return badBody("request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return badBody("unexpected end of input")
+	case errors.As(err, &syntaxErr):
+		return badBody("syntax error at byte %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return badBody("field %q must be %s", typeErr.Field, jsonKind(typeErr.Type))
+	case errors.As(err, &typeErr):
+		return badBody("want %s", jsonKind(typeErr.Type))
+	}
+	// DisallowUnknownFields reports an untyped error.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return badBody("unknown field %s", field)
+	}
+	return badBody("%s", strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// jsonKind names the JSON value that decodes into t.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	}
+	return "a " + t.String()
+}
+
+// writeRequestError answers a readJSON error with its status, or 400 for
+// any other error.
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, requestErrorStatus(err), err.Error())
+}
+
+// requestErrorStatus is the status for a readJSON error.
+func requestErrorStatus(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.status
+	}
+	return http.StatusBadRequest
+}
+
+// pathID parses the path value name, as in "GET /items/{id}", as a
+// positive integer ID. Anything else names no resource, so it writes a 404
+// saying what was not found:
+//
+//	id, ok := pathID(w, r, "id", "item")
+//	if !ok {
+//		return
+//	}
+func pathID(w http.ResponseWriter, r *http.Request, name, what string) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil || id < 1 {
+		writeError(w, r, http.StatusNotFound, what+" not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// queryInt reads the query parameter name as an integer from lo to hi,
+// returning def when it is absent. Out of range or not a number, it writes
+// a 400 naming the parameter and the range. Pass math.MaxInt as hi for no
+// upper bound.
+func queryInt(w http.ResponseWriter, r *http.Request, name string, def, lo, hi int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		if hi == math.MaxInt {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s must be an integer of at least %d", name, lo))
+		} else {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s must be an integer between %d and %d", name, lo, hi))
+		}
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSONNilSlice(t *testing.T) {
+	w := httptest.NewRecorder()
+	var items []string
+	writeJSON(w, http.StatusOK, items)
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Fatalf("writeJSON(nil slice) = %s, want []", got)
+	}
+}
+
+func TestWriteErrorIncludesRequestID(t *testing.T) {
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusTeapot, "short and stout")
+	}))
+	w := do(h, "GET", "/", nil, requestIDHeader, "req-1")
+	var resp map[string]string
+	decode(t, w, &resp)
+	if w.Code != http.StatusTeapot || resp["error"] != "short and stout" || resp["request_id"] != "req-1" {
+		t.Fatalf("writeError = %d %v", w.Code, resp)
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	type input struct {
+		Name  string `json:"name"`
+		Price int    `json:"price"`
+	}
+	tests := []struct {
+		body        string
+		contentType string
+		wantStatus  int
+		wantErr     string
+	}{
+		{body: `{"name": "a", "price": 3}`},
+		{body: `{"name": "a"}`, contentType: "application/json; charset=utf-8"},
+		{body: `{"name": "a"}`, contentType: "application/merge-patch+json"},
+		{body: `{"name": "a"}`, contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType, wantErr: "Content-Type"},
+		{body: `{"name": "a", "extra": 1}`, wantStatus: http.StatusBadRequest, wantErr: `unknown field "extra"`},
+		{body: `{"name": "a", "price": "3"}`, wantStatus: http.StatusBadRequest, wantErr: `field "price" must be an integer`},
+		{body: `{"name": "a"} {}`, wantStatus: http.StatusBadRequest, wantErr: "unexpected data"},
+		{body: `{"name": "a"} }`, wantStatus: http.StatusBadRequest, wantErr: "unexpected data"},
+		{body: `{"name": "a",, }`, wantStatus: http.StatusBadRequest, wantErr: "syntax error at byte 14"},
+		{body: `{"name": `, wantStatus: http.StatusBadRequest, wantErr: "unexpected end"},
+		{body: ``, wantStatus: http.StatusBadRequest, wantErr: "empty"},
+		{body: `{"name": "` + strings.Repeat("a", defaultMaxRequestBody) + `"}`, wantStatus: http.StatusRequestEntityTooLarge, wantErr: "larger than"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		var in input
+		err := readJSON(httptest.NewRecorder(), r, &in)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("readJSON(%.40q) = %v, want no error", tt.body, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("readJSON(%.40q) = %v, want an error containing %q", tt.body, err, tt.wantErr)
+		case err != nil && requestErrorStatus(err) != tt.wantStatus:
+			t.Errorf("readJSON(%.40q) status = %d, want %d", tt.body, requestErrorStatus(err), tt.wantStatus)
+		}
+	}
+}
+
+func TestWriteRequestError(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]any
+		if err := readJSON(w, r, &v); err != nil {
+			writeRequestError(w, r, err)
+		}
+	})
+	w := do(h, "POST", "/", strings.NewReader(`<xml/>`), "Content-Type", "application/xml")
+	var resp map[string]string
+	decode(t, w, &resp)
+	if w.Code != http.StatusUnsupportedMediaType || resp["error"] != "Content-Type must be application/json" {
+		t.Fatalf("XML body = %d %v, want a JSON 415", w.Code, resp)
+	}
+}
+
+func TestPathID(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := pathID(w, r, "id", "thing"); ok {
+			writeJSON(w, http.StatusOK, id)
+		}
+	})
+	if w := do(mux, "GET", "/things/42", nil); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "42" {
+		t.Errorf("GET /things/42 = %d %s, want 200 42", w.Code, w.Body)
+	}
+	for _, path := range []string{"/things/0", "/things/-1", "/things/abc", "/things/99999999999999999999"} {
+		w := do(mux, "GET", path, nil)
+		var resp map[string]string
+		decode(t, w, &resp)
+		if w.Code != http.StatusNotFound || resp["error"] != "thing not found" {
+			t.Errorf("GET %s = %d %v, want a JSON 404", path, w.Code, resp)
+		}
+	}
+}
+
+func TestQueryInt(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		hi      int
+		want    int
+		wantErr string
+	}{
+		{"", 100, 10, ""},
+		{"n=1", 100, 1, ""},
+		{"n=100", 100, 100, ""},
+		{"n=1000000", math.MaxInt, 1000000, ""},
+		{"n=0", 100, 0, "n must be an integer between 1 and 100"},
+		{"n=101", 100, 0, "n must be an integer between 1 and 100"},
+		{"n=ten", 100, 0, "n must be an integer between 1 and 100"},
+		{"n=0", math.MaxInt, 0, "n must be an integer of at least 1"},
+	} {
+		r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		n, ok := queryInt(w, r, "n", 10, 1, tt.hi)
+		var resp map[string]string
+		if !ok {
+			decode(t, w, &resp)
+		}
+		if n != tt.want || ok != (tt.wantErr == "") || resp["error"] != tt.wantErr {
+			t.Errorf("queryInt(%q) = %d %v %v, want %d %q", tt.query, n, ok, resp, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// API key authentication for service-to-service callers that do not need
+// OAuth. Disabled unless API_KEYS is set.
+//
+//	API_KEYS        the accepted keys as id:key entries, separated by commas
+//	                or newlines; secret and reloadable, so mounting it with
+//	                API_KEYS_FILE lets keys rotate without a restart
+//	API_KEY_HEADER  header carrying the key (default X-API-Key)
+//
+// Requests to AUTH_PATHS (see auth.go) need a key from API_KEYS. The id
+// names the caller, e.g. "billing-service": it is logged as api_key_id on
+// the request's lines, and handlers read it with apiKeyID. Keys themselves
+// are never logged. Keys are compared by their SHA-256 digests in constant
+// time, against every configured key, so timing reveals neither a key nor
+// which one matched.
+//
+// With JWT authentication enabled too, either credential will do: a
+// request with a valid API key skips the token check, and one without an
+// API key header is left to jwtMiddleware.
+
+// apiKeyMinLength rejects keys short enough to guess.
+const apiKeyMinLength = 16
+
+type apiKey struct {
+	id     string
+	digest [sha256.Size]byte
+}
+
+// parseAPIKeys parses API_KEYS. Errors name the entry by position or id,
+// never by key.
+func parseAPIKeys(raw string) ([]apiKey, error) {
+	var keys []apiKey
+	ids := map[string]bool{}
+	digests := map[[sha256.Size]byte]bool{}
+	for i, entry := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(entry, ":")
+		id, key = strings.TrimSpace(id), strings.TrimSpace(key)
+		switch {
+		case !ok || id == "" || key == "":
+			return nil, fmt.Errorf("entry %d: want id:key", i+1)
+		case !contextHeaderValue.MatchString(id):
+			return nil, fmt.Errorf("entry %d: id must be letters, digits and ._:@-", i+1)
+		case ids[id]:
+			return nil, fmt.Errorf("id %q used twice", id)
+		case len(key) < apiKeyMinLength:
+			return nil, fmt.Errorf("key %q shorter than %d characters", id, apiKeyMinLength)
+		}
+		digest := sha256.Sum256([]byte(key))
+		if digests[digest] {
+			return nil, fmt.Errorf("key %q is also another id's key", id)
+		}
+		ids[id], digests[digest] = true, true
+		keys = append(keys, apiKey{id: id, digest: digest})
+	}
+	return keys, nil
+}
+
+func checkAPIKeys(v string) error {
+	_, err := parseAPIKeys(v)
+	return err
+}
+
+// apiKeyAuth holds the accepted keys, swapped by reload.
+type apiKeyAuth struct {
+	header string
+
+	mu   sync.RWMutex
+	keys []apiKey
+}
+
+// newAPIKeyAuth reads the API_KEY* variables; nil means API key
+// authentication is disabled.
+func newAPIKeyAuth() *apiKeyAuth {
+	keys, _ := parseAPIKeys(conf("API_KEYS"))
+	if len(keys) == 0 {
+		return nil
+	}
+	a := &apiKeyAuth{header: conf("API_KEY_HEADER"), keys: keys}
+	onConfigReload(a.reload)
+	slog.Info("API key authentication enabled", "header", a.header, "key_ids", a.ids(),
+		"paths", authPaths())
+	return a
+}
+
+// reload applies a new API_KEYS. Removing every key would open the API,
+// so an empty set keeps the current keys until restart.
+func (a *apiKeyAuth) reload() {
+	keys, err := parseAPIKeys(conf("API_KEYS"))
+	if err != nil || len(keys) == 0 {
+		slog.Warn("API_KEYS empty or invalid after reload, keeping the current keys", "error", err)
+		return
+	}
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	slog.Info("API keys reloaded", "key_ids", a.ids())
+}
+
+func (a *apiKeyAuth) ids() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ids := make([]string, len(a.keys))
+	for i, k := range a.keys {
+		ids[i] = k.id
+	}
+	return ids
+}
+
+// match returns the id of key, or false if no configured key matches.
+func (a *apiKeyAuth) match(key string) (string, bool) {
+	digest := sha256.Sum256([]byte(key))
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var id string
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(digest[:], k.digest[:]) == 1 {
+			id = k.id
+		}
+	}
+	return id, id != ""
+}
+
+// apiKeyID returns the id of the API key the request authenticated with,
+// or "".
+func apiKeyID(ctx context.Context) string {
+	if ident, ok := ctx.Value(identityKey{}).(*identity); ok {
+		return ident.apiKeyID
+	}
+	return ""
+}
+
+// apiKeyMiddleware requires a valid API key on AUTH_PATHS.
+func apiKeyMiddleware(a *apiKeyAuth, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	paths := authPaths()
+	jwtEnabled := conf("JWT_JWKS_URL") != ""
+	challenge := fmt.Sprintf("APIKey header=%q", a.header)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) || !protectedPath(r.URL.Path, paths) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get(a.header)
+		if key == "" {
+			if jwtEnabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			unauthorized(w, r, challenge, "missing API key")
+			return
+		}
+		id, ok := a.match(key)
+		if !ok {
+			requestLogger(r).Info("rejected API key")
+			unauthorized(w, r, challenge, "invalid API key")
+			return
+		}
+		r, ident := withIdentity(r)
+		ident.apiKeyID = id
+		next.ServeHTTP(w, r)
+	})
+}
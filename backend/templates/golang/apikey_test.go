@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	billingKey = "billing-0123456789abcdef"
+	reportsKey = "reports-0123456789abcdef"
+)
+
+// withAPIKeys enables API key authentication on /api/ and returns a
+// handler behind it that echoes the caller's key id.
+func withAPIKeys(t *testing.T) http.Handler {
+	t.Setenv("API_KEYS", "billing:"+billingKey+",\nreports:"+reportsKey)
+	t.Setenv("AUTH_PATHS", "/api/")
+	t.Setenv("JWT_JWKS_URL", "")
+	return apiKeyMiddleware(newAPIKeyAuth(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(apiKeyID(r.Context())))
+	}))
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	h := withAPIKeys(t)
+
+	for id, key := range map[string]string{"billing": billingKey, "reports": reportsKey} {
+		w := do(h, "GET", "/api/items", nil, "X-API-Key", key)
+		if w.Code != http.StatusOK || w.Body.String() != id {
+			t.Errorf("%s key: got %d %q, want 200 %q", id, w.Code, w.Body.String(), id)
+		}
+	}
+	for name, key := range map[string]string{"no key": "", "wrong key": "billing-0123456789abcdeX", "prefix": billingKey[:16]} {
+		w := do(h, "GET", "/api/items", nil, "X-API-Key", key)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `APIKey header="X-API-Key"` {
+			t.Errorf("%s: got %d WWW-Authenticate %q, want 401 with an APIKey challenge", name, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	if w := do(h, "GET", "/healthz", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /healthz without a key = %d, want 200: only AUTH_PATHS need one", w.Code)
+	}
+
+	// Only a CORS preflight skips the key; a plain OPTIONS reaches
+	// handlers registered for every method, so it needs one too.
+	if w := do(h, "OPTIONS", "/api/items", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("OPTIONS without a key = %d, want 401", w.Code)
+	}
+	if w := do(h, "OPTIONS", "/api/items", nil, "Access-Control-Request-Method", "POST"); w.Code != http.StatusUnauthorized {
+		t.Errorf("OPTIONS with Access-Control-Request-Method but no Origin = %d, want 401", w.Code)
+	}
+	w := do(h, "OPTIONS", "/api/items", nil, "Origin", "https://app.example", "Access-Control-Request-Method", "POST")
+	if w.Code != http.StatusOK {
+		t.Errorf("CORS preflight without a key = %d, want 200", w.Code)
+	}
+}
+
+func TestAPIKeyLogged(t *testing.T) {
+	h := withAPIKeys(t)
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	do(accessLogMiddleware(h), "GET", "/api/items", nil, "X-API-Key", billingKey)
+	do(accessLogMiddleware(h), "GET", "/api/items", nil, "X-API-Key", "not-"+reportsKey)
+
+	logs := buf.String()
+	if !strings.Contains(logs, `"api_key_id":"billing"`) {
+		t.Errorf("access log lacks the key id:\n%s", logs)
+	}
+	if strings.Contains(logs, billingKey) || strings.Contains(logs, reportsKey) {
+		t.Errorf("logs contain a key:\n%s", logs)
+	}
+}
+
+func TestAPIKeyOrJWT(t *testing.T) {
+	idp := newTestIdP(t)
+	_, jwt := withJWT(t, idp)
+	t.Setenv("API_KEYS", "billing:"+billingKey)
+	h := apiKeyMiddleware(newAPIKeyAuth(), jwt)
+
+	if w := do(h, "GET", "/api/items", nil, "X-API-Key", billingKey); w.Code != http.StatusOK {
+		t.Errorf("API key without a token = %d, want 200", w.Code)
+	}
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-1", validClaims()))...); w.Code != http.StatusOK {
+		t.Errorf("token without an API key = %d, want 200", w.Code)
+	}
+	if w := do(h, "GET", "/api/items", nil); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("neither = %d WWW-Authenticate %q, want 401 Bearer", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if w := do(h, "GET", "/api/items", nil, "X-API-Key", "wrong-"+billingKey); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid API key = %d, want 401 even though a token would do", w.Code)
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys("# service keys\nbilling:" + billingKey + "\n\nreports : " + reportsKey + "\n")
+	if err != nil || len(keys) != 2 || keys[0].id != "billing" || keys[1].id != "reports" {
+		t.Fatalf("parseAPIKeys = %v, %v; want billing and reports", keys, err)
+	}
+	for _, raw := range []string{
+		billingKey,
+		"billing:",
+		"bill ing:" + billingKey,
+		"billing:short",
+		"billing:" + billingKey + ",billing:" + reportsKey,
+		"billing:" + billingKey + ",reports:" + billingKey,
+	} {
+		_, err := parseAPIKeys(raw)
+		if err == nil {
+			t.Errorf("parseAPIKeys(%q) succeeded, want an error", raw)
+		} else if strings.Contains(err.Error(), billingKey) || strings.Contains(err.Error(), reportsKey) {
+			t.Errorf("parseAPIKeys(%q) error %q contains the key", raw, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// The app itself: what this service does on top of the platform files
+// (configuration, health, logging, metrics, tracing, middleware). Template
+// variants replace this file, and it is where customer code starts.
+//
+//	appSettings  settings read by the app's own code, declared and read
+//	             like the platform's in config.go
+//	setupApp     registers the app's routes on mux, and any readiness
+//	             checks, startup tasks and background services it needs.
+//	             It runs once before the server starts; an error stops
+//	             startup.
+
+var appSettings = landingSettings
+
+func setupApp(mux *http.ServeMux) error {
+	loadLandingPage()
+	mux.HandleFunc("/", rootHandler)
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWT authentication for the app's API routes. Disabled unless
+// JWT_JWKS_URL is set.
+//
+//	JWT_JWKS_URL      URL of the identity provider's JSON Web Key Set,
+//	                  e.g. https://idp.example.com/.well-known/jwks.json
+//	JWT_ISSUER        required "iss" claim
+//	JWT_AUDIENCE      "aud" claim the token must include
+//	JWT_LEEWAY        clock skew allowed on exp and nbf (default 30s)
+//	JWT_JWKS_REFRESH  how often the key set is re-fetched (default 1h)
+//	AUTH_PATHS        comma-separated path prefixes that need a token, or
+//	                  an API key (apikey.go); default [% AUTH_PATHS %].
+//	                  Everything else, including the probes and the landing
+//	                  page, stays open
+//
+// Requests to AUTH_PATHS need "Authorization: Bearer <token>", a JWT
+// signed with a key from the key set (RS*, PS*, ES* or EdDSA), unexpired,
+// and matching JWT_ISSUER and JWT_AUDIENCE when those are set. Otherwise
+// they get 401 with a WWW-Authenticate header. Handlers read the verified
+// claims with claimsFromContext.
+//
+// A token signed with a key the cached set does not have triggers a
+// re-fetch, at most once every jwksMinRefresh, so key rotation at the
+// provider needs no restart. If the provider is unreachable the last key
+// set keeps being used.
+
+// jwksMinRefresh limits re-fetches triggered by unknown key IDs, so
+// tokens with made-up IDs cannot hammer the provider.
+const jwksMinRefresh = time.Minute
+
+// jwksFetchTimeout bounds a key set fetch.
+const jwksFetchTimeout = 5 * time.Second
+
+// jwtClaims are the claims of a verified token.
+type jwtClaims map[string]any
+
+// subject is the token's "sub" claim.
+func (c jwtClaims) subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+type claimsKey struct{}
+
+// claimsFromContext returns the claims of the request's verified token,
+// or nil if the route does not need one.
+func claimsFromContext(ctx context.Context) jwtClaims {
+	claims, _ := ctx.Value(claimsKey{}).(jwtClaims)
+	return claims
+}
+
+// authPaths returns the prefixes that need a token or an API key:
+// AUTH_PATHS, and the route policies setting Auth (routepolicy.go).
+func authPaths() []string {
+	return slices.Concat(confList("AUTH_PATHS"), policyAuthPaths())
+}
+
+// protectedPath reports whether path falls under one of prefixes: "/items"
+// covers /items and /items/42, "/api/" everything below /api/.
+func protectedPath(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type jwtVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	leeway   time.Duration
+	refresh  time.Duration
+	client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // by key ID
+	fetchedAt time.Time
+	triedAt   time.Time
+	// refreshing is closed when the fetch in flight ends; nil when there
+	// is none.
+	refreshing chan struct{}
+}
+
+// newJWTVerifier reads the JWT_* variables; nil means JWT authentication
+// is disabled.
+func newJWTVerifier() *jwtVerifier {
+	jwksURL := conf("JWT_JWKS_URL")
+	if jwksURL == "" {
+		return nil
+	}
+	v := &jwtVerifier{
+		jwksURL:  jwksURL,
+		issuer:   conf("JWT_ISSUER"),
+		audience: conf("JWT_AUDIENCE"),
+		leeway:   confDuration("JWT_LEEWAY"),
+		refresh:  confDuration("JWT_JWKS_REFRESH"),
+		client:   &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if v.audience == "" {
+		slog.Warn("JWT_AUDIENCE unset: tokens the provider issued for other apps are accepted too")
+	}
+	slog.Info("JWT authentication enabled", "jwks_url", jwksURL, "issuer", v.issuer, "audience", v.audience,
+		"paths", authPaths())
+	return v
+}
+
+// errTokenInvalid is returned for every token that fails verification;
+// the wrapped detail is logged, not sent to the client.
+var errTokenInvalid = errors.New("invalid token")
+
+// verify checks a compact JWT and returns its claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", errTokenInvalid)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errTokenInvalid, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", errTokenInvalid, err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errTokenInvalid, err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+	return claims, nil
+}
+
+func (v *jwtVerifier) checkClaims(c jwtClaims, now time.Time) error {
+	exp, ok := c["exp"].(float64)
+	if !ok {
+		return errors.New("no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return errors.New("expired")
+	}
+	if nbf, ok := c["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("not valid yet")
+	}
+	if v.issuer != "" && c["iss"] != v.issuer {
+		return fmt.Errorf("issuer %v, want %s", c["iss"], v.issuer)
+	}
+	if v.audience != "" {
+		var aud []string
+		switch a := c["aud"].(type) {
+		case string:
+			aud = []string{a}
+		case []any:
+			for _, s := range a {
+				if s, ok := s.(string); ok {
+					aud = append(aud, s)
+				}
+			}
+		}
+		if !slices.Contains(aud, v.audience) {
+			return fmt.Errorf("audience %v, want %s", c["aud"], v.audience)
+		}
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the public key with ID kid, re-fetching the key set when it
+// is stale or does not have the key. A token without a key ID is accepted
+// only while the set holds a single key.
+//
+// One fetch runs at a time, outside the lock: a key already in the set is
+// returned at once, even while a refresh runs, and only callers needing a
+// key the set lacks wait for the fetch, or for their own ctx.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	now := time.Now()
+	key, known := v.lookup(kid)
+	stale := v.keys == nil || !known || now.Sub(v.fetchedAt) > v.refresh
+	if stale && v.refreshing == nil && now.Sub(v.triedAt) >= jwksMinRefresh {
+		v.triedAt = now
+		v.refreshing = make(chan struct{})
+		go v.refreshKeys(ctx, v.refreshing)
+	}
+	refreshing := v.refreshing
+	v.mu.Unlock()
+
+	if known {
+		return key, nil
+	}
+	if refreshing != nil {
+		select {
+		case <-refreshing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.lookup(kid); ok {
+		return key, nil
+	}
+	if v.keys == nil {
+		return nil, errors.New("no signing keys available")
+	}
+	return nil, fmt.Errorf("%w: unknown key ID %q", errTokenInvalid, kid)
+}
+
+// refreshKeys fetches the key set and swaps it in, then closes done. The
+// fetch keeps the values of ctx, the request that triggered it, but not
+// its cancellation, so a client going away cannot abort it for everyone
+// waiting; jwksFetchTimeout bounds it instead.
+func (v *jwtVerifier) refreshKeys(ctx context.Context, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	defer cancel()
+	keys, err := fetchJWKS(ctx, v.client, v.jwksURL)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err != nil {
+		slog.Warn("fetching JWKS failed, keeping the cached keys", "url", v.jwksURL, "error", err, "cached", len(v.keys))
+	} else {
+		v.keys, v.fetchedAt = keys, time.Now()
+	}
+	v.refreshing = nil
+	close(done)
+}
+
+func (v *jwtVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// fetchJWKS downloads a key set and parses its signing keys. Keys of
+// unsupported types are skipped.
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("skipping JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// jwk is a JSON Web Key (RFC 7517).
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(data)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: b64(k.X), Y: b64(k.Y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid or unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks sig over signed with key for the JWS algorithm
+// alg. The algorithm must suit the key's type, so a token cannot pick a
+// weaker scheme (or "none") than the key was published for.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	digest := func(h crypto.Hash) []byte {
+		hh := h.New()
+		hh.Write(signed)
+		return hh.Sum(nil)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if len(alg) != 5 {
+			break
+		}
+		h, ok := hashes[alg[2:]]
+		switch {
+		case ok && alg[:2] == "RS":
+			return rsa.VerifyPKCS1v15(key, h, digest(h), sig)
+		case ok && alg[:2] == "PS":
+			return rsa.VerifyPSS(key, h, digest(h), sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		want := map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}[key.Curve.Params().Name]
+		if alg != want {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("malformed ECDSA signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest(hashes[alg[2:]]), r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signed, sig) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q not allowed for the key", alg)
+}
+
+// jwtMiddleware requires a valid bearer token on AUTH_PATHS and puts its
+// claims in the request context. Requests apiKeyMiddleware already
+// authenticated pass through.
+func jwtMiddleware(v *jwtVerifier, next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	paths := authPaths()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) || !protectedPath(r.URL.Path, paths) || apiKeyID(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			unauthorized(w, r, `Bearer`, "missing bearer token")
+			return
+		}
+		claims, err := v.verify(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			requestLogger(r).Info("rejected bearer token", "error", err)
+			if !errors.Is(err, errTokenInvalid) {
+				// The key set could not be loaded: not the client's fault.
+				writeError(w, r, http.StatusServiceUnavailable, "authentication unavailable")
+				return
+			}
+			unauthorized(w, r, `Bearer error="invalid_token"`, "invalid token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, challenge, message string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, r, http.StatusUnauthorized, message)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIdP is an identity provider serving a JWKS over httptest and
+// signing tokens with its keys.
+type testIdP struct {
+	t       *testing.T
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	keys    atomic.Value // []map[string]string
+	fetches atomic.Int32
+	server  *httptest.Server
+	// hold, when set, is a channel the JWKS handler waits on.
+	hold atomic.Value // chan struct{}
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{t: t, rsaKey: rsaKey, ecKey: ecKey}
+	idp.publish("rsa-1", "ec-1")
+	idp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.fetches.Add(1)
+		if hold, ok := idp.hold.Load().(chan struct{}); ok {
+			<-hold
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": idp.keys.Load()})
+	}))
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// publish replaces the key set with the RSA key under rsaKid and the EC
+// key under ecKid.
+func (idp *testIdP) publish(rsaKid, ecKid string) {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	pub := idp.ecKey.PublicKey
+	idp.keys.Store([]map[string]string{
+		{"kid": rsaKid, "kty": "RSA", "use": "sig", "n": b64(idp.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(idp.rsaKey.E)).Bytes())},
+		{"kid": ecKid, "kty": "EC", "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))},
+	})
+}
+
+// token signs claims with alg (RS256 or ES256) under key ID kid.
+func (idp *testIdP) token(alg, kid string, claims map[string]any) string {
+	idp.t.Helper()
+	seg := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			idp.t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := seg(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims are claims that pass for the verifier set up by withJWT.
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub": "user-42",
+		"iss": "https://idp.example.com",
+		"aud": []string{"other-app", "sample-app"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// withJWT enables JWT authentication on /api/ against idp and returns the
+// verifier and a handler behind it that echoes the token's subject.
+func withJWT(t *testing.T, idp *testIdP) (*jwtVerifier, http.Handler) {
+	t.Setenv("JWT_JWKS_URL", idp.server.URL)
+	t.Setenv("JWT_ISSUER", "https://idp.example.com")
+	t.Setenv("JWT_AUDIENCE", "sample-app")
+	t.Setenv("AUTH_PATHS", "/api/")
+	v := newJWTVerifier()
+	return v, jwtMiddleware(v, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims := claimsFromContext(r.Context()); claims != nil {
+			w.Write([]byte(claims.subject()))
+		}
+	}))
+}
+
+func bearer(token string) []string { return []string{"Authorization", "Bearer " + token} }
+
+func TestJWTMiddleware(t *testing.T) {
+	idp := newTestIdP(t)
+	_, h := withJWT(t, idp)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa-1", "ES256": "ec-1"}[alg]
+		w := do(h, "GET", "/api/items", nil, bearer(idp.token(alg, kid, validClaims()))...)
+		if w.Code != http.StatusOK || w.Body.String() != "user-42" {
+			t.Errorf("%s token: got %d %q, want 200 with the subject from the claims", alg, w.Code, w.Body.String())
+		}
+	}
+
+	w := do(h, "GET", "/api/items", nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("no token: got %d WWW-Authenticate %q, want 401 Bearer", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	w = do(h, "GET", "/", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET / without a token = %d, want 200: only AUTH_PATHS need one", w.Code)
+	}
+	w = do(h, "OPTIONS", "/api/items", nil, "Origin", "https://app.example", "Access-Control-Request-Method", "GET")
+	if w.Code != http.StatusOK {
+		t.Errorf("CORS preflight without a token = %d, want 200", w.Code)
+	}
+	// A plain OPTIONS reaches handlers registered for every method.
+	w = do(h, "OPTIONS", "/api/items", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("OPTIONS without a token = %d, want 401", w.Code)
+	}
+}
+
+func TestJWTMiddlewareRejects(t *testing.T) {
+	idp := newTestIdP(t)
+	_, h := withJWT(t, idp)
+
+	with := func(k string, v any) map[string]any {
+		c := validClaims()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	valid := idp.token("RS256", "rsa-1", validClaims())
+	parts := strings.Split(valid, ".")
+	tokens := map[string]string{
+		"expired":         idp.token("RS256", "rsa-1", with("exp", time.Now().Add(-time.Hour).Unix())),
+		"no exp":          idp.token("RS256", "rsa-1", with("exp", nil)),
+		"not yet valid":   idp.token("RS256", "rsa-1", with("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong issuer":    idp.token("RS256", "rsa-1", with("iss", "https://evil.example.com")),
+		"wrong audience":  idp.token("RS256", "rsa-1", with("aud", "other-app")),
+		"bad signature":   parts[0] + "." + parts[1] + "." + strings.Split(idp.token("RS256", "rsa-1", with("sub", "x")), ".")[2],
+		"alg mismatch":    idp.token("ES256", "rsa-1", validClaims()),
+		"alg none":        base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa-1"}`)) + "." + parts[1] + ".",
+		"unknown key":     idp.token("RS256", "rsa-9", validClaims()),
+		"not a JWT":       "opaque-token",
+		"tampered claims": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`)) + "." + parts[2],
+	}
+	for name, token := range tokens {
+		w := do(h, "GET", "/api/items", nil, bearer(token)...)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+			t.Errorf("%s: got %d WWW-Authenticate %q, want 401 invalid_token", name, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	v, h := withJWT(t, idp)
+
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-1", validClaims()))...); w.Code != http.StatusOK {
+		t.Fatalf("token before rotation = %d, want 200", w.Code)
+	}
+	idp.publish("rsa-2", "ec-2")
+
+	// An unknown key ID right after a fetch waits out jwksMinRefresh.
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-2", validClaims()))...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("rotated key within jwksMinRefresh = %d, want 401", w.Code)
+	}
+	if n := idp.fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	v.mu.Lock()
+	v.triedAt = time.Now().Add(-jwksMinRefresh)
+	v.mu.Unlock()
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-2", validClaims()))...); w.Code != http.StatusOK {
+		t.Fatalf("rotated key after jwksMinRefresh = %d, want 200", w.Code)
+	}
+	if n := idp.fetches.Load(); n != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+// TestJWKSRefreshUnlocked holds a refresh at the provider: requests with
+// a key the cached set has must not wait for it, and a caller that gives
+// up waiting must not abort it for the others.
+func TestJWKSRefreshUnlocked(t *testing.T) {
+	idp := newTestIdP(t)
+	v, h := withJWT(t, idp)
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-1", validClaims()))...); w.Code != http.StatusOK {
+		t.Fatalf("first token = %d, want 200", w.Code)
+	}
+
+	hold := make(chan struct{})
+	idp.hold.Store(hold)
+	idp.publish("rsa-2", "ec-2")
+	v.mu.Lock()
+	v.fetchedAt, v.triedAt = time.Time{}, time.Time{}
+	v.mu.Unlock()
+
+	// The stale set triggers a refresh, which hangs; the known key serves.
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-1", validClaims()))...); w.Code != http.StatusOK {
+		t.Fatalf("cached key during a refresh = %d, want 200", w.Code)
+	}
+
+	// A rotated key waits for the refresh; this caller gives up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequestWithContext(ctx, "GET", "/api/items", nil)
+	r.Header.Set("Authorization", "Bearer "+idp.token("RS256", "rsa-2", validClaims()))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("cancelled caller = %d, want 503", w.Code)
+	}
+
+	// The refresh carries on and serves the next caller, with no new fetch.
+	close(hold)
+	if w := do(h, "GET", "/api/items", nil, bearer(idp.token("RS256", "rsa-2", validClaims()))...); w.Code != http.StatusOK {
+		t.Fatalf("rotated key after the refresh = %d, want 200", w.Code)
+	}
+	if n := idp.fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func TestJWTDisabled(t *testing.T) {
+	t.Setenv("JWT_JWKS_URL", "")
+	if v := newJWTVerifier(); v != nil {
+		t.Fatal("newJWTVerifier() without JWT_JWKS_URL is not nil")
+	}
+	h := jwtMiddleware(nil, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	if w := do(h, "GET", "/api/items", nil); w.Code != http.StatusOK {
+		t.Fatalf("GET /api/items with JWT disabled = %d, want 200", w.Code)
+	}
+}
+
+func TestProtectedPath(t *testing.T) {
+	prefixes := []string{"/api/", "/items"}
+	for path, want := range map[string]bool{
+		"/api/":     true,
+		"/api/x":    true,
+		"/api":      false,
+		"/items":    true,
+		"/items/42": true,
+		"/itemsx":   false,
+		"/healthz":  false,
+		"/":         false,
+	} {
+		if got := protectedPath(path, prefixes); got != want {
+			t.Errorf("protectedPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
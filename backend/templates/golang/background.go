@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Background services run next to the HTTP server for the life of the
+// process: a gRPC listener, a queue consumer, a broadcast hub. Register
+// them from setupApp:
+//
+//	registerBackground("consumer", func(ctx context.Context) error {
+//		return consume(ctx, queue)
+//	})
+//
+// Each run function starts once the HTTP listener is up and must block
+// until ctx is cancelled, which happens when shutdown begins (after the
+// SHUTDOWN_DELAY drain window), then return once it has stopped; main
+// waits for it within SHUTDOWN_TIMEOUT. A service that returns before
+// shutdown takes the app down with it, so Kubernetes restarts the pod
+// rather than leaving it half working.
+
+type backgroundService struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+var (
+	backgroundServices []backgroundService
+	backgroundRunning  sync.WaitGroup
+)
+
+// registerBackground adds a service. Register before the server starts.
+func registerBackground(name string, run func(ctx context.Context) error) {
+	backgroundServices = append(backgroundServices, backgroundService{name: name, run: run})
+}
+
+// startBackground runs every registered service until ctx is cancelled.
+// The returned channel reports the first service to stop on its own.
+func startBackground(ctx context.Context) <-chan error {
+	failed := make(chan error, len(backgroundServices))
+	for _, s := range backgroundServices {
+		backgroundRunning.Add(1)
+		go func() {
+			defer backgroundRunning.Done()
+			slog.Info("background service started", "name", s.name)
+			err := s.run(ctx)
+			if ctx.Err() == nil {
+				if err == nil {
+					err = errors.New("stopped unexpectedly")
+				}
+				failed <- fmt.Errorf("%s: %w", s.name, err)
+				return
+			}
+			if err != nil && !errors.Is(err, context.Canceled) {
+				slog.Warn("background service stopped with error", "name", s.name, "error", err)
+				return
+			}
+			slog.Info("background service stopped", "name", s.name)
+		}()
+	}
+	return failed
+}
+
+// waitBackground waits until every service has returned or ctx is done.
+func waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backgroundRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown hooks release what the app holds open, such as the database
+// pool, once the server has drained and the background services have
+// returned, so nothing is still using it. They run in reverse order of
+// registration, like deferred calls, within SHUTDOWN_TIMEOUT.
+
+type shutdownHook struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+var shutdownHooks []shutdownHook
+
+// onShutdown registers close to run at shutdown. Register before the
+// server starts.
+func onShutdown(name string, close func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, close: close})
+}
+
+// runShutdownHooks runs every hook, logging the ones that fail.
+func runShutdownHooks(ctx context.Context) {
+	for i := len(shutdownHooks) - 1; i >= 0; i-- {
+		h := shutdownHooks[i]
+		if err := h.close(ctx); err != nil {
+			slog.Warn("closing on shutdown failed", "name", h.name, "error", err)
+			continue
+		}
+		slog.Info("closed on shutdown", "name", h.name)
+	}
+}
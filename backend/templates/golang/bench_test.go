@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Benchmarks and a load test for the request path every Go template
+// shares. Each route is served twice, by the bare mux and through the full
+// platform middleware, so the difference between the two is what the
+// middleware costs a request:
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// openluffy.py bench runs them for every template and fails when a route
+// allocates more than the committed baseline, so a middleware added to
+// chain.go cannot slow every generated app down unnoticed.
+
+// benchMux serves the platform endpoints and a small JSON handler standing
+// in for the app's own routes. setupApp is left out: apps open their
+// dependencies there.
+func benchMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	mux.HandleFunc("GET /bench/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": r.PathValue("id"), "name": "widget"})
+	})
+	return mux
+}
+
+// benchRoutes are the requests benchmarked and load-tested, by name.
+var benchRoutes = []struct{ name, path string }{
+	{"healthz", "/healthz"},
+	{"version", "/version"},
+	{"info", "/api/info"},
+	{"app", "/bench/items/42"},
+	{"not_found", "/no/such/page"},
+}
+
+func BenchmarkRequest(b *testing.B) {
+	mux := benchMux()
+	handlers := []struct {
+		name string
+		h    http.Handler
+	}{
+		{"bare", mux},
+		{"platform", platformHandler(mux, newRateLimiter())},
+	}
+	for _, route := range benchRoutes {
+		for _, h := range handlers {
+			b.Run(route.name+"/"+h.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for b.Loop() {
+					w := httptest.NewRecorder()
+					r := httptest.NewRequest("GET", route.path, nil)
+					r.Header.Set("Accept-Encoding", "gzip")
+					r.Header.Set("User-Agent", "bench")
+					h.h.ServeHTTP(w, r)
+				}
+			})
+		}
+	}
+}
+
+// TestLoad drives the platform handler over real connections, the way hey
+// or vegeta would, and reports throughput and latency percentiles. It
+// only runs when LOAD_TEST_DURATION is set:
+//
+//	LOAD_TEST_DURATION=10s LOAD_TEST_CONCURRENCY=32 go test -run '^TestLoad$' -v
+//
+// Workers take benchRoutes in turn. The test fails on transport errors and
+// 5xx answers, and on a 99th percentile latency over LOAD_TEST_MAX_P99 when
+// that is set. The summary is printed as one "loadtest {json}" line for
+// openluffy.py bench to read.
+func TestLoad(t *testing.T) {
+	duration, err := time.ParseDuration(os.Getenv("LOAD_TEST_DURATION"))
+	if err != nil {
+		t.Skip("set LOAD_TEST_DURATION, such as 10s, to run the load test")
+	}
+	concurrency := 16
+	if v := os.Getenv("LOAD_TEST_CONCURRENCY"); v != "" {
+		if _, err := fmt.Sscan(v, &concurrency); err != nil || concurrency < 1 {
+			t.Fatalf("LOAD_TEST_CONCURRENCY=%q is not a positive integer", v)
+		}
+	}
+
+	srv := httptest.NewServer(platformHandler(benchMux(), newRateLimiter()))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: concurrency}}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failures  = map[string]int{}
+		wg        sync.WaitGroup
+	)
+	deadline := time.Now().Add(duration)
+	for worker := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var mine []time.Duration
+			for i := worker; time.Now().Before(deadline); i++ {
+				route := benchRoutes[i%len(benchRoutes)]
+				start := time.Now()
+				resp, err := client.Get(srv.URL + route.path)
+				if err == nil {
+					resp.Body.Close()
+				}
+				mine = append(mine, time.Since(start))
+				if err != nil || resp.StatusCode >= 500 {
+					mu.Lock()
+					if err != nil {
+						failures[err.Error()]++
+					} else {
+						failures[route.path+": "+resp.Status]++
+					}
+					mu.Unlock()
+				}
+			}
+			mu.Lock()
+			latencies = append(latencies, mine...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(latencies) == 0 {
+		t.Fatal("no requests completed")
+	}
+
+	slices.Sort(latencies)
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))].Microseconds()) / 1000
+	}
+	failed := 0
+	for _, n := range failures {
+		failed += n
+	}
+	summary, _ := json.Marshal(map[string]any{
+		"requests":       len(latencies),
+		"failed":         failed,
+		"concurrency":    concurrency,
+		"duration_s":     duration.Seconds(),
+		"requests_per_s": float64(len(latencies)) / duration.Seconds(),
+		"p50_ms":         percentile(.50),
+		"p90_ms":         percentile(.90),
+		"p99_ms":         percentile(.99),
+		"max_ms":         percentile(1),
+	})
+	fmt.Printf("loadtest %s\n", summary)
+
+	if failed > 0 {
+		var lines []string
+		for what, n := range failures {
+			lines = append(lines, fmt.Sprintf("%d x %s", n, what))
+		}
+		slices.Sort(lines)
+		t.Errorf("%d of %d requests failed:\n%s", failed, len(latencies), strings.Join(lines, "\n"))
+	}
+	if v := os.Getenv("LOAD_TEST_MAX_P99"); v != "" {
+		limit, err := time.ParseDuration(v)
+		if err != nil {
+			t.Fatalf("LOAD_TEST_MAX_P99=%q is not a duration", v)
+		}
+		if p99 := latencies[int(.99*float64(len(latencies)-1))]; p99 > limit {
+			t.Errorf("p99 latency %s exceeds LOAD_TEST_MAX_P99 %s", p99, limit)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Circuit breaking for calls to upstream APIs. Give each upstream its own
+// client, built once in setupApp:
+//
+//	payments = newUpstreamClient("payments")
+//	resp, err := payments.Do(req.WithContext(r.Context()))
+//	if errors.Is(err, errCircuitOpen) {
+//		writeError(w, r, http.StatusServiceUnavailable, "payments unavailable")
+//		return
+//	}
+//
+// After CIRCUIT_BREAKER_FAILURES consecutive failures (a transport error,
+// a timeout or a 5xx answer) the circuit opens, and calls fail at once with
+// errCircuitOpen instead of each waiting for UPSTREAM_TIMEOUT: a struggling
+// upstream is left alone, and the app's own handlers stay fast. After
+// CIRCUIT_BREAKER_COOLDOWN one probe call is let through; its success
+// closes the circuit, its failure opens it for another cooldown. Calls the
+// caller cancelled, such as when the client went away, count neither way.
+//
+//	UPSTREAM_TIMEOUT          per-call timeout (default 10s)
+//	CIRCUIT_BREAKER_FAILURES  consecutive failures that open it (default 5)
+//	CIRCUIT_BREAKER_COOLDOWN  how long it stays open (default 30s)
+//
+// /metrics reports upstream_circuit_state and upstream_requests_total per
+// upstream. A call counts once, however many attempts retry.go made.
+
+// errCircuitOpen is returned, wrapped, for calls refused by an open
+// circuit.
+var errCircuitOpen = errors.New("circuit open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// circuitBreaker is an http.RoundTripper that stops calling base while
+// the upstream is failing.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	base      http.RoundTripper
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	succeeded, failed, rejected, retried atomic.Int64
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   []*circuitBreaker
+)
+
+// newUpstreamClient returns a client for the upstream name, which labels
+// its logs and metrics, with UPSTREAM_TIMEOUT, a circuit breaker and
+// retries (retry.go). It sends through http.DefaultTransport, so calls
+// carry the request ID and trace context.
+func newUpstreamClient(name string) *http.Client {
+	cb := &circuitBreaker{
+		name:      name,
+		threshold: confInt("CIRCUIT_BREAKER_FAILURES"),
+		cooldown:  confDuration("CIRCUIT_BREAKER_COOLDOWN"),
+	}
+	cb.base = newRetryTransport(http.DefaultTransport, func() { cb.retried.Add(1) })
+	breakersMu.Lock()
+	if len(breakers) == 0 {
+		registerMetrics(writeBreakerMetrics)
+	}
+	breakers = append(breakers, cb)
+	breakersMu.Unlock()
+	return &http.Client{Transport: cb, Timeout: confDuration("UPSTREAM_TIMEOUT")}
+}
+
+func (cb *circuitBreaker) RoundTrip(r *http.Request) (*http.Response, error) {
+	probe, ok := cb.allow(time.Now())
+	if !ok {
+		cb.rejected.Add(1)
+		return nil, fmt.Errorf("%s: %w", cb.name, errCircuitOpen)
+	}
+	resp, err := cb.base.RoundTrip(r)
+	switch {
+	case err != nil && errors.Is(r.Context().Err(), context.Canceled):
+		cb.record(probe, callCancelled, "", time.Now())
+	case err != nil:
+		cb.record(probe, callFailed, err.Error(), time.Now())
+	case resp.StatusCode >= 500:
+		cb.record(probe, callFailed, resp.Status, time.Now())
+	default:
+		cb.record(probe, callSucceeded, "", time.Now())
+	}
+	return resp, err
+}
+
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	callCancelled
+)
+
+// allow reports whether a call may go ahead, and whether it is the probe
+// of a half-open circuit.
+func (cb *circuitBreaker) allow(now time.Time) (probe, ok bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false, false
+		}
+		cb.state = breakerHalfOpen
+		slog.Info("circuit half-open, probing upstream", "upstream", cb.name)
+		fallthrough
+	case breakerHalfOpen:
+		if cb.probing {
+			return false, false
+		}
+		cb.probing = true
+		return true, true
+	}
+	return false, true
+}
+
+// record updates the circuit with a call's outcome; cause says why a
+// failed call failed. A cancelled call only frees the probe slot.
+func (cb *circuitBreaker) record(probe bool, outcome callOutcome, cause string, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe {
+		cb.probing = false
+	}
+	switch outcome {
+	case callSucceeded:
+		cb.succeeded.Add(1)
+		cb.failures = 0
+		if probe && cb.state == breakerHalfOpen {
+			slog.Info("circuit closed, upstream recovered", "upstream", cb.name)
+			cb.state = breakerClosed
+		}
+	case callFailed:
+		cb.failed.Add(1)
+		cb.failures++
+		if (probe && cb.state == breakerHalfOpen) || (cb.state == breakerClosed && cb.failures >= cb.threshold) {
+			slog.Warn("circuit open, failing upstream calls fast", "upstream", cb.name,
+				"consecutive_failures", cb.failures, "error", cause, "cooldown", cb.cooldown.String())
+			cb.state = breakerOpen
+			cb.openedAt = now
+		}
+	}
+}
+
+func writeBreakerMetrics(w io.Writer) {
+	breakersMu.Lock()
+	list := slices.Clone(breakers)
+	breakersMu.Unlock()
+	slices.SortFunc(list, func(a, b *circuitBreaker) int { return strings.Compare(a.name, b.name) })
+
+	fmt.Fprintln(w, "# HELP upstream_circuit_state Circuit breaker state per upstream: 0 closed, 1 half-open, 2 open.")
+	fmt.Fprintln(w, "# TYPE upstream_circuit_state gauge")
+	for _, cb := range list {
+		cb.mu.Lock()
+		state := cb.state
+		cb.mu.Unlock()
+		fmt.Fprintf(w, "upstream_circuit_state{upstream=\"%s\"} %d\n", cb.name, state)
+	}
+	fmt.Fprintln(w, "# HELP upstream_requests_total Upstream calls by outcome; rejected calls were refused by an open circuit.")
+	fmt.Fprintln(w, "# TYPE upstream_requests_total counter")
+	for _, cb := range list {
+		fmt.Fprintf(w, "upstream_requests_total{upstream=\"%s\",result=\"success\"} %d\n", cb.name, cb.succeeded.Load())
+		fmt.Fprintf(w, "upstream_requests_total{upstream=\"%s\",result=\"failure\"} %d\n", cb.name, cb.failed.Load())
+		fmt.Fprintf(w, "upstream_requests_total{upstream=\"%s\",result=\"rejected\"} %d\n", cb.name, cb.rejected.Load())
+	}
+	fmt.Fprintln(w, "# HELP upstream_retries_total Upstream call attempts repeated after a failure.")
+	fmt.Fprintln(w, "# TYPE upstream_retries_total counter")
+	for _, cb := range list {
+		fmt.Fprintf(w, "upstream_retries_total{upstream=\"%s\"} %d\n", cb.name, cb.retried.Load())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyUpstream answers 503 while failing is set, and 200 otherwise.
+func flakyUpstream(t *testing.T, failing *atomic.Bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func callUpstream(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_FAILURES", "3")
+	t.Setenv("CIRCUIT_BREAKER_COOLDOWN", "1h")
+	var failing atomic.Bool
+	failing.Store(true)
+	srv := flakyUpstream(t, &failing)
+	client := newUpstreamClient("flaky")
+	cb := client.Transport.(*circuitBreaker)
+
+	for i := range 3 {
+		if err := callUpstream(client, srv.URL); err != nil {
+			t.Fatalf("call %d = %v, want the 503 passed through while closed", i, err)
+		}
+	}
+	if err := callUpstream(client, srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("call after 3 failures = %v, want errCircuitOpen", err)
+	}
+
+	// The cooldown has passed: one probe goes through. Its failure
+	// reopens the circuit, its success closes it.
+	cb.openedAt = cb.openedAt.Add(-2 * time.Hour)
+	callUpstream(client, srv.URL)
+	if err := callUpstream(client, srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("call after a failed probe = %v, want errCircuitOpen", err)
+	}
+	failing.Store(false)
+	cb.openedAt = cb.openedAt.Add(-2 * time.Hour)
+	for i := range 5 {
+		if err := callUpstream(client, srv.URL); err != nil {
+			t.Fatalf("call %d after a successful probe = %v, want the circuit closed", i, err)
+		}
+	}
+
+	w := do(http.HandlerFunc(metricsHandler), "GET", "/metrics", nil)
+	for _, want := range []string{
+		`upstream_circuit_state{upstream="flaky"} 0`,
+		`upstream_requests_total{upstream="flaky",result="failure"} 4`,
+		`upstream_requests_total{upstream="flaky",result="rejected"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenSingleProbe(t *testing.T) {
+	cb := &circuitBreaker{name: "probe", threshold: 1, cooldown: time.Minute, state: breakerOpen}
+	now := time.Now()
+	if probe, ok := cb.allow(now); !probe || !ok {
+		t.Fatalf("allow after the cooldown = %v %v, want a probe", probe, ok)
+	}
+	if _, ok := cb.allow(now); ok {
+		t.Fatal("a second call went through while the probe was in flight")
+	}
+	cb.record(true, callCancelled, "", now)
+	if probe, ok := cb.allow(now); !probe || !ok {
+		t.Fatal("a cancelled probe did not free the probe slot")
+	}
+}
+
+func TestCircuitBreakerIgnoresCancelledCalls(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_FAILURES", "1")
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(block) })
+	client := newUpstreamClient("cancelled")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("cancelled call succeeded")
+	}
+	if state := client.Transport.(*circuitBreaker).state; state != breakerClosed {
+		t.Fatalf("circuit state after a cancelled call = %d, want closed", state)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// The middleware chain every Go template serves its mux through. The
+// order matters and is decided here once, rather than in each main.go:
+// metrics and the request ID come first so every response is counted and
+// correlated, the client address is resolved behind trusted proxies
+// (clientip.go) before anything logs or limits by it, identity headers
+// and tracing are set before the access log writes its line, load
+// shedding, rate limiting, the route policies' limits (routepolicy.go)
+// and authentication run before anything reads the body, the request deadline is set just outside the handler, with
+// injected faults (faults.go) inside it so they meet the deadline as a
+// slow handler would, and recovery sits innermost so a panicking handler
+// still goes through all of the above.
+//
+// An app adds its own middleware with useMiddleware from setupApp. It runs
+// inside the platform middleware, just outside the mux, so it sees
+// authenticated, size-limited requests with their request ID and its
+// panics are recovered:
+//
+//	useMiddleware(func(next http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			w.Header().Set("X-Frame-Options", "DENY")
+//			next.ServeHTTP(w, r)
+//		})
+//	})
+
+// middleware wraps a handler.
+type middleware func(http.Handler) http.Handler
+
+// appMiddleware are the middleware added with useMiddleware.
+var appMiddleware []middleware
+
+// useMiddleware adds mw to the chain after the platform middleware.
+// Middleware added first runs first.
+func useMiddleware(mw middleware) {
+	appMiddleware = append(appMiddleware, mw)
+}
+
+// chain wraps h in mws, the first outermost.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for _, mw := range slices.Backward(mws) {
+		h = mw(h)
+	}
+	return h
+}
+
+// platformHandler wraps mux in the platform middleware, outermost first,
+// then the app's. limiter is nil when rate limiting is off.
+func platformHandler(mux *http.ServeMux, limiter *rateLimiter) http.Handler {
+	jwt, apiKeys, cors, headers, proxies := newJWTVerifier(), newAPIKeyAuth(), loadCORSConfig(), contextHeaders(), newTrustedProxies()
+	shedder, timeouts := newLoadShedder(), newRequestTimeouts()
+	platform := []middleware{
+		func(next http.Handler) http.Handler { return metricsMiddleware(mux, next) },
+		requestIDMiddleware,
+		func(next http.Handler) http.Handler { return clientIPMiddleware(proxies, next) },
+		func(next http.Handler) http.Handler { return tracingMiddleware(mux, next) },
+		func(next http.Handler) http.Handler { return headerContextMiddleware(headers, next) },
+		accessLogMiddleware,
+		func(next http.Handler) http.Handler { return loadShedMiddleware(shedder, next) },
+		compressionMiddleware,
+		func(next http.Handler) http.Handler { return corsMiddleware(cors, next) },
+		func(next http.Handler) http.Handler { return rateLimitMiddleware(limiter, next) },
+		routeLimitMiddleware,
+		mtlsMiddleware,
+		func(next http.Handler) http.Handler { return apiKeyMiddleware(apiKeys, next) },
+		func(next http.Handler) http.Handler { return jwtMiddleware(jwt, next) },
+		bodyLimitMiddleware,
+		func(next http.Handler) http.Handler { return timeoutMiddleware(timeouts, next) },
+		faultMiddleware,
+		recoveryMiddleware,
+	}
+	return chain(routeErrors(mux), slices.Concat(platform, appMiddleware)...)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Built-in health checkers, selected by the URL scheme of a DEPENDENCIES
+// entry:
+//
+//	tcp://host:port                  a TCP connection is accepted
+//	http://... https://...           GET answers with a status below 400
+//	postgres://host:5432             the server answers the Postgres
+//	                                 protocol (SSLRequest handshake; no
+//	                                 credentials needed)
+//	redis://[:password@]host:6379    PING answers PONG; rediss:// uses TLS
+//	cmd:/path/to/check [args...]     the command exits 0 within the
+//	                                 check's timeout
+//
+// Each speaks just enough of its protocol to prove the server is serving,
+// so the template needs no database drivers. Apps with a real client
+// should register a checkFunc wrapping it instead, e.g.
+//
+//	readinessChecks.register("db", checkFunc(db.PingContext), 0)
+//
+// A cmd: check runs the command with the app's environment and no shell,
+// so the arguments are split on spaces and cannot be quoted, and it is
+// killed when the check times out. A failure reports the exit status and
+// the last line the command printed. The production image has no shell:
+// mount a static binary, or a script with an image that has its
+// interpreter. Each probe starts the command afresh, so set
+// HEALTH_CACHE_TTL for one that is expensive.
+
+// checker is one health check.
+type checker interface {
+	Check(ctx context.Context) error
+}
+
+// checkFunc adapts an ordinary function to a checker.
+type checkFunc func(ctx context.Context) error
+
+func (f checkFunc) Check(ctx context.Context) error { return f(ctx) }
+
+// checkerFor returns the built-in checker for a DEPENDENCIES target, and
+// the target as it may be logged, without credentials.
+func checkerFor(target string) (checker, string, error) {
+	if command, ok := strings.CutPrefix(target, "cmd:"); ok {
+		c, err := newCommandChecker(command)
+		return c, target, err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := checkerForURL(u)
+	return c, u.Redacted(), err
+}
+
+// checkerForURL returns the built-in checker for u's scheme.
+func checkerForURL(u *url.URL) (checker, error) {
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	switch u.Scheme {
+	case "tcp":
+		return tcpChecker{addr: u.Host}, nil
+	case "http", "https":
+		return httpChecker{url: u.String()}, nil
+	case "postgres", "postgresql":
+		return postgresChecker{addr: withDefaultPort(u.Host, "5432")}, nil
+	case "redis", "rediss":
+		c := redisChecker{addr: withDefaultPort(u.Host, "6379"), tls: u.Scheme == "rediss"}
+		if u.User != nil {
+			c.username = u.User.Username()
+			c.password, _ = u.User.Password()
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (want tcp, http, https, postgres, redis, rediss or cmd)", u.Scheme)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// dial opens a connection whose reads and writes are bounded by ctx.
+func dial(ctx context.Context, addr string, useTLS bool) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = (&tls.Dialer{}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+type tcpChecker struct{ addr string }
+
+func (c tcpChecker) Check(ctx context.Context) error {
+	conn, err := dial(ctx, c.addr, false)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type httpChecker struct{ url string }
+
+// dependencyClient is used for http(s) checks. Redirects are not followed:
+// a 3xx already proves the upstream is answering.
+var dependencyClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (c httpChecker) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dependencyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type postgresChecker struct{ addr string }
+
+// postgresSSLRequest is the protocol's SSLRequest message: length 8, code
+// 80877103. A Postgres server answers it with a single 'S' or 'N' byte
+// before any authentication.
+var postgresSSLRequest = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), 80877103)
+
+func (c postgresChecker) Check(ctx context.Context) error {
+	conn, err := dial(ctx, c.addr, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(postgresSSLRequest); err != nil {
+		return err
+	}
+	reply := make([]byte, 1)
+	if _, err := conn.Read(reply); err != nil {
+		return err
+	}
+	if reply[0] != 'S' && reply[0] != 'N' {
+		return fmt.Errorf("unexpected reply %q, not a Postgres server", reply[0])
+	}
+	return nil
+}
+
+type redisChecker struct {
+	addr               string
+	tls                bool
+	username, password string
+}
+
+func (c redisChecker) Check(ctx context.Context) error {
+	conn, err := dial(ctx, c.addr, c.tls)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := redisCommand(conn, r, args...); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	reply, err := redisCommand(conn, r, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+type commandChecker struct {
+	path string
+	args []string
+}
+
+// commandWaitDelay bounds how long a timed-out command's output is
+// waited for once it is killed, in case a child it started keeps it open.
+const commandWaitDelay = 500 * time.Millisecond
+
+// newCommandChecker resolves command's program now, so a typo fails
+// startup rather than every probe.
+func newCommandChecker(command string) (commandChecker, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return commandChecker{}, errors.New("missing command")
+	}
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return commandChecker{}, err
+	}
+	return commandChecker{path: path, args: fields[1:]}, nil
+}
+
+func (c commandChecker) Check(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.WaitDelay = commandWaitDelay
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if line := commandOutputLine(out); line != "" {
+		return fmt.Errorf("%w: %s", err, line)
+	}
+	return err
+}
+
+// commandMaxOutput bounds the output a failing command's error reports.
+const commandMaxOutput = 200
+
+// commandOutputLine returns the last non-empty line of out, shortened to
+// commandMaxOutput bytes.
+func commandOutputLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	line := strings.TrimSpace(lines[len(lines)-1])
+	if len(line) > commandMaxOutput {
+		line = line[:commandMaxOutput] + "..."
+	}
+	return line
+}
+
+// redisCommand sends args as a RESP array and returns a simple-string reply.
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "+"):
+		return line[1:], nil
+	case strings.HasPrefix(line, "-"):
+		return "", errors.New(line[1:])
+	default:
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Client addresses behind proxies. Behind an ingress controller or a load
+// balancer the peer of every request is the proxy, so the access log, the
+// error reports and RATE_LIMIT_MODE=ip would all see one client. The
+// proxies name the client in X-Forwarded-For, but any client can send that
+// header too, so it is believed only from the proxies listed here:
+//
+//	TRUSTED_PROXIES    addresses and CIDRs of the proxies in front of the
+//	                   app, e.g. 10.0.0.0/8 for an in-cluster ingress
+//	                   controller, and "unix" for one in front of
+//	                   LISTEN_SOCKET (default none: the peer is the client)
+//	CLIENT_IP_HEADERS  headers naming the client, the first present used
+//	                   (default X-Forwarded-For,X-Real-IP); put the CDN's
+//	                   own first, e.g. CF-Connecting-IP, when it sets one
+//
+// A request from a trusted proxy is attributed to the last address in the
+// header that is not itself a trusted proxy, reading from the right: each
+// proxy appends the peer it got the request from, and what a client put
+// in the header before the first proxy saw it is to the left. A request
+// from any other peer is attributed to the peer, whatever its headers say.
+// Trust only the proxies that connect to the app, and those in front of
+// them: 0.0.0.0/0 lets every client choose its own address.
+
+type clientIPKey struct{}
+
+// trustedProxies is the parsed TRUSTED_PROXIES.
+type trustedProxies struct {
+	prefixes []netip.Prefix
+	unix     bool
+	headers  []string
+}
+
+// parseProxy parses a TRUSTED_PROXIES entry; an address is a prefix of
+// its full length.
+func parseProxy(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func checkTrustedProxies(v string) error {
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" || entry == "unix" {
+			continue
+		}
+		if _, err := parseProxy(entry); err != nil {
+			return fmt.Errorf("%q: want an IP address, a CIDR or unix", entry)
+		}
+	}
+	return nil
+}
+
+// newTrustedProxies reads TRUSTED_PROXIES and CLIENT_IP_HEADERS, or
+// returns nil when no proxy is trusted.
+func newTrustedProxies() *trustedProxies {
+	entries := confList("TRUSTED_PROXIES")
+	if len(entries) == 0 {
+		return nil
+	}
+	tp := &trustedProxies{headers: confList("CLIENT_IP_HEADERS")}
+	for _, entry := range entries {
+		if entry == "unix" {
+			tp.unix = true
+			continue
+		}
+		p, _ := parseProxy(entry)
+		if p.Bits() == 0 {
+			slog.Warn("TRUSTED_PROXIES trusts every peer: any client can choose the address it is logged and rate limited as", "entry", entry)
+		}
+		tp.prefixes = append(tp.prefixes, p)
+	}
+	return tp
+}
+
+// trusted reports whether addr is a trusted proxy.
+func (tp *trustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range tp.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the address r comes from, by its peer and, from a
+// trusted proxy, the first of CLIENT_IP_HEADERS it carries.
+func (tp *trustedProxies) resolve(r *http.Request) string {
+	peer := peerIP(r)
+	addr, err := netip.ParseAddr(peer)
+	switch {
+	case err == nil && !tp.trusted(addr):
+		return peer
+	case err != nil && !(tp.unix && isUnixPeer(r.RemoteAddr)):
+		return peer
+	}
+	for _, name := range tp.headers {
+		var hops []string
+		for _, v := range r.Header.Values(name) {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+		if len(hops) == 0 {
+			continue
+		}
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			hopAddr, ok := parseHop(hops[i])
+			if !ok {
+				// Garbage in the header: the last address read is the
+				// furthest one the proxies vouch for.
+				break
+			}
+			client = hopAddr.String()
+			if !tp.trusted(hopAddr) {
+				break
+			}
+		}
+		return client
+	}
+	return peer
+}
+
+// parseHop parses an address in a proxy header, which some proxies send
+// with a port.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// isUnixPeer reports whether remoteAddr is a Unix socket peer's, which
+// net/http leaves empty or "@".
+func isUnixPeer(remoteAddr string) bool {
+	return remoteAddr == "" || remoteAddr == "@"
+}
+
+// clientIPMiddleware resolves each request's client address once, for
+// clientIP. tp is nil when no proxy is trusted.
+func clientIPMiddleware(tp *trustedProxies, next http.Handler) http.Handler {
+	if tp == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, tp.resolve(r))))
+	})
+}
+
+// clientIP returns the IP address of the client that sent the request:
+// the peer, or the address a trusted proxy names.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the IP address of the peer that sent the request.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transparent response compression, negotiated via Accept-Encoding.
+//
+//	COMPRESSION_ENABLED   "false" disables compression (default on)
+//	COMPRESSION_MIN_SIZE  responses smaller than this many bytes are sent
+//	                      uncompressed (default 1024)
+//
+// Only text-like content types are compressed. The first
+// COMPRESSION_MIN_SIZE bytes are buffered so tiny bodies (health checks,
+// short JSON) skip compression entirely: below the threshold it costs CPU
+// and can make the body larger. A Flush before the threshold is reached
+// ends buffering immediately, so streaming responses (SSE, chunked JSON)
+// are never held back.
+
+const defaultCompressionMinSize = 1024
+
+// compressibleTypes are the media types worth compressing.
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+	"text/css",
+	"text/html",
+	"text/javascript",
+	"text/plain",
+	"text/xml",
+}
+
+var gzipWriters = sync.Pool{New: func() any {
+	w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return w
+}}
+
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// honouring q=0 exclusions, or returns "" for identity. "*" stands only for
+// the codings the header does not name, so "gzip;q=0, *" picks deflate.
+func negotiateEncoding(header string) string {
+	// -1 until the header names the coding.
+	gzipQ, deflateQ, starQ := -1.0, -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip":
+			gzipQ = q
+		case "deflate":
+			deflateQ = q
+		case "*":
+			starQ = q
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = starQ
+	}
+	if deflateQ < 0 {
+		deflateQ = starQ
+	}
+	// Prefer gzip on ties: it is the most widely supported.
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter buffers the start of a response, then either compresses
+// the rest through a pooled gzip/flate writer or passes it through as-is.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	zw      interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	switch {
+	case cw.decided:
+		cw.ResponseWriter.WriteHeader(code)
+	case cw.status != 0:
+		// Duplicate call before anything was sent; net/http ignores these too.
+	case code < 200:
+		// Informational responses (103 Early Hints) go straight out.
+		cw.ResponseWriter.WriteHeader(code)
+	default:
+		cw.status = code
+		if code == http.StatusNoContent || code == http.StatusNotModified {
+			cw.decide(false)
+		}
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.zw != nil {
+			return cw.zw.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide ends buffering. large reports whether the body reached the size
+// threshold; small bodies are always sent uncompressed.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if large && cw.compressible() {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.zw = gz
+		} else {
+			fl := flateWriters.Get().(*flate.Writer)
+			fl.Reset(cw.ResponseWriter)
+			cw.zw = fl
+		}
+	}
+
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && slices.Contains(compressibleTypes, mediaType)
+}
+
+// Flush sends everything written so far to the client: it ends buffering,
+// flushes the compressor's internal buffer, then flushes the connection.
+// A streamed body's final size is unknown, so once a handler flushes it is
+// compressed whenever its content type is eligible.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the response after the handler returns.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// Nothing was written; let net/http send its default 200.
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.zw == nil {
+		return
+	}
+	cw.zw.Close()
+	switch zw := cw.zw.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(zw)
+	case *flate.Writer:
+		flateWriters.Put(zw)
+	}
+	cw.zw = nil
+}
+
+// compressionMiddleware compresses eligible responses for clients that
+// accept gzip or deflate.
+func compressionMiddleware(next http.Handler) http.Handler {
+	if !confBool("COMPRESSION_ENABLED") {
+		return next
+	}
+	minSize := confInt("COMPRESSION_MIN_SIZE")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
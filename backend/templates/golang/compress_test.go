@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"gzip":                      "gzip",
+		"deflate":                   "deflate",
+		"gzip, deflate, br":         "gzip",
+		"GZIP;q=0.5, deflate;q=0.8": "deflate",
+		"gzip;q=0":                  "",
+		"gzip;q=0, deflate":         "deflate",
+		"*":                         "gzip",
+		"*;q=0":                     "",
+		"gzip;q=0, *":               "deflate", // * stands only for what is not listed
+		"gzip;q=0, deflate;q=0, *":  "",
+		"deflate, *;q=0.1":          "deflate",
+		"br, *;q=0":                 "",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+// compressed serves body with contentType through the compression
+// middleware, COMPRESSION_MIN_SIZE at 100.
+func compressed(t *testing.T, contentType string, code int, body string) http.Handler {
+	t.Helper()
+	t.Setenv("COMPRESSION_MIN_SIZE", "100")
+	return compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	}))
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	large := strings.Repeat("compressible ", 20)
+
+	w := do(compressed(t, "application/json", http.StatusOK, `{"ok":true}`), "GET", "/", nil, "Accept-Encoding", "gzip")
+	if enc := w.Header().Get("Content-Encoding"); enc != "" || w.Body.String() != `{"ok":true}` {
+		t.Errorf("below the threshold: encoding %q body %q, want it sent as is", enc, w.Body)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", vary)
+	}
+
+	w = do(compressed(t, "text/plain; charset=utf-8", http.StatusCreated, large), "GET", "/", nil, "Accept-Encoding", "gzip")
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("above the threshold: %d encoding %q, want 201 gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != large {
+		t.Errorf("gunzipped body = %q, want %q", got, large)
+	}
+
+	w = do(compressed(t, "text/html", http.StatusOK, large), "GET", "/", nil, "Accept-Encoding", "deflate")
+	if got, _ := io.ReadAll(flate.NewReader(w.Body)); w.Header().Get("Content-Encoding") != "deflate" || string(got) != large {
+		t.Errorf("deflate: encoding %q body %q", w.Header().Get("Content-Encoding"), got)
+	}
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"image/png":          do(compressed(t, "image/png", http.StatusOK, large), "GET", "/", nil, "Accept-Encoding", "gzip"),
+		"no Accept-Encoding": do(compressed(t, "text/plain", http.StatusOK, large), "GET", "/", nil),
+		"HEAD":               do(compressed(t, "text/plain", http.StatusOK, large), "HEAD", "/", nil, "Accept-Encoding", "gzip"),
+	} {
+		if enc := w.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s: Content-Encoding %q, want none", name, enc)
+		}
+	}
+}
+
+func TestCompressionQZero(t *testing.T) {
+	large := strings.Repeat("compressible ", 20)
+	for header, want := range map[string]string{
+		"gzip;q=0":    "",
+		"*;q=0":       "",
+		"gzip;q=0, *": "deflate",
+	} {
+		w := do(compressed(t, "text/plain", http.StatusOK, large), "GET", "/", nil, "Accept-Encoding", header)
+		if enc := w.Header().Get("Content-Encoding"); enc != want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", header, enc, want)
+		}
+		if want == "" && w.Body.String() != large {
+			t.Errorf("Accept-Encoding %q: body %q, want it uncompressed", header, w.Body)
+		}
+	}
+}
+
+func TestCompressionNoBody(t *testing.T) {
+	for _, code := range []int{http.StatusNoContent, http.StatusNotModified} {
+		w := do(compressed(t, "application/json", code, ""), "GET", "/", nil, "Accept-Encoding", "gzip")
+		if w.Code != code || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+			t.Errorf("%d: got %d encoding %q body %q, want it passed through", code, w.Code, w.Header().Get("Content-Encoding"), w.Body)
+		}
+	}
+}
+
+func TestCompressionFlush(t *testing.T) {
+	t.Setenv("COMPRESSION_MIN_SIZE", "100")
+	rec := httptest.NewRecorder()
+	var mid string
+	h := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+
+		// The event must reach the client now, though it is far below
+		// the threshold.
+		if zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes())); err == nil {
+			buf := make([]byte, len("data: 1\n\n"))
+			n, _ := io.ReadFull(zr, buf)
+			mid = string(buf[:n])
+		}
+		io.WriteString(w, "data: 2\n\n")
+	}))
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(rec, r)
+
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("flushed %v encoding %q, want a flushed gzip stream", rec.Flushed, rec.Header().Get("Content-Encoding"))
+	}
+	if mid != "data: 1\n\n" {
+		t.Errorf("readable after Flush: %q, want the first event", mid)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("body = %q, want both events", got)
+	}
+}
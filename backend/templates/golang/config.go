@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Configuration. Every setting the app reads is declared in settings with
+// its type and default, and resolved from, in order of precedence:
+//
+//	1. the environment
+//	2. a file named by NAME_FILE, e.g. DB_PASSWORD_FILE, holding the value
+//	   (a Kubernetes secret volume key); surrounding whitespace is trimmed
+//	3. the control plane's document at REMOTE_CONFIG_URL (remoteconfig.go)
+//	4. CONFIG_FILE, a JSON object or a flat YAML file of NAME: value lines
+//	5. the default of the ENVIRONMENT's observability profile, for the
+//	   settings it covers (observability.go)
+//	6. the declared default
+//
+// validateConfig checks every setting once at startup. An invalid value is
+// logged and replaced by its default, so a typo degrades one feature rather
+// than taking the app down; with STRICT_CONFIG=true every problem is logged
+// and the app exits instead. Required settings that are unset always stop
+// startup. The effective configuration is then logged with secrets
+// redacted.
+//
+// Settings marked reloadable are re-read on SIGHUP and when CONFIG_FILE, a
+// NAME_FILE or the remote document changes (checked every
+// CONFIG_RELOAD_INTERVAL, default 30s); environment variables cannot
+// change in a running process, so reloads only pick up file-based values.
+// Subsystems re-apply them through onConfigReload. Everything else is
+// fixed at startup.
+//
+// Platform settings are declared in the table below, the app's own in
+// appSettings (app.go) and its mixins' in mixinSettings (mixins.go). Read
+// them with conf, confBool, confInt, confFloat, confDuration or confList;
+// reading an undeclared name panics, which catches typos on the first run.
+
+type settingKind int
+
+const (
+	kindString settingKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindDuration // a positive Go duration such as "30s"
+	kindList     // comma-separated
+)
+
+type setting struct {
+	name       string
+	kind       settingKind
+	def        string
+	required   bool               // startup fails when unset
+	secret     bool               // redacted when the configuration is logged
+	reloadable bool               // re-read by reloadConfig
+	check      func(string) error // validation beyond what kind implies
+}
+
+var settings = slices.Concat(platformSettings, mixinSettings, appSettings)
+
+var platformSettings = []setting{
+	// Server
+	{name: "CONFIG_RELOAD_INTERVAL", kind: kindDuration, def: "30s"},
+	{name: "REMOTE_CONFIG_URL", secret: true, check: httpURL}, // may carry a token
+	{name: "REMOTE_CONFIG_TOKEN", secret: true},
+	{name: "REMOTE_CONFIG_TIMEOUT", kind: kindDuration, def: "5s"},
+	{name: "REMOTE_CONFIG_CACHE", def: defaultRemoteConfigCache},
+	{name: "PORT", kind: kindInt, def: "[% PORT %]", check: inRange(1, 65535)},
+	{name: "BIND_ADDR", check: checkBindAddr},
+	{name: "LISTEN_SOCKET"},
+	{name: "LISTEN_SOCKET_MODE", def: "0660", check: checkSocketMode},
+	{name: "HTTP_REUSE_PORT", kind: kindBool, def: "false"},
+	{name: "ADMIN_PORT", kind: kindInt, check: inRange(1, 65535)},
+	{name: "ENVIRONMENT", def: "development"},
+	{name: "HTTP_READ_HEADER_TIMEOUT", kind: kindDuration, def: defaultReadHeaderTimeout.String()},
+	{name: "HTTP_READ_TIMEOUT", kind: kindDuration, def: defaultReadTimeout.String()},
+	{name: "HTTP_WRITE_TIMEOUT", kind: kindDuration, def: defaultWriteTimeout.String()},
+	{name: "HTTP_IDLE_TIMEOUT", kind: kindDuration, def: defaultIdleTimeout.String()},
+	{name: "HTTP_MAX_HEADER_BYTES", kind: kindInt, def: strconv.Itoa(defaultMaxHeaderBytes), check: atLeast(1)},
+	{name: "HTTP_KEEP_ALIVES", kind: kindBool, def: "true"},
+	{name: "HTTP_MAX_IDLE_CONNS", kind: kindInt, def: "0", check: atLeast(0)},
+	{name: "HTTP_TCP_KEEP_ALIVE_PERIOD", def: defaultTCPKeepAlive.String(), check: checkKeepAlivePeriod},
+	{name: "SHUTDOWN_DELAY", kind: kindDuration},
+	{name: "SHUTDOWN_TIMEOUT", kind: kindDuration, def: defaultShutdownTimeout.String()},
+	{name: "H2C_ENABLED", kind: kindBool, def: "false"},
+	{name: "TLS_CERT_FILE"},
+	{name: "TLS_KEY_FILE"},
+	{name: "TLS_RELOAD_INTERVAL", kind: kindDuration, def: defaultTLSReloadInterval.String()},
+	{name: "TLS_CLIENT_CA_FILE"},
+	{name: "TLS_CLIENT_CNS", kind: kindList},
+	{name: "TLS_CLIENT_EXEMPT", kind: kindList, def: defaultProbePaths},
+
+	// Health
+	{name: "LIVENESS_PATH", def: "[% LIVENESS_PATH %]", check: checkProbePath},
+	{name: "READINESS_PATH", def: "[% READINESS_PATH %]", check: checkProbePath},
+	{name: "STARTUP_PATH", def: "[% STARTUP_PATH %]", check: checkProbePath},
+	{name: "DEPENDENCIES", secret: true}, // URLs may embed credentials
+	{name: "HEALTH_CHECK_TIMEOUT", kind: kindDuration, def: "2s"},
+	{name: "HEALTH_CHECK_TIMEOUTS", kind: kindList},
+	{name: "HEALTH_CHECK_CONCURRENCY", kind: kindInt, def: "4", check: atLeast(1)},
+	{name: "HEALTH_CACHE_TTL", kind: kindDuration},
+	{name: "STARTUP_WAIT_FOR", kind: kindList},
+	{name: "STARTUP_WAIT_TIMEOUT", kind: kindDuration, def: "2m"},
+	{name: "HEALTH_DETAIL", kind: kindBool, def: "false", reloadable: true},
+
+	// Metrics
+	{name: "SLO_LATENCY_THRESHOLD", kind: kindDuration},
+	{name: "METRICS_STATUS_CODES", kind: kindBool, def: "false"},
+
+	// Logging
+	{name: "LOG_LEVEL", def: "info", reloadable: true, check: func(v string) error {
+		if _, ok := parseLogLevel(v); !ok {
+			return errors.New("want debug, info, warn or error")
+		}
+		return nil
+	}},
+	{name: "LOG_FORMAT", def: "json", check: oneOf("json", "text")},
+	{name: "LOG_SOURCE", kind: kindBool, def: "false"},
+	{name: "ACCESS_LOG", kind: kindBool, def: "true"},
+	{name: "ACCESS_LOG_EXCLUDE", kind: kindList, def: defaultProbePaths + ",/metrics," + drainPath},
+	{name: "LOKI_URL", check: httpURL},
+	{name: "LOKI_HEADERS", kind: kindList, secret: true},
+	{name: "OTEL_LOGS_EXPORTER", def: "none", check: oneOf("none", "otlp")},
+	{name: "OTEL_EXPORTER_OTLP_LOGS_ENDPOINT", check: httpURL},
+
+	// Tracing
+	{name: "OTEL_EXPORTER_OTLP_ENDPOINT"},
+	{name: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"},
+	{name: "OTEL_EXPORTER_OTLP_HEADERS", secret: true},
+	{name: "OTEL_EXPORTER_OTLP_PROTOCOL", def: "http/json", check: oneOf("http/json")},
+	{name: "OTEL_SERVICE_NAME", def: serviceName},
+	{name: "OTEL_TRACES_SAMPLER_ARG", kind: kindFloat, def: "1", check: inRange(0, 1)},
+
+	// Error reporting
+	{name: "SENTRY_DSN", secret: true, check: checkDSN},
+	{name: "SENTRY_SAMPLE_RATE", kind: kindFloat, def: "1", check: inRange(0, 1)},
+
+	// Continuous profiling
+	{name: "PROFILING_URL", check: httpURL},
+	{name: "PROFILING_HEADERS", kind: kindList, secret: true},
+	{name: "PROFILING_TYPES", kind: kindList, def: "cpu,heap", check: checkProfileTypes},
+	{name: "PROFILING_INTERVAL", kind: kindDuration, def: "15s"},
+	{name: "PROFILING_LABELS", kind: kindList, check: checkProfileLabels},
+
+	// Middleware
+	{name: "CONTEXT_HEADERS", kind: kindList, def: strings.Join(defaultContextHeaders, ",")},
+	{name: "TRUSTED_PROXIES", kind: kindList, check: checkTrustedProxies},
+	{name: "CLIENT_IP_HEADERS", kind: kindList, def: "X-Forwarded-For,X-Real-IP"},
+	{name: "CORS_ALLOWED_ORIGINS", kind: kindList},
+	{name: "CORS_ALLOWED_METHODS", kind: kindList, def: "GET,POST,PUT,PATCH,DELETE,OPTIONS"},
+	{name: "CORS_ALLOWED_HEADERS", kind: kindList, def: "Accept,Authorization,Content-Type,X-Request-ID"},
+	{name: "CORS_EXPOSED_HEADERS", kind: kindList, def: requestIDHeader},
+	{name: "CORS_ALLOW_CREDENTIALS", kind: kindBool, def: "false"},
+	{name: "CORS_MAX_AGE", kind: kindDuration, def: "10m"},
+	{name: "RATE_LIMIT_RPS", kind: kindFloat, reloadable: true, check: positive},
+	{name: "RATE_LIMIT_BURST", kind: kindFloat, reloadable: true, check: atLeast(1)},
+	{name: "RATE_LIMIT_MODE", def: "ip", check: oneOf("ip", "global")},
+	{name: "RATE_LIMIT_IDLE_TTL", kind: kindDuration, def: "10m"},
+	{name: "RATE_LIMIT_EXEMPT", kind: kindList, def: defaultProbePaths + ",/metrics," + drainPath},
+	{name: "MAX_IN_FLIGHT", kind: kindInt, def: "0", check: atLeast(0)},
+	{name: "LOAD_SHED_RETRY_AFTER", kind: kindDuration, def: "1s"},
+	{name: "LOAD_SHED_EXEMPT", kind: kindList, def: defaultProbePaths + ",/metrics," + drainPath},
+	{name: "COMPRESSION_ENABLED", kind: kindBool, def: "true"},
+	{name: "COMPRESSION_MIN_SIZE", kind: kindInt, def: strconv.Itoa(defaultCompressionMinSize), check: atLeast(0)},
+	{name: "MAX_REQUEST_BODY", kind: kindInt, def: strconv.Itoa(defaultMaxRequestBody), check: atLeast(1)},
+	{name: "REQUEST_TIMEOUT", kind: kindDuration, def: defaultRequestTimeout.String()},
+	{name: "REQUEST_TIMEOUTS", kind: kindList, check: checkRouteTimeouts},
+
+	// Upstream calls, made with newUpstreamClient
+	{name: "UPSTREAM_TIMEOUT", kind: kindDuration, def: "10s"},
+	{name: "CIRCUIT_BREAKER_FAILURES", kind: kindInt, def: "5", check: atLeast(1)},
+	{name: "CIRCUIT_BREAKER_COOLDOWN", kind: kindDuration, def: "30s"},
+	{name: "UPSTREAM_RETRIES", kind: kindInt, def: "2", check: atLeast(0)},
+	{name: "UPSTREAM_RETRY_BACKOFF", kind: kindDuration, def: "100ms"},
+	{name: "UPSTREAM_RETRY_MAX_BACKOFF", kind: kindDuration, def: "2s"},
+	{name: "UPSTREAM_ATTEMPT_TIMEOUT", kind: kindDuration},
+
+	// Authentication
+	{name: "JWT_JWKS_URL"},
+	{name: "JWT_ISSUER"},
+	{name: "JWT_AUDIENCE"},
+	{name: "JWT_LEEWAY", kind: kindDuration, def: "30s"},
+	{name: "JWT_JWKS_REFRESH", kind: kindDuration, def: "1h"},
+	{name: "AUTH_PATHS", kind: kindList, def: "[% AUTH_PATHS %]"},
+	{name: "API_KEYS", secret: true, reloadable: true, check: checkAPIKeys},
+	{name: "API_KEY_HEADER", def: "X-API-Key"},
+	{name: "ADMIN_USERNAME", def: "admin", reloadable: true},
+	{name: "ADMIN_PASSWORD", secret: true, reloadable: true},
+	{name: "ADMIN_ENDPOINTS", kind: kindList, def: strings.Join(adminEndpoints, ","), check: checkAdminEndpoints},
+
+	// Kubernetes downward API, for /api/info
+	{name: "POD_NAME"},
+	{name: "POD_NAMESPACE"},
+	{name: "NODE_NAME"},
+
+	// Misc endpoints
+	{name: "ROBOTS_TXT"},
+	{name: "SECURITY_CONTACT"},
+	{name: "SECURITY_TXT_EXPIRES", check: func(v string) error {
+		_, err := time.Parse(time.RFC3339, v)
+		return err
+	}},
+	{name: "DEBUG_ECHO", kind: kindBool, def: "false"},
+	{name: "ENABLE_PPROF", kind: kindBool, def: "false"},
+	{name: "PPROF_ADDR", def: defaultPprofAddr},
+	{name: "PPROF_APP_PORT", kind: kindBool, def: "false"},
+	{name: "ENABLE_FAULTS", kind: kindBool, def: "false"},
+	{name: "FAULTS_MAX_DURATION", kind: kindDuration, def: "15m"},
+	{name: "ENABLE_CONFIG_ENDPOINT", kind: kindBool, def: "false"},
+}
+
+// oneOf accepts exactly the given values.
+func oneOf(values ...string) func(string) error {
+	return func(v string) error {
+		if !slices.Contains(values, v) {
+			return fmt.Errorf("want one of %s", strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
+
+// inRange accepts numbers between lo and hi inclusive.
+func inRange(lo, hi float64) func(string) error {
+	return func(v string) error {
+		if f, _ := strconv.ParseFloat(v, 64); f < lo || f > hi {
+			return fmt.Errorf("want a value between %g and %g", lo, hi)
+		}
+		return nil
+	}
+}
+
+// atLeast accepts numbers of at least lo.
+func atLeast(lo float64) func(string) error {
+	return func(v string) error {
+		if f, _ := strconv.ParseFloat(v, 64); f < lo {
+			return fmt.Errorf("want a value of at least %g", lo)
+		}
+		return nil
+	}
+}
+
+func positive(v string) error {
+	if f, _ := strconv.ParseFloat(v, 64); f <= 0 {
+		return errors.New("must be positive")
+	}
+	return nil
+}
+
+// httpURL accepts absolute http and https URLs.
+func httpURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("want an http or https URL")
+	}
+	return nil
+}
+
+var settingIndex = func() map[string]*setting {
+	m := make(map[string]*setting, len(settings))
+	for i := range settings {
+		m[settings[i].name] = &settings[i]
+	}
+	return m
+}()
+
+// loadSecretFiles reads the NAME_FILE path of every declared setting.
+func loadSecretFiles() (map[string]string, map[string]error) {
+	values, errs := map[string]string{}, map[string]error{}
+	for _, s := range settings {
+		path := os.Getenv(s.name + "_FILE")
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs[s.name] = err
+			continue
+		}
+		values[s.name] = strings.TrimSpace(string(data))
+	}
+	return values, errs
+}
+
+// configSources is a snapshot of the configuration sources besides the
+// environment.
+type configSources struct {
+	file       map[string]string
+	fileErr    error
+	secrets    map[string]string
+	secretErrs map[string]error
+	// remote holds the remote document's settings, bar those it may not
+	// set, which are in refused. remoteErr is why the document is the
+	// cached one, or missing.
+	remote    map[string]string
+	refused   []string
+	remoteErr error
+}
+
+// loadConfigSources reads the files, then fetches the remote document
+// with the REMOTE_CONFIG_* settings they and the environment give.
+func loadConfigSources() *configSources {
+	src := &configSources{}
+	src.file, src.fileErr = loadConfigFile(os.Getenv("CONFIG_FILE"))
+	src.secrets, src.secretErrs = loadSecretFiles()
+	src.remote, src.refused, src.remoteErr = loadRemoteConfig(src)
+	return src
+}
+
+func (src *configSources) equal(other *configSources) bool {
+	return maps.Equal(src.file, other.file) &&
+		fmt.Sprint(src.fileErr) == fmt.Sprint(other.fileErr) &&
+		maps.Equal(src.secrets, other.secrets) &&
+		len(src.secretErrs) == len(other.secretErrs) &&
+		maps.Equal(src.remote, other.remote) &&
+		fmt.Sprint(src.remoteErr) == fmt.Sprint(other.remoteErr)
+}
+
+// startupSources serves settings that are not reloadable. It is loaded on
+// first use because package-level variables such as environment read
+// settings during initialization. currentSources serves reloadable settings
+// and is replaced by reloadConfig.
+var (
+	startupOnce    sync.Once
+	startupSources *configSources
+	currentSources atomic.Pointer[configSources]
+)
+
+func loadStartupSources() {
+	startupSources = loadConfigSources()
+	currentSources.Store(startupSources)
+}
+
+func sourcesFor(s *setting) *configSources {
+	startupOnce.Do(loadStartupSources)
+	if s.reloadable {
+		return currentSources.Load()
+	}
+	return startupSources
+}
+
+// rawSetting returns the configured value, environment first, or "" when
+// the setting is not configured anywhere.
+func rawSetting(s *setting, src *configSources) string {
+	if v := strings.TrimSpace(os.Getenv(s.name)); v != "" {
+		return v
+	}
+	if v, ok := src.secrets[s.name]; ok {
+		return v
+	}
+	if v, ok := src.remote[s.name]; ok {
+		return v
+	}
+	return src.file[s.name]
+}
+
+func (s *setting) validate(raw string) error {
+	var err error
+	switch s.kind {
+	case kindBool:
+		_, err = strconv.ParseBool(raw)
+	case kindInt:
+		_, err = strconv.Atoi(raw)
+	case kindFloat:
+		_, err = strconv.ParseFloat(raw, 64)
+	case kindDuration:
+		var d time.Duration
+		if d, err = time.ParseDuration(raw); err == nil && d <= 0 {
+			err = errors.New("must be positive")
+		}
+	}
+	if err == nil && s.check != nil {
+		err = s.check(raw)
+	}
+	return err
+}
+
+// conf returns the effective value of a declared setting: the configured
+// value if it is valid, otherwise the default.
+func conf(name string) string {
+	s, ok := settingIndex[name]
+	if !ok {
+		panic("undeclared setting " + name)
+	}
+	return s.effective(sourcesFor(s))
+}
+
+func (s *setting) effective(src *configSources) string {
+	raw := rawSetting(s, src)
+	if raw == "" || s.validate(raw) != nil {
+		return s.fallback(src)
+	}
+	return raw
+}
+
+// fallback is the value of s when nothing configures it: the environment's
+// observability profile's (observability.go), if it sets s, otherwise the
+// default in the table.
+func (s *setting) fallback(src *configSources) string {
+	if v, ok := profileDefault(s, src); ok {
+		return v
+	}
+	return s.def
+}
+
+func confBool(name string) bool {
+	b, _ := strconv.ParseBool(conf(name))
+	return b
+}
+
+func confInt(name string) int {
+	n, _ := strconv.Atoi(conf(name))
+	return n
+}
+
+func confFloat(name string) float64 {
+	f, _ := strconv.ParseFloat(conf(name), 64)
+	return f
+}
+
+func confDuration(name string) time.Duration {
+	d, _ := time.ParseDuration(conf(name))
+	return d
+}
+
+func confList(name string) []string {
+	var out []string
+	for _, v := range strings.Split(conf(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// environment is the deployment environment, resolved once at startup so
+// the landing page, health responses and startup logs always agree.
+var environment = resolveEnvironment()
+
+// resolveEnvironment reads ENVIRONMENT, normalising case and surrounding
+// whitespace so "Prod " and "prod" select the same badge, and defaults to
+// development when it is unset.
+func resolveEnvironment() string {
+	env := strings.ToLower(conf("ENVIRONMENT"))
+	if env == "" {
+		return "development"
+	}
+	return env
+}
+
+// configProblem is one issue found in the configuration sources.
+type configProblem struct {
+	msg      string
+	args     []any
+	required bool // a required setting is missing
+}
+
+func configProblems(src *configSources) []configProblem {
+	var problems []configProblem
+	add := func(msg string, args ...any) {
+		problems = append(problems, configProblem{msg: msg, args: args})
+	}
+
+	if src.fileErr != nil {
+		add("config file ignored", "error", src.fileErr)
+	}
+	for k := range src.file {
+		if _, ok := settingIndex[k]; !ok {
+			add("unknown setting in config file", "setting", k)
+		}
+	}
+	for k := range src.remote {
+		if _, ok := settingIndex[k]; !ok {
+			add("unknown setting in remote config", "setting", k)
+		}
+	}
+	for _, k := range src.refused {
+		add("setting ignored in remote config, set it locally", "setting", k)
+	}
+	for name, err := range src.secretErrs {
+		add("secret file unreadable", "setting", name, "error", err)
+	}
+	for i := range settings {
+		s := &settings[i]
+		if os.Getenv(s.name) != "" && os.Getenv(s.name+"_FILE") != "" {
+			add("both set, ignoring the file", "setting", s.name, "file_setting", s.name+"_FILE")
+		}
+		raw := rawSetting(s, src)
+		if raw == "" {
+			if s.required {
+				problems = append(problems, configProblem{
+					msg: "required setting is not set", args: []any{"setting", s.name}, required: true,
+				})
+			}
+			continue
+		}
+		if err := s.validate(raw); err != nil {
+			add("invalid setting", "setting", s.name, "value", redact(s, raw), "default", s.fallback(src), "error", err)
+		}
+	}
+	return problems
+}
+
+// validateConfig reports every configuration problem, then logs the
+// effective configuration. It exits when a required setting is missing, or
+// on any problem with STRICT_CONFIG=true.
+func validateConfig() {
+	strict := os.Getenv("STRICT_CONFIG") == "true"
+	fatal := false
+	startupOnce.Do(loadStartupSources)
+	for _, p := range configProblems(startupSources) {
+		if strict || p.required {
+			fatal = true
+			slog.Error(p.msg, p.args...)
+		} else {
+			slog.Warn(p.msg, p.args...)
+		}
+	}
+	if fatal {
+		slog.Error("invalid configuration, exiting", "strict", strict)
+		os.Exit(1)
+	}
+	if err := startupSources.remoteErr; err != nil {
+		slog.Warn("remote config degraded", "error", err)
+	}
+
+	attrs := make([]any, 0, len(settings))
+	for i := range settings {
+		s := &settings[i]
+		attrs = append(attrs, slog.String(s.name, redact(s, conf(s.name))))
+	}
+	slog.Info("effective configuration", "file", os.Getenv("CONFIG_FILE"), slog.Group("config", attrs...))
+}
+
+// reloadHooks run after a reload changed at least one reloadable setting.
+var reloadHooks []func()
+
+// onConfigReload registers f to re-read its settings after a reload. Hooks
+// must be registered before watchConfig starts.
+func onConfigReload(f func()) {
+	reloadHooks = append(reloadHooks, f)
+}
+
+// reloadConfig re-reads CONFIG_FILE and the NAME_FILE secrets. Only
+// reloadable settings take effect; changes to the others are logged as
+// needing a restart. With STRICT_CONFIG=true a reload with any problem is
+// rejected as a whole.
+func reloadConfig() {
+	prev := currentSources.Load()
+	next := loadConfigSources()
+	if next.equal(prev) {
+		return
+	}
+
+	switch {
+	case next.remoteErr != nil && fmt.Sprint(next.remoteErr) != fmt.Sprint(prev.remoteErr):
+		slog.Warn("remote config degraded", "error", next.remoteErr)
+	case next.remoteErr == nil && prev.remoteErr != nil:
+		slog.Info("remote config recovered")
+	}
+
+	strict := os.Getenv("STRICT_CONFIG") == "true"
+	problems := configProblems(next)
+	for _, p := range problems {
+		slog.Warn(p.msg, p.args...)
+	}
+	if strict && len(problems) > 0 {
+		slog.Error("config reload rejected, keeping current configuration", "problems", len(problems))
+		return
+	}
+
+	var changed []any
+	for i := range settings {
+		s := &settings[i]
+		before, after := s.effective(prev), s.effective(next)
+		switch {
+		case before == after:
+		case s.reloadable:
+			changed = append(changed, slog.String(s.name, redact(s, after)))
+		default:
+			slog.Warn("setting changed but only takes effect after a restart", "setting", s.name)
+		}
+	}
+	currentSources.Store(next)
+	if len(changed) == 0 {
+		return
+	}
+	slog.Info("configuration reloaded", slog.Group("changed", changed...))
+	for _, hook := range reloadHooks {
+		hook()
+	}
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the files
+// change, checking every CONFIG_RELOAD_INTERVAL, until ctx is done.
+func watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(confDuration("CONFIG_RELOAD_INTERVAL"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+		}
+		reloadConfig()
+	}
+}
+
+func redact(s *setting, v string) string {
+	if s.secret && v != "" {
+		return "[redacted]"
+	}
+	return v
+}
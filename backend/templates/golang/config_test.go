@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to name in a directory removed after the test,
+// returning its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withConfigFile points CONFIG_FILE at a file holding content and serves
+// the reloadable settings from it, as a reload would. The sources and the
+// reload hooks are restored afterwards.
+func withConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	startupOnce.Do(loadStartupSources)
+	sources, hooks := currentSources.Load(), reloadHooks
+	reloadHooks = nil
+	t.Cleanup(func() { currentSources.Store(sources); reloadHooks = hooks })
+	t.Setenv("REMOTE_CONFIG_URL", "")
+	path := writeFile(t, name, content)
+	t.Setenv("CONFIG_FILE", path)
+	currentSources.Store(loadConfigSources())
+	return path
+}
+
+// problemsFor returns the messages of the problems src has with setting,
+// or, for "", with the sources as a whole.
+func problemsFor(src *configSources, setting string) []string {
+	var msgs []string
+	for _, p := range configProblems(src) {
+		name := ""
+		for i := 0; i+1 < len(p.args); i += 2 {
+			if p.args[i] == "setting" {
+				name, _ = p.args[i+1].(string)
+			}
+		}
+		if name == setting {
+			msgs = append(msgs, p.msg)
+		}
+	}
+	return msgs
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file, content string
+		want          map[string]string
+	}{
+		"json": {"config.json", `{
+			"LOG_LEVEL": "debug",
+			"RATE_LIMIT_RPS": 2.5,
+			"ENABLE_PPROF": true,
+			"CORS_ALLOWED_ORIGINS": ["https://a.example", "https://b.example"],
+			"SENTRY_DSN": null
+		}`, map[string]string{
+			"LOG_LEVEL":            "debug",
+			"RATE_LIMIT_RPS":       "2.5",
+			"ENABLE_PPROF":         "true",
+			"CORS_ALLOWED_ORIGINS": "https://a.example,https://b.example",
+		}},
+		"yaml": {"config.yaml", strings.Join([]string{
+			"---",
+			"# a ConfigMap key mounted as a file",
+			"LOG_LEVEL: debug",
+			`ADMIN_PASSWORD: "pa:ss # not a comment"`,
+			"ADMIN_USERNAME: 'ops'",
+			"RATE_LIMIT_RPS: 3 # per second",
+			"",
+			"CORS_ALLOWED_ORIGINS: https://a.example,https://b.example",
+		}, "\n"), map[string]string{
+			"LOG_LEVEL":            "debug",
+			"ADMIN_PASSWORD":       "pa:ss # not a comment",
+			"ADMIN_USERNAME":       "ops",
+			"RATE_LIMIT_RPS":       "3",
+			"CORS_ALLOWED_ORIGINS": "https://a.example,https://b.example",
+		}},
+		"no extension": {"config", "LOG_LEVEL: warn\n", map[string]string{"LOG_LEVEL": "warn"}},
+	} {
+		got, err := loadConfigFile(writeFile(t, tc.file, tc.content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %d values %v, want %v", name, len(got), got, tc.want)
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("%s: %s = %q, want %q", name, k, got[k], v)
+			}
+		}
+	}
+
+	if got, err := loadConfigFile(""); err != nil || len(got) != 0 {
+		t.Errorf(`loadConfigFile("") = %v, %v; want no values`, got, err)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file, content, want string
+	}{
+		"bad json":       {"config.json", `{"LOG_LEVEL": `, "config.json: unexpected end of JSON input"},
+		"json array":     {"config.json", `["LOG_LEVEL"]`, "config.json: json: cannot unmarshal array"},
+		"nested json":    {"config.json", `{"LOG": {"LEVEL": "debug"}}`, "LOG: nested objects are not supported"},
+		"nested yaml":    {"config.yaml", "LOG:\n  LEVEL: debug\n", "config.yaml:2: want NAME: value"},
+		"yaml list":      {"config.yaml", "LOG_LEVEL: debug\n- item\n", "config.yaml:2: want NAME: value"},
+		"no colon":       {"config.yaml", "LOG_LEVEL debug\n", "config.yaml:1: want NAME: value"},
+		"space in name":  {"config.yaml", "LOG LEVEL: debug\n", "config.yaml:1: want NAME: value"},
+		"missing a name": {"config.yaml", ": debug\n", "config.yaml:1: want NAME: value"},
+	} {
+		if _, err := loadConfigFile(writeFile(t, tc.file, tc.content)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %v, want it to contain %q", name, err, tc.want)
+		}
+	}
+
+	if _, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: error %v, want not exist", err)
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "development")
+	t.Setenv("ADMIN_USERNAME", "from-env")
+	t.Setenv("ADMIN_PASSWORD_FILE", writeFile(t, "admin-password", "  from-secret\n"))
+	for _, name := range []string{"LOG_LEVEL", "LOG_FORMAT", "RATE_LIMIT_RPS", "CORS_MAX_AGE", "ADMIN_PASSWORD"} {
+		t.Setenv(name, "")
+	}
+	withConfigFile(t, "config.yaml", strings.Join([]string{
+		"ADMIN_USERNAME: from-file",
+		"ADMIN_PASSWORD: from-file",
+		"LOG_LEVEL: warn",
+		"LOG_FORMAT: json",
+		"RATE_LIMIT_RPS: fast",
+		"NOT_A_SETTING: 1",
+	}, "\n"))
+	src := loadConfigSources()
+
+	for name, want := range map[string]string{
+		"ADMIN_USERNAME": "from-env",    // the environment beats the file
+		"ADMIN_PASSWORD": "from-secret", // NAME_FILE beats the file, trimmed
+		"LOG_LEVEL":      "warn",        // the file beats the default
+		"LOG_FORMAT":     "json",        // and the development profile's text
+		"RATE_LIMIT_RPS": "",            // invalid, so the default
+		"CORS_MAX_AGE":   "10m",         // nowhere, so the default
+	} {
+		if got := settingIndex[name].effective(src); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	// The reloadable settings read the same sources through conf.
+	if got := conf("LOG_LEVEL"); got != "warn" {
+		t.Errorf(`conf("LOG_LEVEL") = %q, want warn`, got)
+	}
+
+	if got := problemsFor(src, "RATE_LIMIT_RPS"); len(got) != 1 || got[0] != "invalid setting" {
+		t.Errorf("RATE_LIMIT_RPS problems = %q, want invalid setting", got)
+	}
+	if got := problemsFor(src, "NOT_A_SETTING"); len(got) != 1 || got[0] != "unknown setting in config file" {
+		t.Errorf("NOT_A_SETTING problems = %q, want unknown setting", got)
+	}
+	if got := problemsFor(src, "ADMIN_PASSWORD"); len(got) != 0 {
+		t.Errorf("ADMIN_PASSWORD problems = %q, want none", got)
+	}
+}
+
+func TestBadConfigFile(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+	withConfigFile(t, "config.yaml", "LOG_LEVEL: debug\n  nested: true\n")
+	src := loadConfigSources()
+
+	if src.fileErr == nil || len(src.file) != 0 {
+		t.Fatalf("bad file: values %v, error %v; want an error and no values", src.file, src.fileErr)
+	}
+	if got := problemsFor(src, ""); len(got) != 1 || got[0] != "config file ignored" {
+		t.Errorf("problems = %q, want the file ignored", got)
+	}
+	// Nothing from a bad file applies, not even its valid lines.
+	if got := settingIndex["LOG_LEVEL"].effective(src); got != "info" {
+		t.Errorf("LOG_LEVEL = %q, want the default", got)
+	}
+
+	// An unreadable file is ignored the same way.
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	if src := loadConfigSources(); !os.IsNotExist(src.fileErr) {
+		t.Errorf("missing file: error %v, want not exist", src.fileErr)
+	}
+}
+
+// TestConfigReloadReachesHandlers rewrites CONFIG_FILE under running
+// handlers: the rate limiter, which re-reads its settings through a reload
+// hook, and the admin check, which reads ADMIN_PASSWORD per request.
+func TestConfigReloadReachesHandlers(t *testing.T) {
+	for _, name := range []string{"RATE_LIMIT_RPS", "RATE_LIMIT_BURST", "RATE_LIMIT_MODE", "ADMIN_PASSWORD", "ADMIN_USERNAME", "STRICT_CONFIG"} {
+		t.Setenv(name, "")
+	}
+	path := withConfigFile(t, "config.yaml", "RATE_LIMIT_RPS: 1\nRATE_LIMIT_BURST: 1\nADMIN_PASSWORD: old-pass\n")
+
+	ok := func(http.ResponseWriter, *http.Request) {}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", rateLimitMiddleware(newRateLimiter(), http.HandlerFunc(ok)))
+	mux.Handle("/admin/", requireAdmin("config", ok))
+
+	// granted counts the requests a new client gets through in a row.
+	granted := func(ip string) int {
+		for n := range 20 {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, fromIP("/api/items", ip))
+			if w.Code != http.StatusOK {
+				return n
+			}
+		}
+		return 20
+	}
+	admin := func(password string) int {
+		return do(mux, "GET", "/admin/x", nil, basicAuth("admin", password)...).Code
+	}
+
+	if n := granted("192.0.2.1"); n != 1 {
+		t.Fatalf("before the reload a client got %d requests, want the burst of 1", n)
+	}
+	if admin("old-pass") != http.StatusOK || admin("new-pass") != http.StatusUnauthorized {
+		t.Fatal("before the reload the admin check does not take old-pass alone")
+	}
+
+	if err := os.WriteFile(path, []byte("RATE_LIMIT_RPS: 100\nRATE_LIMIT_BURST: 10\nADMIN_PASSWORD: new-pass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+
+	if n := granted("192.0.2.2"); n != 10 {
+		t.Errorf("after the reload a client got %d requests, want the new burst of 10", n)
+	}
+	if got := admin("old-pass"); got != http.StatusUnauthorized {
+		t.Errorf("old password after the reload: %d, want 401", got)
+	}
+	if got := admin("new-pass"); got != http.StatusOK {
+		t.Errorf("new password after the reload: %d, want 200", got)
+	}
+
+	// With STRICT_CONFIG=true a reload with a problem is rejected as a
+	// whole, so the password it also changes does not apply either.
+	t.Setenv("STRICT_CONFIG", "true")
+	if err := os.WriteFile(path, []byte("RATE_LIMIT_RPS: 100\nRATE_LIMIT_BURST: 0\nADMIN_PASSWORD: newer-pass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+	if admin("new-pass") != http.StatusOK || admin("newer-pass") != http.StatusUnauthorized {
+		t.Error("a rejected reload changed the admin password")
+	}
+}
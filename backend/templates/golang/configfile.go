@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file is shared with openluffy-sdk, whose copy is generated from it
+// by ./openluffy.py sdk-sync: it uses no template tags and nothing defined
+// outside it.
+
+// loadConfigFile reads a JSON object (.json) or flat YAML file mapping
+// setting names to values. Lists may be JSON arrays or comma-separated
+// strings.
+func loadConfigFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		values, err := parseConfigJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return values, nil
+	}
+
+	// Flat YAML: NAME: value per line, # comments, optional quotes. This is
+	// the shape of a ConfigMap key mounted as a file; nesting is rejected
+	// rather than misread.
+	for i, line := range strings.Split(string(data), "\n") {
+		nested := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if nested || !ok || k == "" || strings.ContainsAny(k, " \t") || strings.HasPrefix(line, "-") {
+			return nil, fmt.Errorf("%s:%d: want NAME: value", path, i+1)
+		}
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		} else if before, _, found := strings.Cut(v, " #"); found {
+			v = strings.TrimSpace(before)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// parseConfigJSON reads a JSON object mapping setting names to values, as
+// CONFIG_FILE and the remote document hold them.
+func parseConfigJSON(data []byte) (map[string]string, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for k, v := range raw {
+		switch v := v.(type) {
+		case []any:
+			parts := make([]string, len(v))
+			for i, p := range v {
+				parts[i] = fmt.Sprint(p)
+			}
+			values[k] = strings.Join(parts, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("%s: nested objects are not supported", k)
+		case nil:
+		default:
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS for browser frontends hosted on other origins. Disabled unless
+// CORS_ALLOWED_ORIGINS is set.
+//
+//	CORS_ALLOWED_ORIGINS    comma-separated origins; "*" allows any, and
+//	                        "https://*.example.com" allows any subdomain
+//	CORS_ALLOWED_METHODS    default GET,POST,PUT,PATCH,DELETE,OPTIONS
+//	CORS_ALLOWED_HEADERS    default Accept,Authorization,Content-Type,X-Request-ID
+//	CORS_EXPOSED_HEADERS    default X-Request-ID
+//	CORS_ALLOW_CREDENTIALS  "true" to allow cookies and auth headers
+//	CORS_MAX_AGE            how long browsers may cache a preflight (default 10m)
+//
+// With credentials allowed, the matching origin is echoed back instead of
+// "*", since browsers reject a wildcard on credentialed requests.
+
+type corsConfig struct {
+	origins          []string
+	allowAll         bool
+	methods          string
+	headers          string
+	exposed          string
+	allowCredentials bool
+	maxAge           string
+}
+
+// loadCORSConfig reads the CORS_* variables; nil means CORS is disabled.
+func loadCORSConfig() *corsConfig {
+	origins := confList("CORS_ALLOWED_ORIGINS")
+	if len(origins) == 0 {
+		return nil
+	}
+
+	cfg := &corsConfig{
+		methods:          strings.Join(confList("CORS_ALLOWED_METHODS"), ", "),
+		headers:          strings.Join(confList("CORS_ALLOWED_HEADERS"), ", "),
+		exposed:          strings.Join(confList("CORS_EXPOSED_HEADERS"), ", "),
+		allowCredentials: confBool("CORS_ALLOW_CREDENTIALS"),
+		maxAge:           strconv.Itoa(int(confDuration("CORS_MAX_AGE").Seconds())),
+	}
+	for _, o := range origins {
+		if o == "*" {
+			cfg.allowAll = true
+			continue
+		}
+		cfg.origins = append(cfg.origins, strings.ToLower(strings.TrimRight(o, "/")))
+	}
+	return cfg
+}
+
+// allowed reports whether origin may make cross-origin requests.
+func (c *corsConfig) allowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, o := range c.origins {
+		if o == origin {
+			return true
+		}
+		// "https://*.example.com" matches "https://app.example.com" but not
+		// "https://example.com" or "https://evil-example.com".
+		if scheme, host, ok := strings.Cut(o, "://*."); ok {
+			if rest, ok := strings.CutPrefix(origin, scheme+"://"); ok && strings.HasSuffix(rest, "."+host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers
+// preflight requests directly. Requests from other origins pass through
+// without CORS headers, so the browser blocks them.
+func corsMiddleware(cfg *corsConfig, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !cfg.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if cfg.allowAll && !cfg.allowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.allowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if isPreflight(r) {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", cfg.methods)
+			h.Set("Access-Control-Allow-Headers", cfg.headers)
+			h.Set("Access-Control-Max-Age", cfg.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", cfg.exposed)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isPreflight reports whether r is a CORS preflight: an OPTIONS request
+// with Origin and Access-Control-Request-Method. Browsers send those
+// without credentials, so authentication lets them through; any other
+// OPTIONS request is authenticated like the rest, since routes registered
+// for every method would serve it.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withCORS returns a handler behind the CORS middleware configured from
+// env; the handler answers 200 "ok".
+func withCORS(t *testing.T, env map[string]string) http.Handler {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg := loadCORSConfig()
+	if cfg == nil {
+		t.Fatal("loadCORSConfig = nil, want CORS on")
+	}
+	return corsMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestCORSDisabled(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "")
+	if cfg := loadCORSConfig(); cfg != nil {
+		t.Fatalf("loadCORSConfig without CORS_ALLOWED_ORIGINS = %+v, want nil", cfg)
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	h := withCORS(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com/, https://*.example.org"})
+
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":     true,
+		"HTTPS://APP.EXAMPLE.COM":     true,
+		"https://other.example.com":   false,
+		"http://app.example.com":      false,
+		"https://eu.api.example.org":  true,
+		"https://example.org":         false,
+		"https://evil-example.org":    false,
+		"https://example.org.evil.io": false,
+	} {
+		w := do(h, "GET", "/api/items", nil, "Origin", origin)
+		got := w.Header().Get("Access-Control-Allow-Origin")
+		if w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Errorf("%s: %d %q, want the handler's answer", origin, w.Code, w.Body)
+		}
+		if allowed && got != origin {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want the origin", origin, got)
+		}
+		if !allowed && got != "" {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want none", origin, got)
+		}
+		if vary := w.Header().Values("Vary"); !slices.Contains(vary, "Origin") {
+			t.Errorf("%s: Vary %q, want Origin", origin, vary)
+		}
+	}
+
+	w := do(h, "GET", "/api/items", nil, "Origin", "https://app.example.com")
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != requestIDHeader {
+		t.Errorf("Access-Control-Expose-Headers = %q, want %s", got, requestIDHeader)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q without CORS_ALLOW_CREDENTIALS", got)
+	}
+
+	// Same-origin and non-browser requests carry no Origin.
+	if w := do(h, "GET", "/api/items", nil); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("CORS headers on a request without Origin")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := withCORS(t, map[string]string{
+		"CORS_ALLOWED_ORIGINS": "https://app.example.com",
+		"CORS_ALLOWED_METHODS": "GET,POST",
+		"CORS_MAX_AGE":         "1h",
+	})
+
+	w := do(h, "OPTIONS", "/api/items", nil,
+		"Origin", "https://app.example.com",
+		"Access-Control-Request-Method", "POST",
+		"Access-Control-Request-Headers", "Content-Type")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("preflight = %d %q, want 204 from the middleware", w.Code, w.Body)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Accept, Authorization, Content-Type, X-Request-ID",
+		"Access-Control-Max-Age":       "3600",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("preflight %s = %q, want %q", header, got, want)
+		}
+	}
+	if vary := strings.Join(w.Header().Values("Vary"), ","); vary != "Origin,Access-Control-Request-Method,Access-Control-Request-Headers" {
+		t.Errorf("preflight Vary = %q", vary)
+	}
+
+	// An OPTIONS request that is not a preflight reaches the handler.
+	if w := do(h, "OPTIONS", "/api/items", nil, "Origin", "https://app.example.com"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("plain OPTIONS = %d %q, want the handler's answer", w.Code, w.Body)
+	}
+
+	// A preflight from an origin not allowed gets no CORS headers, so the
+	// browser blocks the request.
+	w = do(h, "OPTIONS", "/api/items", nil, "Origin", "https://evil.example", "Access-Control-Request-Method", "POST")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("preflight from a disallowed origin got CORS headers: %v", w.Header())
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	h := withCORS(t, map[string]string{"CORS_ALLOWED_ORIGINS": "*"})
+	if got := do(h, "GET", "/", nil, "Origin", "https://anywhere.example").Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wildcard Access-Control-Allow-Origin = %q, want *", got)
+	}
+
+	// Browsers reject "*" on credentialed requests, so the origin is echoed.
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	h = withCORS(t, map[string]string{"CORS_ALLOWED_ORIGINS": "*"})
+	w := do(h, "GET", "/", nil, "Origin", "https://anywhere.example")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://anywhere.example" {
+		t.Errorf("credentialed wildcard Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The drain endpoint, for load balancers that poll one before taking an
+// instance out of rotation rather than relying on readiness alone:
+//
+//	GET   /drain  200 {"draining": false} while the app serves, 503
+//	              {"draining": true, "reason": ...} once it drains
+//	POST  /drain  {"draining": true} starts draining without stopping
+//	              the process; {"draining": false} takes it back
+//
+// A drain started with POST fails readiness, as the SHUTDOWN_DELAY drain
+// after SIGTERM does, so the load balancer and the endpoints controller
+// deregister the instance; it keeps serving whatever still reaches it
+// until the operator stops it or cancels the drain. A drain begun by
+// SIGTERM cannot be cancelled: POST answers 409 then.
+//
+// GET is served next to the probes, on ADMIN_PORT when that is set. POST
+// is served there too, and on the application port only behind the
+// admin credentials (admin.go), ADMIN_PASSWORD set with drain among
+// ADMIN_ENDPOINTS; without them /drain answers GET only.
+
+// drainPath is where the drain endpoint is served.
+const drainPath = "/drain"
+
+// DrainRequest is the body of POST /drain.
+type DrainRequest struct {
+	Draining *bool `json:"draining"`
+}
+
+// DrainResponse answers every /drain request.
+type DrainResponse struct {
+	Draining       bool   `json:"draining"`
+	Reason         string `json:"reason,omitempty"`
+	DrainRemaining string `json:"drain_remaining,omitempty"`
+	Timestamp      string `json:"timestamp"`
+}
+
+// registerDrain adds /drain to mux, with POST where the operator may
+// start a drain from it.
+func registerDrain(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+drainPath, drainHandler)
+	allow := "GET, HEAD"
+	if conf("ADMIN_PORT") != "" || adminProtected("drain") {
+		mux.HandleFunc("POST "+drainPath, requireAdmin("drain", setDrainHandler))
+		allow += ", POST"
+	}
+	mux.HandleFunc(drainPath, methodNotAllowed(allow))
+}
+
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	writeDrain(w, r, true)
+}
+
+func setDrainHandler(w http.ResponseWriter, r *http.Request) {
+	var req DrainRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid JSON body: "+strings.TrimPrefix(err.Error(), "json: "))
+		return
+	}
+	if req.Draining == nil {
+		writeError(w, r, http.StatusBadRequest, `"draining" is required, true or false`)
+		return
+	}
+	if !requestDrain(*req.Draining) {
+		writeError(w, r, http.StatusConflict, "shutting down: a drain begun by SIGTERM cannot be cancelled")
+		return
+	}
+	if *req.Draining {
+		requestLogger(r).Warn("drain requested: readiness fails until POST /drain cancels it")
+	} else {
+		requestLogger(r).Warn("drain cancelled")
+	}
+	writeDrain(w, r, false)
+}
+
+// writeDrain answers with the drain state. For a poll, while the app
+// drains, the status is 503, so a load balancer can go by it alone.
+func writeDrain(w http.ResponseWriter, r *http.Request, poll bool) {
+	resp := DrainResponse{Timestamp: time.Now().Format(time.RFC3339)}
+	status, text := http.StatusOK, "serving"
+	if reason, remaining := shuttingDown(); reason != "" {
+		resp.Draining, resp.Reason, text = true, reason, "draining"
+		if remaining > 0 {
+			resp.DrainRemaining = remaining.Round(time.Millisecond).String()
+		}
+		if poll {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, text)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
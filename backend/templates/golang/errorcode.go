@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// This file is shared with openluffy-sdk, whose copy is generated from it
+// by ./openluffy.py sdk-sync: it uses no template tags and nothing defined
+// outside it.
+
+// errorCode is the code for status: its reason phrase in snake_case, or
+// "error" for a status with none.
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return '_'
+	}, text)
+}
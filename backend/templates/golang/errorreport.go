@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error reporting to Sentry or a Sentry-compatible service (GlitchTip,
+// self-hosted Sentry). Off unless SENTRY_DSN is set:
+//
+//	SENTRY_DSN          the project's DSN,
+//	                    https://<key>@<host>/<project id>; secret
+//	SENTRY_SAMPLE_RATE  share of errors reported, 0..1 (default 1)
+//
+// Handler panics are reported by recoveryMiddleware. Report other errors
+// worth a look with reportError(r, err), typically where a handler answers
+// 500:
+//
+//	if err != nil {
+//		reportError(r, err)
+//		writeError(w, r, http.StatusInternalServerError, "internal server error")
+//		return
+//	}
+//
+// Events carry the stack, the request (method, URL and headers, with
+// credentials redacted as on /debug/echo), the request and trace IDs, the
+// user ID when known, and the release (git SHA), environment and pod.
+// They are queued and sent in the background, so reporting never slows a
+// request; when the queue is full, or the service is unreachable, events
+// are dropped and a warning is logged.
+
+const (
+	errorQueueSize    = 100
+	errorSendTimeout  = 10 * time.Second
+	maxErrorStackSize = 64
+)
+
+// sentryEvent is the subset of the Sentry event payload the reporter uses.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment"`
+	Exception   sentryExceptions  `json:"exception"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	User        map[string]string `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Contexts    map[string]any    `json:"contexts,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	Mechanism struct {
+		Type    string `json:"type"`
+		Handled bool   `json:"handled"`
+	} `json:"mechanism"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryRequest struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers"`
+}
+
+// errorReporter ships events. A nil *errorReporter means reporting is off.
+type errorReporter struct {
+	endpoint string
+	auth     string
+	dsn      string
+	rate     float64
+	server   string
+	client   *http.Client
+
+	queue   chan *sentryEvent
+	done    chan struct{} // closed to request a final flush
+	stopped chan struct{} // closed by run once the queue is drained
+	once    sync.Once
+}
+
+var errorReporting *errorReporter
+
+// parseDSN returns the envelope endpoint and public key of a Sentry DSN.
+func parseDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User == nil {
+		return "", "", errors.New("want https://<key>@<host>/<project id>")
+	}
+	prefix, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" || u.User.Username() == "" {
+		return "", "", errors.New("want https://<key>@<host>/<project id>")
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project), u.User.Username(), nil
+}
+
+func checkDSN(v string) error {
+	_, _, err := parseDSN(v)
+	return err
+}
+
+// setupErrorReporting configures the global reporter from SENTRY_DSN.
+func setupErrorReporting() {
+	dsn := conf("SENTRY_DSN")
+	if dsn == "" {
+		return
+	}
+	endpoint, key, err := parseDSN(dsn)
+	if err != nil {
+		slog.Warn("invalid SENTRY_DSN, error reporting disabled", "error", err)
+		return
+	}
+	server := conf("POD_NAME")
+	if server == "" {
+		server, _ = os.Hostname()
+	}
+	errorReporting = &errorReporter{
+		endpoint: endpoint,
+		auth:     "Sentry sentry_version=7, sentry_client=openluffy-go/" + templateVersion + ", sentry_key=" + key,
+		dsn:      dsn,
+		rate:     confFloat("SENTRY_SAMPLE_RATE"),
+		server:   server,
+		client:   &http.Client{Timeout: errorSendTimeout},
+		queue:    make(chan *sentryEvent, errorQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go errorReporting.run()
+
+	u, _ := url.Parse(endpoint)
+	slog.Info("error reporting enabled", "host", u.Host, "sample_rate", errorReporting.rate)
+}
+
+// reportError reports err, with r's context when r is not nil. It is a
+// no-op when reporting is off.
+func reportError(r *http.Request, err error) {
+	if errorReporting == nil || err == nil {
+		return
+	}
+	errorReporting.capture(r, "error", errorType(err), err.Error(), "generic", true, 3)
+}
+
+// reportPanic reports a recovered panic. Call it from the deferred
+// function that recovered, so the stack still shows where it panicked.
+func reportPanic(r *http.Request, recovered any) {
+	if errorReporting == nil {
+		return
+	}
+	typ, msg := "panic", fmt.Sprint(recovered)
+	if err, ok := recovered.(error); ok {
+		typ = errorType(err)
+	}
+	errorReporting.capture(r, "fatal", typ, msg, "panic", false, 3)
+}
+
+// errorType names err's innermost wrapped error type, so events group by
+// cause rather than by *fmt.wrapError.
+func errorType(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return reflect.TypeOf(err).String()
+		}
+		err = next
+	}
+}
+
+// capture builds an event and queues it, dropping it if the queue is full
+// rather than blocking the caller. skip is passed on to stackFrames and
+// counts stackFrames, capture and the report function calling it.
+func (e *errorReporter) capture(r *http.Request, level, typ, msg, mechanism string, handled bool, skip int) {
+	var id [16]byte
+	rand.Read(id[:])
+	// As in tracing.go, the random ID doubles as the sampling source.
+	if e.rate < 1 && binary.BigEndian.Uint64(id[8:]) >= uint64(e.rate*float64(^uint64(0))) {
+		return
+	}
+	ev := &sentryEvent{
+		EventID:     hex.EncodeToString(id[:]),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       level,
+		Logger:      serviceName,
+		ServerName:  e.server,
+		Release:     version.GitSHA,
+		Environment: environment,
+	}
+	ex := sentryException{Type: typ, Value: msg}
+	ex.Mechanism.Type, ex.Mechanism.Handled = mechanism, handled
+	ex.Stacktrace.Frames = stackFrames(skip)
+	ev.Exception.Values = []sentryException{ex}
+	if r != nil {
+		addRequest(ev, r)
+	}
+
+	select {
+	case e.queue <- ev:
+	default:
+		slog.Warn("error report queue full, dropping event", "type", typ)
+	}
+}
+
+// stackFrames returns the stack, leaving out skip frames counting
+// stackFrames itself, outermost call first as Sentry expects. Below a
+// panic it starts at the panicking function rather than at the deferred
+// recover. Frames in the app's own packages are marked in_app.
+func stackFrames(skip int) []sentryFrame {
+	pcs := make([]uintptr, maxErrorStackSize)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []sentryFrame
+	for {
+		f, more := frames.Next()
+		if f.Function == "runtime.gopanic" {
+			out = out[:0]
+		} else {
+			out = append(out, newFrame(f))
+		}
+		if !more {
+			break
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// appModule is the module path of the app's packages: main in a binary,
+// the go.mod module path in a test binary and in any subpackages.
+var appModule = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Path != "" {
+		return info.Main.Path
+	}
+	return "main"
+}()
+
+// newFrame splits f's function into Sentry's module and function names.
+func newFrame(f runtime.Frame) sentryFrame {
+	module, function := "", f.Function
+	if i := strings.LastIndex(function, "/"); i >= 0 {
+		if j := strings.Index(function[i:], "."); j >= 0 {
+			module, function = function[:i+j], function[i+j+1:]
+		}
+	} else if j := strings.Index(function, "."); j >= 0 {
+		module, function = function[:j], function[j+1:]
+	}
+	return sentryFrame{
+		Function: function,
+		Module:   module,
+		Filename: f.File[strings.LastIndex(f.File, "/")+1:],
+		AbsPath:  f.File,
+		Lineno:   f.Line,
+		InApp:    module == "main" || module == appModule || strings.HasPrefix(module, appModule+"/"),
+	}
+}
+
+// addRequest attaches r's method, URL, headers and correlation IDs.
+func addRequest(ev *sentryEvent, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	ev.Request = &sentryRequest{
+		Method:      r.Method,
+		URL:         scheme + "://" + r.Host + r.URL.Path,
+		QueryString: r.URL.RawQuery,
+		Headers:     map[string]string{},
+	}
+	for name, values := range redactedHeaders(r.Header) {
+		ev.Request.Headers[name] = strings.Join(values, ", ")
+	}
+
+	ctx := r.Context()
+	ev.Tags = map[string]string{}
+	if id := requestIDFromContext(ctx); id != "" {
+		ev.Tags["request_id"] = id
+	}
+	if id := tenantID(ctx); id != "" {
+		ev.Tags["tenant_id"] = id
+	}
+	if id := apiKeyID(ctx); id != "" {
+		ev.Tags["api_key_id"] = id
+	}
+	ev.User = map[string]string{"ip_address": clientIP(r)}
+	if id := cmp.Or(userID(ctx), claimsFromContext(ctx).subject()); id != "" {
+		ev.User["id"] = id
+	}
+	if sc, ok := spanFromContext(ctx); ok {
+		ev.Contexts = map[string]any{"trace": map[string]string{
+			"trace_id": hex.EncodeToString(sc.TraceID[:]),
+			"span_id":  hex.EncodeToString(sc.SpanID[:]),
+		}}
+	}
+}
+
+func (e *errorReporter) run() {
+	defer close(e.stopped)
+	for {
+		select {
+		case ev := <-e.queue:
+			e.send(ev)
+		case <-e.done:
+			for {
+				select {
+				case ev := <-e.queue:
+					e.send(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts one event as a Sentry envelope.
+func (e *errorReporter) send(ev *sentryEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		slog.Warn("encoding error report failed", "error", err)
+		return
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": ev.EventID, "dsn": e.dsn, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(payload)})
+	var body bytes.Buffer
+	for _, line := range [][]byte{header, item, payload} {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, &body)
+	if err != nil {
+		slog.Warn("building error report request failed", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", e.auth)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		slog.Warn("sending error report failed", "error", err, "event_id", ev.EventID)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		slog.Warn("error reporting service rejected event", "status", resp.StatusCode, "event_id", ev.EventID)
+	}
+}
+
+// flushErrorReports sends queued events, waiting at most until ctx is done.
+func flushErrorReports(ctx context.Context) {
+	if errorReporting == nil {
+		return
+	}
+	errorReporting.once.Do(func() { close(errorReporting.done) })
+	select {
+	case <-errorReporting.stopped:
+	case <-ctx.Done():
+		slog.Warn("timed out sending error reports")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusNotFound:              "not_found",
+		http.StatusMethodNotAllowed:      "method_not_allowed",
+		http.StatusRequestEntityTooLarge: "request_entity_too_large",
+		http.StatusTeapot:                "i_m_a_teapot",
+		599:                              "error",
+	} {
+		if got := errorCode(status); got != want {
+			t.Errorf("errorCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusTooManyRequests, "slow down")
+	}))
+
+	w := do(h, "GET", "/", nil, requestIDHeader, "req-1")
+	var resp errorResponse
+	decode(t, w, &resp)
+	want := errorResponse{Code: "too_many_requests", Message: "slow down", Error: "slow down", RequestID: "req-1"}
+	if w.Code != http.StatusTooManyRequests || resp != want || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("writeError = %d %+v, want 429 %+v keeping Retry-After", w.Code, resp, want)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	mux.HandleFunc("GET /docs/", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	h := requestIDMiddleware(routeErrors(mux))
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code, allow  string
+	}{
+		{"GET", "/nope", http.StatusNotFound, "not_found", ""},
+		{"POST", "/items", http.StatusMethodNotAllowed, "method_not_allowed", "GET, HEAD"},
+	} {
+		w := do(h, tc.method, tc.path, nil)
+		var resp errorResponse
+		decode(t, w, &resp)
+		if w.Code != tc.status || resp.Code != tc.code || resp.RequestID == "" || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s = %d %+v Allow %q, want a JSON %d %s", tc.method, tc.path, w.Code, resp, w.Header().Get("Allow"), tc.status, tc.code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s has Content-Type %q, want application/json", tc.method, tc.path, ct)
+		}
+	}
+
+	// Routes, and the mux's redirects, are served as they are.
+	if w := do(h, "GET", "/items", nil); w.Code != http.StatusNoContent {
+		t.Errorf("GET /items = %d, want the handler's 204", w.Code)
+	}
+	if w := do(h, "GET", "/docs", nil); w.Code/100 != 3 || w.Header().Get("Location") != "/docs/" {
+		t.Errorf("GET /docs = %d Location %q, want the mux's redirect to /docs/", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Fault injection for chaos testing, off unless ENABLE_FAULTS=true: an
+// operator can fail the probes, slow requests down or answer a share of
+// them with errors for a while, to see the probes, rollouts, alerts and
+// retries around the app react as they should.
+//
+//	ENABLE_FAULTS        "true" serves /debug/faults
+//	FAULTS_MAX_DURATION  longest a fault may be set for (default 15m)
+//
+// The endpoint is on the admin server with ADMIN_PORT set. Without it,
+// it is served on the application port only behind the admin credentials
+// (admin.go), ADMIN_PASSWORD set with faults among ADMIN_ENDPOINTS, and
+// not at all otherwise.
+//
+//	GET     /debug/faults  the faults in effect
+//	PUT     /debug/faults  replace them, e.g.
+//	                       {"readiness": true, "duration": "2m"} or
+//	                       {"latency": "800ms", "error_rate": 0.2,
+//	                        "error_status": 503, "paths": ["/api/"],
+//	                        "duration": "10m"}
+//	DELETE  /debug/faults  clear them
+//
+// "liveness" and "readiness" fail the probes' fault-injection check;
+// "latency" delays, and "error_rate" answers error_status (default 500)
+// to, that share of the requests under paths, every path by default. The
+// probes, /metrics and /debug/faults itself are never delayed or failed.
+// Faults clear themselves once their duration, which is required, has
+// passed, so a forgotten experiment cannot outlive it. /metrics reports
+// faults_active and faults_injected_total per fault.
+
+// faultsPath is where the fault injection endpoint is served.
+const faultsPath = "/debug/faults"
+
+// FaultSpec is the body of PUT /debug/faults.
+type FaultSpec struct {
+	Liveness    bool     `json:"liveness,omitempty"`
+	Readiness   bool     `json:"readiness,omitempty"`
+	Latency     string   `json:"latency,omitempty"`
+	ErrorRate   float64  `json:"error_rate,omitempty"`
+	ErrorStatus int      `json:"error_status,omitempty"`
+	Paths       []string `json:"paths,omitempty"`
+	Duration    string   `json:"duration"`
+}
+
+// faultState is a FaultSpec in effect.
+type faultState struct {
+	spec    FaultSpec
+	latency time.Duration
+	until   time.Time
+}
+
+// FaultsResponse answers every /debug/faults request.
+type FaultsResponse struct {
+	Active bool `json:"active"`
+	*FaultSpec
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+var (
+	injectedFaults atomic.Pointer[faultState]
+
+	faultsInjected struct{ latency, errors atomic.Int64 }
+)
+
+// activeFaults returns the faults in effect, nil for none.
+func activeFaults() *faultState {
+	f := injectedFaults.Load()
+	if f == nil || time.Now().After(f.until) {
+		return nil
+	}
+	return f
+}
+
+// newFaultState validates spec.
+func newFaultState(spec FaultSpec) (*faultState, error) {
+	duration, err := time.ParseDuration(spec.Duration)
+	if err != nil || duration <= 0 {
+		return nil, errors.New(`"duration" is required, e.g. "5m"`)
+	}
+	if longest := confDuration("FAULTS_MAX_DURATION"); duration > longest {
+		return nil, fmt.Errorf(`"duration" is longer than FAULTS_MAX_DURATION (%s)`, longest)
+	}
+	f := &faultState{spec: spec, until: time.Now().Add(duration)}
+	if spec.Latency != "" {
+		if f.latency, err = time.ParseDuration(spec.Latency); err != nil || f.latency < 0 {
+			return nil, errors.New(`"latency" must be a duration, e.g. "500ms"`)
+		}
+	}
+	if spec.ErrorRate < 0 || spec.ErrorRate > 1 {
+		return nil, errors.New(`"error_rate" must be between 0 and 1`)
+	}
+	if f.spec.ErrorStatus == 0 {
+		f.spec.ErrorStatus = http.StatusInternalServerError
+	}
+	if f.spec.ErrorStatus < 400 || f.spec.ErrorStatus > 599 {
+		return nil, errors.New(`"error_status" must be an HTTP error status, 400 to 599`)
+	}
+	for _, p := range spec.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf(`"paths": %q is not an absolute path`, p)
+		}
+	}
+	if !spec.Liveness && !spec.Readiness && f.latency == 0 && spec.ErrorRate == 0 {
+		return nil, errors.New("no fault given: set liveness, readiness, latency or error_rate")
+	}
+	return f, nil
+}
+
+// registerFaults adds the probes' fault-injection checks and, on the
+// application port, the endpoint, when ENABLE_FAULTS is set.
+func registerFaults(mux *http.ServeMux) {
+	if !confBool("ENABLE_FAULTS") {
+		return
+	}
+	livenessChecks.register("fault-injection", faultCheck(func(f *faultState) bool { return f.spec.Liveness }), 0)
+	readinessChecks.register("fault-injection", faultCheck(func(f *faultState) bool { return f.spec.Readiness }), 0)
+	registerMetrics(writeFaultMetrics)
+
+	switch {
+	case conf("ADMIN_PORT") != "":
+		// newAdminServer (server.go) serves it.
+	case adminProtected("faults"):
+		registerFaultsEndpoint(mux)
+		slog.Warn("fault injection enabled on the application port, behind the admin credentials")
+	default:
+		slog.Error("ENABLE_FAULTS ignored: it needs ADMIN_PORT, or ADMIN_PASSWORD set and faults in ADMIN_ENDPOINTS")
+	}
+}
+
+// registerFaultsEndpoint adds /debug/faults to mux behind requireAdmin.
+func registerFaultsEndpoint(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+faultsPath, requireAdmin("faults", getFaultsHandler))
+	mux.HandleFunc("PUT "+faultsPath, requireAdmin("faults", putFaultsHandler))
+	mux.HandleFunc("DELETE "+faultsPath, requireAdmin("faults", deleteFaultsHandler))
+	mux.HandleFunc(faultsPath, methodNotAllowed("GET, HEAD, PUT, DELETE"))
+}
+
+// faultCheck fails while the faults in effect have failing set.
+func faultCheck(failing func(*faultState) bool) checkFunc {
+	return func(context.Context) error {
+		if f := activeFaults(); f != nil && failing(f) {
+			return errors.New("failure injected with " + faultsPath)
+		}
+		return nil
+	}
+}
+
+func getFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	writeFaults(w, activeFaults())
+}
+
+func putFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	var spec FaultSpec
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&spec)
+	if err != nil {
+		err = fmt.Errorf("invalid JSON body: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	var f *faultState
+	if err == nil {
+		f, err = newFaultState(spec)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	injectedFaults.Store(f)
+	time.AfterFunc(time.Until(f.until), func() {
+		if injectedFaults.CompareAndSwap(f, nil) {
+			slog.Warn("injected faults expired")
+		}
+	})
+	requestLogger(r).Warn("faults injected", "liveness", spec.Liveness, "readiness", spec.Readiness,
+		"latency", f.latency.String(), "error_rate", spec.ErrorRate, "error_status", f.spec.ErrorStatus,
+		"paths", spec.Paths, "duration", spec.Duration)
+	writeFaults(w, f)
+}
+
+func deleteFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if injectedFaults.Swap(nil) != nil {
+		requestLogger(r).Warn("injected faults cleared")
+	}
+	writeFaults(w, nil)
+}
+
+func writeFaults(w http.ResponseWriter, f *faultState) {
+	resp := FaultsResponse{}
+	if f != nil {
+		resp = FaultsResponse{Active: true, FaultSpec: &f.spec, ExpiresAt: f.until.Format(time.RFC3339)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// faultMiddleware delays and fails requests as the faults in effect ask.
+// Without ENABLE_FAULTS it is not in the chain at all.
+func faultMiddleware(next http.Handler) http.Handler {
+	if !confBool("ENABLE_FAULTS") {
+		return next
+	}
+	exempt := append(opsPaths(), faultsPath)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := activeFaults()
+		if f == nil || protectedPath(r.URL.Path, exempt) ||
+			len(f.spec.Paths) > 0 && !protectedPath(r.URL.Path, f.spec.Paths) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if f.latency > 0 {
+			faultsInjected.latency.Add(1)
+			timer := time.NewTimer(f.latency)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if f.spec.ErrorRate > 0 && rand.Float64() < f.spec.ErrorRate {
+			faultsInjected.errors.Add(1)
+			w.Header().Set("X-Fault-Injected", "error")
+			writeError(w, r, f.spec.ErrorStatus, "fault injected")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeFaultMetrics(w io.Writer) {
+	active := 0
+	if activeFaults() != nil {
+		active = 1
+	}
+	fmt.Fprintln(w, "# HELP faults_active Whether faults injected with /debug/faults are in effect.")
+	fmt.Fprintln(w, "# TYPE faults_active gauge")
+	fmt.Fprintf(w, "faults_active %d\n", active)
+	fmt.Fprintln(w, "# HELP faults_injected_total Requests delayed or failed by injected faults.")
+	fmt.Fprintln(w, "# TYPE faults_injected_total counter")
+	fmt.Fprintf(w, "faults_injected_total{fault=\"latency\"} %d\n", faultsInjected.latency.Load())
+	fmt.Fprintf(w, "faults_injected_total{fault=\"error\"} %d\n", faultsInjected.errors.Load())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withFaults enables fault injection behind the admin credentials and
+// serves an app handler through faultMiddleware, for one test.
+func withFaults(t *testing.T) http.Handler {
+	t.Helper()
+	t.Setenv("ENABLE_FAULTS", "true")
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+	withChecks(t)
+	saved := metricWriters
+	t.Cleanup(func() {
+		metricWriters = saved
+		injectedFaults.Store(nil)
+	})
+
+	mux := http.NewServeMux()
+	registerOps(mux)
+	registerFaults(mux)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	return faultMiddleware(mux)
+}
+
+// putFaults sets the faults with the admin credentials.
+func putFaults(t *testing.T, h http.Handler, body string) FaultsResponse {
+	t.Helper()
+	w := do(h, "PUT", "/debug/faults", strings.NewReader(body), basicAuth("admin", "s3cret-admin-pass")...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /debug/faults %s = %d %s, want 200", body, w.Code, w.Body)
+	}
+	var resp FaultsResponse
+	decode(t, w, &resp)
+	return resp
+}
+
+func TestFaultInjection(t *testing.T) {
+	h := withFaults(t)
+
+	if w := do(h, "PUT", "/debug/faults", strings.NewReader(`{"readiness": true, "duration": "1m"}`)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("PUT /debug/faults without credentials = %d, want 401", w.Code)
+	}
+
+	if resp := putFaults(t, h, `{"readiness": true, "duration": "1m"}`); !resp.Active || resp.ExpiresAt == "" {
+		t.Errorf("PUT /debug/faults answered %+v, want the fault active with its expiry", resp)
+	}
+	if w := do(h, "GET", "[% READINESS_PATH %]", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness with a readiness fault = %d, want 503", w.Code)
+	}
+	if w := do(h, "GET", "[% LIVENESS_PATH %]", nil); w.Code != http.StatusOK {
+		t.Errorf("liveness with a readiness fault = %d, want 200", w.Code)
+	}
+
+	// A PUT replaces what was in effect.
+	putFaults(t, h, `{"error_rate": 1, "error_status": 503, "paths": ["/api/"], "duration": "1m"}`)
+	if w := do(h, "GET", "/api/orders", nil); w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Fault-Injected") != "error" {
+		t.Errorf("GET /api/orders = %d, want the injected 503", w.Code)
+	}
+	for _, path := range []string{"/landing", "[% READINESS_PATH %]", "/metrics"} {
+		if w := do(h, "GET", path, nil, basicAuth("admin", "s3cret-admin-pass")...); w.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200 outside the faulted paths", path, w.Code)
+		}
+	}
+
+	putFaults(t, h, `{"latency": "50ms", "duration": "1m"}`)
+	start := time.Now()
+	if w := do(h, "GET", "/api/orders", nil); w.Code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("GET /api/orders = %d after %s, want 200 after the injected 50ms", w.Code, time.Since(start))
+	}
+
+	w := do(h, "DELETE", "/debug/faults", nil, basicAuth("admin", "s3cret-admin-pass")...)
+	var resp FaultsResponse
+	decode(t, w, &resp)
+	if resp.Active || activeFaults() != nil {
+		t.Errorf("DELETE /debug/faults left %+v in effect", resp)
+	}
+	if w := do(h, "GET", "/metrics", nil, basicAuth("admin", "s3cret-admin-pass")...); !strings.Contains(w.Body.String(), `faults_injected_total{fault="error"} 1`) {
+		t.Errorf("/metrics does not count the injected error:\n%s", w.Body)
+	}
+}
+
+func TestFaultsRejected(t *testing.T) {
+	h := withFaults(t)
+	t.Setenv("FAULTS_MAX_DURATION", "5m")
+	for _, body := range []string{
+		`{"readiness": true}`,
+		`{"readiness": true, "duration": "1h"}`,
+		`{"duration": "1m"}`,
+		`{"error_rate": 1.5, "duration": "1m"}`,
+		`{"error_rate": 0.5, "error_status": 302, "duration": "1m"}`,
+		`{"latency": "1m", "paths": ["api"], "duration": "1m"}`,
+		`{"readyness": true, "duration": "1m"}`,
+	} {
+		w := do(h, "PUT", "/debug/faults", strings.NewReader(body), basicAuth("admin", "s3cret-admin-pass")...)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PUT /debug/faults %s = %d, want 400", body, w.Code)
+		}
+	}
+	if activeFaults() != nil {
+		t.Error("a rejected PUT set faults")
+	}
+}
+
+func TestFaultsExpire(t *testing.T) {
+	h := withFaults(t)
+	putFaults(t, h, `{"liveness": true, "duration": "20ms"}`)
+	if w := do(h, "GET", "[% LIVENESS_PATH %]", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("liveness with a liveness fault = %d, want 503", w.Code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if w := do(h, "GET", "[% LIVENESS_PATH %]", nil); w.Code != http.StatusOK {
+		t.Errorf("liveness once the fault expired = %d, want 200", w.Code)
+	}
+}
+
+func TestFaultsNeedAdmin(t *testing.T) {
+	withFaults(t)
+	t.Setenv("ADMIN_PASSWORD", "")
+	mux := http.NewServeMux()
+	registerFaults(mux)
+	if _, pattern := mux.Handler(httptest.NewRequest("PUT", "/debug/faults", nil)); pattern != "" {
+		t.Errorf("/debug/faults served on the application port without the admin credentials, as %q", pattern)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Feature flags from the environment. Every FEATURE_<NAME> variable
+// declares the flag <name>, lowercased:
+//
+//	FEATURE_NEW_CHECKOUT=true   on for everyone (also on, yes, 1)
+//	FEATURE_NEW_CHECKOUT=false  off for everyone (also off, no, 0)
+//	FEATURE_NEW_CHECKOUT=25%    on for 25% of users
+//
+// Handlers check a flag with featureEnabled(r, "new_checkout"); code
+// without a request uses featureEnabledFor with its own subject. A
+// rollout buckets the subject by hashing it with the flag name, so a user
+// keeps the same answer across requests and replicas, and raising the
+// percentage only adds users. The subject is the caller's user ID (the
+// X-User-Id context header or the JWT subject), else the API key ID;
+// anonymous callers only get flags that are fully on. Undeclared flags
+// are off.
+//
+// Flags are read once at startup: changing one means a rollout, like any
+// other environment variable. GET /api/flags lists them, evaluated for the
+// caller, so a frontend can follow the same flags.
+
+const featurePrefix = "FEATURE_"
+
+// featureFlag is a declared flag; rollout is the percentage of subjects
+// that get it, 0 to 100.
+type featureFlag struct {
+	name    string
+	rollout int
+}
+
+var featureFlags = map[string]featureFlag{}
+
+// parseFeatureFlag reads a FEATURE_* value as a rollout percentage.
+func parseFeatureFlag(v string) (int, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case "true", "on", "yes", "1":
+		return 100, true
+	case "false", "off", "no", "0", "":
+		return 0, true
+	}
+	if pct, ok := strings.CutSuffix(v, "%"); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(pct)); err == nil && n >= 0 && n <= 100 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// loadFeatureFlags declares a flag for every FEATURE_* variable. An
+// invalid value is logged and the flag left off.
+func loadFeatureFlags() {
+	flags := map[string]featureFlag{}
+	var attrs []any
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, featurePrefix)
+		if !ok || name == "" {
+			continue
+		}
+		name = strings.ToLower(name)
+		rollout, ok := parseFeatureFlag(value)
+		if !ok {
+			slog.Warn("invalid feature flag, leaving it off", "flag", key, "value", value, "want", "true, false or a percentage such as 25%")
+		}
+		flags[name] = featureFlag{name: name, rollout: rollout}
+		attrs = append(attrs, slog.Int(name, rollout))
+	}
+	featureFlags = flags
+	if len(attrs) > 0 {
+		slog.Info("feature flags", slog.Group("rollout_percent", attrs...))
+	}
+}
+
+// featureEnabledFor reports whether flag name is on for subject.
+func featureEnabledFor(name, subject string) bool {
+	f, ok := featureFlags[strings.ToLower(name)]
+	switch {
+	case !ok || f.rollout <= 0:
+		return false
+	case f.rollout >= 100:
+		return true
+	case subject == "":
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.name + "\x00" + subject))
+	return int(h.Sum32()%100) < f.rollout
+}
+
+// featureEnabled reports whether flag name is on for the caller of r.
+func featureEnabled(r *http.Request, name string) bool {
+	return featureEnabledFor(name, featureSubject(r))
+}
+
+// featureSubject is who percentage rollouts bucket r by.
+func featureSubject(r *http.Request) string {
+	ctx := r.Context()
+	return cmp.Or(userID(ctx), claimsFromContext(ctx).subject(), apiKeyID(ctx))
+}
+
+type flagResponse struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Rollout int    `json:"rollout_percent"`
+}
+
+// flagsHandler serves GET /api/flags: every flag, evaluated for the
+// caller.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	subject := featureSubject(r)
+	resp := make([]flagResponse, 0, len(featureFlags))
+	for _, f := range featureFlags {
+		resp = append(resp, flagResponse{Name: f.name, Enabled: featureEnabledFor(f.name, subject), Rollout: f.rollout})
+	}
+	slices.SortFunc(resp, func(a, b flagResponse) int { return strings.Compare(a.Name, b.Name) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{"flags": resp})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// withFlags declares the flags for one test.
+func withFlags(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	loadFeatureFlags()
+	t.Cleanup(func() { featureFlags = map[string]featureFlag{} })
+}
+
+func TestFeatureFlags(t *testing.T) {
+	withFlags(t, map[string]string{
+		"FEATURE_NEW_CHECKOUT": "true",
+		"FEATURE_DARK_MODE":    "off",
+		"FEATURE_SEARCH_V2":    "30%",
+		"FEATURE_TYPO":         "maybe",
+	})
+	for name, want := range map[string]bool{"new_checkout": true, "NEW_CHECKOUT": true, "dark_mode": false, "typo": false, "undeclared": false} {
+		if got := featureEnabledFor(name, "user-1"); got != want {
+			t.Errorf("featureEnabledFor(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if featureEnabledFor("search_v2", "") {
+		t.Error("a partial rollout is on for an anonymous caller")
+	}
+
+	on := 0
+	for i := range 1000 {
+		subject := fmt.Sprintf("user-%d", i)
+		enabled := featureEnabledFor("search_v2", subject)
+		if enabled != featureEnabledFor("search_v2", subject) {
+			t.Fatalf("search_v2 flips between calls for %s", subject)
+		}
+		if enabled {
+			on++
+		}
+	}
+	if on < 250 || on > 350 {
+		t.Errorf("search_v2 at 30%% is on for %d of 1000 users", on)
+	}
+}
+
+func TestFeatureFlagsRolloutGrows(t *testing.T) {
+	withFlags(t, map[string]string{"FEATURE_SEARCH_V2": "10%"})
+	var before []string
+	for i := range 200 {
+		if s := fmt.Sprintf("user-%d", i); featureEnabledFor("search_v2", s) {
+			before = append(before, s)
+		}
+	}
+	withFlags(t, map[string]string{"FEATURE_SEARCH_V2": "50%"})
+	for _, s := range before {
+		if !featureEnabledFor("search_v2", s) {
+			t.Fatalf("raising the rollout to 50%% turned search_v2 off for %s", s)
+		}
+	}
+}
+
+func TestFlagsEndpoint(t *testing.T) {
+	withFlags(t, map[string]string{"FEATURE_NEW_CHECKOUT": "yes", "FEATURE_SEARCH_V2": "0%"})
+	w := do(http.HandlerFunc(flagsHandler), "GET", "/api/flags", nil)
+	var resp struct {
+		Flags []flagResponse `json:"flags"`
+	}
+	decode(t, w, &resp)
+	want := []flagResponse{{Name: "new_checkout", Enabled: true, Rollout: 100}, {Name: "search_v2", Rollout: 0}}
+	if w.Code != http.StatusOK || fmt.Sprint(resp.Flags) != fmt.Sprint(want) {
+		t.Fatalf("GET /api/flags = %d %+v, want %+v", w.Code, resp.Flags, want)
+	}
+}
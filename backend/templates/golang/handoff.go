@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Zero-downtime restarts outside Kubernetes. On a VM under systemd,
+// restarting the app closes its port until the new process listens, and
+// connections meanwhile are refused. Two ways close the gap.
+//
+// Socket activation: systemd opens the port from a socket unit, keeps it
+// open across restarts and hands it to each process it starts, by the
+// LISTEN_FDS protocol. Connections arriving between the old process
+// draining and the new one accepting wait in the socket's backlog:
+//
+//	# /etc/systemd/system/app.socket
+//	[Socket]
+//	ListenStream=8080
+//	# ListenStream=9090 for ADMIN_PORT, as a second socket
+//
+//	# /etc/systemd/system/app.service
+//	[Service]
+//	ExecStart=/usr/local/bin/app
+//	TimeoutStopSec=40s  # above SHUTDOWN_DELAY + SHUTDOWN_TIMEOUT
+//
+// The first socket passed serves the app, in place of PORT, BIND_ADDR and
+// LISTEN_SOCKET; a second serves ADMIN_PORT, which must still be set to
+// enable the admin server. Sockets passed to another process, by a
+// LISTEN_PID that is not the app's, are left alone.
+//
+// Overlapping instances: HTTP_REUSE_PORT=true binds PORT and ADMIN_PORT
+// with SO_REUSEPORT, so a second instance can listen on the same port
+// while the first still serves. Start the new one, wait for its
+// READINESS_PATH to answer 200, then SIGTERM the old one, which drains
+// within SHUTDOWN_TIMEOUT. The kernel spreads new connections across every
+// instance's socket, so both must serve the same version of the app until
+// the switch; Linux lets only processes of the same user share the port,
+// and resets the connections still queued on one socket when it closes,
+// so a few arriving at that instant can fail where socket activation
+// queues them. It needs Linux, macOS or a BSD (reuseport_linux.go,
+// reuseport_unix.go).
+
+// sdListenFDsStart is the first file descriptor socket activation passes.
+const sdListenFDsStart = 3
+
+// inheritedListeners returns the sockets passed to the app, read once:
+// their file descriptors are the process's, and handing them out twice
+// would serve two servers from one socket.
+var inheritedListeners = sync.OnceValues(func() ([]net.Listener, error) {
+	return listenersFromEnv(os.Getpid(), sdListenFDsStart)
+})
+
+// listenersFromEnv returns the LISTEN_FDS sockets starting at firstFD
+// when LISTEN_PID is pid, and clears the variables so the processes the
+// app starts, such as cmd: health checks, do not take them for theirs.
+func listenersFromEnv(pid, firstFD int) ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS %q: want the number of sockets passed", fds)
+	}
+	listeners := make([]net.Listener, 0, n)
+	for fd := firstFD; fd < firstFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FDS socket "+strconv.Itoa(fd))
+		// FileListener takes a close-on-exec copy; the original closes.
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("inherited socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// inheritedListener returns the i-th socket passed to the app, or nil
+// when fewer were passed.
+func inheritedListener(i int) (net.Listener, error) {
+	listeners, err := inheritedListeners()
+	if err != nil || i >= len(listeners) {
+		return nil, err
+	}
+	return listeners[i], nil
+}
+
+// listenControl returns the net.ListenConfig Control hook for
+// HTTP_REUSE_PORT, or nil without it.
+func listenControl() func(network, address string, c syscall.RawConn) error {
+	if !confBool("HTTP_REUSE_PORT") {
+		return nil
+	}
+	return reusePortControl
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health endpoints:
+//
+//	/healthz  liveness: the process is up and serving. Runs only the checks
+//	          registered in livenessChecks (none by default), never the
+//	          dependencies, so a slow database cannot get the pod killed.
+//	/readyz   readiness: startup has completed (see startup.go) and every
+//	          check in readinessChecks passes. Kubernetes stops routing
+//	          traffic while it returns 503.
+//
+// Dependencies declared in DEPENDENCIES become readiness checks, so
+// operators can add checks to a rendered app without changing its code.
+// It takes comma-separated targets, each optionally named, for example
+//
+//	DEPENDENCIES=db=postgres://postgres:5432,redis://redis:6379,auth=http://auth:8080/healthz,cmd:/checks/disk-free
+//
+// An unnamed target is named after its host, or its command's file name
+// ("redis" and "disk-free" above); names must be unique, and are what
+// /readyz, HEALTH_CHECK_TIMEOUTS and STARTUP_WAIT_FOR call the checks.
+// See checks.go for the supported targets. Code can register further
+// checks on either list before the server starts.
+//
+//	LIVENESS_PATH             path of /healthz (default [% LIVENESS_PATH %])
+//	READINESS_PATH            path of /readyz (default [% READINESS_PATH %])
+//	STARTUP_PATH              path of /startupz (default [% STARTUP_PATH %])
+//	HEALTH_CHECK_TIMEOUT      per-check timeout (default 2s), kept below
+//	                          the kubelet's probe timeout
+//	HEALTH_CHECK_TIMEOUTS     per-check overrides, e.g. "db=500ms,auth=1s"
+//	HEALTH_CHECK_CONCURRENCY  checks run at once per probe (default 4)
+//	HEALTH_CACHE_TTL          reuse each check's result for this long
+//	                          (default off)
+//	HEALTH_DETAIL             "true" adds every check's status, latency and
+//	                          most recent error to the JSON responses. Error
+//	                          text can name internal hosts, so leave it off
+//	                          where the endpoints are publicly reachable,
+//	                          or require the admin credentials for it
+//	                          (admin.go).
+//
+// With HEALTH_CACHE_TTL set, a check's result, passing or failing, is
+// reused by every probe within the TTL, and probes arriving while the
+// check runs wait for it rather than starting their own. The kubelet, the
+// ingress and external uptime monitors then cost one database ping per
+// TTL between them, however often they probe, and a struggling dependency
+// is not hit harder by the probes meant to detect it. A cached check runs
+// detached from the probe that started it, within its timeout, so a
+// prober hanging up early cannot cache a cancellation for the others. A
+// recovered dependency is seen up to a TTL late: keep it near the
+// kubelet's periodSeconds (10s by default).
+
+type HealthResponse struct {
+	Status      string            `json:"status"`
+	Environment string            `json:"environment"`
+	Failing     map[string]string `json:"failing,omitempty"`
+	Checks      []CheckDetail     `json:"checks,omitempty"`
+	Timestamp   string            `json:"timestamp"`
+}
+
+type ReadinessResponse struct {
+	Status         string            `json:"status"`
+	Reason         string            `json:"reason,omitempty"`
+	DrainRemaining string            `json:"drain_remaining,omitempty"`
+	Failing        map[string]string `json:"failing,omitempty"`
+	Checks         []CheckDetail     `json:"checks,omitempty"`
+	Timestamp      string            `json:"timestamp"`
+}
+
+// CheckDetail is one check's entry in a HEALTH_DETAIL response. LastError
+// survives recovery, so a flapping dependency is visible even while it
+// happens to be passing.
+type CheckDetail struct {
+	Name        string  `json:"name"`
+	Status      string  `json:"status"`
+	LatencyMS   float64 `json:"latency_ms"`
+	Cached      bool    `json:"cached,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	LastError   string  `json:"last_error,omitempty"`
+	LastErrorAt string  `json:"last_error_at,omitempty"`
+}
+
+// healthCheck is a registered, named checker and its most recent failure.
+type healthCheck struct {
+	name    string
+	checker checker
+	timeout time.Duration
+
+	mu          sync.Mutex
+	lastErr     string
+	lastErrTime time.Time
+
+	// With HEALTH_CACHE_TTL: the latest result, and while the check runs,
+	// a channel closed when it is done.
+	cached   checkResult
+	cachedAt time.Time
+	inflight chan struct{}
+}
+
+// checkResult is the outcome of one check.
+type checkResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+	Cached   bool
+}
+
+// healthChecks is a list of checks run together by a probe.
+type healthChecks struct {
+	checks []*healthCheck
+}
+
+var livenessChecks, readinessChecks healthChecks
+
+// register adds a check. A zero timeout uses HEALTH_CHECK_TIMEOUT.
+func (h *healthChecks) register(name string, c checker, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = confDuration("HEALTH_CHECK_TIMEOUT")
+	}
+	h.checks = append(h.checks, &healthCheck{name: name, checker: c, timeout: timeout})
+}
+
+// run executes every check on a pool of HEALTH_CHECK_CONCURRENCY workers,
+// so a long dependency list cannot open a burst of connections, or start
+// a goroutine per check, on every probe. Results are in registration
+// order.
+func (h *healthChecks) run(ctx context.Context) []checkResult {
+	results := make([]checkResult, len(h.checks))
+	ttl := confDuration("HEALTH_CACHE_TTL")
+	forEachPooled(len(h.checks), confInt("HEALTH_CHECK_CONCURRENCY"), func(i int) {
+		if ttl > 0 {
+			results[i] = h.checks[i].cachedCheck(ctx, ttl)
+		} else {
+			results[i] = h.checks[i].check(ctx)
+		}
+	})
+	return results
+}
+
+// check runs the checker within the check's timeout.
+func (c *healthCheck) check(ctx context.Context) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	err := c.checker.Check(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.lastErr, c.lastErrTime = err.Error(), start
+		c.mu.Unlock()
+	}
+	return checkResult{Name: c.name, Err: err, Duration: time.Since(start)}
+}
+
+// cachedCheck returns the result of a check run less than ttl ago, waits
+// for the one in flight, or runs the check itself.
+func (c *healthCheck) cachedCheck(ctx context.Context, ttl time.Duration) checkResult {
+	c.mu.Lock()
+	for {
+		if !c.cachedAt.IsZero() && time.Since(c.cachedAt) < ttl {
+			r := c.cached
+			c.mu.Unlock()
+			r.Cached = true
+			return r
+		}
+		wait := c.inflight
+		if wait == nil {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return checkResult{Name: c.name, Err: ctx.Err()}
+		}
+		c.mu.Lock()
+	}
+	done := make(chan struct{})
+	c.inflight = done
+	c.mu.Unlock()
+
+	r := c.check(context.WithoutCancel(ctx))
+	c.mu.Lock()
+	c.cached, c.cachedAt, c.inflight = r, time.Now(), nil
+	c.mu.Unlock()
+	close(done)
+	return r
+}
+
+// failing returns the error of each failed check, keyed by name.
+func failing(results []checkResult) map[string]string {
+	out := map[string]string{}
+	for _, r := range results {
+		if r.Err != nil {
+			out[r.Name] = r.Err.Error()
+		}
+	}
+	return out
+}
+
+// details describes each check for a HEALTH_DETAIL response, or returns
+// nil when detail is off or req lacks the admin credentials it needs
+// (admin.go).
+func (h *healthChecks) details(req *http.Request, results []checkResult) []CheckDetail {
+	if !confBool("HEALTH_DETAIL") || adminProtected("health") && !adminAuthorized(req) {
+		return nil
+	}
+	out := make([]CheckDetail, len(results))
+	for i, r := range results {
+		d := CheckDetail{
+			Name:      r.Name,
+			Status:    "ok",
+			LatencyMS: float64(r.Duration.Microseconds()) / 1000,
+		}
+		if r.Err != nil {
+			d.Status, d.Error = "failing", r.Err.Error()
+		}
+		d.Cached = r.Cached
+		c := h.checks[i]
+		c.mu.Lock()
+		if c.lastErr != "" {
+			d.LastError, d.LastErrorAt = c.lastErr, c.lastErrTime.Format(time.RFC3339)
+		}
+		c.mu.Unlock()
+		out[i] = d
+	}
+	return out
+}
+
+// registerDependencies parses DEPENDENCIES and HEALTH_CHECK_TIMEOUTS and
+// registers a readiness check per dependency.
+func registerDependencies() error {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range confList("HEALTH_CHECK_TIMEOUTS") {
+		name, raw, _ := strings.Cut(entry, "=")
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("HEALTH_CHECK_TIMEOUTS %q: want name=duration", entry)
+		}
+		timeouts[strings.TrimSpace(name)] = d
+	}
+
+	names := map[string]bool{}
+	for _, entry := range confList("DEPENDENCIES") {
+		name, target := splitDependency(entry)
+		if target == "" {
+			return fmt.Errorf("dependency %q: want [name=]target", entry)
+		}
+		c, shown, err := checkerFor(target)
+		if err != nil {
+			return fmt.Errorf("dependency %q: %w", cmp.Or(name, target), err)
+		}
+		if name == "" {
+			name = dependencyName(target)
+		}
+		if names[name] {
+			return fmt.Errorf("dependency %q: name used twice; name the entries, as name=target", name)
+		}
+		names[name] = true
+		readinessChecks.register(name, c, timeouts[name])
+		slog.Info("readiness dependency registered", "name", name, "target", shown)
+	}
+	return nil
+}
+
+// splitDependency splits a DEPENDENCIES entry into its name, "" when it
+// has none, and target. A name has no ":" or "/", which tells it from an
+// unnamed URL with "=" in its query.
+func splitDependency(entry string) (name, target string) {
+	name, target, ok := strings.Cut(entry, "=")
+	if !ok || strings.ContainsAny(name, ":/") {
+		return "", entry
+	}
+	return name, target
+}
+
+// dependencyName names an unnamed target: a URL after its host, a command
+// after its file name.
+func dependencyName(target string) string {
+	if command, ok := strings.CutPrefix(target, "cmd:"); ok {
+		return filepath.Base(strings.Fields(command)[0])
+	}
+	u, _ := url.Parse(target)
+	return u.Hostname()
+}
+
+// prefersPlainText reports whether the client asked for text/plain without
+// also accepting JSON. Simple uptime checkers send "Accept: text/plain" and
+// only look for a 200 with a short body; everyone else gets JSON.
+func prefersPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") &&
+		!strings.Contains(accept, "application/json")
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	results := livenessChecks.run(r.Context())
+	failed := failing(results)
+
+	status, code := "healthy", http.StatusOK
+	if len(failed) > 0 {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+		requestLogger(r).Error("liveness check failed", "failing", failed)
+	}
+
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(HealthResponse{
+		Status:      status,
+		Environment: environment,
+		Failing:     failed,
+		Checks:      livenessChecks.details(r, results),
+		Timestamp:   time.Now().Format(time.RFC3339),
+	})
+}
+
+// healthcheckTimeout bounds the container health check's request, inside
+// the Dockerfile's HEALTHCHECK --timeout.
+const healthcheckTimeout = 2 * time.Second
+
+// runHealthcheck is "app healthcheck", the Dockerfile's HEALTHCHECK: the
+// distroless image has no shell, curl or wget, so the binary asks the
+// running server's liveness probe itself, on ADMIN_PORT or over
+// LISTEN_SOCKET when set, and exits 0 when it answers 200. With
+// TLS_CERT_FILE set it speaks HTTPS to the app port without verifying
+// the certificate, which names the public host rather than localhost.
+func runHealthcheck() int {
+	scheme, transport := "http", &http.Transport{}
+	if conf("TLS_CERT_FILE") != "" {
+		scheme = "https"
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{Transport: transport, Timeout: healthcheckTimeout}
+	u := url.URL{Scheme: scheme, Host: selfAddr(conf("PORT")), Path: conf("LIVENESS_PATH")}
+	if port := conf("ADMIN_PORT"); port != "" {
+		u.Scheme, u.Host = "http", net.JoinHostPort("127.0.0.1", port)
+	} else if path := conf("LISTEN_SOCKET"); path != "" {
+		u.Host = "localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "healthcheck:", err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "healthcheck:", resp.Status)
+		return 1
+	}
+	return 0
+}
+
+// shutdownState is set by main once SIGTERM arrives: first the
+// SHUTDOWN_DELAY drain window, then the shutdown proper. requested is a
+// drain started with POST /drain (drain.go), ahead of any SIGTERM.
+var shutdownState struct {
+	mu         sync.Mutex
+	draining   bool
+	drainUntil time.Time
+	requested  bool
+}
+
+// beginDrain marks the app as leaving; readiness fails from now on.
+func beginDrain(delay time.Duration) {
+	shutdownState.mu.Lock()
+	defer shutdownState.mu.Unlock()
+	shutdownState.draining = true
+	shutdownState.drainUntil = time.Now().Add(delay)
+}
+
+// requestDrain starts or cancels a drain requested through POST /drain.
+// It returns false when asked to cancel once SIGTERM has begun the drain.
+func requestDrain(draining bool) bool {
+	shutdownState.mu.Lock()
+	defer shutdownState.mu.Unlock()
+	if !draining && shutdownState.draining {
+		return false
+	}
+	shutdownState.requested = draining
+	return true
+}
+
+// shuttingDown returns why readiness must fail because of shutdown, and how
+// much of the drain delay is left, or "" while the app is serving normally.
+func shuttingDown() (reason string, remaining time.Duration) {
+	shutdownState.mu.Lock()
+	defer shutdownState.mu.Unlock()
+	if !shutdownState.draining {
+		if shutdownState.requested {
+			return "drain requested", 0
+		}
+		return "", 0
+	}
+	if remaining = time.Until(shutdownState.drainUntil); remaining > 0 {
+		return "pre-shutdown drain", remaining
+	}
+	return "shutting down", 0
+}
+
+// readinessHandler returns 200 while every readiness check passes and 503
+// listing the failing ones otherwise. Once shutdown begins it fails without
+// running the checks.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{Status: "ready", Timestamp: time.Now().Format(time.RFC3339)}
+	code := http.StatusOK
+
+	if reason, remaining := shuttingDown(); reason != "" {
+		resp.Status, resp.Reason, code = "not ready", reason, http.StatusServiceUnavailable
+		if remaining > 0 {
+			resp.DrainRemaining = remaining.Round(time.Millisecond).String()
+		}
+	} else {
+		results := readinessChecks.run(r.Context())
+		resp.Failing = failing(results)
+		resp.Checks = readinessChecks.details(r, results)
+		if !started() {
+			resp.Status, code = "starting", http.StatusServiceUnavailable
+		} else if len(resp.Failing) > 0 {
+			resp.Status, code = "not ready", http.StatusServiceUnavailable
+			requestLogger(r).Warn("readiness check failed", "failing", resp.Failing)
+		}
+	}
+
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, resp.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
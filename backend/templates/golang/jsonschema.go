@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// JSON Schema validation of request bodies. Declare the contract of a
+// route's body as apiDoc.Schema and handleAPI checks every request against
+// it before the handler runs:
+//
+//	handleAPI(mux, "POST /widgets", apiDoc{
+//		Request: widgetInput{},
+//		Schema: `{
+//			"type": "object",
+//			"properties": {"name": {"type": "string", "minLength": 1}},
+//			"required": ["name"],
+//			"additionalProperties": false
+//		}`,
+//	}, createWidget)
+//
+// A body that does not match is answered 400 with every violation found,
+// up to maxSchemaViolations, each with the JSON Pointer to the offending
+// value, in the error envelope (errors.go):
+//
+//	{"code": "bad_request", "message": "request body does not match the schema", ...,
+//	 "violations": [{"path": "/name", "message": "must be a string"}]}
+//
+// The handler then reads the body with readJSON as usual. The schema also
+// replaces the one derived from Request in the OpenAPI document.
+//
+// A subset of JSON Schema 2020-12 is supported: type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// uniqueItems, minLength, maxLength, pattern, format (date, date-time,
+// email, uri, uuid), minimum, maximum, exclusiveMinimum, exclusiveMaximum
+// and multipleOf, plus annotations such as title and description. Any
+// other keyword, $ref included, makes handleAPI panic at startup, so a
+// contract is never silently ignored.
+
+const maxSchemaViolations = 20
+
+// jsonSchema is a compiled schema. Nil fields and zero flags leave their
+// keyword out.
+type jsonSchema struct {
+	types      []string
+	enum       []any
+	hasConst   bool
+	constValue any
+
+	properties   map[string]*jsonSchema
+	required     []string
+	additional   *jsonSchema
+	noAdditional bool
+
+	items                *jsonSchema
+	minItems, maxItems   *int
+	uniqueItems          bool
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	format               string
+
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf *float64
+}
+
+// schemaViolation is one way a body breaks its schema.
+type schemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+var schemaAnnotations = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples", "deprecated", "readOnly", "writeOnly"}
+
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+var schemaFormats = map[string]struct {
+	name  string
+	valid func(string) bool
+}{
+	"date": {"a date (YYYY-MM-DD)", func(s string) bool {
+		_, err := time.Parse(time.DateOnly, s)
+		return err == nil
+	}},
+	"date-time": {"an RFC 3339 date-time", func(s string) bool {
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	}},
+	"email": {"an email address", func(s string) bool {
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s
+	}},
+	"uri": {"an absolute URI", func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	}},
+	"uuid": {"a UUID", uuidPattern.MatchString},
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// compileSchema parses a schema, rejecting keywords it does not support.
+func compileSchema(src []byte) (*jsonSchema, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(src, &raw); err != nil {
+		return nil, fmt.Errorf("schema is not a JSON object: %w", err)
+	}
+	s := &jsonSchema{}
+	for _, key := range slices.Sorted(maps.Keys(raw)) {
+		if err := s.compileKeyword(key, raw[key]); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *jsonSchema) compileKeyword(key string, v json.RawMessage) error {
+	var err error
+	switch key {
+	case "type":
+		var one string
+		if json.Unmarshal(v, &one) == nil {
+			s.types = []string{one}
+		} else if err = json.Unmarshal(v, &s.types); err != nil {
+			return err
+		}
+		for _, t := range s.types {
+			if !slices.Contains(schemaTypes, t) {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	case "enum":
+		err = json.Unmarshal(v, &s.enum)
+	case "const":
+		s.hasConst = true
+		err = json.Unmarshal(v, &s.constValue)
+	case "properties":
+		var props map[string]json.RawMessage
+		if err = json.Unmarshal(v, &props); err != nil {
+			return err
+		}
+		s.properties = map[string]*jsonSchema{}
+		for name, sub := range props {
+			if s.properties[name], err = compileSchema(sub); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	case "required":
+		err = json.Unmarshal(v, &s.required)
+	case "additionalProperties":
+		var allowed bool
+		if json.Unmarshal(v, &allowed) == nil {
+			s.noAdditional = !allowed
+		} else {
+			s.additional, err = compileSchema(v)
+		}
+	case "items":
+		s.items, err = compileSchema(v)
+	case "uniqueItems":
+		err = json.Unmarshal(v, &s.uniqueItems)
+	case "minItems":
+		s.minItems, err = schemaCount(v)
+	case "maxItems":
+		s.maxItems, err = schemaCount(v)
+	case "minLength":
+		s.minLength, err = schemaCount(v)
+	case "maxLength":
+		s.maxLength, err = schemaCount(v)
+	case "pattern":
+		var expr string
+		if err = json.Unmarshal(v, &expr); err == nil {
+			s.pattern, err = regexp.Compile(expr)
+		}
+	case "format":
+		if err = json.Unmarshal(v, &s.format); err == nil {
+			if _, ok := schemaFormats[s.format]; !ok {
+				err = fmt.Errorf("unsupported format %q", s.format)
+			}
+		}
+	case "minimum":
+		s.minimum, err = schemaNumber(v)
+	case "maximum":
+		s.maximum, err = schemaNumber(v)
+	case "exclusiveMinimum":
+		s.exclusiveMinimum, err = schemaNumber(v)
+	case "exclusiveMaximum":
+		s.exclusiveMaximum, err = schemaNumber(v)
+	case "multipleOf":
+		if s.multipleOf, err = schemaNumber(v); err == nil && *s.multipleOf <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	default:
+		if !slices.Contains(schemaAnnotations, key) {
+			return fmt.Errorf("unsupported keyword")
+		}
+	}
+	return err
+}
+
+func schemaCount(v json.RawMessage) (*int, error) {
+	var n int
+	if err := json.Unmarshal(v, &n); err != nil || n < 0 {
+		return nil, fmt.Errorf("want a non-negative integer")
+	}
+	return &n, nil
+}
+
+func schemaNumber(v json.RawMessage) (*float64, error) {
+	var n float64
+	if err := json.Unmarshal(v, &n); err != nil {
+		return nil, fmt.Errorf("want a number")
+	}
+	return &n, nil
+}
+
+// validate returns the violations of v, as decoded by encoding/json into
+// an any, at most maxSchemaViolations of them.
+func (s *jsonSchema) validate(v any) []schemaViolation {
+	var out []schemaViolation
+	s.check(v, "", &out)
+	return out
+}
+
+func (s *jsonSchema) check(v any, path string, out *[]schemaViolation) {
+	report := func(format string, args ...any) {
+		*out = appendViolation(*out, path, fmt.Sprintf(format, args...))
+	}
+
+	if len(s.types) > 0 && !slices.ContainsFunc(s.types, func(t string) bool { return schemaTypeMatches(t, v) }) {
+		report("must be %s", schemaTypeNames(s.types))
+		return
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(e any) bool { return jsonEqual(e, v) }) {
+		report("must be one of %s", jsonList(s.enum))
+	}
+	if s.hasConst && !jsonEqual(s.constValue, v) {
+		report("must be %s", jsonList([]any{s.constValue}))
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				*out = appendViolation(*out, path+"/"+jsonPointerToken(name), "is required")
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			sub, ok := s.properties[name]
+			switch {
+			case ok:
+			case s.noAdditional:
+				*out = appendViolation(*out, path+"/"+jsonPointerToken(name), "is not allowed")
+				continue
+			case s.additional != nil:
+				sub = s.additional
+			default:
+				continue
+			}
+			sub.check(v[name], path+"/"+jsonPointerToken(name), out)
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			report("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			report("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range v {
+				if slices.ContainsFunc(v[:i], func(e any) bool { return jsonEqual(e, v[i]) }) {
+					report("must not repeat items, as item %d does", i)
+					break
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				s.items.check(item, path+"/"+strconv.Itoa(i), out)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			report("must be at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			report("must be at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			report("must match the pattern %s", s.pattern)
+		}
+		if f, ok := schemaFormats[s.format]; ok && !f.valid(v) {
+			report("must be %s", f.name)
+		}
+	case float64:
+		bound := func(limit *float64, ok func(float64) bool, format string) {
+			if limit != nil && !ok(*limit) {
+				report(format, strconv.FormatFloat(*limit, 'g', -1, 64))
+			}
+		}
+		bound(s.minimum, func(l float64) bool { return v >= l }, "must be at least %s")
+		bound(s.maximum, func(l float64) bool { return v <= l }, "must be at most %s")
+		bound(s.exclusiveMinimum, func(l float64) bool { return v > l }, "must be greater than %s")
+		bound(s.exclusiveMaximum, func(l float64) bool { return v < l }, "must be less than %s")
+		bound(s.multipleOf, func(l float64) bool {
+			q := v / l
+			return math.Abs(q-math.Round(q)) < 1e-9
+		}, "must be a multiple of %s")
+	}
+}
+
+func appendViolation(out []schemaViolation, path, message string) []schemaViolation {
+	if len(out) < maxSchemaViolations {
+		out = append(out, schemaViolation{Path: path, Message: message})
+	}
+	return out
+}
+
+func schemaTypeMatches(t string, v any) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		return t == "object"
+	case []any:
+		return t == "array"
+	case string:
+		return t == "string"
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	case float64:
+		return t == "number" || t == "integer" && v == math.Trunc(v)
+	}
+	return false
+}
+
+// schemaTypeNames reads types as a phrase: "a string", "a string or null".
+func schemaTypeNames(types []string) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		switch t {
+		case "null":
+			names[i] = "null"
+		case "object", "array", "integer":
+			names[i] = "an " + t
+		default:
+			names[i] = "a " + t
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+func jsonEqual(a, b any) bool {
+	// encoding/json writes object keys sorted, so equal values encode the
+	// same.
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+func jsonList(values []any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		data, _ := json.Marshal(v)
+		parts[i] = string(data)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// jsonPointerToken escapes a property name for a JSON Pointer (RFC 6901).
+func jsonPointerToken(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// validateBody checks the request body against s before h runs. h gets
+// the body unread, so it decodes it with readJSON as usual.
+func (s *jsonSchema) validateBody(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody()))
+		if err != nil {
+			writeRequestError(w, r, decodeError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var v any
+		if err := readJSON(w, r, &v); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		if violations := s.validate(v); len(violations) > 0 {
+			writeErrorResponse(w, http.StatusBadRequest, struct {
+				errorResponse
+				Violations []schemaViolation `json:"violations"`
+			}{newErrorResponse(r, http.StatusBadRequest, "request body does not match the schema"), violations})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testWidgetSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 10},
+		"email": {"type": "string", "format": "email"},
+		"size": {"enum": ["small", "large"]},
+		"count": {"type": "integer", "minimum": 1},
+		"tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}, "uniqueItems": true},
+		"labels": {"type": "object", "additionalProperties": {"type": ["string", "null"]}}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`
+
+func TestSchemaViolations(t *testing.T) {
+	schema, err := compileSchema([]byte(testWidgetSchema))
+	if err != nil {
+		t.Fatalf("compileSchema: %v", err)
+	}
+	for _, tc := range []struct {
+		body string
+		want []schemaViolation
+	}{
+		{`{"name": "w", "email": "a@example.com", "size": "small", "count": 2, "tags": ["a", "b"], "labels": {"x": null}}`, nil},
+		{`[]`, []schemaViolation{{"", "must be an object"}}},
+		{`{}`, []schemaViolation{{"/name", "is required"}}},
+		{`{"name": "far too long", "colour": "red"}`, []schemaViolation{
+			{"/colour", "is not allowed"},
+			{"/name", "must be at most 10 characters"},
+		}},
+		{`{"name": "w", "email": "not an address", "size": "huge", "count": 1.5}`, []schemaViolation{
+			{"/count", "must be an integer"},
+			{"/email", "must be an email address"},
+			{"/size", `must be one of "small", "large"`},
+		}},
+		{`{"name": "w", "count": 0, "tags": ["a", "B", "a"], "labels": {"a/b": 1}}`, []schemaViolation{
+			{"/count", "must be at least 1"},
+			{"/labels/a~1b", "must be a string or null"},
+			{"/tags", "must not repeat items, as item 2 does"},
+			{"/tags/1", "must match the pattern ^[a-z]+$"},
+		}},
+	} {
+		var v any
+		if err := json.Unmarshal([]byte(tc.body), &v); err != nil {
+			t.Fatalf("decoding %s: %v", tc.body, err)
+		}
+		if got := schema.validate(v); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: violations %v, want %v", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestSchemaRejected(t *testing.T) {
+	for _, src := range []string{
+		`[]`,
+		`{"$ref": "#/$defs/widget"}`,
+		`{"type": "text"}`,
+		`{"format": "phone"}`,
+		`{"properties": {"name": {"minLength": -1}}}`,
+		`{"pattern": "("}`,
+	} {
+		if _, err := compileSchema([]byte(src)); err == nil {
+			t.Errorf("compileSchema(%s) accepted it", src)
+		}
+	}
+}
+
+func TestHandleAPIValidatesBody(t *testing.T) {
+	saved := apiOperations
+	t.Cleanup(func() { apiOperations = saved })
+
+	mux := http.NewServeMux()
+	handleAPI(mux, "POST /widgets", apiDoc{Request: testWidgetInput{}, Schema: testWidgetSchema, Status: http.StatusCreated}, func(w http.ResponseWriter, r *http.Request) {
+		var in testWidgetInput
+		if err := readJSON(w, r, &in); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, in)
+	})
+
+	w := do(mux, "POST", "/widgets", strings.NewReader(`{"name": ""}`))
+	var resp struct {
+		Error      string            `json:"error"`
+		Violations []schemaViolation `json:"violations"`
+	}
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || len(resp.Violations) != 1 || resp.Violations[0].Path != "/name" {
+		t.Errorf("POST /widgets with an empty name = %d %+v, want a 400 listing the violation", w.Code, resp)
+	}
+
+	if w := do(mux, "POST", "/widgets", strings.NewReader(`{"name": "w"`)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unexpected end") {
+		t.Errorf("POST /widgets with malformed JSON = %d %s, want readJSON's 400", w.Code, w.Body)
+	}
+
+	// The handler reads the body the schema was checked against.
+	w = do(mux, "POST", "/widgets", strings.NewReader(`{"name": "w"}`))
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusCreated || !strings.Contains(string(body), `"name":"w"`) {
+		t.Errorf("POST /widgets = %d %s, want 201 with the widget", w.Code, body)
+	}
+
+	// The OpenAPI document describes the body with the declared schema.
+	registerOpenAPI(mux)
+	if doc := do(mux, "GET", "/openapi.json", nil).Body.String(); !strings.Contains(doc, `"maxLength":10`) {
+		t.Errorf("/openapi.json does not document the declared schema:\n%s", doc)
+	}
+}
+
+func TestHandleAPIInvalidSchema(t *testing.T) {
+	saved := apiOperations
+	t.Cleanup(func() { apiOperations = saved })
+	defer func() {
+		if recover() == nil {
+			t.Error("handleAPI accepted a schema with an unsupported keyword")
+		}
+	}()
+	handleAPI(http.NewServeMux(), "POST /widgets", apiDoc{Schema: `{"oneOf": []}`}, createTestWidget)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The landing page is web/index.html, embedded into the binary and
+// rendered with html/template, so values are escaped for their context
+// (text, attribute, URL, CSS): a branding value cannot break out of the
+// page even if it slips past the manifest's patterns. Its text is
+// translated (locale.go). If the embedded template cannot be parsed or
+// rendered the handler serves fallbackPage instead, so / always answers.
+//
+// The stylesheet and script, web/landing.css and web/landing.js, are
+// served from memory under /_landing/, named by their content hash and
+// cached by browsers for good; a new build links new names. The page
+// itself is rendered once per language, theme and badge configuration
+// and then served from memory with an ETag and no-cache, so revisits
+// cost a 304.
+//
+// The page is also a small status page: a script polls the readiness
+// probe every 10 seconds and shows whether the app is ready, with a card
+// per dependency (DEPENDENCIES, and any check the app registers). With
+// HEALTH_DETAIL on each card has the check's latency; without it the
+// page only names the failing checks. Error text is never shown. Every
+// open page runs the readiness checks, so set HEALTH_CACHE_TTL where
+// many people keep it open. With ADMIN_PORT set the probe is not on the
+// public port and the section is left out.
+//
+//	THEME               look of the page: gradient, minimal, dark,
+//	                    corporate or playful
+//	LOCALE              language of the page, e.g. es; unset, the
+//	                    browser's Accept-Language picks it
+//	ENVIRONMENT_BADGES  environment badge colors and labels, as
+//	                    comma-separated name=#rrggbb or
+//	                    name=#rrggbb:label entries, for example
+//	                    "qa=#805ad5:QA,sandbox=#e53e3e"
+//	LANDING_STATUS      "false" leaves the live status section out
+//	                    (default true)
+//
+// An environment ENVIRONMENT_BADGES does not list gets the color of
+// defaultBadgeColors, or gray, and its translated name as label.
+//
+// API clients get JSON instead of the page: a request whose Accept ranks
+// application/json above text/html is answered with a RootResponse.
+// Browsers list text/html first, and a request with no Accept or only
+// */*, as curl sends by default, gets the page.
+
+// customerName is the display name the app was generated for.
+const customerName = "[% CUSTOMER_NAME | go %]"
+
+// landingBrand white-labels the landing page for the customer. Empty
+// fields are left out of the page.
+type landingBrand struct {
+	LogoURL        string
+	FaviconURL     string
+	PrimaryColor   string
+	SecondaryColor string
+	Tagline        string
+}
+
+// landingThemes are the looks web/index.html can take, each a theme-<name>
+// class on <body>. THEME picks one at runtime; its default is the theme
+// the app was generated with.
+var landingThemes = []string{"gradient", "minimal", "dark", "corporate", "playful"}
+
+// landingSettings are the landing page's settings. An app that serves the
+// landing page adds them to its appSettings.
+var landingSettings = []setting{
+	{name: "THEME", def: "[% THEME %]", reloadable: true, check: oneOf(landingThemes...)},
+	{name: "LOCALE", reloadable: true, check: isLanguageTag},
+	{name: "ENVIRONMENT_BADGES", kind: kindList, reloadable: true, check: checkBadges},
+	{name: "LANDING_STATUS", kind: kindBool, def: "true", reloadable: true},
+}
+
+// defaultBadgeColors colors the badges of common environment names. An
+// empty color is the brand's primary color.
+var defaultBadgeColors = map[string]string{
+	"dev":         "#48bb78",
+	"development": "#48bb78",
+	"test":        "#38b2ac",
+	"qa":          "#38b2ac",
+	"uat":         "#805ad5",
+	"staging":     "#ed8936",
+	"preprod":     "#ed8936",
+	"prod":        "",
+	"production":  "",
+}
+
+// fallbackBadgeColor colors environments nothing else knows.
+const fallbackBadgeColor = "#718096"
+
+var hexColor = regexp.MustCompile(`^#([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+
+// landingBadge is the environment badge.
+type landingBadge struct {
+	Label string
+	Color string // empty for the brand's primary color
+}
+
+// parseBadge parses an ENVIRONMENT_BADGES entry.
+func parseBadge(entry string) (string, landingBadge, error) {
+	name, rest, ok := strings.Cut(entry, "=")
+	color, label, _ := strings.Cut(rest, ":")
+	name, color, label = strings.TrimSpace(name), strings.TrimSpace(color), strings.TrimSpace(label)
+	if !ok || name == "" || !hexColor.MatchString(color) {
+		return "", landingBadge{}, fmt.Errorf("%q: want name=#rrggbb or name=#rrggbb:label", entry)
+	}
+	return name, landingBadge{Label: label, Color: color}, nil
+}
+
+func checkBadges(v string) error {
+	for _, entry := range strings.Split(v, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		if _, _, err := parseBadge(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// environmentBadge is the badge for env, labelled in text's language.
+func environmentBadge(env string, text landingText) landingBadge {
+	badge := landingBadge{Color: fallbackBadgeColor}
+	if color, ok := defaultBadgeColors[env]; ok {
+		badge.Color = color
+	}
+	for _, entry := range confList("ENVIRONMENT_BADGES") {
+		if name, configured, err := parseBadge(entry); err == nil && name == env {
+			badge = configured
+		}
+	}
+	if badge.Label == "" {
+		badge.Label = text.environmentLabel(env)
+	}
+	return badge
+}
+
+// customerBrand is the branding the app was generated with.
+var customerBrand = landingBrand{
+	LogoURL:        "[% BRAND_LOGO_URL | go %]",
+	FaviconURL:     "[% BRAND_FAVICON_URL | go %]",
+	PrimaryColor:   "[% BRAND_PRIMARY_COLOR | go %]",
+	SecondaryColor: "[% BRAND_SECONDARY_COLOR | go %]",
+	Tagline:        "[% BRAND_TAGLINE | go %]",
+}
+
+//go:embed web/index.html web/locales.json web/landing.css web/landing.js
+var webFS embed.FS
+
+// landingAssetPrefix is where the landing page's assets are served.
+const landingAssetPrefix = "/_landing/"
+
+// landingAssetFiles are the files of web/ the page links to.
+var landingAssetFiles = []string{"landing.css", "landing.js"}
+
+// landingAsset is an embedded file the page links to.
+type landingAsset struct {
+	content     []byte
+	contentType string
+	etag        string
+}
+
+// landingAssets holds the assets by the path they are served on, which
+// carries their content hash; assetPaths maps each file name to it.
+var (
+	landingAssets = map[string]landingAsset{}
+	assetPaths    = map[string]string{}
+)
+
+// landingModTime is the Last-Modified of the assets: the build time when
+// the Dockerfile stamps it, else none.
+var landingModTime time.Time
+
+// loadLandingAssets hashes the embedded assets.
+func loadLandingAssets() error {
+	assets, paths := map[string]landingAsset{}, map[string]string{}
+	for _, name := range landingAssetFiles {
+		content, err := webFS.ReadFile("web/" + name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:8])
+		ext := path.Ext(name)
+		served := landingAssetPrefix + strings.TrimSuffix(name, ext) + "-" + hash + ext
+		assets[served] = landingAsset{content: content, contentType: mime.TypeByExtension(ext), etag: `"` + hash + `"`}
+		paths[name] = served
+	}
+	landingAssets, assetPaths = assets, paths
+	landingModTime, _ = time.Parse(time.RFC3339, version.BuildTime)
+	return nil
+}
+
+// serveLandingAsset serves an asset, or 404 for a path under
+// landingAssetPrefix that is not one, such as an older build's.
+func serveLandingAsset(w http.ResponseWriter, r *http.Request) {
+	asset, ok := landingAssets[r.URL.Path]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", asset.contentType)
+	h.Set("ETag", asset.etag)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	h.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", landingModTime, bytes.NewReader(asset.content))
+}
+
+// landingData is what web/index.html is rendered with.
+type landingData struct {
+	CustomerName string
+	Environment  string
+	Badge        landingBadge
+	Lang         string
+	Text         landingText
+	Theme        string
+	Brand        landingBrand
+	// StatusURL is the readiness probe the status section polls, empty
+	// for no section.
+	StatusURL string
+	Assets    landingAssetPaths
+}
+
+// landingAssetPaths are the paths web/index.html links its assets on.
+type landingAssetPaths struct {
+	Stylesheet string
+	Script     string
+}
+
+// fallbackPage is served when web/index.html is unusable. It is parsed
+// from a constant, so it cannot fail at runtime.
+var fallbackPage = template.Must(template.New("fallback").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="UTF-8"><title>{{.CustomerName}}</title></head>
+<body>
+  <h1>{{.CustomerName}}</h1>
+  <p>{{.Text.Status}} ({{.Badge.Label}})</p>
+</body>
+</html>
+`))
+
+// landingPage is the parsed web/index.html, or fallbackPage.
+var landingPage = fallbackPage
+
+// renderedPage is a rendered landing page and its ETag.
+type renderedPage struct {
+	body []byte
+	etag string
+}
+
+// pageKey is everything a rendered landing page depends on, besides what
+// is fixed once loadLandingPage has run: the reloadable settings are
+// read raw into it, so changing one renders the page afresh.
+type pageKey struct {
+	lang      string
+	theme     string
+	badges    string
+	statusURL string
+}
+
+// maxRenderedPages bounds the page cache. Every language, theme and
+// badge configuration in use takes an entry; past the bound the cache
+// starts over.
+const maxRenderedPages = 64
+
+var (
+	renderedPagesMu sync.Mutex
+	renderedPages   = map[pageKey]renderedPage{}
+)
+
+// loadLandingPage parses the embedded landing page and its translations,
+// and hashes its assets. A failure is logged and leaves fallbackPage in
+// place.
+func loadLandingPage() {
+	loadTranslations()
+	renderedPagesMu.Lock()
+	clear(renderedPages)
+	renderedPagesMu.Unlock()
+	if err := loadLandingAssets(); err != nil {
+		slog.Warn("landing page assets unusable, serving fallback page", "error", err)
+		landingPage = fallbackPage
+		return
+	}
+	tmpl, err := template.ParseFS(webFS, "web/index.html")
+	if err != nil {
+		slog.Warn("landing page template unusable, serving fallback page", "error", err)
+		landingPage = fallbackPage
+		return
+	}
+	landingPage = tmpl
+}
+
+// renderLandingPage renders the page for key, or returns it from the
+// cache. A page that fails to render is the fallback page, not cached.
+func renderLandingPage(r *http.Request, key pageKey) renderedPage {
+	renderedPagesMu.Lock()
+	page, ok := renderedPages[key]
+	renderedPagesMu.Unlock()
+	if ok {
+		return page
+	}
+
+	text := textFor(key.lang)
+	data := landingData{
+		CustomerName: customerName,
+		Environment:  environment,
+		Badge:        environmentBadge(environment, text),
+		Lang:         key.lang,
+		Text:         text,
+		Theme:        key.theme,
+		Brand:        customerBrand,
+		StatusURL:    key.statusURL,
+		Assets: landingAssetPaths{
+			Stylesheet: assetPaths["landing.css"],
+			Script:     assetPaths["landing.js"],
+		},
+	}
+	var buf bytes.Buffer
+	if err := landingPage.Execute(&buf, data); err != nil {
+		requestLogger(r).Error("rendering landing page failed, serving fallback page", "error", err)
+		buf.Reset()
+		fallbackPage.Execute(&buf, data)
+		return renderedPage{body: buf.Bytes()}
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	page = renderedPage{body: buf.Bytes(), etag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+
+	renderedPagesMu.Lock()
+	if len(renderedPages) >= maxRenderedPages {
+		clear(renderedPages)
+	}
+	renderedPages[key] = page
+	renderedPagesMu.Unlock()
+	return page
+}
+
+// RootResponse is the JSON answer on "/" for clients that prefer it:
+// the page's status line, in the page's language, with the environment
+// and the git SHA.
+type RootResponse struct {
+	Message     string `json:"message"`
+	Environment string `json:"environment"`
+	Version     string `json:"version"`
+}
+
+// prefersJSON reports whether r's Accept ranks application/json above
+// text/html, as Express's req.accepts does: by q, then by the type named
+// more specifically, then by the one listed first. "application/json,
+// */*" is JSON; */* alone, or no Accept, goes to the page.
+func prefersJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	page := acceptQuality(accept, "text/html")
+	if xhtml := acceptQuality(accept, "application/xhtml+xml"); xhtml.beats(page) {
+		page = xhtml
+	}
+	data := acceptQuality(accept, "application/json")
+	return data.q > 0 && data.beats(page)
+}
+
+// acceptMatch is how an Accept header ranks a media type: the q of the
+// most specific range matching it, how specific that range is (2 for the
+// type itself, 1 for application/* and the like, 0 for */*), and its
+// position in the header.
+type acceptMatch struct {
+	q           float64
+	specificity int
+	index       int
+}
+
+func (m acceptMatch) beats(other acceptMatch) bool {
+	if m.q != other.q {
+		return m.q > other.q
+	}
+	if m.specificity != other.specificity {
+		return m.specificity > other.specificity
+	}
+	return m.index < other.index
+}
+
+// acceptQuality ranks mediaType by an Accept header; q is 0 when no
+// range matches it.
+func acceptQuality(header, mediaType string) acceptMatch {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	m := acceptMatch{specificity: -1}
+	i := -1
+	for part := range strings.SplitSeq(header, ",") {
+		i++
+		mediaRange, params, _ := strings.Cut(part, ";")
+		s := -1
+		switch strings.ToLower(strings.TrimSpace(mediaRange)) {
+		case mediaType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= m.specificity {
+			continue
+		}
+		m = acceptMatch{q: 1, specificity: s, index: i}
+		for p := range strings.SplitSeq(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					m.q = f
+				}
+			}
+		}
+	}
+	return m
+}
+
+// statusURL is the path the landing page polls for the app's status, or
+// "" when the page should not: LANDING_STATUS is off, or the probes are
+// on the admin server, out of the browser's reach.
+func statusURL() string {
+	if !confBool("LANDING_STATUS") || conf("ADMIN_PORT") != "" {
+		return ""
+	}
+	return conf("READINESS_PATH")
+}
+
+// rootHandler serves the landing page and its assets on "/", the
+// catch-all pattern, so it answers every other path with 404 and methods
+// other than GET and HEAD with 405 itself.
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && !strings.HasPrefix(r.URL.Path, landingAssetPrefix) {
+		notFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed("GET, HEAD")(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, landingAssetPrefix) {
+		serveLandingAsset(w, r)
+		return
+	}
+	lang := pageLocale(r)
+	h := w.Header()
+	h.Set("Content-Language", lang)
+	h.Add("Vary", "Accept")
+	h.Add("Vary", "Accept-Language")
+	if prefersJSON(r) {
+		h.Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RootResponse{
+			Message:     textFor(lang).Status,
+			Environment: environment,
+			Version:     version.GitSHA,
+		})
+		return
+	}
+	page := renderLandingPage(r, pageKey{
+		lang:      lang,
+		theme:     conf("THEME"),
+		badges:    conf("ENVIRONMENT_BADGES"),
+		statusURL: statusURL(),
+	})
+
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	if page.etag != "" {
+		h.Set("ETag", page.etag)
+		h.Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(page.body))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLandingPage(t *testing.T) {
+	loadLandingPage()
+	w := do(http.HandlerFunc(rootHandler), "GET", "/", nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET / = %d %s, want 200 text/html", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), html.EscapeString(customerName)) {
+		t.Fatalf("GET / does not name the customer %q", customerName)
+	}
+	if w := do(http.HandlerFunc(rootHandler), "POST", "/", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST / = %d, want 405", w.Code)
+	}
+}
+
+func TestLandingPageNegotiation(t *testing.T) {
+	loadLandingPage()
+	for _, tc := range []struct {
+		accept string
+		json   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"text/html, application/json", false},
+		{"application/json, text/html", true},
+		{"application/json", true},
+		{"application/json, text/plain, */*", true},
+		{"text/html;q=0.5, application/json", true},
+		{"application/json;q=0.8, */*;q=0.9", false},
+		{"application/json;q=0, */*", false},
+	} {
+		w := do(http.HandlerFunc(rootHandler), "GET", "/", nil, "Accept", tc.accept)
+		if got := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"); got != tc.json {
+			t.Errorf("Accept %q = %s, want JSON %v", tc.accept, w.Header().Get("Content-Type"), tc.json)
+		}
+		if !slices.Contains(w.Header().Values("Vary"), "Accept") {
+			t.Errorf("Accept %q: Vary is %q, want Accept among it", tc.accept, w.Header().Values("Vary"))
+		}
+		if !tc.json {
+			continue
+		}
+		var resp RootResponse
+		decode(t, w, &resp)
+		if resp.Message != textFor(defaultLocale).Status || resp.Environment != environment || resp.Version != version.GitSHA {
+			t.Errorf("Accept %q answered %+v", tc.accept, resp)
+		}
+	}
+}
+
+func TestLandingPageBranding(t *testing.T) {
+	defer func(b landingBrand) { customerBrand = b }(customerBrand)
+	customerBrand = landingBrand{
+		LogoURL:        "https://cdn.example.com/logo.svg",
+		FaviconURL:     "https://cdn.example.com/favicon.ico",
+		PrimaryColor:   "#112233",
+		SecondaryColor: "red; } body { display: none",
+		Tagline:        "Fast & <friendly>",
+	}
+	loadLandingPage()
+	body := do(http.HandlerFunc(rootHandler), "GET", "/", nil).Body.String()
+	for _, want := range []string{
+		`<img class="logo" src="https://cdn.example.com/logo.svg"`,
+		`<link rel="icon" href="https://cdn.example.com/favicon.ico">`,
+		"--brand-primary: #112233;",
+		"Fast &amp; &lt;friendly&gt;",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("branded landing page does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "display: none") {
+		t.Error("a branding color broke out of its CSS value")
+	}
+}
+
+func TestLandingPageThemes(t *testing.T) {
+	loadLandingPage()
+	for _, theme := range landingThemes {
+		t.Setenv("THEME", theme)
+		body := do(http.HandlerFunc(rootHandler), "GET", "/", nil).Body.String()
+		if !strings.Contains(body, `<body class="theme-`+theme+`">`) || !bytes.Contains(landingAssets[assetPaths["landing.css"]].content, []byte(".theme-"+theme+" ")) {
+			t.Errorf("THEME=%s does not select a theme the stylesheet styles", theme)
+		}
+	}
+}
+
+func TestLandingPageLocale(t *testing.T) {
+	loadLandingPage()
+	get := func(acceptLanguage string) (lang, body string) {
+		w := do(http.HandlerFunc(rootHandler), "GET", "/", nil, "Accept-Language", acceptLanguage)
+		return w.Header().Get("Content-Language"), w.Body.String()
+	}
+
+	for header, want := range map[string]string{
+		"":                          "en",
+		"es":                        "es",
+		"pt-BR,pt;q=0.9,en;q=0.8":   "pt",
+		"zh-CN, de;q=0.7, fr;q=0.9": "fr",
+		"fr;q=0, ja;q=0.5":          "ja",
+		"*":                         "en",
+		"not a language;q=x, DE-AT": "de",
+	} {
+		if lang, body := get(header); lang != want || !strings.Contains(body, `<html lang="`+want+`">`) {
+			t.Errorf("Accept-Language %q = page in %q, want %q", header, lang, want)
+		}
+	}
+	if _, body := get("es"); !strings.Contains(body, html.EscapeString(textFor("es").Status)) {
+		t.Error("Spanish page does not show the Spanish status message")
+	}
+
+	t.Setenv("LOCALE", "de")
+	if lang, _ := get("es"); lang != "de" {
+		t.Errorf("LOCALE=de page in %q, want de whatever the browser asks for", lang)
+	}
+}
+
+func TestLandingPageStatus(t *testing.T) {
+	loadLandingPage()
+	get := func() string { return do(http.HandlerFunc(rootHandler), "GET", "/", nil).Body.String() }
+
+	body := get()
+	if !strings.Contains(body, `<section class="status" id="status"`) {
+		t.Fatal("landing page has no status section")
+	}
+	if want := `data-url="` + conf("READINESS_PATH") + `"`; !strings.Contains(body, want) {
+		t.Errorf("status section does not poll the readiness probe: no %q", want)
+	}
+	if !strings.Contains(body, `"ready":"All systems operational"`) {
+		t.Error("status section has no labels")
+	}
+
+	t.Setenv("LANDING_STATUS", "false")
+	if strings.Contains(get(), `id="status"`) {
+		t.Error("LANDING_STATUS=false still shows the status section")
+	}
+	t.Setenv("LANDING_STATUS", "true")
+	t.Setenv("ADMIN_PORT", "9090")
+	if strings.Contains(get(), `id="status"`) {
+		t.Error("status section polls the readiness probe on the public port with ADMIN_PORT set")
+	}
+}
+
+func TestLandingPageCaching(t *testing.T) {
+	loadLandingPage()
+	h := http.HandlerFunc(rootHandler)
+	w := do(h, "GET", "/", nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("GET / ETag %q, Cache-Control %q, want an ETag and no-cache", etag, w.Header().Get("Cache-Control"))
+	}
+	if w := do(h, "GET", "/", nil, "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("GET / with If-None-Match = %d, want 304", w.Code)
+	}
+	t.Setenv("THEME", "dark")
+	if got := do(h, "GET", "/", nil).Header().Get("ETag"); got == etag {
+		t.Error("changing THEME left the page's ETag unchanged")
+	}
+
+	body := w.Body.String()
+	for _, name := range landingAssetFiles {
+		path := assetPaths[name]
+		if !strings.Contains(body, `"`+path+`"`) {
+			t.Errorf("landing page does not link %s as %s", name, path)
+		}
+		w := do(h, "GET", path, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+			t.Errorf("GET %s = %d, Cache-Control %q, want 200 and immutable", path, w.Code, w.Header().Get("Cache-Control"))
+		}
+		if w := do(h, "GET", path, nil, "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+			t.Errorf("GET %s with If-None-Match = %d, want 304", path, w.Code)
+		}
+	}
+	if ct := do(h, "GET", assetPaths["landing.css"], nil).Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("stylesheet Content-Type = %q, want text/css", ct)
+	}
+	if w := do(h, "GET", landingAssetPrefix+"landing-0000000000000000.css", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown asset = %d, want 404", w.Code)
+	}
+}
+
+func TestTextForHealth(t *testing.T) {
+	loadLandingPage()
+	defer func(tr map[string]landingText) { translations = tr }(translations)
+	translations = map[string]landingText{
+		defaultLocale: englishText,
+		"xx":          {Health: map[string]string{"ready": "Prêt"}},
+	}
+	health := textFor("xx").Health
+	if health["ready"] != "Prêt" || health["failing"] != englishText.Health["failing"] {
+		t.Errorf("textFor(xx).Health = %v, want its own ready label and English for the rest", health)
+	}
+}
+
+func TestEnvironmentBadge(t *testing.T) {
+	loadLandingPage()
+	t.Setenv("ENVIRONMENT_BADGES", "qa=#805ad5:Quality,sandbox=#e53e3e")
+	en, es := textFor("en"), textFor("es")
+	for _, tc := range []struct {
+		env  string
+		text landingText
+		want landingBadge
+	}{
+		{"qa", en, landingBadge{"Quality", "#805ad5"}},
+		{"sandbox", es, landingBadge{"sandbox", "#e53e3e"}},
+		{"staging", en, landingBadge{"staging", "#ed8936"}},
+		{"prod", es, landingBadge{"producción", ""}},
+		{"feature-123", en, landingBadge{"feature-123", fallbackBadgeColor}},
+	} {
+		if got := environmentBadge(tc.env, tc.text); got != tc.want {
+			t.Errorf("environmentBadge(%q) = %+v, want %+v", tc.env, got, tc.want)
+		}
+	}
+
+	t.Setenv("ENVIRONMENT_BADGES", "qa=purple")
+	if got := environmentBadge("qa", en); got.Color != defaultBadgeColors["qa"] {
+		t.Errorf("invalid ENVIRONMENT_BADGES: qa badge = %+v, want the defaults", got)
+	}
+}
+
+func BenchmarkLandingPage(b *testing.B) {
+	loadLandingPage()
+	b.ReportAllocs()
+	for b.Loop() {
+		do(http.HandlerFunc(rootHandler), "GET", "/", nil)
+	}
+}
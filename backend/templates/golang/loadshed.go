@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// Load shedding. Disabled unless MAX_IN_FLIGHT is set.
+//
+//	MAX_IN_FLIGHT          requests served at once; the rest get 503
+//	LOAD_SHED_RETRY_AFTER  Retry-After sent with the 503 (default 1s)
+//	LOAD_SHED_EXEMPT       paths never shed
+//	                       (default the probe paths and /metrics)
+//
+// Rate limiting caps how fast clients may send; this caps how much work
+// the pod holds at once, whatever the rate. A request over the limit is
+// rejected straight away rather than queued, so a slow dependency makes
+// the pod answer 503 quickly instead of piling up goroutines and buffers
+// until it is OOM-killed. The probes are exempt by default: a busy pod is
+// not a dead one. Shed requests are counted in http_requests_shed_total.
+
+type loadShedder struct {
+	slots      chan struct{}
+	retryAfter string
+	exempt     []string
+	shed       atomic.Int64
+}
+
+// newLoadShedder reads the MAX_IN_FLIGHT variables; nil means disabled.
+func newLoadShedder() *loadShedder {
+	limit := confInt("MAX_IN_FLIGHT")
+	if limit <= 0 {
+		return nil
+	}
+	ls := &loadShedder{
+		slots:      make(chan struct{}, limit),
+		retryAfter: strconv.Itoa(int(math.Max(1, math.Ceil(confDuration("LOAD_SHED_RETRY_AFTER").Seconds())))),
+		exempt:     confList("LOAD_SHED_EXEMPT"),
+	}
+	registerMetrics(ls.writeMetrics)
+	return ls
+}
+
+// loadShedMiddleware answers 503 while MAX_IN_FLIGHT requests are being
+// served.
+func loadShedMiddleware(ls *loadShedder, next http.Handler) http.Handler {
+	if ls == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(ls.exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case ls.slots <- struct{}{}:
+			defer func() { <-ls.slots }()
+			next.ServeHTTP(w, r)
+			return
+		default:
+		}
+
+		ls.shed.Add(1)
+		w.Header().Set("Retry-After", ls.retryAfter)
+		writeError(w, r, http.StatusServiceUnavailable, "server overloaded")
+	})
+}
+
+func (ls *loadShedder) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP http_requests_shed_total Requests rejected with 503 because MAX_IN_FLIGHT requests were in flight.")
+	fmt.Fprintln(w, "# TYPE http_requests_shed_total counter")
+	fmt.Fprintf(w, "http_requests_shed_total %d\n", ls.shed.Load())
+	fmt.Fprintln(w, "# HELP http_requests_max_in_flight The MAX_IN_FLIGHT limit.")
+	fmt.Fprintln(w, "# TYPE http_requests_max_in_flight gauge")
+	fmt.Fprintf(w, "http_requests_max_in_flight %d\n", cap(ls.slots))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Landing page translations. web/locales.json maps a language ("en",
+// "es", ...) to the page's strings; a string missing from a language is
+// shown in English. The language is LOCALE when set, otherwise the best
+// match for the request's Accept-Language, otherwise English.
+
+// defaultLocale is the language every other one falls back to.
+const defaultLocale = "en"
+
+// landingText is the translatable text of the landing page.
+type landingText struct {
+	Status string `json:"status"`
+	Footer string `json:"footer"`
+	// Environments labels the environment badge, by ENVIRONMENT value.
+	// An environment without a label is shown as is.
+	Environments map[string]string `json:"environments"`
+	// Health labels the live status section (landing.go), by state:
+	// checking, ready, starting, not_ready, unreachable, ok, failing and
+	// cached. A label missing from a language is shown in English.
+	Health map[string]string `json:"health"`
+}
+
+// englishText is used when web/locales.json is unusable, so the page
+// always has its text.
+var englishText = landingText{
+	Status: "Application is running successfully",
+	Footer: "Powered by OpenLuffy",
+	Health: map[string]string{
+		"checking":    "Checking status…",
+		"ready":       "All systems operational",
+		"starting":    "Starting up",
+		"not_ready":   "Not ready",
+		"unreachable": "Status unavailable",
+		"ok":          "OK",
+		"failing":     "Failing",
+		"cached":      "cached",
+	},
+}
+
+// translations holds the languages of web/locales.json.
+var translations = map[string]landingText{defaultLocale: englishText}
+
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// isLanguageTag accepts language tags such as en, es or pt-BR.
+func isLanguageTag(v string) error {
+	if !languageTag.MatchString(v) {
+		return errors.New("want a language such as en, es or pt-BR")
+	}
+	return nil
+}
+
+// loadTranslations parses the embedded web/locales.json. A failure is
+// logged and leaves the page in English.
+func loadTranslations() {
+	parsed, err := parseTranslations()
+	if err != nil {
+		slog.Warn("landing page translations unusable, serving English", "error", err)
+		return
+	}
+	translations = parsed
+}
+
+func parseTranslations() (map[string]landingText, error) {
+	data, err := webFS.ReadFile("web/locales.json")
+	if err != nil {
+		return nil, err
+	}
+	var parsed map[string]landingText
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	if _, ok := parsed[defaultLocale]; !ok {
+		return nil, errors.New("no " + defaultLocale + " translation")
+	}
+	return parsed, nil
+}
+
+// textFor returns the text of locale, filled in from English where the
+// translation has gaps.
+func textFor(locale string) landingText {
+	text, en := translations[locale], translations[defaultLocale]
+	if text.Status == "" {
+		text.Status = en.Status
+	}
+	if text.Footer == "" {
+		text.Footer = en.Footer
+	}
+	if text.Environments == nil {
+		text.Environments = en.Environments
+	}
+	health := maps.Clone(englishText.Health)
+	maps.Copy(health, en.Health)
+	maps.Copy(health, text.Health)
+	text.Health = health
+	return text
+}
+
+// environmentLabel is the badge label for env in text.
+func (text landingText) environmentLabel(env string) string {
+	if label := text.Environments[env]; label != "" {
+		return label
+	}
+	return env
+}
+
+// pageLocale picks the landing page language for r.
+func pageLocale(r *http.Request) string {
+	if l := matchLocale(conf("LOCALE")); l != "" {
+		return l
+	}
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if l := matchLocale(tag); l != "" {
+			return l
+		}
+	}
+	return defaultLocale
+}
+
+// matchLocale returns the translation for a language tag: the tag itself
+// ("pt-BR"), else its primary language ("pt"), else "".
+func matchLocale(tag string) string {
+	tag = strings.ToLower(tag)
+	for candidate := tag; candidate != ""; {
+		for l := range translations {
+			if strings.ToLower(l) == candidate {
+				return l
+			}
+		}
+		i := strings.LastIndexByte(candidate, '-')
+		if i < 0 {
+			break
+		}
+		candidate = candidate[:i]
+	}
+	return ""
+}
+
+// acceptedLanguages parses an Accept-Language header into its language
+// tags, most preferred first. Tags with q=0, and "*", are dropped.
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" && q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	slices.SortStableFunc(tags, func(a, b weighted) int { return cmp.Compare(b.q, a.q) })
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
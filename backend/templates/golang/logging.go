@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Structured logging on log/slog, JSON unless LOG_FORMAT asks for text.
+// Every line carries service and env;
+// request-scoped lines also carry request_id, trace_id/span_id when the
+// request is traced, any identity headers copied into the context by
+// headerContextMiddleware, the API key's id (apikey.go) and the client
+// certificate's common name (tls.go).
+//
+//	LOG_LEVEL          debug, info (default), warn or error; reloadable
+//	LOG_FORMAT         json, or text for key=value lines that read better
+//	                   in a terminal (the default in development)
+//	LOG_SOURCE         "true" adds the source file and line to every record
+//	                   (the default in development)
+//	ACCESS_LOG         "false" disables the per-request access log
+//	ACCESS_LOG_EXCLUDE paths not access-logged
+//	                   (default the probe paths and /metrics)
+//
+// The lines can also be shipped to Loki or an OTLP logs endpoint, for
+// clusters without a log collector (logship.go).
+
+// serviceName identifies this app in aggregated logs.
+const serviceName = "[% APP_NAME %]"
+
+// parseLogLevel maps LOG_LEVEL to a slog level, reporting whether raw was
+// recognised.
+func parseLogLevel(raw string) (slog.Level, bool) {
+	var level slog.Level
+	if raw == "" {
+		return slog.LevelInfo, true
+	}
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(raw))); err != nil {
+		return slog.LevelInfo, false
+	}
+	return level, true
+}
+
+// logLevel is the active level, changed in place when LOG_LEVEL is reloaded.
+var logLevel slog.LevelVar
+
+// setupLogging installs the logger as the slog default. slog.SetDefault
+// also routes the standard log package through it, so stray log.Printf
+// calls still come out structured.
+func setupLogging() {
+	applyLevel := func() {
+		level, _ := parseLogLevel(conf("LOG_LEVEL"))
+		logLevel.Set(level)
+	}
+	applyLevel()
+	onConfigReload(applyLevel)
+
+	opts := &slog.HandlerOptions{
+		Level:     &logLevel,
+		AddSource: confBool("LOG_SOURCE"),
+	}
+	logSinks = setupLogSinks()
+	text := conf("LOG_FORMAT") == "text" && len(logSinks) == 0
+	if text {
+		localLog = slog.New(slog.NewTextHandler(os.Stdout, opts)).With("service", serviceName, "env", environment)
+	} else {
+		localLog = slog.New(slog.NewJSONHandler(os.Stdout, opts)).With("service", serviceName, "env", environment)
+	}
+	if len(logSinks) == 0 {
+		slog.SetDefault(localLog)
+		return
+	}
+	handler := slog.NewJSONHandler(logTee{out: os.Stdout, sinks: logSinks}, opts)
+	slog.SetDefault(slog.New(handler).With("service", serviceName, "env", environment))
+	if conf("LOG_FORMAT") == "text" {
+		slog.Warn("LOG_FORMAT=text ignored: shipped logs are JSON")
+	}
+	for _, s := range logSinks {
+		slog.Info("log shipping enabled", "sink", s.name, "endpoint", s.endpoint)
+	}
+}
+
+// requestLogger returns the default logger annotated with the request's
+// correlation fields.
+func requestLogger(r *http.Request) *slog.Logger {
+	logger := slog.Default()
+	if id := requestIDFromContext(r.Context()); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if sc, ok := spanFromContext(r.Context()); ok {
+		logger = logger.With("trace_id", hex.EncodeToString(sc.TraceID[:]), "span_id", hex.EncodeToString(sc.SpanID[:]))
+	}
+	if id := tenantID(r.Context()); id != "" {
+		logger = logger.With("tenant_id", id)
+	}
+	if id := userID(r.Context()); id != "" {
+		logger = logger.With("user_id", id)
+	}
+	if id := apiKeyID(r.Context()); id != "" {
+		logger = logger.With("api_key_id", id)
+	}
+	if cn := clientCN(r); cn != "" {
+		logger = logger.With("client_cn", cn)
+	}
+	return logger
+}
+
+// identityKey holds an *identity, so what middleware inside the outer
+// accessLogMiddleware, which installs it, learns about the caller is in
+// the access log line too.
+type identityKey struct{}
+
+// identity is who a request turned out to be from: the API key
+// apiKeyMiddleware matched, and the tenant an app resolved itself (see
+// setTenantID).
+type identity struct {
+	apiKeyID string
+	tenantID string
+}
+
+// withIdentity returns r with an identity in its context, or r itself if
+// it already has one, and the identity.
+func withIdentity(r *http.Request) (*http.Request, *identity) {
+	if ident, ok := r.Context().Value(identityKey{}).(*identity); ok {
+		return r, ident
+	}
+	ident := new(identity)
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, ident)), ident
+}
+
+// accessLogMiddleware writes one log line per request. Probe and scrape
+// paths are excluded by default so kubelet and Prometheus traffic does not
+// drown out real requests.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	if !confBool("ACCESS_LOG") {
+		return next
+	}
+	exclude := confList("ACCESS_LOG_EXCLUDE")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exclude, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r, _ = withIdentity(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		requestLogger(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.statusCode(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes", rec.bytes,
+			"remote_addr", clientIP(r),
+			"user_agent", r.UserAgent())
+	})
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log shipping, for clusters without a node-level collector (Promtail,
+// Fluent Bit or an OpenTelemetry Collector DaemonSet) to pick up stdout.
+// Every line still goes to stdout; each endpoint configured also gets it:
+//
+//	LOKI_URL                          Loki's base URL, e.g. http://loki:3100;
+//	                                  /loki/api/v1/push is appended
+//	LOKI_HEADERS                      extra headers, "k1=v1,k2=v2", such as
+//	                                  X-Scope-OrgID for a multi-tenant Loki;
+//	                                  secret
+//	OTEL_LOGS_EXPORTER                "otlp" ships over OTLP/HTTP JSON, next
+//	                                  to the traces (tracing.go)
+//	OTEL_EXPORTER_OTLP_LOGS_ENDPOINT  full logs URL; defaults to
+//	                                  OTEL_EXPORTER_OTLP_ENDPOINT with
+//	                                  /v1/logs appended
+//
+// Loki streams are labelled service, env and level only, to keep their
+// number down: every other field stays in the JSON line, for LogQL's
+// | json. OTLP records carry the level as severity, msg as body, the rest
+// as attributes, and trace_id and span_id to link them to their traces.
+//
+// Shipping never slows the app down. Lines wait in a queue of
+// logQueueSize per endpoint and go out in batches of logBatchSize, or
+// every logFlushInterval. A batch the endpoint refuses with a 429 or 5xx,
+// or does not answer, is retried with backoff while the queue takes new
+// lines; once the queue is full, new lines are dropped for that endpoint
+// and counted in log_shipping_records_total{result="dropped"}. On shutdown
+// what is queued is sent within SHUTDOWN_TIMEOUT.
+
+const (
+	logQueueSize     = 10000
+	logBatchSize     = 1000
+	logFlushInterval = 2 * time.Second
+	logSendAttempts  = 3
+	logRetryBackoff  = time.Second
+)
+
+// logSink ships log lines to one endpoint.
+type logSink struct {
+	name     string // "loki" or "otlp", the metrics label
+	endpoint string
+	headers  map[string]string
+	encode   func(lines [][]byte) ([]byte, error)
+	client   *http.Client
+
+	queue   chan []byte
+	done    chan struct{} // closed to request a final flush
+	stopped chan struct{} // closed by run once the queue is sent
+	once    sync.Once
+
+	sent, failed, dropped atomic.Uint64
+}
+
+var logSinks []*logSink
+
+// localLog logs to stdout only. Shipping problems go there, so an
+// endpoint that is down does not fill its own queue with them.
+var localLog = slog.Default()
+
+func newLogSink(name, endpoint string, headers map[string]string, encode func([][]byte) ([]byte, error)) *logSink {
+	return &logSink{
+		name:     name,
+		endpoint: endpoint,
+		headers:  headers,
+		encode:   encode,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan []byte, logQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// setupLogSinks starts a sink per endpoint configured and returns them.
+// setupLogging calls it, before any line is logged.
+func setupLogSinks() []*logSink {
+	var sinks []*logSink
+	if base := conf("LOKI_URL"); base != "" {
+		sinks = append(sinks, newLogSink("loki", strings.TrimRight(base, "/")+"/loki/api/v1/push",
+			parseHeaders(confList("LOKI_HEADERS")), encodeLoki))
+	}
+	if conf("OTEL_LOGS_EXPORTER") == "otlp" {
+		endpoint := conf("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT")
+		if base := conf("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/logs"
+		}
+		if endpoint != "" {
+			sinks = append(sinks, newLogSink("otlp", endpoint,
+				parseHeaders(confList("OTEL_EXPORTER_OTLP_HEADERS")), encodeOTLPLogs))
+		}
+	}
+	for _, s := range sinks {
+		go s.run()
+	}
+	if len(sinks) > 0 {
+		registerMetrics(writeLogShippingMetrics)
+	}
+	return sinks
+}
+
+// parseHeaders reads "k=v" entries.
+func parseHeaders(entries []string) map[string]string {
+	headers := map[string]string{}
+	for _, kv := range entries {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return headers
+}
+
+// logTee is what the JSON handler writes to: out, then every sink. The
+// handler writes one whole line per call, holding its lock, so lines
+// reach the sinks in order.
+type logTee struct {
+	out   io.Writer
+	sinks []*logSink
+}
+
+func (t logTee) Write(p []byte) (int, error) {
+	n, err := t.out.Write(p)
+	for _, s := range t.sinks {
+		s.enqueue(p)
+	}
+	return n, err
+}
+
+// enqueue queues a copy of line, or drops it if the queue is full.
+func (s *logSink) enqueue(line []byte) {
+	select {
+	case s.queue <- bytes.Clone(line):
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *logSink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, logBatchSize)
+	var reported uint64
+	flush := func() {
+		if len(batch) > 0 {
+			s.send(batch)
+			batch = batch[:0]
+		}
+		if dropped := s.dropped.Load(); dropped > reported {
+			localLog.Warn("log queue full, lines dropped", "sink", s.name, "dropped", dropped-reported)
+			reported = dropped
+		}
+	}
+	for {
+		select {
+		case line := <-s.queue:
+			batch = append(batch, line)
+			if len(batch) >= logBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.done:
+			for {
+				select {
+				case line := <-s.queue:
+					batch = append(batch, line)
+					if len(batch) >= logBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts one batch, retrying while the endpoint is unavailable, but
+// not once shutdown has begun.
+func (s *logSink) send(batch [][]byte) {
+	body, err := s.encode(batch)
+	if err != nil {
+		s.failed.Add(uint64(len(batch)))
+		localLog.Warn("encoding logs failed", "sink", s.name, "error", err)
+		return
+	}
+	backoff := logRetryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			s.sent.Add(uint64(len(batch)))
+			return
+		}
+		select {
+		case <-s.done:
+			retry = false
+		default:
+		}
+		if !retry || attempt == logSendAttempts {
+			s.failed.Add(uint64(len(batch)))
+			localLog.Warn("shipping logs failed", "sink", s.name, "error", err, "lines", len(batch), "attempts", attempt)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends body, reporting whether a failure is worth retrying.
+func (s *logSink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return false, fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// flushLogs sends the queued lines, waiting at most until ctx is done.
+func flushLogs(ctx context.Context) {
+	for _, s := range logSinks {
+		s.once.Do(func() { close(s.done) })
+	}
+	for _, s := range logSinks {
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+			localLog.Warn("timed out shipping logs", "sink", s.name, "queued", len(s.queue))
+		}
+	}
+}
+
+// logRecord is the part of a JSON log line the encoders need.
+type logRecord struct {
+	time   time.Time
+	level  string
+	fields map[string]any
+}
+
+func parseLogLine(line []byte) logRecord {
+	rec := logRecord{time: time.Now(), level: "INFO"}
+	if json.Unmarshal(line, &rec.fields) != nil {
+		rec.fields = map[string]any{"msg": string(bytes.TrimSpace(line))}
+		return rec
+	}
+	if t, ok := rec.fields["time"].(string); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			rec.time = parsed
+		}
+	}
+	if level, ok := rec.fields["level"].(string); ok {
+		rec.level = level
+	}
+	return rec
+}
+
+// encodeLoki builds a Loki push request, a stream per level.
+func encodeLoki(lines [][]byte) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	var streams []*stream
+	byLevel := map[string]*stream{}
+	for _, line := range lines {
+		rec := parseLogLine(line)
+		level := strings.ToLower(rec.level)
+		st, ok := byLevel[level]
+		if !ok {
+			st = &stream{Stream: map[string]string{"service": serviceName, "env": environment, "level": level}}
+			byLevel[level] = st
+			streams = append(streams, st)
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(rec.time.UnixNano(), 10), string(bytes.TrimRight(line, "\n"))})
+	}
+	return json.Marshal(map[string]any{"streams": streams})
+}
+
+// severityNumber maps a slog level, such as "WARN" or "INFO+2", to its
+// OTLP severity.
+func severityNumber(level string) int {
+	switch {
+	case strings.HasPrefix(level, "DEBUG"):
+		return 5
+	case strings.HasPrefix(level, "WARN"):
+		return 13
+	case strings.HasPrefix(level, "ERROR"):
+		return 17
+	}
+	return 9
+}
+
+// otlpLogValue encodes a JSON field value as an OTLP AnyValue. Groups and
+// arrays are kept as their JSON.
+func otlpLogValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		data, _ := json.Marshal(v)
+		return map[string]any{"stringValue": string(data)}
+	}
+}
+
+// encodeOTLPLogs builds an OTLP/JSON logs export request.
+func encodeOTLPLogs(lines [][]byte) ([]byte, error) {
+	type logRecordOut struct {
+		TimeUnixNano   string          `json:"timeUnixNano"`
+		SeverityNumber int             `json:"severityNumber"`
+		SeverityText   string          `json:"severityText"`
+		Body           map[string]any  `json:"body"`
+		Attributes     []otlpAttribute `json:"attributes,omitempty"`
+		TraceID        string          `json:"traceId,omitempty"`
+		SpanID         string          `json:"spanId,omitempty"`
+	}
+	records := make([]logRecordOut, 0, len(lines))
+	for _, line := range lines {
+		rec := parseLogLine(line)
+		out := logRecordOut{
+			TimeUnixNano:   strconv.FormatInt(rec.time.UnixNano(), 10),
+			SeverityNumber: severityNumber(rec.level),
+			SeverityText:   rec.level,
+			Body:           otlpLogValue(fmt.Sprint(rec.fields["msg"])),
+		}
+		for k, v := range rec.fields {
+			switch k {
+			case "time", "level", "msg", "service", "env":
+			case "trace_id":
+				out.TraceID = fmt.Sprint(v)
+			case "span_id":
+				out.SpanID = fmt.Sprint(v)
+			default:
+				out.Attributes = append(out.Attributes, otlpAttribute{Key: k, Value: otlpLogValue(v)})
+			}
+		}
+		records = append(records, out)
+	}
+	return json.Marshal(map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{
+				{Key: "service.name", Value: otlpValue(conf("OTEL_SERVICE_NAME"))},
+				{Key: "deployment.environment", Value: otlpValue(environment)},
+			}},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "openluffy-template"},
+				"logRecords": records,
+			}},
+		}},
+	})
+}
+
+func writeLogShippingMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP log_shipping_records_total Log lines shipped, by sink and result: sent, failed or dropped (queue full).")
+	fmt.Fprintln(out, "# TYPE log_shipping_records_total counter")
+	for _, s := range logSinks {
+		for _, c := range []struct {
+			result string
+			n      *atomic.Uint64
+		}{{"sent", &s.sent}, {"failed", &s.failed}, {"dropped", &s.dropped}} {
+			fmt.Fprintf(out, "log_shipping_records_total{sink=%q,result=%q} %d\n", s.name, c.result, c.n.Load())
+		}
+	}
+	fmt.Fprintln(out, "# HELP log_shipping_queue_depth Log lines waiting to be shipped, by sink.")
+	fmt.Fprintln(out, "# TYPE log_shipping_queue_depth gauge")
+	for _, s := range logSinks {
+		fmt.Fprintf(out, "log_shipping_queue_depth{sink=%q} %d\n", s.name, len(s.queue))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shipLogs logs through a sink posting to a fake endpoint with the given
+// encoder, flushes it and returns the request bodies the endpoint got.
+func shipLogs(t *testing.T, name string, encode func([][]byte) ([]byte, error), log func(*slog.Logger)) []string {
+	t.Helper()
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Scope-OrgID"); got != "acme" {
+			t.Errorf("X-Scope-OrgID = %q, want acme", got)
+		}
+		data, _ := io.ReadAll(r.Body)
+		bodies <- string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	sink := newLogSink(name, srv.URL, parseHeaders([]string{"X-Scope-OrgID=acme"}), encode)
+	go sink.run()
+	sinks := logSinks
+	logSinks = []*logSink{sink}
+	t.Cleanup(func() { logSinks = sinks })
+
+	log(slog.New(slog.NewJSONHandler(logTee{out: io.Discard, sinks: logSinks}, nil)).With("service", serviceName, "env", environment))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flushLogs(ctx)
+
+	close(bodies)
+	var got []string
+	for b := range bodies {
+		got = append(got, b)
+	}
+	if sink.sent.Load() == 0 || sink.failed.Load() != 0 {
+		t.Errorf("sent %d, failed %d; want every line sent", sink.sent.Load(), sink.failed.Load())
+	}
+	return got
+}
+
+func TestShipLogsLoki(t *testing.T) {
+	bodies := shipLogs(t, "loki", encodeLoki, func(log *slog.Logger) {
+		log.Info("request served", "status", 200)
+		log.Warn("slow request", "duration_ms", 1500)
+		log.Info("request served", "status", 404)
+	})
+	if len(bodies) != 1 {
+		t.Fatalf("%d pushes, want the lines in one batch", len(bodies))
+	}
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(bodies[0]), &push); err != nil {
+		t.Fatalf("decoding push: %v", err)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("%d streams, want one per level", len(push.Streams))
+	}
+	info := push.Streams[0]
+	if info.Stream["level"] != "info" || info.Stream["service"] != serviceName || len(info.Values) != 2 {
+		t.Errorf("first stream %v with %d lines, want the two info lines under service %s", info.Stream, len(info.Values), serviceName)
+	}
+	if line := info.Values[1][1]; !strings.Contains(line, `"status":404`) || strings.HasSuffix(line, "\n") {
+		t.Errorf("line %q, want the whole JSON line without its newline", line)
+	}
+}
+
+func TestShipLogsOTLP(t *testing.T) {
+	bodies := shipLogs(t, "otlp", encodeOTLPLogs, func(log *slog.Logger) {
+		log.Error("charge failed", "trace_id", "4bf92f3577b34da6a3ce929d0e0e4736", "span_id", "00f067aa0ba902b7", "amount", 12.5, "retry", true)
+	})
+	var export struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					SeverityNumber int             `json:"severityNumber"`
+					SeverityText   string          `json:"severityText"`
+					Body           map[string]any  `json:"body"`
+					TraceID        string          `json:"traceId"`
+					Attributes     []otlpAttribute `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if len(bodies) != 1 || json.Unmarshal([]byte(bodies[0]), &export) != nil {
+		t.Fatalf("exports %q, want one OTLP request", bodies)
+	}
+	rec := export.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if rec.SeverityNumber != 17 || rec.SeverityText != "ERROR" || rec.Body["stringValue"] != "charge failed" || rec.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("record %+v, want an ERROR saying charge failed in its trace", rec)
+	}
+	attrs := map[string]map[string]any{}
+	for _, a := range rec.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if attrs["amount"]["doubleValue"] != 12.5 || attrs["retry"]["boolValue"] != true || attrs["msg"] != nil {
+		t.Errorf("attributes %v, want amount and retry typed, msg left to the body", attrs)
+	}
+}
+
+func TestLogSinkFullQueue(t *testing.T) {
+	sink := newLogSink("loki", "http://127.0.0.1:0", nil, encodeLoki)
+	sink.queue = make(chan []byte, 2)
+	tee := logTee{out: io.Discard, sinks: []*logSink{sink}}
+	for range 5 {
+		tee.Write([]byte("{}\n"))
+	}
+	if len(sink.queue) != 2 || sink.dropped.Load() != 3 {
+		t.Errorf("queued %d, dropped %d; want 2 and 3", len(sink.queue), sink.dropped.Load())
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus metrics in the text exposition format, served on /metrics.
+// Implemented on the standard library so generated apps keep a
+// dependency-free go.mod.
+//
+//	http_requests_total                 counter   method, route, status_class
+//	http_requests_in_flight             gauge
+//	http_request_duration_seconds       histogram method, route
+//	http_requests_slo_exceeded_total    counter   method, route
+//	http_request_slo_threshold_seconds  gauge
+//
+// route is the ServeMux pattern that matched, never the raw path, and
+// method is one of the standard methods or OTHER, so scanners probing
+// random URLs or sending made-up methods cannot blow up label
+// cardinality. Apps add their own metric families with registerMetrics.
+//
+// status_class is 2xx, 4xx and so on. METRICS_STATUS_CODES=true adds
+// code, the exact status, for dashboards that tell a 404 from a 429; it
+// multiplies each route's series by the statuses the route answers with.
+//
+// SLO_LATENCY_THRESHOLD turns the latency measured for the histogram into
+// an SLO signal: requests slower than it are counted per route in
+// http_requests_slo_exceeded_total, and the threshold itself is exported
+// as http_request_slo_threshold_seconds for dashboards to draw the line.
+// Alert on the exceeded share burning the error budget, e.g.
+//
+//	sum by (route) (rate(http_requests_slo_exceeded_total[5m]))
+//	  / sum by (route) (rate(http_request_duration_seconds_count[5m]))
+//	  > 0.01
+//
+// Unset, neither family is exported.
+
+// latencyBuckets are the Prometheus client default histogram buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	Method, Route string
+	Code          int
+}
+
+type routeKey struct {
+	Method, Route string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Shutdown phases, by which requests still in flight at shutdown are
+// counted as drained or cancelled.
+const (
+	phaseServing  int32 = iota
+	phaseDraining       // srv.Shutdown: no new requests, in-flight ones finish
+	phaseForced         // srv.Close: SHUTDOWN_TIMEOUT passed, connections closed
+)
+
+// httpMetrics holds the request metrics for the whole process.
+type httpMetrics struct {
+	inFlight atomic.Int64
+
+	phase     atomic.Int32
+	drained   atomic.Int64 // finished while draining
+	cancelled atomic.Int64 // finished after their connection was closed
+
+	// slo is SLO_LATENCY_THRESHOLD as a time.Duration, 0 when unset.
+	slo atomic.Int64
+	// statusCodes is METRICS_STATUS_CODES: label requests with the exact
+	// code as well as its class.
+	statusCodes atomic.Bool
+
+	mu          sync.Mutex
+	requests    map[requestKey]uint64
+	latencies   map[routeKey]*histogram
+	sloExceeded map[routeKey]uint64
+}
+
+var metrics = &httpMetrics{
+	requests:    map[requestKey]uint64{},
+	latencies:   map[routeKey]*histogram{},
+	sloExceeded: map[routeKey]uint64{},
+}
+
+// methodLabel returns method for the standard methods and OTHER for any
+// other, which a client can make up.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+func (m *httpMetrics) observe(method, route string, code int, d time.Duration) {
+	method = methodLabel(method)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{method, route, code}]++
+
+	rk := routeKey{method, route}
+	h, ok := m.latencies[rk]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[rk] = h
+	}
+	h.observe(d.Seconds())
+	if slo := time.Duration(m.slo.Load()); slo > 0 && d > slo {
+		m.sloExceeded[rk]++
+	}
+}
+
+// requestDone records a request leaving flight, counting it by shutdown
+// phase.
+func (m *httpMetrics) requestDone() {
+	m.inFlight.Add(-1)
+	switch m.phase.Load() {
+	case phaseDraining:
+		m.drained.Add(1)
+	case phaseForced:
+		m.cancelled.Add(1)
+	}
+}
+
+// beginDraining marks the start of srv.Shutdown and returns the number of
+// requests in flight.
+func (m *httpMetrics) beginDraining() int64 {
+	m.phase.Store(phaseDraining)
+	return m.inFlight.Load()
+}
+
+// beginForced marks the connections as closed under the requests left.
+func (m *httpMetrics) beginForced() {
+	m.phase.Store(phaseForced)
+}
+
+// shutdownCounts returns how the requests in flight at shutdown ended:
+// drained, or cancelled by the forced close, including those still
+// running that the process exit will cut off.
+func (m *httpMetrics) shutdownCounts() (drained, cancelled int64) {
+	return m.drained.Load(), m.cancelled.Load() + m.inFlight.Load()
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler. Flush and Unwrap keep streaming responses and
+// http.ResponseController working through the wrapper.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// statusCode returns the status written, defaulting to 200 for handlers that
+// returned without writing anything.
+func (rec *statusRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// metricsMiddleware records request count, latency and in-flight requests.
+// Routes are resolved against mux so the label is the registered pattern.
+func metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	metrics.slo.Store(int64(confDuration("SLO_LATENCY_THRESHOLD")))
+	metrics.statusCodes.Store(confBool("METRICS_STATUS_CODES"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		metrics.inFlight.Add(1)
+		defer metrics.requestDone()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		metrics.observe(r.Method, route, rec.statusCode(), time.Since(start))
+	})
+}
+
+// statusClass maps 404 to "4xx" and so on.
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// escapeLabel escapes a label value per the exposition format.
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricWriters append app metrics to /metrics; see registerMetrics.
+var metricWriters []func(w io.Writer)
+
+// registerMetrics adds app metrics to /metrics. write is called on every
+// scrape, after the HTTP metrics, and must write whole metric families
+// (HELP, TYPE and samples). Register before the server starts.
+func registerMetrics(write func(w io.Writer)) {
+	metricWriters = append(metricWriters, write)
+}
+
+// snapshot copies the request counts, latency histograms and SLO counts,
+// so a scrape writes them without holding m.mu.
+func (m *httpMetrics) snapshot() (requests map[requestKey]uint64, latencies map[routeKey]histogram, sloExceeded map[routeKey]uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latencies = make(map[routeKey]histogram, len(m.latencies))
+	for k, h := range m.latencies {
+		latencies[k] = histogram{counts: slices.Clone(h.counts), count: h.count, sum: h.sum}
+	}
+	return maps.Clone(m.requests), latencies, maps.Clone(m.sloExceeded)
+}
+
+// metricsHandler serves all metrics in the Prometheus text format. The
+// HTTP metrics are copied first, so a slow scraper never holds up the
+// requests being observed.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, latencies, sloExceeded := metrics.snapshot()
+	statusCodes := metrics.statusCodes.Load()
+	if !statusCodes {
+		// Requests are counted by exact code; fold them into their class.
+		byClass := make(map[requestKey]uint64, len(requests))
+		for k, n := range requests {
+			k.Code = k.Code / 100 * 100
+			byClass[k] += n
+		}
+		requests = byClass
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	requestKeys := make([]requestKey, 0, len(requests))
+	for k := range requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Code < b.Code
+	})
+
+	fmt.Fprintln(out, "# HELP http_requests_total Total HTTP requests by method, route and status.")
+	fmt.Fprintln(out, "# TYPE http_requests_total counter")
+	for _, k := range requestKeys {
+		if statusCodes {
+			fmt.Fprintf(out, "http_requests_total{method=\"%s\",route=\"%s\",code=\"%d\",status_class=\"%s\"} %d\n",
+				escapeLabel(k.Method), escapeLabel(k.Route), k.Code, statusClass(k.Code), requests[k])
+		} else {
+			fmt.Fprintf(out, "http_requests_total{method=\"%s\",route=\"%s\",status_class=\"%s\"} %d\n",
+				escapeLabel(k.Method), escapeLabel(k.Route), statusClass(k.Code), requests[k])
+		}
+	}
+
+	fmt.Fprintln(out, "# HELP http_requests_in_flight HTTP requests currently being served.")
+	fmt.Fprintln(out, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(out, "http_requests_in_flight %d\n", metrics.inFlight.Load())
+
+	routeKeys := make([]routeKey, 0, len(latencies))
+	for k := range latencies {
+		routeKeys = append(routeKeys, k)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		a, b := routeKeys[i], routeKeys[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		return a.Method < b.Method
+	})
+
+	fmt.Fprintln(out, "# HELP http_request_duration_seconds HTTP request latency by method and route.")
+	fmt.Fprintln(out, "# TYPE http_request_duration_seconds histogram")
+	for _, k := range routeKeys {
+		h := latencies[k]
+		labels := fmt.Sprintf("method=\"%s\",route=\"%s\"", escapeLabel(k.Method), escapeLabel(k.Route))
+
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(b), cumulative)
+		}
+		fmt.Fprintf(out, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(out, "http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(out, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	if slo := time.Duration(metrics.slo.Load()); slo > 0 {
+		fmt.Fprintln(out, "# HELP http_requests_slo_exceeded_total HTTP requests slower than SLO_LATENCY_THRESHOLD by method and route.")
+		fmt.Fprintln(out, "# TYPE http_requests_slo_exceeded_total counter")
+		for _, k := range routeKeys {
+			if n := sloExceeded[k]; n > 0 {
+				fmt.Fprintf(out, "http_requests_slo_exceeded_total{method=\"%s\",route=\"%s\"} %d\n", escapeLabel(k.Method), escapeLabel(k.Route), n)
+			}
+		}
+		fmt.Fprintln(out, "# HELP http_request_slo_threshold_seconds The SLO_LATENCY_THRESHOLD requests are measured against.")
+		fmt.Fprintln(out, "# TYPE http_request_slo_threshold_seconds gauge")
+		fmt.Fprintf(out, "http_request_slo_threshold_seconds %s\n", formatFloat(slo.Seconds()))
+	}
+
+	for _, write := range metricWriters {
+		write(out)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"slices"
+)
+
+// requestIDHeader carries the correlation ID between services.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDMiddleware reuses the caller's X-Request-ID when it is well
+// formed and generates one otherwise. The ID is stored in the request
+// context, echoed in the response header, included in request logs and
+// forwarded on outbound calls by propagatingTransport.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDValue.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFromContext returns the ID assigned by requestIDMiddleware.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// recoveryMiddleware turns a handler panic into a logged stack trace and a
+// JSON 500, instead of a dropped connection with nothing in the logs. If the
+// handler had already started the response, only the log line is written.
+// http.ErrAbortHandler is re-panicked: it is net/http's deliberate way of
+// aborting a response.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			requestLogger(r).Error("panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(err),
+				"stack", string(debug.Stack()))
+			reportPanic(r, err)
+
+			if rec.status != 0 {
+				return
+			}
+			w.Header().Set("Connection", "close")
+			writeError(w, r, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// defaultMaxRequestBody is the MAX_REQUEST_BODY default, 1 MiB.
+const defaultMaxRequestBody = 1 << 20
+
+// maxRequestBody returns MAX_REQUEST_BODY, the most bytes a request body
+// may have.
+func maxRequestBody() int64 { return int64(confInt("MAX_REQUEST_BODY")) }
+
+// bodyLimitExempt are the paths exempted by exemptBodyLimit.
+var bodyLimitExempt []string
+
+// exemptBodyLimit lifts MAX_REQUEST_BODY for path, for routes such as file
+// uploads that take larger bodies and cap them themselves. Call it from
+// setupApp.
+func exemptBodyLimit(path string) {
+	bodyLimitExempt = append(bodyLimitExempt, path)
+}
+
+// bodyLimitMiddleware caps request bodies at MAX_REQUEST_BODY. A request
+// declaring a longer Content-Length gets 413 before the handler runs; a
+// body that turns out longer fails the handler's read with
+// *http.MaxBytesError, which readJSON (api.go) also answers with 413.
+// Without the cap a client can stream a body for as long as the read
+// timeout allows into a handler that reads it all.
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	limit := maxRequestBody()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || slices.Contains(bodyLimitExempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			w.Header().Set("Connection", "close")
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body larger than %d bytes", limit))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contextHeaderKey is the context key for a header value copied into the
+// request context by headerContextMiddleware.
+type contextHeaderKey string
+
+// defaultContextHeaders are the gateway-set identity headers copied into
+// the request context when CONTEXT_HEADERS is not set.
+var defaultContextHeaders = []string{"X-Tenant-Id", "X-User-Id"}
+
+// contextHeaderValue restricts copied header values to identifier-like
+// strings so they are safe to log and use as lookup keys.
+var contextHeaderValue = regexp.MustCompile(`^[A-Za-z0-9._:@-]{1,128}$`)
+
+// contextHeaders returns the header allowlist from CONTEXT_HEADERS
+// (comma-separated), falling back to defaultContextHeaders.
+func contextHeaders() []string {
+	var headers []string
+	for _, h := range confList("CONTEXT_HEADERS") {
+		headers = append(headers, http.CanonicalHeaderKey(h))
+	}
+	return headers
+}
+
+// headerContextMiddleware copies the allowlisted headers into the request
+// context. Requests carrying a malformed value are rejected with 400 rather
+// than passing unvalidated identity downstream.
+func headerContextMiddleware(headers []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		for _, h := range headers {
+			v := r.Header.Get(h)
+			if v == "" {
+				continue
+			}
+			if !contextHeaderValue.MatchString(v) {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid %s header", h))
+				return
+			}
+			ctx = context.WithValue(ctx, contextHeaderKey(http.CanonicalHeaderKey(h)), v)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// headerFromContext returns the value of an allowlisted header copied into
+// ctx, or "" if it was absent.
+func headerFromContext(ctx context.Context, header string) string {
+	v, _ := ctx.Value(contextHeaderKey(http.CanonicalHeaderKey(header))).(string)
+	return v
+}
+
+// tenantID returns the tenant an app resolved for the request with
+// setTenantID, or else its X-Tenant-Id header.
+func tenantID(ctx context.Context) string {
+	if ident, ok := ctx.Value(identityKey{}).(*identity); ok && ident.tenantID != "" {
+		return ident.tenantID
+	}
+	return headerFromContext(ctx, "X-Tenant-Id")
+}
+
+// setTenantID records id as the request's tenant, for its log lines and
+// error reports, and returns r with it.
+func setTenantID(r *http.Request, id string) *http.Request {
+	r, ident := withIdentity(r)
+	ident.tenantID = id
+	return r
+}
+
+func userID(ctx context.Context) string { return headerFromContext(ctx, "X-User-Id") }
+
+// propagatingTransport forwards request-scoped correlation headers
+// (X-Request-ID and, when tracing, traceparent) on outbound requests whose
+// context came from an incoming request. main installs it as
+// http.DefaultTransport, which http.DefaultClient and most SDKs use.
+type propagatingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *propagatingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	id := requestIDFromContext(r.Context())
+	sc, traced := spanFromContext(r.Context())
+	if (id != "" && r.Header.Get(requestIDHeader) == "") || (traced && r.Header.Get("traceparent") == "") {
+		r = r.Clone(r.Context())
+		if id != "" && r.Header.Get(requestIDHeader) == "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		if traced && r.Header.Get("traceparent") == "" {
+			r.Header.Set("traceparent", sc.traceparent())
+		}
+	}
+	return t.base.RoundTrip(r)
+}
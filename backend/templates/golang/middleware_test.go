@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// echoContextHeaders answers with the tenant and user the request context
+// carries, as "tenant/user".
+var echoContextHeaders = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(tenantID(r.Context()) + "/" + userID(r.Context())))
+})
+
+func TestHeaderContextMiddleware(t *testing.T) {
+	h := headerContextMiddleware(defaultContextHeaders, echoContextHeaders)
+
+	w := do(h, "GET", "/", nil, "X-Tenant-Id", "acme", "X-User-Id", "user:42@idp")
+	if w.Code != http.StatusOK || w.Body.String() != "acme/user:42@idp" {
+		t.Errorf("both headers: %d %q, want acme/user:42@idp", w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/", nil); w.Code != http.StatusOK || w.Body.String() != "/" {
+		t.Errorf("no headers: %d %q, want them absent", w.Code, w.Body)
+	}
+
+	for name, value := range map[string]string{
+		"space":     "acme corp",
+		"newline":   "acme\nX-Admin: true",
+		"too long":  strings.Repeat("a", 129),
+		"non-ASCII": "acmé",
+	} {
+		w := do(h, "GET", "/", nil, "X-Tenant-Id", value)
+		var resp errorResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusBadRequest || resp.Message != "invalid X-Tenant-Id header" {
+			t.Errorf("%s: %d %+v, want 400 naming the header", name, w.Code, resp)
+		}
+	}
+}
+
+func TestHeaderContextAllowlist(t *testing.T) {
+	t.Setenv("CONTEXT_HEADERS", "x-tenant-id")
+	headers := contextHeaders()
+	if len(headers) != 1 || headers[0] != "X-Tenant-Id" {
+		t.Fatalf("contextHeaders() = %q, want [X-Tenant-Id]", headers)
+	}
+
+	// A header off the allowlist is neither copied nor validated.
+	h := headerContextMiddleware(headers, echoContextHeaders)
+	w := do(h, "GET", "/", nil, "X-Tenant-Id", "acme", "X-User-Id", "not valid!")
+	if w.Code != http.StatusOK || w.Body.String() != "acme/" {
+		t.Errorf("%d %q, want only the tenant copied", w.Code, w.Body)
+	}
+}
+
+func TestSetTenantID(t *testing.T) {
+	// The tenant an app resolves itself wins over the gateway's header.
+	h := headerContextMiddleware(defaultContextHeaders, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		echoContextHeaders(w, setTenantID(r, "resolved"))
+	}))
+	if w := do(h, "GET", "/", nil, "X-Tenant-Id", "header"); w.Body.String() != "resolved/" {
+		t.Errorf("tenant = %q, want the resolved one", w.Body)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "net/http"
+
+// Mixins are optional features added to the app when it is rendered, such
+// as a Postgres pool with golang+postgres. Each brings its own files and
+// is wired in here: mixinSettings joins the settings table (config.go)
+// and setupMixins runs every mixin's setup, in order, before setupApp, so
+// the app's own code can use what they open. openluffy writes this file;
+// this app was rendered without mixins.
+
+var mixinSettings []setting
+
+func setupMixins(mux *http.ServeMux) error {
+	return nil
+}
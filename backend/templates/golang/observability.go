@@ -0,0 +1,68 @@
+package main
+
+import "strings"
+
+// Observability defaults by environment. ENVIRONMENT selects a profile
+// whose values stand in for the settings table's defaults, so a laptop
+// gets readable logs and pprof and production gets JSON logs, sampled
+// traces and no pprof, without either configuring anything:
+//
+//	                         development  staging  production
+//	LOG_FORMAT               text         json     json
+//	LOG_SOURCE               true         false    false
+//	ENABLE_PPROF             true         false    false
+//	OTEL_TRACES_SAMPLER_ARG  1            0.5      0.1
+//
+// /metrics is served in every profile: Prometheus scraping a development
+// cluster costs nothing, and production is where it is needed.
+//
+// A setting given explicitly, in the environment, a NAME_FILE, the remote
+// document or CONFIG_FILE, always wins over its profile value, so
+// ENABLE_PPROF=true still turns pprof on in production. dev and local are
+// development; stage, test, qa, uat and preprod are staging; prod,
+// production and any environment not named here are production, so an
+// unfamiliar name gets the cautious defaults.
+
+// observabilityProfiles are the per-environment defaults, by profile and
+// setting.
+var observabilityProfiles = map[string]map[string]string{
+	"development": {
+		"LOG_FORMAT":              "text",
+		"LOG_SOURCE":              "true",
+		"ENABLE_PPROF":            "true",
+		"OTEL_TRACES_SAMPLER_ARG": "1",
+	},
+	"staging": {
+		"LOG_FORMAT":              "json",
+		"LOG_SOURCE":              "false",
+		"ENABLE_PPROF":            "false",
+		"OTEL_TRACES_SAMPLER_ARG": "0.5",
+	},
+	"production": {
+		"LOG_FORMAT":              "json",
+		"LOG_SOURCE":              "false",
+		"ENABLE_PPROF":            "false",
+		"OTEL_TRACES_SAMPLER_ARG": "0.1",
+	},
+}
+
+// observabilityProfile names the profile of the environment env.
+func observabilityProfile(env string) string {
+	switch strings.ToLower(strings.TrimSpace(env)) {
+	case "", "dev", "development", "local":
+		return "development"
+	case "stage", "staging", "test", "qa", "uat", "preprod":
+		return "staging"
+	default:
+		return "production"
+	}
+}
+
+// profileDefault returns the profile value of s for the environment src
+// configures, if its profile sets s. It reads ENVIRONMENT as rawSetting
+// does rather than through conf, which would come back here.
+func profileDefault(s *setting, src *configSources) (string, bool) {
+	env := rawSetting(settingIndex["ENVIRONMENT"], src)
+	v, ok := observabilityProfiles[observabilityProfile(env)][s.name]
+	return v, ok
+}
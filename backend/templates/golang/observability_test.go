@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestObservabilityProfile(t *testing.T) {
+	for env, want := range map[string]map[string]string{
+		"":           {"LOG_FORMAT": "text", "LOG_SOURCE": "true", "ENABLE_PPROF": "true", "OTEL_TRACES_SAMPLER_ARG": "1"},
+		"Dev":        {"LOG_FORMAT": "text", "ENABLE_PPROF": "true"},
+		"staging":    {"LOG_FORMAT": "json", "LOG_SOURCE": "false", "ENABLE_PPROF": "false", "OTEL_TRACES_SAMPLER_ARG": "0.5"},
+		"qa":         {"OTEL_TRACES_SAMPLER_ARG": "0.5"},
+		"production": {"LOG_FORMAT": "json", "LOG_SOURCE": "false", "ENABLE_PPROF": "false", "OTEL_TRACES_SAMPLER_ARG": "0.1"},
+		"eu-west":    {"ENABLE_PPROF": "false", "OTEL_TRACES_SAMPLER_ARG": "0.1"},
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("ENVIRONMENT", env)
+			src := loadConfigSources()
+			for name, v := range want {
+				if got := settingIndex[name].effective(src); got != v {
+					t.Errorf("%s = %q, want %q", name, got, v)
+				}
+			}
+			// Settings no profile sets keep the table's default.
+			if got := settingIndex["LOG_LEVEL"].effective(src); got != "info" {
+				t.Errorf("LOG_LEVEL = %q, want the default info", got)
+			}
+		})
+	}
+}
+
+func TestObservabilityProfileOverrides(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(file, []byte("OTEL_TRACES_SAMPLER_ARG: 0.25\n"), 0o600)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("ENVIRONMENT", "production")
+	t.Setenv("ENABLE_PPROF", "true")
+	t.Setenv("LOG_FORMAT", "yaml")
+
+	src := loadConfigSources()
+	for name, want := range map[string]string{
+		"ENABLE_PPROF":            "true", // the environment over the profile
+		"OTEL_TRACES_SAMPLER_ARG": "0.25", // CONFIG_FILE over the profile
+		"LOG_FORMAT":              "json", // an invalid value falls back to it
+	} {
+		if got := settingIndex[name].effective(src); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for name, want := range map[string]string{"ENABLE_PPROF": "env", "LOG_SOURCE": "profile", "LOG_LEVEL": "default"} {
+		if got := settingSource(settingIndex[name], src); got != want {
+			t.Errorf("source of %s = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAPI 3.1 description of the API, generated from the routes as they
+// are registered rather than written by hand, so it cannot drift from
+// the code. Register each route with handleAPI instead of mux.HandleFunc,
+// describing what the handler reads and writes:
+//
+//	handleAPI(mux, "GET /items/{id}", apiDoc{
+//		Summary:  "Fetch an item",
+//		Response: item{},
+//		Errors:   []int{http.StatusNotFound},
+//	}, getItem)
+//
+// Request and response schemas are derived from the Go types through their
+// json tags: fields without omitempty or omitzero are required. Path
+// parameters come from the pattern, the operation ID from the handler's
+// name, and routes with a Request body also document the 400, 413 and 415
+// answers of readJSON. A route with a Schema validates its body against
+// it (jsonschema.go) and documents the schema rather than the derived one.
+// The document is served on GET /openapi.json.
+//
+//	OPENAPI_UI  "true" also serves Swagger UI on /docs, loaded from a CDN
+
+// openAPISettings are the settings of the OpenAPI endpoints. An app that
+// serves them adds them to its appSettings.
+var openAPISettings = []setting{
+	{name: "OPENAPI_UI", kind: kindBool, def: "false"},
+}
+
+// swaggerUIVersion is the swagger-ui-dist release /docs loads.
+const swaggerUIVersion = "5.17.14"
+
+// apiDoc describes a route for the OpenAPI document.
+type apiDoc struct {
+	Summary  string
+	Params   []apiParam // query parameters, and types for path parameters
+	Request  any        // a value of the request body type, nil for none
+	Schema   string     // JSON Schema the body must match (jsonschema.go)
+	Response any        // a value of the success body type, nil for none
+	Status   int        // success status, default 200
+	Errors   []int      // error statuses, answered with the error shape
+}
+
+// apiParam is a query or path parameter. Type is a JSON schema type, by
+// default "string".
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+type apiOperation struct {
+	method, path string
+	id           string
+	doc          apiDoc
+}
+
+var (
+	apiMu         sync.Mutex
+	apiOperations []apiOperation
+)
+
+// handleAPI registers h on mux for pattern ("METHOD /path") and adds the
+// route to the OpenAPI document.
+func handleAPI(mux *http.ServeMux, pattern string, doc apiDoc, h http.HandlerFunc) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		panic("handleAPI: pattern " + pattern + " has no method")
+	}
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	if doc.Schema != "" {
+		schema, err := compileSchema([]byte(doc.Schema))
+		if err != nil {
+			panic("handleAPI: " + pattern + ": invalid schema: " + err.Error())
+		}
+		h = schema.validateBody(h)
+	}
+	mux.HandleFunc(pattern, h)
+
+	op := apiOperation{method: strings.ToLower(method), path: path, id: name[strings.LastIndex(name, ".")+1:], doc: doc}
+	apiMu.Lock()
+	defer apiMu.Unlock()
+	// The same route registered again, on another mux, replaces the first.
+	apiOperations = slices.DeleteFunc(apiOperations, func(o apiOperation) bool { return o.method == op.method && o.path == op.path })
+	apiOperations = append(apiOperations, op)
+}
+
+// registerOpenAPI serves the document, and Swagger UI with OPENAPI_UI.
+func registerOpenAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /openapi.json", openAPIHandler)
+	if confBool("OPENAPI_UI") {
+		mux.HandleFunc("GET /docs", swaggerUIHandler)
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument())
+}
+
+var pathParam = regexp.MustCompile(`\{([A-Za-z0-9_]+)\.{0,3}\}`)
+
+// openAPIDocument builds the document from the registered routes.
+func openAPIDocument() map[string]any {
+	schemas := map[string]any{
+		"error": map[string]any{
+			"type":     "object",
+			"required": []string{"code", "message", "error", "request_id"},
+			"properties": map[string]any{
+				"code":       map[string]any{"type": "string", "description": "The status's reason phrase in snake_case, such as not_found."},
+				"message":    map[string]any{"type": "string"},
+				"error":      map[string]any{"type": "string", "description": "The message, for clients of the earlier shape.", "deprecated": true},
+				"request_id": map[string]any{"type": "string"},
+				"violations": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type":     "object",
+						"required": []string{"path", "message"},
+						"properties": map[string]any{
+							"path":    map[string]any{"type": "string"},
+							"message": map[string]any{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+	}
+	apiMu.Lock()
+	ops := slices.Clone(apiOperations)
+	apiMu.Unlock()
+
+	paths := map[string]map[string]any{}
+	for _, op := range ops {
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][op.method] = op.document(schemas)
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   serviceName,
+			"version": version.GitSHA,
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// document returns the operation object, adding the schemas it uses.
+func (op apiOperation) document(schemas map[string]any) map[string]any {
+	params := []any{}
+	declared := map[string]apiParam{}
+	for _, p := range op.doc.Params {
+		declared[p.Name] = p
+	}
+	for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+		p := declared[m[1]]
+		delete(declared, m[1])
+		p.Name = m[1]
+		params = append(params, p.document("path", true))
+	}
+	for _, p := range op.doc.Params {
+		if _, ok := declared[p.Name]; ok {
+			params = append(params, p.document("query", false))
+		}
+	}
+
+	responses := map[string]any{}
+	status := op.doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if op.doc.Response != nil {
+		success["content"] = jsonContent(schemaOf(reflect.TypeOf(op.doc.Response), schemas))
+	}
+	responses[strconv.Itoa(status)] = success
+
+	errorStatuses := slices.Clone(op.doc.Errors)
+	doc := map[string]any{
+		"operationId": op.id,
+		"summary":     op.doc.Summary,
+		"parameters":  params,
+	}
+	if op.doc.Request != nil || op.doc.Schema != "" {
+		var body any
+		if op.doc.Schema != "" {
+			body = json.RawMessage(op.doc.Schema)
+		} else {
+			body = schemaOf(reflect.TypeOf(op.doc.Request), schemas)
+		}
+		doc["requestBody"] = map[string]any{
+			"required": true,
+			"content":  jsonContent(body),
+		}
+		errorStatuses = append(errorStatuses, http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType)
+	}
+	for _, code := range errorStatuses {
+		responses[strconv.Itoa(code)] = map[string]any{
+			"description": http.StatusText(code),
+			"content":     jsonContent(map[string]any{"$ref": "#/components/schemas/error"}),
+		}
+	}
+	doc["responses"] = responses
+	return doc
+}
+
+func (p apiParam) document(in string, required bool) map[string]any {
+	typ := p.Type
+	if typ == "" {
+		typ = "string"
+	}
+	doc := map[string]any{"name": p.Name, "in": in, "required": required, "schema": map[string]any{"type": typ}}
+	if p.Description != "" {
+		doc["description"] = p.Description
+	}
+	return doc
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// schemaOf returns the JSON schema of t as encoding/json writes it. Named
+// structs go into schemas and are referenced.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // placeholder, for types that refer to themselves
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			required = append(required, name)
+		}
+	}
+	return map[string]any{"type": "object", "properties": props, "required": required}
+}
+
+// swaggerUIHandler serves Swagger UI for /openapi.json.
+func swaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%[1]s API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@%[2]s/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@%[2]s/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`, serviceName, swaggerUIVersion)
+}
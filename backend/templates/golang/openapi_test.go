@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testWidget struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Tags    []string  `json:"tags,omitempty"`
+	Created time.Time `json:"created_at"`
+	secret  string
+}
+
+type testWidgetInput struct {
+	Name string `json:"name"`
+}
+
+func getTestWidget(w http.ResponseWriter, r *http.Request) {}
+
+func createTestWidget(w http.ResponseWriter, r *http.Request) {}
+
+func TestOpenAPIDocument(t *testing.T) {
+	saved := apiOperations
+	t.Cleanup(func() { apiOperations = saved })
+	apiOperations = nil
+
+	mux := http.NewServeMux()
+	handleAPI(mux, "GET /widgets/{id}", apiDoc{
+		Summary:  "Fetch a widget",
+		Params:   []apiParam{{Name: "id", Type: "integer"}, {Name: "fields", Description: "fields to return"}},
+		Response: testWidget{},
+		Errors:   []int{http.StatusNotFound},
+	}, getTestWidget)
+	handleAPI(mux, "POST /widgets", apiDoc{Request: testWidgetInput{}, Response: testWidget{}, Status: http.StatusCreated}, createTestWidget)
+	registerOpenAPI(mux)
+
+	w := do(mux, "GET", "/openapi.json", nil)
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Parameters  []struct {
+				Name, In string
+				Required bool
+				Schema   map[string]string
+			}
+			RequestBody map[string]any            `json:"requestBody"`
+			Responses   map[string]map[string]any `json:"responses"`
+		}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]any
+				Required   []string
+			}
+		}
+	}
+	decode(t, w, &doc)
+	if w.Code != http.StatusOK || doc.OpenAPI != "3.1.0" {
+		t.Fatalf("GET /openapi.json = %d, openapi %q", w.Code, doc.OpenAPI)
+	}
+
+	get := doc.Paths["/widgets/{id}"]["get"]
+	if get.OperationID != "getTestWidget" || len(get.Parameters) != 2 {
+		t.Fatalf("GET /widgets/{id} = %+v, want getTestWidget with two parameters", get)
+	}
+	if p := get.Parameters[0]; p.Name != "id" || p.In != "path" || !p.Required || p.Schema["type"] != "integer" {
+		t.Errorf("first parameter %+v, want the required integer path id", p)
+	}
+	if p := get.Parameters[1]; p.Name != "fields" || p.In != "query" || p.Required {
+		t.Errorf("second parameter %+v, want the optional query fields", p)
+	}
+	if _, ok := get.Responses["404"]; !ok || get.Responses["200"] == nil {
+		t.Errorf("GET /widgets/{id} responses %v, want 200 and 404", get.Responses)
+	}
+
+	post := doc.Paths["/widgets"]["post"]
+	for _, code := range []string{"201", "400", "413", "415"} {
+		if post.Responses[code] == nil {
+			t.Errorf("POST /widgets has no %s response: %v", code, post.Responses)
+		}
+	}
+	if post.RequestBody == nil {
+		t.Error("POST /widgets has no request body")
+	}
+
+	widget := doc.Components.Schemas["testWidget"]
+	if strings.Join(widget.Required, ",") != "id,name,created_at" {
+		t.Errorf("testWidget required %v, want the fields without omitempty", widget.Required)
+	}
+	if widget.Properties["created_at"]["format"] != "date-time" || widget.Properties["tags"]["type"] != "array" {
+		t.Errorf("testWidget properties %v", widget.Properties)
+	}
+	if _, ok := widget.Properties["secret"]; ok {
+		t.Error("testWidget documents an unexported field")
+	}
+
+	if w := do(mux, "GET", "/docs", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /docs without OPENAPI_UI = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests for the platform endpoints every Go template serves. They call the
+// handlers through httptest, so they need no listener and no dependencies.
+// The helpers here are shared with the app's own tests.
+
+// TestMain keeps the log lines handlers write out of the test output,
+// unless the tests run with -v.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// do serves one request with h and returns the recorded response.
+func do(h http.Handler, method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decode unmarshals a JSON response body into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+}
+
+// withChecks swaps in empty liveness and readiness lists for one test.
+func withChecks(t *testing.T) {
+	t.Helper()
+	liveness, readiness := livenessChecks, readinessChecks
+	livenessChecks, readinessChecks = healthChecks{}, healthChecks{}
+	t.Cleanup(func() { livenessChecks, readinessChecks = liveness, readiness })
+}
+
+func failingCheck(context.Context) error { return errors.New("connection refused") }
+
+func TestHealthz(t *testing.T) {
+	withChecks(t)
+
+	w := do(http.HandlerFunc(healthHandler), "GET", "/healthz", nil)
+	var resp HealthResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Status != "healthy" {
+		t.Fatalf("GET /healthz = %d %q, want 200 healthy", w.Code, resp.Status)
+	}
+
+	w = do(http.HandlerFunc(healthHandler), "GET", "/healthz", nil, "Accept", "text/plain")
+	if got := w.Body.String(); w.Code != http.StatusOK || got != "healthy\n" {
+		t.Fatalf("GET /healthz as text = %d %q, want 200 \"healthy\\n\"", w.Code, got)
+	}
+}
+
+func TestHealthzFailingCheck(t *testing.T) {
+	withChecks(t)
+	livenessChecks.register("deadlock", checkFunc(failingCheck), 0)
+
+	w := do(http.HandlerFunc(healthHandler), "GET", "/healthz", nil)
+	var resp HealthResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Failing["deadlock"] == "" {
+		t.Fatalf("GET /healthz = %d %+v, want 503 failing deadlock", w.Code, resp)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	withChecks(t)
+
+	w := do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /readyz = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	readinessChecks.register("db", checkFunc(failingCheck), 0)
+	w = do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil)
+	var resp ReadinessResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Status != "not ready" || resp.Failing["db"] == "" {
+		t.Fatalf("GET /readyz with a failing check = %d %+v, want 503 not ready", w.Code, resp)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	withChecks(t)
+	t.Cleanup(func() {
+		shutdownState.mu.Lock()
+		shutdownState.draining, shutdownState.requested = false, false
+		shutdownState.mu.Unlock()
+	})
+	t.Setenv("ADMIN_PASSWORD", "s3cret-admin-pass")
+	mux := http.NewServeMux()
+	registerDrain(mux)
+	admin := basicAuth("admin", "s3cret-admin-pass")
+	post := func(body string, header ...string) *httptest.ResponseRecorder {
+		return do(mux, "POST", "/drain", strings.NewReader(body), append([]string{"Content-Type", "application/json"}, header...)...)
+	}
+
+	var resp DrainResponse
+	w := do(mux, "GET", "/drain", nil)
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Draining {
+		t.Fatalf("GET /drain while serving = %d %+v, want 200 not draining", w.Code, resp)
+	}
+	if w := post(`{"draining": true}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /drain without credentials = %d, want 401", w.Code)
+	}
+	if w := post(`{}`, admin...); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /drain without draining = %d, want 400", w.Code)
+	}
+
+	if w := post(`{"draining": true}`, admin...); w.Code != http.StatusOK {
+		t.Fatalf("POST /drain with the admin credentials = %d, want 200: %s", w.Code, w.Body)
+	}
+	w = do(mux, "GET", "/drain", nil)
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || !resp.Draining || resp.Reason != "drain requested" {
+		t.Fatalf("GET /drain after POST = %d %+v, want 503 drain requested", w.Code, resp)
+	}
+	if w := do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz while draining = %d, want 503", w.Code)
+	}
+
+	if w := post(`{"draining": false}`, admin...); w.Code != http.StatusOK {
+		t.Fatalf("POST /drain to cancel = %d, want 200", w.Code)
+	}
+	if w := do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /readyz after the drain was cancelled = %d, want 200", w.Code)
+	}
+
+	beginDrain(time.Minute)
+	if w := post(`{"draining": false}`, admin...); w.Code != http.StatusConflict {
+		t.Errorf("POST /drain to cancel a SIGTERM drain = %d, want 409", w.Code)
+	}
+
+	t.Setenv("ADMIN_PASSWORD", "")
+	mux = http.NewServeMux()
+	registerDrain(mux)
+	if w := do(mux, "POST", "/drain", strings.NewReader(`{"draining": true}`)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /drain on the app port without admin credentials = %d, want 405", w.Code)
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	withChecks(t)
+	t.Setenv("HEALTH_CACHE_TTL", "1h")
+	t.Setenv("HEALTH_DETAIL", "true")
+	var calls atomic.Int32
+	release := make(chan struct{})
+	readinessChecks.register("db", checkFunc(func(ctx context.Context) error {
+		calls.Add(1)
+		<-release
+		return errors.New("connection refused")
+	}), 0)
+
+	// A storm of probes runs the check once; the rest wait for it.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Failures are cached too, and marked as such.
+	w := do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil)
+	var resp ReadinessResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || len(resp.Checks) != 1 || !resp.Checks[0].Cached || resp.Failing["db"] != "connection refused" {
+		t.Errorf("GET /readyz = %d %+v, want the cached failure", w.Code, resp)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("check ran %d times for 11 probes, want once", n)
+	}
+
+	t.Setenv("HEALTH_CACHE_TTL", "1ns")
+	do(http.HandlerFunc(readinessHandler), "GET", "/readyz", nil)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("check ran %d times after the TTL passed, want twice", n)
+	}
+}
+
+func TestHealthCacheDetached(t *testing.T) {
+	withChecks(t)
+	t.Setenv("HEALTH_CACHE_TTL", "1h")
+	readinessChecks.register("db", checkFunc(func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return ctx.Err()
+	}), 0)
+
+	// The first prober hangs up; the result cached for the others must
+	// not be its cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	readinessChecks.run(ctx)
+	if results := readinessChecks.run(context.Background()); results[0].Err != nil {
+		t.Errorf("cached result after the first prober left = %v, want the check's own result", results[0].Err)
+	}
+}
+
+// TestHealthCheckPool registers more checks than HEALTH_CHECK_CONCURRENCY
+// and holds them: only that many run, or even have a goroutine, at once.
+func TestHealthCheckPool(t *testing.T) {
+	withChecks(t)
+	t.Setenv("HEALTH_CHECK_CONCURRENCY", "2")
+	var running, most atomic.Int32
+	release := make(chan struct{})
+	for i := range 50 {
+		readinessChecks.register(fmt.Sprintf("dep-%d", i), checkFunc(func(ctx context.Context) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+			<-release
+			return nil
+		}), 0)
+	}
+
+	before := runtime.NumGoroutine()
+	done := make(chan []checkResult)
+	go func() { done <- readinessChecks.run(context.Background()) }()
+	for running.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if extra := runtime.NumGoroutine() - before; extra > 10 {
+		t.Errorf("%d goroutines for 50 checks held at 2 at a time, want a pool of 2", extra)
+	}
+	close(release)
+	results := <-done
+
+	if n := most.Load(); n != 2 {
+		t.Errorf("%d checks ran at once, want HEALTH_CHECK_CONCURRENCY=2", n)
+	}
+	for i, r := range results {
+		if want := fmt.Sprintf("dep-%d", i); r.Name != want || r.Err != nil {
+			t.Fatalf("result %d = %s %v, want %s passing, in registration order", i, r.Name, r.Err, want)
+		}
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	withChecks(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer auth.Close()
+	script := filepath.Join(t.TempDir(), "disk-free")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho checking\necho disk full >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DEPENDENCIES", "db=tcp://"+ln.Addr().String()+","+auth.URL+"/healthz?deep=1,cmd:"+script+",cmd:true,slow=cmd:sleep 5")
+	t.Setenv("HEALTH_CHECK_TIMEOUTS", "slow=100ms")
+	if err := registerDependencies(); err != nil {
+		t.Fatalf("registerDependencies: %v", err)
+	}
+
+	results := map[string]error{}
+	for _, r := range readinessChecks.run(context.Background()) {
+		results[r.Name] = r.Err
+	}
+	for name, want := range map[string]string{
+		"db":        "",
+		"127.0.0.1": "",
+		"true":      "",
+		"disk-free": "exit status 1: disk full",
+		"slow":      "context deadline exceeded",
+	} {
+		err, ok := results[name]
+		switch {
+		case !ok:
+			t.Errorf("no check named %q in %v", name, results)
+		case want == "" && err != nil, want != "" && (err == nil || err.Error() != want):
+			t.Errorf("check %s = %v, want %q", name, err, want)
+		}
+	}
+
+	for entries, want := range map[string]string{
+		"tcp://a:1,tcp://a:2":        "name used twice",
+		"cmd:/no/such/check":         "no such file",
+		"cmd:":                       "missing command",
+		"queue=amqp://rabbit:5672":   "unsupported scheme",
+		"db=":                        "want [name=]target",
+		"http://auth:8080/%zzhealth": "invalid URL escape",
+	} {
+		withChecks(t)
+		t.Setenv("DEPENDENCIES", entries)
+		if err := registerDependencies(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("DEPENDENCIES=%s: got %v, want an error with %q", entries, err, want)
+		}
+	}
+}
+
+func TestStartupz(t *testing.T) {
+	w := do(http.HandlerFunc(startupHandler), "GET", "/startupz", nil)
+	var resp StartupResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Status != "started" {
+		t.Fatalf("GET /startupz = %d %q, want 200 started", w.Code, resp.Status)
+	}
+}
+
+func TestStartupWait(t *testing.T) {
+	withChecks(t)
+	t.Setenv("STARTUP_WAIT_FOR", "db,cache")
+	var dbCalls atomic.Int32
+	readinessChecks.register("db", checkFunc(func(context.Context) error {
+		if dbCalls.Add(1) < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}), 0)
+	readinessChecks.register("queue", checkFunc(failingCheck), 0)
+
+	w := newStartupWait()
+	if err := w.wait(context.Background(), false); err != nil || dbCalls.Load() != 3 {
+		t.Fatalf("wait = %v after %d tries, want db ready on the third; queue is not waited for", err, dbCalls.Load())
+	}
+	// cache is registered by setupApp, between the phases.
+	readinessChecks.register("cache", checkFunc(func(context.Context) error { return nil }), 0)
+	if err := w.wait(context.Background(), true); err != nil {
+		t.Fatalf("final wait = %v, want cache ready", err)
+	}
+
+	t.Setenv("STARTUP_WAIT_FOR", "db,typo")
+	if err := newStartupWait().wait(context.Background(), true); err == nil || !strings.Contains(err.Error(), `"typo"`) {
+		t.Errorf("wait for an unknown check = %v, want a configuration error", err)
+	}
+}
+
+func TestStartupWaitTimeout(t *testing.T) {
+	withChecks(t)
+	t.Setenv("STARTUP_WAIT_FOR", "*")
+	t.Setenv("STARTUP_WAIT_TIMEOUT", "300ms")
+	readinessChecks.register("db", checkFunc(failingCheck), 0)
+
+	start := time.Now()
+	err := newStartupWait().wait(context.Background(), true)
+	if err == nil || !strings.Contains(err.Error(), "not ready after 300ms: db") || time.Since(start) > 2*time.Second {
+		t.Errorf("wait for a dependency that never comes up = %v after %s, want a timeout", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newStartupWait().wait(ctx, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait after a shutdown signal = %v, want context.Canceled", err)
+	}
+}
+func TestVersion(t *testing.T) {
+	w := do(http.HandlerFunc(versionHandler), "GET", "/version", nil)
+	var resp VersionResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.GoVersion == "" || resp.TemplateVersion != templateVersion {
+		t.Fatalf("GET /version = %d %+v", w.Code, resp)
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	h := http.HandlerFunc(attestationHandler)
+	if w := do(h, "GET", "/.well-known/openluffy-attestation", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("GET attestation without one stamped = %d, want 404", w.Code)
+	}
+
+	saved := attestationToken
+	t.Cleanup(func() { attestationToken = saved })
+	attestationToken = "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"acme","template":"golang"}`)) + ".c2ln"
+	w := do(h, "GET", "/.well-known/openluffy-attestation", nil)
+	var resp struct {
+		Token  string            `json:"token"`
+		Claims map[string]string `json:"claims"`
+	}
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Token != attestationToken || resp.Claims["sub"] != "acme" || resp.Claims["template"] != "golang" {
+		t.Fatalf("GET attestation = %d %+v, want the token and its claims", w.Code, resp)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	t.Setenv("POD_NAME", "app-7d9f8-x2k4q")
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("POD_NAMESPACE", "customer-a")
+	w := do(http.HandlerFunc(infoHandler), "GET", "/api/info", nil)
+	var resp InfoResponse
+	decode(t, w, &resp)
+	want := InfoResponse{App: serviceName, Environment: environment, Version: version.GitSHA, Pod: "app-7d9f8-x2k4q", Node: "node-1", Namespace: "customer-a"}
+	if w.Code != http.StatusOK || resp != want {
+		t.Fatalf("GET /api/info = %d %+v, want %+v", w.Code, resp, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/metrics", metricsHandler)
+	h := metricsMiddleware(mux, mux)
+
+	do(h, "GET", "/ping", nil)
+	w := do(h, "GET", "/metrics", nil)
+	want := `http_requests_total{method="GET",route="/ping",status_class="2xx"}`
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("GET /metrics = %d, want a line starting %s in:\n%s", w.Code, want, w.Body)
+	}
+	if strings.Contains(w.Body.String(), `code="`) {
+		t.Errorf("code label without METRICS_STATUS_CODES:\n%s", w.Body)
+	}
+}
+
+func TestMetricsStatusCodes(t *testing.T) {
+	t.Setenv("METRICS_STATUS_CODES", "true")
+	t.Cleanup(func() { metrics.statusCodes.Store(false) })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/teapot", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	mux.HandleFunc("/metrics", metricsHandler)
+	h := metricsMiddleware(mux, mux)
+
+	do(h, "GET", "/teapot", nil)
+	body := do(h, "GET", "/metrics", nil).Body.String()
+	if want := `http_requests_total{method="GET",route="/teapot",code="418",status_class="4xx"}`; !strings.Contains(body, want) {
+		t.Errorf("METRICS_STATUS_CODES=true: want a line starting %s in:\n%s", want, body)
+	}
+
+	// Off again, the same requests are folded into their class.
+	metrics.statusCodes.Store(false)
+	body = do(h, "GET", "/metrics", nil).Body.String()
+	if want := `http_requests_total{method="GET",route="/teapot",status_class="4xx"} 1`; !strings.Contains(body, want) {
+		t.Errorf("METRICS_STATUS_CODES=false: want %s in:\n%s", want, body)
+	}
+}
+
+func TestMetricsMethodLabel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/metrics", metricsHandler)
+	h := metricsMiddleware(mux, mux)
+
+	for i := range 3 {
+		do(h, fmt.Sprintf("SCAN%d", i), "/ping", nil)
+	}
+	body := do(h, "GET", "/metrics", nil).Body.String()
+	if strings.Contains(body, `method="SCAN`) || !strings.Contains(body, `http_requests_total{method="OTHER",route="/ping",status_class="2xx"}`) {
+		t.Errorf("made-up methods not counted as OTHER:\n%s", body)
+	}
+}
+
+// TestMetricsSlowScrape checks a scrape stuck writing to its client does
+// not hold up the requests being observed.
+func TestMetricsSlowScrape(t *testing.T) {
+	// Enough series that the handler writes before it has read them all.
+	for i := range 100 {
+		metrics.observe("GET", fmt.Sprintf("/slow-scrape/%d", i), 200, time.Millisecond)
+	}
+	stuck := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+	defer close(stuck.release)
+	go metricsHandler(stuck, httptest.NewRequest("GET", "/metrics", nil))
+	<-stuck.writing
+
+	done := make(chan struct{})
+	go func() {
+		metrics.observe("GET", "/ping", 200, time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("observe blocked behind a scrape writing to a slow client")
+	}
+}
+
+// blockingWriter blocks its first Write until release is closed.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	once    sync.Once
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestSLOMetrics(t *testing.T) {
+	t.Cleanup(func() { metrics.slo.Store(0) })
+	t.Setenv("SLO_LATENCY_THRESHOLD", "20ms")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) { time.Sleep(30 * time.Millisecond) })
+	mux.HandleFunc("/metrics", metricsHandler)
+	h := metricsMiddleware(mux, mux)
+
+	do(h, "GET", "/fast", nil)
+	do(h, "GET", "/slow", nil)
+	do(h, "GET", "/slow", nil)
+	body := do(h, "GET", "/metrics", nil).Body.String()
+	for _, want := range []string{
+		`http_requests_slo_exceeded_total{method="GET",route="/slow"} 2` + "\n",
+		"http_request_slo_threshold_seconds 0.02\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `http_requests_slo_exceeded_total{method="GET",route="/fast"}`) {
+		t.Errorf("/fast counted as exceeding the SLO:\n%s", body)
+	}
+}
+
+func TestShutdownCounts(t *testing.T) {
+	t.Cleanup(func() {
+		metrics.phase.Store(phaseServing)
+		metrics.drained.Store(0)
+		metrics.cancelled.Store(0)
+	})
+	release := map[string]chan struct{}{"/fast": make(chan struct{}), "/slow": make(chan struct{}), "/stuck": make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { <-release[r.URL.Path] })
+	h := metricsMiddleware(mux, mux)
+
+	var wg sync.WaitGroup
+	for path := range release {
+		wg.Add(1)
+		go func() { defer wg.Done(); do(h, "GET", path, nil) }()
+	}
+	for metrics.inFlight.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	done := func(path string, want int64) {
+		close(release[path])
+		for metrics.inFlight.Load() > want {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if n := metrics.beginDraining(); n != 3 {
+		t.Fatalf("in flight at shutdown = %d, want 3", n)
+	}
+	done("/fast", 2)
+	metrics.beginForced()
+	done("/slow", 1)
+	if drained, cancelled := metrics.shutdownCounts(); drained != 1 || cancelled != 2 {
+		t.Errorf("shutdown counts = %d drained, %d cancelled; want 1 and 2, counting the stuck request", drained, cancelled)
+	}
+	close(release["/stuck"])
+	wg.Wait()
+}
+
+func TestRobotsTxt(t *testing.T) {
+	t.Setenv("ROBOTS_TXT", "User-agent: *\nDisallow: /private")
+	w := do(http.HandlerFunc(robotsHandler), "GET", "/robots.txt", nil)
+	if got := w.Body.String(); got != "User-agent: *\nDisallow: /private" {
+		t.Fatalf("GET /robots.txt = %q, want ROBOTS_TXT", got)
+	}
+
+	t.Setenv("ROBOTS_TXT", "off")
+	if w := do(http.HandlerFunc(robotsHandler), "GET", "/robots.txt", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("GET /robots.txt with ROBOTS_TXT=off = %d, want 404", w.Code)
+	}
+}
+
+func TestSecurityTxt(t *testing.T) {
+	if w := do(http.HandlerFunc(securityTxtHandler), "GET", "/.well-known/security.txt", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("GET security.txt without a contact = %d, want 404", w.Code)
+	}
+
+	t.Setenv("SECURITY_CONTACT", "security@example.com")
+	w := do(http.HandlerFunc(securityTxtHandler), "GET", "/.well-known/security.txt", nil)
+	if !strings.HasPrefix(w.Body.String(), "Contact: mailto:security@example.com\nExpires: ") {
+		t.Fatalf("GET security.txt = %q, want a mailto contact", w.Body)
+	}
+}
+
+func TestDebugEcho(t *testing.T) {
+	h := http.HandlerFunc(echoHandler)
+	if w := do(h, "GET", "/debug/echo", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("GET /debug/echo without DEBUG_ECHO = %d, want 404", w.Code)
+	}
+
+	t.Setenv("DEBUG_ECHO", "true")
+	w := do(h, "GET", "/debug/echo?x=1", nil,
+		"X-Forwarded-For", "203.0.113.7, 10.0.0.2",
+		"Authorization", "Bearer secret-token",
+		"X-API-Key", "secret-key",
+		"X-Custom", "kept")
+	var resp echoResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.URI != "/debug/echo?x=1" || resp.ClientIP != "192.0.2.1" || resp.TLS != nil {
+		t.Fatalf("GET /debug/echo = %d %+v, want the request as received over plain HTTP", w.Code, resp)
+	}
+	if len(resp.ForwardedFor) != 2 || resp.ForwardedFor[0] != "203.0.113.7" || resp.ForwardedFor[1] != "10.0.0.2" {
+		t.Errorf("forwarded_for = %q, want the X-Forwarded-For hops in order", resp.ForwardedFor)
+	}
+	if got := resp.Headers["X-Custom"]; len(got) != 1 || got[0] != "kept" {
+		t.Errorf("X-Custom header echoed as %q, want kept", got)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("GET /debug/echo echoes credentials: %s", w.Body)
+	}
+}
+
+func TestPlatformMethods(t *testing.T) {
+	withChecks(t)
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { t.Errorf("%s %s reached the catch-all", r.Method, r.URL) })
+
+	if w := do(mux, "HEAD", "/healthz", nil); w.Code != http.StatusOK {
+		t.Errorf("HEAD /healthz = %d, want 200", w.Code)
+	}
+	for _, path := range []string{"/healthz", "/version", "/api/info", "/robots.txt"} {
+		w := do(mux, "POST", path, nil)
+		var resp map[string]string
+		decode(t, w, &resp)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" || resp["error"] != "method not allowed" {
+			t.Errorf("POST %s = %d Allow %q %v, want a JSON 405 allowing GET, HEAD", path, w.Code, w.Header().Get("Allow"), resp)
+		}
+	}
+}
+
+func TestProbePaths(t *testing.T) {
+	withChecks(t)
+	t.Setenv("LIVENESS_PATH", "/ping")
+	t.Setenv("READINESS_PATH", "/status")
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+
+	for path, want := range map[string]int{"/ping": http.StatusOK, "/status": http.StatusOK, "/startupz": http.StatusOK, "/healthz": http.StatusNotFound} {
+		if w := do(mux, "GET", path, nil); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, w.Code, want)
+		}
+	}
+	for _, bad := range []string{"/", "ping", "/status/", "/{id}"} {
+		if checkProbePath(bad) == nil {
+			t.Errorf("probe path %q accepted", bad)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, requestIDFromContext(r.Context()))
+	}))
+
+	w := do(h, "GET", "/", nil, requestIDHeader, "abc-123")
+	if got := w.Header().Get(requestIDHeader); got != "abc-123" || w.Body.String() != "abc-123" {
+		t.Fatalf("request ID = header %q, context %q, want the caller's abc-123", got, w.Body)
+	}
+
+	w = do(h, "GET", "/", nil, requestIDHeader, "bad id\r\n")
+	if got := w.Header().Get(requestIDHeader); len(got) != 32 || got != w.Body.String() {
+		t.Fatalf("request ID for a malformed one = %q, want a fresh 32-character ID", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 2001:db8::1,unix")
+	h := clientIPMiddleware(newTrustedProxies(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientIP(r))
+	}))
+
+	for _, tc := range []struct {
+		name, peer string
+		header     []string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"direct client spoofing", "203.0.113.7:5000", []string{"X-Forwarded-For", "198.51.100.1"}, "203.0.113.7"},
+		{"through the ingress", "10.1.2.3:5000", []string{"X-Forwarded-For", "198.51.100.1"}, "198.51.100.1"},
+		{"client-sent hops ignored", "10.1.2.3:5000", []string{"X-Forwarded-For", "1.1.1.1, 198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"IPv6 proxy", "[2001:db8::1]:443", []string{"X-Forwarded-For", "2001:db8::beef"}, "2001:db8::beef"},
+		{"hop with a port", "10.1.2.3:5000", []string{"X-Forwarded-For", "198.51.100.1:61000"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:5000", []string{"X-Forwarded-For", "10.0.0.9, 10.0.0.8"}, "10.0.0.9"},
+		{"garbage hop", "10.1.2.3:5000", []string{"X-Forwarded-For", "198.51.100.1, not-an-ip, 10.0.0.8"}, "10.0.0.8"},
+		{"X-Real-IP", "10.1.2.3:5000", []string{"X-Real-IP", "198.51.100.2"}, "198.51.100.2"},
+		{"X-Forwarded-For first", "10.1.2.3:5000", []string{"X-Real-IP", "198.51.100.2", "X-Forwarded-For", "198.51.100.1"}, "198.51.100.1"},
+		{"no header", "10.1.2.3:5000", nil, "10.1.2.3"},
+		{"Unix socket", "@", []string{"X-Forwarded-For", "198.51.100.1"}, "198.51.100.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.peer
+		for i := 0; i+1 < len(tc.header); i += 2 {
+			r.Header.Set(tc.header[i], tc.header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("%s: client IP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if err := checkTrustedProxies("10.0.0.0/8,ingress"); err == nil {
+		t.Error("TRUSTED_PROXIES with a host name was accepted")
+	}
+	t.Setenv("TRUSTED_PROXIES", "")
+	if newTrustedProxies() != nil {
+		t.Error("proxies trusted without TRUSTED_PROXIES")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	h := requestIDMiddleware(recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+
+	w := do(h, "GET", "/", nil)
+	var resp map[string]string
+	decode(t, w, &resp)
+	if w.Code != http.StatusInternalServerError || resp["error"] != "internal server error" || resp["request_id"] == "" {
+		t.Fatalf("panicking handler = %d %v, want a JSON 500 with the request ID", w.Code, resp)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	tag := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := chain(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { order = append(order, "handler") }), tag("outer"), tag("inner"))
+	do(h, "GET", "/", nil)
+	if got := strings.Join(order, " "); got != "outer inner handler" {
+		t.Fatalf("chain ran %s, want outer inner handler", got)
+	}
+}
+
+func TestAppMiddleware(t *testing.T) {
+	saved := appMiddleware
+	t.Cleanup(func() { appMiddleware = saved })
+	useMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestIDFromContext(r.Context()) == "" {
+				t.Error("app middleware ran before the request ID was set")
+			}
+			panic("boom")
+		})
+	})
+	w := do(platformHandler(http.NewServeMux(), nil), "GET", "/", nil)
+	if w.Code != http.StatusInternalServerError || w.Header().Get(requestIDHeader) == "" {
+		t.Fatalf("panicking app middleware = %d, want a recovered 500 with a request ID", w.Code)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	t.Setenv("MAX_REQUEST_BODY", "16")
+	t.Cleanup(func() { bodyLimitExempt = nil })
+	exemptBodyLimit("/upload")
+	h := bodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	if w := do(h, "POST", "/items", strings.NewReader(`{"name": "a"}`)); w.Code != http.StatusOK {
+		t.Errorf("POST with a small body = %d, want 200", w.Code)
+	}
+	big := strings.Repeat("a", 17)
+	w := do(h, "POST", "/items", strings.NewReader(big))
+	var resp map[string]string
+	decode(t, w, &resp)
+	if w.Code != http.StatusRequestEntityTooLarge || resp["error"] != "request body larger than 16 bytes" {
+		t.Errorf("POST with a long Content-Length = %d %v, want a JSON 413", w.Code, resp)
+	}
+	// No Content-Length: the limit applies as the handler reads.
+	if w := do(h, "POST", "/items", io.MultiReader(strings.NewReader(big))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST streaming a long body = %d, want 413", w.Code)
+	}
+	if w := do(h, "POST", "/upload", strings.NewReader(big)); w.Code != http.StatusOK {
+		t.Errorf("POST to an exempt path = %d, want 200", w.Code)
+	}
+}
+
+func TestLoadShed(t *testing.T) {
+	t.Setenv("MAX_IN_FLIGHT", "1")
+	t.Setenv("LOAD_SHED_RETRY_AFTER", "1500ms")
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := loadShedMiddleware(newLoadShedder(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	done := make(chan struct{})
+	go func() {
+		do(h, "GET", "/slow", nil)
+		close(done)
+	}()
+	<-entered
+
+	w := do(h, "GET", "/items", nil)
+	var resp map[string]string
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" || resp["error"] != "server overloaded" {
+		t.Errorf("request over MAX_IN_FLIGHT = %d Retry-After %q %v, want a JSON 503 retrying after 2s", w.Code, w.Header().Get("Retry-After"), resp)
+	}
+	if w := do(h, "GET", "/healthz", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /healthz under load = %d, want 200: probes are exempt", w.Code)
+	}
+	close(release)
+	<-done
+	if w := do(h, "GET", "/items", nil); w.Code != http.StatusOK {
+		t.Errorf("request after the slow one finished = %d, want 200", w.Code)
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "1024")
+	t.Setenv("HTTP_KEEP_ALIVES", "false")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config = newServer(h)
+	srv.Start()
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !resp.Close {
+		t.Error("response with HTTP_KEEP_ALIVES=false kept the connection open")
+	}
+
+	// net/http allows 4 KiB of slack over MaxHeaderBytes.
+	req.Header.Set("X-Padding", strings.Repeat("a", 8<<10))
+	resp, err = srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("request over HTTP_MAX_HEADER_BYTES = %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestIdleConns(t *testing.T) {
+	ic := &idleConns{limit: 2}
+	conns := make([]net.Conn, 4)
+	for i := range conns {
+		conns[i], _ = net.Pipe()
+	}
+	closed := func(c net.Conn) bool { return c.SetDeadline(time.Time{}) != nil }
+
+	ic.track(conns[0], http.StateIdle)
+	ic.track(conns[1], http.StateIdle)
+	ic.track(conns[0], http.StateActive)
+	ic.track(conns[2], http.StateIdle)
+	if ic.closed.Load() != 0 {
+		t.Fatalf("closed %d connections with 2 idle, want none", ic.closed.Load())
+	}
+	// conns[1] has now been idle the longest.
+	ic.track(conns[0], http.StateIdle)
+	ic.track(conns[3], http.StateNew)
+	if !closed(conns[1]) || closed(conns[0]) || closed(conns[2]) || ic.closed.Load() != 1 {
+		t.Errorf("over the limit, closed %d; want only the longest-idle connection closed", ic.closed.Load())
+	}
+	ic.track(conns[2], http.StateClosed)
+	if len(ic.idle) != 1 {
+		t.Errorf("%d idle connections tracked after one closed, want 1", len(ic.idle))
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	srv := &http.Server{Addr: "127.0.0.1:0"}
+	first, err := listen(context.Background(), srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	srv.Addr = first.Addr().String()
+	if ln, err := listen(context.Background(), srv); err == nil {
+		ln.Close()
+		t.Fatal("second listener bound the port without HTTP_REUSE_PORT")
+	}
+	first.Close()
+
+	t.Setenv("HTTP_REUSE_PORT", "true")
+	old, err := listen(context.Background(), srv)
+	if err != nil {
+		t.Skip("no SO_REUSEPORT:", err)
+	}
+	defer old.Close()
+	// The new instance binds while the old one still listens.
+	next, err := listen(context.Background(), srv)
+	if err != nil {
+		t.Fatalf("second listener with HTTP_REUSE_PORT: %v", err)
+	}
+	next.Close()
+}
+
+func TestInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Skip("no listener files:", err)
+	}
+	defer f.Close()
+
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if lns, err := listenersFromEnv(2, int(f.Fd())); lns != nil || err != nil || os.Getenv("LISTEN_FDS") != "1" {
+		t.Fatalf("sockets passed to another process = %v, %v; want them left alone", lns, err)
+	}
+	lns, err := listenersFromEnv(1, int(f.Fd()))
+	if err != nil || len(lns) != 1 || lns[0].Addr().String() != ln.Addr().String() {
+		t.Fatalf("inherited = %v, %v; want the listener on %s", lns, err, ln.Addr())
+	}
+	defer lns[0].Close()
+	if _, ok := os.LookupEnv("LISTEN_PID"); ok {
+		t.Error("LISTEN_PID left for child processes")
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "inherited")
+	})}
+	go srv.Serve(lns[0])
+	defer srv.Close()
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "inherited" {
+		t.Errorf("GET over the inherited socket = %q", body)
+	}
+
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "none")
+	if _, err := listenersFromEnv(1, int(f.Fd())); err == nil {
+		t.Error("LISTEN_FDS=none was accepted")
+	}
+}
+
+func TestTCPKeepAlivePeriod(t *testing.T) {
+	for v, want := range map[string]time.Duration{"": defaultTCPKeepAlive, "45s": 45 * time.Second, "off": -1, "-1s": defaultTCPKeepAlive} {
+		t.Setenv("HTTP_TCP_KEEP_ALIVE_PERIOD", v)
+		if got := tcpKeepAlivePeriod(); got != want {
+			t.Errorf("HTTP_TCP_KEEP_ALIVE_PERIOD=%q: period %s, want %s", v, got, want)
+		}
+	}
+}
+
+func TestBindAddr(t *testing.T) {
+	for v, want := range map[string][2]string{
+		"":          {":8080", "127.0.0.1:8080"},
+		"0.0.0.0":   {"0.0.0.0:8080", "127.0.0.1:8080"},
+		"::":        {"[::]:8080", "[::1]:8080"},
+		"[::1]":     {"[::1]:8080", "[::1]:8080"},
+		"10.0.0.5":  {"10.0.0.5:8080", "10.0.0.5:8080"},
+		"localhost": {"localhost:8080", "localhost:8080"},
+		"pod.local": {":8080", "127.0.0.1:8080"},
+	} {
+		t.Setenv("BIND_ADDR", v)
+		if got := [2]string{listenAddr("8080"), selfAddr("8080")}; got != want {
+			t.Errorf("BIND_ADDR=%q: listen on %s, reach at %s; want %s and %s", v, got[0], got[1], want[0], want[1])
+		}
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	withChecks(t)
+	path := filepath.Join(t.TempDir(), "app.sock")
+	t.Setenv("LISTEN_SOCKET", path)
+	t.Setenv("LISTEN_SOCKET_MODE", "0600")
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	srv := newServer(mux)
+
+	// A socket left behind by a killed process is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix sockets:", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(context.Background(), srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, %v, want 0600", fi.Mode().Perm(), err)
+	}
+	if code := runHealthcheck(); code != 0 {
+		t.Errorf("healthcheck over the socket exited %d, want 0", code)
+	}
+
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind after close: %v", err)
+	}
+	os.WriteFile(path, nil, 0o600)
+	if _, err := listen(context.Background(), srv); err == nil {
+		t.Error("listen replaced a regular file at LISTEN_SOCKET")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "sync"
+
+// This file is shared with openluffy-sdk, whose copy is generated from it
+// by ./openluffy.py sdk-sync: it uses no template tags and nothing defined
+// outside it.
+
+// forEachPooled calls f(i) for every i in [0, n) on a fixed pool of at
+// most workers goroutines, which take the indices from a channel, and
+// returns once every call has. However large n is, no more goroutines
+// start than workers.
+func forEachPooled(n, workers int, f func(i int)) {
+	workers = max(min(workers, n), 1)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := range n {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
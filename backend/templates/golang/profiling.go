@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Continuous profiling, for finding production hotspots without
+// port-forwarding to pprof. Off unless PROFILING_URL is set:
+//
+//	PROFILING_URL       the Pyroscope base URL, e.g. http://pyroscope:4040;
+//	                    /ingest is appended
+//	PROFILING_HEADERS   extra headers, "k1=v1,k2=v2", such as Authorization
+//	                    or X-Scope-OrgID for a multi-tenant Pyroscope;
+//	                    secret
+//	PROFILING_TYPES     profiles uploaded: cpu, heap and goroutine
+//	                    (default cpu,heap)
+//	PROFILING_INTERVAL  how often they go out, and how long each CPU
+//	                    profile runs (default 15s)
+//	PROFILING_LABELS    extra labels, "k1=v1,k2=v2", such as region=eu-west-1
+//
+// Every profile is labelled service_name, env and version (the git SHA),
+// plus PROFILING_LABELS. CPU profiles run back to back, each for the
+// interval; heap and goroutine profiles are snapshots taken as each CPU
+// profile ends. The heap profile is the runtime's own: memory in use at
+// the time, and allocations since the process started.
+//
+// Parca, and agents such as Grafana Alloy, pull profiles rather than take
+// uploads: leave PROFILING_URL unset and point them at the /debug/pprof
+// endpoints ENABLE_PPROF serves (pprof.go). Only one CPU profile can run
+// at a time, so a cycle that starts while /debug/pprof/profile is taking
+// one uploads no CPU profile.
+//
+// Uploads are not retried, since the next cycle's follow soon; a failed
+// one is logged and counted in profiling_uploads_total{result="failed"}.
+// On shutdown the running CPU profile is cut short and sent within
+// SHUTDOWN_TIMEOUT.
+
+var profileTypes = []string{"cpu", "heap", "goroutine"}
+
+// profileLabelName is what Pyroscope accepts as a label name.
+var profileLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// profiler uploads profiles to one Pyroscope endpoint.
+type profiler struct {
+	endpoint string
+	headers  map[string]string
+	name     string // the application name with its labels, as /ingest takes it
+	types    []string
+	interval time.Duration
+	client   *http.Client
+
+	done    chan struct{} // closed to stop after a final upload
+	stopped chan struct{} // closed by run once that upload is done
+	once    sync.Once
+
+	sent, failed map[string]*atomic.Uint64 // by profile type
+}
+
+var profiling *profiler
+
+// setupProfiling starts uploading profiles when PROFILING_URL is set.
+func setupProfiling() {
+	base := conf("PROFILING_URL")
+	if base == "" {
+		return
+	}
+
+	labels := map[string]string{"service_name": serviceName, "env": environment, "version": version.GitSHA}
+	for k, v := range parseHeaders(confList("PROFILING_LABELS")) {
+		labels[k] = v
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+
+	p := &profiler{
+		endpoint: strings.TrimRight(base, "/") + "/ingest",
+		headers:  parseHeaders(confList("PROFILING_HEADERS")),
+		name:     serviceName + "{" + strings.Join(pairs, ",") + "}",
+		types:    slices.Compact(slices.Sorted(slices.Values(confList("PROFILING_TYPES")))),
+		interval: confDuration("PROFILING_INTERVAL"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		sent:     map[string]*atomic.Uint64{},
+		failed:   map[string]*atomic.Uint64{},
+	}
+	for _, typ := range p.types {
+		p.sent[typ], p.failed[typ] = new(atomic.Uint64), new(atomic.Uint64)
+	}
+	profiling = p
+	go p.run()
+	registerMetrics(p.writeMetrics)
+
+	slog.Info("continuous profiling enabled", "endpoint", p.endpoint, "types", strings.Join(p.types, ","), "interval", p.interval.String())
+}
+
+func (p *profiler) run() {
+	defer close(p.stopped)
+	for {
+		from := time.Now()
+		var cpu bytes.Buffer
+		profilingCPU := slices.Contains(p.types, "cpu")
+		if profilingCPU {
+			if err := pprof.StartCPUProfile(&cpu); err != nil {
+				slog.Debug("CPU profile skipped", "error", err)
+				profilingCPU = false
+			}
+		}
+
+		stopping := false
+		timer := time.NewTimer(p.interval)
+		select {
+		case <-timer.C:
+		case <-p.done:
+			timer.Stop()
+			stopping = true
+		}
+
+		if profilingCPU {
+			pprof.StopCPUProfile()
+		}
+		until := time.Now()
+		for _, typ := range p.types {
+			profile := &cpu
+			switch {
+			case typ == "cpu" && !profilingCPU:
+				continue
+			case typ != "cpu":
+				// debug=0 is the gzipped protobuf format Pyroscope ingests.
+				profile = new(bytes.Buffer)
+				if err := pprof.Lookup(typ).WriteTo(profile, 0); err != nil {
+					p.failed[typ].Add(1)
+					slog.Warn("taking profile failed", "type", typ, "error", err)
+					continue
+				}
+			}
+			if err := p.upload(typ, from, until, profile.Bytes()); err != nil {
+				p.failed[typ].Add(1)
+				slog.Warn("uploading profile failed", "type", typ, "error", err)
+				continue
+			}
+			p.sent[typ].Add(1)
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// upload posts one profile to /ingest as the multipart form it takes.
+func (p *profiler) upload(typ string, from, until time.Time, profile []byte) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("profile", typ+".pprof")
+	if err != nil {
+		return err
+	}
+	part.Write(profile)
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"name":       {p.name},
+		"from":       {strconv.FormatInt(from.Unix(), 10)},
+		"until":      {strconv.FormatInt(until.Unix(), 10)},
+		"format":     {"pprof"},
+		"spyName":    {"gospy"},
+		"sampleRate": {"100"},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.endpoint+"?"+query.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// flushProfiles stops profiling after uploading what the running cycle
+// has, waiting at most until ctx is done.
+func flushProfiles(ctx context.Context) {
+	if profiling == nil {
+		return
+	}
+	profiling.once.Do(func() { close(profiling.done) })
+	select {
+	case <-profiling.stopped:
+	case <-ctx.Done():
+		slog.Warn("timed out uploading profiles")
+	}
+}
+
+// checkProfileTypes accepts a list of profileTypes.
+func checkProfileTypes(v string) error {
+	for _, typ := range strings.Split(v, ",") {
+		if typ = strings.TrimSpace(typ); typ != "" && !slices.Contains(profileTypes, typ) {
+			return fmt.Errorf("unknown profile type %q, want cpu, heap or goroutine", typ)
+		}
+	}
+	return nil
+}
+
+// checkProfileLabels accepts "k=v" entries whose keys Pyroscope takes as
+// label names and whose values do not break its name{k=v,...} syntax.
+func checkProfileLabels(v string) error {
+	for _, kv := range strings.Split(v, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(kv, "=")
+		if !ok || !profileLabelName.MatchString(strings.TrimSpace(k)) {
+			return fmt.Errorf("label %q, want name=value with a name of letters, digits, _ and .", kv)
+		}
+		if strings.ContainsAny(val, "{}=") {
+			return fmt.Errorf("label %q: the value may not hold {, } or =", kv)
+		}
+	}
+	return nil
+}
+
+func (p *profiler) writeMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP profiling_uploads_total Profiles uploaded for continuous profiling, by type and result: sent or failed.")
+	fmt.Fprintln(out, "# TYPE profiling_uploads_total counter")
+	for _, typ := range p.types {
+		fmt.Fprintf(out, "profiling_uploads_total{type=%q,result=\"sent\"} %d\n", typ, p.sent[typ].Load())
+		fmt.Fprintf(out, "profiling_uploads_total{type=%q,result=\"failed\"} %d\n", typ, p.failed[typ].Load())
+	}
+}
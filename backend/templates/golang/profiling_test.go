@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// profileUpload is what the fake Pyroscope got in one /ingest request.
+type profileUpload struct {
+	name, format string
+	profile      []byte
+}
+
+func TestContinuousProfiling(t *testing.T) {
+	uploads := make(chan profileUpload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest" || r.Header.Get("X-Scope-OrgID") != "acme" {
+			t.Errorf("profile sent to %s with X-Scope-OrgID %q", r.URL.Path, r.Header.Get("X-Scope-OrgID"))
+		}
+		file, _, err := r.FormFile("profile")
+		if err != nil {
+			t.Errorf("reading the profile part: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		uploads <- profileUpload{name: r.URL.Query().Get("name"), format: r.URL.Query().Get("format"), profile: data}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("PROFILING_URL", srv.URL+"/")
+	t.Setenv("PROFILING_HEADERS", "X-Scope-OrgID=acme")
+	t.Setenv("PROFILING_TYPES", "cpu,heap")
+	t.Setenv("PROFILING_LABELS", "region=eu-west-1")
+	t.Setenv("PROFILING_INTERVAL", "1h")
+	saved := metricWriters
+	t.Cleanup(func() {
+		metricWriters = saved
+		profiling = nil
+	})
+
+	setupProfiling()
+	// Shutdown cuts the hour-long CPU profile short and uploads both.
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flushProfiles(ctx)
+	close(uploads)
+
+	var got []profileUpload
+	for u := range uploads {
+		got = append(got, u)
+	}
+	if len(got) != 2 {
+		t.Fatalf("%d profiles uploaded, want the CPU and heap profiles", len(got))
+	}
+	for _, u := range got {
+		for _, label := range []string{"service_name=" + serviceName, "env=" + environment, "region=eu-west-1"} {
+			if !strings.HasPrefix(u.name, serviceName+"{") || !strings.Contains(u.name, label) {
+				t.Errorf("profile uploaded as %q, want it labelled %s", u.name, label)
+			}
+		}
+		// pprof's protobuf format is gzipped.
+		if u.format != "pprof" || len(u.profile) < 2 || u.profile[0] != 0x1f || u.profile[1] != 0x8b {
+			t.Errorf("profile uploaded in format %q, want a gzipped pprof profile", u.format)
+		}
+	}
+
+	h := http.NewServeMux()
+	registerOps(h)
+	if w := do(h, "GET", "/metrics", nil); !strings.Contains(w.Body.String(), `profiling_uploads_total{type="heap",result="sent"} 1`) {
+		t.Errorf("/metrics does not count the uploaded heap profile:\n%s", w.Body)
+	}
+}
+
+func TestProfilingSettingsRejected(t *testing.T) {
+	for _, c := range []struct {
+		check func(string) error
+		value string
+	}{
+		{checkProfileTypes, "cpu,threads"},
+		{checkProfileLabels, "region"},
+		{checkProfileLabels, "pod-name=web-1"},
+		{checkProfileLabels, "team=a{b}"},
+	} {
+		if c.check(c.value) == nil {
+			t.Errorf("%q accepted", c.value)
+		}
+	}
+	if err := checkProfileLabels("region=eu-west-1, team=payments"); err != nil {
+		t.Errorf("valid labels rejected: %v", err)
+	}
+}
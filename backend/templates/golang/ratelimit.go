@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Token-bucket rate limiting. Disabled unless RATE_LIMIT_RPS is set.
+//
+//	RATE_LIMIT_RPS       sustained requests per second
+//	RATE_LIMIT_BURST     bucket size (default 2x RPS, at least 1)
+//	RATE_LIMIT_MODE      "ip" (default): one bucket per client IP, behind
+//	                     a proxy the one TRUSTED_PROXIES resolves
+//	                     (clientip.go)
+//	                     "global": one bucket shared by all clients
+//	RATE_LIMIT_IDLE_TTL  per-IP buckets unused this long are evicted once
+//	                     they have refilled (default 10m)
+//	RATE_LIMIT_EXEMPT    paths never limited
+//	                     (default the probe paths and /metrics)
+//
+// Limited requests get 429 with Retry-After set to when the next token is
+// available. RATE_LIMIT_RPS and RATE_LIMIT_BURST are reloadable (see
+// config.go); turning limiting on or off still needs a restart.
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time elapsed since the last call and
+// consumes one token. Without a token it returns how long until one is
+// available.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimiter holds the buckets. The rates and the per-IP map are guarded
+// by mu; the map is pruned by janitor, so memory stays bounded by the
+// number of recently active IPs rather than every IP ever seen.
+type rateLimiter struct {
+	perIP   bool
+	idleTTL time.Duration
+	exempt  []string
+
+	mu          sync.Mutex
+	rate, burst float64
+	buckets     map[string]*tokenBucket
+	global      tokenBucket
+}
+
+// rateLimitSettings returns the configured rate and burst; a zero rate
+// means limiting is off.
+func rateLimitSettings() (rate, burst float64) {
+	rate = confFloat("RATE_LIMIT_RPS")
+	burst = confFloat("RATE_LIMIT_BURST")
+	if burst == 0 {
+		burst = math.Max(1, 2*rate)
+	}
+	return rate, burst
+}
+
+// newRateLimiter reads the RATE_LIMIT_* variables; nil means disabled.
+func newRateLimiter() *rateLimiter {
+	rate, burst := rateLimitSettings()
+	if rate == 0 {
+		return nil
+	}
+
+	rl := newBucketLimiter(rate, burst)
+	rl.exempt = confList("RATE_LIMIT_EXEMPT")
+	onConfigReload(rl.reload)
+	slog.Info("rate limiting enabled", "rps", rate, "burst", burst, "per_ip", rl.perIP)
+	return rl
+}
+
+// newBucketLimiter returns a limiter of rate and burst, per client with
+// RATE_LIMIT_MODE=ip, for RATE_LIMIT_RPS and the route policies
+// (routepolicy.go).
+func newBucketLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		perIP:   conf("RATE_LIMIT_MODE") == "ip",
+		idleTTL: confDuration("RATE_LIMIT_IDLE_TTL"),
+		buckets: map[string]*tokenBucket{},
+		global:  tokenBucket{tokens: burst, last: time.Now()},
+	}
+}
+
+// reload applies new RATE_LIMIT_RPS/RATE_LIMIT_BURST values. Existing
+// buckets keep their tokens, capped at the new burst on their next use.
+func (rl *rateLimiter) reload() {
+	rate, burst := rateLimitSettings()
+	if rate == 0 {
+		slog.Warn("RATE_LIMIT_RPS unset by reload, keeping the current rate until restart")
+		return
+	}
+	rl.mu.Lock()
+	rl.rate, rl.burst = rate, burst
+	rl.mu.Unlock()
+}
+
+// allow takes a token for key, creating a full bucket on first use.
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if !rl.perIP {
+		return rl.global.take(now, rl.rate, rl.burst)
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	return b.take(now, rl.rate, rl.burst)
+}
+
+// janitor evicts idle per-IP buckets until ctx is done.
+func (rl *rateLimiter) janitor(ctx context.Context) {
+	if !rl.perIP {
+		return
+	}
+	ticker := time.NewTicker(rl.idleTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rl.evict(now)
+		}
+	}
+}
+
+// evict drops the buckets unused for RATE_LIMIT_IDLE_TTL that have also
+// refilled. A bucket is only dropped once full, as a new one would start,
+// so eviction never changes a verdict, even with a TTL shorter than
+// burst/rate.
+func (rl *rateLimiter) evict(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, b := range rl.buckets {
+		idle := now.Sub(b.last)
+		if idle > rl.idleTTL && b.tokens+idle.Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimitMiddleware rejects requests over the limit with 429.
+func rateLimitMiddleware(rl *rateLimiter, next http.Handler) http.Handler {
+	if rl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(rl.exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := rl.allow(clientIP(r), time.Now())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rateLimited(w, r, wait)
+	})
+}
+
+// rateLimited answers 429, with Retry-After set to wait.
+func rateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+}
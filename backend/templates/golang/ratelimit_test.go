@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withRateLimit returns a limiter from the RATE_LIMIT_* variables set for
+// the test, with the reload hook it registers dropped afterwards.
+func withRateLimit(t *testing.T, env map[string]string) *rateLimiter {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	hooks := reloadHooks
+	t.Cleanup(func() { reloadHooks = hooks })
+	rl := newRateLimiter()
+	if rl == nil {
+		t.Fatal("newRateLimiter = nil, want limiting on")
+	}
+	return rl
+}
+
+// fromIP is a GET of path from ip.
+func fromIP(path, ip string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = ip + ":40000"
+	return r
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := tokenBucket{tokens: 2, last: start}
+	for i := range 2 {
+		if ok, _ := b.take(start, 1, 2); !ok {
+			t.Fatalf("take %d of a burst of 2 refused", i+1)
+		}
+	}
+	if ok, wait := b.take(start, 1, 2); ok || wait != time.Second {
+		t.Fatalf("empty bucket: %v, wait %v; want refused with 1s", ok, wait)
+	}
+	if ok, _ := b.take(start.Add(500*time.Millisecond), 1, 2); ok {
+		t.Fatal("half a token granted a request")
+	}
+	if ok, _ := b.take(start.Add(time.Second), 1, 2); !ok {
+		t.Fatal("refilled token refused")
+	}
+	// A long idle period refills to the burst, no further.
+	b.take(start.Add(time.Hour), 1, 2)
+	if b.tokens != 1 {
+		t.Errorf("tokens after an hour idle and one take = %v, want 1", b.tokens)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rl := withRateLimit(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "2"})
+	h := rateLimitMiddleware(rl, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, fromIP("/api/items", "192.0.2.1"))
+		if w.Code != want {
+			t.Fatalf("request %d: %d, want %d", i+1, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+		}
+	}
+
+	for name, r := range map[string]*http.Request{
+		"another client": fromIP("/api/items", "192.0.2.2"),
+		"exempt path":    fromIP(conf("LIVENESS_PATH"), "192.0.2.1"),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: %d, want 200", name, w.Code)
+		}
+	}
+}
+
+func TestRateLimitGlobal(t *testing.T) {
+	rl := withRateLimit(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "1", "RATE_LIMIT_MODE": "global"})
+	now := time.Now()
+	if ok, _ := rl.allow("192.0.2.1", now); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, _ := rl.allow("192.0.2.2", now); ok {
+		t.Error("a second client got a token from the shared, empty bucket")
+	}
+}
+
+func TestRateLimitReload(t *testing.T) {
+	rl := withRateLimit(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "1"})
+	t.Setenv("RATE_LIMIT_RPS", "10")
+	t.Setenv("RATE_LIMIT_BURST", "5")
+	rl.reload()
+	if rl.rate != 10 || rl.burst != 5 {
+		t.Errorf("after reload: rate %v burst %v, want 10 and 5", rl.rate, rl.burst)
+	}
+
+	t.Setenv("RATE_LIMIT_RPS", "")
+	rl.reload()
+	if rl.rate != 10 {
+		t.Errorf("unsetting RATE_LIMIT_RPS changed the rate to %v, want it kept", rl.rate)
+	}
+}
+
+// TestRateLimitEvict has an idle TTL shorter than burst/rate: a bucket
+// idle past the TTL but not yet refilled must survive, or its client would
+// get a fresh burst.
+func TestRateLimitEvict(t *testing.T) {
+	rl := withRateLimit(t, map[string]string{
+		"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "10", "RATE_LIMIT_IDLE_TTL": "2s",
+	})
+	start := time.Now()
+	for range 10 {
+		rl.allow("192.0.2.1", start)
+	}
+	rl.allow("192.0.2.2", start)
+
+	rl.evict(start.Add(3 * time.Second))
+	if _, ok := rl.buckets["192.0.2.1"]; !ok {
+		t.Fatal("an emptied bucket was evicted before it refilled")
+	}
+	if _, ok := rl.buckets["192.0.2.2"]; ok {
+		t.Error("a bucket idle past the TTL and full again was kept")
+	}
+	// Three seconds earn three tokens, not a fresh burst of ten.
+	granted := 0
+	for range 10 {
+		if ok, _ := rl.allow("192.0.2.1", start.Add(3*time.Second)); ok {
+			granted++
+		}
+	}
+	if granted != 3 {
+		t.Errorf("%d requests granted after 3s, want 3", granted)
+	}
+
+	rl.evict(start.Add(time.Minute))
+	if len(rl.buckets) != 0 {
+		t.Errorf("%d buckets left after a minute idle, want none", len(rl.buckets))
+	}
+}
+
+// TestRateLimitConcurrent hammers one limiter from many goroutines, with
+// reloads and evictions in between, for go test -race. The clock does not
+// move, so each client gets exactly its burst.
+func TestRateLimitConcurrent(t *testing.T) {
+	rl := withRateLimit(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "20"})
+	const clients, workers, requests = 8, 64, 50
+	now := time.Now()
+
+	var allowed [clients]atomic.Int64
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range requests {
+				client := (w + i) % clients
+				if ok, _ := rl.allow("192.0.2."+strconv.Itoa(client), now); ok {
+					allowed[client].Add(1)
+				}
+				switch i % 10 {
+				case 0:
+					rl.reload()
+				case 5:
+					rl.evict(now)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for client := range allowed {
+		if got := allowed[client].Load(); got != 20 {
+			t.Errorf("client %d allowed %d requests, want its burst of 20", client, got)
+		}
+	}
+}
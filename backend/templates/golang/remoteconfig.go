@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote configuration from the OpenLuffy control plane, so platform
+// operators change an app's settings centrally instead of redeploying it.
+// Off unless REMOTE_CONFIG_URL is set:
+//
+//	REMOTE_CONFIG_URL      the app's document,
+//	                       https://<openluffy>/api/v1/customers/<customer>/apps/<app>/config;
+//	                       the app adds ?environment=<ENVIRONMENT>
+//	REMOTE_CONFIG_TOKEN    an OpenLuffy API token with the config:read
+//	                       scope; secret
+//	REMOTE_CONFIG_TIMEOUT  time a fetch may take (default 5s)
+//	REMOTE_CONFIG_CACHE    file keeping the last document fetched
+//
+// The document is a JSON object of settings, shaped like a JSON
+// CONFIG_FILE. It is fetched whenever the configuration sources load: at
+// startup, and every CONFIG_RELOAD_INTERVAL after, when reloadable
+// settings take effect at once and the others on the next restart. Each
+// fetch sends the ETag of the last one, so an unchanged document costs a
+// 304.
+//
+// The document overrides CONFIG_FILE but not the environment or a
+// NAME_FILE, so a setting the deployment pins is never changed from afar.
+// Nor does it set secrets, ENVIRONMENT or the REMOTE_CONFIG_* settings:
+// those are logged as ignored. When the control plane is unreachable or
+// errors, the app runs on the cached document, and without one on its own
+// settings alone, with a warning either way; startup never waits longer
+// than REMOTE_CONFIG_TIMEOUT for it.
+
+// maxRemoteConfigSize bounds the remote document.
+const maxRemoteConfigSize = 1 << 20
+
+var defaultRemoteConfigCache = filepath.Join(os.TempDir(), "remote-config.json")
+
+// remoteDocument is a fetched document, as the cache file holds it.
+type remoteDocument struct {
+	ETag     string            `json:"etag"`
+	Settings map[string]string `json:"settings"`
+}
+
+// remoteState keeps the last document, so a 304 and a failed fetch have
+// one to fall back on.
+var remoteState struct {
+	mu   sync.Mutex
+	last *remoteDocument
+}
+
+// loadRemoteConfig fetches the remote document with the settings local,
+// the other sources, give. It returns the settings the document may set,
+// the names of those it may not, and why the document is the cached one
+// or missing.
+func loadRemoteConfig(local *configSources) (map[string]string, []string, error) {
+	get := func(name string) string { return settingIndex[name].effective(local) }
+	target := get("REMOTE_CONFIG_URL")
+	if target == "" {
+		return nil, nil, nil
+	}
+	cache := get("REMOTE_CONFIG_CACHE")
+
+	remoteState.mu.Lock()
+	defer remoteState.mu.Unlock()
+	if remoteState.last == nil {
+		remoteState.last = readRemoteCache(cache)
+	}
+	timeout, _ := time.ParseDuration(get("REMOTE_CONFIG_TIMEOUT"))
+	env := strings.ToLower(get("ENVIRONMENT"))
+	doc, err := fetchRemoteConfig(target, get("REMOTE_CONFIG_TOKEN"), env, timeout, remoteState.last)
+	switch {
+	case err != nil && remoteState.last != nil:
+		err = fmt.Errorf("%w; using the cached document", err)
+		doc = remoteState.last
+	case err != nil:
+		return nil, nil, fmt.Errorf("%w; no cached document, using local settings only", err)
+	case doc != remoteState.last:
+		remoteState.last = doc
+		if cacheErr := writeRemoteCache(cache, doc); cacheErr != nil {
+			err = fmt.Errorf("caching the document: %w", cacheErr)
+		}
+	}
+
+	values := map[string]string{}
+	var refused []string
+	for k, v := range doc.Settings {
+		if s, ok := settingIndex[k]; ok && (s.secret || k == "ENVIRONMENT" || strings.HasPrefix(k, "REMOTE_CONFIG_")) {
+			refused = append(refused, k)
+			continue
+		}
+		values[k] = v
+	}
+	slices.Sort(refused)
+	return values, refused, err
+}
+
+// fetchRemoteConfig returns the document at target, or last when the
+// control plane answers that it has not changed.
+func fetchRemoteConfig(target, token, env string, timeout time.Duration, last *remoteDocument) (*remoteDocument, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("environment", env)
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "openluffy-go/"+templateVersion)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if last != nil && last.ETag != "" {
+		req.Header.Set("If-None-Match", last.ETag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && last != nil:
+		return last, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("control plane answered %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("document larger than %d bytes", maxRemoteConfigSize)
+	}
+	values, err := parseConfigJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("document: %w", err)
+	}
+	return &remoteDocument{ETag: resp.Header.Get("ETag"), Settings: values}, nil
+}
+
+// readRemoteCache returns the cached document, or nil if there is none.
+func readRemoteCache(path string) *remoteDocument {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var doc remoteDocument
+	if json.Unmarshal(data, &doc) != nil || doc.Settings == nil {
+		return nil
+	}
+	return &doc
+}
+
+// writeRemoteCache replaces the cache file, through a rename so a crash
+// midway never leaves half a document.
+func writeRemoteCache(path string, doc *remoteDocument) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// withRemoteConfig serves doc as the remote document with ETag "r1", and
+// points REMOTE_CONFIG_URL and a fresh REMOTE_CONFIG_CACHE at it. It
+// counts the 200s and 304s served.
+func withRemoteConfig(t *testing.T, doc string) (srv *httptest.Server, served, unchanged *atomic.Int32) {
+	t.Helper()
+	served, unchanged = &atomic.Int32{}, &atomic.Int32{}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("environment"); got != "staging" {
+			t.Errorf("fetched for environment %q, want staging", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer olf_dev_test" {
+			t.Errorf("Authorization = %q, want the REMOTE_CONFIG_TOKEN bearer", got)
+		}
+		if r.Header.Get("If-None-Match") == `"r1"` {
+			unchanged.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		served.Add(1)
+		w.Header().Set("ETag", `"r1"`)
+		w.Write([]byte(doc))
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("ENVIRONMENT", "Staging")
+	t.Setenv("REMOTE_CONFIG_URL", srv.URL+"/api/v1/customers/acme/apps/acme-app/config")
+	t.Setenv("REMOTE_CONFIG_TOKEN", "olf_dev_test")
+	t.Setenv("REMOTE_CONFIG_CACHE", filepath.Join(t.TempDir(), "remote-config.json"))
+	last := remoteState.last
+	remoteState.last = nil
+	t.Cleanup(func() { remoteState.last = last })
+	return srv, served, unchanged
+}
+
+func TestRemoteConfig(t *testing.T) {
+	_, served, unchanged := withRemoteConfig(t, `{"LOG_LEVEL": "debug", "RATE_LIMIT_RPS": 5, "ROBOTS_TXT": "remote", "API_KEYS": "ops:hunter2", "NO_SUCH_SETTING": "x"}`)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(file, []byte("LOG_LEVEL: warn\nSECURITY_CONTACT: security@example.com\n"), 0o600)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("ROBOTS_TXT", "local")
+
+	src := loadConfigSources()
+	if src.remoteErr != nil {
+		t.Fatalf("remoteErr = %v", src.remoteErr)
+	}
+	for name, want := range map[string]string{
+		"LOG_LEVEL":        "debug", // the document over CONFIG_FILE
+		"RATE_LIMIT_RPS":   "5",
+		"SECURITY_CONTACT": "security@example.com",
+		"ROBOTS_TXT":       "local", // the environment over the document
+		"API_KEYS":         "",      // secrets are never set remotely
+	} {
+		if got := settingIndex[name].effective(src); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	var problems []string
+	for _, p := range configProblems(src) {
+		problems = append(problems, p.msg+" "+p.args[1].(string))
+	}
+	for _, want := range []string{
+		"setting ignored in remote config, set it locally API_KEYS",
+		"unknown setting in remote config NO_SUCH_SETTING",
+	} {
+		if !slices.Contains(problems, want) {
+			t.Errorf("problems %q lack %q", problems, want)
+		}
+	}
+
+	again := loadConfigSources()
+	if served.Load() != 1 || unchanged.Load() != 1 || !again.equal(src) {
+		t.Errorf("refetch: %d documents and %d not modified served, want 1 and 1 with the same settings", served.Load(), unchanged.Load())
+	}
+}
+
+func TestRemoteConfigUnavailable(t *testing.T) {
+	srv, _, _ := withRemoteConfig(t, `{"LOG_LEVEL": "debug"}`)
+	loadConfigSources()
+	srv.Close()
+
+	// A restart with the control plane down runs on the cached document.
+	remoteState.last = nil
+	src := loadConfigSources()
+	if got := settingIndex["LOG_LEVEL"].effective(src); got != "debug" || !strings.Contains(src.remoteErr.Error(), "cached") {
+		t.Errorf("LOG_LEVEL = %q, remoteErr = %v; want debug from the cached document", got, src.remoteErr)
+	}
+
+	// Without a cache, on the local settings alone.
+	remoteState.last = nil
+	t.Setenv("REMOTE_CONFIG_CACHE", filepath.Join(t.TempDir(), "remote-config.json"))
+	src = loadConfigSources()
+	if got := settingIndex["LOG_LEVEL"].effective(src); got != "info" || src.remoteErr == nil {
+		t.Errorf("LOG_LEVEL = %q, remoteErr = %v; want the default and an error", got, src.remoteErr)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+// This file is shared with openluffy-sdk, whose copy is generated from it
+// by ./openluffy.py sdk-sync: it uses no template tags and nothing defined
+// outside it.
+
+type requestIDKey struct{}
+
+// requestIDValue accepts IDs from upstream proxies (UUIDs, nginx
+// $request_id, Traefik and cloud LB trace IDs) while rejecting anything
+// that is unsafe to echo into headers and logs.
+var requestIDValue = regexp.MustCompile(`^[A-Za-z0-9._:=/+-]{1,128}$`)
+
+// newRequestID returns a random 128-bit hex ID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retries for calls to upstream APIs, inside the circuit breaker of
+// newUpstreamClient (breaker.go): the breaker sees one outcome per call,
+// whatever the attempts it took, and an open circuit is not retried.
+//
+// A call is retried after a transport error, an attempt timeout, or a 429,
+// 502, 503 or 504 answer, and only when repeating it is safe: its method
+// is idempotent (GET, HEAD, OPTIONS, TRACE, PUT, DELETE) or it carries an
+// Idempotency-Key header, and its body, if any, can be replayed, as
+// http.NewRequest bodies from bytes and strings can. Each retry waits an
+// exponential backoff with jitter, or the answer's Retry-After when that
+// is no longer than UPSTREAM_RETRY_MAX_BACKOFF; a longer one, or the call's
+// deadline arriving first, ends the retries and returns the last answer.
+//
+//	UPSTREAM_RETRIES            retries after the first attempt (default 2;
+//	                            0 disables them)
+//	UPSTREAM_RETRY_BACKOFF      wait before the first retry, doubled for
+//	                            each after it (default 100ms)
+//	UPSTREAM_RETRY_MAX_BACKOFF  longest wait (default 2s)
+//	UPSTREAM_ATTEMPT_TIMEOUT    deadline of each attempt (default none);
+//	                            UPSTREAM_TIMEOUT bounds the call as a whole
+//
+// /metrics reports upstream_retries_total per upstream.
+
+// idempotentMethods may be repeated without changing the outcome.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryTransport is an http.RoundTripper that repeats failed attempts
+// with base.
+type retryTransport struct {
+	base           http.RoundTripper
+	retries        int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	attemptTimeout time.Duration
+	onRetry        func()
+}
+
+func newRetryTransport(base http.RoundTripper, onRetry func()) *retryTransport {
+	return &retryTransport{
+		base:           base,
+		retries:        confInt("UPSTREAM_RETRIES"),
+		backoff:        confDuration("UPSTREAM_RETRY_BACKOFF"),
+		maxBackoff:     confDuration("UPSTREAM_RETRY_MAX_BACKOFF"),
+		attemptTimeout: confDuration("UPSTREAM_ATTEMPT_TIMEOUT"),
+		onRetry:        onRetry,
+	}
+}
+
+// retryable reports whether r may be sent again.
+func retryable(r *http.Request) bool {
+	if !idempotentMethods[r.Method] && r.Header.Get("Idempotency-Key") == "" {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	retries := t.retries
+	if !retryable(r) {
+		retries = 0
+	}
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		req := r
+		if attempt > 0 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = r.Clone(r.Context())
+			req.Body = body
+		}
+		resp, err := t.attempt(req)
+
+		wait, retry := t.shouldRetry(r.Context(), resp, err, backoff)
+		if !retry || attempt == retries {
+			return resp, err
+		}
+		if resp != nil {
+			// Drained, so the connection is reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+		if t.onRetry != nil {
+			t.onRetry()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+		backoff = min(2*backoff, t.maxBackoff)
+	}
+}
+
+// attempt sends r once, within UPSTREAM_ATTEMPT_TIMEOUT. The attempt's
+// deadline stays on until the response body is closed, so reading it is
+// bounded too.
+func (t *retryTransport) attempt(r *http.Request) (*http.Response, error) {
+	if t.attemptTimeout <= 0 {
+		return t.base.RoundTrip(r)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), t.attemptTimeout)
+	resp, err := t.base.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// shouldRetry reports whether an attempt's outcome is worth another, and
+// how long to wait first.
+func (t *retryTransport) shouldRetry(ctx context.Context, resp *http.Response, err error, backoff time.Duration) (time.Duration, bool) {
+	switch {
+	case ctx.Err() != nil, errors.Is(err, errCircuitOpen):
+		return 0, false
+	case err != nil:
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return after, after <= t.maxBackoff && fitsDeadline(ctx, after)
+		}
+	case resp.StatusCode == http.StatusBadGateway, resp.StatusCode == http.StatusGatewayTimeout:
+	default:
+		return 0, false
+	}
+	// Equal jitter: half the backoff, plus up to as much again at random,
+	// so the replicas that failed together do not retry together.
+	wait := backoff/2 + rand.N(backoff/2+1)
+	return wait, fitsDeadline(ctx, wait)
+}
+
+// fitsDeadline reports whether waiting d still leaves the call time.
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > d
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// cancelOnClose ends an attempt's context when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstreamFailing answers status to the first failures requests it gets,
+// and 200 with the request body after that.
+func upstreamFailing(t *testing.T, failures int32, status int, header ...string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			for i := 0; i+1 < len(header); i += 2 {
+				w.Header().Set(header[i], header[i+1])
+			}
+			w.WriteHeader(status)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "1ms")
+	for _, tc := range []struct {
+		name     string
+		method   string
+		header   []string
+		status   int
+		failures int32
+		want     int   // final status
+		calls    int32 // attempts made
+	}{
+		{"get retried", "GET", nil, http.StatusServiceUnavailable, 2, http.StatusOK, 3},
+		{"retries run out", "GET", nil, http.StatusBadGateway, 5, http.StatusBadGateway, 3},
+		{"post not retried", "POST", nil, http.StatusServiceUnavailable, 1, http.StatusServiceUnavailable, 1},
+		{"post with idempotency key", "POST", []string{"Idempotency-Key", "k1"}, http.StatusServiceUnavailable, 1, http.StatusOK, 2},
+		{"client error not retried", "GET", nil, http.StatusNotFound, 1, http.StatusNotFound, 1},
+		{"internal error not retried", "PUT", nil, http.StatusInternalServerError, 1, http.StatusInternalServerError, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, calls := upstreamFailing(t, tc.failures, tc.status)
+			client := newUpstreamClient("retried")
+			req, _ := http.NewRequest(tc.method, srv.URL, strings.NewReader("payload"))
+			for i := 0; i+1 < len(tc.header); i += 2 {
+				req.Header.Set(tc.header[i], tc.header[i+1])
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("call: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.want || calls.Load() != tc.calls {
+				t.Errorf("status %d after %d attempts, want %d after %d", resp.StatusCode, calls.Load(), tc.want, tc.calls)
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != "payload" {
+				t.Errorf("body %q, want the request body replayed", body)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetryAfter(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "1ms")
+	t.Setenv("UPSTREAM_RETRY_MAX_BACKOFF", "100ms")
+
+	// Retry-After longer than UPSTREAM_RETRY_MAX_BACKOFF: given up at once.
+	srv, calls := upstreamFailing(t, 1, http.StatusTooManyRequests, "Retry-After", "30")
+	start := time.Now()
+	resp, err := newUpstreamClient("throttled").Get(srv.URL)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 || time.Since(start) > time.Second {
+		t.Errorf("status %d after %d attempts, want the 429 passed through without waiting", resp.StatusCode, calls.Load())
+	}
+
+	srv, calls = upstreamFailing(t, 1, http.StatusTooManyRequests, "Retry-After", "0")
+	resp, err = newUpstreamClient("throttled").Get(srv.URL)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("status %d after %d attempts, want 200 after 2", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestUpstreamAttemptTimeout(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "1ms")
+	t.Setenv("UPSTREAM_ATTEMPT_TIMEOUT", "50ms")
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-r.Context().Done() // hangs until the attempt times out
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, err := newUpstreamClient("slow").Get(srv.URL)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" || calls.Load() != 2 {
+		t.Errorf("body %q after %d attempts, want ok from the second", body, calls.Load())
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the frozen syscall package does not
+// define for Linux.
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on a socket before it binds, for
+// HTTP_REUSE_PORT (handoff.go).
+func reusePortControl(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
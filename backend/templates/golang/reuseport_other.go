@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+// reusePortControl fails where the app has no SO_REUSEPORT; see
+// reuseport_linux.go and reuseport_unix.go.
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errors.New("HTTP_REUSE_PORT: SO_REUSEPORT is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Route policies: a route group's deadline, rate limit and authentication
+// declared together, rather than spread over setRouteTimeout, AUTH_PATHS
+// and a middleware of the app's own. Declare them once from setupApp:
+//
+//	err := setRoutePolicies(map[string]routePolicy{
+//		"/api/items":   {Timeout: 5 * time.Second, RateLimit: 20, Auth: true},
+//		"/api/reports": {Timeout: 2 * time.Minute, RateLimit: 1, Burst: 5, Auth: true},
+//		"/events":      {NoTimeout: true},
+//	})
+//
+// The platform chain (chain.go) applies each policy to the requests under
+// its prefix, the longest prefix matching winning as in REQUEST_TIMEOUTS;
+// Auth adds to AUTH_PATHS instead, so a nested policy cannot open routes
+// a shorter prefix protects:
+//
+//	Timeout    the requests' deadline, in place of REQUEST_TIMEOUT;
+//	           REQUEST_TIMEOUTS still overrides it (timeout.go)
+//	NoTimeout  no deadline, for streams and long polls
+//	RateLimit  requests per second to the group, per client with
+//	           RATE_LIMIT_MODE=ip or shared otherwise, on top of
+//	           RATE_LIMIT_RPS (ratelimit.go), which need not be set
+//	Burst      bucket size for RateLimit (default 2x, at least 1)
+//	Auth       a bearer token or an API key, as AUTH_PATHS asks for
+//	           (auth.go, apikey.go), whether or not AUTH_PATHS covers it
+//
+// setRoutePolicies checks the whole declaration at startup and returns
+// every problem at once: a policy that cannot be enforced, such as Auth
+// with neither JWT_JWKS_URL nor API_KEYS set, stops the app rather than
+// leaving the routes open. Route limits are fixed at startup; the
+// requests they reject count in http_requests_route_limited_total.
+
+// routePolicy is what the platform enforces on a route group.
+type routePolicy struct {
+	Timeout   time.Duration
+	NoTimeout bool
+	RateLimit float64
+	Burst     float64
+	Auth      bool
+}
+
+// declaredPolicy is a routePolicy with its prefix, and the limiter built
+// for its RateLimit.
+type declaredPolicy struct {
+	prefix  string
+	policy  routePolicy
+	limiter *rateLimiter
+	limited atomic.Int64
+}
+
+// routePolicies are the policies set with setRoutePolicies, longest
+// prefix first.
+var routePolicies []*declaredPolicy
+
+// setRoutePolicies declares the policies of the route groups, keyed by
+// path prefix. Call it from setupApp, and return its error.
+func setRoutePolicies(policies map[string]routePolicy) error {
+	var errs []error
+	for _, prefix := range slices.Sorted(maps.Keys(policies)) {
+		if err := checkRoutePolicy(prefix, policies[prefix]); err != nil {
+			errs = append(errs, fmt.Errorf("route policy %s: %w", prefix, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	limits := false
+	for prefix, p := range policies {
+		d := &declaredPolicy{prefix: prefix, policy: p}
+		switch {
+		case p.NoTimeout:
+			setRouteTimeout(prefix, 0)
+		case p.Timeout > 0:
+			setRouteTimeout(prefix, p.Timeout)
+		}
+		if p.RateLimit > 0 {
+			burst := p.Burst
+			if burst == 0 {
+				burst = max(1, 2*p.RateLimit)
+			}
+			d.limiter, limits = newBucketLimiter(p.RateLimit, burst), true
+			registerBackground("rate limit "+prefix, func(ctx context.Context) error {
+				d.limiter.janitor(ctx)
+				<-ctx.Done()
+				return ctx.Err()
+			})
+		}
+		routePolicies = append(routePolicies, d)
+	}
+	slices.SortStableFunc(routePolicies, func(a, b *declaredPolicy) int { return len(b.prefix) - len(a.prefix) })
+	if limits {
+		registerMetrics(writeRouteLimitMetrics)
+	}
+	return nil
+}
+
+// checkRoutePolicy reports why p cannot be enforced on prefix.
+func checkRoutePolicy(prefix string, p routePolicy) error {
+	var errs []error
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "{} \t") {
+		errs = append(errs, errors.New("want an absolute path prefix such as /api/items"))
+	}
+	for _, d := range routePolicies {
+		if d.prefix == prefix {
+			errs = append(errs, errors.New("declared twice"))
+		}
+	}
+	switch {
+	case p.Timeout < 0:
+		errs = append(errs, errors.New("Timeout must not be negative"))
+	case p.Timeout > 0 && p.NoTimeout:
+		errs = append(errs, errors.New("Timeout and NoTimeout both set"))
+	case p.Timeout > 0 && confDuration("HTTP_WRITE_TIMEOUT") > 0 && p.Timeout >= confDuration("HTTP_WRITE_TIMEOUT"):
+		errs = append(errs, fmt.Errorf("Timeout %s is not inside HTTP_WRITE_TIMEOUT (%s), so the connection would be cut before the 504", p.Timeout, confDuration("HTTP_WRITE_TIMEOUT")))
+	}
+	switch {
+	case p.RateLimit < 0:
+		errs = append(errs, errors.New("RateLimit must not be negative"))
+	case p.Burst != 0 && p.RateLimit == 0:
+		errs = append(errs, errors.New("Burst set without RateLimit"))
+	case p.Burst != 0 && p.Burst < 1:
+		errs = append(errs, errors.New("Burst must be at least 1"))
+	}
+	if p.Auth && conf("JWT_JWKS_URL") == "" && conf("API_KEYS") == "" {
+		errs = append(errs, errors.New("Auth needs JWT_JWKS_URL or API_KEYS set, or the routes would be open"))
+	}
+	return errors.Join(errs...)
+}
+
+// routePolicyFor returns the policy of the requests to path, or nil.
+func routePolicyFor(path string) *declaredPolicy {
+	for _, d := range routePolicies {
+		if protectedPath(path, []string{d.prefix}) {
+			return d
+		}
+	}
+	return nil
+}
+
+// policyAuthPaths are the prefixes whose policy sets Auth.
+func policyAuthPaths() []string {
+	var paths []string
+	for _, d := range routePolicies {
+		if d.policy.Auth {
+			paths = append(paths, d.prefix)
+		}
+	}
+	return paths
+}
+
+// routeLimitMiddleware applies the RateLimit of the requests' policy.
+func routeLimitMiddleware(next http.Handler) http.Handler {
+	if !slices.ContainsFunc(routePolicies, func(d *declaredPolicy) bool { return d.limiter != nil }) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := routePolicyFor(r.URL.Path)
+		if d == nil || d.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := d.limiter.allow(clientIP(r), time.Now()); !ok {
+			d.limited.Add(1)
+			rateLimited(w, r, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRouteLimitMetrics reports the requests each route limit rejected.
+func writeRouteLimitMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP http_requests_route_limited_total Requests rejected by a route policy's RateLimit, by prefix.")
+	fmt.Fprintln(w, "# TYPE http_requests_route_limited_total counter")
+	for _, d := range routePolicies {
+		if d.limiter != nil {
+			fmt.Fprintf(w, "http_requests_route_limited_total{prefix=\"%s\"} %d\n", escapeLabel(d.prefix), d.limited.Load())
+		}
+	}
+}
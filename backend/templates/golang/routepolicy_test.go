@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withRoutePolicies clears the route policies, and what declaring them
+// registers, for one test.
+func withRoutePolicies(t *testing.T) {
+	t.Helper()
+	withRouteTimeouts(t)
+	saved, savedBackground := routePolicies, backgroundServices
+	t.Cleanup(func() { routePolicies, backgroundServices = saved, savedBackground })
+	routePolicies = nil
+}
+
+func TestRoutePolicies(t *testing.T) {
+	withRoutePolicies(t)
+	t.Setenv("API_KEYS", "billing:"+billingKey)
+	t.Setenv("AUTH_PATHS", "/nothing/")
+	t.Setenv("JWT_JWKS_URL", "")
+	t.Setenv("REQUEST_TIMEOUT", "5s")
+	err := setRoutePolicies(map[string]routePolicy{
+		"/private":   {RateLimit: 1, Burst: 2, Auth: true},
+		"/private/x": {Timeout: 20 * time.Millisecond},
+		"/events":    {NoTimeout: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			w.Write([]byte("no deadline"))
+			return
+		}
+		if r.URL.Query().Has("slow") {
+			<-r.Context().Done()
+		}
+	})
+	h := platformHandler(mux, nil)
+
+	if w := do(h, "GET", "/private/items", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /private/items without a key = %d, want 401", w.Code)
+	}
+	if w := do(h, "GET", "/private/items", nil, "X-API-Key", billingKey); w.Code != http.StatusOK {
+		t.Errorf("GET /private/items with a key = %d, want 200", w.Code)
+	}
+	if w := do(h, "GET", "/private/items", nil, "X-API-Key", billingKey); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("GET /private/items over the route's rate limit = %d, want 429 with Retry-After", w.Code)
+	}
+	if w := do(h, "GET", "/public", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /public, under no policy = %d, want 200", w.Code)
+	}
+
+	// The longest prefix sets the deadline and the limit, but Auth covers
+	// every route under /private.
+	if w := do(h, "GET", "/private/x?slow", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /private/x without a key = %d, want 401", w.Code)
+	}
+	if w := do(h, "GET", "/private/x?slow", nil, "X-API-Key", billingKey); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("GET /private/x past its Timeout = %d, want 504", w.Code)
+	}
+	if w := do(h, "GET", "/events", nil); w.Body.String() != "no deadline" {
+		t.Errorf("GET /events with NoTimeout: %q, want no deadline", w.Body)
+	}
+	if body := do(http.HandlerFunc(metricsHandler), "GET", "/metrics", nil).Body.String(); !strings.Contains(body, `http_requests_route_limited_total{prefix="/private"} 1`) {
+		t.Errorf("/metrics lacks the route limit's rejection:\n%s", body)
+	}
+}
+
+func TestRoutePoliciesInvalid(t *testing.T) {
+	withRoutePolicies(t)
+	t.Setenv("API_KEYS", "")
+	t.Setenv("JWT_JWKS_URL", "")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "30s")
+	err := setRoutePolicies(map[string]routePolicy{
+		"api":          {},
+		"/negative":    {Timeout: -time.Second},
+		"/both":        {Timeout: time.Second, NoTimeout: true},
+		"/too-long":    {Timeout: time.Minute},
+		"/burst-only":  {Burst: 5},
+		"/tiny-burst":  {RateLimit: 1, Burst: 0.5},
+		"/needs-login": {Auth: true},
+		"/fine":        {Timeout: time.Second},
+	})
+	if err == nil {
+		t.Fatal("invalid policies accepted")
+	}
+	for _, want := range []string{"api:", "/negative:", "/both:", "/too-long:", "/burst-only:", "/tiny-burst:", "/needs-login:"} {
+		if !strings.Contains(err.Error(), "route policy "+want) {
+			t.Errorf("error %q does not report %s", err, strings.TrimSuffix(want, ":"))
+		}
+	}
+	if strings.Contains(err.Error(), "/fine") || len(routePolicies) != 0 || len(appRouteTimeouts) != 0 {
+		t.Errorf("error %q with %d policies applied; want only the invalid ones reported and none applied", err, len(routePolicies))
+	}
+
+	t.Setenv("API_KEYS", "billing:"+billingKey)
+	if err := setRoutePolicies(map[string]routePolicy{"/api": {Auth: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRoutePolicies(map[string]routePolicy{"/api": {}}); err == nil || !strings.Contains(err.Error(), "declared twice") {
+		t.Errorf("a second policy for /api: %v, want declared twice", err)
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP server defaults and the platform endpoints every Go template's
+// main.go registers next to the probes.
+
+// defaultProbePaths are the probe paths the template was rendered with,
+// the default of the *_EXEMPT lists.
+const defaultProbePaths = "[% LIVENESS_PATH %],[% READINESS_PATH %],[% STARTUP_PATH %]"
+
+// probes maps the settings naming the probe paths to their handlers.
+// Load balancers hardwired to probe /ping or /status can be pointed at
+// them by setting LIVENESS_PATH and friends; set the *_EXEMPT lists to
+// match, which default to the rendered paths.
+var probes = []struct {
+	setting string
+	handler http.HandlerFunc
+}{
+	{"LIVENESS_PATH", healthHandler},
+	{"READINESS_PATH", readinessHandler},
+	{"STARTUP_PATH", startupHandler},
+}
+
+// checkProbePath accepts an exact path such as /healthz: "/" or a path
+// ending in "/" would be a subtree and take the app's requests.
+func checkProbePath(v string) error {
+	if !strings.HasPrefix(v, "/") || strings.HasSuffix(v, "/") || strings.ContainsAny(v, "{} \t") {
+		return errors.New("want an absolute path such as /healthz, not ending in /")
+	}
+	return nil
+}
+
+// registerPlatform registers the probes and platform endpoints on mux.
+// They all answer GET and HEAD only; any other method gets 405 rather
+// than falling through to the app's "/" handler. With ADMIN_PORT set the
+// probes, /metrics and /drain are on the admin server instead, and 404
+// here.
+func registerPlatform(mux *http.ServeMux) {
+	if conf("ADMIN_PORT") == "" {
+		registerOps(mux)
+	} else {
+		for _, path := range opsPaths() {
+			mux.HandleFunc(path, notFound)
+		}
+	}
+	handleGet(mux, "/version", versionHandler)
+	handleGet(mux, "/api/info", infoHandler)
+	handleGet(mux, "/api/flags", flagsHandler)
+	handleGet(mux, "/robots.txt", robotsHandler)
+	handleGet(mux, "/.well-known/security.txt", securityTxtHandler)
+	handleGet(mux, "/.well-known/openluffy-attestation", attestationHandler)
+	handleGet(mux, "/debug/echo", echoHandler)
+	registerFaults(mux)
+	registerConfigEndpoint(mux)
+}
+
+// registerOps registers the operational endpoints, the probes, /metrics
+// and /drain, on mux.
+func registerOps(mux *http.ServeMux) {
+	seen := make(map[string]string)
+	for _, p := range probes {
+		path := conf(p.setting)
+		if other, ok := seen[path]; ok {
+			slog.Error("probe paths must differ, exiting", p.setting, path, other, path)
+			os.Exit(1)
+		}
+		seen[path] = p.setting
+		handleGet(mux, path, p.handler)
+	}
+	handleGet(mux, "/metrics", requireAdmin("metrics", metricsHandler))
+	registerDrain(mux)
+}
+
+// opsPaths are the paths registerOps serves.
+func opsPaths() []string {
+	paths := []string{"/metrics", drainPath}
+	for _, p := range probes {
+		paths = append(paths, conf(p.setting))
+	}
+	return paths
+}
+
+// ADMIN_PORT moves the operational endpoints (the probes, /metrics,
+// /drain and, with ENABLE_PPROF, ENABLE_FAULTS and ENABLE_CONFIG_ENDPOINT,
+// pprof, /debug/faults and /admin/config) off PORT onto a second
+// listener, so the app port can be exposed publicly without them. It
+// listens on every interface whatever BIND_ADDR and LISTEN_SOCKET say,
+// since the kubelet and Prometheus reach it from outside the pod, and
+// speaks plain HTTP: keep it out of the Ingress and point the probes at
+// it, as the Helm chart's app.adminPort does.
+// requireAdmin still applies to /metrics, pprof, /debug/faults and POST
+// /drain there, and /admin/config always needs the credentials.
+
+// newAdminServer returns the server for ADMIN_PORT, or nil when it is
+// unset.
+func newAdminServer() *http.Server {
+	port := conf("ADMIN_PORT")
+	if port == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	registerOps(mux)
+	if confBool("ENABLE_PPROF") {
+		registerPprof(mux)
+	}
+	if confBool("ENABLE_FAULTS") {
+		registerFaultsEndpoint(mux)
+	}
+	if configEndpointEnabled() {
+		handleGet(mux, configPath, serveConfig)
+	}
+	// No WriteTimeout, as on the pprof listener: CPU profiles and
+	// execution traces stream for as long as ?seconds= asks.
+	return &http.Server{
+		Addr:              net.JoinHostPort("", port),
+		Handler:           chain(routeErrors(mux), requestIDMiddleware, recoveryMiddleware),
+		ReadHeaderTimeout: confDuration("HTTP_READ_HEADER_TIMEOUT"),
+		IdleTimeout:       confDuration("HTTP_IDLE_TIMEOUT"),
+		MaxHeaderBytes:    confInt("HTTP_MAX_HEADER_BYTES"),
+	}
+}
+
+// startAdmin listens on ADMIN_PORT, or the second socket passed by socket
+// activation (handoff.go), and serves the admin server in the
+// background. It returns nil without ADMIN_PORT; stop the server with
+// Shutdown once the app server has drained, so probes are answered until
+// the end.
+func startAdmin(ctx context.Context) (*http.Server, error) {
+	srv := newAdminServer()
+	if srv == nil {
+		return nil, nil
+	}
+	ln, err := inheritedListener(1)
+	if ln == nil && err == nil {
+		lc := net.ListenConfig{Control: listenControl()}
+		ln, err = lc.Listen(ctx, "tcp", srv.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ADMIN_PORT: %w", err)
+	}
+	slog.Info("admin server listening", "addr", ln.Addr().String(), "pprof", confBool("ENABLE_PPROF"))
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin server failed", "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+// handleGet registers h for GET (which also matches HEAD) on path, and
+// methodNotAllowed for every other method.
+func handleGet(mux *http.ServeMux, path string, h http.HandlerFunc) {
+	mux.HandleFunc("GET "+path, h)
+	mux.HandleFunc(path, methodNotAllowed("GET, HEAD"))
+}
+
+// robotsHandler serves ROBOTS_TXT verbatim when set. Otherwise production
+// allows crawling and every other environment disallows it, so dev and
+// preprod hosts stay out of search indexes. ROBOTS_TXT=off disables it.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	body := conf("ROBOTS_TXT")
+	if body == "off" {
+		notFound(w, r)
+		return
+	}
+	if body == "" {
+		switch environment {
+		case "prod", "production":
+			body = "User-agent: *\nAllow: /\n"
+		default:
+			body = "User-agent: *\nDisallow: /\n"
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	fmt.Fprint(w, body)
+}
+
+// securityTxtHandler serves an RFC 9116 security.txt built from
+// SECURITY_CONTACT (an email address or URL). It is only served when a
+// contact is configured.
+func securityTxtHandler(w http.ResponseWriter, r *http.Request) {
+	contact := conf("SECURITY_CONTACT")
+	if contact == "" {
+		notFound(w, r)
+		return
+	}
+	if !strings.Contains(contact, ":") && strings.Contains(contact, "@") {
+		contact = "mailto:" + contact
+	}
+
+	expires := conf("SECURITY_TXT_EXPIRES")
+	if expires == "" {
+		expires = time.Now().UTC().AddDate(1, 0, 0).Truncate(24 * time.Hour).Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	fmt.Fprintf(w, "Contact: %s\nExpires: %s\n", contact, expires)
+}
+
+// echoResponse is what /debug/echo returns.
+type echoResponse struct {
+	Method       string              `json:"method"`
+	URI          string              `json:"uri"`
+	Host         string              `json:"host"`
+	Proto        string              `json:"proto"`
+	RemoteAddr   string              `json:"remote_addr"`
+	ClientIP     string              `json:"client_ip"`
+	ForwardedFor []string            `json:"forwarded_for"`
+	Forwarded    string              `json:"forwarded,omitempty"`
+	TLS          *echoTLS            `json:"tls"`
+	Headers      map[string][]string `json:"headers"`
+}
+
+type echoTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+	ClientCN    string `json:"client_cn,omitempty"`
+}
+
+// credentialHeaders are headers whose values redactedHeaders replaces;
+// API_KEY_HEADER is added to them.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactedHeaders copies h with the values of credential headers
+// replaced, for echoing or reporting a request.
+func redactedHeaders(h http.Header) map[string][]string {
+	redacted := append(slices.Clone(credentialHeaders), http.CanonicalHeaderKey(conf("API_KEY_HEADER")))
+	out := make(map[string][]string, len(h))
+	for name, values := range h {
+		if slices.Contains(redacted, name) {
+			values = []string{"[redacted]"}
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// echoHandler describes the request as the app received it, for debugging
+// ingress and proxy setups: which headers made it through, the peer
+// address (the last proxy rather than the client, behind one), the
+// client address TRUSTED_PROXIES resolves it to (clientip.go), the
+// X-Forwarded-For chain and whether TLS ended here. It is served only with
+// DEBUG_ECHO=true, and never echoes credentials.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	if !confBool("DEBUG_ECHO") {
+		notFound(w, r)
+		return
+	}
+	resp := echoResponse{
+		Method:       r.Method,
+		URI:          r.RequestURI,
+		Host:         r.Host,
+		Proto:        r.Proto,
+		RemoteAddr:   r.RemoteAddr,
+		ClientIP:     clientIP(r),
+		ForwardedFor: []string{},
+		Forwarded:    r.Header.Get("Forwarded"),
+		Headers:      redactedHeaders(r.Header),
+	}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				resp.ForwardedFor = append(resp.ForwardedFor, hop)
+			}
+		}
+	}
+	if r.TLS != nil {
+		resp.TLS = &echoTLS{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+			ALPN:        r.TLS.NegotiatedProtocol,
+			ClientCN:    clientCN(r),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Server timeout defaults. ReadHeaderTimeout is what defeats slowloris;
+// the others bound slow uploads, slow readers and idle keep-alives.
+// Each can be overridden with a Go duration, e.g. HTTP_WRITE_TIMEOUT=2m.
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// Connection tuning. The defaults are net/http's; change them to match
+// the ingress or load balancer in front of the app:
+//
+//	HTTP_MAX_HEADER_BYTES       request line and headers, in bytes (default 1 MiB)
+//	HTTP_KEEP_ALIVES            reuse connections between requests (default true)
+//	HTTP_MAX_IDLE_CONNS         idle keep-alive connections kept open; 0 is no limit
+//	HTTP_TCP_KEEP_ALIVE_PERIOD  TCP keep-alive probe interval, or off (default 15s)
+//
+// HTTP_IDLE_TIMEOUT should exceed the ingress's upstream keep-alive
+// timeout (60s by default on ingress-nginx and AWS ALBs), or the app closes
+// connections the ingress is about to reuse and requests fail with 502.
+//
+// Over HTTP_MAX_IDLE_CONNS the connection idle the longest is closed.
+// Ingresses that pool connections per worker can otherwise hold
+// thousands open. A request racing the close fails on the client side;
+// Go clients and ingress-nginx retry idempotent requests on a fresh
+// connection. Closed connections are counted in
+// http_idle_conns_closed_total.
+const (
+	defaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+	defaultTCPKeepAlive   = 15 * time.Second
+)
+
+// checkKeepAlivePeriod accepts a positive Go duration or off.
+func checkKeepAlivePeriod(v string) error {
+	if v == "off" {
+		return nil
+	}
+	if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+		return errors.New("want a positive duration such as 30s, or off")
+	}
+	return nil
+}
+
+// BIND_ADDR is the address the app listens on: empty (the default) for
+// every interface, 127.0.0.1 or ::1 for the pod's own traffic only, as a
+// sidecar or an app behind a proxy in the same pod wants, or one
+// interface's address. IPv6 literals may be bracketed or not: ::1 and
+// [::1] are the same.
+
+// checkBindAddr accepts an IP address, bracketed or not, or localhost.
+func checkBindAddr(v string) error {
+	host := strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+	if _, err := netip.ParseAddr(host); err != nil && host != "localhost" {
+		return errors.New("want an IP address such as 127.0.0.1 or ::1, or localhost")
+	}
+	return nil
+}
+
+// bindHost is BIND_ADDR without brackets, empty for every interface.
+func bindHost() string {
+	return strings.TrimSuffix(strings.TrimPrefix(conf("BIND_ADDR"), "["), "]")
+}
+
+// listenAddr is the address to listen on port at, on BIND_ADDR.
+func listenAddr(port string) string {
+	return net.JoinHostPort(bindHost(), port)
+}
+
+// selfAddr is the address at which the app reaches its own listener on
+// port: loopback when it listens on every interface, BIND_ADDR otherwise.
+func selfAddr(port string) string {
+	host := bindHost()
+	if ip, err := netip.ParseAddr(host); host == "" || (err == nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if err == nil && ip.Is6() {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// newServer returns the app's HTTP server on BIND_ADDR and PORT, with the
+// timeouts and connection settings above.
+func newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              listenAddr(conf("PORT")),
+		Handler:           handler,
+		ReadHeaderTimeout: confDuration("HTTP_READ_HEADER_TIMEOUT"),
+		ReadTimeout:       confDuration("HTTP_READ_TIMEOUT"),
+		WriteTimeout:      confDuration("HTTP_WRITE_TIMEOUT"),
+		IdleTimeout:       confDuration("HTTP_IDLE_TIMEOUT"),
+		MaxHeaderBytes:    confInt("HTTP_MAX_HEADER_BYTES"),
+	}
+	srv.SetKeepAlivesEnabled(confBool("HTTP_KEEP_ALIVES"))
+	if limit := confInt("HTTP_MAX_IDLE_CONNS"); limit > 0 {
+		ic := &idleConns{limit: limit}
+		srv.ConnState = ic.track
+		registerMetrics(ic.writeMetrics)
+	}
+	return srv
+}
+
+// LISTEN_SOCKET replaces the TCP listener on BIND_ADDR and PORT with a
+// Unix socket at that path, for an nginx or a sidecar in front of the app
+// sharing a volume with it, typically an emptyDir. LISTEN_SOCKET_MODE sets
+// its permissions (default 0660: the app's user and group). The kubelet's
+// httpGet probes cannot reach a socket: give the pod exec probes running
+// "/app healthcheck", which dials it. Requests over the socket carry no
+// client address, so RATE_LIMIT_MODE=ip sees a single client unless
+// TRUSTED_PROXIES includes unix and the proxy sets X-Forwarded-For
+// (clientip.go). The socket is removed when the server closes, and a
+// stale one left by a killed process is replaced.
+
+// checkSocketMode accepts octal permission bits such as 0660.
+func checkSocketMode(v string) error {
+	if m, err := strconv.ParseUint(v, 8, 32); err != nil || m > 0o777 {
+		return errors.New("want octal permissions such as 0660")
+	}
+	return nil
+}
+
+// listen opens srv's listener: the first socket passed by socket
+// activation (handoff.go), the Unix socket at LISTEN_SOCKET, or TCP on
+// srv.Addr with the HTTP_TCP_KEEP_ALIVE_PERIOD probe interval and
+// HTTP_REUSE_PORT. Serve it with srv.Serve or srv.ServeTLS.
+func listen(ctx context.Context, srv *http.Server) (net.Listener, error) {
+	if ln, err := inheritedListener(0); ln != nil || err != nil {
+		return ln, err
+	}
+	if path := conf("LISTEN_SOCKET"); path != "" {
+		mode, _ := strconv.ParseUint(conf("LISTEN_SOCKET_MODE"), 8, 32)
+		return listenUnix(ctx, path, os.FileMode(mode))
+	}
+	lc := net.ListenConfig{KeepAlive: tcpKeepAlivePeriod(), Control: listenControl()}
+	return lc.Listen(ctx, "tcp", srv.Addr)
+}
+
+// listenUnix listens on a Unix socket at path with the given permissions.
+// The socket has the umask's permissions until the chmod; its directory
+// should not be writable by others.
+func listenUnix(ctx context.Context, path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("LISTEN_SOCKET %s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// tcpKeepAlivePeriod is HTTP_TCP_KEEP_ALIVE_PERIOD as net.ListenConfig
+// takes it: negative disables keep-alive probes.
+func tcpKeepAlivePeriod() time.Duration {
+	v := conf("HTTP_TCP_KEEP_ALIVE_PERIOD")
+	if v == "off" {
+		return -1
+	}
+	d, _ := time.ParseDuration(v)
+	return d
+}
+
+// idleConns closes the longest-idle connection once more than limit are
+// idle. It is the server's ConnState hook.
+type idleConns struct {
+	limit  int
+	mu     sync.Mutex
+	idle   []net.Conn // oldest first
+	closed atomic.Int64
+}
+
+func (ic *idleConns) track(c net.Conn, state http.ConnState) {
+	ic.mu.Lock()
+	ic.idle = slices.DeleteFunc(ic.idle, func(idle net.Conn) bool { return idle == c })
+	if state == http.StateIdle {
+		ic.idle = append(ic.idle, c)
+	}
+	var evict net.Conn
+	if len(ic.idle) > ic.limit {
+		evict = ic.idle[0]
+		ic.idle = ic.idle[1:]
+	}
+	ic.mu.Unlock()
+
+	if evict != nil {
+		ic.closed.Add(1)
+		evict.Close()
+	}
+}
+
+func (ic *idleConns) writeMetrics(w io.Writer) {
+	ic.mu.Lock()
+	idle := len(ic.idle)
+	ic.mu.Unlock()
+	fmt.Fprintln(w, "# HELP http_idle_conns Idle keep-alive connections.")
+	fmt.Fprintln(w, "# TYPE http_idle_conns gauge")
+	fmt.Fprintf(w, "http_idle_conns %d\n", idle)
+	fmt.Fprintln(w, "# HELP http_idle_conns_closed_total Idle connections closed because HTTP_MAX_IDLE_CONNS were idle.")
+	fmt.Fprintln(w, "# TYPE http_idle_conns_closed_total counter")
+	fmt.Fprintf(w, "http_idle_conns_closed_total %d\n", ic.closed.Load())
+}
+
+// defaultShutdownTimeout leaves headroom inside the default 30s Kubernetes
+// termination grace period. SHUTDOWN_DELAY comes on top of it, so the
+// chart's terminationGracePeriodSeconds must cover both.
+const defaultShutdownTimeout = 25 * time.Second
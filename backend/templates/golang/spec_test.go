@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The service spec is what OpenLuffy's Go, Node.js and Python templates
+// have in common: the settings every stack reads and the endpoints it
+// serves, with Go as the reference. The tables below are rendered from
+// it, so these tests fail when the app stops meeting it: a setting
+// renamed or an endpoint moved here would leave the other stacks behind.
+
+// specSettings are the settings of the spec and their defaults.
+var specSettings = []struct{ name, def string }{
+[% for SETTING in SPEC_SETTINGS %]
+	{"[% SETTING.name | go %]", "[% SETTING.default | go %]"},
+[% end %]
+}
+
+// specEndpoints are the endpoints of the spec. A probe's path is the value
+// of its setting; fields are the keys of a JSON response, and jsonFields
+// those of the JSON an HTML endpoint answers "Accept: application/json"
+// with.
+var specEndpoints = []struct {
+	name        string
+	path        string
+	setting     string
+	contentType string
+	fields      []string
+	jsonFields  []string
+}{
+[% for ENDPOINT in SPEC_ENDPOINTS %]
+	{"[% ENDPOINT.name | go %]", "[% ENDPOINT.path | go %]", "[% ENDPOINT.setting | go %]", "[% ENDPOINT.content_type | go %]", []string{[% for FIELD in ENDPOINT.fields %]"[% FIELD | go %]"[% if not loop.last %], [% end %][% end %]}, []string{[% for FIELD in ENDPOINT.json_fields %]"[% FIELD | go %]"[% if not loop.last %], [% end %][% end %]}},
+[% end %]
+}
+
+// specErrorFields are the keys of every error response.
+var specErrorFields = []string{[% for FIELD in SPEC_ERROR_FIELDS %]"[% FIELD | go %]"[% if not loop.last %], [% end %][% end %]}
+
+func TestSpecSettings(t *testing.T) {
+	for _, want := range specSettings {
+		s, ok := settingIndex[want.name]
+		if !ok {
+			t.Errorf("%s is in the service spec but not in the settings table", want.name)
+			continue
+		}
+		if s.def != want.def {
+			t.Errorf("%s defaults to %q, the service spec says %q", want.name, s.def, want.def)
+		}
+	}
+}
+
+func TestSpecEndpoints(t *testing.T) {
+	withChecks(t)
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	if err := setupApp(mux); err != nil {
+		t.Fatalf("setupApp: %v", err)
+	}
+	for _, e := range specEndpoints {
+		path := e.path
+		if e.setting != "" {
+			path = conf(e.setting)
+		}
+		w := do(mux, "GET", path, nil)
+		if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || !strings.HasPrefix(ct, e.contentType) {
+			t.Errorf("%s: GET %s = %d %s, want 200 %s", e.name, path, w.Code, ct, e.contentType)
+			continue
+		}
+		if len(e.fields) > 0 {
+			var body map[string]any
+			decode(t, w, &body)
+			for _, field := range e.fields {
+				if _, ok := body[field]; !ok {
+					t.Errorf("%s: GET %s has no %q field", e.name, path, field)
+				}
+			}
+		}
+		if len(e.jsonFields) == 0 {
+			continue
+		}
+		w = do(mux, "GET", path, nil, "Accept", "application/json")
+		if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: GET %s with Accept: application/json = %d %s, want 200 application/json", e.name, path, w.Code, ct)
+			continue
+		}
+		var body map[string]any
+		decode(t, w, &body)
+		for _, field := range e.jsonFields {
+			if _, ok := body[field]; !ok {
+				t.Errorf("%s: GET %s as JSON has no %q field", e.name, path, field)
+			}
+		}
+	}
+}
+
+func TestSpecErrors(t *testing.T) {
+	withChecks(t)
+	mux := http.NewServeMux()
+	registerPlatform(mux)
+	if err := setupApp(mux); err != nil {
+		t.Fatalf("setupApp: %v", err)
+	}
+	h := requestIDMiddleware(routeErrors(mux))
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/no-such-page"},
+		{"POST", "/version"},
+	} {
+		w := do(h, req.method, req.path, nil)
+		if ct := w.Header().Get("Content-Type"); w.Code < 400 || !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s %s = %d %s, want a JSON error", req.method, req.path, w.Code, ct)
+			continue
+		}
+		var body map[string]any
+		decode(t, w, &body)
+		for _, field := range specErrorFields {
+			if _, ok := body[field]; !ok {
+				t.Errorf("%s %s: the error has no %q field", req.method, req.path, field)
+			}
+		}
+	}
+}
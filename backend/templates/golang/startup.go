@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Startup probe. /startupz returns 503 until every registered startup task
+// has finished, then 200 for the life of the process. Kubernetes holds off
+// liveness and readiness probes until it passes, so slow one-time boot work
+// does not get the pod killed; the chart gives it startupFailureThreshold x
+// 5s. /readyz also reports not ready until startup completes.
+//
+// Register boot work before the server starts:
+//
+//	registerStartupTask("migrations", func(ctx context.Context) error {
+//		return migrate(ctx, db)
+//	})
+//
+// Tasks run in registration order once the listener is up, so the probe
+// can answer while they run. A failed task keeps /startupz failing and the
+// kubelet restarts the pod once the threshold is exhausted.
+//
+// Before that, STARTUP_WAIT_FOR can hold startup until dependencies are
+// reachable, so pods started before their database do not crash-loop:
+//
+//	STARTUP_WAIT_FOR      readiness checks to wait for, by name: entries
+//	                      of DEPENDENCIES and checks the app registers
+//	                      (postgres, redis, ...); * waits for all of them
+//	STARTUP_WAIT_TIMEOUT  give up and exit after this long (default 2m)
+//
+// The DEPENDENCIES checks are waited for before setupApp, so it can
+// connect to them; the app's own checks after it. The listener is bound
+// only then, so the startup probe fails during the wait: keep the timeout
+// inside startupFailureThreshold x 5s. Checks are retried with backoff
+// from 250ms to 5s, and each attempt that fails is logged.
+
+type StartupResponse struct {
+	Status    string            `json:"status"`
+	Pending   []string          `json:"pending,omitempty"`
+	Failed    map[string]string `json:"failed,omitempty"`
+	Timestamp string            `json:"timestamp"`
+}
+
+type startupTask struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// startupState tracks boot progress. mu guards pending and failed.
+var startupState struct {
+	mu      sync.Mutex
+	tasks   []startupTask
+	pending []string
+	failed  map[string]string
+}
+
+// registerStartupTask adds boot work to run before the app reports started.
+func registerStartupTask(name string, run func(ctx context.Context) error) {
+	startupState.mu.Lock()
+	defer startupState.mu.Unlock()
+	startupState.tasks = append(startupState.tasks, startupTask{name: name, run: run})
+	startupState.pending = append(startupState.pending, name)
+}
+
+// runStartupTasks runs the registered tasks in order, stopping at the first
+// failure.
+func runStartupTasks(ctx context.Context) {
+	for _, t := range startupState.tasks {
+		start := time.Now()
+		err := t.run(ctx)
+
+		startupState.mu.Lock()
+		startupState.pending = startupState.pending[1:]
+		if err != nil {
+			startupState.failed = map[string]string{t.name: err.Error()}
+		}
+		startupState.mu.Unlock()
+
+		if err != nil {
+			slog.Error("startup task failed", "task", t.name, "error", err, "duration", time.Since(start).String())
+			return
+		}
+		slog.Info("startup task finished", "task", t.name, "duration", time.Since(start).String())
+	}
+}
+
+// started reports whether every startup task has completed successfully.
+func started() bool {
+	startupState.mu.Lock()
+	defer startupState.mu.Unlock()
+	return len(startupState.pending) == 0 && len(startupState.failed) == 0
+}
+
+func startupHandler(w http.ResponseWriter, r *http.Request) {
+	startupState.mu.Lock()
+	resp := StartupResponse{
+		Status:    "started",
+		Pending:   append([]string(nil), startupState.pending...),
+		Failed:    startupState.failed,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	startupState.mu.Unlock()
+
+	code := http.StatusOK
+	switch {
+	case len(resp.Failed) > 0:
+		resp.Status, code = "failed", http.StatusServiceUnavailable
+	case len(resp.Pending) > 0:
+		resp.Status, code = "starting", http.StatusServiceUnavailable
+	}
+
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, resp.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Backoff between the attempts of a startup wait.
+const (
+	startupWaitInitialBackoff = 250 * time.Millisecond
+	startupWaitMaxBackoff     = 5 * time.Second
+)
+
+// startupWait waits for the readiness checks named in STARTUP_WAIT_FOR,
+// in phases as they are registered, under one timeout.
+type startupWait struct {
+	names    []string
+	all      bool
+	timeout  time.Duration
+	deadline time.Time // set by the first phase with checks to wait for
+	waited   map[string]bool
+}
+
+func newStartupWait() *startupWait {
+	w := &startupWait{timeout: confDuration("STARTUP_WAIT_TIMEOUT"), waited: map[string]bool{}}
+	for _, name := range confList("STARTUP_WAIT_FOR") {
+		if name == "*" {
+			w.all = true
+		} else {
+			w.names = append(w.names, name)
+		}
+	}
+	return w
+}
+
+// wait blocks until every selected readiness check registered since the
+// last phase passes at once. In the final phase, a name no check was
+// registered under is a configuration error.
+func (w *startupWait) wait(ctx context.Context, final bool) error {
+	var checks []*healthCheck
+	for _, c := range readinessChecks.checks {
+		if !w.waited[c.name] && (w.all || slices.Contains(w.names, c.name)) {
+			checks = append(checks, c)
+			w.waited[c.name] = true
+		}
+	}
+	if final {
+		for _, name := range w.names {
+			if !w.waited[name] {
+				return fmt.Errorf("STARTUP_WAIT_FOR: no readiness check named %q", name)
+			}
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	if w.deadline.IsZero() {
+		w.deadline = time.Now().Add(w.timeout)
+	}
+	waitCtx, cancel := context.WithDeadline(ctx, w.deadline)
+	defer cancel()
+
+	start, delay := time.Now(), startupWaitInitialBackoff
+	for attempt := 1; ; attempt++ {
+		failed := map[string]string{}
+		for _, c := range checks {
+			if r := c.check(waitCtx); r.Err != nil {
+				failed[c.name] = r.Err.Error()
+			}
+		}
+		if len(failed) == 0 {
+			names := make([]string, len(checks))
+			for i, c := range checks {
+				names[i] = c.name
+			}
+			slog.Info("dependencies ready", "names", names, "attempts", attempt, "waited", time.Since(start).Round(time.Millisecond).String())
+			return nil
+		}
+		slog.Info("waiting for dependencies", "failing", failed, "attempt", attempt, "retry_in", delay.String())
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("not ready after %s: %s", w.timeout, strings.Join(slices.Sorted(maps.Keys(failed)), ", "))
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, startupWaitMaxBackoff)
+	}
+}
+
+// exitStartupWait ends a process whose startup wait failed: quietly when
+// it was told to stop, with an error when the dependencies timed out.
+func exitStartupWait(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		slog.Info("shutdown signal received while waiting for dependencies")
+		os.Exit(0)
+	}
+	slog.Error("dependencies not ready, exiting", "error", err)
+	os.Exit(1)
+}
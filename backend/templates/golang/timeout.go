@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request deadlines. Each request's context gets one, so the database
+// queries and upstream calls made with it are cancelled at the deadline
+// instead of holding the handler's goroutine for as long as a slow
+// dependency takes.
+//
+//	REQUEST_TIMEOUT   deadline of a request (default 25s, inside the 30s
+//	                  HTTP_WRITE_TIMEOUT so the client gets an answer
+//	                  before its connection is cut)
+//	REQUEST_TIMEOUTS  per route group, path prefix=duration, e.g.
+//	                  "/api/reports=2m,/internal/=5s"; the longest prefix
+//	                  matching wins, and 0 exempts the group, so "/=0"
+//	                  turns deadlines off
+//
+// A handler that has not started its response by the deadline is
+// answered 504 at once, "request timed out" in the error envelope
+// (errors.go); what it writes after is discarded, and its goroutine ends
+// when it notices the cancelled context. A handler that has started its response
+// finishes it, with its context cancelled all the same. Routes that hold
+// the connection open, such as event streams, WebSockets and proxied
+// routes, are exempted by their templates with setRouteTimeout from
+// setupApp; REQUEST_TIMEOUTS overrides them.
+//
+// /metrics reports http_request_timeouts_total, and
+// http_requests_abandoned, the handlers still running after their 504:
+// if it grows, some handler ignores its context.
+
+// defaultRequestTimeout is the REQUEST_TIMEOUT default.
+const defaultRequestTimeout = 25 * time.Second
+
+// routeTimeout is the deadline of the requests under prefix.
+type routeTimeout struct {
+	prefix  string
+	timeout time.Duration
+}
+
+// appRouteTimeouts are the groups set with setRouteTimeout.
+var appRouteTimeouts []routeTimeout
+
+// setRouteTimeout gives the requests under prefix their own deadline, 0
+// for none. Call it from setupApp.
+func setRouteTimeout(prefix string, timeout time.Duration) {
+	appRouteTimeouts = append(appRouteTimeouts, routeTimeout{prefix: prefix, timeout: timeout})
+}
+
+// parseRouteTimeouts reads REQUEST_TIMEOUTS.
+func parseRouteTimeouts(entries []string) ([]routeTimeout, error) {
+	var routes []routeTimeout
+	for _, entry := range entries {
+		prefix, raw, _ := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if !strings.HasPrefix(prefix, "/") || err != nil || d < 0 {
+			return nil, fmt.Errorf("%q: want /prefix=duration", entry)
+		}
+		routes = append(routes, routeTimeout{prefix: prefix, timeout: d})
+	}
+	return routes, nil
+}
+
+func checkRouteTimeouts(v string) error {
+	_, err := parseRouteTimeouts(strings.Split(v, ","))
+	return err
+}
+
+type requestTimeouts struct {
+	def    time.Duration
+	routes []routeTimeout // longest prefix first
+
+	timedOut, abandoned atomic.Int64
+}
+
+// newRequestTimeouts reads the REQUEST_TIMEOUT variables.
+func newRequestTimeouts() *requestTimeouts {
+	configured, _ := parseRouteTimeouts(confList("REQUEST_TIMEOUTS"))
+	rt := &requestTimeouts{
+		def:    confDuration("REQUEST_TIMEOUT"),
+		routes: slices.Concat(configured, appRouteTimeouts),
+	}
+	// Stable, so a configured group beats the app's for the same prefix.
+	slices.SortStableFunc(rt.routes, func(a, b routeTimeout) int { return len(b.prefix) - len(a.prefix) })
+	registerMetrics(rt.writeMetrics)
+	return rt
+}
+
+// timeout returns the deadline of requests to path.
+func (rt *requestTimeouts) timeout(path string) time.Duration {
+	for _, route := range rt.routes {
+		if protectedPath(path, []string{route.prefix}) {
+			return route.timeout
+		}
+	}
+	return rt.def
+}
+
+// timeoutMiddleware runs each request under its deadline.
+func timeoutMiddleware(rt *requestTimeouts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := rt.timeout(r.URL.Path)
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, h: w.Header().Clone()}
+		done := make(chan struct{})
+		go func() {
+			defer func() {
+				tw.panicked = recover()
+				tw.finish(rt)
+				close(done)
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// The handler finishes on its own what it has started, and
+			// the requests of clients that went away, which need no 504.
+			if r.Context().Err() != nil || !tw.timeOut(rt) {
+				<-done
+				break
+			}
+			rt.timedOut.Add(1)
+			requestLogger(r).Warn("request timed out", "method", r.Method, "path", r.URL.Path, "timeout", d.String())
+			writeError(w, r, http.StatusGatewayTimeout, "request timed out")
+			return
+		}
+		// recoveryMiddleware handles the rest; http.ErrAbortHandler is for
+		// net/http.
+		if tw.panicked != nil {
+			panic(tw.panicked)
+		}
+	})
+}
+
+// timeoutWriter passes a handler's response through until the request
+// times out, and discards it after. The handler gets a header map of its
+// own, copied to w's when its response starts, so it never touches w's
+// while the 504 is written.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	finished    bool
+
+	panicked any // what the handler panicked with, read once it returned
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+// copyHeader sets w's headers to the handler's. Called with mu held.
+func (tw *timeoutWriter) copyHeader() {
+	dst := tw.w.Header()
+	clear(dst)
+	maps.Copy(dst, tw.h)
+}
+
+// commit starts the response on w. Called with mu held.
+func (tw *timeoutWriter) commit(code int) {
+	tw.copyHeader()
+	tw.w.WriteHeader(code)
+	if code >= 200 {
+		tw.wroteHeader = true
+	}
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut && !tw.wroteHeader {
+		tw.commit(code)
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.commit(http.StatusOK)
+	}
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.commit(http.StatusOK)
+	}
+	http.NewResponseController(tw.w).Flush()
+}
+
+// Unwrap gives http.ResponseController the writer underneath.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter { return tw.w }
+
+// timeOut stops the handler's writes, reporting whether its response had
+// not started, so a 504 may be written instead. The handler then counts
+// as abandoned until it returns.
+func (tw *timeoutWriter) timeOut(rt *requestTimeouts) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader || tw.finished {
+		return false
+	}
+	tw.timedOut = true
+	rt.abandoned.Add(1)
+	return true
+}
+
+// finish is called when the handler returns. A handler that wrote
+// nothing may still have set headers, for the empty 200 net/http sends.
+func (tw *timeoutWriter) finish(rt *requestTimeouts) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.finished = true
+	switch {
+	case tw.timedOut:
+		rt.abandoned.Add(-1)
+	case !tw.wroteHeader:
+		tw.copyHeader()
+	}
+}
+
+func (rt *requestTimeouts) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP http_request_timeouts_total Requests answered 504 because their REQUEST_TIMEOUT passed.")
+	fmt.Fprintln(w, "# TYPE http_request_timeouts_total counter")
+	fmt.Fprintf(w, "http_request_timeouts_total %d\n", rt.timedOut.Load())
+	fmt.Fprintln(w, "# HELP http_requests_abandoned Handlers of timed out requests still running.")
+	fmt.Fprintln(w, "# TYPE http_requests_abandoned gauge")
+	fmt.Fprintf(w, "http_requests_abandoned %d\n", rt.abandoned.Load())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withRouteTimeouts sets the app's route groups for one test.
+func withRouteTimeouts(t *testing.T, routes ...routeTimeout) {
+	t.Helper()
+	saved, savedApp := metricWriters, appRouteTimeouts
+	t.Cleanup(func() { metricWriters, appRouteTimeouts = saved, savedApp })
+	appRouteTimeouts = routes
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT", "50ms")
+	t.Setenv("REQUEST_TIMEOUTS", "/reports=1s,/stream=0")
+	withRouteTimeouts(t)
+	rt := newRequestTimeouts()
+
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	h := timeoutMiddleware(rt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stuck": // ignores its context
+			<-release
+			w.Write([]byte("too late"))
+		case "/started":
+			w.Write([]byte("partial "))
+			<-r.Context().Done()
+			w.Write([]byte("rest"))
+		default:
+			deadline, ok := r.Context().Deadline()
+			w.Header().Set("X-Deadline", time.Until(deadline).Round(time.Second).String())
+			if !ok {
+				w.Header().Set("X-Deadline", "none")
+			}
+		}
+	}))
+
+	w := do(h, "GET", "/stuck", nil)
+	if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "request timed out") {
+		t.Errorf("stuck handler: %d %s, want 504 JSON", w.Code, w.Body)
+	}
+	if rt.timedOut.Load() != 1 || rt.abandoned.Load() != 1 {
+		t.Errorf("timed out %d, abandoned %d; want 1 and 1", rt.timedOut.Load(), rt.abandoned.Load())
+	}
+
+	if w := do(h, "GET", "/started", nil); w.Code != http.StatusOK || w.Body.String() != "partial rest" {
+		t.Errorf("started response: %d %q, want it finished", w.Code, w.Body)
+	}
+
+	for path, want := range map[string]string{
+		"/reports/q3": "1s", // the route group's
+		"/reportsx":   "0s", // not in the group: REQUEST_TIMEOUT
+		"/stream":     "none",
+	} {
+		if got := do(h, "GET", path, nil).Header().Get("X-Deadline"); got != want {
+			t.Errorf("%s deadline %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestRequestTimeoutRoutes(t *testing.T) {
+	withRouteTimeouts(t, routeTimeout{"/events", 0}, routeTimeout{"/api", 2 * time.Second})
+	t.Setenv("REQUEST_TIMEOUTS", "/api=5s")
+	rt := newRequestTimeouts()
+	for path, want := range map[string]time.Duration{
+		"/events":   0,
+		"/api/x":    5 * time.Second, // REQUEST_TIMEOUTS over setRouteTimeout
+		"/anything": defaultRequestTimeout,
+	} {
+		if got := rt.timeout(path); got != want {
+			t.Errorf("timeout(%s) = %s, want %s", path, got, want)
+		}
+	}
+
+	if err := checkRouteTimeouts("/api=5s,reports=1m"); err == nil {
+		t.Error("REQUEST_TIMEOUTS entry without a leading / accepted")
+	}
+}
+
+func TestRequestTimeoutCancelsDownstream(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT", "50ms")
+	withRouteTimeouts(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(upstream.Close)
+
+	rt := newRequestTimeouts()
+	cause := make(chan error, 1)
+	h := timeoutMiddleware(rt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", upstream.URL, nil)
+		_, err := http.DefaultClient.Do(req)
+		cause <- err
+	}))
+	do(h, "GET", "/", nil)
+	select {
+	case err := <-cause:
+		if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+			t.Errorf("upstream call = %v, want it cancelled at the deadline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream call not cancelled")
+	}
+	deadline := time.Now().Add(time.Second)
+	for rt.abandoned.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := rt.abandoned.Load(); n != 0 {
+		t.Errorf("abandoned = %d once the handler returned, want 0", n)
+	}
+}
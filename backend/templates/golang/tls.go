@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// HTTPS serving with zero-downtime certificate rotation, and optionally
+// mutual TLS.
+//
+//	TLS_CERT_FILE         PEM certificate chain; enables HTTPS with TLS_KEY_FILE
+//	TLS_KEY_FILE          PEM private key
+//	TLS_RELOAD_INTERVAL   how often to check the files for changes (default 1m)
+//	TLS_CLIENT_CA_FILE    PEM bundle of the CAs client certificates must
+//	                      chain to; enables mutual TLS
+//	TLS_CLIENT_CNS        client certificate common names allowed in (default
+//	                      any the CAs issued)
+//	TLS_CLIENT_EXEMPT     paths served without a client certificate
+//	                      (default the probe paths)
+//
+// The certificate is served from an atomic pointer through
+// tls.Config.GetCertificate, so renewed certificates (cert-manager,
+// Vault agent, ...) are picked up without a restart. Files are re-read on
+// SIGHUP and whenever their contents change. A new pair is validated before
+// it replaces the current one; a bad renewal is logged and the previous
+// certificate keeps being served. The client CA bundle is reloaded the
+// same way.
+//
+// With mutual TLS, a client certificate that does not chain to the CAs,
+// or is not meant for client authentication, fails the handshake. A connection without one is accepted, but
+// mtlsMiddleware answers its requests with 403 outside TLS_CLIENT_EXEMPT:
+// the kubelet's HTTPS probes and the container health check present no
+// certificate. Handlers read the verified client's common name with
+// clientCN; request log lines carry it as client_cn.
+
+const defaultTLSReloadInterval = time.Minute
+
+// certReloader holds the certificate currently served.
+type certReloader struct {
+	certFile, keyFile string
+	caFile            string // empty without mutual TLS
+
+	cert            atomic.Pointer[tls.Certificate]
+	certPEM, keyPEM []byte
+	clientCAs       atomic.Pointer[x509.CertPool]
+	caPEM           []byte
+}
+
+// newCertReloader loads the initial certificate and client CAs. Failing
+// here is fatal for the caller: there is nothing to fall back to.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	if caFile != "" {
+		if err := cr.reloadClientCAs(); err != nil {
+			return nil, err
+		}
+	}
+	return cr, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load(), nil
+}
+
+// reload reads the files and swaps in the pair if it changed and is valid.
+// It reports whether a new certificate was installed.
+func (cr *certReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(cr.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(certPEM, cr.certPEM) && bytes.Equal(keyPEM, cr.keyPEM) {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return false, fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+
+	cr.cert.Store(&cert)
+	cr.certPEM, cr.keyPEM = certPEM, keyPEM
+	slog.Info("TLS certificate loaded",
+		"subject", leaf.Subject.String(),
+		"serial", leaf.SerialNumber.String(),
+		"not_after", leaf.NotAfter.Format(time.RFC3339))
+	return true, nil
+}
+
+// reloadClientCAs reads TLS_CLIENT_CA_FILE and swaps in its CAs if the
+// file changed and holds at least one certificate.
+func (cr *certReloader) reloadClientCAs() error {
+	caPEM, err := os.ReadFile(cr.caFile)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(caPEM, cr.caPEM) {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("%s: no PEM certificates", cr.caFile)
+	}
+	cr.clientCAs.Store(pool)
+	cr.caPEM = caPEM
+	slog.Info("TLS client CAs loaded", "file", cr.caFile)
+	return nil
+}
+
+// watch reloads the certificate on SIGHUP and on every interval tick until
+// ctx is done.
+func (cr *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+		}
+		if _, err := cr.reload(); err != nil {
+			slog.Error("TLS certificate reload failed, keeping current certificate", "error", err)
+		}
+		if cr.caFile != "" {
+			if err := cr.reloadClientCAs(); err != nil {
+				slog.Error("TLS client CA reload failed, keeping current CAs", "error", err)
+			}
+		}
+	}
+}
+
+// setupTLS returns the TLS config to serve with, or nil when
+// TLS_CERT_FILE/TLS_KEY_FILE are unset and the app should serve plain HTTP.
+func setupTLS(ctx context.Context) (*tls.Config, error) {
+	certFile, keyFile, caFile := conf("TLS_CERT_FILE"), conf("TLS_KEY_FILE"), conf("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	go cr.watch(ctx, confDuration("TLS_RELOAD_INTERVAL"))
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if caFile != "" {
+		// Client certificates are verified here rather than through
+		// ClientCAs, so a reloaded CA bundle applies to the next
+		// handshake without swapping the config the server cloned.
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyClientCert(cs.PeerCertificates, cr.clientCAs.Load())
+		}
+		slog.Info("mutual TLS enabled", "client_ca_file", caFile, "allowed_cns", confList("TLS_CLIENT_CNS"))
+	}
+	return cfg, nil
+}
+
+// verifyClientCert checks a presented client certificate chain against
+// roots. Presenting none is not an error here; mtlsMiddleware decides
+// which requests need one.
+func verifyClientCert(chain []*x509.Certificate, roots *x509.CertPool) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// hasClientCert reports whether r came with a client certificate, which
+// the handshake has verified.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
+
+// clientCN returns the common name of r's client certificate, or "".
+func clientCN(r *http.Request) string {
+	if !hasClientCert(r) {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// mtlsMiddleware requires a verified client certificate, with an allowed
+// common name, outside TLS_CLIENT_EXEMPT when mutual TLS is on.
+func mtlsMiddleware(next http.Handler) http.Handler {
+	if conf("TLS_CLIENT_CA_FILE") == "" {
+		return next
+	}
+	exempt := confList("TLS_CLIENT_EXEMPT")
+	allowed := confList("TLS_CLIENT_CNS")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case !hasClientCert(r):
+			writeError(w, r, http.StatusForbidden, "client certificate required")
+			return
+		case len(allowed) > 0 && !slices.Contains(allowed, clientCN(r)):
+			requestLogger(r).Warn("client certificate not allowed")
+			writeError(w, r, http.StatusForbidden, "client certificate not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
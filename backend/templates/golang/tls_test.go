@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the mutual TLS tests.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{t: t, cert: cert, key: key}
+}
+
+// issue returns a certificate for cn with the given extended key usage.
+func (ca *testCA) issue(cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes blocks of typ to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, typ string, blocks ...[]byte) string {
+	t.Helper()
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withMTLS serves h over HTTPS with mutual TLS against ca and returns the
+// server URL and a client factory.
+func withMTLS(t *testing.T, ca *testCA, h http.Handler) (string, func(*tls.Certificate) *http.Client) {
+	t.Helper()
+	dir := t.TempDir()
+	server := ca.issue("127.0.0.1", x509.ExtKeyUsageServerAuth)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TLS_CERT_FILE", writePEM(t, dir, "tls.crt", "CERTIFICATE", server.Certificate[0]))
+	t.Setenv("TLS_KEY_FILE", writePEM(t, dir, "tls.key", "PRIVATE KEY", keyDER))
+	t.Setenv("TLS_CLIENT_CA_FILE", writePEM(t, dir, "ca.crt", "CERTIFICATE", ca.cert.Raw))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cfg, err := setupTLS(ctx)
+	if err != nil {
+		t.Fatalf("setupTLS: %v", err)
+	}
+	// Not StartTLS: it would add httptest's own certificate, which wins
+	// over GetCertificate for clients that send no server name.
+	srv := httptest.NewUnstartedServer(mtlsMiddleware(h))
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return "https://" + srv.Listener.Addr().String(), func(cert *tls.Certificate) *http.Client {
+		c := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			c.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string, error) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	t.Setenv("TLS_CLIENT_CNS", "billing")
+	url, client := withMTLS(t, ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientCN(r))
+	}))
+
+	billing := ca.issue("billing", x509.ExtKeyUsageClientAuth)
+	if code, body, err := get(t, client(&billing), url+"/api/items"); err != nil || code != http.StatusOK || body != "billing" {
+		t.Errorf("allowed client certificate: %d %q %v, want 200 with its CN", code, body, err)
+	}
+
+	reports := ca.issue("reports", x509.ExtKeyUsageClientAuth)
+	if code, _, err := get(t, client(&reports), url+"/api/items"); err != nil || code != http.StatusForbidden {
+		t.Errorf("client certificate with another CN: %d %v, want 403", code, err)
+	}
+
+	if code, _, err := get(t, client(nil), url+"/api/items"); err != nil || code != http.StatusForbidden {
+		t.Errorf("no client certificate: %d %v, want 403", code, err)
+	}
+	if code, _, err := get(t, client(nil), url+"/healthz"); err != nil || code != http.StatusOK {
+		t.Errorf("no client certificate on an exempt path: %d %v, want 200", code, err)
+	}
+
+	intruder := newTestCA(t, "other CA").issue("billing", x509.ExtKeyUsageClientAuth)
+	if _, _, err := get(t, client(&intruder), url+"/api/items"); err == nil {
+		t.Error("client certificate from another CA passed the handshake")
+	}
+	serverOnly := ca.issue("billing", x509.ExtKeyUsageServerAuth)
+	if _, _, err := get(t, client(&serverOnly), url+"/api/items"); err == nil {
+		t.Error("certificate without client auth usage passed the handshake")
+	}
+}
+
+func TestMutualTLSNeedsTLS(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CLIENT_CA_FILE", "/etc/tls/ca.crt")
+	if _, err := setupTLS(context.Background()); err == nil {
+		t.Fatal("setupTLS accepted TLS_CLIENT_CA_FILE without a server certificate")
+	}
+}
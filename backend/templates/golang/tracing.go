@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetry tracing: one server span per request, W3C trace context
+// propagation on inbound and outbound requests (outbound via
+// propagatingTransport), and a batching exporter
+// speaking OTLP/HTTP with JSON encoding (accepted by the OpenTelemetry
+// Collector, Tempo and Jaeger on the OTLP HTTP port, usually 4318).
+//
+// Tracing is off unless an endpoint is configured through the standard
+// variables:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT         base URL; /v1/traces is appended
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT  full traces URL, used as-is
+//	OTEL_EXPORTER_OTLP_HEADERS          extra headers, "k1=v1,k2=v2"
+//	OTEL_SERVICE_NAME                   defaults to the app name
+//	OTEL_TRACES_SAMPLER_ARG             root sampling ratio, 0..1 (default 1
+//	                                    in development, 0.5 in staging and
+//	                                    0.1 in production)
+//
+// Sampling is parent-based: requests arriving with a traceparent follow the
+// caller's sampled flag; new traces are sampled at OTEL_TRACES_SAMPLER_ARG.
+
+const (
+	spanBatchSize     = 512
+	spanQueueSize     = 2048
+	spanFlushInterval = 5 * time.Second
+)
+
+type traceID [16]byte
+
+type spanID [8]byte
+
+// spanContext identifies a span within a trace.
+type spanContext struct {
+	TraceID traceID
+	SpanID  spanID
+	Sampled bool
+}
+
+// traceparent formats sc as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != 16 {
+		return sc, false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], tid)
+	copy(sc.SpanID[:], sid)
+	if sc.TraceID == (traceID{}) || sc.SpanID == (spanID{}) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// span is a finished or in-progress server span.
+type span struct {
+	Context spanContext
+	Parent  spanID
+	Name    string
+	Start   time.Time
+	End     time.Time
+	Attrs   map[string]any
+	Error   bool
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span context of the request being served.
+func spanFromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(spanContext)
+	return sc, ok
+}
+
+// tracer owns sampling and span export. A nil *tracer means tracing is off.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	ratio    float64
+	client   *http.Client
+
+	queue   chan *span
+	done    chan struct{} // closed to request a final flush
+	stopped chan struct{} // closed by run once the final flush is done
+	once    sync.Once
+}
+
+var tracing *tracer
+
+// setupTracing configures the global tracer from the OTEL_* environment.
+func setupTracing() {
+	endpoint := conf("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := conf("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+
+	ratio := confFloat("OTEL_TRACES_SAMPLER_ARG")
+	service := conf("OTEL_SERVICE_NAME")
+
+	headers := parseHeaders(confList("OTEL_EXPORTER_OTLP_HEADERS"))
+
+	tracing = &tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, spanQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go tracing.run()
+
+	slog.Info("tracing enabled", "endpoint", endpoint, "sample_ratio", ratio)
+}
+
+// startSpan begins a server span, continuing the caller's trace if the
+// request carried a valid traceparent.
+func (t *tracer) startSpan(r *http.Request) *span {
+	s := &span{Start: time.Now(), Attrs: map[string]any{}}
+	if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.Context.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.Context.Sampled = parent.Sampled
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		// The low 8 bytes of a random trace ID are uniformly distributed,
+		// which makes them a fair sampling source.
+		threshold := uint64(t.ratio * float64(^uint64(0)))
+		s.Context.Sampled = t.ratio >= 1 || binary.BigEndian.Uint64(s.Context.TraceID[8:]) < threshold
+	}
+	rand.Read(s.Context.SpanID[:])
+	return s
+}
+
+// finish queues a sampled span for export, dropping it if the queue is full
+// rather than blocking the request.
+func (t *tracer) finish(s *span) {
+	if !s.Context.Sampled {
+		return
+	}
+	s.End = time.Now()
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, spanBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// shutdownTracing flushes queued spans, waiting at most until ctx is done.
+func shutdownTracing(ctx context.Context) {
+	if tracing == nil {
+		return
+	}
+	tracing.once.Do(func() { close(tracing.done) })
+	select {
+	case <-tracing.stopped:
+	case <-ctx.Done():
+		slog.Warn("timed out flushing trace spans")
+	}
+}
+
+// OTLP/JSON payload types. Trace and span IDs are hex strings and
+// timestamps are decimal strings, per the OTLP JSON encoding rules.
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            map[string]int  `json:"status,omitempty"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case bool:
+		return map[string]any{"boolValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (t *tracer) export(batch []*span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              2, // SPAN_KIND_SERVER
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (spanID{}) {
+			out.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for k, v := range s.Attrs {
+			out.Attributes = append(out.Attributes, otlpAttribute{Key: k, Value: otlpValue(v)})
+		}
+		if s.Error {
+			out.Status = map[string]int{"code": 2} // STATUS_CODE_ERROR
+		}
+		spans = append(spans, out)
+	}
+
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{
+				{Key: "service.name", Value: otlpValue(t.service)},
+				{Key: "deployment.environment", Value: otlpValue(environment)},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "openluffy-template"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Warn("encoding trace spans failed", "error", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("building trace export request failed", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		slog.Warn("exporting trace spans failed", "error", err, "spans", len(batch))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		slog.Warn("trace collector rejected spans", "status", resp.StatusCode, "spans", len(batch))
+	}
+}
+
+// tracingMiddleware wraps each request in a server span named after the
+// matched route and stores its span context for logging and propagation.
+func tracingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	if tracing == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		s := tracing.startSpan(r)
+		s.Name = r.Method + " " + route
+		s.Attrs["http.request.method"] = r.Method
+		s.Attrs["http.route"] = route
+		s.Attrs["url.path"] = r.URL.Path
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), spanKey{}, s.Context)))
+
+		code := rec.statusCode()
+		s.Attrs["http.response.status_code"] = code
+		s.Error = code >= http.StatusInternalServerError
+		tracing.finish(s)
+	})
+}
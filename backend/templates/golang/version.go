@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Build metadata, served on /version. gitSHA and buildTime are stamped by
+// the Dockerfile through -ldflags:
+//
+//	go build -ldflags "-X main.gitSHA=<sha> -X main.buildTime=<RFC 3339>"
+//
+// Local builds without ldflags fall back to the VCS information the Go
+// toolchain embeds when building inside a git checkout.
+var (
+	gitSHA    = ""
+	buildTime = ""
+)
+
+// Template provenance: the OpenLuffy template this app was generated
+// from, when, and a SHA-256 of the variables it was rendered with, as
+// .openluffy.json records them. The backend writes them into
+// .openluffy.ldflags at render time, and the Dockerfile and Makefile add
+// that file to -ldflags, so a build is stamped with the render it came
+// from. Being build flags, they are also in the build info of binaries
+// built without -trimpath, as the Dockerfile's are (debug.ReadBuildInfo,
+// go version -m), so a fleet can be audited for template drift from its
+// images alone. templateVersion defaults to the version rendered into
+// the source; the others are empty unless stamped.
+var (
+	templateName     = ""
+	templateVersion  = "[% TEMPLATE_VERSION %]"
+	templateRevision = ""
+	renderedAt       = ""
+	variablesHash    = ""
+)
+
+type VersionResponse struct {
+	GitSHA           string `json:"git_sha"`
+	BuildTime        string `json:"build_time"`
+	GoVersion        string `json:"go_version"`
+	Template         string `json:"template,omitempty"`
+	TemplateVersion  string `json:"template_version"`
+	TemplateRevision string `json:"template_revision,omitempty"`
+	RenderedAt       string `json:"rendered_at,omitempty"`
+	VariablesSHA256  string `json:"variables_sha256,omitempty"`
+}
+
+// buildVersion resolves the metadata once at startup.
+func buildVersion() VersionResponse {
+	v := VersionResponse{
+		GitSHA:           gitSHA,
+		BuildTime:        buildTime,
+		GoVersion:        runtime.Version(),
+		Template:         templateName,
+		TemplateVersion:  templateVersion,
+		TemplateRevision: templateRevision,
+		RenderedAt:       renderedAt,
+		VariablesSHA256:  variablesHash,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && v.GitSHA == "":
+				v.GitSHA = s.Value
+			case s.Key == "vcs.time" && v.BuildTime == "":
+				v.BuildTime = s.Value
+			}
+		}
+	}
+	if v.GitSHA == "" {
+		v.GitSHA = "unknown"
+	}
+	if v.BuildTime == "" {
+		v.BuildTime = "unknown"
+	}
+	return v
+}
+
+var version = buildVersion()
+
+// attestationToken is the attestation the backend signed when it
+// rendered this app into its customer's repo: a JWT naming the customer,
+// app and template provenance, verified with the backend's
+// POST /api/v1/attestations/verify. The Dockerfile and Makefile stamp it
+// from .openluffy.attestation; apps not rendered by the backend, such as
+// local scaffolds, have none.
+var attestationToken = ""
+
+// AttestationResponse is served on /.well-known/openluffy-attestation.
+// Claims are the token's, decoded for reading, not verified: only the
+// backend can verify them.
+type AttestationResponse struct {
+	Token  string          `json:"token"`
+	Claims json.RawMessage `json:"claims,omitempty"`
+}
+
+// attestationHandler serves the render attestation, or 404 without one.
+func attestationHandler(w http.ResponseWriter, r *http.Request) {
+	if attestationToken == "" {
+		notFound(w, r)
+		return
+	}
+	resp := AttestationResponse{Token: attestationToken}
+	if parts := strings.Split(attestationToken, "."); len(parts) == 3 {
+		if claims, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && json.Valid(claims) {
+			resp.Claims = claims
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// InfoResponse identifies the replica that served a request, for support
+// requests and for telling replicas apart behind a load balancer.
+type InfoResponse struct {
+	App         string `json:"app"`
+	Environment string `json:"environment"`
+	Version     string `json:"version"`
+	Pod         string `json:"pod"`
+	Node        string `json:"node,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+}
+
+// infoHandler serves /api/info. The pod, node and namespace come from
+// POD_NAME, NODE_NAME and POD_NAMESPACE, which the Helm chart sets through
+// the downward API; outside Kubernetes the pod falls back to the host name.
+func infoHandler(w http.ResponseWriter, r *http.Request) {
+	pod := conf("POD_NAME")
+	if pod == "" {
+		pod, _ = os.Hostname()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(InfoResponse{
+		App:         serviceName,
+		Environment: environment,
+		Version:     version.GitSHA,
+		Pod:         pod,
+		Node:        conf("NODE_NAME"),
+		Namespace:   conf("POD_NAMESPACE"),
+	})
+}
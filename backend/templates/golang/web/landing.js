@@ -0,0 +1,57 @@
+// The landing page's live status: poll the readiness probe named by the
+// status section's data-url and show its verdict, with a card per check:
+// its latency when HEALTH_DETAIL lists the checks, otherwise just the
+// names of those failing. Error text is left to the logs. The labels, in
+// the page's language, are the JSON of the status-labels script.
+(() => {
+  const interval = 10000;
+  const section = document.getElementById('status');
+  const url = section.dataset.url;
+  const labels = JSON.parse(document.getElementById('status-labels').textContent);
+  const summary = document.getElementById('status-summary');
+  const list = document.getElementById('checks');
+
+  const card = (name, ok, detail) => {
+    const li = document.createElement('li');
+    li.className = ok ? 'check' : 'check check-failing';
+    const title = document.createElement('span');
+    title.className = 'check-name';
+    title.textContent = name;
+    const info = document.createElement('span');
+    info.className = 'check-detail';
+    info.textContent = detail;
+    li.append(title, info);
+    return li;
+  };
+
+  const show = (state, cards) => {
+    section.dataset.state = state;
+    summary.textContent = labels[state];
+    list.replaceChildren(...cards);
+  };
+
+  const poll = async () => {
+    if (!document.hidden) {
+      try {
+        const res = await fetch(url, { headers: { Accept: 'application/json' }, cache: 'no-store' });
+        const body = await res.json();
+        const state = body.status === 'ready' || body.status === 'starting' ? body.status : 'not_ready';
+        const cards = body.checks
+          ? body.checks.map((c) => card(c.name, c.status === 'ok', [
+              labels[c.status === 'ok' ? 'ok' : 'failing'],
+              `${c.latency_ms.toFixed(1)} ms`,
+              c.cached ? labels.cached : '',
+            ].filter(Boolean).join(' · ')))
+          : Object.keys(body.failing || {}).map((name) => card(name, false, labels.failing));
+        show(state, cards);
+      } catch {
+        show('unreachable', []);
+      }
+    }
+    setTimeout(poll, interval);
+  };
+
+  summary.textContent = labels.checking;
+  section.hidden = false;
+  poll();
+})();
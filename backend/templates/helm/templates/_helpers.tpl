@@ -28,3 +28,15 @@ Selector labels
 {{- define "app.selectorLabels" -}}
 app: {{ include "app.fullname" . }}
 {{- end }}
+
+{{/*
+Port and scheme of the probes: the admin port, which speaks plain HTTP,
+when app.adminPort is set; the http port otherwise.
+*/}}
+{{- define "app.probePort" -}}
+{{- if .Values.app.adminPort }}admin{{ else }}http{{ end }}
+{{- end }}
+
+{{- define "app.probeScheme" -}}
+{{- if .Values.app.adminPort }}HTTP{{ else }}{{ .Values.app.probes.scheme | default "HTTP" }}{{ end }}
+{{- end }}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// The heartbeat mixin: every replica reports to the OpenLuffy control
+// plane every HEARTBEAT_INTERVAL, so the customer's dashboard lists the
+// app's instances with their version, uptime and readiness, and one that
+// stops reporting shows up as stale.
+//
+//	HEARTBEAT_URL       the control plane's heartbeat endpoint,
+//	                    https://<openluffy>/api/v1/heartbeats, filled in
+//	                    when OpenLuffy renders the app; "" turns
+//	                    heartbeats off
+//	HEARTBEAT_ENABLED   "false" turns them off too, e.g. for local runs
+//	HEARTBEAT_TOKEN     an OpenLuffy API token with the heartbeats:write
+//	                    scope; secret and reloadable
+//	HEARTBEAT_INTERVAL  time between heartbeats (default 1m)
+//
+// A heartbeat carries the readiness checks' outcome, as /readyz would
+// report it, but never their error details beyond the failing map. A
+// control plane that is down or refuses a heartbeat is logged and
+// otherwise ignored: the app serves on regardless. On shutdown a last
+// heartbeat reports the instance stopped, so it is not taken for lost.
+
+const heartbeatSendTimeout = 10 * time.Second
+
+var heartbeatSettings = []setting{
+	{name: "HEARTBEAT_URL", def: "[% HEARTBEAT_URL %]", check: checkHeartbeatURL},
+	{name: "HEARTBEAT_ENABLED", kind: kindBool, def: "true"},
+	{name: "HEARTBEAT_TOKEN", secret: true, reloadable: true},
+	{name: "HEARTBEAT_INTERVAL", kind: kindDuration, def: "1m"},
+}
+
+// heartbeatCustomer is the OpenLuffy customer the app was rendered for.
+const heartbeatCustomer = "[% CUSTOMER_ID %]"
+
+// heartbeatStart approximates the process start time: package variables
+// are initialized before main runs.
+var heartbeatStart = time.Now()
+
+func checkHeartbeatURL(v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("want an http or https URL")
+	}
+	return nil
+}
+
+// heartbeat is the payload POSTed to HEARTBEAT_URL.
+type heartbeat struct {
+	CustomerID      string `json:"customer_id"`
+	App             string `json:"app"`
+	Environment     string `json:"environment"`
+	Instance        string `json:"instance"`
+	Version         string `json:"version"`
+	BuildTime       string `json:"build_time,omitempty"`
+	TemplateVersion string `json:"template_version"`
+	StartedAt       string `json:"started_at"`
+	UptimeSeconds   int64  `json:"uptime_seconds"`
+	// Status is ready, starting, not ready, shutting down or stopped.
+	Status          string            `json:"status"`
+	Failing         map[string]string `json:"failing,omitempty"`
+	IntervalSeconds int64             `json:"interval_seconds"`
+}
+
+type heartbeater struct {
+	url      string
+	interval time.Duration
+	instance string
+	client   *http.Client
+}
+
+func setupHeartbeat(*http.ServeMux) error {
+	target := conf("HEARTBEAT_URL")
+	if target == "" || !confBool("HEARTBEAT_ENABLED") {
+		slog.Info("heartbeats off", "url_set", target != "")
+		return nil
+	}
+	if conf("HEARTBEAT_TOKEN") == "" {
+		slog.Warn("HEARTBEAT_TOKEN is not set, the control plane will refuse heartbeats")
+	}
+	hb := newHeartbeater(target)
+	registerBackground("heartbeat", hb.run)
+	u, _ := url.Parse(target)
+	slog.Info("heartbeats enabled", "host", u.Host, "interval", hb.interval.String())
+	return nil
+}
+
+func newHeartbeater(target string) *heartbeater {
+	instance := conf("POD_NAME")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return &heartbeater{
+		url:      target,
+		interval: confDuration("HEARTBEAT_INTERVAL"),
+		instance: instance,
+		client:   &http.Client{Timeout: heartbeatSendTimeout},
+	}
+}
+
+// run sends a heartbeat at once and then every interval until ctx is
+// cancelled, then the last one.
+func (hb *heartbeater) run(ctx context.Context) error {
+	ticker := time.NewTicker(hb.interval)
+	defer ticker.Stop()
+	for {
+		hb.send(ctx, hb.collect(ctx))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			last := hb.collect(ctx)
+			last.Status, last.Failing = "stopped", nil
+			hb.send(context.WithoutCancel(ctx), last)
+			return ctx.Err()
+		}
+	}
+}
+
+// collect reports the instance as /readyz sees it.
+func (hb *heartbeater) collect(ctx context.Context) *heartbeat {
+	now := time.Now()
+	b := &heartbeat{
+		CustomerID:      heartbeatCustomer,
+		App:             serviceName,
+		Environment:     environment,
+		Instance:        hb.instance,
+		Version:         version.GitSHA,
+		BuildTime:       version.BuildTime,
+		TemplateVersion: templateVersion,
+		StartedAt:       heartbeatStart.UTC().Format(time.RFC3339),
+		UptimeSeconds:   int64(now.Sub(heartbeatStart).Seconds()),
+		Status:          "ready",
+		IntervalSeconds: int64(hb.interval.Seconds()),
+	}
+	if reason, _ := shuttingDown(); reason != "" {
+		b.Status = "shutting down"
+		return b
+	}
+	if ctx.Err() != nil {
+		return b
+	}
+	b.Failing = failing(readinessChecks.run(ctx))
+	switch {
+	case !started():
+		b.Status = "starting"
+	case len(b.Failing) > 0:
+		b.Status = "not ready"
+	}
+	return b
+}
+
+// send posts b, logging rather than returning any failure.
+func (hb *heartbeater) send(ctx context.Context, b *heartbeat) {
+	if err := hb.post(ctx, b); err != nil {
+		slog.Warn("sending heartbeat failed", "error", err, "status", b.Status)
+	}
+}
+
+func (hb *heartbeater) post(ctx context.Context, b *heartbeat) error {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, heartbeatSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hb.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "openluffy-heartbeat/"+templateVersion)
+	if token := conf("HEARTBEAT_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := hb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("control plane answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withControlPlane serves a heartbeat endpoint that passes on every
+// heartbeat it receives, with its Authorization header.
+func withControlPlane(t *testing.T) (*httptest.Server, chan *heartbeat, chan string) {
+	t.Helper()
+	beats, auth := make(chan *heartbeat, 10), make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b heartbeat
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Errorf("heartbeat body: %v", err)
+		}
+		beats <- &b
+		auth <- r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, beats, auth
+}
+
+func receive[T any](t *testing.T, c chan T) T {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat within 5s")
+		panic("unreachable")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	withChecks(t)
+	readinessChecks.register("postgres", checkFunc(func(context.Context) error {
+		return errors.New("connection refused")
+	}), 0)
+	t.Setenv("HEARTBEAT_TOKEN", "olf_dev_test")
+	t.Setenv("HEARTBEAT_INTERVAL", "1h")
+	t.Setenv("POD_NAME", "app-7d9f8-x2k4q")
+	srv, beats, auth := withControlPlane(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- newHeartbeater(srv.URL).run(ctx) }()
+
+	b := receive(t, beats)
+	if got := receive(t, auth); got != "Bearer olf_dev_test" {
+		t.Errorf("Authorization = %q, want the HEARTBEAT_TOKEN bearer", got)
+	}
+	if b.App != serviceName || b.Instance != "app-7d9f8-x2k4q" || b.TemplateVersion != templateVersion || b.IntervalSeconds != 3600 {
+		t.Errorf("heartbeat = %+v, want the app, pod, template version and interval", b)
+	}
+	if b.Status != "not ready" || b.Failing["postgres"] == "" {
+		t.Errorf("heartbeat status %q failing %v, want not ready with postgres failing", b.Status, b.Failing)
+	}
+
+	cancel()
+	if last := receive(t, beats); last.Status != "stopped" {
+		t.Errorf("last heartbeat status %q, want stopped", last.Status)
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("run = %v, want context.Canceled", err)
+	}
+}
+
+func TestHeartbeatControlPlaneDown(t *testing.T) {
+	withChecks(t)
+	srv, _, _ := withControlPlane(t)
+	hb := newHeartbeater(srv.URL)
+	srv.Close()
+
+	if err := hb.post(context.Background(), hb.collect(context.Background())); err == nil {
+		t.Error("post to a closed control plane succeeded, want an error")
+	}
+	for _, v := range []string{"openluffy.example.com/api/v1/heartbeats", "ftp://openluffy.example.com", "https://"} {
+		if checkHeartbeatURL(v) == nil {
+			t.Errorf("checkHeartbeatURL(%q) succeeded, want an error", v)
+		}
+	}
+}
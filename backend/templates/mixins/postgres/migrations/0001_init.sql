@@ -0,0 +1,2 @@
+-- The first schema migration, applied at startup. Put the app's tables
+-- here, and each later change in a new file: 0002_add_orders.sql, ...
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+)
+
+// The postgres mixin: a Postgres connection pool, db, for the app's own
+// code, and schema migrations applied at startup. db.go opens the pool,
+// serves its metrics and closes it at shutdown; migrate.go applies the
+// files in migrations/.
+//
+//	DATABASE_URL           postgres:// URL or key=value connection string
+//	DB_MAX_OPEN_CONNS      pool size per replica (default 10)
+//	DB_MAX_IDLE_CONNS      connections kept open when idle (default 5)
+//	DB_CONN_MAX_LIFETIME   connections are recycled after this long, so
+//	                       failovers and PgBouncer restarts are picked up
+//	                       (default 30m)
+//	DB_CONN_MAX_IDLE_TIME  idle connections are closed after this long
+//	                       (default 5m)
+//	DB_MIGRATE             "false" skips migrations at startup, for
+//	                       deployments that run them separately
+//
+// The pool sizes are reloadable. The database is on /readyz, so replicas
+// leave the Service while it is unreachable, but not while their pool is
+// merely full (checkDB).
+
+var postgresSettings = []setting{
+	{name: "DATABASE_URL", required: true, secret: true},
+	{name: "DB_MAX_OPEN_CONNS", kind: kindInt, def: "10", check: atLeast(1), reloadable: true},
+	{name: "DB_MAX_IDLE_CONNS", kind: kindInt, def: "5", check: atLeast(0), reloadable: true},
+	{name: "DB_CONN_MAX_LIFETIME", kind: kindDuration, def: "30m", reloadable: true},
+	{name: "DB_CONN_MAX_IDLE_TIME", kind: kindDuration, def: "5m", reloadable: true},
+	{name: "DB_MIGRATE", kind: kindBool, def: "true"},
+}
+
+// db is the connection pool, opened by setupPostgres before setupApp runs.
+var db *sql.DB
+
+func setupPostgres(*http.ServeMux) error {
+	var err error
+	if db, err = openDB(conf("DATABASE_URL")); err != nil {
+		return err
+	}
+
+	readinessChecks.register("postgres", checkDB(db), 0)
+	if confBool("DB_MIGRATE") {
+		registerStartupTask("migrations", func(ctx context.Context) error {
+			return migrate(ctx, db)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// These tests need no database: opening the pool does not connect.
+
+func TestSetupPostgres(t *testing.T) {
+	withChecks(t)
+	t.Setenv("DATABASE_URL", "postgres://postgres@127.0.0.1:1/postgres?connect_timeout=1")
+	t.Setenv("DB_MIGRATE", "false")
+	savedDB, savedWriters, savedReload, savedShutdown := db, metricWriters, reloadHooks, shutdownHooks
+	t.Cleanup(func() {
+		db, metricWriters, reloadHooks, shutdownHooks = savedDB, savedWriters, savedReload, savedShutdown
+	})
+
+	if err := setupPostgres(http.NewServeMux()); err != nil {
+		t.Fatalf("setupPostgres: %v", err)
+	}
+	if db == nil || len(readinessChecks.checks) != 1 || readinessChecks.checks[0].name != "postgres" {
+		t.Errorf("readiness checks = %+v, want postgres", readinessChecks.checks)
+	}
+	db.Close()
+
+	t.Setenv("DB_MAX_IDLE_CONNS", "20")
+	if err := setupPostgres(http.NewServeMux()); err == nil {
+		t.Error("DB_MAX_IDLE_CONNS above DB_MAX_OPEN_CONNS accepted")
+	}
+}
+
+func TestPostgresPoolLifecycle(t *testing.T) {
+	withChecks(t)
+	t.Setenv("DATABASE_URL", "postgres://postgres@127.0.0.1:1/postgres?connect_timeout=1")
+	t.Setenv("DB_MIGRATE", "false")
+	savedDB, savedWriters, savedReload, savedShutdown := db, metricWriters, reloadHooks, shutdownHooks
+	t.Cleanup(func() {
+		db, metricWriters, reloadHooks, shutdownHooks = savedDB, savedWriters, savedReload, savedShutdown
+	})
+	sources := currentSources.Load()
+	t.Cleanup(func() { currentSources.Store(sources) })
+
+	if err := setupPostgres(http.NewServeMux()); err != nil {
+		t.Fatalf("setupPostgres: %v", err)
+	}
+	if err := checkDB(db).Check(context.Background()); err == nil {
+		t.Error("readiness passed with the database unreachable")
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(file, []byte("DB_MAX_OPEN_CONNS: 3\n"), 0o600)
+	t.Setenv("CONFIG_FILE", file)
+	reloadConfig()
+	if got := db.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("max open connections after reload = %d, want 3", got)
+	}
+
+	runShutdownHooks(context.Background())
+	if err := db.PingContext(context.Background()); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("ping after shutdown: %v, want the pool closed", err)
+	}
+}
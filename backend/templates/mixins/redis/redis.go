@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The redis mixin: a Redis client, rdb, for the app's own code, on
+// /readyz unless REDIS_REQUIRED is false.
+//
+//	REDIS_URL        redis:// or rediss:// URL, with the password and
+//	                 database number if any
+//	REDIS_POOL_SIZE  connections per replica (default 10)
+//	REDIS_REQUIRED   "false" leaves Redis off /readyz, for apps that treat
+//	                 it as a cache and serve on without it
+//
+// Commands take their deadline from the context passed in, so give every
+// call a bounded one.
+
+// redisConnectTimeout bounds the first ping at startup.
+const redisConnectTimeout = 5 * time.Second
+
+var redisSettings = []setting{
+	{name: "REDIS_URL", required: true, secret: true},
+	{name: "REDIS_POOL_SIZE", kind: kindInt, def: "10", check: atLeast(1)},
+	{name: "REDIS_REQUIRED", kind: kindBool, def: "true"},
+}
+
+// rdb is the Redis client, opened by setupRedis before setupApp runs.
+var rdb *redis.Client
+
+func setupRedis(*http.ServeMux) error {
+	opts, err := redis.ParseURL(conf("REDIS_URL"))
+	if err != nil {
+		return fmt.Errorf("REDIS_URL: %w", err)
+	}
+	opts.PoolSize = confInt("REDIS_POOL_SIZE")
+	opts.ContextTimeoutEnabled = true
+	redis.SetLogger(redisLogger{})
+	rdb = redis.NewClient(opts)
+
+	// An unreachable Redis is not fatal at startup: /readyz reports it
+	// until it comes up.
+	ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		slog.Warn("redis not reachable at startup", "error", err)
+	}
+
+	if confBool("REDIS_REQUIRED") {
+		readinessChecks.register("redis", checkFunc(func(ctx context.Context) error {
+			return rdb.Ping(ctx).Err()
+		}), 0)
+	}
+	return nil
+}
+
+// redisLogger sends go-redis's internal messages, such as pool dial
+// failures, to the structured log instead of the standard logger.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.WarnContext(ctx, fmt.Sprintf(format, v...), "component", "go-redis")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestSetupRedis(t *testing.T) {
+	withChecks(t)
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	saved := rdb
+	t.Cleanup(func() { rdb = saved })
+
+	if err := setupRedis(http.NewServeMux()); err != nil {
+		t.Fatalf("setupRedis: %v", err)
+	}
+	t.Cleanup(func() { rdb.Close() })
+	if err := rdb.Set(context.Background(), "k", "v", 0).Err(); err != nil || !mr.Exists("k") {
+		t.Errorf("SET through rdb = %v, want the key in Redis", err)
+	}
+	if results := readinessChecks.run(context.Background()); len(results) != 1 || results[0].Err != nil {
+		t.Errorf("readiness = %+v, want a passing redis check", results)
+	}
+
+	addr := mr.Addr()
+	mr.Close()
+	if results := readinessChecks.run(context.Background()); len(results) != 1 || results[0].Err == nil {
+		t.Errorf("readiness with Redis down = %+v, want the redis check failing", results)
+	}
+
+	t.Setenv("REDIS_URL", "http://"+addr)
+	if err := setupRedis(http.NewServeMux()); err == nil {
+		t.Error("REDIS_URL with an http scheme accepted")
+	}
+}
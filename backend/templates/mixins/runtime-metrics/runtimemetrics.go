@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"strconv"
+	"time"
+)
+
+// The runtime-metrics mixin: Go runtime and process metrics on /metrics,
+// named as the Prometheus Go client names them, so the usual Go service
+// dashboards work unchanged:
+//
+//	go_info                        gauge    version
+//	go_goroutines                  gauge
+//	go_threads                     gauge
+//	go_sched_gomaxprocs_threads    gauge
+//	go_memstats_heap_alloc_bytes   gauge    live and not yet swept heap objects
+//	go_memstats_sys_bytes          gauge    memory mapped by the runtime
+//	go_memstats_next_gc_bytes      gauge    heap size the next GC triggers at
+//	go_gc_duration_seconds         summary  stop-the-world GC pauses
+//	process_start_time_seconds     gauge
+//	process_cpu_seconds_total      counter  Linux only, as are the rest
+//	process_resident_memory_bytes  gauge
+//	process_open_fds               gauge
+//
+// The memory figures come from runtime/metrics, which unlike
+// runtime.ReadMemStats does not stop the world on every scrape.
+
+// processStart approximates the process start time: package variables are
+// initialized before main runs.
+var processStart = time.Now()
+
+// runtimeSamples are read from runtime/metrics on every scrape, in
+// go_memstats_* order.
+var runtimeSamples = []struct {
+	metric, name, help string
+}{
+	{"/memory/classes/heap/objects:bytes", "go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects."},
+	{"/memory/classes/total:bytes", "go_memstats_sys_bytes", "Bytes of memory obtained from the OS."},
+	{"/gc/heap/goal:bytes", "go_memstats_next_gc_bytes", "Heap size target of the next GC cycle."},
+}
+
+// clockTicks is USER_HZ, the unit of /proc/self/stat CPU times: 100 on
+// every Linux platform Go supports.
+const clockTicks = 100
+
+func setupRuntimeMetrics(*http.ServeMux) error {
+	registerMetrics(writeRuntimeMetrics)
+	return nil
+}
+
+func writeRuntimeMetrics(out io.Writer) {
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+	}
+
+	fmt.Fprintln(out, "# HELP go_info Information about the Go environment.")
+	fmt.Fprintln(out, "# TYPE go_info gauge")
+	fmt.Fprintf(out, "go_info{version=\"%s\"} 1\n", escapeLabel(runtime.Version()))
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	threads, _ := runtime.ThreadCreateProfile(nil)
+	gauge("go_threads", "Number of OS threads created.", float64(threads))
+
+	samples := make([]rtmetrics.Sample, len(runtimeSamples)+1)
+	for i, s := range runtimeSamples {
+		samples[i].Name = s.metric
+	}
+	samples[len(runtimeSamples)].Name = "/sched/gomaxprocs:threads"
+	rtmetrics.Read(samples)
+	gauge("go_sched_gomaxprocs_threads", "The current runtime.GOMAXPROCS setting.",
+		float64(samples[len(runtimeSamples)].Value.Uint64()))
+	for i, s := range runtimeSamples {
+		gauge(s.name, s.help, float64(samples[i].Value.Uint64()))
+	}
+
+	// Pause quantiles as the Go client reports them: min, 25%, 50%, 75%, max.
+	gc := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&gc)
+	fmt.Fprintln(out, "# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.")
+	fmt.Fprintln(out, "# TYPE go_gc_duration_seconds summary")
+	for i, q := range []string{"0", "0.25", "0.5", "0.75", "1"} {
+		fmt.Fprintf(out, "go_gc_duration_seconds{quantile=\"%s\"} %s\n", q, formatFloat(gc.PauseQuantiles[i].Seconds()))
+	}
+	fmt.Fprintf(out, "go_gc_duration_seconds_sum %s\n", formatFloat(gc.PauseTotal.Seconds()))
+	fmt.Fprintf(out, "go_gc_duration_seconds_count %d\n", gc.NumGC)
+
+	gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.",
+		float64(processStart.UnixNano())/1e9)
+	writeProcessMetrics(out, gauge)
+}
+
+// writeProcessMetrics adds the metrics read from /proc, and nothing where
+// there is no /proc.
+func writeProcessMetrics(out io.Writer, gauge func(name, help string, v float64)) {
+	stat, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return
+	}
+	// The command name, field 2, is in parentheses and may contain spaces;
+	// the fields after it start at state, field 3.
+	fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 22 {
+		return
+	}
+	utime, _ := strconv.ParseFloat(string(fields[11]), 64)
+	stime, _ := strconv.ParseFloat(string(fields[12]), 64)
+	rss, _ := strconv.ParseFloat(string(fields[21]), 64)
+
+	fmt.Fprintln(out, "# HELP process_cpu_seconds_total Total user and system CPU time spent in seconds.")
+	fmt.Fprintln(out, "# TYPE process_cpu_seconds_total counter")
+	fmt.Fprintf(out, "process_cpu_seconds_total %s\n", formatFloat((utime+stime)/clockTicks))
+	gauge("process_resident_memory_bytes", "Resident memory size in bytes.", rss*float64(os.Getpagesize()))
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		gauge("process_open_fds", "Number of open file descriptors.", float64(len(fds)))
+	}
+}
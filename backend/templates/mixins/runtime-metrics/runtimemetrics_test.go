@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeMetrics(t *testing.T) {
+	var out strings.Builder
+	writeRuntimeMetrics(&out)
+
+	values := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		v, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		values[name] = v
+	}
+
+	for _, name := range []string{
+		"go_memstats_heap_alloc_bytes",
+		"go_memstats_sys_bytes",
+		"go_memstats_next_gc_bytes",
+		"go_threads",
+		"process_start_time_seconds",
+	} {
+		if values[name] <= 0 {
+			t.Errorf("%s = %v, want a positive value", name, values[name])
+		}
+	}
+	if values["go_goroutines"] < 1 || values["go_sched_gomaxprocs_threads"] != float64(runtime.GOMAXPROCS(0)) {
+		t.Errorf("go_goroutines = %v, go_sched_gomaxprocs_threads = %v", values["go_goroutines"], values["go_sched_gomaxprocs_threads"])
+	}
+	if _, ok := values[`go_info{version="`+runtime.Version()+`"}`]; !ok {
+		t.Errorf("go_info missing:\n%s", out.String())
+	}
+	if runtime.GOOS == "linux" && values["process_resident_memory_bytes"] <= 0 {
+		t.Errorf("process_resident_memory_bytes = %v on Linux", values["process_resident_memory_bytes"])
+	}
+}
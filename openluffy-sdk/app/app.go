@@ -0,0 +1,280 @@
+// Package app runs an OpenLuffy service: it declares the platform
+// settings, sets up logging, serves the probes and the app's routes
+// through the shared middleware, and shuts down gracefully on SIGTERM.
+// A rendered app is then only its own code:
+//
+//	func main() {
+//		app.Main(app.App{
+//			Name:     "orders",
+//			Port:     8080,
+//			Settings: []config.Setting{{Name: "ORDERS_DB_URL", Required: true, Secret: true}},
+//			Setup: func(rt *app.Runtime) error {
+//				rt.Mux.HandleFunc("GET /orders", listOrders)
+//				return nil
+//			},
+//		})
+//	}
+//
+// The platform settings, besides those of the logging, health and
+// shutdown packages:
+//
+//	PORT                      port to listen on (default App.Port)
+//	BIND_ADDR                 address to listen on (default every interface)
+//	ENVIRONMENT               deployment environment, which also selects
+//	                          the observability profile (config.Profile)
+//	LIVENESS_PATH             path of the liveness probe (default
+//	                          App.LivenessPath)
+//	READINESS_PATH            path of the readiness probe (default
+//	                          App.ReadinessPath)
+//	STARTUP_PATH              path of the startup probe (default
+//	                          App.StartupPath)
+//	HTTP_READ_HEADER_TIMEOUT  (default 5s)
+//	HTTP_READ_TIMEOUT         (default 30s)
+//	HTTP_WRITE_TIMEOUT        (default 30s)
+//	HTTP_IDLE_TIMEOUT         (default 120s)
+//	ACCESS_LOG                "false" disables the per-request access log;
+//	                          the probes are never logged
+//	CONFIG_RELOAD_INTERVAL    how often reloadable settings are re-read
+//	                          (default 30s), besides on SIGHUP
+//	STRICT_CONFIG             "true" stops startup, and rejects reloads,
+//	                          on any configuration problem
+//	ENABLE_PPROF              "true" serves net/http/pprof on PPROF_ADDR
+//	                          (the default in development only)
+//	PPROF_ADDR                listen address of pprof (default
+//	                          127.0.0.1:6060, reachable only through
+//	                          kubectl port-forward)
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+	"github.com/lebrick07/openluffy/openluffy-sdk/health"
+	"github.com/lebrick07/openluffy/openluffy-sdk/logging"
+	"github.com/lebrick07/openluffy/openluffy-sdk/middleware"
+	"github.com/lebrick07/openluffy/openluffy-sdk/shutdown"
+)
+
+// Version is the SDK's version, tagged as openluffy-sdk/vVersion.
+const Version = "0.1.0"
+
+// App is what a rendered app hands to Main.
+type App struct {
+	// Name identifies the app in logs, as service.
+	Name string
+	// Port is the PORT default, 8080 if zero.
+	Port int
+	// LivenessPath, ReadinessPath and StartupPath are the defaults of
+	// LIVENESS_PATH, READINESS_PATH and STARTUP_PATH, /healthz, /readyz
+	// and /startupz if empty.
+	LivenessPath, ReadinessPath, StartupPath string
+	// Settings are the app's own settings, read from Runtime.Config like
+	// the platform's.
+	Settings []config.Setting
+	// Setup registers the app's routes, and any readiness checks,
+	// middleware and shutdown hooks it needs. It runs once before the
+	// server starts; an error stops startup.
+	Setup func(rt *Runtime) error
+}
+
+// Runtime is what Setup builds the app with.
+type Runtime struct {
+	Config   *config.Config
+	Mux      *http.ServeMux
+	Health   *health.Probes
+	Shutdown *shutdown.Hooks
+
+	middleware []middleware.Middleware
+}
+
+// Use adds mw to the chain inside the platform middleware, just outside
+// the mux, so it sees requests with their request ID and its panics are
+// recovered. Middleware added first runs first.
+func (rt *Runtime) Use(mw middleware.Middleware) {
+	rt.middleware = append(rt.middleware, mw)
+}
+
+const defaultPprofAddr = "127.0.0.1:6060"
+
+// settings are the platform settings of a.
+func (a App) settings() []config.Setting {
+	return []config.Setting{
+		{Name: "PORT", Kind: config.Int, Default: strconv.Itoa(cmp.Or(a.Port, 8080)), Check: config.InRange(1, 65535)},
+		{Name: "BIND_ADDR"},
+		{Name: "ENVIRONMENT", Default: "development"},
+		{Name: "LIVENESS_PATH", Default: cmp.Or(a.LivenessPath, "/healthz"), Check: probePath},
+		{Name: "READINESS_PATH", Default: cmp.Or(a.ReadinessPath, "/readyz"), Check: probePath},
+		{Name: "STARTUP_PATH", Default: cmp.Or(a.StartupPath, "/startupz"), Check: probePath},
+		{Name: "HTTP_READ_HEADER_TIMEOUT", Kind: config.Duration, Default: "5s"},
+		{Name: "HTTP_READ_TIMEOUT", Kind: config.Duration, Default: "30s"},
+		{Name: "HTTP_WRITE_TIMEOUT", Kind: config.Duration, Default: "30s"},
+		{Name: "HTTP_IDLE_TIMEOUT", Kind: config.Duration, Default: "120s"},
+		{Name: "ACCESS_LOG", Kind: config.Bool, Default: "true"},
+		{Name: "CONFIG_RELOAD_INTERVAL", Kind: config.Duration, Default: "30s"},
+		{Name: "STRICT_CONFIG", Kind: config.Bool, Default: "false"},
+		{Name: "ENABLE_PPROF", Kind: config.Bool, Default: "false",
+			Profiles: map[string]string{"development": "true"}},
+		{Name: "PPROF_ADDR", Default: defaultPprofAddr},
+	}
+}
+
+// probePath accepts absolute paths with no pattern syntax.
+func probePath(v string) error {
+	u, err := url.Parse(v)
+	if err != nil || u.Path != v || v[0] != '/' {
+		return errors.New("want an absolute path such as /healthz")
+	}
+	return nil
+}
+
+// Main runs a until SIGTERM or an interrupt and exits, with status 1 if
+// it fails. "app healthcheck" asks the running server's liveness probe
+// instead and exits 0 when it answers 200, for the Dockerfile's
+// HEALTHCHECK: the distroless image has no shell, curl or wget.
+func Main(a App) {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(healthcheck(a))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := Run(ctx, a); err != nil {
+		slog.Error("app failed", "error", err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+// Run starts a and serves it until ctx is done, then shuts it down
+// gracefully.
+func Run(ctx context.Context, a App) error {
+	cfg, err := config.New(a.settings(), logging.Settings, health.Settings, shutdown.Settings, a.Settings)
+	if err != nil {
+		return err
+	}
+	logging.Setup(os.Stdout, cfg, a.Name)
+	strict := cfg.Bool("STRICT_CONFIG")
+	if err := cfg.Validate(strict); err != nil {
+		return err
+	}
+	attrs := cfg.Values()
+	values := make([]any, len(attrs))
+	for i, attr := range attrs {
+		values[i] = attr
+	}
+	slog.Info("effective configuration", "file", os.Getenv("CONFIG_FILE"), slog.Group("config", values...))
+
+	// An explicit mux rather than http.DefaultServeMux: imported packages
+	// register handlers on the default mux, and those must not leak onto
+	// the public port.
+	probePaths := []string{cfg.Get("LIVENESS_PATH"), cfg.Get("READINESS_PATH"), cfg.Get("STARTUP_PATH")}
+	rt := &Runtime{Config: cfg, Mux: http.NewServeMux(), Health: health.New(cfg), Shutdown: &shutdown.Hooks{}}
+	rt.Health.Register(rt.Mux, probePaths[0], probePaths[1], probePaths[2])
+	if a.Setup != nil {
+		if err := a.Setup(rt); err != nil {
+			return fmt.Errorf("app setup: %w", err)
+		}
+	}
+
+	platform := []middleware.Middleware{middleware.RequestID}
+	if cfg.Bool("ACCESS_LOG") {
+		platform = append(platform, middleware.AccessLog(probePaths...))
+	}
+	chain := slices.Concat(platform, rt.middleware, []middleware.Middleware{middleware.Recover})
+	srv := &http.Server{
+		Handler:           middleware.Chain(middleware.RouteErrors(rt.Mux), chain...),
+		ReadHeaderTimeout: cfg.Duration("HTTP_READ_HEADER_TIMEOUT"),
+		ReadTimeout:       cfg.Duration("HTTP_READ_TIMEOUT"),
+		WriteTimeout:      cfg.Duration("HTTP_WRITE_TIMEOUT"),
+		IdleTimeout:       cfg.Duration("HTTP_IDLE_TIMEOUT"),
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(cfg.Get("BIND_ADDR"), cfg.Get("PORT")))
+	if err != nil {
+		return err
+	}
+	if cfg.Bool("ENABLE_PPROF") {
+		stopPprof := startPprof(cfg.Get("PPROF_ADDR"))
+		rt.Shutdown.Add("pprof", stopPprof)
+	}
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	go cfg.Watch(watchCtx, cfg.Duration("CONFIG_RELOAD_INTERVAL"), strict)
+
+	rt.Health.MarkStarted()
+	slog.Info("starting server", "addr", ln.Addr().String(), "sdk_version", Version)
+	err = shutdown.Serve(ctx, srv, ln, shutdown.Options{
+		Delay:   cfg.Duration("SHUTDOWN_DELAY"),
+		Timeout: cfg.Duration("SHUTDOWN_TIMEOUT"),
+		OnDrain: rt.Health.BeginDrain,
+		Hooks:   rt.Shutdown,
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("server stopped")
+	return nil
+}
+
+// startPprof serves the profiling endpoints on addr in the background,
+// logging rather than failing if it cannot listen, and returns what stops
+// it.
+func startPprof(addr string) func(context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// No WriteTimeout: CPU profiles and execution traces stream for as
+	// long as ?seconds= asks.
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		slog.Info("pprof listening", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("pprof server failed", "addr", addr, "error", err)
+		}
+	}()
+	return srv.Shutdown
+}
+
+// healthcheckTimeout bounds the health check's request, inside the
+// Dockerfile's HEALTHCHECK --timeout.
+const healthcheckTimeout = 2 * time.Second
+
+// healthcheck asks the local server's liveness probe, returning the exit
+// status.
+func healthcheck(a App) int {
+	cfg, err := config.New(a.settings(), logging.Settings, health.Settings, shutdown.Settings, a.Settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "healthcheck:", err)
+		return 1
+	}
+	client := &http.Client{Timeout: healthcheckTimeout}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", cfg.Get("PORT")), Path: cfg.Get("LIVENESS_PATH")}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "healthcheck:", err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "healthcheck:", resp.Status)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+	"github.com/lebrick07/openluffy/openluffy-sdk/middleware"
+)
+
+// freePort returns a port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestRun(t *testing.T) {
+	port := freePort(t)
+	t.Setenv("PORT", strconv.Itoa(port))
+	t.Setenv("BIND_ADDR", "127.0.0.1")
+	t.Setenv("ENVIRONMENT", "production")
+	t.Setenv("GREETING", "hi")
+
+	stopped := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, App{
+			Name:     "orders",
+			Settings: []config.Setting{{Name: "GREETING", Default: "hello"}},
+			Setup: func(rt *Runtime) error {
+				rt.Mux.HandleFunc("GET /greet", func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, rt.Config.Get("GREETING"))
+				})
+				rt.Use(func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("X-App", "orders")
+						next.ServeHTTP(w, r)
+					})
+				})
+				rt.Shutdown.Add("close", func(context.Context) error { close(stopped); return nil })
+				return nil
+			},
+		})
+	}()
+
+	base := "http://127.0.0.1:" + strconv.Itoa(port)
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = http.Get(base + "/readyz"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("readiness = %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(base + "/greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hi" || resp.Header.Get("X-App") != "orders" || resp.Header.Get(middleware.RequestIDHeader) == "" {
+		t.Errorf("/greet = %q, headers %v", body, resp.Header)
+	}
+
+	resp, err = http.Get(base + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope middleware.ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&envelope)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || envelope.Code != "not_found" {
+		t.Errorf("/missing = %d %+v", resp.StatusCode, envelope)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run = %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("shutdown hook did not run")
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "production")
+	err := Run(context.Background(), App{
+		Name:     "orders",
+		Settings: []config.Setting{{Name: "ORDERS_DB_URL", Required: true}},
+	})
+	if err == nil {
+		t.Error("Run started with a required setting unset")
+	}
+	err = Run(context.Background(), App{Name: "orders", Settings: []config.Setting{{Name: "PORT"}}})
+	if err == nil {
+		t.Error("Run accepted an app setting shadowing a platform one")
+	}
+}
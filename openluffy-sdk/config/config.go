@@ -0,0 +1,302 @@
+// Package config resolves an app's settings. Every setting the app reads
+// is declared with its type and default, and resolved from, in order of
+// precedence:
+//
+//  1. the environment
+//  2. a file named by NAME_FILE, e.g. DB_PASSWORD_FILE, holding the value
+//     (a Kubernetes secret volume key); surrounding whitespace is trimmed
+//  3. CONFIG_FILE, a JSON object or a flat YAML file of NAME: value lines
+//  4. the default of the environment's observability profile (profile.go)
+//  5. the declared default
+//
+// An invalid value is reported by Problems and replaced by the default, so
+// a typo degrades one feature rather than taking the app down; Validate
+// turns the problems into an error where they must stop startup.
+//
+// Settings marked Reloadable are re-read by Reload, which Watch calls on
+// SIGHUP and every interval. Environment variables cannot change in a
+// running process, so reloads only pick up file-based values. Everything
+// else is fixed when New reads the sources.
+//
+// Reading an undeclared name panics, which catches typos on the first run.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the type of a setting's value.
+type Kind int
+
+const (
+	String Kind = iota
+	Bool
+	Int
+	Float
+	Duration // a positive Go duration such as "30s"
+	List     // comma-separated
+)
+
+// Setting declares one setting.
+type Setting struct {
+	Name    string
+	Kind    Kind
+	Default string
+	// Profiles replaces Default in the observability profiles it names
+	// ("development", "staging" or "production"; see Profile).
+	Profiles   map[string]string
+	Required   bool               // Validate fails when it is unset
+	Secret     bool               // redacted by Redact and Values
+	Reloadable bool               // re-read by Reload
+	Check      func(string) error // validation beyond what Kind implies
+}
+
+// Config is a set of declared settings and the sources they are read from.
+type Config struct {
+	settings []*Setting
+	index    map[string]*Setting
+
+	// startup serves settings that are not reloadable; current serves
+	// the reloadable ones and is replaced by Reload.
+	startup *sources
+	current atomic.Pointer[sources]
+
+	mu    sync.Mutex
+	hooks []func()
+}
+
+// New declares the settings of each table, reads CONFIG_FILE and the
+// NAME_FILE secrets, and returns the configuration. A name declared
+// twice is an error.
+func New(tables ...[]Setting) (*Config, error) {
+	c := &Config{index: map[string]*Setting{}}
+	for _, table := range tables {
+		for i := range table {
+			s := table[i]
+			if _, ok := c.index[s.Name]; ok {
+				return nil, fmt.Errorf("setting %s declared twice", s.Name)
+			}
+			c.settings = append(c.settings, &s)
+			c.index[s.Name] = &s
+		}
+	}
+	c.startup = c.load()
+	c.current.Store(c.startup)
+	return c, nil
+}
+
+func (c *Config) setting(name string) *Setting {
+	s, ok := c.index[name]
+	if !ok {
+		panic("undeclared setting " + name)
+	}
+	return s
+}
+
+func (c *Config) sourcesFor(s *Setting) *sources {
+	if s.Reloadable {
+		return c.current.Load()
+	}
+	return c.startup
+}
+
+// Get returns the effective value of a declared setting: the configured
+// value if it is valid, otherwise the default.
+func (c *Config) Get(name string) string {
+	s := c.setting(name)
+	return c.effective(s, c.sourcesFor(s))
+}
+
+func (c *Config) effective(s *Setting, src *sources) string {
+	raw := src.raw(s.Name)
+	if raw == "" || validate(s, raw) != nil {
+		return c.fallback(s, src)
+	}
+	return raw
+}
+
+// fallback is the value of s when nothing configures it: its profile
+// default, if its Profiles sets one, otherwise Default.
+func (c *Config) fallback(s *Setting, src *sources) string {
+	if v, ok := s.Profiles[Profile(src.raw("ENVIRONMENT"))]; ok {
+		return v
+	}
+	return s.Default
+}
+
+func (c *Config) Bool(name string) bool {
+	b, _ := strconv.ParseBool(c.Get(name))
+	return b
+}
+
+func (c *Config) Int(name string) int {
+	n, _ := strconv.Atoi(c.Get(name))
+	return n
+}
+
+func (c *Config) Float(name string) float64 {
+	f, _ := strconv.ParseFloat(c.Get(name), 64)
+	return f
+}
+
+func (c *Config) Duration(name string) time.Duration {
+	d, _ := time.ParseDuration(c.Get(name))
+	return d
+}
+
+// List splits a comma-separated setting, trimming items and dropping
+// empty ones.
+func (c *Config) List(name string) []string {
+	var out []string
+	for _, item := range strings.Split(c.Get(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Environment is ENVIRONMENT lower-cased, or development when it is unset.
+func (c *Config) Environment() string {
+	if env := strings.ToLower(c.startup.raw("ENVIRONMENT")); env != "" {
+		return env
+	}
+	return "development"
+}
+
+func validate(s *Setting, raw string) error {
+	var err error
+	switch s.Kind {
+	case Bool:
+		_, err = strconv.ParseBool(raw)
+	case Int:
+		_, err = strconv.Atoi(raw)
+	case Float:
+		_, err = strconv.ParseFloat(raw, 64)
+	case Duration:
+		var d time.Duration
+		if d, err = time.ParseDuration(raw); err == nil && d <= 0 {
+			err = errors.New("must be positive")
+		}
+	}
+	if err == nil && s.Check != nil {
+		err = s.Check(raw)
+	}
+	return err
+}
+
+// OneOf accepts only the given values.
+func OneOf(values ...string) func(string) error {
+	return func(v string) error {
+		if !slices.Contains(values, v) {
+			return fmt.Errorf("want one of %s", strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
+
+// InRange accepts numbers between lo and hi inclusive.
+func InRange(lo, hi float64) func(string) error {
+	return func(v string) error {
+		if f, _ := strconv.ParseFloat(v, 64); f < lo || f > hi {
+			return fmt.Errorf("want a value between %g and %g", lo, hi)
+		}
+		return nil
+	}
+}
+
+// Problem is one issue found in the configuration sources.
+type Problem struct {
+	Msg      string
+	Args     []any
+	Required bool // a required setting is missing
+}
+
+// Problems returns every issue with the sources New read: unreadable
+// files, unknown names in CONFIG_FILE, invalid values and unset required
+// settings.
+func (c *Config) Problems() []Problem {
+	return c.problems(c.startup)
+}
+
+func (c *Config) problems(src *sources) []Problem {
+	var problems []Problem
+	add := func(msg string, args ...any) {
+		problems = append(problems, Problem{Msg: msg, Args: args})
+	}
+
+	if src.fileErr != nil {
+		add("config file ignored", "error", src.fileErr)
+	}
+	for k := range src.file {
+		if _, ok := c.index[k]; !ok {
+			add("unknown setting in config file", "setting", k)
+		}
+	}
+	for name, err := range src.secretErrs {
+		add("secret file unreadable", "setting", name, "error", err)
+	}
+	for _, s := range c.settings {
+		if os.Getenv(s.Name) != "" && os.Getenv(s.Name+"_FILE") != "" {
+			add("both set, ignoring the file", "setting", s.Name, "file_setting", s.Name+"_FILE")
+		}
+		raw := src.raw(s.Name)
+		if raw == "" {
+			if s.Required {
+				problems = append(problems, Problem{
+					Msg: "required setting is not set", Args: []any{"setting", s.Name}, Required: true,
+				})
+			}
+			continue
+		}
+		if err := validate(s, raw); err != nil {
+			add("invalid setting", "setting", s.Name, "value", Redact(s, raw), "default", c.fallback(s, src), "error", err)
+		}
+	}
+	return problems
+}
+
+// Validate logs every problem and returns an error when a required
+// setting is missing, or, with strict, when there is any problem at all.
+func (c *Config) Validate(strict bool) error {
+	fatal := 0
+	for _, p := range c.Problems() {
+		if strict || p.Required {
+			fatal++
+			slog.Error(p.Msg, p.Args...)
+		} else {
+			slog.Warn(p.Msg, p.Args...)
+		}
+	}
+	if fatal > 0 {
+		return fmt.Errorf("invalid configuration: %d problem(s)", fatal)
+	}
+	return nil
+}
+
+// Values returns every setting's effective value, secrets redacted, in
+// declaration order, for the startup log.
+func (c *Config) Values() []slog.Attr {
+	attrs := make([]slog.Attr, len(c.settings))
+	for i, s := range c.settings {
+		attrs[i] = slog.String(s.Name, Redact(s, c.Get(s.Name)))
+	}
+	return attrs
+}
+
+// Redact hides the value of a secret setting.
+func Redact(s *Setting, v string) string {
+	if s.Secret && v != "" {
+		return "[redacted]"
+	}
+	return v
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var testSettings = []Setting{
+	{Name: "ENVIRONMENT", Default: "development"},
+	{Name: "GREETING", Default: "hello", Reloadable: true},
+	{Name: "WORKERS", Kind: Int, Default: "4", Check: InRange(1, 64)},
+	{Name: "DB_PASSWORD", Secret: true},
+	{Name: "API_URL", Required: true},
+	{Name: "TRACE", Kind: Bool, Default: "false", Profiles: map[string]string{"development": "true"}},
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.yaml", "GREETING: from file\nWORKERS: 8\nDB_PASSWORD: file\n"))
+	t.Setenv("DB_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+	t.Setenv("WORKERS", "16")
+
+	c, err := New(testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"GREETING":    "from file", // CONFIG_FILE over the default
+		"WORKERS":     "16",        // the environment over CONFIG_FILE
+		"DB_PASSWORD": "s3cret",    // NAME_FILE over CONFIG_FILE
+		"TRACE":       "true",      // the development profile over the default
+	} {
+		if got := c.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if c.Int("WORKERS") != 16 || !c.Bool("TRACE") {
+		t.Errorf("typed readers: WORKERS %d, TRACE %t", c.Int("WORKERS"), c.Bool("TRACE"))
+	}
+}
+
+func TestInvalidAndRequired(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "production")
+	t.Setenv("WORKERS", "500")
+	c, err := New(testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Get("WORKERS"); got != "4" {
+		t.Errorf("WORKERS = %q, want the default for an invalid value", got)
+	}
+	if c.Bool("TRACE") {
+		t.Error("TRACE is on outside the development profile")
+	}
+	var msgs []string
+	for _, p := range c.Problems() {
+		msgs = append(msgs, p.Msg)
+	}
+	if !slices.Contains(msgs, "invalid setting") || !slices.Contains(msgs, "required setting is not set") {
+		t.Errorf("problems = %q", msgs)
+	}
+	if err := c.Validate(false); err == nil {
+		t.Error("Validate passed with API_URL unset")
+	}
+	t.Setenv("API_URL", "http://api")
+	c, _ = New(testSettings)
+	if err := c.Validate(false); err != nil {
+		t.Errorf("Validate = %v with only an invalid value", err)
+	}
+	if err := c.Validate(true); err == nil {
+		t.Error("strict Validate passed with an invalid value")
+	}
+}
+
+func TestBadFile(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.yaml", "GREETING: hi\n  nested: value\n"))
+	c, _ := New(testSettings)
+	if got := c.Get("GREETING"); got != "hello" {
+		t.Errorf("GREETING = %q from a broken file", got)
+	}
+	if p := c.Problems(); len(p) == 0 || p[0].Msg != "config file ignored" {
+		t.Errorf("problems = %v", p)
+	}
+
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.json", `{"GREETING": "hi", "NOPE": [1, 2]}`))
+	c, _ = New(testSettings)
+	if got := c.Get("GREETING"); got != "hi" {
+		t.Errorf("GREETING = %q from JSON", got)
+	}
+	if p := c.Problems(); len(p) == 0 || p[0].Msg != "unknown setting in config file" {
+		t.Errorf("problems = %v", p)
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Setenv("API_URL", "http://api")
+	file := writeFile(t, "config.yaml", "GREETING: one\nWORKERS: 2\n")
+	t.Setenv("CONFIG_FILE", file)
+	c, _ := New(testSettings)
+	hooks := 0
+	c.OnReload(func() { hooks++ })
+
+	os.WriteFile(file, []byte("GREETING: two\nWORKERS: 3\n"), 0o600)
+	if changed := c.Reload(false); !slices.Equal(changed, []string{"GREETING"}) {
+		t.Errorf("changed = %q", changed)
+	}
+	if c.Get("GREETING") != "two" || c.Get("WORKERS") != "2" || hooks != 1 {
+		t.Errorf("after reload GREETING %q, WORKERS %q (not reloadable), %d hook calls", c.Get("GREETING"), c.Get("WORKERS"), hooks)
+	}
+	if changed := c.Reload(false); changed != nil || hooks != 1 {
+		t.Errorf("an unchanged reload reported %q and ran the hooks", changed)
+	}
+
+	os.WriteFile(file, []byte("GREETING: three\nWORKERS: zero\n"), 0o600)
+	if changed := c.Reload(true); changed != nil || c.Get("GREETING") != "two" {
+		t.Errorf("strict reload of a bad file applied %q", changed)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	if _, err := New(testSettings, []Setting{{Name: "GREETING"}}); err == nil {
+		t.Error("a setting declared twice was accepted")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	for env, want := range map[string]string{
+		"": "development", "Dev": "development", "local": "development",
+		"staging": "staging", "qa": "staging", "preprod": "staging",
+		"prod": "production", "eu-west": "production",
+	} {
+		if got := Profile(env); got != want {
+			t.Errorf("Profile(%q) = %q, want %q", env, got, want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package config
+
+import "strings"
+
+// Observability profiles. ENVIRONMENT selects one, and a setting's
+// Profiles entry for it stands in for the setting's Default, so an app
+// that configures nothing gets readable logs and pprof on a laptop and
+// JSON logs without pprof in production. The SDK's own settings use them
+// as follows (logging and app packages):
+//
+//	               development  staging  production
+//	LOG_FORMAT     text         json     json
+//	LOG_SOURCE     true         false    false
+//	ENABLE_PPROF   true         false    false
+//
+// A configured value always wins over the profile's. dev and local are
+// development; stage, test, qa, uat and preprod are staging; prod,
+// production and any environment not named here are production, so an
+// unfamiliar name gets the cautious defaults.
+
+// Profile names the observability profile of the environment env.
+func Profile(env string) string {
+	switch strings.ToLower(strings.TrimSpace(env)) {
+	case "", "dev", "development", "local":
+		return "development"
+	case "stage", "staging", "test", "qa", "uat", "preprod":
+		return "staging"
+	default:
+		return "production"
+	}
+}
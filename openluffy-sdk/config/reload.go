@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// OnReload registers f to re-read its settings after a reload that
+// changed at least one reloadable setting.
+func (c *Config) OnReload(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, f)
+}
+
+// Reload re-reads CONFIG_FILE and the NAME_FILE secrets. Only reloadable
+// settings take effect; changes to the others are logged as needing a
+// restart. With strict, a reload with any problem is rejected as a whole.
+// It returns the names of the settings that changed.
+func (c *Config) Reload(strict bool) []string {
+	prev := c.current.Load()
+	next := c.load()
+	if next.equal(prev) {
+		return nil
+	}
+
+	problems := c.problems(next)
+	for _, p := range problems {
+		slog.Warn(p.Msg, p.Args...)
+	}
+	if strict && len(problems) > 0 {
+		slog.Error("config reload rejected, keeping current configuration", "problems", len(problems))
+		return nil
+	}
+
+	var changed []string
+	var attrs []any
+	for _, s := range c.settings {
+		before, after := c.effective(s, prev), c.effective(s, next)
+		switch {
+		case before == after:
+		case s.Reloadable:
+			changed = append(changed, s.Name)
+			attrs = append(attrs, slog.String(s.Name, Redact(s, after)))
+		default:
+			slog.Warn("setting changed but only takes effect after a restart", "setting", s.Name)
+		}
+	}
+	c.current.Store(next)
+	if len(changed) == 0 {
+		return nil
+	}
+	slog.Info("configuration reloaded", slog.Group("changed", attrs...))
+	c.mu.Lock()
+	hooks := c.hooks
+	c.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	return changed
+}
+
+// Watch reloads the configuration on SIGHUP and every interval until ctx
+// is done.
+func (c *Config) Watch(ctx context.Context, interval time.Duration, strict bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+		}
+		c.Reload(strict)
+	}
+}
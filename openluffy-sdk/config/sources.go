@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+)
+
+// sources is a snapshot of the configuration sources besides the
+// environment.
+type sources struct {
+	file       map[string]string
+	fileErr    error
+	secrets    map[string]string
+	secretErrs map[string]error
+}
+
+// load reads CONFIG_FILE and the NAME_FILE secret of every declared
+// setting.
+func (c *Config) load() *sources {
+	src := &sources{secrets: map[string]string{}, secretErrs: map[string]error{}}
+	src.file, src.fileErr = loadConfigFile(os.Getenv("CONFIG_FILE"))
+	for _, s := range c.settings {
+		path := os.Getenv(s.Name + "_FILE")
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			src.secretErrs[s.Name] = err
+			continue
+		}
+		src.secrets[s.Name] = strings.TrimSpace(string(data))
+	}
+	return src
+}
+
+// raw returns the configured value of name, environment first, or "" when
+// nothing sets it.
+func (src *sources) raw(name string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	if v, ok := src.secrets[name]; ok {
+		return v
+	}
+	return src.file[name]
+}
+
+func (src *sources) equal(other *sources) bool {
+	return maps.Equal(src.file, other.file) &&
+		fmt.Sprint(src.fileErr) == fmt.Sprint(other.fileErr) &&
+		maps.Equal(src.secrets, other.secrets) &&
+		len(src.secretErrs) == len(other.secretErrs)
+}
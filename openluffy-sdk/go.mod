@@ -0,0 +1,3 @@
+module github.com/lebrick07/openluffy/openluffy-sdk
+
+go 1.24.0
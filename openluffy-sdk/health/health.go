@@ -0,0 +1,337 @@
+// Package health is the probe framework:
+//
+//	liveness   the process is up and serving. Runs only the liveness
+//	           checks (none by default), never the dependencies, so a
+//	           slow database cannot get the pod killed.
+//	readiness  startup has completed and every readiness check passes.
+//	           Kubernetes stops routing traffic while it returns 503, as
+//	           it does from the moment a drain begins.
+//	startup    503 until the app calls MarkStarted, then 200.
+//
+// Each answers JSON, or one word of plain text to a client that asks for
+// text/plain and not JSON.
+//
+//	HEALTH_CHECK_TIMEOUT      per-check timeout (default 2s), kept below
+//	                          the kubelet's probe timeout
+//	HEALTH_CHECK_CONCURRENCY  checks run at once per probe (default 4)
+//	HEALTH_DETAIL             "true" adds every check's status, latency and
+//	                          most recent error to the JSON responses. Error
+//	                          text can name internal hosts, so leave it off
+//	                          where the probes are publicly reachable.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+)
+
+// Settings are the settings New reads.
+var Settings = []config.Setting{
+	{Name: "HEALTH_CHECK_TIMEOUT", Kind: config.Duration, Default: "2s"},
+	{Name: "HEALTH_CHECK_CONCURRENCY", Kind: config.Int, Default: "4", Check: config.InRange(1, 64)},
+	{Name: "HEALTH_DETAIL", Kind: config.Bool, Default: "false"},
+}
+
+// Checker is a health check.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckFunc adapts a function to Checker.
+type CheckFunc func(ctx context.Context) error
+
+func (f CheckFunc) Check(ctx context.Context) error { return f(ctx) }
+
+type HealthResponse struct {
+	Status      string            `json:"status"`
+	Environment string            `json:"environment"`
+	Failing     map[string]string `json:"failing,omitempty"`
+	Checks      []CheckDetail     `json:"checks,omitempty"`
+	Timestamp   string            `json:"timestamp"`
+}
+
+type ReadinessResponse struct {
+	Status         string            `json:"status"`
+	Reason         string            `json:"reason,omitempty"`
+	DrainRemaining string            `json:"drain_remaining,omitempty"`
+	Failing        map[string]string `json:"failing,omitempty"`
+	Checks         []CheckDetail     `json:"checks,omitempty"`
+	Timestamp      string            `json:"timestamp"`
+}
+
+type StartupResponse struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// CheckDetail is one check's entry in a HEALTH_DETAIL response. LastError
+// survives recovery, so a flapping dependency is visible even while it
+// happens to be passing.
+type CheckDetail struct {
+	Name        string  `json:"name"`
+	Status      string  `json:"status"`
+	LatencyMS   float64 `json:"latency_ms"`
+	Error       string  `json:"error,omitempty"`
+	LastError   string  `json:"last_error,omitempty"`
+	LastErrorAt string  `json:"last_error_at,omitempty"`
+}
+
+// check is a registered, named checker and its most recent failure.
+type check struct {
+	name    string
+	checker Checker
+	timeout time.Duration
+
+	mu          sync.Mutex
+	lastErr     string
+	lastErrTime time.Time
+}
+
+// result is the outcome of one check.
+type result struct {
+	name     string
+	err      error
+	duration time.Duration
+}
+
+// Probes holds the checks and the startup and drain state the probe
+// handlers report.
+type Probes struct {
+	environment string
+	timeout     time.Duration
+	concurrency int
+	detail      bool
+
+	mu                  sync.Mutex
+	liveness, readiness []*check
+
+	started atomic.Bool
+
+	drainMu    sync.Mutex
+	draining   bool
+	drainUntil time.Time
+}
+
+// New returns probes with no checks, reading Settings from cfg.
+func New(cfg *config.Config) *Probes {
+	return &Probes{
+		environment: cfg.Environment(),
+		timeout:     cfg.Duration("HEALTH_CHECK_TIMEOUT"),
+		concurrency: cfg.Int("HEALTH_CHECK_CONCURRENCY"),
+		detail:      cfg.Bool("HEALTH_DETAIL"),
+	}
+}
+
+// AddLiveness adds a liveness check. A zero timeout uses
+// HEALTH_CHECK_TIMEOUT. Liveness failures restart the pod, so only check
+// what a restart would fix.
+func (p *Probes) AddLiveness(name string, c Checker, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.liveness = append(p.liveness, p.newCheck(name, c, timeout))
+}
+
+// AddReadiness adds a readiness check, such as a database ping. A zero
+// timeout uses HEALTH_CHECK_TIMEOUT.
+func (p *Probes) AddReadiness(name string, c Checker, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readiness = append(p.readiness, p.newCheck(name, c, timeout))
+}
+
+func (p *Probes) newCheck(name string, c Checker, timeout time.Duration) *check {
+	if timeout <= 0 {
+		timeout = p.timeout
+	}
+	return &check{name: name, checker: c, timeout: timeout}
+}
+
+// MarkStarted ends startup: the startup probe passes from now on, and the
+// readiness probe runs its checks.
+func (p *Probes) MarkStarted() { p.started.Store(true) }
+
+// BeginDrain marks the app as leaving: readiness fails from now on, with
+// the time left of delay reported as drain_remaining.
+func (p *Probes) BeginDrain(delay time.Duration) {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	p.draining = true
+	p.drainUntil = time.Now().Add(delay)
+}
+
+// shuttingDown returns why readiness must fail because of a drain, and
+// how much of its delay is left, or "" while the app serves normally.
+func (p *Probes) shuttingDown() (reason string, remaining time.Duration) {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	if !p.draining {
+		return "", 0
+	}
+	if remaining = time.Until(p.drainUntil); remaining > 0 {
+		return "pre-shutdown drain", remaining
+	}
+	return "shutting down", 0
+}
+
+// Register serves the probes on mux at the given paths.
+func (p *Probes) Register(mux *http.ServeMux, liveness, readiness, startup string) {
+	mux.HandleFunc("GET "+liveness, p.LivenessHandler)
+	mux.HandleFunc("GET "+readiness, p.ReadinessHandler)
+	mux.HandleFunc("GET "+startup, p.StartupHandler)
+}
+
+// run executes checks on a pool of HEALTH_CHECK_CONCURRENCY workers, so a
+// long dependency list cannot open a burst of connections, or start a
+// goroutine per check, on every probe. Results are in registration order.
+func (p *Probes) run(ctx context.Context, checks []*check) []result {
+	results := make([]result, len(checks))
+	forEachPooled(len(checks), p.concurrency, func(i int) {
+		results[i] = checks[i].run(ctx)
+	})
+	return results
+}
+
+// run runs the checker within the check's timeout.
+func (c *check) run(ctx context.Context) result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	err := c.checker.Check(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.lastErr, c.lastErrTime = err.Error(), start
+		c.mu.Unlock()
+	}
+	return result{name: c.name, err: err, duration: time.Since(start)}
+}
+
+// failing returns the error of each failed check, keyed by name.
+func failing(results []result) map[string]string {
+	out := map[string]string{}
+	for _, r := range results {
+		if r.err != nil {
+			out[r.name] = r.err.Error()
+		}
+	}
+	return out
+}
+
+// details describes each check for a HEALTH_DETAIL response, or returns
+// nil when detail is off.
+func (p *Probes) details(checks []*check, results []result) []CheckDetail {
+	if !p.detail {
+		return nil
+	}
+	out := make([]CheckDetail, len(results))
+	for i, r := range results {
+		d := CheckDetail{
+			Name:      r.name,
+			Status:    "ok",
+			LatencyMS: float64(r.duration.Microseconds()) / 1000,
+		}
+		if r.err != nil {
+			d.Status, d.Error = "failing", r.err.Error()
+		}
+		c := checks[i]
+		c.mu.Lock()
+		if c.lastErr != "" {
+			d.LastError, d.LastErrorAt = c.lastErr, c.lastErrTime.Format(time.RFC3339)
+		}
+		c.mu.Unlock()
+		out[i] = d
+	}
+	return out
+}
+
+func (p *Probes) checks() (liveness, readiness []*check) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.liveness, p.readiness
+}
+
+// LivenessHandler answers 200 while every liveness check passes.
+func (p *Probes) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	checks, _ := p.checks()
+	results := p.run(r.Context(), checks)
+	failed := failing(results)
+
+	status, code := "healthy", http.StatusOK
+	if len(failed) > 0 {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+		slog.Error("liveness check failed", "failing", failed)
+	}
+	write(w, r, code, status, HealthResponse{
+		Status:      status,
+		Environment: p.environment,
+		Failing:     failed,
+		Checks:      p.details(checks, results),
+		Timestamp:   time.Now().Format(time.RFC3339),
+	})
+}
+
+// ReadinessHandler answers 200 while every readiness check passes and 503
+// listing the failing ones otherwise. Before MarkStarted and once a drain
+// begins it fails, the latter without running the checks.
+func (p *Probes) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{Status: "ready", Timestamp: time.Now().Format(time.RFC3339)}
+	code := http.StatusOK
+
+	if reason, remaining := p.shuttingDown(); reason != "" {
+		resp.Status, resp.Reason, code = "not ready", reason, http.StatusServiceUnavailable
+		if remaining > 0 {
+			resp.DrainRemaining = remaining.Round(time.Millisecond).String()
+		}
+	} else {
+		_, checks := p.checks()
+		results := p.run(r.Context(), checks)
+		resp.Failing = failing(results)
+		resp.Checks = p.details(checks, results)
+		if !p.started.Load() {
+			resp.Status, code = "starting", http.StatusServiceUnavailable
+		} else if len(resp.Failing) > 0 {
+			resp.Status, code = "not ready", http.StatusServiceUnavailable
+			slog.Warn("readiness check failed", "failing", resp.Failing)
+		}
+	}
+	write(w, r, code, resp.Status, resp)
+}
+
+// StartupHandler answers 503 until MarkStarted, then 200.
+func (p *Probes) StartupHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := "started", http.StatusOK
+	if !p.started.Load() {
+		status, code = "starting", http.StatusServiceUnavailable
+	}
+	write(w, r, code, status, StartupResponse{Status: status, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// write answers with resp, or status alone to a client preferring text.
+func write(w http.ResponseWriter, r *http.Request, code int, status string, resp any) {
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// prefersPlainText reports whether the client asked for text/plain without
+// also accepting JSON. Simple uptime checkers send "Accept: text/plain" and
+// only look for a 200 with a short body; everyone else gets JSON.
+func prefersPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") &&
+		!strings.Contains(accept, "application/json")
+}
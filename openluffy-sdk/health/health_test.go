@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+)
+
+func newProbes(t *testing.T) (*Probes, *http.ServeMux) {
+	t.Helper()
+	t.Setenv("HEALTH_DETAIL", "true")
+	c, err := config.New([]config.Setting{{Name: "ENVIRONMENT"}}, Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, mux := New(c), http.NewServeMux()
+	p.Register(mux, "/healthz", "/readyz", "/startupz")
+	return p, mux
+}
+
+func get(mux *http.ServeMux, path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestProbes(t *testing.T) {
+	p, mux := newProbes(t)
+	var dbErr error
+	p.AddReadiness("db", CheckFunc(func(context.Context) error { return dbErr }), 0)
+
+	if w := get(mux, "/startupz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("startup before MarkStarted = %d", w.Code)
+	}
+	if w := get(mux, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness before MarkStarted = %d", w.Code)
+	}
+	p.MarkStarted()
+	if w := get(mux, "/readyz", "Accept", "text/plain"); w.Code != http.StatusOK || w.Body.String() != "ready\n" {
+		t.Errorf("readiness = %d %q", w.Code, w.Body.String())
+	}
+
+	dbErr = errors.New("connection refused")
+	w := get(mux, "/readyz")
+	var resp ReadinessResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Failing["db"] != "connection refused" || len(resp.Checks) != 1 {
+		t.Errorf("failing readiness = %d %s", w.Code, w.Body.String())
+	}
+	// A readiness failure never fails liveness.
+	if w := get(mux, "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("liveness = %d with a failing dependency", w.Code)
+	}
+
+	dbErr = nil
+	p.BeginDrain(time.Minute)
+	w = get(mux, "/readyz")
+	resp = ReadinessResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Reason != "pre-shutdown drain" || resp.DrainRemaining == "" {
+		t.Errorf("draining readiness = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	p, mux := newProbes(t)
+	p.AddLiveness("stuck", CheckFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}), 10*time.Millisecond)
+
+	start := time.Now()
+	w := get(mux, "/healthz")
+	var resp HealthResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Failing["stuck"] == "" || time.Since(start) > time.Second {
+		t.Errorf("liveness = %d %s after %s", w.Code, w.Body.String(), time.Since(start))
+	}
+	if resp.Checks[0].LastError == "" {
+		t.Error("last_error not reported")
+	}
+}
@@ -0,0 +1,74 @@
+// Package logging sets up structured logging on log/slog. Every line
+// carries service and env.
+//
+//	LOG_LEVEL   debug, info (default), warn or error; reloadable
+//	LOG_FORMAT  json, or text for key=value lines that read better in a
+//	            terminal (the default in development)
+//	LOG_SOURCE  "true" adds the source file and line to every record
+//	            (the default in development)
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+)
+
+// Settings are the settings Setup reads.
+var Settings = []config.Setting{
+	{Name: "LOG_LEVEL", Default: "info", Reloadable: true, Check: func(v string) error {
+		if _, ok := ParseLevel(v); !ok {
+			return errors.New("want debug, info, warn or error")
+		}
+		return nil
+	}},
+	{Name: "LOG_FORMAT", Default: "json", Check: config.OneOf("json", "text"),
+		Profiles: map[string]string{"development": "text"}},
+	{Name: "LOG_SOURCE", Kind: config.Bool, Default: "false",
+		Profiles: map[string]string{"development": "true"}},
+}
+
+// ParseLevel maps LOG_LEVEL to a slog level, reporting whether raw was
+// recognised.
+func ParseLevel(raw string) (slog.Level, bool) {
+	var level slog.Level
+	if raw == "" {
+		return slog.LevelInfo, true
+	}
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(raw))); err != nil {
+		return slog.LevelInfo, false
+	}
+	return level, true
+}
+
+// New returns a logger writing to w as cfg's Settings ask, annotated with
+// service and the environment. Its level follows LOG_LEVEL across
+// reloads.
+func New(w io.Writer, cfg *config.Config, service string) *slog.Logger {
+	level := new(slog.LevelVar)
+	apply := func() {
+		l, _ := ParseLevel(cfg.Get("LOG_LEVEL"))
+		level.Set(l)
+	}
+	apply()
+	cfg.OnReload(apply)
+
+	opts := &slog.HandlerOptions{Level: level, AddSource: cfg.Bool("LOG_SOURCE")}
+	var handler slog.Handler = slog.NewJSONHandler(w, opts)
+	if cfg.Get("LOG_FORMAT") == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(handler).With("service", service, "env", cfg.Environment())
+}
+
+// Setup makes New's logger the slog default. slog.SetDefault also routes
+// the standard log package through it, so stray log.Printf calls still
+// come out structured.
+func Setup(w io.Writer, cfg *config.Config, service string) *slog.Logger {
+	logger := New(w, cfg, service)
+	slog.SetDefault(logger)
+	return logger
+}
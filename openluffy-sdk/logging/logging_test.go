@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+)
+
+func newConfig(t *testing.T) *config.Config {
+	t.Helper()
+	c, err := config.New([]config.Setting{{Name: "ENVIRONMENT"}}, Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFormatByProfile(t *testing.T) {
+	var buf bytes.Buffer
+	t.Setenv("ENVIRONMENT", "production")
+	New(&buf, newConfig(t), "orders").Info("hello", "n", 1)
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("production line is not JSON: %q", buf.String())
+	}
+	if line["service"] != "orders" || line["env"] != "production" || line["source"] != nil {
+		t.Errorf("line = %v", line)
+	}
+
+	buf.Reset()
+	t.Setenv("ENVIRONMENT", "dev")
+	New(&buf, newConfig(t), "orders").Info("hello")
+	if out := buf.String(); !strings.Contains(out, "msg=hello") || !strings.Contains(out, "source=") {
+		t.Errorf("development line = %q, want text with the source", out)
+	}
+
+	buf.Reset()
+	t.Setenv("LOG_FORMAT", "json")
+	New(&buf, newConfig(t), "orders").Info("hello")
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("LOG_FORMAT=json in development wrote %q", buf.String())
+	}
+}
+
+func TestLevelReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(file, []byte("LOG_LEVEL: warn\n"), 0o600)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("ENVIRONMENT", "production")
+	c := newConfig(t)
+
+	var buf bytes.Buffer
+	logger := New(&buf, c, "orders")
+	logger.Info("dropped")
+	os.WriteFile(file, []byte("LOG_LEVEL: debug\n"), 0o600)
+	c.Reload(false)
+	logger.Debug("kept")
+	if out := buf.String(); strings.Contains(out, "dropped") || !strings.Contains(out, "kept") {
+		t.Errorf("output = %q", out)
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The error envelope. Every error an app answers with has one JSON shape,
+// whatever produced it: a handler, the middleware or the mux finding no
+// route.
+//
+//	{"code": "not_found", "message": "item not found", "error": "item not found", "request_id": "..."}
+//
+// code is the status's reason phrase in snake_case, for clients to branch
+// on; message says what went wrong and is safe to show; error repeats it
+// for older clients; request_id is the X-Request-ID of the response.
+
+// ErrorResponse is the error envelope. Embed it to add fields.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// NewErrorResponse returns the envelope for an error answered with status.
+func NewErrorResponse(r *http.Request, status int, message string) ErrorResponse {
+	return ErrorResponse{
+		Code:      errorCode(status),
+		Message:   message,
+		Error:     message,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+}
+
+// WriteError answers the request with status and the error envelope. Set
+// any other headers, such as Retry-After, first.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(NewErrorResponse(r, status, message))
+}
+
+// RouteErrors serves mux, answering the requests it has no route for in
+// the error envelope. ServeMux answers them itself, in plain text: 404
+// when no pattern matches the path, and 405, with Allow, when patterns
+// match it for other methods only.
+func RouteErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, pattern := mux.Handler(r); pattern == "" {
+			h.ServeHTTP(&routeErrorWriter{ResponseWriter: w, r: r}, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// routeErrorWriter replaces ServeMux's plain-text error with the envelope,
+// keeping its status and headers.
+type routeErrorWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	wrote bool
+}
+
+func (w *routeErrorWriter) WriteHeader(status int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	WriteError(w.ResponseWriter, w.r, status, strings.ToLower(http.StatusText(status)))
+}
+
+func (w *routeErrorWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusNotFound)
+	return len(b), nil
+}
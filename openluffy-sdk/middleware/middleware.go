@@ -0,0 +1,157 @@
+// Package middleware is the request handling every OpenLuffy app shares:
+// correlation IDs, the access log, panic recovery and the JSON error
+// envelope. Chain puts them in the order the Go templates serve them in.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// Middleware wraps a handler.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in mws, the first outermost.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for _, mw := range slices.Backward(mws) {
+		h = mw(h)
+	}
+	return h
+}
+
+// RequestIDHeader carries the correlation ID between services.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID reuses the caller's X-Request-ID when it is well formed and
+// generates one otherwise. The ID is stored in the request context,
+// echoed in the response header and included by Logger.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDValue.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the ID assigned by RequestID.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Logger returns the default logger annotated with the request's ID.
+func Logger(r *http.Request) *slog.Logger {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// AccessLog writes one log line per request, except for the paths in
+// exclude, such as the probes, so kubelet traffic does not drown out real
+// requests.
+func AccessLog(exclude ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exclude, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(rec, r)
+
+			Logger(r).Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.statusCode(),
+				"duration_ms", float64(time.Since(start).Microseconds())/1000,
+				"bytes", rec.bytes,
+				"remote_addr", r.RemoteAddr,
+				"user_agent", r.UserAgent())
+		})
+	}
+}
+
+// Recover turns a handler panic into a logged stack trace and a JSON 500,
+// instead of a dropped connection with nothing in the logs. If the
+// handler had already started the response, only the log line is
+// written. http.ErrAbortHandler is re-panicked: it is net/http's
+// deliberate way of aborting a response.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			Logger(r).Error("panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(err),
+				"stack", string(debug.Stack()))
+
+			if rec.status != 0 {
+				return
+			}
+			w.Header().Set("Connection", "close")
+			WriteError(w, r, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// statusCode returns the status written, defaulting to 200 for handlers
+// that returned without writing anything.
+func (rec *statusRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger's output to a buffer for the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	for header, reused := range map[string]bool{"abc-123": true, "": false, "bad id\n": false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			req.Header.Set(RequestIDHeader, header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get(RequestIDHeader); got != seen || got == "" {
+			t.Errorf("%q: response ID %q, context ID %q", header, got, seen)
+		}
+		if (seen == header) != reused {
+			t.Errorf("%q: reused = %t, want %t", header, seen == header, reused)
+		}
+	}
+}
+
+func TestRecoverAndAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /boom", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	mux.HandleFunc("GET /healthz", func(http.ResponseWriter, *http.Request) {})
+	h := Chain(RouteErrors(mux), RequestID, AccessLog("/healthz"), Recover)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/boom", nil))
+	var body ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusInternalServerError || body.Code != "internal_server_error" || body.RequestID != w.Header().Get(RequestIDHeader) {
+		t.Errorf("panic answered %d %+v", w.Code, body)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	out := logs.String()
+	if !strings.Contains(out, `"msg":"panic serving request"`) || !strings.Contains(out, `"status":500`) {
+		t.Errorf("logs = %s", out)
+	}
+	if strings.Contains(out, `"path":"/healthz"`) {
+		t.Errorf("excluded path was logged: %s", out)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items", func(http.ResponseWriter, *http.Request) {})
+	h := RequestID(RouteErrors(mux))
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{"GET", "/missing", http.StatusNotFound, "not_found"},
+		{"POST", "/items", http.StatusMethodNotAllowed, "method_not_allowed"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		var body ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != tc.status || body.Code != tc.code {
+			t.Errorf("%s %s: %d %q", tc.method, tc.path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Package shutdown serves an HTTP server until its context ends, then
+// takes it down the way Kubernetes rollouts need:
+//
+//  1. OnDrain runs, so readiness starts failing (health.Probes.BeginDrain).
+//  2. For SHUTDOWN_DELAY (default none; the Helm chart sets it) the
+//     server keeps serving, with keep-alives off, while endpoints
+//     controllers, kube-proxy and ingresses stop routing here; without
+//     the delay requests still in flight to the pod get 502s during
+//     rollouts.
+//  3. The listener closes and the requests in flight get SHUTDOWN_TIMEOUT
+//     to finish before their connections are closed.
+//  4. The Hooks run, latest registered first, within what is left of
+//     SHUTDOWN_TIMEOUT.
+//
+// Keep SHUTDOWN_DELAY plus SHUTDOWN_TIMEOUT inside the pod's
+// terminationGracePeriodSeconds (30s by default).
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lebrick07/openluffy/openluffy-sdk/config"
+)
+
+// Settings are the settings an app passes to Serve as Options.
+var Settings = []config.Setting{
+	{Name: "SHUTDOWN_DELAY", Kind: config.Duration},
+	{Name: "SHUTDOWN_TIMEOUT", Kind: config.Duration, Default: "25s"},
+}
+
+// Options says how Serve shuts the server down.
+type Options struct {
+	Delay   time.Duration       // SHUTDOWN_DELAY
+	Timeout time.Duration       // SHUTDOWN_TIMEOUT
+	OnDrain func(time.Duration) // called with Delay when the drain begins
+	Hooks   *Hooks              // run after the server has stopped
+}
+
+// Serve serves srv on ln until ctx is done, then shuts it down as the
+// package documents. It returns the server's error if it fails before
+// then, and nil after a shutdown, forced or not.
+func Serve(ctx context.Context, srv *http.Server, ln net.Listener, opts Options) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	if opts.OnDrain != nil {
+		opts.OnDrain(opts.Delay)
+	}
+	if opts.Delay > 0 {
+		slog.Info("shutdown signal received, waiting before closing the listener", "delay", opts.Delay.String())
+		srv.SetKeepAlivesEnabled(false)
+		time.Sleep(opts.Delay)
+	}
+
+	slog.Info("shutting down, draining connections", "timeout", opts.Timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("graceful shutdown incomplete, closing remaining connections", "error", err)
+		srv.Close()
+	}
+	opts.Hooks.Run(shutdownCtx)
+	return nil
+}
+
+// Hooks are functions that release what an app holds, such as database
+// pools and producers, once it has stopped serving.
+type Hooks struct {
+	mu    sync.Mutex
+	hooks []hook
+}
+
+type hook struct {
+	name string
+	f    func(context.Context) error
+}
+
+// Add registers f, named for the log when it fails.
+func (h *Hooks) Add(name string, f func(context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hook{name: name, f: f})
+}
+
+// Run calls the hooks, latest registered first, so what was set up last
+// is released first. ctx bounds them all; a failing or late hook is
+// logged and the rest still run. Run on a nil *Hooks does nothing.
+func (h *Hooks) Run(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	hooks := slices.Clone(h.hooks)
+	h.mu.Unlock()
+	for _, hk := range slices.Backward(hooks) {
+		if err := hk.f(ctx); err != nil {
+			slog.Warn("shutdown hook failed", "hook", hk.name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})}
+
+	var order []string
+	hooks := &Hooks{}
+	hooks.Add("first", func(context.Context) error { order = append(order, "first"); return nil })
+	hooks.Add("second", func(context.Context) error { order = append(order, "second"); return errors.New("logged") })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := make(chan time.Duration, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, srv, ln, Options{
+			Delay:   20 * time.Millisecond,
+			Timeout: time.Second,
+			OnDrain: func(d time.Duration) { drained <- d },
+			Hooks:   hooks,
+		})
+	}()
+
+	// A request in flight when the drain begins completes.
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if d := <-drained; d != 20*time.Millisecond {
+		t.Errorf("OnDrain got %s", d)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Serve = %v", err)
+	}
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("in-flight request got %d", got)
+	}
+	if !slices.Equal(order, []string{"second", "first"}) {
+		t.Errorf("hooks ran %q, want the latest first", order)
+	}
+}
+
+func TestServeFails(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	if err := Serve(context.Background(), &http.Server{}, ln, Options{}); err == nil {
+		t.Error("Serve on a closed listener returned nil")
+	}
+}
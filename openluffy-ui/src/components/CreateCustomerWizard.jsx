@@ -1,4 +1,4 @@
-import { useState } from 'react'
+import { useState, useEffect } from 'react'
 import './CreateCustomerWizard.css'
 
 function CreateCustomerWizard({ onClose, onSuccess }) {
@@ -12,6 +12,7 @@ function CreateCustomerWizard({ onClose, onSuccess }) {
   const [customerName, setCustomerName] = useState('')
   const [stack, setStack] = useState('nodejs')
   const [customerId, setCustomerId] = useState('')
+  const [templates, setTemplates] = useState([])
   
   // Step 2: GitHub (REQUIRED)
   const [githubOrg, setGithubOrg] = useState('')
@@ -27,6 +28,16 @@ function CreateCustomerWizard({ onClose, onSuccess }) {
   const [argoCDValidated, setArgoCDValidated] = useState(false)
   const [validatingArgoCD, setValidatingArgoCD] = useState(false)
   
+  // Load the template catalog for the stack picker
+  useEffect(() => {
+    fetch('/api/templates')
+      .then(response => response.json())
+      .then(data => setTemplates(data.templates || []))
+      .catch(error => console.error('Error fetching templates:', error))
+  }, [])
+  
+  const selectedTemplate = templates.find(t => t.name === stack)
+  
   // Auto-generate customer ID from name
   const handleNameChange = (name) => {
     setCustomerName(name)
@@ -283,10 +294,13 @@ function CreateCustomerWizard({ onClose, onSuccess }) {
               <div className="form-group">
                 <label>Application Stack *</label>
                 <select value={stack} onChange={e => setStack(e.target.value)}>
-                  <option value="nodejs">Node.js</option>
-                  <option value="python">Python FastAPI</option>
-                  <option value="go">Go</option>
+                  {templates.map(t => (
+                    <option key={t.name} value={t.name}>{t.title}</option>
+                  ))}
                 </select>
+                {selectedTemplate && (
+                  <small className="field-help">{selectedTemplate.description}</small>
+                )}
               </div>
             </div>
           )}